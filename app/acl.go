@@ -0,0 +1,355 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/lexLibrary/lexLibrary/data"
+)
+
+/*
+	Access to documents and collections is controlled by access control lists (ACLs).  Each entry in a resource's
+	ACL grants or denies a permission level to a user or a group.  Permission levels are ordered, and granting a
+	level grants every level below it, so granting edit also grants read and comment.  Denying a level denies
+	every level above it, so denying edit still allows read and comment.
+
+	A document with no matching entries inherits its permissions from its collection.  The most specific entries
+	win: a document's entries are checked first, then its collection's, and on the same resource a deny always
+	beats a grant.  If nothing matches, access is denied.
+
+	Tenant administrators have every permission on every resource in their tenant.
+
+	Permission checks are done in SQL, so that the same rules that decide a single check can filter listings and
+	search results in the database.
+*/
+
+// Permission is a level of access to a resource
+type Permission int
+
+// Permission levels, each level includes all of the levels before it
+const (
+	PermissionRead Permission = iota + 1
+	PermissionComment
+	PermissionEdit
+	PermissionPublish
+	PermissionAdmin
+)
+
+func (p Permission) String() string {
+	switch p {
+	case PermissionRead:
+		return "read"
+	case PermissionComment:
+		return "comment on"
+	case PermissionEdit:
+		return "edit"
+	case PermissionPublish:
+		return "publish"
+	case PermissionAdmin:
+		return "administer"
+	default:
+		return "access"
+	}
+}
+
+func (p Permission) valid() bool {
+	return p >= PermissionRead && p <= PermissionAdmin
+}
+
+// Resource types
+const (
+	resourceTenant     = "tenant"
+	resourceCollection = "collection"
+	resourceDocument   = "document"
+)
+
+// Principal types
+const (
+	principalUser  = "user"
+	principalGroup = "group"
+)
+
+// Resource is something that access is controlled to
+type Resource interface {
+	resourceType() string
+	resourceID() string
+	resourceTenant() string
+}
+
+// Principal is someone that access can be granted to; a user or a group
+type Principal interface {
+	principalType() string
+	principalID() string
+	principalTenant() string
+}
+
+// ACLEntry is a single grant or deny in a resource's access control list
+type ACLEntry struct {
+	PrincipalType string
+	PrincipalID   string
+	Permission    Permission
+	Denied        bool
+}
+
+// sqlACLPrincipal matches ACL entries, aliased as a, that apply to the user or any of the user's groups
+const sqlACLPrincipal = `((a.principal_type = 'user' and a.principal_id = {{arg "user_id"}})
+	or (a.principal_type = 'group' and a.principal_id in (
+		select m.group_id from group_members m where m.tenant_id = a.tenant_id and m.user_id = {{arg "user_id"}})))`
+
+// sqlACLEntry matches the grants, or the denies, on a resource that cover the permission in the named arg
+func sqlACLEntry(resourceType, resourceID, permissionArg string, denied bool) string {
+	compare := ">="
+	deniedValue := "0"
+	if denied {
+		compare = "<="
+		deniedValue = "1"
+	}
+	return `exists (select 1 from acl a where a.tenant_id = {{tenant}} and a.resource_type = '` + resourceType + `'
+		and a.resource_id = ` + resourceID + ` and a.denied = ` + deniedValue + `
+		and a.permission ` + compare + ` {{arg "` + permissionArg + `"}} and ` + sqlACLPrincipal + `)`
+}
+
+// sqlCanCollection is a query condition that is true if the user has the permission on the collection, aliased as c.
+// Queries using it need the args user_id, admin, and permission
+var sqlCanCollection = `({{arg "admin"}} = 1 or (not ` + sqlACLEntry(resourceCollection, "c.id", "permission", true) +
+	` and ` + sqlACLEntry(resourceCollection, "c.id", "permission", false) + `))`
+
+// sqlCanDocument is a query condition that is true if the user has the permission on the document, aliased as d.
+// Queries using it need the args user_id, admin, and permission
+var sqlCanDocument = sqlCanDocumentArg("permission")
+
+// sqlCanEditDocument is sqlCanDocument for the permission in the arg edit_permission, so that a query can check
+// edit permission alongside another permission.  Queries using it also need the arg edit_permission
+var sqlCanEditDocument = sqlCanDocumentArg("edit_permission")
+
+// sqlCanDocumentArg is a query condition that is true if the user has the permission in the named arg on the
+// document, aliased as d
+func sqlCanDocumentArg(permissionArg string) string {
+	return `({{arg "admin"}} = 1 or (not ` + sqlACLEntry(resourceDocument, "d.id", permissionArg, true) +
+		` and (` + sqlACLEntry(resourceDocument, "d.id", permissionArg, false) +
+		` or (not ` + sqlACLEntry(resourceCollection, "d.collection_id", permissionArg, true) +
+		` and ` + sqlACLEntry(resourceCollection, "d.collection_id", permissionArg, false) + `))))`
+}
+
+var (
+	sqlCanCollectionCheck = data.NewQuery(`
+		select count(*) from collections c
+		where c.tenant_id = {{tenant}} and c.id = {{arg "id"}} and ` + sqlCanCollection)
+	sqlCanDocumentCheck = data.NewQuery(`
+		select count(*) from documents d
+		where d.tenant_id = {{tenant}} and d.id = {{arg "id"}} and ` + sqlCanDocument)
+
+	sqlACLGet = data.NewQuery(`
+		select principal_type, principal_id, permission, denied from acl
+		where tenant_id = {{tenant}} and resource_type = {{arg "resource_type"}} and resource_id = {{arg "resource_id"}}
+		order by principal_type, principal_id, denied
+	`)
+	sqlACLDelete = data.NewQuery(`
+		delete from acl
+		where tenant_id = {{tenant}} and resource_type = {{arg "resource_type"}} and resource_id = {{arg "resource_id"}}
+		and principal_type = {{arg "principal_type"}} and principal_id = {{arg "principal_id"}}
+		and denied = {{arg "denied"}}
+	`)
+	sqlACLInsert = data.NewQuery(`
+		insert into acl (tenant_id, resource_type, resource_id, principal_type, principal_id, denied, permission)
+		values ({{tenant}}, {{arg "resource_type"}}, {{arg "resource_id"}}, {{arg "principal_type"}},
+			{{arg "principal_id"}}, {{arg "denied"}}, {{arg "permission"}})
+	`)
+	sqlACLDeleteResource = data.NewQuery(`
+		delete from acl
+		where tenant_id = {{tenant}} and resource_type = {{arg "resource_type"}} and resource_id = {{arg "resource_id"}}
+	`)
+	sqlACLDeletePrincipal = data.NewQuery(`
+		delete from acl
+		where tenant_id = {{tenant}} and principal_type = {{arg "principal_type"}}
+		and principal_id = {{arg "principal_id"}}
+	`)
+)
+
+// Can returns nil if the user has the permission on the resource, and a failure if they don't.  Every action on
+// a resource should be checked with Can first
+func Can(user *User, permission Permission, resource Resource) error {
+	return can(nil, user, permission, resource)
+}
+
+func can(tx *sql.Tx, user *User, permission Permission, resource Resource) error {
+	if user == nil {
+		return Unauthorized("You must log in")
+	}
+	if !permission.valid() {
+		return NewFailure("Invalid permission")
+	}
+
+	forbidden := Forbidden(fmt.Sprintf("You don't have permission to %s this %s", permission,
+		resource.resourceType()))
+
+	if user.TenantID != resource.resourceTenant() {
+		return forbidden
+	}
+	if user.Admin {
+		return nil
+	}
+
+	var check *data.Query
+	switch resource.resourceType() {
+	case resourceCollection:
+		check = sqlCanCollectionCheck
+	case resourceDocument:
+		check = sqlCanDocumentCheck
+	default:
+		// only administrators have permissions on the tenant itself
+		return forbidden
+	}
+
+	count := 0
+	args := append(canArgs(user, permission), sql.Named("id", resource.resourceID()))
+	err := check.Tx(tx).Tenant(user.TenantID).QueryRow(args...).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return forbidden
+	}
+	return nil
+}
+
+// canAdminTenant returns nil if the user is an administrator of their tenant
+func canAdminTenant(user *User) error {
+	if user == nil {
+		return Unauthorized("You must log in")
+	}
+	return Can(user, PermissionAdmin, &Tenant{ID: user.TenantID})
+}
+
+// canAdminInstallation returns nil if the user is an administrator of the default tenant, who manages the
+// installation itself rather than a single library within it
+func canAdminInstallation(user *User) error {
+	if user == nil {
+		return Unauthorized("You must log in")
+	}
+	if user.TenantID != defaultTenantID {
+		return Forbidden("Only administrators of the default library can do this")
+	}
+	return Can(user, PermissionAdmin, &Tenant{ID: user.TenantID})
+}
+
+// canArgs returns the query args needed by sqlCanCollection and sqlCanDocument
+func canArgs(user *User, permission Permission) []sql.NamedArg {
+	return []sql.NamedArg{
+		sql.Named("user_id", user.ID),
+		sql.Named("admin", boolInt(user.Admin)),
+		sql.Named("permission", int(permission)),
+	}
+}
+
+// ACL returns the access control list of the resource
+func ACL(who *User, resource Resource) ([]ACLEntry, error) {
+	err := Can(who, PermissionAdmin, resource)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := sqlACLGet.Tenant(resource.resourceTenant()).Query(
+		sql.Named("resource_type", resource.resourceType()),
+		sql.Named("resource_id", resource.resourceID()),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []ACLEntry
+	for rows.Next() {
+		e := ACLEntry{}
+		denied := 0
+		err = rows.Scan(&e.PrincipalType, &e.PrincipalID, &e.Permission, &denied)
+		if err != nil {
+			return nil, err
+		}
+		e.Denied = denied != 0
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Grant gives the principal the permission on the resource, replacing any permission previously granted to them
+func Grant(who *User, resource Resource, principal Principal, permission Permission) error {
+	return setACL(who, resource, principal, permission, false)
+}
+
+// Deny prevents the principal from having the permission, or any higher permission, on the resource, even if
+// it's granted to them by another ACL entry.  This replaces any permission previously denied to them
+func Deny(who *User, resource Resource, principal Principal, permission Permission) error {
+	return setACL(who, resource, principal, permission, true)
+}
+
+// Revoke removes all of the principal's grants and denies from the resource
+func Revoke(who *User, resource Resource, principal Principal) error {
+	err := Can(who, PermissionAdmin, resource)
+	if err != nil {
+		return err
+	}
+	return data.BeginTx(func(tx *sql.Tx) error {
+		for _, denied := range []bool{false, true} {
+			err := deleteACL(tx, resource, principal, denied)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func setACL(who *User, resource Resource, principal Principal, permission Permission, denied bool) error {
+	if !permission.valid() {
+		return NewFailure("Invalid permission")
+	}
+	if principal.principalTenant() != resource.resourceTenant() {
+		return NotFound("The " + principal.principalType() + " was not found")
+	}
+	err := Can(who, PermissionAdmin, resource)
+	if err != nil {
+		return err
+	}
+
+	return data.BeginTx(func(tx *sql.Tx) error {
+		return insertACL(tx, resource, principal, permission, denied)
+	})
+}
+
+func insertACL(tx *sql.Tx, resource Resource, principal Principal, permission Permission, denied bool) error {
+	err := deleteACL(tx, resource, principal, denied)
+	if err != nil {
+		return err
+	}
+	_, err = sqlACLInsert.Tx(tx).Tenant(resource.resourceTenant()).Exec(
+		sql.Named("resource_type", resource.resourceType()),
+		sql.Named("resource_id", resource.resourceID()),
+		sql.Named("principal_type", principal.principalType()),
+		sql.Named("principal_id", principal.principalID()),
+		sql.Named("denied", boolInt(denied)),
+		sql.Named("permission", int(permission)),
+	)
+	return err
+}
+
+func deleteACL(tx *sql.Tx, resource Resource, principal Principal, denied bool) error {
+	_, err := sqlACLDelete.Tx(tx).Tenant(resource.resourceTenant()).Exec(
+		sql.Named("resource_type", resource.resourceType()),
+		sql.Named("resource_id", resource.resourceID()),
+		sql.Named("principal_type", principal.principalType()),
+		sql.Named("principal_id", principal.principalID()),
+		sql.Named("denied", boolInt(denied)),
+	)
+	return err
+}
+
+func (t *Tenant) resourceType() string   { return resourceTenant }
+func (t *Tenant) resourceID() string     { return t.ID }
+func (t *Tenant) resourceTenant() string { return t.ID }
+
+func (u *User) principalType() string   { return principalUser }
+func (u *User) principalID() string     { return u.ID }
+func (u *User) principalTenant() string { return u.TenantID }
@@ -0,0 +1,297 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app_test
+
+import (
+	"testing"
+
+	"github.com/lexLibrary/lexLibrary/app"
+)
+
+func TestACL(t *testing.T) {
+	resetDocuments(t)
+
+	tenant, err := app.TenantNew(installAdmin(t), "ACL Tenant", "", "")
+	if err != nil {
+		t.Fatalf("Error creating tenant: %s", err)
+	}
+	admin := testUser(t, tenant, "admin")
+	owner := testUser(t, tenant, "owner")
+	reader := testUser(t, tenant, "reader")
+	outsider := testUser(t, tenant, "outsider")
+
+	if !admin.Admin || owner.Admin {
+		t.Fatalf("Only the first user in a tenant should be an admin: %v %v", admin.Admin, owner.Admin)
+	}
+
+	var group *app.Group
+	var collection *app.Collection
+	var doc *app.Document
+
+	t.Run("Groups", func(t *testing.T) {
+		_, err := app.GroupNew(owner, "Readers")
+		if !app.IsFailType(err, app.FailForbidden) {
+			t.Fatalf("Expected forbidden creating a group as a non-admin, got %v", err)
+		}
+
+		group, err = app.GroupNew(admin, "Readers")
+		if err != nil {
+			t.Fatalf("Error creating group: %s", err)
+		}
+		err = group.AddMember(reader)
+		if err != nil {
+			t.Fatalf("Error adding group member: %s", err)
+		}
+		err = group.AddMember(reader)
+		if err != nil {
+			t.Fatalf("Error adding an existing group member: %s", err)
+		}
+
+		members, err := group.Members()
+		if err != nil {
+			t.Fatalf("Error getting group members: %s", err)
+		}
+		if len(members) != 1 || members[0].ID != reader.ID {
+			t.Fatalf("Invalid group members: %+v", members)
+		}
+	})
+
+	t.Run("Collection Inheritance", func(t *testing.T) {
+		var err error
+		collection, err = app.CollectionNew(owner, "Handbook")
+		if err != nil {
+			t.Fatalf("Error creating collection: %s", err)
+		}
+		doc, err = app.DocumentNew(owner, collection, "Policies", "<p>Be nice</p>")
+		if err != nil {
+			t.Fatalf("Error creating document: %s", err)
+		}
+
+		_, err = app.DocumentGet(reader, doc.ID)
+		if !app.IsFailType(err, app.FailNotFound) {
+			t.Fatalf("Expected not found getting a document without permission, got %v", err)
+		}
+
+		err = app.Grant(owner, collection, group, app.PermissionRead)
+		if err != nil {
+			t.Fatalf("Error granting read on collection: %s", err)
+		}
+
+		got, err := app.DocumentGet(reader, doc.ID)
+		if err != nil {
+			t.Fatalf("Error getting document with collection permission: %s", err)
+		}
+		_, err = got.Edit()
+		if !app.IsFailType(err, app.FailForbidden) {
+			t.Fatalf("Expected forbidden editing with only read permission, got %v", err)
+		}
+
+		err = app.Grant(reader, collection, reader, app.PermissionAdmin)
+		if !app.IsFailType(err, app.FailForbidden) {
+			t.Fatalf("Expected forbidden changing an ACL without admin permission, got %v", err)
+		}
+	})
+
+	t.Run("Document Override", func(t *testing.T) {
+		err := app.Deny(owner, collection, reader, app.PermissionRead)
+		if err != nil {
+			t.Fatalf("Error denying read on collection: %s", err)
+		}
+		_, err = app.DocumentGet(reader, doc.ID)
+		if !app.IsFailType(err, app.FailNotFound) {
+			t.Fatalf("Expected an explicit deny to beat a group grant, got %v", err)
+		}
+
+		err = doc.Grant(reader, app.PermissionEdit)
+		if err != nil {
+			t.Fatalf("Error granting edit on document: %s", err)
+		}
+		got, err := app.DocumentGet(reader, doc.ID)
+		if err != nil {
+			t.Fatalf("Document grant did not override collection deny: %s", err)
+		}
+		_, err = got.Edit()
+		if err != nil {
+			t.Fatalf("Error editing with document edit permission: %s", err)
+		}
+		err = got.Publish(1)
+		if !app.IsFailType(err, app.FailForbidden) {
+			t.Fatalf("Expected forbidden publishing with edit permission, got %v", err)
+		}
+
+		err = doc.Deny(reader, app.PermissionEdit)
+		if err != nil {
+			t.Fatalf("Error denying edit on document: %s", err)
+		}
+		err = app.Can(reader, app.PermissionEdit, doc)
+		if !app.IsFailType(err, app.FailForbidden) {
+			t.Fatalf("Expected a deny to beat a grant on the same document, got %v", err)
+		}
+		err = app.Can(reader, app.PermissionComment, doc)
+		if err != nil {
+			t.Fatalf("Denying edit should still allow comment: %s", err)
+		}
+
+		entries, err := doc.ACL()
+		if err != nil {
+			t.Fatalf("Error getting document ACL: %s", err)
+		}
+		if len(entries) != 3 {
+			t.Fatalf("Invalid number of ACL entries. Wanted %d got %d: %+v", 3, len(entries), entries)
+		}
+
+		err = doc.Revoke(reader)
+		if err != nil {
+			t.Fatalf("Error revoking document permissions: %s", err)
+		}
+		err = app.Revoke(owner, collection, reader)
+		if err != nil {
+			t.Fatalf("Error revoking collection permissions: %s", err)
+		}
+		_, err = app.DocumentGet(reader, doc.ID)
+		if err != nil {
+			t.Fatalf("Error getting document after revoking the deny: %s", err)
+		}
+	})
+
+	t.Run("Listing", func(t *testing.T) {
+		_, err := app.DocumentNew(owner, nil, "Private", "<p>Secret</p>")
+		if err != nil {
+			t.Fatalf("Error creating document: %s", err)
+		}
+
+		docs, err := app.DocumentList(reader, 0, 10)
+		if err != nil {
+			t.Fatalf("Error listing documents: %s", err)
+		}
+		if len(docs) != 0 {
+			t.Fatalf("Drafts were listed for a user who can only read them: %+v", docs)
+		}
+
+		got, err := app.DocumentGet(reader, doc.ID)
+		if err != nil {
+			t.Fatalf("Error getting document: %s", err)
+		}
+		_, err = got.Latest()
+		if !app.IsFailType(err, app.FailForbidden) {
+			t.Fatalf("Expected forbidden reading an unpublished revision with only read permission, got %v", err)
+		}
+
+		doc, err = app.DocumentGet(owner, doc.ID)
+		if err != nil {
+			t.Fatalf("Error getting document: %s", err)
+		}
+		err = doc.Publish(0)
+		if err != nil {
+			t.Fatalf("Error publishing document: %s", err)
+		}
+
+		docs, err = app.DocumentList(reader, 0, 10)
+		if err != nil {
+			t.Fatalf("Error listing documents: %s", err)
+		}
+		if len(docs) != 1 || docs[0].ID != doc.ID {
+			t.Fatalf("Document list was not filtered by permission: %+v", docs)
+		}
+		_, err = docs[0].Latest()
+		if err != nil {
+			t.Fatalf("Error reading the published revision: %s", err)
+		}
+
+		docs, err = collection.Documents(0, 10)
+		if err != nil {
+			t.Fatalf("Error listing collection documents: %s", err)
+		}
+		if len(docs) != 1 || docs[0].ID != doc.ID {
+			t.Fatalf("Invalid collection documents: %+v", docs)
+		}
+
+		docs, err = app.DocumentList(owner, 0, 10)
+		if err != nil {
+			t.Fatalf("Error listing documents: %s", err)
+		}
+		if len(docs) != 2 {
+			t.Fatalf("Invalid number of documents for owner. Wanted %d got %d", 2, len(docs))
+		}
+
+		collections, err := app.CollectionList(reader)
+		if err != nil {
+			t.Fatalf("Error listing collections: %s", err)
+		}
+		if len(collections) != 1 {
+			t.Fatalf("Invalid number of collections. Wanted %d got %d", 1, len(collections))
+		}
+		collections, err = app.CollectionList(outsider)
+		if err != nil {
+			t.Fatalf("Error listing collections: %s", err)
+		}
+		if len(collections) != 0 {
+			t.Fatalf("Collection list was not filtered by permission: %d", len(collections))
+		}
+		_, err = app.CollectionGet(outsider, collection.ID)
+		if !app.IsFailType(err, app.FailNotFound) {
+			t.Fatalf("Expected not found getting a collection without permission, got %v", err)
+		}
+	})
+
+	t.Run("Tenant Admin", func(t *testing.T) {
+		docs, err := app.DocumentList(admin, 0, 10)
+		if err != nil {
+			t.Fatalf("Error listing documents: %s", err)
+		}
+		if len(docs) != 2 {
+			t.Fatalf("Admin didn't see every document. Wanted %d got %d", 2, len(docs))
+		}
+		err = app.Can(admin, app.PermissionAdmin, doc)
+		if err != nil {
+			t.Fatalf("Admin didn't have admin permission: %s", err)
+		}
+
+		err = outsider.SetAdmin(owner, true)
+		if !app.IsFailType(err, app.FailForbidden) {
+			t.Fatalf("Expected forbidden when a non-admin grants admin, got %v", err)
+		}
+		err = outsider.SetAdmin(admin, true)
+		if err != nil {
+			t.Fatalf("Error making user an admin: %s", err)
+		}
+		err = app.Can(outsider, app.PermissionRead, doc)
+		if err != nil {
+			t.Fatalf("New admin couldn't read document: %s", err)
+		}
+
+		other, err := app.TenantNew(installAdmin(t), "Other ACL Tenant", "", "")
+		if err != nil {
+			t.Fatalf("Error creating tenant: %s", err)
+		}
+		otherAdmin := testUser(t, other, "admin")
+		err = app.Can(otherAdmin, app.PermissionRead, doc)
+		if !app.IsFailType(err, app.FailForbidden) {
+			t.Fatalf("Admin of another tenant could read document: %v", err)
+		}
+	})
+
+	t.Run("Delete Group", func(t *testing.T) {
+		err := app.Grant(owner, doc, group, app.PermissionRead)
+		if err != nil {
+			t.Fatalf("Error granting read to group: %s", err)
+		}
+		err = group.Delete()
+		if err != nil {
+			t.Fatalf("Error deleting group: %s", err)
+		}
+		entries, err := doc.ACL()
+		if err != nil {
+			t.Fatalf("Error getting document ACL: %s", err)
+		}
+		for _, e := range entries {
+			if e.PrincipalID == group.ID {
+				t.Fatalf("Group ACL entry remained after deleting the group")
+			}
+		}
+		err = collection.Delete()
+		if err == nil {
+			t.Fatalf("Deleted a collection that wasn't empty")
+		}
+	})
+}
@@ -4,4 +4,20 @@
 // No web structures or packages (http, cookies, etc) should show up in this package
 package app
 
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
 const maxRows = 10000
+
+// newID returns a new random id for an application record
+func newID() string {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		panic(fmt.Sprintf("Error generating random id: %s", err))
+	}
+	return hex.EncodeToString(id)
+}
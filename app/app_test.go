@@ -14,6 +14,7 @@ import (
 )
 
 var flagConfigFile string
+var flagUpdate bool
 
 const defaultConfigFile = "./config.yaml"
 
@@ -25,6 +26,7 @@ func TestMain(m *testing.M) {
 		log.Fatal("LLTEST environment variable is not set to 'true'.  Make sure you are not running the tests in a real environment")
 	}
 	flag.StringVar(&flagConfigFile, "config", "./config.yaml", "Sets the path to the configuration file. Either a .YAML, .JSON, or .TOML file")
+	flag.BoolVar(&flagUpdate, "update", false, "Updates the golden files in testdata with the current output of the tests that use them")
 
 	flag.Parse()
 	cfg := struct {
@@ -47,6 +49,7 @@ func TestMain(m *testing.M) {
 				DatabaseURL:        "file::memory:?mode=memory&cache=shared",
 				MaxIdleConnections: 1,
 				MaxOpenConnections: 1,
+				BlobStorage:        "database",
 			}
 		} else {
 			log.Fatal(err)
@@ -0,0 +1,1380 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"bytes"
+	"html"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/*
+	AsciiDoc is converted to HTML the way Asciidoctor converts it.  The text is first preprocessed for conditional
+	sections, then split into blocks: sections, paragraphs, lists, and the delimited blocks for listings, examples,
+	quotes, tables and the like.  A block's style, id and options come from the attribute line above it, so a
+	listing styled as source is a code block in its language, and an example styled as a note is an admonition.
+	The text of each block is converted for inline formatting, links and cross references after the document's
+	attributes are substituted into it.
+
+	Cross references can point at sections and anchors anywhere in the document, so they're written as
+	placeholders and resolved once the whole text is converted.  Files included with include:: and references to
+	other documents aren't part of the import, so they're left out and reported, as are block macros without an
+	equivalent in a document.
+*/
+
+// asciidocAdmonitions are the labels of the admonitions, by style
+var asciidocAdmonitions = map[string]string{
+	"NOTE":      "Note",
+	"TIP":       "Tip",
+	"IMPORTANT": "Important",
+	"WARNING":   "Warning",
+	"CAUTION":   "Caution",
+}
+
+// asciidocCharacters are the values of the attributes every document has, for characters that are hard to type or
+// would otherwise be markup
+var asciidocCharacters = map[string]string{
+	"empty": "", "blank": "", "sp": " ", "nbsp": " ", "zwsp": "​", "wj": "⁠", "apos": "'",
+	"quot": `"`, "lsquo": "‘", "rsquo": "’", "ldquo": "“", "rdquo": "”", "deg": "°", "plus": "+", "brvbar": "¦",
+	"vbar": "|", "amp": "&", "lt": "<", "gt": ">", "startsb": "[", "endsb": "]", "caret": "^", "asterisk": "*",
+	"tilde": "~", "backslash": `\`, "backtick": "`", "two-colons": "::", "two-semicolons": ";;", "cpp": "C++",
+}
+
+// asciidocReplacements are the typographic replacements made in text
+var asciidocReplacements = strings.NewReplacer("(C)", "©", "(R)", "®", "(TM)", "™", " -- ", " — ")
+
+var (
+	reAdocSection     = regexp.MustCompile(`^(={1,6}|#{1,6}) +(\S.*?)(?: +=+)?$`)
+	reAdocAttribute   = regexp.MustCompile(`^:(!?[A-Za-z0-9_][-A-Za-z0-9_]*!?):(?:[ \t]+(.*))?$`)
+	reAdocBlockAttrs  = regexp.MustCompile(`^\[(\[[^\[\]]+\]|[^\[\]]*)\]$`)
+	reAdocBlockTitle  = regexp.MustCompile(`^\.([^\s.].*)$`)
+	reAdocDelimiter   = regexp.MustCompile("^(-{4,}|\\.{4,}|={4,}|\\*{4,}|_{4,}|\\+{4,}|/{4,}|--|[|,:!]={3,}|```.*)$")
+	reAdocBlockMacro  = regexp.MustCompile(`^([a-z][-a-z0-9_]*)::(\S*?)\[(.*)\]$`)
+	reAdocUnordered   = regexp.MustCompile(`^[ \t]*(\*{1,5}|-)[ \t]+(.*)$`)
+	reAdocOrdered     = regexp.MustCompile(`^[ \t]*(\.{1,5}|\d+\.)[ \t]+(.*)$`)
+	reAdocDescription = regexp.MustCompile(`^[ \t]*(\S.*?)(:{2,4}|;;)(?:[ \t]+(.*))?$`)
+	reAdocAdmonition  = regexp.MustCompile(`^(NOTE|TIP|IMPORTANT|WARNING|CAUTION):[ \t]+`)
+	reAdocRevision    = regexp.MustCompile(`^v?([0-9][^,:]*)?(?:,? *([^:]+))?(?:: *(.*))?$`)
+	reAdocChecklist   = regexp.MustCompile(`^\[([ xX*])\][ \t]+`)
+	reAdocConditional = regexp.MustCompile(`^(ifdef|ifndef|endif)::([^\[]*)\[(.*)\]$`)
+	reAdocInclude     = regexp.MustCompile(`^include::([^\[]+)\[.*\]$`)
+	reAdocAttrRef     = regexp.MustCompile(`(\\?)\{([A-Za-z0-9_][-A-Za-z0-9_]*)\}`)
+	reAdocPassthrough = regexp.MustCompile(`\+\+\+(.+?)\+\+\+|pass:[a-z,]*\[(.*?)\]|\+\+(.+?)\+\+|` +
+		`(^|[^\w+])\+([^\s+](?:[^+\n]*[^\s+])?)\+`)
+	reAdocMonospace = regexp.MustCompile("``(.+?)``|(^|[^\\w`])`([^\\s`](?:[^`\\n]*[^\\s`])?)`")
+	reAdocEscape    = regexp.MustCompile("\\\\([*_#^~`+\\[{<]|&lt;&lt;|&lt;)")
+	reAdocMacro     = regexp.MustCompile(
+		`(?:footnote|footnoteref|image|link|mailto|xref|kbd|btn|menu|anchor):[^\s\[]*\[(?:[^\]\\]|\\.)*\]|` +
+			`&lt;&lt;.+?&gt;&gt;|\[\[[A-Za-z_][-\w.:]*(?:, *[^\]]+)?\]\]|` +
+			`(?:https?|ftp|irc)://[^\s\[\]<>"]+(?:\[(?:[^\]\\]|\\.)*\])?`)
+	reAdocMacroParts  = regexp.MustCompile(`^([a-z]+):([^\s\[]*)\[((?:[^\]\\]|\\.)*)\]$`)
+	reAdocRole        = regexp.MustCompile(`\[[.#][^\]\s]*\]#`)
+	reAdocLineBreak   = regexp.MustCompile(` \+(\n|$)`)
+	reAdocXref        = regexp.MustCompile("\x00([^\x00]*)\x00([^\x00]*)\x00")
+	reAdocPlaceholder = regexp.MustCompile("\x7f([0-9]+)\x7f")
+	reAdocCalloutMark = regexp.MustCompile(`[ \t]*(?://|#|--|;;)?[ \t]*<(\d+|\.)>[ \t]*$`)
+	reAdocCalloutItem = regexp.MustCompile(`^<(\d+|\.)>[ \t]+(.*)$`)
+	reAdocShorthand   = regexp.MustCompile(`[#.%]`)
+	reAdocCellSpec    = regexp.MustCompile(`[ \t\n](` + asciidocCellSpec + `)$`)
+	reAdocFirstSpec   = regexp.MustCompile(`^[ \t\n]*(` + asciidocCellSpec + `)$`)
+)
+
+// asciidocCellSpec matches the specifier of a table cell, before its separator, like 2+ or a
+const asciidocCellSpec = `(?:\d+\*)?(?:\d*(?:\.\d+)?\+)?(?:[<^>](?:\.[<^>])?)?[adehlmsv]?`
+
+// asciidocAttrs are the attributes of a block, from the line above it
+type asciidocAttrs struct {
+	style      string
+	id         string
+	title      string
+	options    map[string]bool
+	positional []string
+	named      map[string]string
+}
+
+// asciidocConverter converts AsciiDoc to HTML
+type asciidocConverter struct {
+	// the unknown block macros, included files, references to other documents and references without targets
+	// found in the text
+	unknown   []string
+	includes  []string
+	documents []string
+	missing   []string
+
+	attributes   map[string]string
+	ids          map[string]bool
+	titles       map[string]string // the HTML of the titles of sections and blocks, by id
+	sections     map[string]string // the ids of the sections, by title
+	placeholders []string
+	footnotes    []string
+	footnoteIDs  map[string]int
+	pending      *asciidocAttrs
+}
+
+func newAsciiDocConverter() *asciidocConverter {
+	return &asciidocConverter{
+		attributes:  make(map[string]string),
+		ids:         make(map[string]bool),
+		titles:      make(map[string]string),
+		sections:    make(map[string]string),
+		footnoteIDs: make(map[string]int),
+	}
+}
+
+// convert converts the AsciiDoc to HTML
+func (a *asciidocConverter) convert(text string) string {
+	// the placeholder and role markers can't be in the text itself
+	text = strings.NewReplacer("\x00", "", "\x01", "", "\x7f", "", "\r\n", "\n").Replace(text)
+	lines := strings.Split(text, "\n")
+	for l := range lines {
+		lines[l] = strings.TrimRightFunc(rstExpandTabs(lines[l]), unicode.IsSpace)
+	}
+
+	body := a.blocks(a.header(a.preprocess(lines)))
+	if len(a.footnotes) > 0 {
+		body += "<hr />\n<ol>\n"
+		for n, footnote := range a.footnotes {
+			body += `<li id="_footnotedef_` + strconv.Itoa(n+1) + `">` + footnote + "</li>\n"
+		}
+		body += "</ol>\n"
+	}
+	body = a.restore(body)
+
+	return reAdocXref.ReplaceAllStringFunc(body, func(ref string) string {
+		m := reAdocXref.FindStringSubmatch(ref)
+		id, text := m[1], m[2]
+		if !a.ids[id] {
+			if section, ok := a.sections[strings.ToLower(id)]; ok {
+				id = section
+			}
+		}
+		if text == "" {
+			text = a.restore(a.titles[id])
+			if text == "" {
+				text = "[" + escapeHTML(id) + "]"
+			}
+		}
+		if !a.ids[id] {
+			a.missing = append(a.missing, m[1])
+			return text
+		}
+		return `<a href="#` + escapeHTML(id) + `">` + text + "</a>"
+	})
+}
+
+// preprocess removes the lines excluded by conditionals, and the include directives
+func (a *asciidocConverter) preprocess(lines []string) []string {
+	attributes := make(map[string]bool)
+	var kept []string
+	var skipping []bool
+	skipped := func() bool {
+		for _, s := range skipping {
+			if s {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, line := range lines {
+		if m := reAdocConditional.FindStringSubmatch(line); m != nil {
+			if m[1] == "endif" {
+				if len(skipping) > 0 {
+					skipping = skipping[:len(skipping)-1]
+				}
+				continue
+			}
+			defined := false
+			for _, name := range strings.FieldsFunc(m[2], func(c rune) bool { return c == ',' || c == '+' }) {
+				if attributes[name] {
+					defined = true
+				}
+			}
+			if m[1] == "ifndef" {
+				defined = !defined
+			}
+			if m[3] != "" {
+				// a single line conditional
+				if defined && !skipped() {
+					kept = append(kept, m[3])
+				}
+				continue
+			}
+			skipping = append(skipping, !defined)
+			continue
+		}
+		if skipped() {
+			continue
+		}
+		if m := reAdocInclude.FindStringSubmatch(line); m != nil {
+			a.includes = append(a.includes, m[1])
+			continue
+		}
+		if m := reAdocAttribute.FindStringSubmatch(line); m != nil {
+			name := strings.Trim(m[1], "!")
+			attributes[name] = !strings.Contains(m[1], "!")
+		}
+		kept = append(kept, line)
+	}
+	return kept
+}
+
+// header reads the document's title, author and revision lines and attributes, and returns the lines after them.
+// The title is kept as the first heading of the body
+func (a *asciidocConverter) header(lines []string) []string {
+	l := 0
+	for l < len(lines) && (lines[l] == "" || strings.HasPrefix(lines[l], "//")) {
+		l++
+	}
+	if l == len(lines) || !strings.HasPrefix(lines[l], "= ") {
+		return lines
+	}
+	title := l
+	l++
+	// the author and revision lines
+	for n := 0; n < 2 && l < len(lines) && lines[l] != "" && !strings.HasPrefix(lines[l], ":") &&
+		!strings.HasPrefix(lines[l], "//"); n++ {
+		if n == 0 {
+			a.attributes["author"] = strings.TrimSpace(strings.Split(lines[l], "<")[0])
+		} else if m := reAdocRevision.FindStringSubmatch(lines[l]); m != nil {
+			a.attributes["revnumber"] = strings.TrimSpace(m[1])
+			a.attributes["revdate"] = strings.TrimSpace(m[2])
+			a.attributes["revremark"] = strings.TrimSpace(m[3])
+		}
+		l++
+	}
+	return append([]string{lines[title]}, lines[l:]...)
+}
+
+// attribute sets or unsets the document attribute
+func (a *asciidocConverter) attribute(name, value string) {
+	if strings.HasPrefix(name, "!") || strings.HasSuffix(name, "!") {
+		delete(a.attributes, strings.Trim(name, "!"))
+		return
+	}
+	a.attributes[name] = a.substitute(value)
+}
+
+// value returns the text of the document attribute
+func (a *asciidocConverter) value(name string) string {
+	return a.verbatim(a.attributes[name])
+}
+
+// verbatim returns the text with attributes substituted into it as text.  The values of the character attributes
+// are set aside as HTML
+func (a *asciidocConverter) verbatim(text string) string {
+	return reAdocPlaceholder.ReplaceAllStringFunc(text, func(marker string) string {
+		return html.UnescapeString(a.restore(marker))
+	})
+}
+
+// substitute replaces the references to attributes in the text with their values.  References to attributes that
+// aren't defined are left as they are
+func (a *asciidocConverter) substitute(text string) string {
+	if !strings.Contains(text, "{") {
+		return text
+	}
+	return reAdocAttrRef.ReplaceAllStringFunc(text, func(ref string) string {
+		m := reAdocAttrRef.FindStringSubmatch(ref)
+		if m[1] != "" {
+			return ref[1:]
+		}
+		if value, ok := a.attributes[m[2]]; ok {
+			return value
+		}
+		if value, ok := asciidocCharacters[m[2]]; ok {
+			// characters are never markup
+			return a.placeholder(escapeHTML(value))
+		}
+		return ref
+	})
+}
+
+// placeholder sets aside converted HTML, and returns the placeholder that stands in for it in the text
+func (a *asciidocConverter) placeholder(converted string) string {
+	a.placeholders = append(a.placeholders, converted)
+	return "\x7f" + strconv.Itoa(len(a.placeholders)-1) + "\x7f"
+}
+
+// restore replaces the placeholders with their converted HTML.  Set aside HTML can contain placeholders too
+func (a *asciidocConverter) restore(text string) string {
+	for strings.Contains(text, "\x7f") {
+		text = reAdocPlaceholder.ReplaceAllStringFunc(text, func(marker string) string {
+			n, _ := strconv.Atoi(reAdocPlaceholder.FindStringSubmatch(marker)[1])
+			return a.placeholders[n]
+		})
+	}
+	return text
+}
+
+// asciidocID returns the id Asciidoctor gives a section with the title
+func asciidocID(title string) string {
+	buf := &bytes.Buffer{}
+	buf.WriteByte('_')
+	for _, c := range strings.ToLower(title) {
+		switch {
+		case unicode.IsLetter(c) || unicode.IsDigit(c):
+			buf.WriteRune(c)
+		case c == ' ' || c == '-' || c == '.' || c == '_':
+			if !bytes.HasSuffix(buf.Bytes(), []byte("_")) {
+				buf.WriteByte('_')
+			}
+		}
+	}
+	id := strings.TrimRight(buf.String(), "_")
+	if id == "" {
+		id = "_section"
+	}
+	return id
+}
+
+// uniqueID returns the id, or the id with a number if it's already used
+func (a *asciidocConverter) uniqueID(base string) string {
+	id := base
+	for n := 2; a.ids[id]; n++ {
+		id = base + "_" + strconv.Itoa(n)
+	}
+	a.ids[id] = true
+	return id
+}
+
+// xref returns the placeholder for a cross reference to the id, which is replaced with the link once the whole text
+// is converted.  If the text is empty, the link's text is the title of the section or block with the id
+func (a *asciidocConverter) xref(target, text string) string {
+	target = strings.TrimSpace(target)
+	if hash := strings.Index(target, "#"); hash != -1 || strings.HasSuffix(target, ".adoc") {
+		document := target
+		if hash != -1 {
+			document = target[:hash]
+		}
+		if document != "" {
+			a.documents = append(a.documents, document)
+			if text == "" {
+				text = escapeHTML(target)
+			}
+			return text
+		}
+		target = target[hash+1:]
+	}
+	return "\x00" + target + "\x00" + text + "\x00"
+}
+
+// parseAttrs parses the attribute list of a block, like [source,go] or [#id.role%option,name=value]
+func parseAttrs(list string) *asciidocAttrs {
+	attrs := &asciidocAttrs{
+		options: make(map[string]bool),
+		named:   make(map[string]string),
+	}
+	if strings.HasPrefix(list, "[") && strings.HasSuffix(list, "]") {
+		// an anchor, [[id]] or [[id,reference text]]
+		parts := strings.SplitN(list[1:len(list)-1], ",", 2)
+		attrs.id = strings.TrimSpace(parts[0])
+		if len(parts) == 2 {
+			attrs.named["reftext"] = strings.TrimSpace(parts[1])
+		}
+		return attrs
+	}
+
+	var values []string
+	quoted := false
+	start := 0
+	for c := 0; c <= len(list); c++ {
+		if c < len(list) && list[c] == '"' {
+			quoted = !quoted
+		}
+		if c == len(list) || (list[c] == ',' && !quoted) {
+			values = append(values, strings.TrimSpace(list[start:c]))
+			start = c + 1
+		}
+	}
+
+	for v, value := range values {
+		if eq := strings.Index(value, "="); eq > 0 && !strings.ContainsAny(value[:eq], " \"") {
+			name := strings.TrimSpace(value[:eq])
+			value = strings.Trim(strings.TrimSpace(value[eq+1:]), `"'`)
+			attrs.named[name] = value
+			switch name {
+			case "id":
+				attrs.id = value
+			case "options", "opts":
+				for _, option := range strings.Split(value, ",") {
+					attrs.options[strings.TrimSpace(option)] = true
+				}
+			}
+			continue
+		}
+		value = strings.Trim(value, `"`)
+		if v == 0 {
+			// the style, with shorthands for the id, roles and options
+			marks := reAdocShorthand.FindAllStringIndex(value, -1)
+			end := len(value)
+			if len(marks) > 0 {
+				end = marks[0][0]
+			}
+			attrs.style = value[:end]
+			for m, mark := range marks {
+				next := len(value)
+				if m+1 < len(marks) {
+					next = marks[m+1][0]
+				}
+				part := value[mark[1]:next]
+				switch value[mark[0]] {
+				case '#':
+					attrs.id = part
+				case '%':
+					attrs.options[part] = true
+				}
+			}
+		}
+		attrs.positional = append(attrs.positional, value)
+	}
+	return attrs
+}
+
+// takeAttrs returns the attributes for the next block, and clears them
+func (a *asciidocConverter) takeAttrs() *asciidocAttrs {
+	attrs := a.pending
+	a.pending = nil
+	if attrs == nil {
+		attrs = parseAttrs("")
+	}
+	return attrs
+}
+
+// anchor returns the anchor for the block with the attributes, if it has an id
+func (a *asciidocConverter) anchor(attrs *asciidocAttrs) string {
+	if attrs.id == "" {
+		return ""
+	}
+	id := a.uniqueID(attrs.id)
+	if text := attrs.named["reftext"]; text != "" {
+		a.titles[id] = a.inline(text)
+	} else if attrs.title != "" {
+		a.titles[id] = a.inline(attrs.title)
+	}
+	return `<a name="` + escapeHTML(id) + `"></a>`
+}
+
+// title returns the title of the block with the attributes, as a paragraph
+func (a *asciidocConverter) title(attrs *asciidocAttrs) string {
+	if attrs.title == "" {
+		return ""
+	}
+	return "<p><strong>" + a.inline(attrs.title) + "</strong></p>\n"
+}
+
+// blocks converts the lines into blocks
+func (a *asciidocConverter) blocks(lines []string) string {
+	buf := &bytes.Buffer{}
+	for l := 0; l < len(lines); {
+		line := lines[l]
+		switch {
+		case line == "":
+			l++
+		case strings.HasPrefix(line, "//") && !strings.HasPrefix(line, "////"):
+			l++
+		case reAdocAttribute.MatchString(line):
+			m := reAdocAttribute.FindStringSubmatch(line)
+			a.attribute(m[1], m[2])
+			l++
+		case reAdocBlockAttrs.MatchString(line):
+			attrs := parseAttrs(line[1 : len(line)-1])
+			if a.pending != nil {
+				// the lines add to each other
+				if attrs.id == "" {
+					attrs.id = a.pending.id
+				}
+				if attrs.title == "" {
+					attrs.title = a.pending.title
+				}
+				if attrs.style == "" && len(attrs.positional) == 0 {
+					attrs.style = a.pending.style
+					attrs.positional = a.pending.positional
+				}
+				for name, value := range a.pending.named {
+					if _, ok := attrs.named[name]; !ok {
+						attrs.named[name] = value
+					}
+				}
+				for option := range a.pending.options {
+					attrs.options[option] = true
+				}
+			}
+			a.pending = attrs
+			l++
+		case reAdocBlockTitle.MatchString(line):
+			if a.pending == nil {
+				a.pending = parseAttrs("")
+			}
+			a.pending.title = line[1:]
+			l++
+		case reAdocSection.MatchString(line):
+			a.section(buf, line)
+			l++
+		case reAdocDelimiter.MatchString(line):
+			l = a.delimited(buf, lines, l)
+		case reAdocBlockMacro.MatchString(line):
+			a.blockMacro(buf, line)
+			l++
+		case line == "'''" || line == "---" || line == "- - -" || line == "***" || line == "* * *":
+			buf.WriteString(a.anchor(a.takeAttrs()) + "<hr />\n")
+			l++
+		case line == "<<<":
+			a.takeAttrs()
+			l++
+		case reAdocUnordered.MatchString(line) || reAdocOrdered.MatchString(line):
+			l = a.list(buf, lines, l, nil)
+		case reAdocDescription.MatchString(line) && !strings.HasPrefix(line, " "):
+			l = a.descriptionList(buf, lines, l)
+		case reAdocCalloutItem.MatchString(line):
+			l = a.callouts(buf, lines, l)
+		default:
+			l = a.paragraph(buf, lines, l)
+		}
+	}
+	return buf.String()
+}
+
+// section writes a section title
+func (a *asciidocConverter) section(buf *bytes.Buffer, line string) {
+	m := reAdocSection.FindStringSubmatch(line)
+	attrs := a.takeAttrs()
+	level := len(m[1])
+	content := a.inline(m[2])
+	text := htmlToText(a.restore(content))
+
+	id := attrs.id
+	if id == "" {
+		id = asciidocID(text)
+	}
+	id = a.uniqueID(id)
+	a.titles[id] = reAdocXref.ReplaceAllString(content, "$2")
+	if _, ok := a.sections[strings.ToLower(text)]; !ok {
+		a.sections[strings.ToLower(text)] = id
+	}
+
+	h := "h" + strconv.Itoa(level)
+	buf.WriteString("<" + h + ` id="` + escapeHTML(id) + `">` + content + "</" + h + ">\n")
+}
+
+// isBlockStart returns whether the line starts a new block, ending the paragraph or list item before it
+func isBlockStart(line string) bool {
+	return line == "" || line == "+" || reAdocBlockAttrs.MatchString(line) || reAdocDelimiter.MatchString(line) ||
+		reAdocUnordered.MatchString(line) || reAdocOrdered.MatchString(line) ||
+		(strings.HasPrefix(line, "//") && !strings.HasPrefix(line, "///")) || reAdocBlockMacro.MatchString(line) ||
+		reAdocSection.MatchString(line) && strings.HasPrefix(line, "=")
+}
+
+// paragraph writes the paragraph starting at start, and returns the index of the line after it
+func (a *asciidocConverter) paragraph(buf *bytes.Buffer, lines []string, start int) int {
+	attrs := a.takeAttrs()
+	end := start + 1
+	for end < len(lines) && !isBlockStart(lines[end]) {
+		end++
+	}
+	paragraph := lines[start:end]
+	buf.WriteString(a.anchor(attrs))
+
+	if indentation(paragraph[0]) > 0 && attrs.style == "" {
+		buf.WriteString(a.title(attrs) + "<pre>" + escapeHTML(strings.Join(dedent(paragraph), "\n")) + "</pre>\n")
+		return end
+	}
+
+	text := strings.Join(paragraph, "\n")
+	style := attrs.style
+	if m := reAdocAdmonition.FindStringSubmatch(text); m != nil && style == "" {
+		style = m[1]
+		text = text[len(m[0]):]
+	}
+	if label, ok := asciidocAdmonitions[style]; ok {
+		buf.WriteString("<blockquote>\n<p><strong>" + escapeHTML(label) + "</strong></p>\n" + a.title(attrs) +
+			"<p>" + a.inline(strings.TrimSpace(text)) + "</p>\n</blockquote>\n")
+		return end
+	}
+
+	switch style {
+	case "source", "listing":
+		a.code(buf, attrs, paragraph)
+	case "literal":
+		buf.WriteString(a.title(attrs) + "<pre>" + escapeHTML(strings.Join(dedent(paragraph), "\n")) + "</pre>\n")
+	case "quote", "verse":
+		a.quote(buf, attrs, "<p>"+a.inline(text)+"</p>\n")
+	case "pass":
+		buf.WriteString(a.substitute(text) + "\n")
+	default:
+		buf.WriteString(a.title(attrs) + "<p>" + a.inline(text) + "</p>\n")
+	}
+	return end
+}
+
+// code writes a code block, in the language of the source style's second attribute or the document's default
+func (a *asciidocConverter) code(buf *bytes.Buffer, attrs *asciidocAttrs, lines []string) {
+	language := ""
+	if attrs.style == "source" || (attrs.style == "" && len(attrs.positional) > 1) {
+		language = a.attributes["source-language"]
+		if len(attrs.positional) > 1 && attrs.positional[1] != "" {
+			language = attrs.positional[1]
+		}
+		if lang := attrs.named["language"]; lang != "" {
+			language = lang
+		}
+	}
+
+	code := make([]string, len(lines))
+	for l, line := range lines {
+		// callouts are marked in the code by numbers, explained in the list after it
+		code[l] = reAdocCalloutMark.ReplaceAllString(line, "")
+	}
+	buf.WriteString(a.title(attrs) + "<pre><code")
+	if language != "" {
+		buf.WriteString(` class="language-` + escapeHTML(strings.ToLower(language)) + `"`)
+	}
+	buf.WriteString(">" + escapeHTML(a.substituteIf(attrs, strings.Join(code, "\n"))) + "</code></pre>\n")
+}
+
+// substituteIf substitutes attributes into the text of a verbatim block, if its subs include attributes
+func (a *asciidocConverter) substituteIf(attrs *asciidocAttrs, text string) string {
+	if !strings.Contains(attrs.named["subs"], "attributes") {
+		return text
+	}
+	return a.verbatim(a.substitute(text))
+}
+
+// quote writes a quote block with its attribution
+func (a *asciidocConverter) quote(buf *bytes.Buffer, attrs *asciidocAttrs, content string) {
+	buf.WriteString("<blockquote>\n" + a.title(attrs) + content)
+	var attribution []string
+	for _, p := range attrs.positional[1:minInt(len(attrs.positional), 3)] {
+		if p != "" {
+			attribution = append(attribution, a.inline(p))
+		}
+	}
+	if len(attribution) > 0 {
+		buf.WriteString("<p>— " + strings.Join(attribution, ", ") + "</p>\n")
+	}
+	buf.WriteString("</blockquote>\n")
+}
+
+// delimited writes the delimited block starting at start, and returns the index of the line after it
+func (a *asciidocConverter) delimited(buf *bytes.Buffer, lines []string, start int) int {
+	delimiter := lines[start]
+	attrs := a.takeAttrs()
+	closing := delimiter
+	if strings.HasPrefix(delimiter, "```") {
+		closing = "```"
+		if language := strings.TrimSpace(delimiter[3:]); language != "" {
+			attrs.style = "source"
+			attrs.positional = []string{"source", language}
+		}
+	}
+
+	end := start + 1
+	for end < len(lines) && lines[end] != closing {
+		end++
+	}
+	content := lines[start+1 : end]
+	if end < len(lines) {
+		end++
+	}
+	if strings.HasPrefix(delimiter, "////") {
+		return end
+	}
+	buf.WriteString(a.anchor(attrs))
+
+	if label, ok := asciidocAdmonitions[attrs.style]; ok {
+		buf.WriteString("<blockquote>\n<p><strong>" + escapeHTML(label) + "</strong></p>\n" + a.title(attrs) +
+			a.blocks(content) + "</blockquote>\n")
+		return end
+	}
+
+	switch delimiter[0] {
+	case '-':
+		if delimiter == "--" {
+			a.openBlock(buf, attrs, content)
+			break
+		}
+		if attrs.style == "" {
+			attrs.style = "listing"
+		}
+		a.code(buf, attrs, content)
+	case '`':
+		a.code(buf, attrs, content)
+	case '.':
+		if attrs.style == "source" {
+			a.code(buf, attrs, content)
+			break
+		}
+		buf.WriteString(a.title(attrs) + "<pre>" + escapeHTML(a.substituteIf(attrs, strings.Join(content, "\n"))) +
+			"</pre>\n")
+	case '=':
+		if attrs.options["collapsible"] {
+			title := attrs.title
+			if title == "" {
+				title = "Details"
+			}
+			open := ""
+			if attrs.options["open"] {
+				open = ` open=""`
+			}
+			buf.WriteString("<details" + open + ">\n<summary>" + a.inline(title) + "</summary>\n" + a.blocks(content) +
+				"</details>\n")
+			break
+		}
+		buf.WriteString("<blockquote>\n" + a.title(attrs) + a.blocks(content) + "</blockquote>\n")
+	case '*':
+		buf.WriteString("<blockquote>\n" + a.title(attrs) + a.blocks(content) + "</blockquote>\n")
+	case '_':
+		if attrs.style == "verse" {
+			a.quote(buf, attrs, "<p>"+strings.Replace(a.inline(strings.Join(content, "\n")), "\n", "<br />\n", -1)+
+				"</p>\n")
+			break
+		}
+		a.quote(buf, attrs, a.blocks(content))
+	case '+':
+		buf.WriteString(a.substitute(strings.Join(content, "\n")) + "\n")
+	case '|', ',', ':', '!':
+		a.table(buf, attrs, delimiter[0], content)
+	}
+	return end
+}
+
+// openBlock writes an open block, which takes on the style it's given
+func (a *asciidocConverter) openBlock(buf *bytes.Buffer, attrs *asciidocAttrs, content []string) {
+	switch attrs.style {
+	case "source", "listing":
+		a.code(buf, attrs, content)
+	case "literal":
+		buf.WriteString(a.title(attrs) + "<pre>" + escapeHTML(strings.Join(content, "\n")) + "</pre>\n")
+	case "quote", "verse":
+		a.quote(buf, attrs, a.blocks(content))
+	case "pass":
+		buf.WriteString(a.substitute(strings.Join(content, "\n")) + "\n")
+	case "comment":
+	case "example", "sidebar", "abstract", "partintro":
+		buf.WriteString("<blockquote>\n" + a.title(attrs) + a.blocks(content) + "</blockquote>\n")
+	default:
+		buf.WriteString(a.title(attrs) + a.blocks(content))
+	}
+}
+
+// blockMacro writes a block macro, like image::logo.png[Logo]
+func (a *asciidocConverter) blockMacro(buf *bytes.Buffer, line string) {
+	m := reAdocBlockMacro.FindStringSubmatch(line)
+	name, target := m[1], a.substitute(m[2])
+	attrs := a.takeAttrs()
+	macroAttrs := parseAttrs(m[3])
+
+	switch name {
+	case "image":
+		image := a.image(target, macroAttrs)
+		if attrs.title != "" {
+			buf.WriteString(a.anchor(attrs) + "<figure>\n" + image + "\n<figcaption>" + a.inline(attrs.title) +
+				"</figcaption>\n</figure>\n")
+			return
+		}
+		buf.WriteString(a.anchor(attrs) + "<p>" + image + "</p>\n")
+	case "video", "audio":
+		element := name
+		buf.WriteString(a.anchor(attrs) + "<" + element + ` src="` + escapeHTML(a.imagePath(target)) +
+			`" controls=""></` + element + ">\n")
+	case "toc":
+		// generated from the rest of the document
+	case "include":
+		a.includes = append(a.includes, target)
+	default:
+		a.unknown = append(a.unknown, name)
+	}
+}
+
+// imagePath returns the path of the image at the target, relative to the images directory
+func (a *asciidocConverter) imagePath(target string) string {
+	dir := a.attributes["imagesdir"]
+	if dir == "" || strings.Contains(target, "://") || strings.HasPrefix(target, "/") ||
+		strings.HasPrefix(target, "data:") {
+		return target
+	}
+	return strings.TrimSuffix(dir, "/") + "/" + target
+}
+
+// image returns the image element for the target with the macro's attributes, alt text, width and height
+func (a *asciidocConverter) image(target string, attrs *asciidocAttrs) string {
+	alt := attrs.style
+	if value, ok := attrs.named["alt"]; ok {
+		alt = value
+	}
+	if alt == "" {
+		alt = strings.Replace(strings.TrimSuffix(path.Base(target), path.Ext(target)), "-", " ", -1)
+	}
+	image := `<img src="` + escapeHTML(a.imagePath(target)) + `" alt="` + escapeHTML(htmlToText(a.inline(alt))) + `"`
+	for p, size := range []string{"width", "height"} {
+		value := attrs.named[size]
+		if value == "" && len(attrs.positional) > p+1 {
+			value = attrs.positional[p+1]
+		}
+		if value != "" {
+			image += " " + size + `="` + escapeHTML(value) + `"`
+		}
+	}
+	image += " />"
+	if link := attrs.named["link"]; link != "" {
+		return `<a href="` + escapeHTML(link) + `">` + image + "</a>"
+	}
+	return image
+}
+
+// listMarker returns the marker of the list item on the line, with ordered list numbers as dots, and its text
+func listMarker(line string) (marker, text string) {
+	if m := reAdocUnordered.FindStringSubmatch(line); m != nil {
+		return m[1], m[2]
+	}
+	if m := reAdocOrdered.FindStringSubmatch(line); m != nil {
+		if m[1][0] != '.' {
+			return ".", m[2]
+		}
+		return m[1], m[2]
+	}
+	return "", ""
+}
+
+// list writes the list starting at start, and returns the index of the line after it.  Parents are the markers of
+// the lists it's nested in
+func (a *asciidocConverter) list(buf *bytes.Buffer, lines []string, start int, parents []string) int {
+	marker, _ := listMarker(lines[start])
+	attrs := a.takeAttrs()
+	element := "ul"
+	if strings.HasPrefix(marker, ".") {
+		element = "ol"
+	}
+	buf.WriteString(a.anchor(attrs) + a.title(attrs))
+	if s, ok := attrs.named["start"]; ok && element == "ol" {
+		buf.WriteString(`<ol start="` + escapeHTML(s) + `">` + "\n")
+	} else {
+		buf.WriteString("<" + element + ">\n")
+	}
+
+	nested := append(append([]string{}, parents...), marker)
+	l := start
+	for l < len(lines) {
+		m, text := listMarker(lines[l])
+		if m != marker {
+			break
+		}
+		l++
+		for l < len(lines) && !isBlockStart(lines[l]) && !reAdocDescription.MatchString(lines[l]) {
+			text += "\n" + strings.TrimSpace(lines[l])
+			l++
+		}
+
+		item := &bytes.Buffer{}
+		if c := reAdocChecklist.FindStringSubmatch(text); c != nil {
+			item.WriteString(`<input type="checkbox"`)
+			if c[1] != " " {
+				item.WriteString(` checked=""`)
+			}
+			item.WriteString(` disabled="" /> `)
+			text = text[len(c[0]):]
+		}
+		item.WriteString(a.inline(text))
+		l = a.itemContent(item, lines, l, nested)
+		buf.WriteString("<li>" + item.String() + "</li>\n")
+
+		next := l
+		for next < len(lines) && lines[next] == "" {
+			next++
+		}
+		if next < len(lines) {
+			if m, _ := listMarker(lines[next]); m == marker {
+				l = next
+			}
+		}
+	}
+	buf.WriteString("</" + element + ">\n")
+	return l
+}
+
+// itemContent writes the blocks attached to a list item with +, and the lists nested in it, and returns the index
+// of the line after them
+func (a *asciidocConverter) itemContent(item *bytes.Buffer, lines []string, l int, parents []string) int {
+	for l < len(lines) {
+		if lines[l] == "+" && l+1 < len(lines) {
+			end := blockEnd(lines, l+1)
+			item.WriteString("\n" + strings.TrimSuffix(a.blocks(lines[l+1:end]), "\n"))
+			l = end
+			continue
+		}
+
+		next := l
+		for next < len(lines) && lines[next] == "" {
+			next++
+		}
+		if next == len(lines) {
+			return l
+		}
+		marker, _ := listMarker(lines[next])
+		if marker == "" {
+			return l
+		}
+		for _, parent := range parents {
+			if parent == marker {
+				// an item of this list or one it's nested in
+				return l
+			}
+		}
+		nested := &bytes.Buffer{}
+		l = a.list(nested, lines, next, parents)
+		item.WriteString("\n" + strings.TrimSuffix(nested.String(), "\n"))
+	}
+	return l
+}
+
+// blockEnd returns the index of the line after the block starting at start
+func blockEnd(lines []string, start int) int {
+	l := start
+	for l < len(lines) && (reAdocBlockAttrs.MatchString(lines[l]) || reAdocBlockTitle.MatchString(lines[l])) {
+		l++
+	}
+	if l < len(lines) && reAdocDelimiter.MatchString(lines[l]) {
+		closing := lines[l]
+		if strings.HasPrefix(closing, "```") {
+			closing = "```"
+		}
+		for l++; l < len(lines) && lines[l] != closing; l++ {
+		}
+		return minInt(l+1, len(lines))
+	}
+	for l < len(lines) && lines[l] != "" && lines[l] != "+" {
+		l++
+	}
+	return l
+}
+
+// descriptionList writes the description list starting at start, and returns the index of the line after it
+func (a *asciidocConverter) descriptionList(buf *bytes.Buffer, lines []string, start int) int {
+	attrs := a.takeAttrs()
+	buf.WriteString(a.anchor(attrs) + a.title(attrs) + "<dl>\n")
+	l := start
+	for l < len(lines) {
+		m := reAdocDescription.FindStringSubmatch(lines[l])
+		if m == nil || strings.HasPrefix(lines[l], " ") {
+			break
+		}
+		buf.WriteString("<dt>" + a.inline(m[1]) + "</dt>\n")
+		text := m[3]
+		l++
+		for l < len(lines) && lines[l] == "" && text == "" {
+			l++
+		}
+		for l < len(lines) && !isBlockStart(lines[l]) && !reAdocDescription.MatchString(lines[l]) {
+			text = strings.TrimSpace(text + "\n" + strings.TrimSpace(lines[l]))
+			l++
+		}
+		item := &bytes.Buffer{}
+		if text != "" {
+			item.WriteString(a.inline(text))
+		}
+		l = a.itemContent(item, lines, l, nil)
+		buf.WriteString("<dd>" + strings.TrimPrefix(item.String(), "\n") + "</dd>\n")
+
+		for l < len(lines) && lines[l] == "" {
+			l++
+		}
+	}
+	buf.WriteString("</dl>\n")
+	return l
+}
+
+// callouts writes the list explaining the callouts in the code before it
+func (a *asciidocConverter) callouts(buf *bytes.Buffer, lines []string, start int) int {
+	a.takeAttrs()
+	buf.WriteString("<ol>\n")
+	l := start
+	for ; l < len(lines) && reAdocCalloutItem.MatchString(lines[l]); l++ {
+		buf.WriteString("<li>" + a.inline(reAdocCalloutItem.FindStringSubmatch(lines[l])[2]) + "</li>\n")
+	}
+	buf.WriteString("</ol>\n")
+	return l
+}
+
+// table writes the table in a delimited table block, with cells separated by the separator
+func (a *asciidocConverter) table(buf *bytes.Buffer, attrs *asciidocAttrs, separator byte, lines []string) {
+	if s := attrs.named["separator"]; s != "" {
+		separator = s[0]
+	}
+
+	// the number of columns is the number of columns in cols, or the number of cells on the first line
+	columns := 0
+	if cols := attrs.named["cols"]; cols != "" {
+		for _, col := range strings.Split(cols, ",") {
+			if star := strings.Index(col, "*"); star != -1 {
+				n, _ := strconv.Atoi(strings.TrimSpace(col[:star]))
+				columns += n
+				continue
+			}
+			columns++
+		}
+		if n, err := strconv.Atoi(strings.TrimSpace(cols)); err == nil && !strings.Contains(cols, ",") {
+			columns = n
+		}
+	}
+
+	first := 0
+	for first < len(lines) && lines[first] == "" {
+		first++
+	}
+	header := attrs.options["header"]
+	if first < len(lines) {
+		cells := a.splitCells(lines[first], separator)
+		if columns == 0 {
+			columns = len(cells)
+		}
+		if !attrs.options["noheader"] && first+1 < len(lines) && lines[first+1] == "" && len(cells) == columns {
+			// an implicit header row
+			header = true
+		}
+	}
+	if columns == 0 {
+		columns = 1
+	}
+
+	var rows [][]string
+	var row []string
+	for _, cell := range a.splitCells(strings.Join(lines[first:], "\n"), separator) {
+		row = append(row, cell)
+		if len(row) == columns {
+			rows = append(rows, row)
+			row = nil
+		}
+	}
+	if row != nil {
+		rows = append(rows, row)
+	}
+
+	buf.WriteString(a.title(attrs) + "<table>\n")
+	for r, row := range rows {
+		element := "td"
+		if r == 0 && header {
+			element = "th"
+			buf.WriteString("<thead>\n")
+		}
+		if (r == 0 && !header) || (r == 1 && header) {
+			buf.WriteString("<tbody>\n")
+		}
+		buf.WriteString("<tr>")
+		for _, cell := range row {
+			buf.WriteString("<" + element + ">" + cell + "</" + element + ">")
+		}
+		buf.WriteString("</tr>\n")
+		if r == 0 && header {
+			buf.WriteString("</thead>\n")
+		}
+	}
+	if len(rows) > 1 || (len(rows) == 1 && !header) {
+		buf.WriteString("</tbody>\n")
+	}
+	buf.WriteString("</table>\n")
+}
+
+// splitCells splits the text of a table into its converted cells.  In PSV tables, the cell's specifier before the
+// separator sets its style, so cells styled a are converted as AsciiDoc blocks, and the rest as text
+func (a *asciidocConverter) splitCells(text string, separator byte) []string {
+	if separator == ',' || separator == ':' {
+		var cells []string
+		for _, line := range strings.Split(text, "\n") {
+			if line == "" {
+				continue
+			}
+			for _, cell := range strings.Split(line, string(separator)) {
+				cells = append(cells, a.inline(strings.Trim(strings.TrimSpace(cell), `"`)))
+			}
+		}
+		return cells
+	}
+
+	var raw []string
+	var styles []string
+	previous := -1 // the index of the separator before the cell
+	style := ""
+	for c := 0; c <= len(text); c++ {
+		if c < len(text) && (text[c] != separator || (c > 0 && text[c-1] == '\\')) {
+			continue
+		}
+		segment := text[previous+1 : c]
+		spec := ""
+		if c < len(text) {
+			// the specifier of the next cell is at the end of the segment, on its own at the start of the text
+			re := reAdocCellSpec
+			if previous == -1 {
+				re = reAdocFirstSpec
+			}
+			if m := re.FindStringSubmatch(segment); m != nil {
+				spec = m[1]
+				segment = segment[:len(segment)-len(spec)]
+			}
+		}
+		if previous >= 0 {
+			raw = append(raw, segment)
+			styles = append(styles, style)
+		}
+		style = ""
+		if spec != "" && strings.ContainsAny(spec[len(spec)-1:], "adehlmsv") {
+			style = spec[len(spec)-1:]
+		}
+		previous = c
+	}
+
+	cells := make([]string, len(raw))
+	for c, cell := range raw {
+		cell = strings.Replace(strings.TrimSpace(cell), `\`+string(separator), string(separator), -1)
+		switch styles[c] {
+		case "a":
+			cells[c] = strings.TrimSuffix(a.blocks(strings.Split(cell, "\n")), "\n")
+		case "l":
+			cells[c] = "<pre>" + escapeHTML(cell) + "</pre>"
+		case "m":
+			cells[c] = "<code>" + escapeHTML(cell) + "</code>"
+		default:
+			var paragraphs []string
+			for _, p := range strings.Split(cell, "\n\n") {
+				if p = strings.TrimSpace(p); p != "" {
+					paragraphs = append(paragraphs, a.inline(p))
+				}
+			}
+			if len(paragraphs) > 1 {
+				cells[c] = "<p>" + strings.Join(paragraphs, "</p>\n<p>") + "</p>"
+			} else {
+				cells[c] = strings.Join(paragraphs, "")
+			}
+		}
+	}
+	return cells
+}
+
+// inline converts the inline formatting, links and references in the text
+func (a *asciidocConverter) inline(text string) string {
+	text = a.substitute(text)
+
+	// passthroughs and monospace text aren't formatted
+	text = reAdocPassthrough.ReplaceAllStringFunc(text, func(pass string) string {
+		m := reAdocPassthrough.FindStringSubmatch(pass)
+		switch {
+		case m[1] != "":
+			return a.placeholder(m[1])
+		case strings.HasPrefix(pass, "pass:"):
+			return a.placeholder(escapeHTML(m[2]))
+		case m[3] != "":
+			return a.placeholder(escapeHTML(m[3]))
+		}
+		return m[4] + a.placeholder(escapeHTML(m[5]))
+	})
+	text = reAdocMonospace.ReplaceAllStringFunc(text, func(mono string) string {
+		m := reAdocMonospace.FindStringSubmatch(mono)
+		if m[1] != "" {
+			return a.placeholder("<code>" + escapeHTML(m[1]) + "</code>")
+		}
+		return m[2] + a.placeholder("<code>"+escapeHTML(m[3])+"</code>")
+	})
+
+	text = escapeHTML(text)
+	text = reAdocEscape.ReplaceAllStringFunc(text, func(escaped string) string {
+		return a.placeholder(escaped[1:])
+	})
+	text = reAdocMacro.ReplaceAllStringFunc(text, func(macro string) string {
+		trail := ""
+		if strings.Contains(macro, "://") && !strings.HasSuffix(macro, "]") {
+			// punctuation after a URL isn't part of it, and neither are escaped brackets or quotes around it
+			for _, entity := range []string{"&lt;", "&gt;", "&quot;"} {
+				if at := strings.Index(macro, entity); at != -1 {
+					macro, trail = macro[:at], macro[at:]+trail
+				}
+			}
+			trimmed := strings.TrimRight(macro, ".,;:!?)'")
+			macro, trail = trimmed, macro[len(trimmed):]+trail
+		}
+		return a.placeholder(a.macro(macro)) + trail
+	})
+
+	text = reAdocRole.ReplaceAllStringFunc(text, func(role string) string {
+		// text with a role is only styled by the role, which can't be kept
+		return "\x01"
+	})
+	text = asciidocQuote(text, "\x01", "#", "")
+	for _, q := range []struct{ mark, element string }{
+		{"*", "strong"}, {"_", "em"}, {"#", "mark"},
+	} {
+		text = asciidocQuote(text, q.mark+q.mark, q.mark+q.mark, q.element)
+		text = asciidocConstrained(text, q.mark, q.element)
+	}
+	text = asciidocQuote(text, "^", "^", "sup")
+	text = asciidocQuote(text, "~", "~", "sub")
+	text = asciidocReplacements.Replace(text)
+	text = reAdocLineBreak.ReplaceAllString(text, "<br />$1")
+	return text
+}
+
+// asciidocQuote formats the text between the open and close marks, which can be anywhere, as the element.  If
+// element is empty, the text is left as is without the marks.  Superscript and subscript text can't have spaces
+func asciidocQuote(text, open, close, element string) string {
+	buf := &bytes.Buffer{}
+	for {
+		start := strings.Index(text, open)
+		if start == -1 {
+			break
+		}
+		from := start + len(open)
+		end := strings.Index(text[from:], close)
+		if end == -1 {
+			break
+		}
+		content := text[from : from+end]
+		if content == "" || (element == "sup" || element == "sub") && strings.ContainsAny(content, " \t\n") {
+			buf.WriteString(text[:from])
+			text = text[from:]
+			continue
+		}
+		buf.WriteString(text[:start])
+		if element == "" {
+			buf.WriteString(content)
+		} else {
+			buf.WriteString("<" + element + ">" + content + "</" + element + ">")
+		}
+		text = text[from+end+len(close):]
+	}
+	buf.WriteString(text)
+	return buf.String()
+}
+
+// asciidocWord returns whether the character is part of a word, which constrained marks can't be next to
+func asciidocWord(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+// asciidocConstrained formats the text between single marks around words as the element
+func asciidocConstrained(text, mark, element string) string {
+	buf := &bytes.Buffer{}
+	m := mark[0]
+	for at := 0; at < len(text); at++ {
+		c := text[at]
+		if c != m || (at > 0 && (asciidocWord(text[at-1]) || text[at-1] == m)) || at+1 >= len(text) ||
+			text[at+1] == ' ' || text[at+1] == '\n' || text[at+1] == m {
+			buf.WriteByte(c)
+			continue
+		}
+		end := -1
+		for e := at + 2; e < len(text); e++ {
+			if text[e] == m && text[e-1] != ' ' && text[e-1] != '\n' &&
+				(e+1 == len(text) || (!asciidocWord(text[e+1]) && text[e+1] != m)) {
+				end = e
+				break
+			}
+		}
+		if end == -1 {
+			buf.WriteByte(c)
+			continue
+		}
+		buf.WriteString("<" + element + ">" + text[at+1:end] + "</" + element + ">")
+		at = end
+	}
+	return buf.String()
+}
+
+// macro converts an inline macro, link, cross reference or anchor.  The text has already been escaped
+func (a *asciidocConverter) macro(macro string) string {
+	if strings.HasPrefix(macro, "&lt;&lt;") {
+		content := strings.TrimSuffix(strings.TrimPrefix(macro, "&lt;&lt;"), "&gt;&gt;")
+		parts := strings.SplitN(content, ",", 2)
+		text := ""
+		if len(parts) == 2 {
+			text = a.inline(strings.TrimSpace(html.UnescapeString(parts[1])))
+		}
+		return a.xref(html.UnescapeString(parts[0]), text)
+	}
+	if strings.HasPrefix(macro, "[[") {
+		attrs := parseAttrs(html.UnescapeString(macro[1 : len(macro)-1]))
+		return a.anchor(attrs)
+	}
+
+	m := reAdocMacroParts.FindStringSubmatch(macro)
+	if m == nil || strings.Contains(m[2], "//") {
+		// a URL
+		url, text := macro, ""
+		if open := strings.Index(macro, "["); open != -1 {
+			url, text = macro[:open], macro[open+1:len(macro)-1]
+		}
+		return a.link(html.UnescapeString(url), text)
+	}
+
+	name, target, content := m[1], html.UnescapeString(m[2]), html.UnescapeString(strings.Replace(m[3], `\]`, "]", -1))
+	switch name {
+	case "footnote", "footnoteref":
+		id := target
+		if name == "footnoteref" {
+			parts := strings.SplitN(content, ",", 2)
+			id = parts[0]
+			content = ""
+			if len(parts) == 2 {
+				content = parts[1]
+			}
+		}
+		n, ok := a.footnoteIDs[id]
+		if !ok || id == "" {
+			a.footnotes = append(a.footnotes, a.inline(content))
+			n = len(a.footnotes)
+			if id != "" {
+				a.footnoteIDs[id] = n
+			}
+		}
+		number := strconv.Itoa(n)
+		return `<sup>[<a href="#_footnotedef_` + number + `">` + number + "</a>]</sup>"
+	case "image":
+		return a.image(target, parseAttrs(content))
+	case "link", "mailto":
+		if name == "mailto" {
+			target = "mailto:" + target
+		}
+		return a.link(target, escapeHTML(content))
+	case "xref":
+		return a.xref(target, a.inline(content))
+	case "kbd":
+		var keys []string
+		for _, key := range strings.FieldsFunc(content, func(c rune) bool { return c == '+' || c == ',' }) {
+			keys = append(keys, "<kbd>"+escapeHTML(strings.TrimSpace(key))+"</kbd>")
+		}
+		return strings.Join(keys, "+")
+	case "btn":
+		return "<strong>" + escapeHTML(content) + "</strong>"
+	case "menu":
+		items := []string{target}
+		if content != "" {
+			items = append(items, strings.Split(content, ">")...)
+		}
+		for i := range items {
+			items[i] = escapeHTML(strings.TrimSpace(items[i]))
+		}
+		return "<strong>" + strings.Join(items, " › ") + "</strong>"
+	case "anchor":
+		return a.anchor(&asciidocAttrs{id: target, named: map[string]string{"reftext": content}})
+	}
+	return escapeHTML(macro)
+}
+
+// link returns a link to the URL, with the text, which has already been escaped, or the URL if there is no text
+func (a *asciidocConverter) link(url, text string) string {
+	if strings.HasSuffix(text, "^") {
+		// open in a new window, which is up to the reader
+		text = strings.TrimSuffix(text, "^")
+	}
+	if comma := strings.Index(text, ","); comma != -1 && strings.Contains(text[comma:], "=") {
+		text = text[:comma]
+	}
+	text = strings.Trim(text, `"`)
+	if text == "" {
+		text = escapeHTML(strings.TrimPrefix(url, "mailto:"))
+	} else {
+		text = a.inline(html.UnescapeString(text))
+	}
+	return `<a href="` + escapeHTML(url) + `">` + text + "</a>"
+}
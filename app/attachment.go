@@ -0,0 +1,261 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"database/sql"
+	"io"
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/lexLibrary/lexLibrary/data"
+)
+
+/*
+	Attachments are files that belong to a document, such as the images and linked files of an imported document.
+	The file data is stored as a blob (see data/blob.go), and each attachment holds a reference to its blob, so the
+	same file attached to many documents is only stored once.
+
+	Attachments belong to the document, not to a revision, so every revision of a document can link to them.
+	Reading an attachment needs read permission on its document, and adding or deleting one needs edit permission.
+*/
+
+const maxAttachmentNameLength = 255
+
+// Attachment is a file attached to a document
+type Attachment struct {
+	ID          string
+	DocumentID  string
+	TenantID    string
+	Name        string
+	ContentType string
+	BlobID      string
+	Size        int64
+	Creator     string
+	Created     time.Time
+
+	document *Document
+}
+
+var (
+	sqlAttachmentInsert = data.NewQuery(`
+		insert into attachments (tenant_id, document_id, id, name, content_type, blob_id, size, creator, created)
+		values ({{tenant}}, {{arg "document_id"}}, {{arg "id"}}, {{arg "name"}}, {{arg "content_type"}},
+			{{arg "blob_id"}}, {{arg "size"}}, {{arg "creator"}}, {{arg "created"}})
+	`)
+	sqlAttachmentColumns = `id, document_id, tenant_id, name, content_type, blob_id, size, creator, created`
+	sqlAttachmentGet     = data.NewQuery(`
+		select ` + sqlAttachmentColumns + ` from attachments
+		where tenant_id = {{tenant}} and document_id = {{arg "document_id"}} and id = {{arg "id"}}
+	`)
+	sqlAttachmentList = data.NewQuery(`
+		select ` + sqlAttachmentColumns + ` from attachments
+		where tenant_id = {{tenant}} and document_id = {{arg "document_id"}}
+		order by name, id
+	`)
+	sqlAttachmentDelete = data.NewQuery(`
+		delete from attachments where tenant_id = {{tenant}} and document_id = {{arg "document_id"}} and id = {{arg "id"}}
+	`)
+)
+
+// Attachments returns the files attached to the document, by name
+func (d *Document) Attachments() ([]*Attachment, error) {
+	err := Can(d.who, PermissionRead, d)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := sqlAttachmentList.Tenant(d.TenantID).Query(sql.Named("document_id", d.ID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments []*Attachment
+	for rows.Next() {
+		a, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		a.document = d
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
+
+// Attachment returns a file attached to the document
+func (d *Document) Attachment(id string) (*Attachment, error) {
+	err := Can(d.who, PermissionRead, d)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := scanAttachment(sqlAttachmentGet.Tenant(d.TenantID).QueryRow(
+		sql.Named("document_id", d.ID),
+		sql.Named("id", id),
+	))
+	if err != nil {
+		return nil, err
+	}
+	a.document = d
+	return a, nil
+}
+
+// AddAttachment attaches the file read from the reader to the document.  The content type is based on the file
+// name's extension
+func (d *Document) AddAttachment(name string, r io.Reader) (*Attachment, error) {
+	err := Can(d.who, PermissionEdit, d)
+	if err != nil {
+		return nil, err
+	}
+	if d.Status == DocumentStatusArchived {
+		return nil, NewFailure("An archived document can't be edited")
+	}
+
+	a, err := newAttachment(d.who, name, r)
+	if err != nil {
+		return nil, err
+	}
+
+	err = data.BeginTx(func(tx *sql.Tx) error {
+		return insertAttachment(tx, d, a)
+	})
+	if err != nil {
+		releaseAttachments(a)
+		return nil, err
+	}
+	a.document = d
+	return a, nil
+}
+
+// Open opens the attachment's file for reading.  The caller must close the returned reader
+func (a *Attachment) Open() (io.ReadCloser, error) {
+	err := Can(a.document.who, PermissionRead, a.document)
+	if err != nil {
+		return nil, err
+	}
+	r, err := data.BlobRead(a.BlobID)
+	if err == data.ErrBlobNotFound {
+		return nil, NotFound("Attachment file not found")
+	}
+	return r, err
+}
+
+// Delete removes the attachment from its document.  Any revisions that link to it will have a broken link
+func (a *Attachment) Delete() error {
+	err := Can(a.document.who, PermissionEdit, a.document)
+	if err != nil {
+		return err
+	}
+
+	return data.BeginTx(func(tx *sql.Tx) error {
+		result, err := sqlAttachmentDelete.Tx(tx).Tenant(a.TenantID).Exec(
+			sql.Named("document_id", a.DocumentID),
+			sql.Named("id", a.ID),
+		)
+		if err != nil {
+			return err
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rows == 0 {
+			return NotFound("Attachment not found")
+		}
+		return data.BlobRelease(tx, a.BlobID)
+	})
+}
+
+// URL is the link to the attachment from its document's body, relative to the document
+func (a *Attachment) URL() string {
+	return "attachments/" + a.ID + "/" + url.PathEscape(a.Name)
+}
+
+// newAttachment writes the file to the blob store, and returns an attachment holding a reference to it that
+// isn't attached to a document yet.  If the attachment is never inserted, its blob needs to be released
+func newAttachment(who *User, name string, r io.Reader) (*Attachment, error) {
+	name = strings.TrimSpace(path.Base(strings.Replace(name, `\`, "/", -1)))
+	if name == "" || name == "." || name == "/" {
+		return nil, NewFailure("An attachment name is required")
+	}
+	if len(name) > maxAttachmentNameLength {
+		return nil, NewFailure("An attachment name can't be longer than 255 characters")
+	}
+
+	blob, err := data.BlobWrite(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Attachment{
+		ID:          newID(),
+		TenantID:    who.TenantID,
+		Name:        name,
+		ContentType: attachmentType(name),
+		BlobID:      blob.ID,
+		Size:        blob.Size,
+		Creator:     who.ID,
+		Created:     time.Now(),
+	}, nil
+}
+
+// attachmentType returns the content type of a file based on its extension
+func attachmentType(name string) string {
+	contentType := mime.TypeByExtension(strings.ToLower(path.Ext(name)))
+	if contentType == "" {
+		return "application/octet-stream"
+	}
+	return contentType
+}
+
+func insertAttachment(tx *sql.Tx, d *Document, a *Attachment) error {
+	a.DocumentID = d.ID
+	a.TenantID = d.TenantID
+	_, err := sqlAttachmentInsert.Tx(tx).Tenant(a.TenantID).Exec(
+		sql.Named("document_id", a.DocumentID),
+		sql.Named("id", a.ID),
+		sql.Named("name", a.Name),
+		sql.Named("content_type", a.ContentType),
+		sql.Named("blob_id", a.BlobID),
+		sql.Named("size", a.Size),
+		sql.Named("creator", a.Creator),
+		sql.Named("created", a.Created),
+	)
+	return err
+}
+
+// releaseAttachments releases the blobs of attachments that were never inserted
+func releaseAttachments(attachments ...*Attachment) {
+	for _, a := range attachments {
+		err := data.BlobRelease(nil, a.BlobID)
+		if err != nil {
+			LogError(err)
+		}
+	}
+}
+
+func scanAttachment(row scanner) (*Attachment, error) {
+	a := &Attachment{}
+	err := row.Scan(
+		&a.ID,
+		&a.DocumentID,
+		&a.TenantID,
+		&a.Name,
+		&a.ContentType,
+		&a.BlobID,
+		&a.Size,
+		&a.Creator,
+		&a.Created,
+	)
+	if err == sql.ErrNoRows {
+		return nil, NotFound("Attachment not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
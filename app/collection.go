@@ -0,0 +1,283 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/lexLibrary/lexLibrary/data"
+)
+
+const maxCollectionNameLength = 255
+
+// Collection is a group of documents that share permissions.  Documents inherit any permissions granted on their
+// collection.  Collections can be nested in other collections to organize them, but a nested collection has its own
+// permissions, and doesn't inherit its parent's
+type Collection struct {
+	ID       string
+	TenantID string
+	ParentID string
+	Name     string
+	Creator  string
+	Created  time.Time
+	Updated  time.Time
+
+	who *User
+}
+
+var (
+	sqlCollectionInsert = data.NewQuery(`
+		insert into collections (tenant_id, id, parent_id, name, creator, created, updated)
+		values ({{tenant}}, {{arg "id"}}, {{arg "parent_id"}}, {{arg "name"}}, {{arg "creator"}}, {{arg "created"}},
+			{{arg "updated"}})
+	`)
+	sqlCollectionGet = data.NewQuery(`
+		select c.id, c.tenant_id, c.parent_id, c.name, c.creator, c.created, c.updated from collections c
+		where c.tenant_id = {{tenant}} and c.id = {{arg "id"}}
+	`)
+	sqlCollectionList = data.NewQuery(`
+		select c.id, c.tenant_id, c.parent_id, c.name, c.creator, c.created, c.updated from collections c
+		where c.tenant_id = {{tenant}} and ` + sqlCanCollection + `
+		order by c.name
+	`)
+	sqlCollectionChildren = data.NewQuery(`
+		select c.id, c.tenant_id, c.parent_id, c.name, c.creator, c.created, c.updated from collections c
+		where c.tenant_id = {{tenant}} and c.parent_id = {{arg "parent_id"}} and ` + sqlCanCollection + `
+		order by c.name
+	`)
+	sqlCollectionChildCount = data.NewQuery(`
+		select count(*) from collections where tenant_id = {{tenant}} and parent_id = {{arg "parent_id"}}
+	`)
+	sqlCollectionUpdate = data.NewQuery(`
+		update collections set name = {{arg "name"}}, updated = {{arg "updated"}}
+		where tenant_id = {{tenant}} and id = {{arg "id"}}
+	`)
+	sqlCollectionDocumentCount = data.NewQuery(`
+		select count(*) from documents where tenant_id = {{tenant}} and collection_id = {{arg "collection_id"}}
+	`)
+	sqlCollectionDelete = data.NewQuery(`
+		delete from collections where tenant_id = {{tenant}} and id = {{arg "id"}}
+	`)
+)
+
+// CollectionNew creates a new collection.  The user creating the collection is granted admin permission on it
+func CollectionNew(who *User, name string) (*Collection, error) {
+	if who == nil {
+		return nil, Unauthorized("You must log in")
+	}
+	return collectionNew(who, "", name)
+}
+
+// NewChild creates a new collection nested in this one.  The user needs edit permission on this collection, and is
+// granted admin permission on the new one
+func (c *Collection) NewChild(name string) (*Collection, error) {
+	err := Can(c.who, PermissionEdit, c)
+	if err != nil {
+		return nil, err
+	}
+	return collectionNew(c.who, c.ID, name)
+}
+
+func collectionNew(who *User, parentID, name string) (*Collection, error) {
+	c := &Collection{
+		ID:       newID(),
+		TenantID: who.TenantID,
+		ParentID: parentID,
+		Name:     strings.TrimSpace(name),
+		Creator:  who.ID,
+		Created:  time.Now(),
+		who:      who,
+	}
+	c.Updated = c.Created
+
+	err := c.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	err = data.BeginTx(func(tx *sql.Tx) error {
+		_, err := sqlCollectionInsert.Tx(tx).Tenant(c.TenantID).Exec(
+			sql.Named("id", c.ID),
+			sql.Named("parent_id", nullString(c.ParentID)),
+			sql.Named("name", c.Name),
+			sql.Named("creator", c.Creator),
+			sql.Named("created", c.Created),
+			sql.Named("updated", c.Updated),
+		)
+		if err != nil {
+			return err
+		}
+		return insertACL(tx, c, who, PermissionAdmin, false)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// CollectionGet retrieves a collection the user can read
+func CollectionGet(who *User, id string) (*Collection, error) {
+	if who == nil {
+		return nil, Unauthorized("You must log in")
+	}
+	c, err := scanCollection(sqlCollectionGet.Tenant(who.TenantID).QueryRow(sql.Named("id", id)))
+	if err != nil {
+		return nil, err
+	}
+	c.who = who
+
+	err = Can(who, PermissionRead, c)
+	if IsFailType(err, FailForbidden) {
+		// users who can't read a collection shouldn't know it exists
+		return nil, NotFound("Collection not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// CollectionList returns the collections the user can read
+func CollectionList(who *User) ([]*Collection, error) {
+	if who == nil {
+		return nil, Unauthorized("You must log in")
+	}
+	rows, err := sqlCollectionList.Tenant(who.TenantID).Query(canArgs(who, PermissionRead)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var collections []*Collection
+	for rows.Next() {
+		c, err := scanCollection(rows)
+		if err != nil {
+			return nil, err
+		}
+		c.who = who
+		collections = append(collections, c)
+	}
+	return collections, rows.Err()
+}
+
+// Children returns the collections nested in this one that the user can read
+func (c *Collection) Children() ([]*Collection, error) {
+	args := append(canArgs(c.who, PermissionRead), sql.Named("parent_id", c.ID))
+	rows, err := sqlCollectionChildren.Tenant(c.TenantID).Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var children []*Collection
+	for rows.Next() {
+		child, err := scanCollection(rows)
+		if err != nil {
+			return nil, err
+		}
+		child.who = c.who
+		children = append(children, child)
+	}
+	return children, rows.Err()
+}
+
+func scanCollection(row scanner) (*Collection, error) {
+	c := &Collection{}
+	var parentID sql.NullString
+	err := row.Scan(&c.ID, &c.TenantID, &parentID, &c.Name, &c.Creator, &c.Created, &c.Updated)
+	if err == sql.ErrNoRows {
+		return nil, NotFound("Collection not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.ParentID = parentID.String
+	return c, nil
+}
+
+func (c *Collection) validate() error {
+	if c.Name == "" {
+		return NewFailure("A collection name is required")
+	}
+	if len(c.Name) > maxCollectionNameLength {
+		return NewFailure("A collection name can't be longer than 255 characters")
+	}
+	return nil
+}
+
+// SetName changes the collection's name
+func (c *Collection) SetName(name string) error {
+	err := Can(c.who, PermissionAdmin, c)
+	if err != nil {
+		return err
+	}
+
+	changed := *c
+	changed.Name = strings.TrimSpace(name)
+	changed.Updated = time.Now()
+	err = changed.validate()
+	if err != nil {
+		return err
+	}
+
+	_, err = sqlCollectionUpdate.Tenant(c.TenantID).Exec(
+		sql.Named("id", changed.ID),
+		sql.Named("name", changed.Name),
+		sql.Named("updated", changed.Updated),
+	)
+	if err != nil {
+		return err
+	}
+	*c = changed
+	return nil
+}
+
+// Delete removes the collection and its permissions.  Only empty collections, without documents or nested
+// collections, can be deleted
+func (c *Collection) Delete() error {
+	err := Can(c.who, PermissionAdmin, c)
+	if err != nil {
+		return err
+	}
+
+	return data.BeginTx(func(tx *sql.Tx) error {
+		count := 0
+		err := sqlCollectionDocumentCount.Tx(tx).Tenant(c.TenantID).QueryRow(
+			sql.Named("collection_id", c.ID)).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return NewFailure("Only empty collections can be deleted")
+		}
+		err = sqlCollectionChildCount.Tx(tx).Tenant(c.TenantID).QueryRow(
+			sql.Named("parent_id", c.ID)).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return NewFailure("Only collections without nested collections can be deleted")
+		}
+
+		_, err = sqlACLDeleteResource.Tx(tx).Tenant(c.TenantID).Exec(
+			sql.Named("resource_type", resourceCollection),
+			sql.Named("resource_id", c.ID),
+		)
+		if err != nil {
+			return err
+		}
+		_, err = sqlCollectionDelete.Tx(tx).Tenant(c.TenantID).Exec(sql.Named("id", c.ID))
+		return err
+	})
+}
+
+// Documents returns the documents in the collection the user can read, most recently updated first
+func (c *Collection) Documents(offset, limit int) ([]*Document, error) {
+	return documentList(c.who, c.ID, offset, limit)
+}
+
+func (c *Collection) resourceType() string   { return resourceCollection }
+func (c *Collection) resourceID() string     { return c.ID }
+func (c *Collection) resourceTenant() string { return c.TenantID }
@@ -0,0 +1,322 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+)
+
+/*
+	The body of a Confluence page is in its storage format: XHTML, with Confluence's own elements in the ac and ri
+	namespaces for macros, links, images and the like.  The namespaces are never declared in a body, and bodies use
+	HTML entities, so they're read with a lenient decoder.
+
+	The HTML is kept as is, and the sanitizer removes anything a document doesn't allow.  The macros with an
+	equivalent in a document are converted to it: code blocks become preformatted code, info, tip, note, warning and
+	panel macros become block quotes led by their label, and expand macros become details.  Any other macro is
+	reported as unmapped, and only its content is kept.  Links to pages in the export point at the pages' documents,
+	and attached files are attached to the document.
+*/
+
+// confluencePanels are the labels of the panel macros, by macro name
+var confluencePanels = map[string]string{
+	"info":    "Info",
+	"tip":     "Tip",
+	"note":    "Note",
+	"warning": "Warning",
+	"panel":   "",
+}
+
+// confluenceEmoticons are the emoji for Confluence's emoticons
+var confluenceEmoticons = map[string]string{
+	"smile":        "🙂",
+	"sad":          "🙁",
+	"cheeky":       "😛",
+	"laugh":        "😀",
+	"wink":         "😉",
+	"thumbs-up":    "👍",
+	"thumbs-down":  "👎",
+	"information":  "ℹ️",
+	"tick":         "✅",
+	"cross":        "❌",
+	"warning":      "⚠️",
+	"plus":         "➕",
+	"minus":        "➖",
+	"question":     "❓",
+	"light-on":     "💡",
+	"light-off":    "💡",
+	"yellow-star":  "⭐",
+	"red-star":     "⭐",
+	"green-star":   "⭐",
+	"blue-star":    "⭐",
+	"heart":        "❤️",
+	"broken-heart": "💔",
+}
+
+// confluenceVoid are the HTML elements without content or end tags.  Bodies should close them, but older ones
+// don't always.  Other names in xml.HTMLAutoClose, like link, are also the names of Confluence's elements
+var confluenceVoid = []string{"br", "hr", "img", "col", "input", "wbr"}
+
+// confluenceConverter converts the body of a page to HTML
+type confluenceConverter struct {
+	c    *confluenceImport
+	page *confluencePage
+	i    *importDoc
+	buf  bytes.Buffer
+
+	unmapped []string
+	missing  []string // the titles of linked pages that aren't in the export
+}
+
+// convert converts the storage format body to HTML, and warns about the parts of it that couldn't be converted
+func (v *confluenceConverter) convert(body string) string {
+	d := xml.NewDecoder(strings.NewReader("<body>" + body + "</body>"))
+	d.Strict = false
+	d.AutoClose = confluenceVoid
+	d.Entity = xml.HTMLEntity
+
+	root, err := parseXMLTokens(d)
+	if err != nil {
+		v.i.warn("The body of %s could not be read, and was imported as plain text: %s", v.page.title, err)
+		return "<pre>" + escapeHTML(body) + "</pre>"
+	}
+	v.children(root)
+
+	if unmapped := uniqueSorted(v.unmapped); len(unmapped) > 0 {
+		v.i.warn("The macros %s on %s have no equivalent in a document, and only their content was kept",
+			strings.Join(unmapped, ", "), v.page.title)
+	}
+	if missing := uniqueSorted(v.missing); len(missing) > 0 {
+		v.i.warn("The links on %s to %s were left as text, because those pages aren't in the export",
+			v.page.title, strings.Join(missing, ", "))
+	}
+	return v.buf.String()
+}
+
+func (v *confluenceConverter) children(n *xmlNode) {
+	for _, c := range n.Children {
+		v.node(c)
+	}
+}
+
+func (v *confluenceConverter) node(n *xmlNode) {
+	if n.Name.Local == "" {
+		v.buf.WriteString(escapeHTML(n.Text))
+		return
+	}
+
+	switch n.Name.Space {
+	case "":
+		v.element(n)
+	case "ac":
+		switch n.Name.Local {
+		case "structured-macro", "macro":
+			v.macro(n)
+		case "link":
+			v.link(n)
+		case "image":
+			v.image(n)
+		case "emoticon":
+			v.buf.WriteString(confluenceEmoticons[n.attr("ac", "name")])
+		case "task-list":
+			v.buf.WriteString("<ul>\n")
+			for _, task := range n.Children {
+				if !task.is("ac", "task") {
+					continue
+				}
+				v.buf.WriteString(`<li><input type="checkbox"`)
+				if strings.TrimSpace(task.child("ac", "task-status").text()) == "complete" {
+					v.buf.WriteString(` checked=""`)
+				}
+				v.buf.WriteString(` disabled="" /> `)
+				v.children(task.child("ac", "task-body"))
+				v.buf.WriteString("</li>\n")
+			}
+			v.buf.WriteString("</ul>\n")
+		case "placeholder", "parameter":
+			// instructions for the editor, and the parameters of macros, aren't content
+		default:
+			// layouts, and the bodies of macros
+			v.children(n)
+		}
+	case "ri":
+		// resources are only meaningful inside of links and images
+	default:
+		v.children(n)
+	}
+}
+
+// element writes the HTML element as is
+func (v *confluenceConverter) element(n *xmlNode) {
+	name := strings.ToLower(n.Name.Local)
+	v.buf.WriteString("<" + name)
+	for _, a := range n.Attr {
+		if a.Name.Space == "" {
+			v.buf.WriteString(" " + strings.ToLower(a.Name.Local) + `="` + escapeHTML(a.Value) + `"`)
+		}
+	}
+	for _, void := range confluenceVoid {
+		if name == void {
+			v.buf.WriteString(" />")
+			return
+		}
+	}
+	v.buf.WriteString(">")
+	v.children(n)
+	v.buf.WriteString("</" + name + ">")
+}
+
+// confluenceParameter returns the value of the macro's parameter
+func confluenceParameter(macro *xmlNode, name string) string {
+	for _, c := range macro.Children {
+		if c.is("ac", "parameter") && c.attr("ac", "name") == name {
+			return strings.TrimSpace(c.text())
+		}
+	}
+	return ""
+}
+
+func (v *confluenceConverter) macro(n *xmlNode) {
+	name := n.attr("ac", "name")
+	title := confluenceParameter(n, "title")
+	body := n.child("ac", "rich-text-body")
+
+	switch name {
+	case "code", "noformat":
+		if title != "" {
+			v.buf.WriteString("<p><strong>" + escapeHTML(title) + "</strong></p>\n")
+		}
+		v.buf.WriteString("<pre><code")
+		if language := strings.ToLower(confluenceParameter(n, "language")); language != "" && name == "code" {
+			v.buf.WriteString(` class="language-` + escapeHTML(language) + `"`)
+		}
+		v.buf.WriteString(">" + escapeHTML(n.child("ac", "plain-text-body").text()) + "</code></pre>\n")
+	case "info", "tip", "note", "warning", "panel":
+		if title == "" {
+			title = confluencePanels[name]
+		}
+		v.buf.WriteString("<blockquote>\n")
+		if title != "" {
+			v.buf.WriteString("<p><strong>" + escapeHTML(title) + "</strong></p>\n")
+		}
+		v.children(body)
+		v.buf.WriteString("\n</blockquote>\n")
+	case "expand":
+		if title == "" {
+			title = "Click here to expand..."
+		}
+		v.buf.WriteString("<details>\n<summary>" + escapeHTML(title) + "</summary>\n")
+		v.children(body)
+		v.buf.WriteString("\n</details>\n")
+	case "anchor":
+		v.buf.WriteString(`<a name="` + escapeHTML(confluenceParameter(n, "")) + `"></a>`)
+	case "status":
+		v.buf.WriteString("<mark>" + escapeHTML(title) + "</mark>")
+	default:
+		v.unmapped = append(v.unmapped, name)
+		v.c.unmapped(name, v.page)
+		switch {
+		case body != nil:
+			v.children(body)
+		case n.child("ac", "plain-text-body") != nil:
+			v.buf.WriteString("<pre>" + escapeHTML(n.child("ac", "plain-text-body").text()) + "</pre>\n")
+		default:
+			v.buf.WriteString("<code>{" + escapeHTML(name) + "}</code>")
+		}
+	}
+}
+
+// link writes a link to a page, attachment, URL or user.  Links to anything that isn't in the export are written as
+// their text
+func (v *confluenceConverter) link(n *xmlNode) {
+	href := ""
+	text := ""
+	if anchor := n.attr("ac", "anchor"); anchor != "" {
+		href = "#" + anchor
+	}
+
+	switch {
+	case n.child("ri", "page") != nil:
+		ref := n.child("ri", "page")
+		title := ref.attr("ri", "content-title")
+		text = title
+		p := v.c.pageByTitle(ref.attr("ri", "space-key"), title, v.page)
+		if p == nil {
+			v.missing = append(v.missing, title)
+			href = ""
+		} else if p != v.page || href == "" {
+			href = documentLink(p.documentID) + href
+		}
+	case n.child("ri", "attachment") != nil:
+		ref := n.child("ri", "attachment")
+		text = ref.attr("ri", "filename")
+		href, _ = v.attachment(ref)
+	case n.child("ri", "url") != nil:
+		text = n.child("ri", "url").attr("ri", "value")
+		href = text
+	case n.child("ri", "user") != nil:
+		ref := n.child("ri", "user")
+		name := v.c.users[ref.attr("ri", "userkey")]
+		if name == "" {
+			name = ref.attr("ri", "username")
+		}
+		v.buf.WriteString("@" + escapeHTML(name))
+		return
+	}
+
+	if href != "" {
+		v.buf.WriteString(`<a href="` + escapeHTML(href) + `">`)
+	}
+	if body := n.child("ac", "link-body"); body != nil {
+		v.children(body)
+	} else if body := n.child("ac", "plain-text-link-body"); body != nil {
+		v.buf.WriteString(escapeHTML(body.text()))
+	} else {
+		v.buf.WriteString(escapeHTML(text))
+	}
+	if href != "" {
+		v.buf.WriteString("</a>")
+	}
+}
+
+// attachment attaches the file attached to the page, and returns the link to it
+func (v *confluenceConverter) attachment(ref *xmlNode) (string, bool) {
+	name := ref.attr("ri", "filename")
+	if ref.child("ri", "page") != nil {
+		v.i.warn("The link to %s, attached to another page, was left as text", name)
+		return "", false
+	}
+	for _, a := range v.page.attachments {
+		if a.name == name {
+			return v.c.attach(v.i, v.page, a)
+		}
+	}
+	v.i.warn("The attachment %s is missing from the export, and was skipped", name)
+	return "", false
+}
+
+// image writes an image attached to the page or at a URL
+func (v *confluenceConverter) image(n *xmlNode) {
+	src := ""
+	alt := n.attr("ac", "alt")
+	if ref := n.child("ri", "attachment"); ref != nil {
+		src, _ = v.attachment(ref)
+		if alt == "" {
+			alt = ref.attr("ri", "filename")
+		}
+	} else if ref := n.child("ri", "url"); ref != nil {
+		src = ref.attr("ri", "value")
+	}
+	if src == "" {
+		return
+	}
+	v.buf.WriteString(`<img src="` + escapeHTML(src) + `" alt="` + escapeHTML(alt) + `"`)
+	for _, size := range []string{"width", "height"} {
+		if value := n.attr("ac", size); value != "" {
+			v.buf.WriteString(" " + size + `="` + escapeHTML(value) + `"`)
+		}
+	}
+	v.buf.WriteString(" />")
+}
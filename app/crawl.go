@@ -0,0 +1,1222 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lexLibrary/lexLibrary/data"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/publicsuffix"
+)
+
+/*
+	A crawl imports the pages of a web site as documents.  It starts at a seed URL, and follows the links on each
+	page to the other pages within its scope, which is either a URL prefix, or a domain and all of its subdomains.
+
+	Crawls run in the background in two phases, and keep their progress in the database so they pick up where they
+	left off after a restart:
+
+	1. Every page is fetched, following the site's robots.txt and waiting between requests.  Pages are identified by
+	   their canonical URL, and pages with the same content as a page already fetched are recorded as duplicates
+	   instead of being imported twice.  The main content of each page is converted to HTML and kept with the page.
+	2. Once there are no pages left to fetch, a document is created for each fetched page.  Every page's document id
+	   is chosen when the page is found, so links between pages are rewritten to link to their documents, and links
+	   to pages that weren't imported point back to the site.
+*/
+
+// statuses of a crawl
+const (
+	CrawlStatusRunning  = "running"
+	CrawlStatusDone     = "done"
+	CrawlStatusCanceled = "canceled"
+	CrawlStatusFailed   = "failed"
+)
+
+// statuses of a crawled page
+const (
+	CrawlPageStatusPending   = "pending"
+	CrawlPageStatusFetched   = "fetched"
+	CrawlPageStatusImported  = "imported"
+	CrawlPageStatusDuplicate = "duplicate"
+	CrawlPageStatusSkipped   = "skipped"
+	CrawlPageStatusFailed    = "failed"
+)
+
+const (
+	// crawlBatchSize is the number of pages fetched or imported from each crawl every time crawls are run
+	crawlBatchSize = 20
+	// maxCrawlPages is the most pages a crawl will find, links to more pages are not followed
+	maxCrawlPages = 10000
+	// maxCrawlDelay is the longest delay between requests a site's robots.txt can ask for
+	maxCrawlDelay = time.Minute
+	// maxCrawlRedirects is the longest chain of duplicate pages followed to find the page that was imported
+	maxCrawlRedirects = 10
+)
+
+// crawlClient doesn't follow redirects, so the pages they redirect to are found and fetched like any other page.
+// It only connects to public addresses, and never through a proxy, so a crawl can't be used to reach the server
+// itself, the network it's on, or a cloud provider's metadata service
+var crawlClient = &http.Client{
+	Timeout: 30 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+	Transport: &http.Transport{
+		DialContext:         dialCrawl,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+var crawlDialer = &net.Dialer{
+	Timeout:   30 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
+// crawlBlockedNetworks are the addresses crawls can't connect to: loopback, private (RFC 1918 and unique local),
+// shared (RFC 6598), link local, which includes the metadata services of cloud providers, and addresses that
+// aren't for a single host
+var crawlBlockedNetworks = parseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+	"192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+// crawlNAT64 and crawl6to4 are the IPv6 networks that reach an IPv4 address embedded in the IPv6 address, so
+// crawls to them are checked by that IPv4 address
+var (
+	crawlNAT64 = parseCIDRs("64:ff9b::/96")[0]
+	crawl6to4  = parseCIDRs("2002::/16")[0]
+)
+
+// crawlAllowLoopback lets crawls connect to loopback addresses.  It's only ever set by tests, which crawl sites
+// served on the loopback address
+var crawlAllowLoopback = false
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i := range cidrs {
+		_, network, err := net.ParseCIDR(cidrs[i])
+		if err != nil {
+			panic(fmt.Sprintf("Invalid CIDR %s: %s", cidrs[i], err))
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+// checkCrawlIP returns a failure if crawls can't connect to the IP address
+func checkCrawlIP(ip net.IP) error {
+	reached := ip
+	if ip4 := ip.To4(); ip4 != nil {
+		reached = ip4
+	} else if crawlNAT64.Contains(ip) {
+		reached = ip[12:16]
+	} else if crawl6to4.Contains(ip) {
+		reached = ip[2:6]
+	}
+	if crawlAllowLoopback && reached.IsLoopback() {
+		return nil
+	}
+	for _, network := range crawlBlockedNetworks {
+		if network.Contains(reached) {
+			return NewFailure(fmt.Sprintf("Crawls can't connect to %s, it's not a public address", ip))
+		}
+	}
+	return nil
+}
+
+// dialCrawl connects to the address, after checking that every address its host resolves to can be crawled.  The
+// connection is made to the checked address, and not resolved again, so the host can't resolve to another
+// address in between.  It's used for every connection a crawl makes
+func dialCrawl(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("No addresses found for %s", host)
+	}
+	for i := range addrs {
+		err = checkCrawlIP(addrs[i].IP)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range addrs {
+		var conn net.Conn
+		conn, err = crawlDialer.DialContext(ctx, network, net.JoinHostPort(addrs[i].IP.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// Crawl is a job importing the pages of a web site as documents
+type Crawl struct {
+	ID           string
+	TenantID     string
+	SeedURL      string
+	Scope        string
+	CollectionID string // empty if the documents aren't imported into a collection
+	Status       string
+	// Delay is the least time between requests to the site
+	Delay   time.Duration
+	Message string // why the crawl failed
+	Creator string
+	Created time.Time
+	Updated time.Time
+
+	who *User
+}
+
+// CrawlPage is a page found by a crawl, and the outcome of importing it
+type CrawlPage struct {
+	URL        string
+	Status     string
+	DocumentID string // only set once the page is imported
+	Title      string
+	Message    string // why the page wasn't imported, or the warnings from importing it
+	Updated    time.Time
+}
+
+// crawlPage is a page of a crawl as it's stored
+type crawlPage struct {
+	key         string // the hash of the page's canonical URL
+	id          string
+	url         string
+	sequence    int
+	status      string
+	documentID  string
+	contentHash string
+	duplicateOf string // the key of the page with the same content
+	title       string
+	summary     string
+	body        string
+	message     string
+}
+
+func init() {
+	data.RegisterEncryptedColumn("crawl_pages", "id", "summary")
+	data.RegisterEncryptedColumn("crawl_pages", "id", "body")
+}
+
+var (
+	sqlCrawlInsert = data.NewQuery(`
+		insert into crawls (tenant_id, id, seed_url, scope, collection_id, status, delay, creator, created, updated)
+		values ({{tenant}}, {{arg "id"}}, {{arg "seed_url"}}, {{arg "scope"}}, {{arg "collection_id"}},
+			{{arg "status"}}, {{arg "delay"}}, {{arg "creator"}}, {{arg "created"}}, {{arg "updated"}})
+	`)
+	sqlCrawlColumns = `c.id, c.tenant_id, c.seed_url, c.scope, c.collection_id, c.status, c.delay, c.message,
+		c.creator, c.created, c.updated`
+	sqlCrawlGet = data.NewQuery(`
+		select ` + sqlCrawlColumns + ` from crawls c
+		where c.tenant_id = {{tenant}} and c.id = {{arg "id"}}
+	`)
+	sqlCrawlRunning = data.NewQuery(`
+		select ` + sqlCrawlColumns + ` from crawls c
+		where c.tenant_id = {{tenant}} and c.status = 'running'
+		order by c.created
+	`)
+	sqlCrawlUpdate = data.NewQuery(`
+		update crawls set status = {{arg "status"}}, message = {{arg "message"}}, updated = {{arg "updated"}}
+		where tenant_id = {{tenant}} and id = {{arg "id"}}
+	`)
+
+	sqlCrawlPageInsert = data.NewQuery(`
+		insert into crawl_pages (tenant_id, crawl_id, url_key, id, url, sequence, status, document_id,
+			duplicate_of, updated)
+		values ({{tenant}}, {{arg "crawl_id"}}, {{arg "url_key"}}, {{arg "id"}}, {{arg "url"}}, {{arg "sequence"}},
+			{{arg "status"}}, {{arg "document_id"}}, {{arg "duplicate_of"}}, {{arg "updated"}})
+	`)
+	sqlCrawlPageColumns = `p.url_key, p.id, p.url, p.sequence, p.status, p.document_id, p.content_hash,
+		p.duplicate_of, p.title, p.summary, p.body, p.message`
+	sqlCrawlPageGet = data.NewQuery(`
+		select ` + sqlCrawlPageColumns + ` from crawl_pages p
+		where p.tenant_id = {{tenant}} and p.crawl_id = {{arg "crawl_id"}} and p.url_key = {{arg "url_key"}}
+	`)
+	sqlCrawlPageNext = data.NewQuery(`
+		select ` + sqlCrawlPageColumns + ` from crawl_pages p
+		where p.tenant_id = {{tenant}} and p.crawl_id = {{arg "crawl_id"}} and p.status = {{arg "status"}}
+		order by p.sequence
+		LIMIT {{arg "limit"}}
+	`)
+	sqlCrawlPageHash = data.NewQuery(`
+		select p.url_key, p.url from crawl_pages p
+		where p.tenant_id = {{tenant}} and p.crawl_id = {{arg "crawl_id"}} and p.content_hash = {{arg "hash"}}
+		and p.status in ('fetched', 'imported')
+	`)
+	sqlCrawlPageLinks = data.NewQuery(`
+		select p.url_key, p.status, p.document_id, p.duplicate_of from crawl_pages p
+		where p.tenant_id = {{tenant}} and p.crawl_id = {{arg "crawl_id"}}
+	`)
+	sqlCrawlPageCount = data.NewQuery(`
+		select count(*), max(sequence) from crawl_pages
+		where tenant_id = {{tenant}} and crawl_id = {{arg "crawl_id"}}
+	`)
+	sqlCrawlPageUpdate = data.NewQuery(`
+		update crawl_pages set status = {{arg "status"}}, content_hash = {{arg "content_hash"}},
+			duplicate_of = {{arg "duplicate_of"}}, title = {{arg "title"}}, summary = {{arg "summary"}},
+			body = {{arg "body"}}, message = {{arg "message"}}, updated = {{arg "updated"}}
+		where tenant_id = {{tenant}} and crawl_id = {{arg "crawl_id"}} and url_key = {{arg "url_key"}}
+	`)
+	sqlCrawlPageList = data.NewQuery(`
+		select p.url, p.status, p.document_id, p.title, p.message, p.updated from crawl_pages p
+		where p.tenant_id = {{tenant}} and p.crawl_id = {{arg "crawl_id"}}
+		order by p.sequence
+		LIMIT {{arg "limit"}} OFFSET {{arg "offset"}}
+	`)
+)
+
+// CrawlNew starts a crawl of a web site, importing its pages as new documents in the collection if it isn't nil.
+// If scope is empty, the crawl stays within the directory of the seed URL.  A scope with a scheme, like
+// https://example.com/docs/, is a prefix every crawled URL must start with, and a scope without one, like
+// example.com, is a domain every crawled URL must be in, or be in one of its subdomains
+func CrawlNew(who *User, collection *Collection, seedURL, scope string, delay time.Duration) (*Crawl, error) {
+	collectionID, err := canCreateDocument(who, collection)
+	if err != nil {
+		return nil, err
+	}
+
+	seed, err := url.Parse(strings.TrimSpace(seedURL))
+	if err != nil || (seed.Scheme != "http" && seed.Scheme != "https") || seed.Host == "" {
+		return nil, NewFailure("The seed URL must be a full http or https URL")
+	}
+	seedURL = canonicalURL(seed)
+	seed, _ = url.Parse(seedURL)
+
+	scope, err = crawlScope(seedURL, scope)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(seed.Hostname()); ip != nil {
+		err = checkCrawlIP(ip)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if delay < 0 {
+		return nil, NewFailure("The delay between requests can't be negative")
+	}
+
+	c := &Crawl{
+		ID:           newID(),
+		TenantID:     who.TenantID,
+		SeedURL:      seedURL,
+		Scope:        scope,
+		CollectionID: collectionID,
+		Status:       CrawlStatusRunning,
+		Delay:        delay,
+		Creator:      who.ID,
+		Created:      time.Now(),
+		who:          who,
+	}
+	c.Updated = c.Created
+	if !c.inScope(seed) {
+		return nil, NewFailure("The seed URL must be within the scope of the crawl")
+	}
+
+	err = data.BeginTx(func(tx *sql.Tx) error {
+		_, err := sqlCrawlInsert.Tx(tx).Tenant(c.TenantID).Exec(
+			sql.Named("id", c.ID),
+			sql.Named("seed_url", c.SeedURL),
+			sql.Named("scope", c.Scope),
+			sql.Named("collection_id", nullString(c.CollectionID)),
+			sql.Named("status", c.Status),
+			sql.Named("delay", int(c.Delay/time.Millisecond)),
+			sql.Named("creator", c.Creator),
+			sql.Named("created", c.Created),
+			sql.Named("updated", c.Updated),
+		)
+		if err != nil {
+			return err
+		}
+		return c.insertPage(tx, c.SeedURL, 1, CrawlPageStatusPending, "")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// CrawlGet retrieves a crawl started by the user, or any crawl if the user is an admin
+func CrawlGet(who *User, id string) (*Crawl, error) {
+	if who == nil {
+		return nil, Unauthorized("You must log in")
+	}
+	c, err := scanCrawl(sqlCrawlGet.Tenant(who.TenantID).QueryRow(sql.Named("id", id)))
+	if err != nil {
+		return nil, err
+	}
+	if c.Creator != who.ID && !who.Admin {
+		return nil, NotFound("Crawl not found")
+	}
+	c.who = who
+	return c, nil
+}
+
+func scanCrawl(row scanner) (*Crawl, error) {
+	c := &Crawl{}
+	var collectionID, message sql.NullString
+	delay := 0
+	err := row.Scan(&c.ID, &c.TenantID, &c.SeedURL, &c.Scope, &collectionID, &c.Status, &delay, &message,
+		&c.Creator, &c.Created, &c.Updated)
+	if err == sql.ErrNoRows {
+		return nil, NotFound("Crawl not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.CollectionID = collectionID.String
+	c.Message = message.String
+	c.Delay = time.Duration(delay) * time.Millisecond
+	return c, nil
+}
+
+// Pages returns the pages the crawl has found in the order they were found, with the outcome of each
+func (c *Crawl) Pages(offset, limit int) ([]*CrawlPage, error) {
+	if limit == 0 || limit > maxRows {
+		limit = 10
+	}
+	rows, err := sqlCrawlPageList.Tenant(c.TenantID).Query(
+		sql.Named("crawl_id", c.ID),
+		sql.Named("offset", offset),
+		sql.Named("limit", limit),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pages []*CrawlPage
+	for rows.Next() {
+		p := &CrawlPage{}
+		var title, message sql.NullString
+		err = rows.Scan(&p.URL, &p.Status, &p.DocumentID, &title, &message, &p.Updated)
+		if err != nil {
+			return nil, err
+		}
+		if p.Status != CrawlPageStatusImported {
+			p.DocumentID = ""
+		}
+		p.Title = title.String
+		p.Message = message.String
+		pages = append(pages, p)
+	}
+	return pages, rows.Err()
+}
+
+// Cancel stops a running crawl.  The pages already imported are kept
+func (c *Crawl) Cancel() error {
+	if c.Status != CrawlStatusRunning {
+		return NewFailure("Only running crawls can be canceled")
+	}
+	return c.setStatus(CrawlStatusCanceled, "")
+}
+
+func (c *Crawl) setStatus(status, message string) error {
+	updated := time.Now()
+	_, err := sqlCrawlUpdate.Tenant(c.TenantID).Exec(
+		sql.Named("id", c.ID),
+		sql.Named("status", status),
+		sql.Named("message", nullString(message)),
+		sql.Named("updated", updated),
+	)
+	if err != nil {
+		return err
+	}
+	c.Status = status
+	c.Message = message
+	c.Updated = updated
+	if status != CrawlStatusRunning {
+		c.releaseSites()
+	}
+	return nil
+}
+
+// crawlScope returns the normalized scope of a crawl of the seed URL, or the directory of the seed URL if the scope
+// is empty.  A URL prefix scope has to include the host, and a domain scope can't be a public suffix like com or
+// co.uk, which would let the crawl wander across every site under it
+func crawlScope(seedURL, scope string) (string, error) {
+	scope = strings.TrimSpace(scope)
+	if scope == "" {
+		scope = seedURL[:strings.LastIndex(seedURL, "/")+1]
+		if i := strings.Index(scope, "?"); i != -1 {
+			scope = scope[:strings.LastIndex(scope[:i], "/")+1]
+		}
+		return scope, nil
+	}
+
+	if strings.Contains(scope, "://") {
+		prefix, err := url.Parse(scope)
+		if err != nil || (prefix.Scheme != "http" && prefix.Scheme != "https") || prefix.Host == "" {
+			return "", NewFailure("A scope URL must be a full http or https URL")
+		}
+		// the path always starts with /, so a prefix can't match the start of another host
+		return canonicalURL(prefix), nil
+	}
+
+	domain := strings.ToLower(strings.Trim(scope, "/."))
+	if isPublicSuffix(domain) {
+		return "", NewFailure("The scope must be a domain, and can't be a public suffix like com or co.uk")
+	}
+	return domain, nil
+}
+
+// isPublicSuffix returns whether the domain is one under which anyone can register their own domain, like com,
+// co.uk or github.io
+func isPublicSuffix(domain string) bool {
+	if domain == "" || !strings.Contains(domain, ".") {
+		return true
+	}
+	_, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	return err != nil
+}
+
+// inScope returns whether the URL is within the scope of the crawl
+func (c *Crawl) inScope(u *url.URL) bool {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	if strings.Contains(c.Scope, "://") {
+		return strings.HasPrefix(canonicalURL(u), c.Scope)
+	}
+	domain := strings.ToLower(strings.TrimSuffix(c.Scope, "/"))
+	if isPublicSuffix(domain) {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// canonicalURL normalizes the URL, so the different URLs of the same page are the same.  The scheme and host are
+// lower case, default ports are removed, the query is sorted without tracking parameters, and the fragment is
+// removed
+func canonicalURL(u *url.URL) string {
+	c := *u
+	c.Scheme = strings.ToLower(c.Scheme)
+	c.Host = strings.ToLower(c.Host)
+	if (c.Scheme == "http" && strings.HasSuffix(c.Host, ":80")) ||
+		(c.Scheme == "https" && strings.HasSuffix(c.Host, ":443")) {
+		c.Host = c.Host[:strings.LastIndex(c.Host, ":")]
+	}
+	if c.Path == "" {
+		c.Path = "/"
+	}
+	c.Fragment = ""
+	c.User = nil
+
+	query := c.Query()
+	for key := range query {
+		lower := strings.ToLower(key)
+		if strings.HasPrefix(lower, "utm_") || lower == "fbclid" || lower == "gclid" {
+			delete(query, key)
+		}
+	}
+	c.RawQuery = query.Encode()
+	return c.String()
+}
+
+func crawlKey(canonical string) string {
+	hash := sha256.Sum256([]byte(canonical))
+	return hex.EncodeToString(hash[:])
+}
+
+func (c *Crawl) insertPage(tx *sql.Tx, pageURL string, sequence int, status, duplicateOf string) error {
+	_, err := sqlCrawlPageInsert.Tx(tx).Tenant(c.TenantID).Exec(
+		sql.Named("crawl_id", c.ID),
+		sql.Named("url_key", crawlKey(pageURL)),
+		sql.Named("id", newID()),
+		sql.Named("url", pageURL),
+		sql.Named("sequence", sequence),
+		sql.Named("status", status),
+		sql.Named("document_id", newID()),
+		sql.Named("duplicate_of", nullString(duplicateOf)),
+		sql.Named("updated", time.Now()),
+	)
+	return err
+}
+
+func (c *Crawl) page(key string) (*crawlPage, error) {
+	return scanCrawlPage(sqlCrawlPageGet.Tenant(c.TenantID).QueryRow(
+		sql.Named("crawl_id", c.ID),
+		sql.Named("url_key", key),
+	))
+}
+
+// nextPages returns the first pages with the status, in the order they were found
+func (c *Crawl) nextPages(status string) ([]*crawlPage, error) {
+	rows, err := sqlCrawlPageNext.Tenant(c.TenantID).Query(
+		sql.Named("crawl_id", c.ID),
+		sql.Named("status", status),
+		sql.Named("limit", crawlBatchSize),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pages []*crawlPage
+	for rows.Next() {
+		p, err := scanCrawlPage(rows)
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, p)
+	}
+	return pages, rows.Err()
+}
+
+func scanCrawlPage(row scanner) (*crawlPage, error) {
+	p := &crawlPage{}
+	var hash, duplicateOf, title, message sql.NullString
+	var summary, body data.EncryptedText
+	err := row.Scan(&p.key, &p.id, &p.url, &p.sequence, &p.status, &p.documentID, &hash, &duplicateOf, &title,
+		&summary, &body, &message)
+	if err == sql.ErrNoRows {
+		return nil, NotFound("Crawl page not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.contentHash = hash.String
+	p.duplicateOf = duplicateOf.String
+	p.title = title.String
+	p.summary = string(summary)
+	p.body = string(body)
+	p.message = message.String
+	return p, nil
+}
+
+func (c *Crawl) updatePage(p *crawlPage) error {
+	_, err := sqlCrawlPageUpdate.Tenant(c.TenantID).Exec(
+		sql.Named("crawl_id", c.ID),
+		sql.Named("url_key", p.key),
+		sql.Named("status", p.status),
+		sql.Named("content_hash", nullString(p.contentHash)),
+		sql.Named("duplicate_of", nullString(p.duplicateOf)),
+		sql.Named("title", nullString(p.title)),
+		sql.Named("summary", data.EncryptedText(p.summary)),
+		sql.Named("body", data.EncryptedText(p.body)),
+		sql.Named("message", nullString(p.message)),
+		sql.Named("updated", time.Now()),
+	)
+	return err
+}
+
+// CrawlPending fetches or imports the next pages of every running crawl.  It returns the number of pages
+// processed, and is meant to be run regularly in the background
+func CrawlPending() (int, error) {
+	count := 0
+	err := EachTenant(func(t *Tenant) error {
+		crawls, err := runningCrawls(t)
+		if err != nil {
+			return err
+		}
+		for _, c := range crawls {
+			n, err := c.run()
+			count += n
+			if err != nil {
+				// one failing crawl shouldn't hold up the rest
+				LogError(fmt.Errorf("Error running crawl %s in tenant %s: %s", c.ID, t.ID, err))
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+func runningCrawls(t *Tenant) ([]*Crawl, error) {
+	rows, err := sqlCrawlRunning.Tenant(t.ID).Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var crawls []*Crawl
+	for rows.Next() {
+		c, err := scanCrawl(rows)
+		if err != nil {
+			return nil, err
+		}
+		crawls = append(crawls, c)
+	}
+	return crawls, rows.Err()
+}
+
+// crawler runs the next batch of a crawl
+type crawler struct {
+	c          *Crawl
+	collection *Collection
+	count      int // the number of pages found
+	sequence   int // the sequence of the last page found
+}
+
+// crawlSite is what's known about a site being crawled.  It's kept between runs, so the delay between requests holds
+// across runs and crawls of the same site, and robots.txt isn't read again for every batch of pages.  It's removed
+// once every crawl of the site has finished
+type crawlSite struct {
+	robots  *robotsRules
+	expires time.Time       // when robots.txt should be read again
+	last    time.Time       // when the response to the last request arrived
+	crawls  map[string]bool // the ids of the crawls using the site
+}
+
+var crawlSites = struct {
+	sync.Mutex
+	sites map[string]*crawlSite // by scheme and host
+}{sites: make(map[string]*crawlSite)}
+
+// robotsExpiration is how long the rules from a site's robots.txt are used before it's read again
+const robotsExpiration = time.Hour
+
+// siteOf returns the site of the URL, which is kept until the crawl finishes
+func (c *Crawl) siteOf(u *url.URL) *crawlSite {
+	crawlSites.Lock()
+	defer crawlSites.Unlock()
+	key := u.Scheme + "://" + u.Host
+	site, ok := crawlSites.sites[key]
+	if !ok {
+		site = &crawlSite{crawls: make(map[string]bool)}
+		crawlSites.sites[key] = site
+	}
+	site.crawls[c.ID] = true
+	return site
+}
+
+// releaseSites removes the crawl from the sites it used, and removes the sites no other crawl is using
+func (c *Crawl) releaseSites() {
+	crawlSites.Lock()
+	defer crawlSites.Unlock()
+	for key, site := range crawlSites.sites {
+		delete(site.crawls, c.ID)
+		if len(site.crawls) == 0 {
+			delete(crawlSites.sites, key)
+		}
+	}
+}
+
+// run fetches the next pages of the crawl, or imports the next fetched pages once every page has been fetched.
+// A crawl that can't continue, because its creator can no longer create documents, fails
+func (c *Crawl) run() (int, error) {
+	if c.who == nil {
+		who, _, err := userGet(nil, c.TenantID, c.Creator)
+		if IsFailType(err, FailNotFound) {
+			return 0, c.setStatus(CrawlStatusFailed, "The user who started the crawl no longer exists")
+		}
+		if err != nil {
+			return 0, err
+		}
+		c.who = who
+	}
+
+	cr := &crawler{c: c}
+	if c.CollectionID != "" {
+		collection, err := CollectionGet(c.who, c.CollectionID)
+		if IsFail(err) {
+			return 0, c.setStatus(CrawlStatusFailed, err.Error())
+		}
+		if err != nil {
+			return 0, err
+		}
+		cr.collection = collection
+	}
+	if _, err := canCreateDocument(c.who, cr.collection); IsFail(err) {
+		return 0, c.setStatus(CrawlStatusFailed, err.Error())
+	}
+
+	var max sql.NullInt64
+	err := sqlCrawlPageCount.Tenant(c.TenantID).QueryRow(sql.Named("crawl_id", c.ID)).Scan(&cr.count, &max)
+	if err != nil {
+		return 0, err
+	}
+	cr.sequence = int(max.Int64)
+
+	pending, err := c.nextPages(CrawlPageStatusPending)
+	if err != nil {
+		return 0, err
+	}
+	for _, p := range pending {
+		err = cr.fetch(p)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(pending) > 0 {
+		return len(pending), nil
+	}
+
+	fetched, err := c.nextPages(CrawlPageStatusFetched)
+	if err != nil {
+		return 0, err
+	}
+	if len(fetched) == 0 {
+		return 0, c.setStatus(CrawlStatusDone, "")
+	}
+	links, err := cr.links()
+	if err != nil {
+		return 0, err
+	}
+	for _, p := range fetched {
+		err = cr.importPage(p, links)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(fetched), nil
+}
+
+// request sends a request to the site once enough time has passed since the response to the last one.  The delay
+// is counted from the response, so slow responses don't bunch the requests after them together
+func (site *crawlSite) request(u string, delay time.Duration) (*http.Response, error) {
+	if delay > maxCrawlDelay {
+		delay = maxCrawlDelay
+	}
+	if wait := site.last.Add(delay).Sub(time.Now()); wait > 0 {
+		time.Sleep(wait)
+	}
+	res, err := crawlRequest(u)
+	site.last = time.Now()
+	return res, err
+}
+
+// get requests the URL if the site's robots.txt allows it, waiting for the crawl's delay first
+func (cr *crawler) get(u *url.URL) (*http.Response, error) {
+	site := cr.c.siteOf(u)
+	rules := cr.robotsRules(site, u)
+	if !rules.allowed(u.RequestURI()) {
+		return nil, errCrawlDisallowed
+	}
+	delay := cr.c.Delay
+	if rules.delay > delay {
+		delay = rules.delay
+	}
+	return site.request(u.String(), delay)
+}
+
+var errCrawlDisallowed = NewFailure("The site's robots.txt doesn't allow crawling this page")
+
+func crawlRequest(u string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", crawlUserAgent)
+	return crawlClient.Do(req)
+}
+
+// robotsRules returns the rules from the robots.txt of the URL's site.  If a site has no robots.txt every page is
+// allowed, and if it can't be read no page is
+func (cr *crawler) robotsRules(site *crawlSite, u *url.URL) *robotsRules {
+	if site.robots != nil && time.Now().Before(site.expires) {
+		return site.robots
+	}
+
+	rules := &robotsRules{}
+	res, err := site.request(u.Scheme+"://"+u.Host+"/robots.txt", cr.c.Delay)
+	switch {
+	case err != nil:
+		rules.rules = []robotsRule{{allow: false, pattern: robotsPattern("/")}}
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		file, _ := ioutil.ReadAll(io.LimitReader(res.Body, maxImportFileSize))
+		rules = parseRobots(string(file))
+	case res.StatusCode >= 400 && res.StatusCode < 500:
+		// no robots.txt
+	default:
+		rules.rules = []robotsRule{{allow: false, pattern: robotsPattern("/")}}
+	}
+	if res != nil {
+		res.Body.Close()
+	}
+	site.robots = rules
+	site.expires = time.Now().Add(robotsExpiration)
+	return rules
+}
+
+// fetch reads the page, finds the pages it links to, and keeps its main content to import once every page has been
+// fetched
+func (cr *crawler) fetch(p *crawlPage) error {
+	u, err := url.Parse(p.url)
+	if err != nil {
+		p.status = CrawlPageStatusFailed
+		p.message = "The URL is invalid"
+		return cr.c.updatePage(p)
+	}
+
+	res, err := cr.get(u)
+	if err == errCrawlDisallowed {
+		p.status = CrawlPageStatusSkipped
+		p.message = err.Error()
+		return cr.c.updatePage(p)
+	}
+	if err != nil {
+		p.status = CrawlPageStatusFailed
+		p.message = fmt.Sprintf("The page could not be read: %s", err)
+		return cr.c.updatePage(p)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 && res.StatusCode < 400 && res.Header.Get("Location") != "" {
+		return cr.redirect(p, u, res.Header.Get("Location"))
+	}
+	status, message := cr.check(res)
+	if status != "" {
+		p.status = status
+		p.message = message
+		return cr.c.updatePage(p)
+	}
+
+	file, err := ioutil.ReadAll(io.LimitReader(res.Body, maxImportFileSize+1))
+	if err != nil {
+		p.status = CrawlPageStatusFailed
+		p.message = fmt.Sprintf("The page could not be read: %s", err)
+		return cr.c.updatePage(p)
+	}
+	if len(file) > maxImportFileSize {
+		p.status = CrawlPageStatusSkipped
+		p.message = "The page is larger than 32MB"
+		return cr.c.updatePage(p)
+	}
+
+	i := newImportDoc(nil, crawlFile(u))
+	page := i.decodeHTML(file)
+	doc, err := html.Parse(strings.NewReader(page))
+	if err != nil {
+		p.status = CrawlPageStatusFailed
+		p.message = fmt.Sprintf("The page could not be read: %s", err)
+		return cr.c.updatePage(p)
+	}
+
+	base := res.Request.URL
+	if b := findElement(doc, func(n *html.Node) bool { return n.DataAtom == atom.Base }); b != nil {
+		if href, err := base.Parse(attrValue(b, "href")); err == nil {
+			base = href
+		}
+	}
+	follow, index := true, true
+	for _, meta := range findElements(doc, func(n *html.Node) bool { return n.DataAtom == atom.Meta }) {
+		if strings.ToLower(attrValue(meta, "name")) != "robots" {
+			continue
+		}
+		content := strings.ToLower(attrValue(meta, "content"))
+		follow = follow && !strings.Contains(content, "nofollow") && !strings.Contains(content, "none")
+		index = index && !strings.Contains(content, "noindex") && !strings.Contains(content, "none")
+	}
+
+	if follow {
+		for _, a := range findElements(doc, func(n *html.Node) bool { return n.DataAtom == atom.A }) {
+			link, err := base.Parse(strings.TrimSpace(attrValue(a, "href")))
+			if err != nil || !cr.c.inScope(link) {
+				continue
+			}
+			err = cr.found(canonicalURL(link))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	duplicate, err := cr.canonical(p, doc, base)
+	if err != nil {
+		return err
+	}
+	if duplicate != nil {
+		p.status = CrawlPageStatusDuplicate
+		p.duplicateOf = duplicate.key
+		p.message = fmt.Sprintf("The page's canonical URL is %s", duplicate.url)
+		return cr.c.updatePage(p)
+	}
+	if !index {
+		p.status = CrawlPageStatusSkipped
+		p.message = "The page asks not to be indexed"
+		return cr.c.updatePage(p)
+	}
+
+	err = i.html(page)
+	if err != nil {
+		p.status = CrawlPageStatusFailed
+		p.message = fmt.Sprintf("The page could not be read: %s", err)
+		return cr.c.updatePage(p)
+	}
+	hash := sha256.Sum256([]byte(i.body))
+	p.contentHash = hex.EncodeToString(hash[:])
+
+	var key, same string
+	err = sqlCrawlPageHash.Tenant(cr.c.TenantID).QueryRow(
+		sql.Named("crawl_id", cr.c.ID),
+		sql.Named("hash", p.contentHash),
+	).Scan(&key, &same)
+	if err == nil {
+		p.status = CrawlPageStatusDuplicate
+		p.duplicateOf = key
+		p.message = fmt.Sprintf("The page has the same content as %s", same)
+		return cr.c.updatePage(p)
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	p.status = CrawlPageStatusFetched
+	p.title = i.title
+	p.summary = i.summary
+	p.body = i.body
+	p.message = strings.Join(i.warnings, "\n")
+	return cr.c.updatePage(p)
+}
+
+// check returns the status of a page that can't be imported from its response
+func (cr *crawler) check(res *http.Response) (status, message string) {
+	if res.StatusCode != http.StatusOK {
+		return CrawlPageStatusFailed, fmt.Sprintf("The site responded with %s", res.Status)
+	}
+	contentType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if contentType != "text/html" && contentType != "application/xhtml+xml" {
+		return CrawlPageStatusSkipped, fmt.Sprintf("The page is not HTML, it's %s", contentType)
+	}
+	return "", ""
+}
+
+// redirect records a page that redirects as a duplicate of the page it redirects to, which is added to the crawl
+// if it's within its scope
+func (cr *crawler) redirect(p *crawlPage, u *url.URL, location string) error {
+	target, err := u.Parse(location)
+	if err != nil || !cr.c.inScope(target) {
+		p.status = CrawlPageStatusSkipped
+		p.message = fmt.Sprintf("The page redirects to %s, which is outside of the crawl", location)
+		return cr.c.updatePage(p)
+	}
+	canonical := canonicalURL(target)
+	if canonical == p.url {
+		p.status = CrawlPageStatusFailed
+		p.message = "The page redirects to itself"
+		return cr.c.updatePage(p)
+	}
+	err = cr.found(canonical)
+	if err != nil {
+		return err
+	}
+	p.status = CrawlPageStatusDuplicate
+	p.duplicateOf = crawlKey(canonical)
+	p.message = fmt.Sprintf("The page redirects to %s", canonical)
+	return cr.c.updatePage(p)
+}
+
+// canonical returns the page this page is a duplicate of, if it names a different canonical URL that was already
+// found.  If the canonical URL wasn't found yet, it's recorded as a duplicate of this page, so it's never fetched
+// and links to it link to this page
+func (cr *crawler) canonical(p *crawlPage, doc *html.Node, base *url.URL) (*crawlPage, error) {
+	link := findElement(doc, func(n *html.Node) bool {
+		return n.DataAtom == atom.Link && strings.ToLower(attrValue(n, "rel")) == "canonical"
+	})
+	if link == nil {
+		return nil, nil
+	}
+	u, err := base.Parse(attrValue(link, "href"))
+	if err != nil || !cr.c.inScope(u) {
+		return nil, nil
+	}
+	canonical := canonicalURL(u)
+	if canonical == p.url {
+		return nil, nil
+	}
+
+	existing, err := cr.c.page(crawlKey(canonical))
+	if err == nil {
+		return existing, nil
+	}
+	if !IsFailType(err, FailNotFound) {
+		return nil, err
+	}
+	cr.sequence++
+	return nil, cr.c.insertPage(nil, canonical, cr.sequence, CrawlPageStatusDuplicate, p.key)
+}
+
+// found adds a page to the crawl, if it hasn't been found already
+func (cr *crawler) found(canonical string) error {
+	if cr.count >= maxCrawlPages {
+		return nil
+	}
+	_, err := cr.c.page(crawlKey(canonical))
+	if err == nil {
+		return nil
+	}
+	if !IsFailType(err, FailNotFound) {
+		return err
+	}
+	cr.sequence++
+	cr.count++
+	return cr.c.insertPage(nil, canonical, cr.sequence, CrawlPageStatusPending, "")
+}
+
+// crawlLink is where a link to a page of the crawl points
+type crawlLink struct {
+	status      string
+	documentID  string
+	duplicateOf string
+}
+
+// links loads where the links to every page of the crawl point
+func (cr *crawler) links() (map[string]crawlLink, error) {
+	rows, err := sqlCrawlPageLinks.Tenant(cr.c.TenantID).Query(sql.Named("crawl_id", cr.c.ID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := make(map[string]crawlLink)
+	for rows.Next() {
+		key := ""
+		l := crawlLink{}
+		var duplicateOf sql.NullString
+		err = rows.Scan(&key, &l.status, &l.documentID, &duplicateOf)
+		if err != nil {
+			return nil, err
+		}
+		l.duplicateOf = duplicateOf.String
+		links[key] = l
+	}
+	return links, rows.Err()
+}
+
+// documentID returns the id of the document the page at the URL is imported as, following duplicates to the page
+// that was imported
+func documentID(links map[string]crawlLink, canonical string) (string, bool) {
+	l, ok := links[crawlKey(canonical)]
+	for i := 0; ok && l.status == CrawlPageStatusDuplicate && i < maxCrawlRedirects; i++ {
+		l, ok = links[l.duplicateOf]
+	}
+	if !ok || (l.status != CrawlPageStatusFetched && l.status != CrawlPageStatusImported) {
+		return "", false
+	}
+	return l.documentID, true
+}
+
+// importPage creates the document of a fetched page, with its links to other pages pointing at their documents
+func (cr *crawler) importPage(p *crawlPage, links map[string]crawlLink) error {
+	u, err := url.Parse(p.url)
+	if err != nil {
+		return err
+	}
+	i := newImportDoc(&crawlSource{cr: cr, site: &url.URL{Scheme: u.Scheme, Host: u.Host}}, crawlFile(u))
+	i.id = p.documentID
+	i.title = p.title
+	i.summary = p.summary
+	i.body = rewriteLinks(p.body, func(element atom.Atom, link string) (string, bool) {
+		return crawlLinkTo(cr.c, links, u, i.file, element, link)
+	})
+
+	result, err := i.create(cr.c.who, cr.collection)
+	if IsFail(err) {
+		p.status = CrawlPageStatusFailed
+		p.message = err.Error()
+		return cr.c.updatePage(p)
+	}
+	if err != nil {
+		return err
+	}
+	p.status = CrawlPageStatusImported
+	p.body = ""
+	p.summary = ""
+	p.message = strings.Join(append(strings.Split(p.message, "\n"), result.Warnings...), "\n")
+	p.message = strings.TrimSpace(p.message)
+	return cr.c.updatePage(p)
+}
+
+// crawlLinkTo rewrites a link on a page.  Links to pages that are imported link to their documents, and links to
+// files on the same site are made relative to the page's file, so they're attached to the document.  Every other
+// link is made absolute, so it still points to the site
+func crawlLinkTo(c *Crawl, links map[string]crawlLink, page *url.URL, file string, element atom.Atom,
+	link string) (string, bool) {
+	link = strings.TrimSpace(link)
+	if strings.HasPrefix(link, "#") {
+		return "", false
+	}
+	u, err := page.Parse(link)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", false
+	}
+
+	if element == atom.A {
+		if c.inScope(u) {
+			if id, ok := documentID(links, canonicalURL(u)); ok {
+				if u.Fragment != "" {
+					return documentLink(id) + "#" + u.Fragment, true
+				}
+				return documentLink(id), true
+			}
+		}
+		return u.String(), true
+	}
+
+	if u.Scheme != page.Scheme || u.Host != page.Host || u.RawQuery != "" {
+		return u.String(), true
+	}
+	dir := path.Dir(file)
+	rel := strings.TrimPrefix(u.Path, "/")
+	if dir != "." {
+		rel = strings.Repeat("../", strings.Count(dir, "/")+1) + rel
+	}
+	return (&url.URL{Path: rel, Fragment: u.Fragment}).String(), true
+}
+
+// crawlFile returns the path of the page on its site, as the file it's imported from.  Pages at directories are
+// index.html in their directory
+func crawlFile(u *url.URL) string {
+	file := strings.TrimPrefix(u.Path, "/")
+	if file == "" || strings.HasSuffix(file, "/") {
+		file += "index.html"
+	}
+	return path.Clean(file)
+}
+
+// crawlSource is an import source of the files on a site, following the crawl's robots.txt and delay
+type crawlSource struct {
+	cr   *crawler
+	site *url.URL
+}
+
+func (s *crawlSource) Open(name string) (io.ReadCloser, error) {
+	u := *s.site
+	u.Path = "/" + name
+	res, err := s.cr.get(&u)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone {
+		return nil, os.ErrNotExist
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the site responded with %s", res.Status)
+	}
+	file, err := ioutil.ReadAll(io.LimitReader(res.Body, maxImportFileSize))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(file)), nil
+}
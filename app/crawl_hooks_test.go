@@ -0,0 +1,26 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"context"
+	"net"
+)
+
+// AllowCrawlLoopback lets crawls connect to sites served on the loopback address by httptest, which they can't
+// outside of tests
+func AllowCrawlLoopback(allow bool) {
+	crawlAllowLoopback = allow
+}
+
+// CrawlSiteCount returns the number of sites crawls are keeping track of
+func CrawlSiteCount() int {
+	crawlSites.Lock()
+	defer crawlSites.Unlock()
+	return len(crawlSites.sites)
+}
+
+// DialCrawl connects to the address the way crawls do
+func DialCrawl(address string) (net.Conn, error) {
+	return dialCrawl(context.Background(), "tcp", address)
+}
@@ -0,0 +1,353 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lexLibrary/lexLibrary/app"
+)
+
+// testSite is a web site for crawling, which records the requests made to it
+type testSite struct {
+	sync.Mutex
+	requests map[string]int
+	times    []time.Time
+}
+
+func (s *testSite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	s.requests[r.URL.RequestURI()]++
+	s.times = append(s.times, time.Now())
+	s.Unlock()
+
+	if r.UserAgent() != "LexLibrary" {
+		http.Error(w, "Unexpected user agent", http.StatusBadRequest)
+		return
+	}
+
+	page := func(title, body string) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(`<html><head><title>` + title + ` - Test Site</title></head><body>
+			<nav><a href="/docs/">Home</a> <a href="/">Site</a></nav>
+			<article>` + body + `</article></body></html>`))
+	}
+	usage := `<h1>Usage</h1><p>Run it with <a href="old">the old flags</a>.</p>`
+
+	switch r.URL.Path {
+	case "/robots.txt":
+		w.Write([]byte("User-agent: *\nDisallow: /docs/private/\n"))
+	case "/docs/":
+		page("Docs", `<h1>Docs</h1><p>Start with the <a href="install?utm_source=nav">install guide</a>, then `+
+			`read <a href="/docs/usage#flags">the usage</a>.  Skip the <a href="private/secret">secrets</a>, `+
+			`<a href="copy">the copy</a>, <a href="notes.txt">the notes</a> and `+
+			`<a href="https://example.com/">elsewhere</a>.</p>`)
+	case "/docs/install":
+		page("Install", `<h1>Install</h1><p><img src="images/setup.png" alt="Setup"></p>`+
+			`<p>Then <a href="../docs/">go back</a>.</p>`)
+	case "/docs/usage", "/docs/copy":
+		page("Usage", usage)
+	case "/docs/old":
+		http.Redirect(w, r, "/docs/usage", http.StatusMovedPermanently)
+	case "/docs/notes.txt":
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("notes"))
+	case "/docs/images/setup.png":
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("\x89PNG\r\n\x1a\nnot really a png"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestCrawl(t *testing.T) {
+	resetDocuments(t)
+
+	tenant, err := app.TenantNew(installAdmin(t), "Crawl Tenant", "", "")
+	if err != nil {
+		t.Fatalf("Error creating tenant: %s", err)
+	}
+	author := testUser(t, tenant, "author")
+	other := testUser(t, tenant, "other")
+
+	site := &testSite{requests: make(map[string]int)}
+	server := httptest.NewServer(site)
+	defer server.Close()
+
+	t.Run("Private Addresses", func(t *testing.T) {
+		for _, seed := range []string{server.URL + "/docs/", "http://169.254.169.254/latest/meta-data/",
+			"http://10.1.2.3/", "http://[::1]/", "http://[fd00:ec2::254]/", "http://0.0.0.0/",
+			"http://[64:ff9b::a9fe:a9fe]/", "http://[64:ff9b::7f00:1]/", "http://[2002:a01:203::]/",
+			"http://[2002:c0a8:101::1]/"} {
+			_, err := app.CrawlNew(author, nil, seed, "", 0)
+			if !app.IsFailType(err, app.FailInvalid) {
+				t.Fatalf("Expected invalid failure crawling %s, got %v", seed, err)
+			}
+		}
+
+		// IPv6 addresses that reach an embedded IPv4 address are checked by that address when dialed
+		for _, address := range []string{"[64:ff9b::a9fe:a9fe]:80", "[64:ff9b::a01:203]:80",
+			"[2002:a9fe:a9fe::]:80", "[2002:7f00:1::1]:80"} {
+			_, err := app.DialCrawl(address)
+			if !app.IsFailType(err, app.FailInvalid) {
+				t.Fatalf("Expected invalid failure dialing %s, got %v", address, err)
+			}
+		}
+
+		// a host name is checked when the crawl connects to it, every time it connects
+		u, err := url.Parse(server.URL)
+		if err != nil {
+			t.Fatalf("Error parsing server URL: %s", err)
+		}
+		c, err := app.CrawlNew(author, nil, "http://localhost:"+u.Port()+"/docs/", "", 0)
+		if err != nil {
+			t.Fatalf("Error starting crawl: %s", err)
+		}
+		for runs := 0; c.Status == app.CrawlStatusRunning; runs++ {
+			if runs > 5 {
+				t.Fatalf("Crawl didn't finish")
+			}
+			_, err = app.CrawlPending()
+			if err != nil {
+				t.Fatalf("Error running crawls: %s", err)
+			}
+			c, err = app.CrawlGet(author, c.ID)
+			if err != nil {
+				t.Fatalf("Error getting crawl: %s", err)
+			}
+		}
+		if len(site.requests) != 0 {
+			t.Fatalf("A crawl connected to the loopback address: %v", site.requests)
+		}
+		pages, err := c.Pages(0, 10)
+		if err != nil {
+			t.Fatalf("Error getting pages: %s", err)
+		}
+		if len(pages) != 1 || pages[0].Status == app.CrawlPageStatusImported {
+			t.Fatalf("A page on the loopback address was imported: %+v", pages)
+		}
+		if app.CrawlSiteCount() != 0 {
+			t.Fatalf("A finished crawl's sites were kept: %d", app.CrawlSiteCount())
+		}
+	})
+
+	app.AllowCrawlLoopback(true)
+	defer app.AllowCrawlLoopback(false)
+
+	t.Run("New", func(t *testing.T) {
+		for _, seed := range []string{"", "ftp://example.com/", "/docs/"} {
+			_, err := app.CrawlNew(author, nil, seed, "", 0)
+			if !app.IsFailType(err, app.FailInvalid) {
+				t.Fatalf("Expected invalid failure for seed %q, got %v", seed, err)
+			}
+		}
+		for _, scope := range []string{"com", "co.uk", ".com.", "github.io", "https://", "http:///docs/"} {
+			_, err := app.CrawlNew(author, nil, "https://docs.example.com/guide/", scope, 0)
+			if !app.IsFailType(err, app.FailInvalid) {
+				t.Fatalf("Expected invalid failure for scope %q, got %v", scope, err)
+			}
+		}
+		c, err := app.CrawlNew(author, nil, "https://docs.example.com/guide/", "https://docs.example.com", 0)
+		if err != nil {
+			t.Fatalf("Error starting crawl: %s", err)
+		}
+		if c.Scope != "https://docs.example.com/" {
+			t.Fatalf("A URL prefix scope without a path can match other hosts: %s", c.Scope)
+		}
+		err = c.Cancel()
+		if err != nil {
+			t.Fatalf("Error canceling crawl: %s", err)
+		}
+		_, err = app.CrawlNew(author, nil, server.URL+"/blog/", server.URL+"/docs/", 0)
+		if !app.IsFailType(err, app.FailInvalid) {
+			t.Fatalf("Expected invalid failure for a seed outside of the scope, got %v", err)
+		}
+		_, err = app.CrawlNew(nil, nil, server.URL+"/docs/", "", 0)
+		if !app.IsFailType(err, app.FailUnauthorized) {
+			t.Fatalf("Expected unauthorized without a user, got %v", err)
+		}
+	})
+
+	const delay = 20 * time.Millisecond
+	crawl, err := app.CrawlNew(author, nil, server.URL+"/docs/", "", delay)
+	if err != nil {
+		t.Fatalf("Error starting crawl: %s", err)
+	}
+	if crawl.Scope != server.URL+"/docs/" || crawl.Status != app.CrawlStatusRunning {
+		t.Fatalf("Invalid crawl: %+v", crawl)
+	}
+
+	t.Run("Get", func(t *testing.T) {
+		_, err := app.CrawlGet(other, crawl.ID)
+		if !app.IsFailType(err, app.FailNotFound) {
+			t.Fatalf("Expected not found getting another user's crawl, got %v", err)
+		}
+		got, err := app.CrawlGet(author, crawl.ID)
+		if err != nil {
+			t.Fatalf("Error getting crawl: %s", err)
+		}
+		if got.SeedURL != crawl.SeedURL || got.Delay != delay {
+			t.Fatalf("Invalid crawl. Wanted %+v got %+v", crawl, got)
+		}
+	})
+
+	t.Run("Run", func(t *testing.T) {
+		// every run starts from what's in the database, as it would after a restart
+		for runs := 0; crawl.Status == app.CrawlStatusRunning; runs++ {
+			if runs > 20 {
+				t.Fatalf("Crawl didn't finish")
+			}
+			_, err := app.CrawlPending()
+			if err != nil {
+				t.Fatalf("Error running crawls: %s", err)
+			}
+			crawl, err = app.CrawlGet(author, crawl.ID)
+			if err != nil {
+				t.Fatalf("Error getting crawl: %s", err)
+			}
+		}
+		if crawl.Status != app.CrawlStatusDone {
+			t.Fatalf("Crawl %s: %s", crawl.Status, crawl.Message)
+		}
+
+		if app.CrawlSiteCount() != 0 {
+			t.Fatalf("A finished crawl's sites were kept: %d", app.CrawlSiteCount())
+		}
+
+		for uri, count := range site.requests {
+			if count != 1 {
+				t.Fatalf("%s was requested %d times", uri, count)
+			}
+		}
+		for _, uri := range []string{"/docs/private/secret", "/", "/docs/install?utm_source=nav"} {
+			if site.requests[uri] != 0 {
+				t.Fatalf("%s should not have been requested", uri)
+			}
+		}
+		for i := 1; i < len(site.times); i++ {
+			if site.times[i].Sub(site.times[i-1]) < delay-time.Millisecond {
+				t.Fatalf("Requests %d and %d were only %s apart", i-1, i, site.times[i].Sub(site.times[i-1]))
+			}
+		}
+	})
+
+	pages, err := crawl.Pages(0, 100)
+	if err != nil {
+		t.Fatalf("Error getting pages: %s", err)
+	}
+	docs := make(map[string]string)
+
+	t.Run("Pages", func(t *testing.T) {
+		expected := []struct {
+			path   string
+			status string
+		}{
+			{"/docs/", app.CrawlPageStatusImported},
+			{"/docs/install", app.CrawlPageStatusImported},
+			{"/docs/usage", app.CrawlPageStatusImported},
+			{"/docs/private/secret", app.CrawlPageStatusSkipped},
+			{"/docs/copy", app.CrawlPageStatusDuplicate},
+			{"/docs/notes.txt", app.CrawlPageStatusSkipped},
+			{"/docs/old", app.CrawlPageStatusDuplicate},
+		}
+		if len(pages) != len(expected) {
+			t.Fatalf("Expected %d pages, got %d: %+v", len(expected), len(pages), pages)
+		}
+		for i := range expected {
+			p := pages[i]
+			if p.URL != server.URL+expected[i].path || p.Status != expected[i].status {
+				t.Fatalf("Invalid page %d. Wanted %s %s, got %s %s: %s", i, expected[i].path,
+					expected[i].status, p.URL, p.Status, p.Message)
+			}
+			if (p.DocumentID != "") != (p.Status == app.CrawlPageStatusImported) {
+				t.Fatalf("Invalid document id for %s: %q", p.URL, p.DocumentID)
+			}
+			docs[expected[i].path] = p.DocumentID
+		}
+		if !strings.Contains(pages[4].Message, server.URL+"/docs/usage") {
+			t.Fatalf("Invalid duplicate message: %s", pages[4].Message)
+		}
+	})
+
+	t.Run("Documents", func(t *testing.T) {
+		doc, err := app.DocumentGet(author, docs["/docs/"])
+		if err != nil {
+			t.Fatalf("Error getting document: %s", err)
+		}
+		rev, err := doc.Latest()
+		if err != nil {
+			t.Fatalf("Error getting revision: %s", err)
+		}
+		if rev.Title != "Docs" {
+			t.Fatalf("Invalid title: %q", rev.Title)
+		}
+		for _, link := range []string{
+			`href="../` + docs["/docs/install"] + `/"`,
+			`href="../` + docs["/docs/usage"] + `/#flags"`,
+			`href="../` + docs["/docs/usage"] + `/"`,
+			`href="` + server.URL + `/docs/private/secret"`,
+			`href="` + server.URL + `/docs/notes.txt"`,
+			`href="https://example.com/"`,
+		} {
+			if !strings.Contains(rev.Body, link) {
+				t.Fatalf("Body is missing the link %s:\n%s", link, rev.Body)
+			}
+		}
+		if strings.Contains(rev.Body, "Home") {
+			t.Fatalf("Site navigation was imported:\n%s", rev.Body)
+		}
+
+		doc, err = app.DocumentGet(author, docs["/docs/install"])
+		if err != nil {
+			t.Fatalf("Error getting document: %s", err)
+		}
+		rev, err = doc.Latest()
+		if err != nil {
+			t.Fatalf("Error getting revision: %s", err)
+		}
+		attachments, err := doc.Attachments()
+		if err != nil {
+			t.Fatalf("Error getting attachments: %s", err)
+		}
+		if len(attachments) != 1 || attachments[0].Name != "setup.png" {
+			t.Fatalf("Invalid attachments: %+v", attachments)
+		}
+		for _, link := range []string{
+			`src="` + attachments[0].URL() + `"`,
+			`href="../` + docs["/docs/"] + `/"`,
+		} {
+			if !strings.Contains(rev.Body, link) {
+				t.Fatalf("Body is missing the link %s:\n%s", link, rev.Body)
+			}
+		}
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		err := crawl.Cancel()
+		if !app.IsFailType(err, app.FailInvalid) {
+			t.Fatalf("Expected invalid failure canceling a finished crawl, got %v", err)
+		}
+
+		c, err := app.CrawlNew(author, nil, server.URL+"/docs/", "", 0)
+		if err != nil {
+			t.Fatalf("Error starting crawl: %s", err)
+		}
+		err = c.Cancel()
+		if err != nil {
+			t.Fatalf("Error canceling crawl: %s", err)
+		}
+		count, err := app.CrawlPending()
+		if err != nil {
+			t.Fatalf("Error running crawls: %s", err)
+		}
+		if count != 0 {
+			t.Fatalf("A canceled crawl fetched %d pages", count)
+		}
+	})
+}
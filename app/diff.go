@@ -0,0 +1,493 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"strings"
+	"unicode"
+)
+
+// DiffMode determines how the text of revisions is split up before comparing
+type DiffMode int
+
+// Diff modes
+const (
+	DiffLines DiffMode = iota // compare whole lines of text
+	DiffWords                 // compare individual words
+)
+
+// DiffOpType is the type of change in a diff
+type DiffOpType int
+
+// Diff operation types
+const (
+	DiffEqual DiffOpType = iota
+	DiffInsert
+	DiffDelete
+)
+
+// maxDiffEdits is the most changes that will be individually tracked between two revisions.  Revisions with more
+// differences than this are shown as entirely replaced, to keep the time and memory spent diffing bounded
+const maxDiffEdits = 2000
+
+// minMovedWords is the fewest words a block of text can have to be detected as moved
+const minMovedWords = 3
+
+// DiffOp is a run of text that is either the same, inserted, or deleted between two revisions
+type DiffOp struct {
+	Type DiffOpType
+	Text string
+	// Move is non-zero if the text was moved rather than inserted or deleted.  The deleted and inserted ops of
+	// the moved text share the same Move number
+	Move int
+}
+
+// Diff is the difference between two revisions of a document. Revisions are compared by their text, not their markup
+type Diff struct {
+	From  *Revision
+	To    *Revision
+	Mode  DiffMode
+	Title []DiffOp
+	Body  []DiffOp
+}
+
+// Diff compares two revisions of the document
+func (d *Document) Diff(from, to int, mode DiffMode) (*Diff, error) {
+	if mode != DiffLines && mode != DiffWords {
+		return nil, NewFailure("Invalid diff mode")
+	}
+
+	fromRev, err := d.Revision(from)
+	if err != nil {
+		return nil, err
+	}
+	toRev, err := d.Revision(to)
+	if err != nil {
+		return nil, err
+	}
+
+	return diffRevisions(fromRev, toRev, mode), nil
+}
+
+func diffRevisions(from, to *Revision, mode DiffMode) *Diff {
+	split := splitLines
+	if mode == DiffWords {
+		split = splitWords
+	}
+
+	diff := &Diff{
+		From:  from,
+		To:    to,
+		Mode:  mode,
+		Title: diffTokens(splitWords(from.Title), splitWords(to.Title)),
+		Body:  diffTokens(split(htmlToText(from.Body)), split(htmlToText(to.Body))),
+	}
+	detectMoves(diff.Body, mode)
+	return diff
+}
+
+// Changed returns whether or not there are any differences between the revisions
+func (d *Diff) Changed() bool {
+	for _, ops := range [][]DiffOp{d.Title, d.Body} {
+		for i := range ops {
+			if ops[i].Type != DiffEqual {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// splitLines splits text into lines, keeping the line endings with each line
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// splitWords splits text into words, runs of whitespace, and individual punctuation characters, so that joining
+// the tokens back together returns the original text
+func splitWords(text string) []string {
+	var tokens []string
+	start := 0
+	class := -1
+
+	classOf := func(r rune) int {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '\'':
+			return 0
+		case unicode.IsSpace(r):
+			return 1
+		default:
+			return 2
+		}
+	}
+
+	for i, r := range text {
+		c := classOf(r)
+		if i > start && (c != class || c == 2) {
+			tokens = append(tokens, text[start:i])
+			start = i
+		}
+		class = c
+	}
+	if start < len(text) {
+		tokens = append(tokens, text[start:])
+	}
+	return tokens
+}
+
+// diffTokens finds the shortest set of inserts and deletes to turn a into b using Myers' diff algorithm
+// http://www.xmailserver.org/diff2.pdf
+func diffTokens(a, b []string) []DiffOp {
+	var ops []DiffOp
+
+	// common prefix and suffix don't need to go through the diff
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	ops = appendOps(ops, DiffEqual, a[:prefix]...)
+	for _, op := range mergeChanges(myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])) {
+		ops = appendOps(ops, op.Type, op.Text)
+	}
+	ops = appendOps(ops, DiffEqual, a[len(a)-suffix:]...)
+
+	return ops
+}
+
+// mergeChanges combines changes that are only separated by whitespace into a single delete and insert, so that
+// replaced sentences read as one change instead of alternating single words
+func mergeChanges(ops []DiffOp) []DiffOp {
+	var merged []DiffOp
+	for i := 0; i < len(ops); {
+		if ops[i].Type == DiffEqual {
+			merged = append(merged, ops[i])
+			i++
+			continue
+		}
+
+		deleted, inserted := &bytes.Buffer{}, &bytes.Buffer{}
+		end := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].Type == DiffEqual {
+				if strings.TrimSpace(ops[j].Text) != "" {
+					break
+				}
+				continue
+			}
+			end = j
+		}
+
+		for _, op := range ops[i : end+1] {
+			if op.Type != DiffInsert {
+				deleted.WriteString(op.Text)
+			}
+			if op.Type != DiffDelete {
+				inserted.WriteString(op.Text)
+			}
+		}
+		if deleted.Len() > 0 {
+			merged = append(merged, DiffOp{Type: DiffDelete, Text: deleted.String()})
+		}
+		if inserted.Len() > 0 {
+			merged = append(merged, DiffOp{Type: DiffInsert, Text: inserted.String()})
+		}
+		i = end + 1
+	}
+	return merged
+}
+
+func myers(a, b []string) []DiffOp {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		var ops []DiffOp
+		ops = appendOps(ops, DiffDelete, a...)
+		return appendOps(ops, DiffInsert, b...)
+	}
+
+	max := n + m
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	var trace [][]int
+
+	for d := 0; d <= max; d++ {
+		if d > maxDiffEdits {
+			var ops []DiffOp
+			ops = appendOps(ops, DiffDelete, a...)
+			return appendOps(ops, DiffInsert, b...)
+		}
+
+		// only the diagonals reachable in d steps need to be kept
+		step := make([]int, 2*d+3)
+		copy(step, v[offset-d-1:offset+d+2])
+		trace = append(trace, step)
+
+		for k := -d; k <= d; k += 2 {
+			x := 0
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return myersBacktrack(a, b, trace)
+			}
+		}
+	}
+	// unreachable, the diff always completes in n+m steps
+	return nil
+}
+
+func myersBacktrack(a, b []string, trace [][]int) []DiffOp {
+	var reversed []DiffOp
+	x, y := len(a), len(b)
+
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		get := func(k int) int {
+			return v[k+d+1]
+		}
+		k := x - y
+
+		prevK := 0
+		if k == -d || (k != d && get(k-1) < get(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := get(prevK)
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			reversed = append(reversed, DiffOp{Type: DiffEqual, Text: a[x-1]})
+			x--
+			y--
+		}
+
+		if d > 0 {
+			if x == prevX {
+				reversed = append(reversed, DiffOp{Type: DiffInsert, Text: b[y-1]})
+			} else {
+				reversed = append(reversed, DiffOp{Type: DiffDelete, Text: a[x-1]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	var ops []DiffOp
+	for i := len(reversed) - 1; i >= 0; i-- {
+		ops = appendOps(ops, reversed[i].Type, reversed[i].Text)
+	}
+	return ops
+}
+
+// appendOps appends the tokens to the ops, merging them into the last op if it's the same type
+func appendOps(ops []DiffOp, opType DiffOpType, tokens ...string) []DiffOp {
+	for _, token := range tokens {
+		if len(ops) > 0 && ops[len(ops)-1].Type == opType {
+			ops[len(ops)-1].Text += token
+			continue
+		}
+		ops = append(ops, DiffOp{Type: opType, Text: token})
+	}
+	return ops
+}
+
+// detectMoves marks deleted and inserted blocks of identical text as moved
+func detectMoves(ops []DiffOp, mode DiffMode) {
+	move := 0
+	for i := range ops {
+		if ops[i].Type != DiffDelete || ops[i].Move != 0 {
+			continue
+		}
+		words := strings.Fields(ops[i].Text)
+		if len(words) == 0 || (mode == DiffWords && len(words) < minMovedWords) {
+			continue
+		}
+		normalized := strings.Join(words, " ")
+
+		for j := range ops {
+			if ops[j].Type != DiffInsert || ops[j].Move != 0 {
+				continue
+			}
+			if strings.Join(strings.Fields(ops[j].Text), " ") == normalized {
+				move++
+				ops[i].Move = move
+				ops[j].Move = move
+				break
+			}
+		}
+	}
+}
+
+// Unified returns the diff as text.  Line diffs are in the unified diff format with the passed in number of lines
+// of context around each change.  Word diffs mark deleted text as [-text-] and inserted text as {+text+}
+func (d *Diff) Unified(context int) string {
+	buff := &bytes.Buffer{}
+
+	fmt.Fprintf(buff, "--- Revision %d\n+++ Revision %d\n", d.From.Revision, d.To.Revision)
+	if d.From.Title != d.To.Title {
+		buff.WriteString("Title: ")
+		writeWordDiff(buff, d.Title)
+		buff.WriteString("\n")
+	}
+
+	if d.Mode == DiffWords {
+		writeWordDiff(buff, d.Body)
+		return buff.String()
+	}
+
+	writeUnifiedLines(buff, d.Body, context)
+	return buff.String()
+}
+
+func writeWordDiff(buff *bytes.Buffer, ops []DiffOp) {
+	for _, op := range ops {
+		switch op.Type {
+		case DiffEqual:
+			buff.WriteString(op.Text)
+		case DiffDelete:
+			buff.WriteString("[-" + op.Text + "-]")
+		case DiffInsert:
+			buff.WriteString("{+" + op.Text + "+}")
+		}
+	}
+}
+
+type diffLine struct {
+	opType DiffOpType
+	text   string
+}
+
+func writeUnifiedLines(buff *bytes.Buffer, ops []DiffOp, context int) {
+	if context < 0 {
+		context = 0
+	}
+
+	var lines []diffLine
+	for _, op := range ops {
+		for _, line := range splitLines(op.Text) {
+			lines = append(lines, diffLine{opType: op.Type, text: strings.TrimSuffix(line, "\n")})
+		}
+	}
+
+	for i := 0; i < len(lines); {
+		if lines[i].opType == DiffEqual {
+			i++
+			continue
+		}
+
+		// find the extent of the hunk, merging changes that are within the context of each other
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(lines); j++ {
+			if lines[j].opType != DiffEqual {
+				end = j
+			} else if j-end > context*2 {
+				break
+			}
+		}
+		end += context
+		if end >= len(lines) {
+			end = len(lines) - 1
+		}
+
+		fromStart, toStart := 1, 1
+		for _, l := range lines[:start] {
+			if l.opType != DiffInsert {
+				fromStart++
+			}
+			if l.opType != DiffDelete {
+				toStart++
+			}
+		}
+		fromLen, toLen := 0, 0
+		for _, l := range lines[start : end+1] {
+			if l.opType != DiffInsert {
+				fromLen++
+			}
+			if l.opType != DiffDelete {
+				toLen++
+			}
+		}
+		if fromLen == 0 {
+			fromStart--
+		}
+		if toLen == 0 {
+			toStart--
+		}
+
+		fmt.Fprintf(buff, "@@ -%d,%d +%d,%d @@\n", fromStart, fromLen, toStart, toLen)
+		for _, l := range lines[start : end+1] {
+			switch l.opType {
+			case DiffEqual:
+				buff.WriteString(" ")
+			case DiffDelete:
+				buff.WriteString("-")
+			case DiffInsert:
+				buff.WriteString("+")
+			}
+			buff.WriteString(l.text + "\n")
+		}
+
+		i = end + 1
+	}
+}
+
+// HTML returns the diff as HTML with inserted text in <ins> elements and deleted text in <del> elements.  Moved text
+// has the class "moved" and a data-move attribute linking the deleted and inserted text.  Line breaks are left as
+// newline characters, so the diff should be displayed with white-space: pre-wrap
+func (d *Diff) HTML() string {
+	buff := &bytes.Buffer{}
+	buff.WriteString(`<div class="diff-title">`)
+	writeHTMLDiff(buff, d.Title)
+	buff.WriteString(`</div><div class="diff-body">`)
+	writeHTMLDiff(buff, d.Body)
+	buff.WriteString(`</div>`)
+	return buff.String()
+}
+
+func writeHTMLDiff(buff *bytes.Buffer, ops []DiffOp) {
+	for _, op := range ops {
+		tag := ""
+		switch op.Type {
+		case DiffEqual:
+			buff.WriteString(html.EscapeString(op.Text))
+			continue
+		case DiffDelete:
+			tag = "del"
+		case DiffInsert:
+			tag = "ins"
+		}
+		if op.Move != 0 {
+			fmt.Fprintf(buff, `<%s class="moved" data-move="%d">`, tag, op.Move)
+		} else {
+			fmt.Fprintf(buff, "<%s>", tag)
+		}
+		buff.WriteString(html.EscapeString(op.Text))
+		fmt.Fprintf(buff, "</%s>", tag)
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/lexLibrary/lexLibrary/app"
+)
+
+func TestDiff(t *testing.T) {
+	resetDocuments(t)
+
+	tenant, err := app.TenantNew(installAdmin(t), "Diff Tenant", "", "")
+	if err != nil {
+		t.Fatalf("Error creating tenant: %s", err)
+	}
+	author1 := testUser(t, tenant, "author1")
+	author2 := testUser(t, tenant, "author2")
+
+	doc, err := app.DocumentNew(author1, nil, "Diff Document",
+		"<h1>Heading</h1><p>The quick brown fox</p><p>jumps over the lazy dog</p><p>Last line</p>")
+	if err != nil {
+		t.Fatalf("Error creating document: %s", err)
+	}
+
+	save := func(title, body string) {
+		draft, err := doc.Edit()
+		if err != nil {
+			t.Fatalf("Error starting draft: %s", err)
+		}
+		err = draft.Update(title, body)
+		if err != nil {
+			t.Fatalf("Error updating draft: %s", err)
+		}
+		_, err = draft.Save()
+		if err != nil {
+			t.Fatalf("Error saving draft: %s", err)
+		}
+		doc, err = app.DocumentGet(author1, doc.ID)
+		if err != nil {
+			t.Fatalf("Error getting document: %s", err)
+		}
+	}
+
+	// revision 2
+	save("Diff Document Changed",
+		"<h1>Heading</h1><p>The quick red fox</p><p>jumps over the lazy dog</p><p>Last line</p>")
+	// revision 3
+	save("Diff Document Changed",
+		"<p>jumps over the lazy dog</p><h1>Heading</h1><p>The quick red fox</p><p>Last line</p>")
+
+	t.Run("Lines", func(t *testing.T) {
+		diff, err := doc.Diff(1, 2, app.DiffLines)
+		if err != nil {
+			t.Fatalf("Error diffing revisions: %s", err)
+		}
+		if !diff.Changed() {
+			t.Fatalf("Diff of changed revisions reported no changes")
+		}
+
+		expected := "--- Revision 1\n+++ Revision 2\n" +
+			"Title: Diff Document{+ Changed+}\n" +
+			"@@ -1,4 +1,4 @@\n" +
+			" Heading\n" +
+			"-The quick brown fox\n" +
+			"+The quick red fox\n" +
+			" jumps over the lazy dog\n" +
+			" Last line\n"
+		if got := diff.Unified(3); got != expected {
+			t.Fatalf("Invalid unified diff. Expected:\n%s\nGot:\n%s", expected, got)
+		}
+
+		expected = "--- Revision 1\n+++ Revision 2\n" +
+			"Title: Diff Document{+ Changed+}\n" +
+			"@@ -2,1 +2,1 @@\n" +
+			"-The quick brown fox\n" +
+			"+The quick red fox\n"
+		if got := diff.Unified(0); got != expected {
+			t.Fatalf("Invalid unified diff without context. Expected:\n%s\nGot:\n%s", expected, got)
+		}
+	})
+
+	t.Run("Words", func(t *testing.T) {
+		diff, err := doc.Diff(1, 2, app.DiffWords)
+		if err != nil {
+			t.Fatalf("Error diffing revisions: %s", err)
+		}
+
+		expected := "--- Revision 1\n+++ Revision 2\n" +
+			"Title: Diff Document{+ Changed+}\n" +
+			"Heading\nThe quick [-brown-]{+red+} fox\njumps over the lazy dog\nLast line"
+		if got := diff.Unified(3); got != expected {
+			t.Fatalf("Invalid word diff. Expected:\n%s\nGot:\n%s", expected, got)
+		}
+
+		expected = `<div class="diff-title">Diff Document<ins> Changed</ins></div>` +
+			`<div class="diff-body">Heading
+The quick <del>brown</del><ins>red</ins> fox
+jumps over the lazy dog
+Last line</div>`
+		if got := diff.HTML(); got != expected {
+			t.Fatalf("Invalid HTML diff. Expected:\n%s\nGot:\n%s", expected, got)
+		}
+	})
+
+	t.Run("Moved", func(t *testing.T) {
+		diff, err := doc.Diff(2, 3, app.DiffLines)
+		if err != nil {
+			t.Fatalf("Error diffing revisions: %s", err)
+		}
+
+		moves := map[int][]app.DiffOpType{}
+		for _, op := range diff.Body {
+			if op.Move != 0 {
+				moves[op.Move] = append(moves[op.Move], op.Type)
+			}
+		}
+		if len(moves) != 1 {
+			t.Fatalf("Expected one moved block, got %d: %+v", len(moves), diff.Body)
+		}
+		for _, types := range moves {
+			if len(types) != 2 || types[0] == types[1] {
+				t.Fatalf("Moved block was not matched with a delete and an insert: %v", types)
+			}
+		}
+
+		if !strings.Contains(diff.HTML(), `class="moved" data-move="1"`) {
+			t.Fatalf("Moved block was not marked in the HTML diff: %s", diff.HTML())
+		}
+	})
+
+	t.Run("Escaping", func(t *testing.T) {
+		save("Diff Document Changed", "<p>1 &lt; 2 &amp; 3</p>")
+
+		diff, err := doc.Diff(3, 4, app.DiffWords)
+		if err != nil {
+			t.Fatalf("Error diffing revisions: %s", err)
+		}
+		if !strings.Contains(diff.HTML(), "1 &lt; 2 &amp; 3") {
+			t.Fatalf("Text was not escaped in the HTML diff: %s", diff.HTML())
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := doc.Diff(1, 100, app.DiffLines)
+		if !app.IsFailType(err, app.FailNotFound) {
+			t.Fatalf("Expected not found diffing an invalid revision, got %v", err)
+		}
+		_, err = doc.Diff(1, 2, app.DiffMode(10))
+		if !app.IsFailType(err, app.FailInvalid) {
+			t.Fatalf("Expected invalid failure for an unknown diff mode, got %v", err)
+		}
+	})
+
+	t.Run("Restore", func(t *testing.T) {
+		err := doc.Grant(author2, app.PermissionEdit)
+		if err != nil {
+			t.Fatalf("Error granting edit permission: %s", err)
+		}
+		doc, err = app.DocumentGet(author2, doc.ID)
+		if err != nil {
+			t.Fatalf("Error getting document: %s", err)
+		}
+
+		latest := doc.LatestRevision
+		rev, err := doc.Restore(1)
+		if err != nil {
+			t.Fatalf("Error restoring revision: %s", err)
+		}
+		if rev.Revision != latest+1 || doc.LatestRevision != rev.Revision || rev.Author != author2.ID {
+			t.Fatalf("Restore did not create a new revision: %+v", rev)
+		}
+
+		diff, err := doc.Diff(1, rev.Revision, app.DiffWords)
+		if err != nil {
+			t.Fatalf("Error diffing revisions: %s", err)
+		}
+		if diff.Changed() {
+			t.Fatalf("Restored revision does not match the original: %s", diff.Unified(3))
+		}
+
+		old, err := doc.Revision(latest)
+		if err != nil {
+			t.Fatalf("Error getting previous revision: %s", err)
+		}
+		if old.Body != "<p>1 &lt; 2 &amp; 3</p>" {
+			t.Fatalf("Restore changed an existing revision: %s", old.Body)
+		}
+
+		_, err = doc.Restore(100)
+		if !app.IsFailType(err, app.FailNotFound) {
+			t.Fatalf("Expected not found restoring an invalid revision, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,690 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/lexLibrary/lexLibrary/data"
+)
+
+/*
+	Documents are made up of an immutable history of revisions.  Every save of a document creates a new revision,
+	and existing revisions are never changed.
+
+	Authors edit a document through their own draft, which is a private working copy started from the latest
+	revision.  Saving a draft creates a new revision, but only if no one else has saved a revision since the draft
+	was started, so two editors can never silently overwrite each other's changes.
+
+	Every function on a document checks the permissions of the user who retrieved it, see acl.go.
+
+	A document's lifecycle status is one of:
+		draft:		no revision of the document is published
+		published:	a revision of the document is published
+		archived:	the document is read only and hidden from normal use
+*/
+
+// Document statuses
+const (
+	DocumentStatusDraft     = "draft"
+	DocumentStatusPublished = "published"
+	DocumentStatusArchived  = "archived"
+)
+
+const maxTitleLength = 500
+
+// Document is a document in the library
+type Document struct {
+	ID                string
+	TenantID          string
+	CollectionID      string // empty if the document isn't in a collection
+	Status            string
+	LatestRevision    int
+	PublishedRevision int // 0 if no revision is published
+	Version           int
+	Creator           string
+	Created           time.Time
+	Updated           time.Time
+
+	who *User
+}
+
+// Revision is an immutable version of a document's content
+type Revision struct {
+	DocumentID string
+	Revision   int
+	Title      string
+	Body       string // HTML
+	Summary    string // plain text
+	// true if the summary was written by an author instead of generated from the body
+	SummaryManual bool
+	Author        string
+	Created       time.Time
+}
+
+func init() {
+	data.RegisterEncryptedColumn("document_revisions", "id", "body")
+	data.RegisterEncryptedColumn("document_revisions", "id", "summary")
+	data.RegisterEncryptedColumn("document_drafts", "id", "body")
+}
+
+var (
+	sqlDocumentInsert = data.NewQuery(`
+		insert into documents (tenant_id, id, collection_id, status, latest_revision, version, creator, created,
+			updated)
+		values ({{tenant}}, {{arg "id"}}, {{arg "collection_id"}}, {{arg "status"}}, {{arg "latest_revision"}},
+			{{arg "version"}}, {{arg "creator"}}, {{arg "created"}}, {{arg "updated"}})
+	`)
+	sqlDocumentColumns = `d.id, d.tenant_id, d.collection_id, d.status, d.latest_revision, d.published_revision,
+		d.version, d.creator, d.created, d.updated`
+	sqlDocumentGet = data.NewQuery(`
+		select ` + sqlDocumentColumns + ` from documents d
+		where d.tenant_id = {{tenant}} and d.id = {{arg "id"}}
+	`)
+	sqlDocumentList = data.NewQuery(`
+		select ` + sqlDocumentColumns + ` from documents d
+		where d.tenant_id = {{tenant}}
+		and ({{arg "all_collections"}} = 1 or d.collection_id = {{arg "collection_id"}})
+		and ` + sqlCanDocument + `
+		and (d.status = 'published' or ` + sqlCanEditDocument + `)
+		order by d.updated desc
+		LIMIT {{arg "limit"}} OFFSET {{arg "offset"}}
+	`)
+	sqlDocumentUpdate = data.NewQuery(`
+		update documents set
+			status = {{arg "status"}},
+			latest_revision = {{arg "latest_revision"}},
+			published_revision = {{arg "published_revision"}},
+			collection_id = {{arg "collection_id"}},
+			version = version + 1,
+			updated = {{arg "updated"}}
+		where tenant_id = {{tenant}} and id = {{arg "id"}} and version = {{arg "version"}}
+	`)
+	sqlRevisionInsert = data.NewQuery(`
+		insert into document_revisions (tenant_id, document_id, revision, id, title, body, summary, summary_manual,
+			author, created)
+		values ({{tenant}}, {{arg "document_id"}}, {{arg "revision"}}, {{arg "id"}}, {{arg "title"}}, {{arg "body"}},
+			{{arg "summary"}}, {{arg "summary_manual"}}, {{arg "author"}}, {{arg "created"}})
+	`)
+	sqlRevisionGet = data.NewQuery(`
+		select document_id, revision, title, body, summary, summary_manual, author, created
+		from document_revisions
+		where tenant_id = {{tenant}} and document_id = {{arg "document_id"}} and revision = {{arg "revision"}}
+	`)
+	sqlRevisionList = data.NewQuery(`
+		select document_id, revision, title, summary, summary_manual, author, created
+		from document_revisions
+		where tenant_id = {{tenant}} and document_id = {{arg "document_id"}}
+		order by revision desc
+		LIMIT {{arg "limit"}} OFFSET {{arg "offset"}}
+	`)
+)
+
+// DocumentNew creates a new document with its first revision.  If a collection is passed in, the document is
+// created in it, and the user needs edit permission on the collection.  The user creating the document is granted
+// admin permission on it
+func DocumentNew(who *User, collection *Collection, title, body string) (*Document, error) {
+	return documentNew(who, collection, []*Revision{{Title: title, Body: body}}, time.Time{}, nil)
+}
+
+// documentNew creates a new document from its revisions, oldest first, and runs fn in the same transaction, so
+// anything created along with the document, like its tags and attachments, is only kept if the document is.  The
+// revisions are written by the user creating the document, unless they have an author, and a revision without a
+// created date is created now.  The document's updated date defaults to the created date of its latest revision
+func documentNew(who *User, collection *Collection, revisions []*Revision, updated time.Time,
+	fn func(tx *sql.Tx, d *Document) error) (*Document, error) {
+	collectionID, err := canCreateDocument(who, collection)
+	if err != nil {
+		return nil, err
+	}
+	if len(revisions) == 0 {
+		return nil, NewFailure("A document must have a revision")
+	}
+
+	// importers can choose the new document's id, so other imported documents can link to it
+	id := revisions[0].DocumentID
+	if id == "" {
+		id = newID()
+	}
+
+	revs, err := prepareRevisions(who, revisions)
+	if err != nil {
+		return nil, err
+	}
+	for i := range revs {
+		revs[i].DocumentID = id
+		revs[i].Revision = i + 1
+	}
+	if updated.IsZero() {
+		updated = revs[len(revs)-1].Created
+	}
+
+	d := &Document{
+		ID:             id,
+		TenantID:       who.TenantID,
+		CollectionID:   collectionID,
+		Status:         DocumentStatusDraft,
+		LatestRevision: len(revs),
+		Version:        1,
+		Creator:        who.ID,
+		Created:        revs[0].Created,
+		Updated:        updated,
+		who:            who,
+	}
+
+	err = data.BeginTx(func(tx *sql.Tx) error {
+		_, err := sqlDocumentInsert.Tx(tx).Tenant(d.TenantID).Exec(
+			sql.Named("id", d.ID),
+			sql.Named("collection_id", nullString(d.CollectionID)),
+			sql.Named("status", d.Status),
+			sql.Named("latest_revision", d.LatestRevision),
+			sql.Named("version", d.Version),
+			sql.Named("creator", d.Creator),
+			sql.Named("created", d.Created),
+			sql.Named("updated", d.Updated),
+		)
+		if err != nil {
+			return err
+		}
+
+		err = insertACL(tx, d, who, PermissionAdmin, false)
+		if err != nil {
+			return err
+		}
+
+		for i := range revs {
+			err = d.insertRevision(tx, &revs[i])
+			if err != nil {
+				return err
+			}
+		}
+		if fn != nil {
+			return fn(tx, d)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// prepareRevisions validates and summarizes copies of the revisions.  The revisions are written by the user, unless
+// they have an author, and a revision without a created date is created now
+func prepareRevisions(who *User, revisions []*Revision) ([]Revision, error) {
+	revs := make([]Revision, len(revisions))
+	for i := range revisions {
+		r := &revs[i]
+		*r = *revisions[i]
+		r.Title = strings.TrimSpace(r.Title)
+		err := validateRevision(r.Title)
+		if err != nil {
+			return nil, err
+		}
+		if !r.SummaryManual {
+			r.Summary, err = revisionSummary(who.TenantID, r.Body)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if r.Created.IsZero() {
+			r.Created = time.Now()
+		}
+		if r.Author == "" {
+			r.Author = who.ID
+		}
+	}
+	return revs, nil
+}
+
+// canCreateDocument checks that the user can create a document in the collection, or outside of any collection if
+// collection is nil, and returns the collection's id
+func canCreateDocument(who *User, collection *Collection) (string, error) {
+	if who == nil {
+		return "", Unauthorized("You must log in")
+	}
+	if collection == nil {
+		return "", nil
+	}
+	err := Can(who, PermissionEdit, collection)
+	if err != nil {
+		return "", err
+	}
+	return collection.ID, nil
+}
+
+// DocumentGet retrieves a document the user can read
+func DocumentGet(who *User, id string) (*Document, error) {
+	if who == nil {
+		return nil, Unauthorized("You must log in")
+	}
+	d, err := documentGet(nil, who.TenantID, id)
+	if err != nil {
+		return nil, err
+	}
+	d.who = who
+
+	err = Can(who, PermissionRead, d)
+	if IsFailType(err, FailForbidden) {
+		// users who can't read a document shouldn't know it exists
+		return nil, NotFound("Document not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// DocumentList returns the documents the user can read, most recently updated first
+func DocumentList(who *User, offset, limit int) ([]*Document, error) {
+	return documentList(who, "", offset, limit)
+}
+
+// documentList returns the documents the user can read in the collection, or in every collection if collectionID
+// is empty.  Drafts and archived documents are only listed for users who can edit them
+func documentList(who *User, collectionID string, offset, limit int) ([]*Document, error) {
+	if who == nil {
+		return nil, Unauthorized("You must log in")
+	}
+	if limit == 0 || limit > maxRows {
+		limit = 10
+	}
+
+	args := append(canArgs(who, PermissionRead),
+		sql.Named("edit_permission", int(PermissionEdit)),
+		sql.Named("all_collections", boolInt(collectionID == "")),
+		sql.Named("collection_id", collectionID),
+		sql.Named("offset", offset),
+		sql.Named("limit", limit),
+	)
+	rows, err := sqlDocumentList.Tenant(who.TenantID).Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanDocuments(who, rows)
+}
+
+// scanDocuments reads and closes the rows of a document listing, loaded by the user
+func scanDocuments(who *User, rows *sql.Rows) ([]*Document, error) {
+	defer rows.Close()
+
+	var documents []*Document
+	for rows.Next() {
+		d, err := scanDocument(rows)
+		if err != nil {
+			return nil, err
+		}
+		d.who = who
+		documents = append(documents, d)
+	}
+	return documents, rows.Err()
+}
+
+// documentLink is the link to a document from the body of another document.  Like the links to attachments, it's
+// relative to the document the link is in
+func documentLink(id string) string {
+	return "../" + id + "/"
+}
+
+func documentGet(tx *sql.Tx, tenantID, id string) (*Document, error) {
+	return scanDocument(sqlDocumentGet.Tx(tx).Tenant(tenantID).QueryRow(sql.Named("id", id)))
+}
+
+func scanDocument(row scanner) (*Document, error) {
+	d := &Document{}
+	var collectionID sql.NullString
+	var published sql.NullInt64
+	err := row.Scan(
+		&d.ID,
+		&d.TenantID,
+		&collectionID,
+		&d.Status,
+		&d.LatestRevision,
+		&published,
+		&d.Version,
+		&d.Creator,
+		&d.Created,
+		&d.Updated,
+	)
+	if err == sql.ErrNoRows {
+		return nil, NotFound("Document not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.CollectionID = collectionID.String
+	d.PublishedRevision = int(published.Int64)
+	return d, nil
+}
+
+func validateRevision(title string) error {
+	if title == "" {
+		return NewFailure("A document title is required")
+	}
+	if len(title) > maxTitleLength {
+		return NewFailure("A document title can't be longer than 500 characters")
+	}
+	return nil
+}
+
+func (d *Document) insertRevision(tx *sql.Tx, r *Revision) error {
+	_, err := sqlRevisionInsert.Tx(tx).Tenant(d.TenantID).Exec(
+		sql.Named("document_id", r.DocumentID),
+		sql.Named("revision", r.Revision),
+		sql.Named("id", newID()),
+		sql.Named("title", r.Title),
+		sql.Named("body", data.EncryptedText(r.Body)),
+		sql.Named("summary", data.EncryptedText(r.Summary)),
+		sql.Named("summary_manual", boolInt(r.SummaryManual)),
+		sql.Named("author", r.Author),
+		sql.Named("created", r.Created),
+	)
+	return err
+}
+
+// addRevisions adds revisions, oldest first, after the document's latest revision, and runs fn in the same
+// transaction.  Like the revisions of a new document, they're written by the user unless they have an author, and
+// keep their created date
+func (d *Document) addRevisions(revisions []*Revision, fn func(tx *sql.Tx, d *Document) error) error {
+	err := Can(d.who, PermissionEdit, d)
+	if err != nil {
+		return err
+	}
+	if d.Status == DocumentStatusArchived {
+		return NewFailure("An archived document can't be edited")
+	}
+	// revisions are summarized before the transaction, because summaries read the tenant's settings
+	revs, err := prepareRevisions(d.who, revisions)
+	if err != nil {
+		return err
+	}
+
+	return d.change(PermissionEdit, func(tx *sql.Tx, d *Document) error {
+		for i := range revs {
+			d.LatestRevision++
+			revs[i].DocumentID = d.ID
+			revs[i].Revision = d.LatestRevision
+			err := d.insertRevision(tx, &revs[i])
+			if err != nil {
+				return err
+			}
+		}
+		if fn != nil {
+			return fn(tx, d)
+		}
+		return nil
+	})
+}
+
+// update writes the document's current state, and fails with a conflict if the document was changed since
+// it was loaded
+func (d *Document) update(tx *sql.Tx) error {
+	published := sql.NullInt64{Int64: int64(d.PublishedRevision), Valid: d.PublishedRevision != 0}
+	d.Updated = time.Now()
+
+	result, err := sqlDocumentUpdate.Tx(tx).Tenant(d.TenantID).Exec(
+		sql.Named("id", d.ID),
+		sql.Named("status", d.Status),
+		sql.Named("latest_revision", d.LatestRevision),
+		sql.Named("published_revision", published),
+		sql.Named("collection_id", nullString(d.CollectionID)),
+		sql.Named("updated", d.Updated),
+		sql.Named("version", d.Version),
+	)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return Conflict("The document has been changed by someone else since it was loaded. Reload the document " +
+			"and try again")
+	}
+	d.Version++
+	return nil
+}
+
+// change checks that the user has the permission, then runs the changes to the document inside a transaction, and
+// only keeps the changes if they were written successfully
+func (d *Document) change(permission Permission, fn func(tx *sql.Tx, d *Document) error) error {
+	err := Can(d.who, permission, d)
+	if err != nil {
+		return err
+	}
+
+	changed := *d
+	err = data.BeginTx(func(tx *sql.Tx) error {
+		err := fn(tx, &changed)
+		if err != nil {
+			return err
+		}
+		return changed.update(tx)
+	})
+	if err != nil {
+		return err
+	}
+	*d = changed
+	return nil
+}
+
+// Publish publishes the passed in revision of the document, or the latest revision if revision is 0
+func (d *Document) Publish(revision int) error {
+	if revision == 0 {
+		revision = d.LatestRevision
+	}
+	if revision < 1 || revision > d.LatestRevision {
+		return NotFound("Revision not found")
+	}
+	if d.Status == DocumentStatusArchived {
+		return NewFailure("An archived document can't be published")
+	}
+
+	return d.change(PermissionPublish, func(tx *sql.Tx, changed *Document) error {
+		changed.Status = DocumentStatusPublished
+		changed.PublishedRevision = revision
+		return nil
+	})
+}
+
+// Unpublish removes the published revision of the document, so it is only visible as a draft
+func (d *Document) Unpublish() error {
+	if d.Status != DocumentStatusPublished {
+		return NewFailure("The document is not published")
+	}
+
+	return d.change(PermissionPublish, func(tx *sql.Tx, changed *Document) error {
+		changed.Status = DocumentStatusDraft
+		changed.PublishedRevision = 0
+		return nil
+	})
+}
+
+// Archive makes the document read only and removes its published revision
+func (d *Document) Archive() error {
+	if d.Status == DocumentStatusArchived {
+		return NewFailure("The document is already archived")
+	}
+
+	return d.change(PermissionAdmin, func(tx *sql.Tx, changed *Document) error {
+		changed.Status = DocumentStatusArchived
+		changed.PublishedRevision = 0
+		return nil
+	})
+}
+
+// Unarchive returns an archived document to a draft
+func (d *Document) Unarchive() error {
+	if d.Status != DocumentStatusArchived {
+		return NewFailure("The document is not archived")
+	}
+
+	return d.change(PermissionAdmin, func(tx *sql.Tx, changed *Document) error {
+		changed.Status = DocumentStatusDraft
+		return nil
+	})
+}
+
+// SetCollection moves the document into the collection, or out of any collection if collection is nil.  The
+// document's inherited permissions change to the new collection's
+func (d *Document) SetCollection(collection *Collection) error {
+	collectionID := ""
+	if collection != nil {
+		err := Can(d.who, PermissionEdit, collection)
+		if err != nil {
+			return err
+		}
+		collectionID = collection.ID
+	}
+
+	return d.change(PermissionAdmin, func(tx *sql.Tx, changed *Document) error {
+		changed.CollectionID = collectionID
+		return nil
+	})
+}
+
+// Restore creates a new revision of the document with the content of an earlier revision.  Existing revisions,
+// including any made after the restored revision, are left in the document's history
+func (d *Document) Restore(revision int) (*Revision, error) {
+	if d.Status == DocumentStatusArchived {
+		return nil, NewFailure("An archived document can't be edited")
+	}
+
+	var restored *Revision
+	err := d.change(PermissionEdit, func(tx *sql.Tx, changed *Document) error {
+		old, err := changed.revision(tx, revision)
+		if err != nil {
+			return err
+		}
+
+		changed.LatestRevision++
+		restored = &Revision{
+			DocumentID:    changed.ID,
+			Revision:      changed.LatestRevision,
+			Title:         old.Title,
+			Body:          old.Body,
+			Summary:       old.Summary,
+			SummaryManual: old.SummaryManual,
+			Author:        d.who.ID,
+			Created:       time.Now(),
+		}
+		return changed.insertRevision(tx, restored)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return restored, nil
+}
+
+// Revision returns a specific revision of the document.  Any revision other than the published one is only
+// available to users who can edit the document
+func (d *Document) Revision(revision int) (*Revision, error) {
+	permission := PermissionRead
+	if revision != d.PublishedRevision {
+		permission = PermissionEdit
+	}
+	err := Can(d.who, permission, d)
+	if err != nil {
+		return nil, err
+	}
+	return d.revision(nil, revision)
+}
+
+func (d *Document) revision(tx *sql.Tx, revision int) (*Revision, error) {
+	r := &Revision{}
+	var body, summary data.EncryptedText
+	manual := 0
+	err := sqlRevisionGet.Tx(tx).Tenant(d.TenantID).QueryRow(
+		sql.Named("document_id", d.ID),
+		sql.Named("revision", revision),
+	).Scan(&r.DocumentID, &r.Revision, &r.Title, &body, &summary, &manual, &r.Author, &r.Created)
+	if err == sql.ErrNoRows {
+		return nil, NotFound("Revision not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.Body = string(body)
+	r.Summary = string(summary)
+	r.SummaryManual = manual != 0
+	return r, nil
+}
+
+// Latest returns the latest revision of the document
+func (d *Document) Latest() (*Revision, error) {
+	return d.Revision(d.LatestRevision)
+}
+
+// Published returns the published revision of the document
+func (d *Document) Published() (*Revision, error) {
+	if d.PublishedRevision == 0 {
+		return nil, NotFound("The document is not published")
+	}
+	return d.Revision(d.PublishedRevision)
+}
+
+// Revisions returns the history of revisions for the document, newest first.  The body of the revisions
+// are not included, but their summaries are
+func (d *Document) Revisions(offset, limit int) ([]*Revision, error) {
+	err := Can(d.who, PermissionRead, d)
+	if err != nil {
+		return nil, err
+	}
+	if limit == 0 || limit > maxRows {
+		limit = 10
+	}
+
+	rows, err := sqlRevisionList.Tenant(d.TenantID).Query(
+		sql.Named("document_id", d.ID),
+		sql.Named("offset", offset),
+		sql.Named("limit", limit),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []*Revision
+	for rows.Next() {
+		r := &Revision{}
+		var summary data.EncryptedText
+		manual := 0
+		err = rows.Scan(&r.DocumentID, &r.Revision, &r.Title, &summary, &manual, &r.Author, &r.Created)
+		if err != nil {
+			return nil, err
+		}
+		r.Summary = string(summary)
+		r.SummaryManual = manual != 0
+		revisions = append(revisions, r)
+	}
+
+	return revisions, rows.Err()
+}
+
+// ACL returns the document's access control list
+func (d *Document) ACL() ([]ACLEntry, error) {
+	return ACL(d.who, d)
+}
+
+// Grant gives the user or group the permission on the document
+func (d *Document) Grant(principal Principal, permission Permission) error {
+	return Grant(d.who, d, principal, permission)
+}
+
+// Deny prevents the user or group from having the permission on the document
+func (d *Document) Deny(principal Principal, permission Permission) error {
+	return Deny(d.who, d, principal, permission)
+}
+
+// Revoke removes the user or group's grants and denies from the document
+func (d *Document) Revoke(principal Principal) error {
+	return Revoke(d.who, d, principal)
+}
+
+func (d *Document) resourceType() string   { return resourceDocument }
+func (d *Document) resourceID() string     { return d.ID }
+func (d *Document) resourceTenant() string { return d.TenantID }
@@ -0,0 +1,302 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app_test
+
+import (
+	"testing"
+
+	"github.com/lexLibrary/lexLibrary/app"
+	"github.com/lexLibrary/lexLibrary/data"
+)
+
+func resetDocuments(t *testing.T) {
+	for _, table := range []string{"document_drafts", "document_revisions", "documents", "collections", "acl",
+		"group_members", "user_groups", "document_terms", "document_tags",
+		"tags", "tag_synonyms", "attachments", "crawls", "crawl_pages", "import_batches", "import_batch_files",
+		"import_batch_folders"} {
+		_, err := data.NewQuery("delete from " + table).Exec()
+		if err != nil {
+			t.Fatalf("Error emptying %s table before running tests: %s", table, err)
+		}
+	}
+}
+
+func TestDocument(t *testing.T) {
+	resetDocuments(t)
+
+	tenant, err := app.TenantNew(installAdmin(t), "Document Tenant", "", "")
+	if err != nil {
+		t.Fatalf("Error creating tenant: %s", err)
+	}
+	author1 := testUser(t, tenant, "author1")
+	author2 := testUser(t, tenant, "author2")
+	author3 := testUser(t, tenant, "author3")
+
+	var doc *app.Document
+
+	t.Run("New", func(t *testing.T) {
+		_, err := app.DocumentNew(author1, nil, "  ", "body")
+		if !app.IsFailType(err, app.FailInvalid) {
+			t.Fatalf("Expected invalid failure for a document with no title, got %v", err)
+		}
+
+		doc, err = app.DocumentNew(author1, nil, "First Document", "<p>First revision</p>")
+		if err != nil {
+			t.Fatalf("Error creating document: %s", err)
+		}
+		if doc.Status != app.DocumentStatusDraft || doc.LatestRevision != 1 || doc.PublishedRevision != 0 {
+			t.Fatalf("Invalid new document: %+v", doc)
+		}
+
+		got, err := app.DocumentGet(author1, doc.ID)
+		if err != nil {
+			t.Fatalf("Error getting document: %s", err)
+		}
+		if got.ID != doc.ID || got.Version != doc.Version || got.Creator != author1.ID {
+			t.Fatalf("Invalid document retrieved: %+v", got)
+		}
+
+		rev, err := got.Latest()
+		if err != nil {
+			t.Fatalf("Error getting latest revision: %s", err)
+		}
+		if rev.Title != "First Document" || rev.Body != "<p>First revision</p>" || rev.Author != author1.ID {
+			t.Fatalf("Invalid first revision: %+v", rev)
+		}
+	})
+
+	t.Run("Draft", func(t *testing.T) {
+		draft, err := doc.Edit()
+		if err != nil {
+			t.Fatalf("Error starting draft: %s", err)
+		}
+		if draft.BaseRevision != 1 || draft.Title != "First Document" || draft.Body != "<p>First revision</p>" {
+			t.Fatalf("Draft was not started from the latest revision: %+v", draft)
+		}
+
+		same, err := doc.Edit()
+		if err != nil {
+			t.Fatalf("Error getting existing draft: %s", err)
+		}
+		if same.Version != draft.Version {
+			t.Fatalf("Editing again did not return the existing draft")
+		}
+
+		err = draft.Update("First Document", "<p>Second revision</p>")
+		if err != nil {
+			t.Fatalf("Error updating draft: %s", err)
+		}
+
+		// stale copy of the draft
+		err = same.Update("First Document", "<p>Stale</p>")
+		if !app.IsFailType(err, app.FailConflict) {
+			t.Fatalf("Expected conflict updating a stale draft, got %v", err)
+		}
+
+		rev, err := draft.Save()
+		if err != nil {
+			t.Fatalf("Error saving draft: %s", err)
+		}
+		if rev.Revision != 2 || rev.Body != "<p>Second revision</p>" {
+			t.Fatalf("Invalid saved revision: %+v", rev)
+		}
+
+		_, err = doc.Draft()
+		if !app.IsFailType(err, app.FailNotFound) {
+			t.Fatalf("Draft was not removed after saving: %v", err)
+		}
+
+		first, err := doc.Revision(1)
+		if err != nil {
+			t.Fatalf("Error getting first revision: %s", err)
+		}
+		if first.Body != "<p>First revision</p>" {
+			t.Fatalf("Saving a draft changed an existing revision: %s", first.Body)
+		}
+	})
+
+	t.Run("Concurrent Drafts", func(t *testing.T) {
+		var err error
+		doc, err = app.DocumentGet(author1, doc.ID)
+		if err != nil {
+			t.Fatalf("Error getting document: %s", err)
+		}
+
+		_, err = app.DocumentGet(author2, doc.ID)
+		if !app.IsFailType(err, app.FailNotFound) {
+			t.Fatalf("Expected not found getting a document without permission, got %v", err)
+		}
+		for _, author := range []*app.User{author2, author3} {
+			err = doc.Grant(author, app.PermissionEdit)
+			if err != nil {
+				t.Fatalf("Error granting edit permission: %s", err)
+			}
+		}
+		doc2, err := app.DocumentGet(author2, doc.ID)
+		if err != nil {
+			t.Fatalf("Error getting document: %s", err)
+		}
+
+		one, err := doc.Edit()
+		if err != nil {
+			t.Fatalf("Error starting draft: %s", err)
+		}
+		two, err := doc2.Edit()
+		if err != nil {
+			t.Fatalf("Error starting draft: %s", err)
+		}
+
+		drafts, err := doc.Drafts()
+		if err != nil {
+			t.Fatalf("Error listing drafts: %s", err)
+		}
+		if len(drafts) != 2 {
+			t.Fatalf("Invalid number of drafts. Wanted %d got %d", 2, len(drafts))
+		}
+
+		err = one.Update("First Document", "<p>Author 1 changes</p>")
+		if err != nil {
+			t.Fatalf("Error updating draft: %s", err)
+		}
+		err = two.Update("First Document", "<p>Author 2 changes</p>")
+		if err != nil {
+			t.Fatalf("Error updating draft: %s", err)
+		}
+
+		_, err = one.Save()
+		if err != nil {
+			t.Fatalf("Error saving draft: %s", err)
+		}
+
+		_, err = two.Save()
+		if !app.IsFailType(err, app.FailConflict) {
+			t.Fatalf("Expected conflict saving a draft started before another save, got %v", err)
+		}
+
+		err = two.Rebase()
+		if err != nil {
+			t.Fatalf("Error rebasing draft: %s", err)
+		}
+		rev, err := two.Save()
+		if err != nil {
+			t.Fatalf("Error saving rebased draft: %s", err)
+		}
+		if rev.Revision != 4 || rev.Author != author2.ID {
+			t.Fatalf("Invalid saved revision: %+v", rev)
+		}
+
+		revisions, err := doc.Revisions(0, 0)
+		if err != nil {
+			t.Fatalf("Error getting revisions: %s", err)
+		}
+		if len(revisions) != 4 || revisions[0].Revision != 4 || revisions[3].Revision != 1 {
+			t.Fatalf("Invalid revision history: %+v", revisions)
+		}
+
+		doc3, err := app.DocumentGet(author3, doc.ID)
+		if err != nil {
+			t.Fatalf("Error getting document: %s", err)
+		}
+		draft, err := doc3.Edit()
+		if err != nil {
+			t.Fatalf("Error starting draft: %s", err)
+		}
+		err = draft.Discard()
+		if err != nil {
+			t.Fatalf("Error discarding draft: %s", err)
+		}
+		_, err = doc3.Draft()
+		if !app.IsFailType(err, app.FailNotFound) {
+			t.Fatalf("Draft was not discarded: %v", err)
+		}
+	})
+
+	t.Run("Lifecycle", func(t *testing.T) {
+		var err error
+		doc, err = app.DocumentGet(author1, doc.ID)
+		if err != nil {
+			t.Fatalf("Error getting document: %s", err)
+		}
+		stale := *doc
+
+		err = doc.Publish(2)
+		if err != nil {
+			t.Fatalf("Error publishing document: %s", err)
+		}
+		rev, err := doc.Published()
+		if err != nil {
+			t.Fatalf("Error getting published revision: %s", err)
+		}
+		if doc.Status != app.DocumentStatusPublished || rev.Revision != 2 {
+			t.Fatalf("Invalid published document: %+v", doc)
+		}
+
+		err = stale.Archive()
+		if !app.IsFailType(err, app.FailConflict) {
+			t.Fatalf("Expected conflict changing a stale document, got %v", err)
+		}
+
+		err = doc.Publish(10)
+		if !app.IsFailType(err, app.FailNotFound) {
+			t.Fatalf("Expected not found publishing an invalid revision, got %v", err)
+		}
+
+		err = doc.Unpublish()
+		if err != nil {
+			t.Fatalf("Error unpublishing document: %s", err)
+		}
+		if doc.Status != app.DocumentStatusDraft || doc.PublishedRevision != 0 {
+			t.Fatalf("Invalid unpublished document: %+v", doc)
+		}
+
+		err = doc.Publish(0)
+		if err != nil {
+			t.Fatalf("Error publishing document: %s", err)
+		}
+		if doc.PublishedRevision != doc.LatestRevision {
+			t.Fatalf("Publishing without a revision did not publish the latest revision")
+		}
+
+		err = doc.Archive()
+		if err != nil {
+			t.Fatalf("Error archiving document: %s", err)
+		}
+		if doc.Status != app.DocumentStatusArchived || doc.PublishedRevision != 0 {
+			t.Fatalf("Invalid archived document: %+v", doc)
+		}
+		_, err = doc.Edit()
+		if !app.IsFailType(err, app.FailInvalid) {
+			t.Fatalf("Expected failure editing an archived document, got %v", err)
+		}
+		err = doc.Publish(0)
+		if !app.IsFailType(err, app.FailInvalid) {
+			t.Fatalf("Expected failure publishing an archived document, got %v", err)
+		}
+
+		err = doc.Unarchive()
+		if err != nil {
+			t.Fatalf("Error unarchiving document: %s", err)
+		}
+
+		got, err := app.DocumentGet(author1, doc.ID)
+		if err != nil {
+			t.Fatalf("Error getting document: %s", err)
+		}
+		if got.Status != app.DocumentStatusDraft || got.Version != doc.Version {
+			t.Fatalf("Document changes were not saved: %+v", got)
+		}
+	})
+
+	t.Run("Tenant Isolation", func(t *testing.T) {
+		other, err := app.TenantNew(installAdmin(t), "Other Document Tenant", "", "")
+		if err != nil {
+			t.Fatalf("Error creating tenant: %s", err)
+		}
+
+		outsider := testUser(t, other, "author1")
+		_, err = app.DocumentGet(outsider, doc.ID)
+		if !app.IsFailType(err, app.FailNotFound) {
+			t.Fatalf("Tenant was able to read another tenant's document: %v", err)
+		}
+	})
+}
@@ -0,0 +1,351 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/lexLibrary/lexLibrary/data"
+)
+
+// Draft is an author's private working copy of a document.  Each author has at most one draft per document
+type Draft struct {
+	DocumentID   string
+	TenantID     string
+	Author       string
+	BaseRevision int
+	Title        string
+	Body         string // HTML
+	Version      int
+	Updated      time.Time
+
+	who *User
+}
+
+var (
+	sqlDraftInsert = data.NewQuery(`
+		insert into document_drafts (tenant_id, document_id, author, id, base_revision, title, body, version, updated)
+		values ({{tenant}}, {{arg "document_id"}}, {{arg "author"}}, {{arg "id"}}, {{arg "base_revision"}},
+			{{arg "title"}}, {{arg "body"}}, {{arg "version"}}, {{arg "updated"}})
+	`)
+	sqlDraftGet = data.NewQuery(`
+		select document_id, tenant_id, author, base_revision, title, body, version, updated
+		from document_drafts
+		where tenant_id = {{tenant}} and document_id = {{arg "document_id"}} and author = {{arg "author"}}
+	`)
+	sqlDraftUpdate = data.NewQuery(`
+		update document_drafts set
+			base_revision = {{arg "base_revision"}},
+			title = {{arg "title"}},
+			body = {{arg "body"}},
+			version = version + 1,
+			updated = {{arg "updated"}}
+		where tenant_id = {{tenant}} and document_id = {{arg "document_id"}} and author = {{arg "author"}}
+		and version = {{arg "version"}}
+	`)
+	sqlDraftDelete = data.NewQuery(`
+		delete from document_drafts
+		where tenant_id = {{tenant}} and document_id = {{arg "document_id"}} and author = {{arg "author"}}
+	`)
+	sqlDraftList = data.NewQuery(`
+		select document_id, tenant_id, author, base_revision, title, body, version, updated
+		from document_drafts
+		where tenant_id = {{tenant}} and document_id = {{arg "document_id"}}
+		order by updated desc
+	`)
+)
+
+// Edit returns the user's draft of the document, starting a new draft from the latest revision if the user
+// doesn't already have one
+func (d *Document) Edit() (*Draft, error) {
+	if d.Status == DocumentStatusArchived {
+		return nil, NewFailure("An archived document can't be edited")
+	}
+	err := Can(d.who, PermissionEdit, d)
+	if err != nil {
+		return nil, err
+	}
+
+	var draft *Draft
+	err = data.BeginTx(func(tx *sql.Tx) error {
+		var err error
+		draft, err = d.draft(tx, d.who.ID)
+		if err == nil {
+			return nil
+		}
+		if !IsFailType(err, FailNotFound) {
+			return err
+		}
+
+		latest, err := d.revision(tx, d.LatestRevision)
+		if err != nil {
+			return err
+		}
+
+		draft = &Draft{
+			DocumentID:   d.ID,
+			TenantID:     d.TenantID,
+			Author:       d.who.ID,
+			BaseRevision: latest.Revision,
+			Title:        latest.Title,
+			Body:         latest.Body,
+			Version:      1,
+			Updated:      time.Now(),
+			who:          d.who,
+		}
+
+		_, err = sqlDraftInsert.Tx(tx).Tenant(d.TenantID).Exec(
+			sql.Named("document_id", draft.DocumentID),
+			sql.Named("author", draft.Author),
+			sql.Named("id", newID()),
+			sql.Named("base_revision", draft.BaseRevision),
+			sql.Named("title", draft.Title),
+			sql.Named("body", data.EncryptedText(draft.Body)),
+			sql.Named("version", draft.Version),
+			sql.Named("updated", draft.Updated),
+		)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return draft, nil
+}
+
+// Draft returns the user's existing draft of the document
+func (d *Document) Draft() (*Draft, error) {
+	err := Can(d.who, PermissionEdit, d)
+	if err != nil {
+		return nil, err
+	}
+	return d.draft(nil, d.who.ID)
+}
+
+func (d *Document) draft(tx *sql.Tx, author string) (*Draft, error) {
+	draft, err := scanDraft(sqlDraftGet.Tx(tx).Tenant(d.TenantID).QueryRow(
+		sql.Named("document_id", d.ID),
+		sql.Named("author", author),
+	))
+	if err == sql.ErrNoRows {
+		return nil, NotFound("Draft not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	draft.who = d.who
+	return draft, nil
+}
+
+// Drafts returns every author's draft of the document
+func (d *Document) Drafts() ([]*Draft, error) {
+	err := Can(d.who, PermissionEdit, d)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := sqlDraftList.Tenant(d.TenantID).Query(sql.Named("document_id", d.ID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var drafts []*Draft
+	for rows.Next() {
+		draft, err := scanDraft(rows)
+		if err != nil {
+			return nil, err
+		}
+		draft.who = d.who
+		drafts = append(drafts, draft)
+	}
+	return drafts, rows.Err()
+}
+
+func scanDraft(row scanner) (*Draft, error) {
+	draft := &Draft{}
+	var body data.EncryptedText
+	err := row.Scan(
+		&draft.DocumentID,
+		&draft.TenantID,
+		&draft.Author,
+		&draft.BaseRevision,
+		&draft.Title,
+		&body,
+		&draft.Version,
+		&draft.Updated,
+	)
+	if err != nil {
+		return nil, err
+	}
+	draft.Body = string(body)
+	return draft, nil
+}
+
+// Update changes the content of the draft.  If the draft was changed since it was loaded, for instance by the same
+// author in another browser window, the update fails with a conflict
+func (dr *Draft) Update(title, body string) error {
+	title = strings.TrimSpace(title)
+	err := validateRevision(title)
+	if err != nil {
+		return err
+	}
+
+	changed := *dr
+	changed.Title = title
+	changed.Body = body
+
+	err = data.BeginTx(func(tx *sql.Tx) error {
+		err := dr.canEdit(tx)
+		if err != nil {
+			return err
+		}
+		return changed.update(tx)
+	})
+	if err != nil {
+		return err
+	}
+	*dr = changed
+	return nil
+}
+
+func (dr *Draft) update(tx *sql.Tx) error {
+	dr.Updated = time.Now()
+	result, err := sqlDraftUpdate.Tx(tx).Tenant(dr.TenantID).Exec(
+		sql.Named("document_id", dr.DocumentID),
+		sql.Named("author", dr.Author),
+		sql.Named("base_revision", dr.BaseRevision),
+		sql.Named("title", dr.Title),
+		sql.Named("body", data.EncryptedText(dr.Body)),
+		sql.Named("updated", dr.Updated),
+		sql.Named("version", dr.Version),
+	)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return Conflict("The draft has been changed since it was loaded. Reload the draft and try again")
+	}
+	dr.Version++
+	return nil
+}
+
+// Save creates a new revision of the document from the draft, and removes the draft.  If another revision was
+// saved since the draft was started, the save fails with a conflict, and the author needs to bring their draft
+// up to date with Rebase before saving
+func (dr *Draft) Save() (*Revision, error) {
+	var revision *Revision
+
+	summary, err := revisionSummary(dr.TenantID, dr.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	err = data.BeginTx(func(tx *sql.Tx) error {
+		err := dr.canEdit(tx)
+		if err != nil {
+			return err
+		}
+		d, err := documentGet(tx, dr.TenantID, dr.DocumentID)
+		if err != nil {
+			return err
+		}
+		if d.Status == DocumentStatusArchived {
+			return NewFailure("An archived document can't be edited")
+		}
+
+		current, err := d.draft(tx, dr.Author)
+		if err != nil {
+			return err
+		}
+		if current.Version != dr.Version {
+			return Conflict("The draft has been changed since it was loaded. Reload the draft and try again")
+		}
+
+		if dr.BaseRevision != d.LatestRevision {
+			return Conflict("The document has been changed by someone else since this draft was started. " +
+				"Review their changes and update the draft before saving")
+		}
+
+		d.LatestRevision++
+		revision = &Revision{
+			DocumentID: d.ID,
+			Revision:   d.LatestRevision,
+			Title:      dr.Title,
+			Body:       dr.Body,
+			Summary:    summary,
+			Author:     dr.Author,
+			Created:    time.Now(),
+		}
+
+		err = d.insertRevision(tx, revision)
+		if err != nil {
+			return err
+		}
+
+		err = d.update(tx)
+		if err != nil {
+			return err
+		}
+
+		return dr.delete(tx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return revision, nil
+}
+
+// Rebase moves the draft's starting point to the document's latest revision, keeping the draft's content.  This
+// should only be done once the author has reviewed the changes made since their draft was started
+func (dr *Draft) Rebase() error {
+	changed := *dr
+	err := data.BeginTx(func(tx *sql.Tx) error {
+		err := dr.canEdit(tx)
+		if err != nil {
+			return err
+		}
+		d, err := documentGet(tx, dr.TenantID, dr.DocumentID)
+		if err != nil {
+			return err
+		}
+		changed.BaseRevision = d.LatestRevision
+		return changed.update(tx)
+	})
+	if err != nil {
+		return err
+	}
+	*dr = changed
+	return nil
+}
+
+// Discard removes the draft without saving it
+func (dr *Draft) Discard() error {
+	if dr.who == nil || dr.who.ID != dr.Author {
+		return Forbidden("Only the author of a draft can discard it")
+	}
+	return data.BeginTx(func(tx *sql.Tx) error {
+		return dr.delete(tx)
+	})
+}
+
+// canEdit checks that the draft belongs to the user, and that they still have permission to edit the document
+func (dr *Draft) canEdit(tx *sql.Tx) error {
+	if dr.who == nil || dr.who.ID != dr.Author {
+		return Forbidden("Only the author of a draft can change it")
+	}
+	return can(tx, dr.who, PermissionEdit, &Document{ID: dr.DocumentID, TenantID: dr.TenantID})
+}
+
+func (dr *Draft) delete(tx *sql.Tx) error {
+	_, err := sqlDraftDelete.Tx(tx).Tenant(dr.TenantID).Exec(
+		sql.Named("document_id", dr.DocumentID),
+		sql.Named("author", dr.Author),
+	)
+	return err
+}
@@ -0,0 +1,322 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+/*
+	Exports write part of the library out as files: the published revision of every document the user can read,
+	in a collection and the collections nested in it, or in the whole library.  Drafts and archived documents are
+	never exported.
+
+	The files are written to an ExportTarget, either a directory or a zip archive.  Exports are deterministic:
+	exporting the same documents again writes exactly the same files, so an export can be committed to version
+	control and diffed.  Nothing depends on when the export ran, and everything is written in a stable order.
+*/
+
+// exportModifiedDate is the modified date of every file in an exported zip archive, so the archive only changes
+// when its contents do.  It's January 1, 1980 in MS-DOS format, the earliest date a zip archive can hold.  The date
+// is set directly instead of with SetModTime, so no extra timestamp field is added to each file
+const exportModifiedDate = 1<<5 | 1
+
+// ExportTarget is where the files of an export are written
+type ExportTarget interface {
+	// Create creates the file with the slash separated path, relative to the root of the export
+	Create(name string) (io.WriteCloser, error)
+}
+
+// ExportDir writes exported files to a directory, creating any folders they are in.  Existing files are
+// overwritten, but files that weren't part of the export are left alone, so exports should be written to an
+// empty directory
+type ExportDir string
+
+// Create creates the file in the directory
+func (d ExportDir) Create(name string) (io.WriteCloser, error) {
+	name, err := exportPath(name)
+	if err != nil {
+		return nil, err
+	}
+	filename := filepath.Join(string(d), filepath.FromSlash(name))
+	err = os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return nil, err
+	}
+	return os.Create(filename)
+}
+
+// ExportZip writes exported files to a zip archive.  The archive isn't complete until it's closed
+type ExportZip struct {
+	zip *zip.Writer
+}
+
+// NewExportZip returns an export target that writes a zip archive to the writer
+func NewExportZip(w io.Writer) *ExportZip {
+	return &ExportZip{zip: zip.NewWriter(w)}
+}
+
+// Create adds the file to the archive.  Each file must be closed before the next is created
+func (z *ExportZip) Create(name string) (io.WriteCloser, error) {
+	return z.create(name, zip.Deflate)
+}
+
+// create adds the file to the archive, compressed with the method
+func (z *ExportZip) create(name string, method uint16) (io.WriteCloser, error) {
+	name, err := exportPath(name)
+	if err != nil {
+		return nil, err
+	}
+	w, err := z.zip.CreateHeader(&zip.FileHeader{
+		Name:         name,
+		Method:       method,
+		ModifiedDate: exportModifiedDate,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return nopWriteCloser{w}, nil
+}
+
+// Close finishes the archive.  It doesn't close the underlying writer
+func (z *ExportZip) Close() error {
+	return z.zip.Close()
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// exportPath cleans the path of an exported file, which must stay inside the export
+func exportPath(name string) (string, error) {
+	clean := path.Clean("/" + name)[1:]
+	if clean == "" || clean != strings.TrimPrefix(name, "/") {
+		return "", NewFailure("Invalid export path " + name)
+	}
+	return clean, nil
+}
+
+// exportSlug returns the name with everything but letters and numbers replaced by dashes, so it can be used as a
+// file name, or the fallback if nothing is left
+func exportSlug(name, fallback string) string {
+	slug := strings.Trim(strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return '-'
+	}, name), "-")
+	if slug == "" {
+		return fallback
+	}
+	return slug
+}
+
+// exportFile writes a file to the target
+func exportFile(target ExportTarget, name string, fn func(w io.Writer) error) error {
+	w, err := target.Create(name)
+	if err != nil {
+		return err
+	}
+	err = fn(w)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// exportLibrary is the part of the library being exported, nested as it is in the library
+type exportLibrary struct {
+	who         *User
+	root        *exportCollection
+	collections []*exportCollection // every collection nested in the root, in the order they are nested
+	documents   []*exportDocument   // by title
+	byID        map[string]*exportDocument
+}
+
+// exportCollection is an exported collection.  The root of a library export has no collection
+type exportCollection struct {
+	collection *Collection
+	parent     *exportCollection
+	children   []*exportCollection // by name
+	documents  []*exportDocument   // by title
+}
+
+// exportDocument is an exported document, with the revision that is exported
+type exportDocument struct {
+	document    *Document
+	revision    *Revision
+	collection  *exportCollection
+	tags        []string // by name
+	attachments []*Attachment
+}
+
+// newExportLibrary loads the published documents the user can read in the collection and the collections nested
+// in it, or in the whole library if collection is nil
+func newExportLibrary(who *User, collection *Collection) (*exportLibrary, error) {
+	if who == nil {
+		return nil, Unauthorized("You must log in")
+	}
+	all, err := CollectionList(who)
+	if err != nil {
+		return nil, err
+	}
+
+	children := make(map[string][]*Collection)
+	readable := make(map[string]bool, len(all))
+	for _, c := range all {
+		readable[c.ID] = true
+	}
+	for _, c := range all {
+		parentID := c.ParentID
+		if !readable[parentID] {
+			// nested in a collection the user can't read, so it's shown at the top level of the library
+			parentID = ""
+		}
+		children[parentID] = append(children[parentID], c)
+	}
+
+	l := &exportLibrary{
+		who:  who,
+		root: &exportCollection{collection: collection},
+		byID: make(map[string]*exportDocument),
+	}
+	rootID := ""
+	if collection != nil {
+		rootID = collection.ID
+	}
+	byCollection := map[string]*exportCollection{rootID: l.root}
+	var nest func(parent *exportCollection, id string)
+	nest = func(parent *exportCollection, id string) {
+		list := children[id]
+		sort.SliceStable(list, func(i, j int) bool {
+			if list[i].Name != list[j].Name {
+				return list[i].Name < list[j].Name
+			}
+			return list[i].ID < list[j].ID
+		})
+		for _, c := range list {
+			child := &exportCollection{collection: c, parent: parent}
+			parent.children = append(parent.children, child)
+			l.collections = append(l.collections, child)
+			byCollection[c.ID] = child
+			nest(child, c.ID)
+		}
+	}
+	nest(l.root, rootID)
+
+	for offset := 0; ; offset += maxRows {
+		documents, err := DocumentList(who, offset, maxRows)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range documents {
+			if d.Status != DocumentStatusPublished {
+				continue
+			}
+			parent, ok := byCollection[d.CollectionID]
+			if !ok {
+				if collection != nil {
+					continue
+				}
+				// in a collection the user can't read
+				parent = l.root
+			}
+			e, err := newExportDocument(d, parent)
+			if err != nil {
+				return nil, err
+			}
+			l.documents = append(l.documents, e)
+			l.byID[d.ID] = e
+		}
+		if len(documents) < maxRows {
+			break
+		}
+	}
+
+	sortExportDocuments(l.documents)
+	for _, d := range l.documents {
+		d.collection.documents = append(d.collection.documents, d)
+	}
+	return l, nil
+}
+
+func newExportDocument(d *Document, collection *exportCollection) (*exportDocument, error) {
+	r, err := d.Published()
+	if err != nil {
+		return nil, err
+	}
+	tags, err := d.Tags()
+	if err != nil {
+		return nil, err
+	}
+	attachments, err := d.Attachments()
+	if err != nil {
+		return nil, err
+	}
+
+	e := &exportDocument{
+		document:    d,
+		revision:    r,
+		collection:  collection,
+		attachments: attachments,
+	}
+	for _, t := range tags {
+		e.tags = append(e.tags, t.Name)
+	}
+	sort.Strings(e.tags)
+	return e, nil
+}
+
+func sortExportDocuments(documents []*exportDocument) {
+	sort.SliceStable(documents, func(i, j int) bool {
+		if documents[i].revision.Title != documents[j].revision.Title {
+			return documents[i].revision.Title < documents[j].revision.Title
+		}
+		return documents[i].document.ID < documents[j].document.ID
+	})
+}
+
+// name is the name of the collection, or the site name of the tenant for the root of a library export
+func (c *exportCollection) name(l *exportLibrary) (string, error) {
+	if c.collection != nil {
+		return c.collection.Name, nil
+	}
+	tenant, err := TenantGet(l.who.TenantID)
+	if err != nil {
+		return "", err
+	}
+	return tenant.Setting("SiteName"), nil
+}
+
+// path returns the collections from the root of the export down to this one, not including the root
+func (c *exportCollection) path() []*exportCollection {
+	var list []*exportCollection
+	for ; c.parent != nil; c = c.parent {
+		list = append([]*exportCollection{c}, list...)
+	}
+	return list
+}
+
+// exportAttachment copies an attachment's file to the target
+func exportAttachment(target ExportTarget, name string, a *Attachment) error {
+	r, err := a.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return exportFile(target, name, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
@@ -0,0 +1,513 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+/*
+	An EPUB export builds an EPUB 3 book from the exported documents, with each document as a chapter, in the order
+	of the collections they are in.  The table of contents nests the chapters under their collections, and the top
+	three levels of headings under their chapters.
+
+		mimetype				first and uncompressed, as the EPUB spec requires
+		META-INF/container.xml			points readers at the package document
+		OEBPS/content.opf			the metadata, manifest and reading order of the book
+		OEBPS/nav.xhtml				the table of contents
+		OEBPS/<id>.xhtml			each chapter
+		OEBPS/attachments/<id>/<name>		the images attached to each chapter's document
+
+	Chapters are in the same folder, and keep the same relative paths to their images, so image links don't need to
+	be rewritten.  Only images that are attached to their document are embedded.  Anything else the book can't
+	include, like other images, audio and video, is removed, along with links to attachments and documents that
+	aren't in the book.
+*/
+
+// epubImageTypes are the image formats every EPUB reader supports
+var epubImageTypes = map[string]bool{
+	"image/gif":     true,
+	"image/jpeg":    true,
+	"image/png":     true,
+	"image/svg+xml": true,
+	"image/webp":    true,
+}
+
+type epubBook struct {
+	library  *exportLibrary
+	title    string
+	chapters []*epubChapter // in reading order
+	byID     map[string]*epubChapter
+}
+
+type epubChapter struct {
+	document *exportDocument
+	body     string // XHTML
+	title    bool   // true if the body needs the document's title as its heading
+	headings []epubHeading
+	images   []*Attachment
+}
+
+type epubHeading struct {
+	level int
+	id    string
+	text  string
+}
+
+// ExportEPUB writes the published documents the user can read, in the collection and the collections nested in
+// it, or in the whole library if collection is nil, to the writer as an EPUB 3 book.  It returns the number of
+// documents exported
+func ExportEPUB(who *User, collection *Collection, w io.Writer) (int, error) {
+	l, err := newExportLibrary(who, collection)
+	if err != nil {
+		return 0, err
+	}
+	if len(l.documents) == 0 {
+		return 0, NewFailure("There are no published documents to export")
+	}
+	title, err := l.root.name(l)
+	if err != nil {
+		return 0, err
+	}
+
+	b := &epubBook{
+		library: l,
+		title:   title,
+		byID:    make(map[string]*epubChapter, len(l.documents)),
+	}
+	var order func(c *exportCollection)
+	order = func(c *exportCollection) {
+		for _, d := range c.documents {
+			chapter := &epubChapter{document: d}
+			b.chapters = append(b.chapters, chapter)
+			b.byID[d.document.ID] = chapter
+		}
+		for _, child := range c.children {
+			order(child)
+		}
+	}
+	order(l.root)
+	for _, c := range b.chapters {
+		err = b.convert(c)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	z := NewExportZip(w)
+	err = b.write(z)
+	if err != nil {
+		return 0, err
+	}
+	err = z.Close()
+	if err != nil {
+		return 0, err
+	}
+	return len(l.documents), nil
+}
+
+// convert converts the body of the chapter's document to XHTML, and finds its headings and images
+func (b *epubBook) convert(c *epubChapter) error {
+	nodes, err := html.ParseFragment(strings.NewReader(c.document.revision.Body), &html.Node{
+		Type:     html.ElementNode,
+		Data:     "body",
+		DataAtom: atom.Body,
+	})
+	if err != nil {
+		return err
+	}
+	root := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	for _, n := range nodes {
+		root.AppendChild(n)
+	}
+
+	attachments := make(map[string]*Attachment, len(c.document.attachments))
+	for _, a := range c.document.attachments {
+		attachments[a.URL()] = a
+	}
+	embedded := make(map[string]bool)
+	ids := make(map[string]bool)
+	for _, n := range findElements(root, func(n *html.Node) bool { return hasAttr(n, "id") }) {
+		ids[attrValue(n, "id")] = true
+	}
+
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		for child := n.FirstChild; child != nil; {
+			next := child.NextSibling
+			if child.Type == html.ElementNode {
+				switch child.DataAtom {
+				case atom.Img:
+					a, ok := attachments[attrValue(child, "src")]
+					if !ok || !epubImageTypes[a.ContentType] {
+						n.InsertBefore(&html.Node{Type: html.TextNode, Data: attrValue(child, "alt")}, child)
+						n.RemoveChild(child)
+						break
+					}
+					if !embedded[a.ID] {
+						embedded[a.ID] = true
+						c.images = append(c.images, a)
+					}
+				case atom.Audio, atom.Video, atom.Source:
+					n.RemoveChild(child)
+				case atom.A:
+					b.link(child)
+					walk(child)
+				case atom.H1, atom.H2, atom.H3:
+					c.headings = append(c.headings, epubHeading{
+						level: int(child.Data[1] - '0'),
+						id:    epubHeadingID(child, ids),
+						text:  nodeText(child),
+					})
+					walk(child)
+				default:
+					walk(child)
+				}
+			}
+			child = next
+		}
+	}
+	walk(root)
+
+	// links to attachments are only kept once every embedded image is known
+	for _, a := range findElements(root, func(n *html.Node) bool { return n.DataAtom == atom.A }) {
+		if at, ok := attachments[attrValue(a, "href")]; ok && !embedded[at.ID] {
+			removeAttr(a, "href")
+		}
+	}
+
+	title := c.document.revision.Title
+	c.title = true
+	if len(c.headings) > 0 && c.headings[0].level == 1 && c.headings[0].text == title {
+		// the document already starts with its title
+		c.title = false
+		c.headings = c.headings[1:]
+	}
+
+	buf := &bytes.Buffer{}
+	for n := root.FirstChild; n != nil; n = n.NextSibling {
+		err = html.Render(buf, n)
+		if err != nil {
+			return err
+		}
+	}
+	c.body = buf.String()
+	return nil
+}
+
+// link points a link to another document at its chapter, and removes it if the document isn't in the book
+func (b *epubBook) link(a *html.Node) {
+	href := attrValue(a, "href")
+	u, err := url.Parse(href)
+	if err != nil || !reDocumentLink.MatchString(u.Path) {
+		return
+	}
+	id := strings.Trim(u.Path, "./")
+	if _, ok := b.byID[id]; !ok {
+		removeAttr(a, "href")
+		return
+	}
+	u.Path = id + ".xhtml"
+	setAttr(a, "href", u.String())
+}
+
+// epubHeadingID returns the id of the heading, giving it one that isn't used yet if it doesn't have one
+func epubHeadingID(n *html.Node, ids map[string]bool) string {
+	if id := attrValue(n, "id"); id != "" {
+		return id
+	}
+	id := ""
+	for i := 1; id == "" || ids[id]; i++ {
+		id = "heading-" + strconv.Itoa(i)
+	}
+	ids[id] = true
+	setAttr(n, "id", id)
+	return id
+}
+
+func setAttr(n *html.Node, key, value string) {
+	for i := range n.Attr {
+		if n.Attr[i].Key == key && n.Attr[i].Namespace == "" {
+			n.Attr[i].Val = value
+			return
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: key, Val: value})
+}
+
+func removeAttr(n *html.Node, key string) {
+	attrs := n.Attr[:0]
+	for _, a := range n.Attr {
+		if a.Key != key || a.Namespace != "" {
+			attrs = append(attrs, a)
+		}
+	}
+	n.Attr = attrs
+}
+
+// write writes the files of the book to the archive, starting with the uncompressed mimetype
+func (b *epubBook) write(z *ExportZip) error {
+	w, err := z.create("mimetype", zip.Store)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "application/epub+zip")
+	if err != nil {
+		return err
+	}
+
+	files := []struct {
+		name    string
+		content func() (string, error)
+	}{
+		{"META-INF/container.xml", func() (string, error) { return epubContainer, nil }},
+		{"OEBPS/content.opf", b.pkg},
+		{"OEBPS/nav.xhtml", func() (string, error) { return b.nav(), nil }},
+		{"OEBPS/style.css", func() (string, error) { return epubStyle, nil }},
+	}
+	for _, f := range files {
+		content, err := f.content()
+		if err != nil {
+			return err
+		}
+		err = exportFile(z, f.name, func(w io.Writer) error {
+			_, err := io.WriteString(w, content)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, c := range b.chapters {
+		err = exportFile(z, "OEBPS/"+c.document.document.ID+".xhtml", func(w io.Writer) error {
+			_, err := io.WriteString(w, c.xhtml())
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for _, a := range c.images {
+			err = exportAttachment(z, "OEBPS/attachments/"+a.ID+"/"+a.Name, a)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pkg returns the package document, with the book's metadata, every file in the book, and the reading order
+func (b *epubBook) pkg() (string, error) {
+	tenant, err := TenantGet(b.library.who.TenantID)
+	if err != nil {
+		return "", err
+	}
+
+	identifier := "urn:lexlibrary:library:" + tenant.ID
+	if tenant.IsDefault() {
+		identifier = "urn:lexlibrary:library:default"
+	}
+	if b.library.root.collection != nil {
+		identifier = "urn:lexlibrary:collection:" + b.library.root.collection.ID
+	}
+
+	modified := b.chapters[0].document.revision.Created
+	authors := make(map[string]bool)
+	for _, c := range b.chapters {
+		if c.document.revision.Created.After(modified) {
+			modified = c.document.revision.Created
+		}
+		authors[c.document.revision.Author] = true
+	}
+	var creators []string
+	for id := range authors {
+		u, err := UserGet(tenant, id)
+		if IsFailType(err, FailNotFound) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		name := u.Name
+		if name == "" {
+			name = u.Username
+		}
+		creators = append(creators, name)
+	}
+	sort.Strings(creators)
+
+	buf := &bytes.Buffer{}
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="book-id" xml:lang="en">
+<metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+<dc:identifier id="book-id">` + escapeHTML(identifier) + `</dc:identifier>
+<dc:title>` + escapeHTML(b.title) + `</dc:title>
+<dc:language>en</dc:language>
+`)
+	for _, creator := range creators {
+		buf.WriteString("<dc:creator>" + escapeHTML(creator) + "</dc:creator>\n")
+	}
+	buf.WriteString(`<dc:publisher>` + escapeHTML(tenant.Setting("SiteName")) + `</dc:publisher>
+<meta property="dcterms:modified">` + modified.UTC().Format("2006-01-02T15:04:05Z") + `</meta>
+</metadata>
+<manifest>
+<item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+<item id="style" href="style.css" media-type="text/css"/>
+`)
+	for _, c := range b.chapters {
+		id := c.document.document.ID
+		buf.WriteString(`<item id="d` + id + `" href="` + id + `.xhtml" media-type="application/xhtml+xml"/>` + "\n")
+		for _, a := range c.images {
+			buf.WriteString(`<item id="a` + a.ID + `" href="` + escapeHTML(a.URL()) + `" media-type="` +
+				a.ContentType + `"/>` + "\n")
+		}
+	}
+	buf.WriteString("</manifest>\n<spine>\n<itemref idref=\"nav\"/>\n")
+	for _, c := range b.chapters {
+		buf.WriteString(`<itemref idref="d` + c.document.document.ID + `"/>` + "\n")
+	}
+	buf.WriteString("</spine>\n</package>\n")
+	return buf.String(), nil
+}
+
+// nav returns the navigation document, with the table of contents
+func (b *epubBook) nav() string {
+	buf := &bytes.Buffer{}
+	buf.WriteString(epubXHTMLStart("Contents"))
+	buf.WriteString("<nav epub:type=\"toc\" id=\"toc\">\n<h1>Contents</h1>\n<ol>\n")
+	b.navCollection(buf, b.library.root)
+	buf.WriteString("</ol>\n</nav>\n</body>\n</html>\n")
+	return buf.String()
+}
+
+// navCollection writes the items of the collection's chapters, and of the collections nested in it that have
+// chapters
+func (b *epubBook) navCollection(buf *bytes.Buffer, c *exportCollection) {
+	for _, d := range c.documents {
+		chapter := b.byID[d.document.ID]
+		href := d.document.ID + ".xhtml"
+		buf.WriteString(`<li><a href="` + href + `">` + escapeHTML(d.revision.Title) + "</a>")
+		if len(chapter.headings) > 0 {
+			buf.WriteString("\n")
+			epubNavHeadings(buf, href, chapter.headings)
+		}
+		buf.WriteString("</li>\n")
+	}
+	for _, child := range c.children {
+		if !epubHasChapters(child) {
+			continue
+		}
+		buf.WriteString("<li><span>" + escapeHTML(child.collection.Name) + "</span>\n<ol>\n")
+		b.navCollection(buf, child)
+		buf.WriteString("</ol>\n</li>\n")
+	}
+}
+
+func epubHasChapters(c *exportCollection) bool {
+	if len(c.documents) > 0 {
+		return true
+	}
+	for _, child := range c.children {
+		if epubHasChapters(child) {
+			return true
+		}
+	}
+	return false
+}
+
+// epubNavHeadings writes the headings as a list, with each heading nested under the last heading above its
+// level
+func epubNavHeadings(buf *bytes.Buffer, href string, headings []epubHeading) {
+	buf.WriteString("<ol>\n")
+	levels := []int{headings[0].level}
+	for i, h := range headings {
+		if i > 0 {
+			if h.level > levels[len(levels)-1] {
+				buf.WriteString("\n<ol>\n")
+				levels = append(levels, h.level)
+			} else {
+				buf.WriteString("</li>\n")
+				for len(levels) > 1 && h.level < levels[len(levels)-1] {
+					levels = levels[:len(levels)-1]
+					buf.WriteString("</ol>\n</li>\n")
+				}
+			}
+		}
+		buf.WriteString(`<li><a href="` + href + "#" + escapeHTML(h.id) + `">` + escapeHTML(h.text) + "</a>")
+	}
+	buf.WriteString("</li>\n")
+	for len(levels) > 1 {
+		levels = levels[:len(levels)-1]
+		buf.WriteString("</ol>\n</li>\n")
+	}
+	buf.WriteString("</ol>\n")
+}
+
+// xhtml returns the chapter as an XHTML content document
+func (c *epubChapter) xhtml() string {
+	buf := &bytes.Buffer{}
+	buf.WriteString(epubXHTMLStart(c.document.revision.Title))
+	if c.title {
+		buf.WriteString("<h1>" + escapeHTML(c.document.revision.Title) + "</h1>\n")
+	}
+	buf.WriteString(strings.TrimSpace(c.body))
+	buf.WriteString("\n</body>\n</html>\n")
+	return buf.String()
+}
+
+// epubXHTMLStart returns the start of an XHTML content document, up to the start of its body
+func epubXHTMLStart(title string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" lang="en" xml:lang="en">
+<head>
+<title>` + escapeHTML(title) + `</title>
+<link rel="stylesheet" type="text/css" href="style.css"/>
+</head>
+<body>
+`
+}
+
+const epubContainer = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+<rootfiles>
+<rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+</rootfiles>
+</container>
+`
+
+const epubStyle = `body {
+	line-height: 1.5;
+}
+
+img {
+	max-width: 100%;
+}
+
+pre {
+	white-space: pre-wrap;
+}
+
+table {
+	border-collapse: collapse;
+}
+
+th, td {
+	padding: 0.25em 0.5em;
+	border: 1px solid #999;
+}
+
+nav ol {
+	list-style: none;
+}
+`
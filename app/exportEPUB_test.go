@@ -0,0 +1,211 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/lexLibrary/lexLibrary/app"
+)
+
+var reXMLHref = regexp.MustCompile(`(?:href|src)="([^"]*)"`)
+
+func TestExportEPUB(t *testing.T) {
+	f := newExportFixture(t)
+
+	buf := &bytes.Buffer{}
+	count, err := app.ExportEPUB(f.author, f.guides, buf)
+	if err != nil {
+		t.Fatalf("Error exporting EPUB: %s", err)
+	}
+	if count != 2 {
+		t.Fatalf("Invalid number of documents exported. Wanted %d got %d", 2, count)
+	}
+
+	files := readZip(t, buf.Bytes())
+	byName := make(map[string]*zip.File, len(files))
+	for _, file := range files {
+		byName[file.Name] = file
+	}
+
+	t.Run("Mimetype", func(t *testing.T) {
+		mimetype := files[0]
+		if mimetype.Name != "mimetype" {
+			t.Fatalf("The first file in the book isn't the mimetype: %s", mimetype.Name)
+		}
+		if mimetype.Method != zip.Store {
+			t.Fatalf("The mimetype is compressed")
+		}
+		if len(mimetype.Extra) != 0 {
+			t.Fatalf("The mimetype has extra fields")
+		}
+		if string(readZipFile(t, mimetype)) != "application/epub+zip" {
+			t.Fatalf("Invalid mimetype: %s", readZipFile(t, mimetype))
+		}
+	})
+
+	t.Run("Well Formed", func(t *testing.T) {
+		for _, file := range files {
+			ext := path.Ext(file.Name)
+			if ext != ".xml" && ext != ".opf" && ext != ".xhtml" {
+				continue
+			}
+			decoder := xml.NewDecoder(bytes.NewReader(readZipFile(t, file)))
+			for {
+				_, err := decoder.Token()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("%s isn't well formed XML: %s", file.Name, err)
+				}
+			}
+		}
+	})
+
+	t.Run("Package", func(t *testing.T) {
+		var container struct {
+			Rootfiles []struct {
+				FullPath  string `xml:"full-path,attr"`
+				MediaType string `xml:"media-type,attr"`
+			} `xml:"rootfiles>rootfile"`
+		}
+		err := xml.Unmarshal(readZipFile(t, byName["META-INF/container.xml"]), &container)
+		if err != nil {
+			t.Fatalf("Error reading container: %s", err)
+		}
+		if len(container.Rootfiles) != 1 || container.Rootfiles[0].MediaType != "application/oebps-package+xml" {
+			t.Fatalf("Invalid container: %+v", container)
+		}
+		opf, ok := byName[container.Rootfiles[0].FullPath]
+		if !ok {
+			t.Fatalf("The package document %s doesn't exist", container.Rootfiles[0].FullPath)
+		}
+
+		var pkg struct {
+			UniqueIdentifier string `xml:"unique-identifier,attr"`
+			Identifiers      []struct {
+				ID    string `xml:"id,attr"`
+				Value string `xml:",chardata"`
+			} `xml:"metadata>identifier"`
+			Title    string `xml:"metadata>title"`
+			Language string `xml:"metadata>language"`
+			Meta     []struct {
+				Property string `xml:"property,attr"`
+				Value    string `xml:",chardata"`
+			} `xml:"metadata>meta"`
+			Items []struct {
+				ID         string `xml:"id,attr"`
+				Href       string `xml:"href,attr"`
+				MediaType  string `xml:"media-type,attr"`
+				Properties string `xml:"properties,attr"`
+			} `xml:"manifest>item"`
+			Spine []struct {
+				IDRef string `xml:"idref,attr"`
+			} `xml:"spine>itemref"`
+		}
+		err = xml.Unmarshal(readZipFile(t, opf), &pkg)
+		if err != nil {
+			t.Fatalf("Error reading package document: %s", err)
+		}
+
+		if len(pkg.Identifiers) != 1 || pkg.Identifiers[0].ID != pkg.UniqueIdentifier ||
+			pkg.Identifiers[0].Value == "" {
+			t.Fatalf("Invalid identifier: %+v", pkg.Identifiers)
+		}
+		if pkg.Title != "Guides" {
+			t.Fatalf("Invalid title. Wanted %s got %s", "Guides", pkg.Title)
+		}
+		if pkg.Language == "" {
+			t.Fatalf("The book has no language")
+		}
+		modified := false
+		for _, meta := range pkg.Meta {
+			if meta.Property == "dcterms:modified" && reGoldenTime.MatchString(meta.Value) {
+				modified = true
+			}
+		}
+		if !modified {
+			t.Fatalf("The book has no modified date: %+v", pkg.Meta)
+		}
+
+		dir := path.Dir(opf.Name)
+		items := make(map[string]bool, len(pkg.Items))
+		nav := 0
+		for _, item := range pkg.Items {
+			name := path.Join(dir, item.Href)
+			if _, ok := byName[name]; !ok {
+				t.Fatalf("Manifest item %s doesn't exist", name)
+			}
+			items[item.ID] = true
+			if item.Properties == "nav" {
+				nav++
+			}
+
+			if item.MediaType != "application/xhtml+xml" {
+				continue
+			}
+			for _, match := range reXMLHref.FindAllStringSubmatch(string(readZipFile(t, byName[name])), -1) {
+				u, err := url.Parse(match[1])
+				if err != nil {
+					t.Fatalf("Invalid link %s in %s: %s", match[1], name, err)
+				}
+				if u.IsAbs() || u.Path == "" {
+					continue
+				}
+				target, err := url.PathUnescape(path.Join(path.Dir(name), u.Path))
+				if err != nil {
+					t.Fatalf("Invalid link %s in %s: %s", match[1], name, err)
+				}
+				if _, ok := byName[target]; !ok {
+					t.Fatalf("Link %s in %s doesn't exist", match[1], name)
+				}
+			}
+		}
+		if nav != 1 {
+			t.Fatalf("The book has %d navigation documents", nav)
+		}
+		if len(pkg.Spine) == 0 {
+			t.Fatalf("The book has an empty spine")
+		}
+		for _, ref := range pkg.Spine {
+			if !items[ref.IDRef] {
+				t.Fatalf("Spine item %s isn't in the manifest", ref.IDRef)
+			}
+		}
+	})
+
+	t.Run("Golden", func(t *testing.T) {
+		compareGolden(t, "epub.golden", f.golden(t, files))
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		empty, err := app.CollectionNew(f.author, "Nothing Here")
+		if err != nil {
+			t.Fatalf("Error creating collection: %s", err)
+		}
+		_, err = app.ExportEPUB(f.author, empty, &bytes.Buffer{})
+		if !app.IsFail(err) {
+			t.Fatalf("Exporting an empty collection didn't fail: %v", err)
+		}
+	})
+
+	t.Run("Title", func(t *testing.T) {
+		// the chapter heading isn't repeated when the document starts with its title
+		intro := byName["OEBPS/"+f.intro.ID+".xhtml"]
+		if intro == nil {
+			t.Fatalf("The introduction isn't in the book")
+		}
+		if n := strings.Count(string(readZipFile(t, intro)), "<h1"); n != 1 {
+			t.Fatalf("The introduction has %d h1 headings", n)
+		}
+	})
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"io"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html/atom"
+	yaml "gopkg.in/yaml.v2"
+)
+
+/*
+	A Markdown export writes each document as a Markdown file with YAML front matter, in the form the Markdown
+	importer reads (see importMarkdown.go), so an exported collection can be edited elsewhere and imported again.
+	Each nested collection is a folder, and files are named after the title of their document or collection:
+
+		introduction.md
+		attachments/<id>/<name>		the files attached to the documents in the folder
+		setup/installing.md
+
+	Links between exported documents point at their Markdown files, and links to documents that weren't exported
+	are removed.
+*/
+
+// markdownFrontMatter is the front matter of an exported document, in the order it's written
+type markdownFrontMatter struct {
+	Title       string   `yaml:"title"`
+	Description string   `yaml:"description,omitempty"`
+	Tags        []string `yaml:"tags,omitempty"`
+	Date        string   `yaml:"date"`
+	Lastmod     string   `yaml:"lastmod"`
+}
+
+// ExportMarkdown writes the published documents the user can read, in the collection and the collections nested
+// in it, or in the whole library if collection is nil, to the target as Markdown files.  It returns the number of
+// documents exported
+func ExportMarkdown(who *User, collection *Collection, target ExportTarget) (int, error) {
+	l, err := newExportLibrary(who, collection)
+	if err != nil {
+		return 0, err
+	}
+
+	files := make(map[string]string, len(l.documents))
+	markdownFiles(l.root, "", files)
+
+	for _, d := range l.documents {
+		file := files[d.document.ID]
+		dir := path.Dir(file)
+		err = exportFile(target, file, func(w io.Writer) error {
+			text, err := markdownDocument(d, func(id string) (string, bool) {
+				other, ok := files[id]
+				if !ok {
+					return "", false
+				}
+				return relativePath(dir, other), true
+			})
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(w, text)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+
+		for _, a := range d.attachments {
+			err = exportAttachment(target, path.Join(dir, "attachments", a.ID, a.Name), a)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(l.documents), nil
+}
+
+// markdownFiles names the file of each document in the collection and the collections nested in it, by document
+// id.  Names that are already taken in a folder are numbered in order, so they always get the same names
+func markdownFiles(c *exportCollection, dir string, files map[string]string) {
+	used := make(map[string]bool)
+	name := func(base string) string {
+		slug := base
+		for n := 2; used[slug]; n++ {
+			slug = base + "-" + strconv.Itoa(n)
+		}
+		used[slug] = true
+		return slug
+	}
+
+	for _, d := range c.documents {
+		files[d.document.ID] = path.Join(dir, name(exportSlug(d.revision.Title, "document"))+".md")
+	}
+	// folders can't use the names of the documents' files, or the folder holding their attachments
+	used["attachments"] = true
+	for _, child := range c.children {
+		markdownFiles(child, path.Join(dir, name(exportSlug(child.collection.Name, "collection"))), files)
+	}
+}
+
+// markdownDocument returns the document as Markdown with front matter.  link returns the relative link to the
+// file of another exported document, and false if it wasn't exported
+func markdownDocument(d *exportDocument, link func(id string) (string, bool)) (string, error) {
+	matter := markdownFrontMatter{
+		Title:   d.revision.Title,
+		Tags:    d.tags,
+		Date:    d.document.Created.UTC().Format(time.RFC3339),
+		Lastmod: d.revision.Created.UTC().Format(time.RFC3339),
+	}
+	if d.revision.SummaryManual {
+		matter.Description = d.revision.Summary
+	}
+	front, err := yaml.Marshal(matter)
+	if err != nil {
+		return "", err
+	}
+
+	body := rewriteLinks(d.revision.Body, func(element atom.Atom, href string) (string, bool) {
+		u, err := url.Parse(href)
+		if err != nil || !reDocumentLink.MatchString(u.Path) {
+			return "", false
+		}
+		file, ok := link(strings.Trim(u.Path, "./"))
+		if !ok {
+			return "", true
+		}
+		u.Path = file
+		return u.String(), true
+	})
+
+	return "---\n" + string(front) + "---\n\n" + htmlToMarkdown(body), nil
+}
+
+// relativePath returns the relative path to the slash separated file from the directory.  Both are relative to
+// the same root
+func relativePath(dir, file string) string {
+	var from []string
+	if dir != "." && dir != "" {
+		from = strings.Split(dir, "/")
+	}
+	to := strings.Split(file, "/")
+
+	common := 0
+	for common < len(from) && common < len(to)-1 && from[common] == to[common] {
+		common++
+	}
+	return strings.Repeat("../", len(from)-common) + strings.Join(to[common:], "/")
+}
@@ -0,0 +1,317 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/lexLibrary/lexLibrary/app"
+)
+
+// exportFixture is the library the export golden files are built from
+type exportFixture struct {
+	author *app.User
+	guides *app.Collection
+	intro  *app.Document
+	// names replace the ids in exported files, so they are the same every time the tests run
+	names map[string]string
+}
+
+func newExportFixture(t *testing.T) *exportFixture {
+	resetDocuments(t)
+
+	tenant, err := app.TenantNew(installAdmin(t), "Export Fixture Tenant", "", "")
+	if err != nil {
+		t.Fatalf("Error creating tenant: %s", err)
+	}
+	f := &exportFixture{
+		author: testUser(t, tenant, "author"),
+		names:  make(map[string]string),
+	}
+
+	f.guides, err = app.CollectionNew(f.author, "Guides")
+	if err != nil {
+		t.Fatalf("Error creating collection: %s", err)
+	}
+	setup, err := f.guides.NewChild("Setup")
+	if err != nil {
+		t.Fatalf("Error creating collection: %s", err)
+	}
+	_, err = f.guides.NewChild("Empty")
+	if err != nil {
+		t.Fatalf("Error creating collection: %s", err)
+	}
+	f.names[f.guides.ID] = "guides"
+	f.names[setup.ID] = "setup"
+
+	logo, err := ioutil.ReadFile(filepath.Join("testdata", "import", "img", "logo.png"))
+	if err != nil {
+		t.Fatalf("Error reading image: %s", err)
+	}
+	result, err := app.ImportMarkdown(f.author, f.guides, app.ImportFiles{
+		"img/logo.png": logo,
+		"intro.md": []byte(`---
+title: Introduction
+description: Where to start
+tags: [getting started, guides]
+date: 2017-01-02T03:04:05Z
+lastmod: 2017-03-04T05:06:07Z
+---
+# Introduction
+
+Lex Library keeps *all* of your **documents** in one place, with ~~no~~ ` + "`code`" + ` and a
+[link](https://example.com "Example").
+
+![The logo](img/logo.png)
+
+## Features
+
+- Search
+- [Tags](https://example.com/tags)
+  - nested
+- [x] Done
+
+1. First
+2. Second
+
+> A quote
+> > nested
+
+` + "```go\nfunc main() {\n\tfmt.Println(\"`\")\n}\n```" + `
+
+| Name | Value |
+| :--- | ---: |
+| a | 1 |
+| b\|c | 2 |
+
+### Details
+
+Line one\
+line two has snake_case, 2 * 3 and <angle> brackets.
+
+---
+
+#1 isn't a heading.
+`),
+	}, "intro.md")
+	if err != nil {
+		t.Fatalf("Error importing document: %s", err)
+	}
+	if len(result.Warnings) != 0 {
+		t.Fatalf("Document imported with warnings: %v", result.Warnings)
+	}
+	intro := result.Document
+	f.intro = intro
+	attachments, err := intro.Attachments()
+	if err != nil || len(attachments) != 1 {
+		t.Fatalf("Error getting attachments: %v %v", attachments, err)
+	}
+	f.names[intro.ID] = "intro"
+	f.names[attachments[0].ID] = "logo"
+
+	elsewhere := f.document(t, nil, "Elsewhere", "<p>Not in the guides.</p>", true)
+	f.document(t, f.guides, "Draft", "<p>Not published.</p>", false)
+	f.document(t, setup, "Installing", `<p>Read the <a href="../`+intro.ID+`/#features">introduction</a> and the
+		<a href="../`+elsewhere.ID+`/">other notes</a> first.</p>
+		<h2>Download</h2><p><img src="https://example.com/download.png" alt="Download button"></p>
+		<h3>Checksums</h3><p>Check the <em>checksum</em>.</p>
+		<h2>Install</h2><ol start="3"><li><p>Run it</p></li><li><p>Done</p><ul><li>really</li></ul></li></ol>
+		<table><tr><th colspan="2">Merged</th></tr><tr><td>a</td><td>b</td></tr></table>`, true)
+
+	err = intro.Publish(0)
+	if err != nil {
+		t.Fatalf("Error publishing document: %s", err)
+	}
+	return f
+}
+
+func (f *exportFixture) document(t *testing.T, collection *app.Collection, title, body string,
+	publish bool) *app.Document {
+	doc, err := app.DocumentNew(f.author, collection, title, body)
+	if err != nil {
+		t.Fatalf("Error creating document: %s", err)
+	}
+	if publish {
+		err = doc.Publish(0)
+		if err != nil {
+			t.Fatalf("Error publishing document: %s", err)
+		}
+	}
+	f.names[doc.ID] = strings.ToLower(title)
+	return doc
+}
+
+var (
+	reGoldenTime     = regexp.MustCompile(`\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}Z`)
+	reAttachmentLink = regexp.MustCompile(`attachments/[0-9a-f]{32}/`)
+	reSpace          = regexp.MustCompile(`\s+`)
+)
+
+// golden lists the files in the archive with their contents.  Ids are replaced with their names, and times that
+// depend on when the test ran are replaced, so the listing is the same every time
+func (f *exportFixture) golden(t *testing.T, files []*zip.File) string {
+	var pairs []string
+	for id, name := range f.names {
+		pairs = append(pairs, id, "{"+name+"}")
+	}
+	replacer := strings.NewReplacer(pairs...)
+
+	buf := &bytes.Buffer{}
+	for _, file := range files {
+		content := readZipFile(t, file)
+		buf.WriteString("=== " + replacer.Replace(file.Name) + " ===\n")
+		if !utf8.Valid(content) || bytes.IndexByte(content, 0) != -1 {
+			buf.WriteString("(binary)\n")
+			continue
+		}
+		text := replacer.Replace(string(content))
+		text = reGoldenTime.ReplaceAllStringFunc(text, func(time string) string {
+			if strings.HasPrefix(time, "2017-") {
+				return time
+			}
+			return "{time}"
+		})
+		buf.WriteString(text)
+		if !strings.HasSuffix(text, "\n") {
+			buf.WriteString("\n")
+		}
+	}
+	return buf.String()
+}
+
+// compareGolden compares the output to the golden file in testdata/export, or updates the golden file when the
+// tests are run with -update
+func compareGolden(t *testing.T, name, output string) {
+	filename := filepath.Join("testdata", "export", name)
+	if flagUpdate {
+		err := ioutil.WriteFile(filename, []byte(output), 0644)
+		if err != nil {
+			t.Fatalf("Error updating golden file: %s", err)
+		}
+	}
+	golden, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Error reading golden file: %s", err)
+	}
+	if string(golden) != output {
+		t.Fatalf("Output doesn't match the golden file %s, run the tests with -update if the change is "+
+			"expected. Got:\n%s", filename, output)
+	}
+}
+
+func readZip(t *testing.T, archive []byte) []*zip.File {
+	r, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("Error reading archive: %s", err)
+	}
+	return r.File
+}
+
+func readZipFile(t *testing.T, file *zip.File) []byte {
+	r, err := file.Open()
+	if err != nil {
+		t.Fatalf("Error opening %s: %s", file.Name, err)
+	}
+	defer r.Close()
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Error reading %s: %s", file.Name, err)
+	}
+	return content
+}
+
+func TestExportMarkdown(t *testing.T) {
+	f := newExportFixture(t)
+
+	buf := &bytes.Buffer{}
+	z := app.NewExportZip(buf)
+	count, err := app.ExportMarkdown(f.author, f.guides, z)
+	if err != nil {
+		t.Fatalf("Error exporting markdown: %s", err)
+	}
+	err = z.Close()
+	if err != nil {
+		t.Fatalf("Error closing archive: %s", err)
+	}
+	if count != 2 {
+		t.Fatalf("Invalid number of documents exported. Wanted %d got %d", 2, count)
+	}
+
+	files := readZip(t, buf.Bytes())
+	compareGolden(t, "markdown.golden", f.golden(t, files))
+
+	t.Run("Import", func(t *testing.T) {
+		source := app.ImportFiles{}
+		var names []string
+		for _, file := range files {
+			source[file.Name] = readZipFile(t, file)
+			if path.Ext(file.Name) == ".md" {
+				names = append(names, file.Name)
+			}
+		}
+		sort.Strings(names)
+
+		want := map[string]string{"introduction.md": "Introduction", "setup/installing.md": "Installing"}
+		if len(names) != len(want) {
+			t.Fatalf("Invalid markdown files exported: %v", names)
+		}
+		for _, name := range names {
+			result, err := app.ImportMarkdown(f.author, nil, source, name)
+			if err != nil {
+				t.Fatalf("Error importing exported file %s: %s", name, err)
+			}
+			if len(result.Warnings) != 0 {
+				t.Fatalf("Exported file %s imported with warnings: %v", name, result.Warnings)
+			}
+			rev, err := result.Document.Latest()
+			if err != nil {
+				t.Fatalf("Error getting revision: %s", err)
+			}
+			if rev.Title != want[name] {
+				t.Fatalf("Exported file %s imported with the wrong title. Wanted %s got %s", name, want[name],
+					rev.Title)
+			}
+		}
+	})
+
+	t.Run("Round Trip", func(t *testing.T) {
+		source := app.ImportFiles{}
+		for _, file := range files {
+			source[file.Name] = readZipFile(t, file)
+		}
+		result, err := app.ImportMarkdown(f.author, nil, source, "introduction.md")
+		if err != nil {
+			t.Fatalf("Error importing exported file: %s", err)
+		}
+		imported, err := result.Document.Latest()
+		if err != nil {
+			t.Fatalf("Error getting revision: %s", err)
+		}
+		original, err := f.intro.Published()
+		if err != nil {
+			t.Fatalf("Error getting revision: %s", err)
+		}
+
+		// the attachments are imported again, with new ids, and whitespace in text isn't kept exactly
+		normalize := func(body string) string {
+			return reSpace.ReplaceAllString(reAttachmentLink.ReplaceAllString(body, "attachments/id/"), " ")
+		}
+		got := normalize(imported.Body)
+		want := normalize(original.Body)
+		if got != want {
+			t.Fatalf("Exported document didn't import as the same HTML.\nWanted:\n%s\nGot:\n%s", want, got)
+		}
+		if imported.Summary != original.Summary || !imported.Created.Equal(original.Created) {
+			t.Fatalf("Front matter didn't import the same: %+v %+v", imported, original)
+		}
+	})
+}
@@ -0,0 +1,638 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"encoding/json"
+	"html/template"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html/atom"
+)
+
+/*
+	A site export renders the exported documents as a static web site that needs no server, and can be browsed
+	straight from the file system of a network with no access to Lex Library.  Every link in the site is relative:
+
+		index.html					the top of the library or collection
+		collections/<id>.html				each nested collection
+		documents/<id>/index.html			each document
+		documents/<id>/attachments/<id>/<name>		the files attached to each document
+		tags/index.html					every tag used by the exported documents
+		tags/<tag>.html					the documents with each tag
+		search.html, search.js				client side search of ...
+		search-index.js					... the text of every document
+		style.css
+
+	Documents keep the same relative paths to each other and to their attachments as they have in the library, so
+	their bodies need very little rewriting.  Links to documents that weren't exported are removed.
+*/
+
+// ExportSite writes the published documents the user can read, in the collection and the collections nested in
+// it, or in the whole library if collection is nil, to the target as a static web site.  It returns the number of
+// documents exported
+func ExportSite(who *User, collection *Collection, target ExportTarget) (int, error) {
+	l, err := newExportLibrary(who, collection)
+	if err != nil {
+		return 0, err
+	}
+	site, err := l.root.name(l)
+	if err != nil {
+		return 0, err
+	}
+	s := &siteExport{
+		library: l,
+		target:  target,
+		site:    site,
+		navs:    make(map[string]*siteNav),
+	}
+	s.tagSlugs()
+
+	err = s.write()
+	if err != nil {
+		return 0, err
+	}
+	return len(l.documents), nil
+}
+
+type siteExport struct {
+	library *exportLibrary
+	target  ExportTarget
+	site    string
+	tags    []string          // every tag on an exported document, by name
+	slugs   map[string]string // the file name of each tag's page, without the extension
+	tagged  map[string][]*exportDocument
+	navs    map[string]*siteNav // the navigation tree for each depth of page, by the path to the root
+}
+
+// sitePage is the data every page of the site is rendered with
+type sitePage struct {
+	Site        string
+	Title       string
+	Root        string // the relative path from the page to the root of the site
+	Nav         *siteNav
+	Breadcrumbs []siteLink
+	Content     interface{}
+}
+
+// siteNav is a collection in the navigation tree
+type siteNav struct {
+	Name      string
+	URL       string
+	Children  []*siteNav
+	Documents []siteLink
+}
+
+type siteLink struct {
+	Name    string
+	URL     string
+	Summary string
+}
+
+type siteCollection struct {
+	Collections []siteLink
+	Documents   []siteLink
+}
+
+type siteDocument struct {
+	Updated     string
+	Date        string
+	Tags        []siteLink
+	Body        template.HTML
+	Attachments []siteLink
+}
+
+type siteTag struct {
+	Name  string
+	URL   string
+	Count int
+}
+
+// siteSearchEntry is a document in the client side search index
+type siteSearchEntry struct {
+	URL     string   `json:"url"`
+	Title   string   `json:"title"`
+	Summary string   `json:"summary"`
+	Tags    []string `json:"tags"`
+	Text    string   `json:"text"`
+}
+
+func (s *siteExport) write() error {
+	err := s.collection(s.library.root)
+	if err != nil {
+		return err
+	}
+	for _, c := range s.library.collections {
+		err = s.collection(c)
+		if err != nil {
+			return err
+		}
+	}
+	for _, d := range s.library.documents {
+		err = s.document(d)
+		if err != nil {
+			return err
+		}
+	}
+	err = s.tagPages()
+	if err != nil {
+		return err
+	}
+	err = s.search()
+	if err != nil {
+		return err
+	}
+	return exportFile(s.target, "style.css", func(w io.Writer) error {
+		_, err := io.WriteString(w, siteStyle)
+		return err
+	})
+}
+
+// page renders a page of the site with the template
+func (s *siteExport) page(name string, tmpl *template.Template, title string, breadcrumbs []siteLink,
+	content interface{}) error {
+	root := siteRoot(name)
+	return exportFile(s.target, name, func(w io.Writer) error {
+		return tmpl.ExecuteTemplate(w, "page", sitePage{
+			Site:        s.site,
+			Title:       title,
+			Root:        root,
+			Nav:         s.nav(root),
+			Breadcrumbs: breadcrumbs,
+			Content:     content,
+		})
+	})
+}
+
+// nav returns the navigation tree of the whole site, linked relative to a page with the path to the root
+func (s *siteExport) nav(root string) *siteNav {
+	if nav, ok := s.navs[root]; ok {
+		return nav
+	}
+	var build func(c *exportCollection) *siteNav
+	build = func(c *exportCollection) *siteNav {
+		nav := &siteNav{URL: root + collectionPage(c)}
+		if c.collection != nil {
+			nav.Name = c.collection.Name
+		}
+		for _, child := range c.children {
+			nav.Children = append(nav.Children, build(child))
+		}
+		nav.Documents = s.documentLinks(root, c.documents)
+		return nav
+	}
+	nav := build(s.library.root)
+	s.navs[root] = nav
+	return nav
+}
+
+// siteRoot is the relative path from the page to the root of the site
+func siteRoot(page string) string {
+	return strings.Repeat("../", strings.Count(page, "/"))
+}
+
+// collectionPage is the path of a collection's page from the root of the site
+func collectionPage(c *exportCollection) string {
+	if c.parent == nil {
+		return "index.html"
+	}
+	return "collections/" + c.collection.ID + ".html"
+}
+
+// documentPage is the path of a document's page from the root of the site
+func documentPage(d *exportDocument) string {
+	return "documents/" + d.document.ID + "/index.html"
+}
+
+func (s *siteExport) documentLinks(root string, documents []*exportDocument) []siteLink {
+	var links []siteLink
+	for _, d := range documents {
+		links = append(links, siteLink{
+			Name:    d.revision.Title,
+			URL:     root + documentPage(d),
+			Summary: d.revision.Summary,
+		})
+	}
+	return links
+}
+
+// breadcrumbs returns the links to the collection and the collections it's nested in
+func (s *siteExport) breadcrumbs(root string, c *exportCollection) []siteLink {
+	links := []siteLink{{Name: s.site, URL: root + "index.html"}}
+	for _, p := range c.path() {
+		links = append(links, siteLink{Name: p.collection.Name, URL: root + collectionPage(p)})
+	}
+	return links
+}
+
+func (s *siteExport) collection(c *exportCollection) error {
+	name := collectionPage(c)
+	root := siteRoot(name)
+
+	content := siteCollection{Documents: s.documentLinks(root, c.documents)}
+	for _, child := range c.children {
+		content.Collections = append(content.Collections, siteLink{
+			Name: child.collection.Name,
+			URL:  root + collectionPage(child),
+		})
+	}
+
+	title := s.site
+	var breadcrumbs []siteLink
+	if c.parent != nil {
+		title = c.collection.Name
+		breadcrumbs = s.breadcrumbs(root, c.parent)
+	}
+	return s.page(name, siteCollectionTemplate, title, breadcrumbs, content)
+}
+
+func (s *siteExport) document(d *exportDocument) error {
+	name := documentPage(d)
+	root := siteRoot(name)
+
+	content := siteDocument{
+		Updated: d.revision.Created.UTC().Format("January 2, 2006"),
+		Date:    d.revision.Created.UTC().Format("2006-01-02"),
+		Body:    template.HTML(s.body(d)),
+	}
+	for _, tag := range d.tags {
+		content.Tags = append(content.Tags, siteLink{Name: tag, URL: root + "tags/" + s.slugs[tag] + ".html"})
+	}
+	for _, a := range d.attachments {
+		content.Attachments = append(content.Attachments, siteLink{Name: a.Name, URL: a.URL()})
+		err := exportAttachment(s.target, "documents/"+d.document.ID+"/attachments/"+a.ID+"/"+a.Name, a)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.page(name, siteDocumentTemplate, d.revision.Title, s.breadcrumbs(root, d.collection), content)
+}
+
+// body returns the document's body with its links to other documents pointed at their pages in the site
+func (s *siteExport) body(d *exportDocument) string {
+	return rewriteLinks(d.revision.Body, func(element atom.Atom, link string) (string, bool) {
+		u, err := url.Parse(link)
+		if err != nil || !reDocumentLink.MatchString(u.Path) {
+			return "", false
+		}
+		id := strings.Trim(u.Path, "./")
+		if _, ok := s.library.byID[id]; !ok {
+			return "", true
+		}
+		u.Path += "index.html"
+		return u.String(), true
+	})
+}
+
+// tagSlugs names the page of each tag used by the exported documents.  Tags that differ only in punctuation are
+// numbered in order, so they always get the same names
+func (s *siteExport) tagSlugs() {
+	s.tagged = make(map[string][]*exportDocument)
+	for _, d := range s.library.documents {
+		for _, tag := range d.tags {
+			if _, ok := s.tagged[tag]; !ok {
+				s.tags = append(s.tags, tag)
+			}
+			s.tagged[tag] = append(s.tagged[tag], d)
+		}
+	}
+	sort.Strings(s.tags)
+
+	s.slugs = make(map[string]string, len(s.tags))
+	used := make(map[string]bool, len(s.tags))
+	for _, tag := range s.tags {
+		base := tagSlug(tag)
+		slug := base
+		for n := 2; used[slug]; n++ {
+			slug = base + "-" + strconv.Itoa(n)
+		}
+		used[slug] = true
+		s.slugs[tag] = slug
+	}
+}
+
+// tagSlug returns the name of a tag's page, which can't be the name of the index of tags
+func tagSlug(tag string) string {
+	slug := exportSlug(tag, "tag")
+	if slug == "index" {
+		return "tag-index"
+	}
+	return slug
+}
+
+func (s *siteExport) tagPages() error {
+	var tags []siteTag
+	for _, tag := range s.tags {
+		tags = append(tags, siteTag{Name: tag, URL: s.slugs[tag] + ".html", Count: len(s.tagged[tag])})
+		err := s.page("tags/"+s.slugs[tag]+".html", siteTagTemplate, tag, nil,
+			s.documentLinks("../", s.tagged[tag]))
+		if err != nil {
+			return err
+		}
+	}
+	return s.page("tags/index.html", siteTagsTemplate, "Tags", nil, tags)
+}
+
+// search writes the search page, and the index of the documents it searches
+func (s *siteExport) search() error {
+	index := make([]siteSearchEntry, 0, len(s.library.documents))
+	for _, d := range s.library.documents {
+		tags := d.tags
+		if tags == nil {
+			tags = []string{}
+		}
+		index = append(index, siteSearchEntry{
+			URL:     documentPage(d),
+			Title:   d.revision.Title,
+			Summary: d.revision.Summary,
+			Tags:    tags,
+			Text:    strings.Join(strings.Fields(htmlToText(d.revision.Body)), " "),
+		})
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	err = exportFile(s.target, "search-index.js", func(w io.Writer) error {
+		_, err := io.WriteString(w, "var searchIndex = "+string(data)+";\n")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = exportFile(s.target, "search.js", func(w io.Writer) error {
+		_, err := io.WriteString(w, siteSearchScript)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return s.page("search.html", siteSearchTemplate, "Search", nil, nil)
+}
+
+var siteLayout = template.Must(template.New("layout").Parse(`{{define "page"}}<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{if ne .Title .Site}}{{.Title}} - {{end}}{{.Site}}</title>
+<link rel="stylesheet" href="{{.Root}}style.css">
+</head>
+<body>
+<header>
+<a class="site" href="{{.Root}}index.html">{{.Site}}</a>
+<form action="{{.Root}}search.html" method="get">
+<input type="search" name="q" placeholder="Search" aria-label="Search">
+</form>
+</header>
+<div class="layout">
+<nav>
+{{template "nav" .Nav}}<p><a href="{{.Root}}tags/index.html">Tags</a></p>
+</nav>
+<main>
+{{if .Breadcrumbs}}<p class="breadcrumbs">{{range $i, $link := .Breadcrumbs}}{{if $i}} / {{end}}` +
+	`<a href="{{$link.URL}}">{{$link.Name}}</a>{{end}}</p>
+{{end}}{{template "content" .}}</main>
+</div>
+{{template "scripts" .}}</body>
+</html>
+{{end}}
+{{define "nav"}}{{if or .Children .Documents}}<ul>
+{{range .Children}}<li><a href="{{.URL}}">{{.Name}}</a>{{template "nav" .}}</li>
+{{end}}{{range .Documents}}<li class="document"><a href="{{.URL}}">{{.Name}}</a></li>
+{{end}}</ul>
+{{end}}{{end}}
+{{define "documents"}}<ul class="documents">
+{{range .}}<li><a href="{{.URL}}">{{.Name}}</a>{{if .Summary}}<p>{{.Summary}}</p>{{end}}</li>
+{{end}}</ul>
+{{end}}
+{{define "scripts"}}{{end}}`))
+
+// sitePageTemplate returns a template for a kind of page, with the content template defined
+func sitePageTemplate(content string) *template.Template {
+	return template.Must(template.Must(siteLayout.Clone()).Parse(content))
+}
+
+var (
+	siteCollectionTemplate = sitePageTemplate(`{{define "content"}}<h1>{{.Title}}</h1>
+{{with .Content}}{{if .Collections}}<h2>Collections</h2>
+<ul class="collections">
+{{range .Collections}}<li><a href="{{.URL}}">{{.Name}}</a></li>
+{{end}}</ul>
+{{end}}{{if .Documents}}<h2>Documents</h2>
+{{template "documents" .Documents}}{{end}}{{end}}{{end}}`)
+
+	siteDocumentTemplate = sitePageTemplate(`{{define "content"}}<article>
+<h1>{{.Title}}</h1>
+{{with .Content}}<p class="meta">Updated <time datetime="{{.Date}}">{{.Updated}}</time>` +
+		`{{range .Tags}} <a class="tag" href="{{.URL}}">{{.Name}}</a>{{end}}</p>
+{{.Body}}
+</article>
+{{if .Attachments}}<h2>Attachments</h2>
+<ul class="attachments">
+{{range .Attachments}}<li><a href="{{.URL}}">{{.Name}}</a></li>
+{{end}}</ul>
+{{end}}{{end}}{{end}}`)
+
+	siteTagsTemplate = sitePageTemplate(`{{define "content"}}<h1>Tags</h1>
+<ul class="tags">
+{{range .Content}}<li><a class="tag" href="{{.URL}}">{{.Name}}</a> ({{.Count}})</li>
+{{end}}</ul>
+{{end}}`)
+
+	siteTagTemplate = sitePageTemplate(`{{define "content"}}<h1>Tagged <span class="tag">{{.Title}}</span></h1>
+{{template "documents" .Content}}{{end}}`)
+
+	siteSearchTemplate = sitePageTemplate(`{{define "content"}}<h1>Search</h1>
+<p id="search-status"><noscript>Searching needs JavaScript to be enabled</noscript></p>
+<ul id="search-results" class="documents"></ul>
+{{end}}
+{{define "scripts"}}<script src="search-index.js"></script>
+<script src="search.js"></script>
+{{end}}`)
+)
+
+// siteSearchScript searches the index for the documents that contain every word of the query, best matches
+// first
+const siteSearchScript = `(function() {
+	"use strict";
+
+	function param(name) {
+		var pairs = window.location.search.substring(1).split("&");
+		for (var i = 0; i < pairs.length; i++) {
+			var pair = pairs[i].split("=");
+			if (decodeURIComponent(pair[0]) === name) {
+				return decodeURIComponent((pair[1] || "").replace(/\+/g, " "));
+			}
+		}
+		return "";
+	}
+
+	function count(text, term) {
+		var n = 0;
+		for (var i = text.indexOf(term); i !== -1; i = text.indexOf(term, i + term.length)) {
+			n++;
+		}
+		return n;
+	}
+
+	function score(doc, terms) {
+		var title = doc.title.toLowerCase();
+		var tags = doc.tags.join(" ").toLowerCase();
+		var text = (doc.summary + " " + doc.text).toLowerCase();
+		var total = 0;
+		for (var i = 0; i < terms.length; i++) {
+			var s = count(text, terms[i]);
+			if (title.indexOf(terms[i]) !== -1) {
+				s += 10;
+			}
+			if (tags.indexOf(terms[i]) !== -1) {
+				s += 5;
+			}
+			if (s === 0) {
+				return 0;
+			}
+			total += s;
+		}
+		return total;
+	}
+
+	var query = param("q");
+	var input = document.querySelector("input[name=q]");
+	input.value = query;
+	var terms = query.toLowerCase().split(/\s+/).filter(function(term) {
+		return term !== "";
+	});
+	var status = document.getElementById("search-status");
+	if (terms.length === 0) {
+		status.textContent = "Enter words to search for";
+		return;
+	}
+
+	var results = [];
+	for (var i = 0; i < searchIndex.length; i++) {
+		var s = score(searchIndex[i], terms);
+		if (s > 0) {
+			results.push({doc: searchIndex[i], score: s, order: i});
+		}
+	}
+	results.sort(function(a, b) {
+		return b.score - a.score || a.order - b.order;
+	});
+
+	status.textContent = results.length === 1 ? "1 document found" : results.length + " documents found";
+	var list = document.getElementById("search-results");
+	for (var r = 0; r < results.length; r++) {
+		var item = document.createElement("li");
+		var link = document.createElement("a");
+		link.href = results[r].doc.url;
+		link.textContent = results[r].doc.title;
+		item.appendChild(link);
+		if (results[r].doc.summary) {
+			var summary = document.createElement("p");
+			summary.textContent = results[r].doc.summary;
+			item.appendChild(summary);
+		}
+		list.appendChild(item);
+	}
+})();
+`
+
+const siteStyle = `body {
+	margin: 0;
+	font-family: -apple-system, "Segoe UI", Roboto, Helvetica, Arial, sans-serif;
+	line-height: 1.5;
+	color: #222;
+}
+
+header {
+	display: flex;
+	align-items: center;
+	justify-content: space-between;
+	padding: 0.5rem 1rem;
+	background: #2c3e50;
+}
+
+header a.site {
+	color: #fff;
+	font-size: 1.25rem;
+	text-decoration: none;
+}
+
+.layout {
+	display: flex;
+	align-items: flex-start;
+}
+
+nav {
+	flex: 0 0 16rem;
+	padding: 1rem;
+	font-size: 0.9rem;
+}
+
+nav ul {
+	margin: 0;
+	padding-left: 1rem;
+	list-style: none;
+}
+
+main {
+	flex: 1;
+	min-width: 0;
+	max-width: 50rem;
+	padding: 1rem 2rem;
+}
+
+main img {
+	max-width: 100%;
+}
+
+pre {
+	overflow-x: auto;
+	padding: 0.5rem;
+	background: #f5f5f5;
+}
+
+table {
+	border-collapse: collapse;
+}
+
+th, td {
+	padding: 0.25rem 0.5rem;
+	border: 1px solid #ddd;
+}
+
+.breadcrumbs, .meta {
+	color: #666;
+	font-size: 0.9rem;
+}
+
+.tag {
+	padding: 0 0.4rem;
+	border-radius: 0.25rem;
+	background: #e8eef4;
+	text-decoration: none;
+}
+
+ul.documents {
+	padding: 0;
+	list-style: none;
+}
+
+ul.documents p {
+	margin: 0 0 0.75rem;
+	color: #555;
+}
+
+@media (max-width: 40rem) {
+	.layout {
+		display: block;
+	}
+}
+`
@@ -0,0 +1,209 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lexLibrary/lexLibrary/app"
+)
+
+func TestExportSite(t *testing.T) {
+	resetDocuments(t)
+
+	tenant, err := app.TenantNew(installAdmin(t), "Export Tenant", "", "")
+	if err != nil {
+		t.Fatalf("Error creating tenant: %s", err)
+	}
+	author := testUser(t, tenant, "author")
+	reader := testUser(t, tenant, "reader")
+
+	guides, err := app.CollectionNew(author, "Guides")
+	if err != nil {
+		t.Fatalf("Error creating collection: %s", err)
+	}
+	setup, err := guides.NewChild("Setup")
+	if err != nil {
+		t.Fatalf("Error creating collection: %s", err)
+	}
+
+	document := func(collection *app.Collection, title, body string, publish bool) *app.Document {
+		doc, err := app.DocumentNew(author, collection, title, body)
+		if err != nil {
+			t.Fatalf("Error creating document: %s", err)
+		}
+		if publish {
+			err = doc.Publish(0)
+			if err != nil {
+				t.Fatalf("Error publishing document: %s", err)
+			}
+		}
+		return doc
+	}
+
+	private := document(nil, "Private Notes", "<p>Only the author can read these.</p>", true)
+	install := document(setup, "Installing", `<p>Install the server, then read the <a href="`+
+		"../"+private.ID+"/"+`">notes</a>.</p>`, true)
+	intro := document(guides, "Introduction", `<p>Start with <a href="../`+install.ID+`/#steps">installing</a>.</p>`,
+		true)
+	document(guides, "Unfinished", "<p>Not ready yet.</p>", false)
+
+	logo, err := intro.AddAttachment("logo.png", strings.NewReader("not really a png"))
+	if err != nil {
+		t.Fatalf("Error adding attachment: %s", err)
+	}
+	err = intro.AddTag("Getting Started")
+	if err != nil {
+		t.Fatalf("Error tagging document: %s", err)
+	}
+	err = install.AddTag("getting started")
+	if err != nil {
+		t.Fatalf("Error tagging document: %s", err)
+	}
+	for _, resource := range []app.Resource{guides, setup} {
+		err = app.Grant(author, resource, reader, app.PermissionRead)
+		if err != nil {
+			t.Fatalf("Error granting permission: %s", err)
+		}
+	}
+
+	exportDir := func(who *app.User, collection *app.Collection, expected int) string {
+		dir, err := ioutil.TempDir("", "lexExport")
+		if err != nil {
+			t.Fatalf("Error creating directory: %s", err)
+		}
+		count, err := app.ExportSite(who, collection, app.ExportDir(dir))
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatalf("Error exporting site: %s", err)
+		}
+		if count != expected {
+			os.RemoveAll(dir)
+			t.Fatalf("Invalid number of documents exported. Wanted %d got %d", expected, count)
+		}
+		return dir
+	}
+
+	read := func(dir, name string) string {
+		data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatalf("Error reading exported file %s: %s", name, err)
+		}
+		return string(data)
+	}
+
+	exists := func(dir, name string) bool {
+		_, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+		return err == nil
+	}
+
+	t.Run("Library", func(t *testing.T) {
+		dir := exportDir(author, nil, 3)
+		defer os.RemoveAll(dir)
+
+		for _, name := range []string{"index.html", "collections/" + guides.ID + ".html",
+			"collections/" + setup.ID + ".html", "documents/" + private.ID + "/index.html", "tags/index.html",
+			"tags/getting-started.html", "search.html", "search.js", "search-index.js", "style.css"} {
+			if !exists(dir, name) {
+				t.Fatalf("Exported file %s is missing", name)
+			}
+		}
+
+		index := read(dir, "index.html")
+		if !strings.Contains(index, `<a href="collections/`+guides.ID+`.html">Guides</a>`) {
+			t.Fatalf("Index doesn't link to the collection: %s", index)
+		}
+		if strings.Contains(index, "Unfinished") {
+			t.Fatalf("Unpublished document was exported: %s", index)
+		}
+
+		page := read(dir, "documents/"+intro.ID+"/index.html")
+		if !strings.Contains(page, `href="../../style.css"`) {
+			t.Fatalf("Document page doesn't link to the style sheet relatively: %s", page)
+		}
+		if !strings.Contains(page, `<a href="../`+install.ID+`/index.html#steps">installing</a>`) {
+			t.Fatalf("Link to the exported document wasn't rewritten: %s", page)
+		}
+		if !strings.Contains(page, `<a href="../../collections/`+guides.ID+`.html">Guides</a>`) {
+			t.Fatalf("Document page is missing its breadcrumbs: %s", page)
+		}
+		if !strings.Contains(page, `<a class="tag" href="../../tags/getting-started.html">getting started</a>`) {
+			t.Fatalf("Document page doesn't link to its tags: %s", page)
+		}
+		if !strings.Contains(page, `<a href="`+logo.URL()+`">logo.png</a>`) {
+			t.Fatalf("Document page doesn't link to its attachment: %s", page)
+		}
+		if read(dir, "documents/"+intro.ID+"/"+logo.URL()) != "not really a png" {
+			t.Fatalf("Attachment wasn't copied")
+		}
+
+		tag := read(dir, "tags/getting-started.html")
+		if !strings.Contains(tag, "Installing") || !strings.Contains(tag, "Introduction") {
+			t.Fatalf("Tag page is missing tagged documents: %s", tag)
+		}
+
+		search := read(dir, "search-index.js")
+		if !strings.HasPrefix(search, "var searchIndex = [") ||
+			!strings.Contains(search, `"url":"documents/`+install.ID+`/index.html"`) ||
+			!strings.Contains(search, "Install the server, then read the notes.") {
+			t.Fatalf("Invalid search index: %s", search)
+		}
+	})
+
+	t.Run("Permissions", func(t *testing.T) {
+		dir := exportDir(reader, nil, 2)
+		defer os.RemoveAll(dir)
+
+		if exists(dir, "documents/"+private.ID+"/index.html") {
+			t.Fatalf("Document the user can't read was exported")
+		}
+		page := read(dir, "documents/"+install.ID+"/index.html")
+		if strings.Contains(page, private.ID) || !strings.Contains(page, "<a>notes</a>") {
+			t.Fatalf("Link to a document that wasn't exported wasn't removed: %s", page)
+		}
+	})
+
+	t.Run("Collection", func(t *testing.T) {
+		dir := exportDir(author, setup, 1)
+		defer os.RemoveAll(dir)
+
+		index := read(dir, "index.html")
+		if !strings.Contains(index, "<h1>Setup</h1>") || !strings.Contains(index, "Installing") {
+			t.Fatalf("Invalid collection index: %s", index)
+		}
+		if exists(dir, "documents/"+intro.ID+"/index.html") {
+			t.Fatalf("Document outside of the collection was exported")
+		}
+
+		_, err := app.ExportSite(nil, setup, app.ExportDir(dir))
+		if !app.IsFailType(err, app.FailUnauthorized) {
+			t.Fatalf("Exporting without a user didn't fail: %v", err)
+		}
+	})
+
+	t.Run("Deterministic", func(t *testing.T) {
+		export := func() []byte {
+			buf := &bytes.Buffer{}
+			z := app.NewExportZip(buf)
+			_, err := app.ExportSite(author, nil, z)
+			if err != nil {
+				t.Fatalf("Error exporting site: %s", err)
+			}
+			err = z.Close()
+			if err != nil {
+				t.Fatalf("Error closing zip: %s", err)
+			}
+			return buf.Bytes()
+		}
+
+		first := export()
+		if !bytes.Equal(first, export()) {
+			t.Fatalf("Exporting the same documents twice didn't produce the same archive")
+		}
+	})
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+// FailType is the kind of failure that occurred
+type FailType int
+
+// Failure types
+const (
+	FailInvalid      FailType = iota // the request or input is invalid
+	FailNotFound                     // the requested item doesn't exist
+	FailUnauthorized                 // the user needs to log in
+	FailForbidden                    // the user doesn't have permission
+	FailConflict                     // the item was changed or already exists
+)
+
+// Fail is an error caused by the user's request or input rather than by a problem in Lex Library.
+// Failures aren't logged, and their messages are safe to show to the user
+type Fail struct {
+	Message string
+	Type    FailType
+}
+
+func (f *Fail) Error() string {
+	return f.Message
+}
+
+// NewFailure returns a new failure caused by invalid input
+func NewFailure(message string) error {
+	return &Fail{Message: message, Type: FailInvalid}
+}
+
+// NotFound returns a new failure for an item that doesn't exist
+func NotFound(message string) error {
+	return &Fail{Message: message, Type: FailNotFound}
+}
+
+// Unauthorized returns a new failure for a request that requires a logged in user
+func Unauthorized(message string) error {
+	return &Fail{Message: message, Type: FailUnauthorized}
+}
+
+// Forbidden returns a new failure for a request the user doesn't have permission for
+func Forbidden(message string) error {
+	return &Fail{Message: message, Type: FailForbidden}
+}
+
+// Conflict returns a new failure for a request that conflicts with the current state of an item
+func Conflict(message string) error {
+	return &Fail{Message: message, Type: FailConflict}
+}
+
+// IsFail returns whether or not the error is a failure
+func IsFail(err error) bool {
+	_, ok := err.(*Fail)
+	return ok
+}
+
+// IsFailType returns whether or not the error is a failure of the passed in type
+func IsFailType(err error, failType FailType) bool {
+	f, ok := err.(*Fail)
+	return ok && f.Type == failType
+}
@@ -0,0 +1,275 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/lexLibrary/lexLibrary/data"
+)
+
+const maxGroupNameLength = 255
+
+// Group is a named set of users that permissions can be granted to.  Groups are managed by tenant administrators
+type Group struct {
+	ID       string
+	TenantID string
+	Name     string
+	Created  time.Time
+	Updated  time.Time
+
+	who *User
+}
+
+var (
+	sqlGroupInsert = data.NewQuery(`
+		insert into user_groups (tenant_id, id, name, created, updated)
+		values ({{tenant}}, {{arg "id"}}, {{arg "name"}}, {{arg "created"}}, {{arg "updated"}})
+	`)
+	sqlGroupGet = data.NewQuery(`
+		select id, tenant_id, name, created, updated from user_groups where tenant_id = {{tenant}} and id = {{arg "id"}}
+	`)
+	sqlGroupList = data.NewQuery(`
+		select id, tenant_id, name, created, updated from user_groups where tenant_id = {{tenant}} order by name
+	`)
+	sqlGroupUpdate = data.NewQuery(`
+		update user_groups set name = {{arg "name"}}, updated = {{arg "updated"}}
+		where tenant_id = {{tenant}} and id = {{arg "id"}}
+	`)
+	sqlGroupDelete = data.NewQuery(`
+		delete from user_groups where tenant_id = {{tenant}} and id = {{arg "id"}}
+	`)
+	sqlGroupMemberInsert = data.NewQuery(`
+		insert into group_members (tenant_id, group_id, user_id)
+		values ({{tenant}}, {{arg "group_id"}}, {{arg "user_id"}})
+	`)
+	sqlGroupMemberGet = data.NewQuery(`
+		select count(*) from group_members
+		where tenant_id = {{tenant}} and group_id = {{arg "group_id"}} and user_id = {{arg "user_id"}}
+	`)
+	sqlGroupMemberDelete = data.NewQuery(`
+		delete from group_members
+		where tenant_id = {{tenant}} and group_id = {{arg "group_id"}} and user_id = {{arg "user_id"}}
+	`)
+	sqlGroupMemberDeleteAll = data.NewQuery(`
+		delete from group_members where tenant_id = {{tenant}} and group_id = {{arg "group_id"}}
+	`)
+	sqlGroupMembers = data.NewQuery(`
+		select ` + sqlUserColumns + ` from users
+		where tenant_id = {{tenant}} and id in (
+			select user_id from group_members where tenant_id = {{tenant}} and group_id = {{arg "group_id"}}
+		)
+		order by username_key
+	`)
+)
+
+// GroupNew creates a new group
+func GroupNew(who *User, name string) (*Group, error) {
+	err := canAdminTenant(who)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &Group{
+		ID:       newID(),
+		TenantID: who.TenantID,
+		Name:     strings.TrimSpace(name),
+		Created:  time.Now(),
+		who:      who,
+	}
+	g.Updated = g.Created
+
+	err = g.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = sqlGroupInsert.Tenant(g.TenantID).Exec(
+		sql.Named("id", g.ID),
+		sql.Named("name", g.Name),
+		sql.Named("created", g.Created),
+		sql.Named("updated", g.Updated),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// GroupGet retrieves a group
+func GroupGet(who *User, id string) (*Group, error) {
+	if who == nil {
+		return nil, Unauthorized("You must log in")
+	}
+	g, err := scanGroup(sqlGroupGet.Tenant(who.TenantID).QueryRow(sql.Named("id", id)))
+	if err != nil {
+		return nil, err
+	}
+	g.who = who
+	return g, nil
+}
+
+// GroupList returns all of the groups in the user's tenant
+func GroupList(who *User) ([]*Group, error) {
+	if who == nil {
+		return nil, Unauthorized("You must log in")
+	}
+	rows, err := sqlGroupList.Tenant(who.TenantID).Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []*Group
+	for rows.Next() {
+		g, err := scanGroup(rows)
+		if err != nil {
+			return nil, err
+		}
+		g.who = who
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
+
+func scanGroup(row scanner) (*Group, error) {
+	g := &Group{}
+	err := row.Scan(&g.ID, &g.TenantID, &g.Name, &g.Created, &g.Updated)
+	if err == sql.ErrNoRows {
+		return nil, NotFound("Group not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *Group) validate() error {
+	if g.Name == "" {
+		return NewFailure("A group name is required")
+	}
+	if len(g.Name) > maxGroupNameLength {
+		return NewFailure("A group name can't be longer than 255 characters")
+	}
+	return nil
+}
+
+// SetName changes the group's name
+func (g *Group) SetName(name string) error {
+	err := canAdminTenant(g.who)
+	if err != nil {
+		return err
+	}
+
+	changed := *g
+	changed.Name = strings.TrimSpace(name)
+	changed.Updated = time.Now()
+	err = changed.validate()
+	if err != nil {
+		return err
+	}
+
+	_, err = sqlGroupUpdate.Tenant(g.TenantID).Exec(
+		sql.Named("id", changed.ID),
+		sql.Named("name", changed.Name),
+		sql.Named("updated", changed.Updated),
+	)
+	if err != nil {
+		return err
+	}
+	*g = changed
+	return nil
+}
+
+// AddMember adds the user to the group
+func (g *Group) AddMember(user *User) error {
+	err := canAdminTenant(g.who)
+	if err != nil {
+		return err
+	}
+	if user.TenantID != g.TenantID {
+		return NotFound("User not found")
+	}
+
+	return data.BeginTx(func(tx *sql.Tx) error {
+		count := 0
+		err := sqlGroupMemberGet.Tx(tx).Tenant(g.TenantID).QueryRow(
+			sql.Named("group_id", g.ID),
+			sql.Named("user_id", user.ID),
+		).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return nil
+		}
+
+		_, err = sqlGroupMemberInsert.Tx(tx).Tenant(g.TenantID).Exec(
+			sql.Named("group_id", g.ID),
+			sql.Named("user_id", user.ID),
+		)
+		return err
+	})
+}
+
+// RemoveMember removes the user from the group
+func (g *Group) RemoveMember(user *User) error {
+	err := canAdminTenant(g.who)
+	if err != nil {
+		return err
+	}
+	_, err = sqlGroupMemberDelete.Tenant(g.TenantID).Exec(
+		sql.Named("group_id", g.ID),
+		sql.Named("user_id", user.ID),
+	)
+	return err
+}
+
+// Members returns the users in the group
+func (g *Group) Members() ([]*User, error) {
+	rows, err := sqlGroupMembers.Tenant(g.TenantID).Query(sql.Named("group_id", g.ID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*User
+	for rows.Next() {
+		u, _, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// Delete removes the group, its members, and any permissions granted to it
+func (g *Group) Delete() error {
+	err := canAdminTenant(g.who)
+	if err != nil {
+		return err
+	}
+
+	return data.BeginTx(func(tx *sql.Tx) error {
+		_, err := sqlACLDeletePrincipal.Tx(tx).Tenant(g.TenantID).Exec(
+			sql.Named("principal_type", principalGroup),
+			sql.Named("principal_id", g.ID),
+		)
+		if err != nil {
+			return err
+		}
+		_, err = sqlGroupMemberDeleteAll.Tx(tx).Tenant(g.TenantID).Exec(sql.Named("group_id", g.ID))
+		if err != nil {
+			return err
+		}
+		_, err = sqlGroupDelete.Tx(tx).Tenant(g.TenantID).Exec(sql.Named("id", g.ID))
+		return err
+	})
+}
+
+func (g *Group) principalType() string   { return principalGroup }
+func (g *Group) principalID() string     { return g.ID }
+func (g *Group) principalTenant() string { return g.TenantID }
@@ -0,0 +1,558 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+/*
+	Documents are exported to Markdown by converting their HTML back into CommonMark, with the GitHub Flavored
+	Markdown tables, task lists and strikethrough the importer reads (see markdown.go), so exported Markdown imports
+	as the same HTML.  Anything Markdown has no syntax for, like tables with merged cells, definition lists or
+	images with a size, is written as raw HTML, which Markdown passes through as is.
+*/
+
+// markdownBlockElements are the elements converted to Markdown blocks.  Everything else is converted to inlines
+var markdownBlockElements = map[atom.Atom]bool{
+	atom.P:          true,
+	atom.H1:         true,
+	atom.H2:         true,
+	atom.H3:         true,
+	atom.H4:         true,
+	atom.H5:         true,
+	atom.H6:         true,
+	atom.Pre:        true,
+	atom.Blockquote: true,
+	atom.Ul:         true,
+	atom.Ol:         true,
+	atom.Hr:         true,
+	atom.Table:      true,
+	atom.Div:        true,
+	atom.Section:    true,
+	atom.Article:    true,
+	atom.Figure:     true,
+	atom.Details:    true,
+	atom.Dl:         true,
+}
+
+// markdownRawInlines are the inline elements with no Markdown syntax that are kept as raw HTML.  The formatting of any
+// other inline element without Markdown syntax is dropped, and only its content is kept
+var markdownRawInlines = map[atom.Atom]bool{
+	atom.Abbr:  true,
+	atom.Audio: true,
+	atom.Ins:   true,
+	atom.Kbd:   true,
+	atom.Mark:  true,
+	atom.Q:     true,
+	atom.Samp:  true,
+	atom.Small: true,
+	atom.Sub:   true,
+	atom.Sup:   true,
+	atom.U:     true,
+	atom.Var:   true,
+	atom.Video: true,
+}
+
+// markdownBreak marks a hard line break in converted inlines, until the spaces around it are trimmed
+const markdownBreak = "\x00"
+
+var (
+	reMarkdownSpace     = regexp.MustCompile(`[ \t\n\r\f]+`)
+	reMarkdownBreak     = regexp.MustCompile(` *` + markdownBreak + ` *`)
+	reMarkdownLineStart = regexp.MustCompile(`(?m)^(?:[#>+=-]|\d+[.)])`)
+	reMarkdownEntity    = regexp.MustCompile(`^&(?:#[0-9]+|#[xX][0-9a-fA-F]+|[A-Za-z][A-Za-z0-9]*);`)
+	reMarkdownBlankLine = regexp.MustCompile(`\n[ \t]*\n`)
+)
+
+// htmlToMarkdown converts a document's HTML body to Markdown
+func htmlToMarkdown(body string) string {
+	nodes, err := html.ParseFragment(strings.NewReader(body), &html.Node{
+		Type:     html.ElementNode,
+		Data:     "body",
+		DataAtom: atom.Body,
+	})
+	if err != nil {
+		// the parser only fails if reading fails, which it can't from a string
+		return markdownEscape(body) + "\n"
+	}
+	root := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	for _, n := range nodes {
+		root.AppendChild(n)
+	}
+
+	blocks := markdownBlocks(root.FirstChild)
+	if len(blocks) == 0 {
+		return ""
+	}
+	return strings.Join(blocks, "\n\n") + "\n"
+}
+
+// markdownBlocks converts the node and its following siblings to Markdown blocks.  Runs of inline nodes between block
+// elements become paragraphs
+func markdownBlocks(first *html.Node) []string {
+	var blocks []string
+	var inlines []*html.Node
+	var lastList *html.Node
+
+	flush := func() {
+		if text := markdownParagraph(inlines); text != "" {
+			blocks = append(blocks, text)
+			lastList = nil
+		}
+		inlines = nil
+	}
+
+	for n := first; n != nil; n = n.NextSibling {
+		if n.Type != html.ElementNode || !markdownBlockElements[n.DataAtom] {
+			inlines = append(inlines, n)
+			continue
+		}
+		flush()
+		block := markdownBlock(n)
+		if block == "" {
+			continue
+		}
+		if lastList != nil && lastList.DataAtom == n.DataAtom {
+			// two lists of the same type in a row would be read back as one list
+			blocks = append(blocks, "<!-- -->")
+		}
+		blocks = append(blocks, block)
+		lastList = nil
+		if n.DataAtom == atom.Ul || n.DataAtom == atom.Ol {
+			lastList = n
+		}
+	}
+	flush()
+	return blocks
+}
+
+func markdownBlock(n *html.Node) string {
+	switch n.DataAtom {
+	case atom.P:
+		return markdownParagraph(markdownChildren(n))
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		text := strings.Replace(markdownInlineText(markdownChildren(n)), "\\\n", " ", -1)
+		if strings.HasSuffix(text, "#") {
+			// a trailing # would be read as the end of the heading
+			text = text[:len(text)-1] + "\\#"
+		}
+		return strings.TrimSpace(strings.Repeat("#", int(n.Data[1]-'0')) + " " + text)
+	case atom.Pre:
+		return markdownCodeBlock(n)
+	case atom.Blockquote:
+		return markdownIndent(strings.Join(markdownBlocks(n.FirstChild), "\n\n"), "> ", ">")
+	case atom.Ul, atom.Ol:
+		return markdownList(n)
+	case atom.Hr:
+		return "---"
+	case atom.Table:
+		return markdownTable(n)
+	case atom.Div, atom.Section, atom.Article:
+		return strings.Join(markdownBlocks(n.FirstChild), "\n\n")
+	}
+	return markdownRawBlock(n)
+}
+
+// markdownParagraph converts the inline nodes to the text of a paragraph, with anything at the start of a line that
+// would be read as the start of a block escaped
+func markdownParagraph(nodes []*html.Node) string {
+	text := markdownInlineText(nodes)
+	return reMarkdownLineStart.ReplaceAllStringFunc(text, func(start string) string {
+		last := len(start) - 1
+		return start[:last] + "\\" + start[last:]
+	})
+}
+
+// markdownInlineText converts the inline nodes to Markdown, with the whitespace at the start and end trimmed
+func markdownInlineText(nodes []*html.Node) string {
+	buf := &bytes.Buffer{}
+	for _, n := range nodes {
+		markdownInline(buf, n)
+	}
+	text := strings.Trim(buf.String(), " "+markdownBreak)
+	return reMarkdownBreak.ReplaceAllString(text, "\\\n")
+}
+
+func markdownChildren(n *html.Node) []*html.Node {
+	var children []*html.Node
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		children = append(children, c)
+	}
+	return children
+}
+
+func markdownInline(buf *bytes.Buffer, n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		buf.WriteString(markdownEscape(reMarkdownSpace.ReplaceAllString(n.Data, " ")))
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Br:
+		buf.WriteString(markdownBreak)
+	case atom.Strong, atom.B:
+		markdownEmphasis(buf, "**", n)
+	case atom.Em, atom.I:
+		markdownEmphasis(buf, "*", n)
+	case atom.Del, atom.S:
+		markdownEmphasis(buf, "~~", n)
+	case atom.Code:
+		buf.WriteString(markdownCodeSpan(reMarkdownSpace.ReplaceAllString(markdownText(n), " ")))
+	case atom.A:
+		href := attrValue(n, "href")
+		if href == "" {
+			markdownInlineChildren(buf, n)
+			return
+		}
+		buf.WriteString("[")
+		markdownInlineChildren(buf, n)
+		buf.WriteString("](" + markdownDestination(href) + markdownTitle(attrValue(n, "title")) + ")")
+	case atom.Img:
+		if hasAttr(n, "width") || hasAttr(n, "height") {
+			buf.WriteString(markdownRawTag(n))
+			return
+		}
+		buf.WriteString("![" + markdownEscape(attrValue(n, "alt")) + "](" + markdownDestination(attrValue(n, "src")) +
+			markdownTitle(attrValue(n, "title")) + ")")
+	case atom.Input:
+		// task list checkboxes are converted with their list item, see markdownList
+	default:
+		if !markdownRawInlines[n.DataAtom] {
+			markdownInlineChildren(buf, n)
+			return
+		}
+		buf.WriteString(markdownRawTag(n))
+		if voidElements[n.DataAtom] {
+			return
+		}
+		markdownInlineChildren(buf, n)
+		buf.WriteString("</" + n.Data + ">")
+	}
+}
+
+func markdownInlineChildren(buf *bytes.Buffer, n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		markdownInline(buf, c)
+	}
+}
+
+// markdownEmphasis wraps the content of the node in the markers.  Whitespace has to be outside of the markers, or they
+// won't be read as emphasis
+func markdownEmphasis(buf *bytes.Buffer, marker string, n *html.Node) {
+	inner := &bytes.Buffer{}
+	markdownInlineChildren(inner, n)
+	text := inner.String()
+	trimmed := strings.Trim(text, " "+markdownBreak)
+	if trimmed == "" {
+		buf.WriteString(text)
+		return
+	}
+	start := strings.Index(text, trimmed)
+	buf.WriteString(text[:start] + marker + trimmed + marker + text[start+len(trimmed):])
+}
+
+// markdownEscape escapes the characters in text that would otherwise be read as Markdown
+func markdownEscape(text string) string {
+	buf := &bytes.Buffer{}
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch c {
+		case '\\', '`', '*', '[', ']', '<', '~':
+			buf.WriteByte('\\')
+		case '_':
+			// underscores inside words are never emphasis
+			if i == 0 || i == len(text)-1 || !markdownWordByte(text[i-1]) || !markdownWordByte(text[i+1]) {
+				buf.WriteByte('\\')
+			}
+		case '&':
+			if reMarkdownEntity.MatchString(text[i:]) {
+				buf.WriteString("&amp;")
+				continue
+			}
+		}
+		buf.WriteByte(c)
+	}
+	return buf.String()
+}
+
+func markdownWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
+
+// markdownCodeSpan wraps the code in enough backticks that none in the code end the span
+func markdownCodeSpan(code string) string {
+	fence := strings.Repeat("`", markdownLongestRun(code, '`')+1)
+	if strings.HasPrefix(code, "`") || strings.HasSuffix(code, "`") ||
+		(strings.HasPrefix(code, " ") && strings.HasSuffix(code, " ") && strings.TrimSpace(code) != "") {
+		code = " " + code + " "
+	}
+	return fence + code + fence
+}
+
+// markdownLongestRun returns the length of the longest run of the character in the text
+func markdownLongestRun(text string, c byte) int {
+	longest, run := 0, 0
+	for i := 0; i < len(text); i++ {
+		if text[i] != c {
+			run = 0
+			continue
+		}
+		run++
+		if run > longest {
+			longest = run
+		}
+	}
+	return longest
+}
+
+// markdownDestination returns the destination of a link or image.  Destinations with spaces or parentheses are wrapped
+// in angle brackets
+func markdownDestination(link string) string {
+	if !strings.ContainsAny(link, " ()<>") {
+		return link
+	}
+	return "<" + strings.NewReplacer("<", "\\<", ">", "\\>").Replace(link) + ">"
+}
+
+func markdownTitle(title string) string {
+	if title == "" {
+		return ""
+	}
+	return ` "` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(title) + `"`
+}
+
+// markdownText returns the text in the node as is
+func markdownText(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	buf := &bytes.Buffer{}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		buf.WriteString(markdownText(c))
+	}
+	return buf.String()
+}
+
+// markdownRawTag returns the start tag of the element as HTML
+func markdownRawTag(n *html.Node) string {
+	t := html.Token{Type: html.StartTagToken, Data: n.Data, Attr: n.Attr}
+	if voidElements[n.DataAtom] {
+		t.Type = html.SelfClosingTagToken
+	}
+	return t.String()
+}
+
+// markdownRawBlock returns the element as HTML.  Blank lines would end an HTML block, so they are removed
+func markdownRawBlock(n *html.Node) string {
+	buf := &bytes.Buffer{}
+	err := html.Render(buf, n)
+	if err != nil {
+		return ""
+	}
+	return reMarkdownBlankLine.ReplaceAllString(strings.TrimSpace(buf.String()), "\n")
+}
+
+// markdownCodeBlock converts a preformatted block to a fenced code block
+func markdownCodeBlock(n *html.Node) string {
+	code := markdownText(n)
+	language := markdownCodeLanguage(n)
+	if c := n.FirstChild; c != nil && c.NextSibling == nil && c.DataAtom == atom.Code {
+		if l := markdownCodeLanguage(c); l != "" {
+			language = l
+		}
+	}
+	code = strings.TrimSuffix(code, "\n")
+
+	fence := "```"
+	if run := markdownLongestRun(code, '`'); run >= len(fence) {
+		fence = strings.Repeat("`", run+1)
+	}
+	if code == "" {
+		return fence + language + "\n" + fence
+	}
+	return fence + language + "\n" + code + "\n" + fence
+}
+
+func markdownCodeLanguage(n *html.Node) string {
+	for _, class := range strings.Fields(attrValue(n, "class")) {
+		if strings.HasPrefix(class, "language-") {
+			return strings.TrimPrefix(class, "language-")
+		}
+	}
+	return ""
+}
+
+// markdownIndent prefixes the first line of the text, and indents every other line that isn't blank
+func markdownIndent(text, first, rest string) string {
+	lines := strings.Split(text, "\n")
+	for i := range lines {
+		prefix := rest
+		if i == 0 {
+			prefix = first
+		}
+		if lines[i] == "" {
+			prefix = strings.TrimRight(prefix, " ")
+		}
+		lines[i] = prefix + lines[i]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// markdownList converts a list.  A list is loose, with blank lines between its items, if any item has paragraphs
+func markdownList(n *html.Node) string {
+	number := 1
+	if n.DataAtom == atom.Ol {
+		if start, err := strconv.Atoi(attrValue(n, "start")); err == nil && start >= 0 {
+			number = start
+		}
+	}
+
+	loose := false
+	var items []*html.Node
+	for li := n.FirstChild; li != nil; li = li.NextSibling {
+		if li.DataAtom != atom.Li {
+			continue
+		}
+		items = append(items, li)
+		for c := li.FirstChild; c != nil; c = c.NextSibling {
+			if c.DataAtom == atom.P {
+				loose = true
+			}
+		}
+	}
+
+	separator := "\n"
+	if loose {
+		separator = "\n\n"
+	}
+	var list []string
+	for _, li := range items {
+		marker := "- "
+		if n.DataAtom == atom.Ol {
+			marker = strconv.Itoa(number) + ". "
+			number++
+		}
+		task := markdownTask(li)
+		content := strings.Join(markdownBlocks(li.FirstChild), separator)
+		if task != "" {
+			content = task + " " + content
+		}
+		list = append(list, strings.TrimRight(markdownIndent(content, marker, strings.Repeat(" ", len(marker))), " "))
+	}
+	return strings.Join(list, separator)
+}
+
+// markdownTask removes the checkbox from the start of a task list item, and returns the Markdown for it
+func markdownTask(li *html.Node) string {
+	var input *html.Node
+	for n := li.FirstChild; n != nil && input == nil; {
+		switch {
+		case n.Type == html.TextNode && strings.TrimSpace(n.Data) == "":
+			n = n.NextSibling
+		case n.DataAtom == atom.P:
+			n = n.FirstChild
+		case n.DataAtom == atom.Input && attrValue(n, "type") == "checkbox":
+			input = n
+		default:
+			return ""
+		}
+	}
+	if input == nil {
+		return ""
+	}
+	input.Parent.RemoveChild(input)
+	if hasAttr(input, "checked") {
+		return "[x]"
+	}
+	return "[ ]"
+}
+
+// markdownTable converts a table to a GitHub Flavored Markdown table.  Tables that Markdown can't represent, without a
+// header row, with merged cells, or with blocks in their cells, are kept as HTML
+func markdownTable(n *html.Node) string {
+	var rows [][]*html.Node
+	var addRows func(n *html.Node) bool
+	addRows = func(n *html.Node) bool {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			switch c.DataAtom {
+			case atom.Thead, atom.Tbody, atom.Tfoot:
+				if !addRows(c) {
+					return false
+				}
+			case atom.Tr:
+				var cells []*html.Node
+				for cell := c.FirstChild; cell != nil; cell = cell.NextSibling {
+					if cell.DataAtom != atom.Th && cell.DataAtom != atom.Td {
+						continue
+					}
+					if attrValue(cell, "colspan") != "" || attrValue(cell, "rowspan") != "" ||
+						findElement(cell, func(e *html.Node) bool { return markdownBlockElements[e.DataAtom] }) != nil {
+						return false
+					}
+					cells = append(cells, cell)
+				}
+				rows = append(rows, cells)
+			case atom.Caption, atom.Colgroup:
+				return false
+			}
+		}
+		return true
+	}
+	if !addRows(n) || len(rows) == 0 || len(rows[0]) == 0 {
+		return markdownRawBlock(n)
+	}
+	header := rows[0]
+	for _, cell := range header {
+		if cell.DataAtom != atom.Th {
+			return markdownRawBlock(n)
+		}
+	}
+	for _, row := range rows[1:] {
+		if len(row) > len(header) {
+			return markdownRawBlock(n)
+		}
+	}
+
+	line := func(cells []string) string {
+		return "| " + strings.Join(cells, " | ") + " |"
+	}
+	text := func(row []*html.Node) string {
+		cells := make([]string, len(header))
+		for i, cell := range row {
+			// pipes end the cell, even in code spans
+			cells[i] = strings.NewReplacer("|", "\\|", "\\\n", "<br />").Replace(markdownInlineText(markdownChildren(cell)))
+		}
+		return line(cells)
+	}
+
+	lines := []string{text(header)}
+	delimiters := make([]string, len(header))
+	for i, cell := range header {
+		switch attrValue(cell, "align") {
+		case "left":
+			delimiters[i] = ":---"
+		case "center":
+			delimiters[i] = ":---:"
+		case "right":
+			delimiters[i] = "---:"
+		default:
+			delimiters[i] = "---"
+		}
+	}
+	lines = append(lines, line(delimiters))
+	for _, row := range rows[1:] {
+		lines = append(lines, text(row))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,710 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+/*
+	Importers convert existing documentation files into Lex Library documents.  Each importer reads a file from an
+	import source, converts it to HTML, and creates a new document from it.
+
+	The converted HTML is always sanitized (see sanitize.go), so nothing in an imported file can run script when the
+	document is viewed.  Files linked from an imported document with a relative link, like its images, are read
+	from the same source and added to the new document as attachments, and the links are rewritten to point at
+	them.  Anything that couldn't be imported exactly as it was, like a missing image, is reported as a warning on
+	the file's result instead of failing the whole import.
+
+	The importers of single files are registered by format, so a file can be imported without knowing its format
+	up front (see Import), and whole zip files or directories can be imported at once (see importBatch.go).
+*/
+
+// maxImportFileSize is the largest file that can be imported as a document, in bytes
+const maxImportFileSize = 32 << 20
+
+// ImportSource is where the files being imported are read from
+type ImportSource interface {
+	// Open opens the file at the slash separated path, relative to the root of the source
+	Open(name string) (io.ReadCloser, error)
+}
+
+// ImportDir is an import source of the files in a directory
+type ImportDir string
+
+// Open opens the file in the directory
+func (d ImportDir) Open(name string) (io.ReadCloser, error) {
+	name, err := importPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(filepath.Join(string(d), filepath.FromSlash(name)))
+}
+
+// ImportFiles is an import source of files in memory, keyed by their slash separated path
+type ImportFiles map[string][]byte
+
+// Open opens the file from memory
+func (f ImportFiles) Open(name string) (io.ReadCloser, error) {
+	name, err := importPath(name)
+	if err != nil {
+		return nil, err
+	}
+	file, ok := f[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(file)), nil
+}
+
+// importPath cleans the path of a file in an import source, and makes sure it doesn't point outside of the source
+func importPath(name string) (string, error) {
+	name = path.Clean(strings.Replace(name, `\`, "/", -1))
+	if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return "", NewFailure(fmt.Sprintf("%s is outside of the files being imported", name))
+	}
+	return name, nil
+}
+
+// pathKey is the key of a file's path in an import, since paths can be too long to index
+func pathKey(name string) string {
+	hash := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(hash[:])
+}
+
+// ImportResult is the outcome of importing a file
+type ImportResult struct {
+	File     string
+	Document *Document
+	// Warnings are the parts of the file that couldn't be imported as they were
+	Warnings []string
+}
+
+// Importer imports the files of one format as documents.  Importers are registered with RegisterImporter, and the
+// importer for a file is chosen by its content, its MIME type or its extension, see DetectImporter
+type Importer interface {
+	// Name identifies the format, and is unique among the registered importers
+	Name() string
+	// Extensions are the lower case extensions of the format's files, with their leading dot
+	Extensions() []string
+	// MIMETypes are the media types of the format, without parameters
+	MIMETypes() []string
+	// Detect returns whether the start of a file, up to sniffLength bytes of it, is in the format.  Only formats with
+	// a signature can be detected, and any other format always returns false
+	Detect(head []byte) bool
+	// Import imports the file from the source as a new document, in the collection if it isn't nil
+	Import(who *User, collection *Collection, source ImportSource, name string) (*ImportResult, error)
+}
+
+// sniffLength is the number of bytes at the start of a file that are read to detect its format
+const sniffLength = 4096
+
+// importers are the registered importers, in the order they were registered
+var importers []Importer
+
+// RegisterImporter adds an importer for a format.  When more than one importer handles the same extension or MIME
+// type, the one registered first is used
+func RegisterImporter(importer Importer) {
+	for _, i := range importers {
+		if i.Name() == importer.Name() {
+			panic(fmt.Sprintf("An importer named %s is already registered", importer.Name()))
+		}
+	}
+	importers = append(importers, importer)
+}
+
+// importFormat is a built in importer
+type importFormat struct {
+	name       string
+	extensions []string
+	mimeTypes  []string
+	detect     func(head []byte) bool // nil if the format has no signature
+	importer   func(who *User, collection *Collection, source ImportSource, name string) (*ImportResult, error)
+}
+
+func (f *importFormat) Name() string         { return f.name }
+func (f *importFormat) Extensions() []string { return f.extensions }
+func (f *importFormat) MIMETypes() []string  { return f.mimeTypes }
+
+func (f *importFormat) Detect(head []byte) bool {
+	return f.detect != nil && f.detect(head)
+}
+
+func (f *importFormat) Import(who *User, collection *Collection, source ImportSource, name string) (*ImportResult,
+	error) {
+	return f.importer(who, collection, source, name)
+}
+
+func init() {
+	for _, f := range []*importFormat{
+		{"markdown", []string{".md", ".markdown", ".mdown"}, []string{"text/markdown", "text/x-markdown"}, nil,
+			ImportMarkdown},
+		{"html", []string{".html", ".htm"}, []string{"text/html", "application/xhtml+xml"}, detectHTML,
+			ImportHTML},
+		{"docx", []string{".docx"}, []string{"application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+			detectDOCX, ImportDOCX},
+		{"odt", []string{".odt"}, []string{"application/vnd.oasis.opendocument.text"}, detectODT, ImportODT},
+		{"pdf", []string{".pdf"}, []string{"application/pdf"}, detectPDF, ImportPDF},
+		{"notebook", []string{".ipynb"}, []string{"application/x-ipynb+json"}, nil, ImportNotebook},
+		{"rst", []string{".rst", ".rest"}, []string{"text/x-rst", "text/prs.fallenstein.rst"}, nil, ImportRST},
+		{"asciidoc", []string{".adoc", ".asciidoc", ".asc"}, []string{"text/asciidoc", "text/x-asciidoc"}, nil,
+			ImportAsciiDoc},
+	} {
+		RegisterImporter(f)
+	}
+}
+
+// detectHTML matches files starting with a doctype or an html element.  Markdown and other text formats can start
+// with other HTML elements, so those aren't enough to tell that a file is HTML
+func detectHTML(head []byte) bool {
+	head = bytes.ToLower(bytes.TrimSpace(bytes.TrimPrefix(head, []byte("\xef\xbb\xbf"))))
+	return bytes.HasPrefix(head, []byte("<!doctype html")) || bytes.HasPrefix(head, []byte("<html"))
+}
+
+// detectDOCX matches zip files with a word directory near their start, where Word writes the document's parts
+func detectDOCX(head []byte) bool {
+	return bytes.HasPrefix(head, []byte("PK\x03\x04")) && bytes.Contains(head, []byte("word/"))
+}
+
+// detectODT matches zip files starting with the uncompressed mimetype file every OpenDocument file starts with
+func detectODT(head []byte) bool {
+	const mimetype = "mimetypeapplication/vnd.oasis.opendocument.text"
+	return bytes.HasPrefix(head, []byte("PK\x03\x04")) && len(head) > 30 &&
+		bytes.HasPrefix(head[30:], []byte(mimetype)) && !bytes.HasPrefix(head[30+len(mimetype):], []byte("-"))
+}
+
+// detectPDF matches files with the PDF header, which readers accept anywhere in the first kilobyte
+func detectPDF(head []byte) bool {
+	return bytes.Contains(head[:minInt(len(head), 1024)], []byte("%PDF-"))
+}
+
+// DetectImporter returns the importer for a file.  A file whose content matches a format's signature is always
+// imported as that format, whatever it's named, and any other file is imported by its MIME type if one is passed
+// in, or else by its extension
+func DetectImporter(name, mimeType string, head []byte) (Importer, bool) {
+	for _, i := range importers {
+		if i.Detect(head) {
+			return i, true
+		}
+	}
+	if mediaType, _, err := mime.ParseMediaType(mimeType); err == nil {
+		for _, i := range importers {
+			if stringIn(mediaType, i.MIMETypes()) {
+				return i, true
+			}
+		}
+	}
+	return extensionImporter(name)
+}
+
+// extensionImporter returns the importer for the file's extension
+func extensionImporter(name string) (Importer, bool) {
+	ext := strings.ToLower(path.Ext(name))
+	for _, i := range importers {
+		if stringIn(ext, i.Extensions()) {
+			return i, true
+		}
+	}
+	return nil, false
+}
+
+// Import imports the file from the source as a new document, with the importer for the file's format.  If the
+// file's content doesn't match its extension, it's imported as the format of its content, with a warning
+func Import(who *User, collection *Collection, source ImportSource, name string) (*ImportResult, error) {
+	head, err := newImportDoc(source, name).head()
+	if err != nil {
+		return nil, err
+	}
+	importer, ok := DetectImporter(name, "", head)
+	if !ok {
+		return nil, NewFailure(fmt.Sprintf("%s can't be imported, because files of its type aren't supported", name))
+	}
+	return importAs(importer, who, collection, source, name)
+}
+
+// importAs imports the file with the importer, and warns if it isn't the importer for the file's extension
+func importAs(importer Importer, who *User, collection *Collection, source ImportSource, name string) (*ImportResult,
+	error) {
+	result, err := importer.Import(who, collection, source, name)
+	if err != nil {
+		return nil, err
+	}
+	if byName, ok := extensionImporter(name); ok && byName != importer {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("%s was imported as %s, because its content doesn't "+
+			"match its extension", name, importer.Name()))
+	}
+	return result, nil
+}
+
+// reDocumentLink matches the path of a link to another document, see documentLink
+var reDocumentLink = regexp.MustCompile(`^\.\./[0-9a-f]{32}/$`)
+
+// importDoc is a document being imported, before it's created
+type importDoc struct {
+	source      ImportSource
+	file        string
+	id          string // the id of the new document, if it was chosen before it was imported
+	title       string
+	body        string // HTML
+	summary     string
+	tags        []string
+	created     time.Time
+	updated     time.Time
+	author      string                 // the id of the imported revision's author, if it isn't the importer
+	history     []*Revision            // the revisions before the imported one, oldest first
+	attachments map[string]*Attachment // by the path of the linked file
+	warnings    []string
+}
+
+func newImportDoc(source ImportSource, file string) *importDoc {
+	return &importDoc{
+		source:      source,
+		file:        file,
+		attachments: make(map[string]*Attachment),
+	}
+}
+
+// warn records a warning about the import, once no matter how many times it's warned about
+func (i *importDoc) warn(format string, args ...interface{}) {
+	warning := fmt.Sprintf(format, args...)
+	for _, w := range i.warnings {
+		if w == warning {
+			return
+		}
+	}
+	i.warnings = append(i.warnings, warning)
+}
+
+// read reads the whole file from the source as text
+func (i *importDoc) read() (string, error) {
+	file, err := i.readBytes()
+	if err != nil {
+		return "", err
+	}
+	return i.text(file), nil
+}
+
+// readBytes reads the whole file from the source
+func (i *importDoc) readBytes() ([]byte, error) {
+	r, err := i.source.Open(i.file)
+	if os.IsNotExist(err) {
+		return nil, NotFound(fmt.Sprintf("%s was not found", i.file))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	file, err := ioutil.ReadAll(io.LimitReader(r, maxImportFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(file) > maxImportFileSize {
+		return nil, NewFailure(fmt.Sprintf("%s is too large to import", i.file))
+	}
+	return file, nil
+}
+
+// head reads the start of the file from the source, to detect its format
+func (i *importDoc) head() ([]byte, error) {
+	name, err := importPath(i.file)
+	if err != nil {
+		return nil, err
+	}
+	r, err := i.source.Open(name)
+	if os.IsNotExist(err) {
+		return nil, NotFound(fmt.Sprintf("%s was not found", name))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	return head[:n], nil
+}
+
+// text returns the UTF-8 file as a string, without a byte order mark
+func (i *importDoc) text(file []byte) string {
+	file = bytes.TrimPrefix(file, []byte("\xef\xbb\xbf"))
+	if !utf8.Valid(file) {
+		i.warn("%s is not valid UTF-8 text, invalid characters were replaced", i.file)
+		return validUTF8(file)
+	}
+	return string(file)
+}
+
+// validUTF8 replaces the invalid UTF-8 in the text with the unicode replacement character
+func validUTF8(text []byte) string {
+	buf := &bytes.Buffer{}
+	for len(text) > 0 {
+		r, size := utf8.DecodeRune(text)
+		buf.WriteRune(r)
+		text = text[size:]
+	}
+	return buf.String()
+}
+
+// linkAttributes are the attributes of each element that link to a file
+var linkAttributes = map[atom.Atom]string{
+	atom.A:      "href",
+	atom.Img:    "src",
+	atom.Audio:  "src",
+	atom.Video:  "src",
+	atom.Source: "src",
+}
+
+// attachLinks adds the files linked from the body with relative links as attachments, and points the links at
+// the attachments
+func (i *importDoc) attachLinks(who *User) {
+	i.body = rewriteLinks(i.body, func(element atom.Atom, link string) (string, bool) {
+		return i.attach(who, link)
+	})
+}
+
+// rewriteLinks calls fn with every link to a file in the HTML, and replaces the link if fn returns true.  If the
+// replacement is empty, the link is removed
+func rewriteLinks(body string, fn func(element atom.Atom, link string) (string, bool)) string {
+	z := html.NewTokenizer(strings.NewReader(body))
+	buf := &bytes.Buffer{}
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			buf.Write(z.Raw())
+			continue
+		}
+
+		raw := z.Raw()
+		t := z.Token()
+		key, ok := linkAttributes[t.DataAtom]
+		if !ok {
+			buf.Write(raw)
+			continue
+		}
+		changed := false
+		attrs := t.Attr[:0]
+		for _, attr := range t.Attr {
+			if attr.Key == key {
+				if link, ok := fn(t.DataAtom, attr.Val); ok {
+					changed = true
+					if link == "" {
+						continue
+					}
+					attr.Val = link
+				}
+			}
+			attrs = append(attrs, attr)
+		}
+		t.Attr = attrs
+		if changed {
+			buf.WriteString(t.String())
+		} else {
+			buf.Write(raw)
+		}
+	}
+	return buf.String()
+}
+
+// attach attaches the file at the relative link, and returns the link to the attachment.  Links that aren't
+// relative, or whose files can't be attached, are left alone
+func (i *importDoc) attach(who *User, link string) (string, bool) {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" || strings.HasPrefix(u.Path, "/") {
+		return "", false
+	}
+	if reDocumentLink.MatchString(u.Path) {
+		// links to other documents aren't files
+		return "", false
+	}
+	for _, a := range i.attachments {
+		if link == a.URL() {
+			// already linked to a file embedded in the imported file
+			return "", false
+		}
+	}
+
+	name, err := importPath(path.Join(path.Dir(i.file), u.Path))
+	if err != nil {
+		i.warn("The link to %s is outside of the files being imported, and was left as is", link)
+		return "", false
+	}
+
+	a, ok := i.attachments[name]
+	if !ok {
+		r, err := i.source.Open(name)
+		if err != nil {
+			i.warn("The linked file %s could not be found, and was left as is", name)
+			return "", false
+		}
+		a, err = newAttachment(who, name, r)
+		r.Close()
+		if err != nil {
+			i.warn("The linked file %s could not be attached: %s", name, err)
+			return "", false
+		}
+		i.attachments[name] = a
+	}
+
+	attached := a.URL()
+	if u.Fragment != "" {
+		attached += (&url.URL{Fragment: u.Fragment}).String()
+	}
+	return attached, true
+}
+
+// create creates the new document from its revisions, with its attachments and tags.  If the document can't be
+// created, the blobs of its attachments are released
+func (i *importDoc) create(who *User, collection *Collection) (*ImportResult, error) {
+	revisions := i.revisions(who)
+
+	var tags []string
+	for _, tag := range i.tags {
+		tag = normalizeTag(tag)
+		err := validateTag(tag)
+		if err != nil {
+			i.warn("The tag %q was skipped: %s", tag, err)
+			continue
+		}
+		tags = append(tags, tag)
+	}
+
+	revisions[0].DocumentID = i.id
+	d, err := documentNew(who, collection, revisions, i.updated, func(tx *sql.Tx, d *Document) error {
+		for _, a := range i.attachments {
+			err := insertAttachment(tx, d, a)
+			if err != nil {
+				return err
+			}
+		}
+
+		seen := make(map[string]bool)
+		for _, tag := range tags {
+			tag, err := resolveTag(tx, d.TenantID, tag)
+			if err != nil {
+				return err
+			}
+			if seen[tag] {
+				continue
+			}
+			seen[tag] = true
+			err = insertTag(tx, d.TenantID, d.ID, tag, false, false)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		i.release()
+		return nil, err
+	}
+
+	return &ImportResult{
+		File:     i.file,
+		Document: d,
+		Warnings: i.warnings,
+	}, nil
+}
+
+// revisions sanitizes the body and history and attaches their linked files, and returns the document's revisions,
+// oldest first.  If the document has a history, the imported title and body become the revision after it, created
+// on the updated date
+func (i *importDoc) revisions(who *User) []*Revision {
+	i.body = sanitizeHTML(i.body)
+	i.attachLinks(who)
+	for _, r := range i.history {
+		r.Body = rewriteLinks(sanitizeHTML(r.Body), func(element atom.Atom, link string) (string, bool) {
+			return i.attach(who, link)
+		})
+		r.Title = truncate(r.Title, maxTitleLength)
+	}
+
+	if strings.TrimSpace(i.title) == "" {
+		i.title = strings.TrimSuffix(path.Base(i.file), path.Ext(i.file))
+	}
+	if len(i.title) > maxTitleLength {
+		i.warn("The title was longer than 500 characters and was shortened")
+		i.title = truncate(i.title, maxTitleLength)
+	}
+	if utf8.RuneCountInString(i.summary) > maxSummaryLength {
+		i.warn("The summary was longer than 2000 characters and was replaced with a generated one")
+		i.summary = ""
+	}
+
+	latest := &Revision{
+		Title:         i.title,
+		Body:          i.body,
+		Summary:       i.summary,
+		SummaryManual: i.summary != "",
+		Author:        i.author,
+		Created:       i.created,
+	}
+	if len(i.history) > 0 {
+		latest.Created = i.updated
+	}
+	return append(i.history, latest)
+}
+
+// update adds the revisions to an existing document, after its latest revision, along with their attachments.
+// Files already attached to the document with the same name and content aren't attached again, and tags aren't
+// changed.  If the revisions can't be added, the blobs of the new attachments are released
+func (i *importDoc) update(who *User, d *Document) (*ImportResult, error) {
+	existing, err := d.Attachments()
+	if err != nil {
+		return nil, err
+	}
+	revisions := i.revisions(who)
+
+	reused := make(map[string]string) // the links to the existing attachments, by the links to the new ones
+	for key, a := range i.attachments {
+		for _, e := range existing {
+			if e.Name == a.Name && e.BlobID == a.BlobID {
+				reused[a.URL()] = e.URL()
+				releaseAttachments(a)
+				delete(i.attachments, key)
+				break
+			}
+		}
+	}
+	if len(reused) > 0 {
+		for _, r := range revisions {
+			r.Body = rewriteLinks(r.Body, func(element atom.Atom, link string) (string, bool) {
+				url, ok := reused[link]
+				return url, ok
+			})
+		}
+	}
+
+	err = d.addRevisions(revisions, func(tx *sql.Tx, d *Document) error {
+		for _, a := range i.attachments {
+			err := insertAttachment(tx, d, a)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		i.release()
+		return nil, err
+	}
+
+	return &ImportResult{
+		File:     i.file,
+		Document: d,
+		Warnings: i.warnings,
+	}, nil
+}
+
+// release releases the blobs of the attachments, if the document wasn't created
+func (i *importDoc) release() {
+	for _, a := range i.attachments {
+		releaseAttachments(a)
+	}
+}
+
+// importAuthors matches the authors of the files being imported to the users with the same usernames or email
+// addresses
+type importAuthors struct {
+	tenant *Tenant
+	ids    map[string]string // the ids of the users, or empty if there is no user, by username
+	emails map[string]string // the ids of the users, or empty if there is no user, by email address
+}
+
+func newImportAuthors(who *User) (*importAuthors, error) {
+	tenant, err := TenantGet(who.TenantID)
+	if err != nil {
+		return nil, err
+	}
+	return &importAuthors{tenant: tenant, ids: make(map[string]string), emails: make(map[string]string)}, nil
+}
+
+// id returns the id of the user with the username, or an empty id if there isn't one
+func (a *importAuthors) id(username string) (string, error) {
+	return a.find(a.ids, username, UserFromUsername)
+}
+
+// email returns the id of the user with the email address, or an empty id if there isn't one
+func (a *importAuthors) email(email string) (string, error) {
+	return a.find(a.emails, email, userFromEmail)
+}
+
+func (a *importAuthors) find(ids map[string]string, key string,
+	get func(tenant *Tenant, key string) (*User, error)) (string, error) {
+	if key == "" {
+		return "", nil
+	}
+	id, ok := ids[key]
+	if ok {
+		return id, nil
+	}
+	u, err := get(a.tenant, key)
+	if err == nil {
+		id = u.ID
+	} else if !IsFailType(err, FailNotFound) {
+		return "", err
+	}
+	ids[key] = id
+	return id, nil
+}
+
+// truncate shortens the text to at most length bytes, without splitting a character
+func truncate(text string, length int) string {
+	if len(text) <= length {
+		return text
+	}
+	for length > 0 && !utf8.RuneStart(text[length]) {
+		length--
+	}
+	return text[:length]
+}
+
+// parseImportDate parses a date in any of the common formats used in documentation files
+func parseImportDate(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range []string{
+		time.RFC3339Nano,
+		"2006-01-02T15:04:05",
+		"2006-01-02 15:04:05 -0700",
+		"2006-01-02 15:04:05 -07:00",
+		"2006-01-02 15:04:05",
+		"2006-01-02 15:04",
+		"2006-01-02",
+		time.RFC1123Z,
+		time.RFC1123,
+		"January 2, 2006",
+		"Jan 2, 2006",
+		"2 January 2006",
+	} {
+		t, err := time.Parse(layout, value)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a recognized date", value)
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"strings"
+)
+
+/*
+	AsciiDoc files are converted by the converter in asciidoc.go.  The title is the document title, or the first top
+	level heading, and the description, keywords and revision date attributes of the header are the summary, tags
+	and updated date, the way they are in front matter.  Images are attached like any other linked file, relative
+	to the imagesdir attribute.
+*/
+
+// ImportAsciiDoc imports an AsciiDoc file from the source as a new document, in the collection if it isn't nil
+func ImportAsciiDoc(who *User, collection *Collection, source ImportSource, name string) (*ImportResult, error) {
+	_, err := canCreateDocument(who, collection)
+	if err != nil {
+		return nil, err
+	}
+	name, err = importPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	i := newImportDoc(source, name)
+	text, err := i.read()
+	if err != nil {
+		return nil, err
+	}
+
+	i.asciidoc(text)
+	return i.create(who, collection)
+}
+
+// asciidoc sets the fields of the document from the AsciiDoc text, and warns about anything that couldn't be
+// converted
+func (i *importDoc) asciidoc(text string) {
+	a := newAsciiDocConverter()
+	i.body = a.convert(text)
+	i.title = firstHeading(i.body)
+	i.summary = a.value("description")
+	for _, name := range []string{"keywords", "tags"} {
+		for _, tag := range strings.Split(a.value(name), ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				i.tags = append(i.tags, tag)
+			}
+		}
+	}
+	if revdate := a.value("revdate"); revdate != "" {
+		updated, err := parseImportDate(revdate)
+		if err != nil {
+			i.warn("The revision date was skipped: %s", err)
+		}
+		i.updated = updated
+	}
+
+	if unknown := uniqueSorted(a.unknown); len(unknown) > 0 {
+		i.warn("The macros %s have no equivalent in a document, and were left out", strings.Join(unknown, ", "))
+	}
+	if documents := uniqueSorted(a.documents); len(documents) > 0 {
+		i.warn("The references to the documents %s were left as text", strings.Join(documents, ", "))
+	}
+	if includes := uniqueSorted(a.includes); len(includes) > 0 {
+		i.warn("The included files %s were left out", strings.Join(includes, ", "))
+	}
+	if missing := uniqueSorted(a.missing); len(missing) > 0 {
+		i.warn("The cross references to %s have no target, and were left as text", strings.Join(missing, ", "))
+	}
+}
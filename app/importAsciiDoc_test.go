@@ -0,0 +1,93 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lexLibrary/lexLibrary/app"
+)
+
+func TestImportAsciiDoc(t *testing.T) {
+	resetDocuments(t)
+
+	tenant, err := app.TenantNew(installAdmin(t), "Import AsciiDoc Tenant", "", "")
+	if err != nil {
+		t.Fatalf("Error creating tenant: %s", err)
+	}
+	author := testUser(t, tenant, "author")
+	fixtures := app.ImportDir("testdata/import")
+
+	result, err := app.ImportAsciiDoc(author, nil, fixtures, "guide.adoc")
+	if err != nil {
+		t.Fatalf("Error importing guide.adoc: %s", err)
+	}
+	warnings := []string{
+		"The macros chart have no equivalent in a document, and were left out",
+		"The references to the documents other.adoc were left as text",
+		"The included files shared.adoc were left out",
+		"The cross references to missing have no target, and were left as text",
+		"The linked file img/intro.mp4 could not be found, and was left as is",
+	}
+	if strings.Join(result.Warnings, "\n") != strings.Join(warnings, "\n") {
+		t.Fatalf("Invalid warnings. Wanted %q got %q", warnings, result.Warnings)
+	}
+
+	doc := result.Document
+	rev, err := doc.Latest()
+	if err != nil {
+		t.Fatalf("Error getting revision: %s", err)
+	}
+	if rev.Title != "Pump Guide" || rev.Summary != "How to look after the pump" {
+		t.Fatalf("Invalid title or summary: %q %q", rev.Title, rev.Summary)
+	}
+	if !doc.Updated.Equal(time.Date(2017, 5, 6, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Invalid updated date: %s", doc.Updated)
+	}
+
+	tags, err := doc.Tags()
+	if err != nil {
+		t.Fatalf("Error getting tags: %s", err)
+	}
+	if len(tags) != 2 || tags[0].Name != "maintenance" || tags[1].Name != "pumps" {
+		t.Fatalf("Invalid tags: %+v", tags)
+	}
+
+	attachments, err := doc.Attachments()
+	if err != nil {
+		t.Fatalf("Error getting attachments: %s", err)
+	}
+	if len(attachments) != 1 || attachments[0].Name != "logo.png" {
+		t.Fatalf("Invalid attachments: %+v", attachments)
+	}
+
+	for _, want := range []string{
+		`<h1 id="_pump_guide">Pump Guide</h1>`,
+		`see <a href="#installing">Installing</a> and <a href="#_cleaning">the cleaning steps</a>.`,
+		`Read <strong>care</strong>fully, and visit <a href="https://example.com/pumps">the vendor</a> or ` +
+			`<a href="https://example.com">https://example.com</a>.`,
+		`H<sub>2</sub>O away, and use <code>pump --help</code>.<sup>[<a href="#_footnotedef_1">1</a>]</sup><br />`,
+		`<li id="_footnotedef_1">Or read the manual.</li>`,
+		"<blockquote>\n<p><strong>Note</strong></p>\n<p>Turn the power off\nbefore starting.</p>\n</blockquote>",
+		"<blockquote>\n<p><strong>Warning</strong></p>\n<p>Wear gloves.</p>\n</blockquote>",
+		`<pre><code class="language-bash">pump --install &amp;&amp; echo &quot;&lt;done&gt;&quot;</code></pre>` +
+			"\n<ol>\n<li>Installs it.</li>\n</ol>",
+		"<pre>$ pump status</pre>",
+		"<li>Scrub it with <code>soap</code>.\n<ul>\n<li>Gently.</li>\n<li>Twice.\n<p>Rinse afterwards.</p></li>",
+		`<li><input type="checkbox" checked="" disabled="" /> Checked</li>`,
+		`<img src="` + attachments[0].URL() + `" alt="Logo" width="100"`,
+		"<p><strong>Parts</strong></p>\n<table>\n<thead>\n<tr><th>Part</th><th>Count</th></tr>",
+		"<tr><td><ul>\n<li>Scrub</li>\n</ul></td><td>10 min</td></tr>",
+		"<dt>Pump</dt>\n<dd>The machine.</dd>\n<dt>Filter</dt>\n<dd>Catches dirt.</dd>",
+		"<p>Vendor defined.</p>\n<p>See the other page and [missing].</p>",
+	} {
+		if !strings.Contains(rev.Body, want) {
+			t.Fatalf("Body is missing %s:\n%s", want, rev.Body)
+		}
+	}
+	if strings.Contains(rev.Body, "Vendor missing") || strings.Contains(rev.Body, "Jane Doe") {
+		t.Fatalf("Body contains excluded text or the header:\n%s", rev.Body)
+	}
+}
@@ -0,0 +1,1066 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lexLibrary/lexLibrary/data"
+)
+
+/*
+	A batch import imports every file in a zip file or a directory tree as documents, and keeps the folders the files
+	are in as collections nested in the collection the batch is imported into.  Each file is imported by the
+	importer for its format (see DetectImporter).  Files that can't be imported as documents, like images, are still
+	kept with the batch, so the documents that link to them can attach them.
+
+	Starting a batch only lists its files, and checks there aren't too many of them to import.  Batches then run in
+	the background a few files at a time, like crawls, and keep their progress in the database so they pick up where
+	they left off after a restart.  Each run first copies the next files into the blob store and detects their
+	formats, and once every file is copied, imports the next of them.  A directory, or a zip file in one, is read in
+	place, so it must stay where it is until the batch's files are copied, and any other zip file is kept in the blob
+	store until then.  The outcome of every file is kept as the batch's report, and once the batch is finished the
+	copies of its files are released.
+*/
+
+// statuses of a batch import
+const (
+	ImportBatchStatusRunning  = "running"
+	ImportBatchStatusDone     = "done"
+	ImportBatchStatusCanceled = "canceled"
+	ImportBatchStatusFailed   = "failed"
+)
+
+// statuses of a file in a batch import
+const (
+	ImportBatchFileStatusPending  = "pending"
+	ImportBatchFileStatusImported = "imported"
+	ImportBatchFileStatusWarned   = "warned" // imported, but with warnings
+	ImportBatchFileStatusFailed   = "failed"
+	ImportBatchFileStatusSkipped  = "skipped"
+
+	// importBatchFileStatusCopying is a file that hasn't been copied from the batch's source yet.  It's reported
+	// as pending
+	importBatchFileStatusCopying = "copying"
+)
+
+const (
+	// importBatchSize is the number of files imported from each batch every time batches are run
+	importBatchSize = 20
+	// maxImportBatchFiles is the most files a batch can import
+	maxImportBatchFiles = 10000
+)
+
+// maxImportBatchSize is the most bytes of files a batch can import, not counting files too large to import.  It's
+// only ever changed by tests
+var maxImportBatchSize int64 = 1 << 30
+
+// ImportBatch is a job importing the files in a zip file or directory as documents
+type ImportBatch struct {
+	ID           string
+	TenantID     string
+	Name         string // the name of the zip file or directory imported
+	CollectionID string // empty if the documents aren't imported into a collection
+	Status       string
+	Message      string // why the batch failed
+	Creator      string
+	Created      time.Time
+	Updated      time.Time
+
+	sourcePath string // the directory or zip file on the server the files are copied from
+	sourceBlob string // the blob of the zip file the files are copied from, until they're all copied
+	who        *User
+}
+
+// ImportBatchFile is a file in a batch import, and the outcome of importing it
+type ImportBatchFile struct {
+	Path       string
+	Format     string // the name of the file's importer, empty if it can't be imported as a document
+	Status     string
+	DocumentID string // only set once the file is imported
+	// Warnings are the parts of the file that couldn't be imported as they were
+	Warnings []string
+	Message  string // why the file failed or was skipped
+	Updated  time.Time
+}
+
+// ImportBatchReport is the number of files in a batch import with each outcome
+type ImportBatchReport struct {
+	Files    int
+	Pending  int
+	Imported int
+	Warned   int
+	Failed   int
+	Skipped  int
+}
+
+// importBatchFile is a file of a batch as it's stored
+type importBatchFile struct {
+	path     string
+	sequence int
+	format   string
+	blob     string // the id of the blob with the file's content, empty once it's released
+	status   string
+	message  string
+}
+
+var (
+	sqlImportBatchInsert = data.NewQuery(`
+		insert into import_batches (tenant_id, id, name, collection_id, status, creator, created, updated,
+			source_path, source_blob_id)
+		values ({{tenant}}, {{arg "id"}}, {{arg "name"}}, {{arg "collection_id"}}, {{arg "status"}},
+			{{arg "creator"}}, {{arg "created"}}, {{arg "updated"}}, {{arg "source_path"}}, {{arg "source_blob_id"}})
+	`)
+	sqlImportBatchColumns = `b.id, b.tenant_id, b.name, b.collection_id, b.status, b.message, b.creator, b.created,
+		b.updated, b.source_path, b.source_blob_id`
+	sqlImportBatchGet = data.NewQuery(`
+		select ` + sqlImportBatchColumns + ` from import_batches b
+		where b.tenant_id = {{tenant}} and b.id = {{arg "id"}}
+	`)
+	sqlImportBatchRunning = data.NewQuery(`
+		select ` + sqlImportBatchColumns + ` from import_batches b
+		where b.tenant_id = {{tenant}} and b.status = 'running'
+		order by b.created
+	`)
+	sqlImportBatchUpdate = data.NewQuery(`
+		update import_batches set status = {{arg "status"}}, message = {{arg "message"}}, updated = {{arg "updated"}},
+			source_blob_id = NULL
+		where tenant_id = {{tenant}} and id = {{arg "id"}}
+	`)
+	sqlImportBatchSourceRelease = data.NewQuery(`
+		update import_batches set source_blob_id = NULL
+		where tenant_id = {{tenant}} and id = {{arg "id"}}
+	`)
+
+	sqlImportBatchFileInsert = data.NewQuery(`
+		insert into import_batch_files (tenant_id, batch_id, path_key, path, sequence, format, blob_id, status,
+			message, updated)
+		values ({{tenant}}, {{arg "batch_id"}}, {{arg "path_key"}}, {{arg "path"}}, {{arg "sequence"}},
+			{{arg "format"}}, {{arg "blob_id"}}, {{arg "status"}}, {{arg "message"}}, {{arg "updated"}})
+	`)
+	sqlImportBatchFileNext = data.NewQuery(`
+		select f.path, f.sequence, f.format, f.blob_id, f.status, f.message from import_batch_files f
+		where f.tenant_id = {{tenant}} and f.batch_id = {{arg "batch_id"}} and f.status = 'pending'
+		order by f.sequence
+		LIMIT {{arg "limit"}}
+	`)
+	sqlImportBatchFileCopyNext = data.NewQuery(`
+		select f.path, f.sequence from import_batch_files f
+		where f.tenant_id = {{tenant}} and f.batch_id = {{arg "batch_id"}} and f.status = 'copying'
+		order by f.sequence
+		LIMIT {{arg "limit"}}
+	`)
+	sqlImportBatchFileCopied = data.NewQuery(`
+		update import_batch_files set format = {{arg "format"}}, blob_id = {{arg "blob_id"}}, status = {{arg "status"}},
+			message = {{arg "message"}}, updated = {{arg "updated"}}
+		where tenant_id = {{tenant}} and batch_id = {{arg "batch_id"}} and path_key = {{arg "path_key"}}
+	`)
+	sqlImportBatchFileBlob = data.NewQuery(`
+		select f.blob_id from import_batch_files f
+		where f.tenant_id = {{tenant}} and f.batch_id = {{arg "batch_id"}} and f.path_key = {{arg "path_key"}}
+	`)
+	sqlImportBatchFileBlobs = data.NewQuery(`
+		select f.blob_id from import_batch_files f
+		where f.tenant_id = {{tenant}} and f.batch_id = {{arg "batch_id"}} and f.blob_id is not null
+	`)
+	sqlImportBatchFileRelease = data.NewQuery(`
+		update import_batch_files set blob_id = NULL
+		where tenant_id = {{tenant}} and batch_id = {{arg "batch_id"}}
+	`)
+	sqlImportBatchFileUpdate = data.NewQuery(`
+		update import_batch_files set status = {{arg "status"}}, document_id = {{arg "document_id"}},
+			warnings = {{arg "warnings"}}, message = {{arg "message"}}, updated = {{arg "updated"}}
+		where tenant_id = {{tenant}} and batch_id = {{arg "batch_id"}} and path_key = {{arg "path_key"}}
+	`)
+	sqlImportBatchFileList = data.NewQuery(`
+		select f.path, f.format, f.status, f.document_id, f.warnings, f.message, f.updated from import_batch_files f
+		where f.tenant_id = {{tenant}} and f.batch_id = {{arg "batch_id"}}
+		order by f.sequence
+		LIMIT {{arg "limit"}} OFFSET {{arg "offset"}}
+	`)
+	sqlImportBatchFileCount = data.NewQuery(`
+		select f.status, count(*) from import_batch_files f
+		where f.tenant_id = {{tenant}} and f.batch_id = {{arg "batch_id"}}
+		group by f.status
+	`)
+
+	sqlImportBatchFolderGet = data.NewQuery(`
+		select f.collection_id from import_batch_folders f
+		where f.tenant_id = {{tenant}} and f.batch_id = {{arg "batch_id"}} and f.path_key = {{arg "path_key"}}
+	`)
+	sqlImportBatchFolderInsert = data.NewQuery(`
+		insert into import_batch_folders (tenant_id, batch_id, path_key, path, collection_id)
+		values ({{tenant}}, {{arg "batch_id"}}, {{arg "path_key"}}, {{arg "path"}}, {{arg "collection_id"}})
+	`)
+	sqlImportBatchFolderDelete = data.NewQuery(`
+		delete from import_batch_folders
+		where tenant_id = {{tenant}} and batch_id = {{arg "batch_id"}} and path_key = {{arg "path_key"}}
+	`)
+)
+
+// batchEntry is a file in the source of a batch
+type batchEntry struct {
+	path string
+	size int64
+	open func() (io.ReadCloser, error)
+}
+
+// ImportBatchNew starts importing the files in the zip file, into the collection if it isn't nil.  If the source is
+// a directory and name is a directory in it, the files in the directory and the directories below it are imported
+// instead.  Hidden files, and the metadata macOS adds to zip files, are left out.  Only administrators of the
+// default tenant can import from a directory, as it reads files from the server
+func ImportBatchNew(who *User, collection *Collection, source ImportSource, name string) (*ImportBatch, error) {
+	collectionID, err := canCreateDocument(who, collection)
+	if err != nil {
+		return nil, err
+	}
+	name, err = importPath(name)
+	if err != nil {
+		return nil, err
+	}
+	if dir, ok := source.(ImportDir); ok {
+		err = canAdminInstallation(who)
+		if err != nil {
+			return nil, err
+		}
+		if !withinDir(string(dir), filepath.Join(string(dir), filepath.FromSlash(name))) {
+			return nil, NotFound(fmt.Sprintf("%s was not found", name))
+		}
+	}
+
+	b := &ImportBatch{
+		ID:           newID(),
+		TenantID:     who.TenantID,
+		Name:         name,
+		CollectionID: collectionID,
+		Status:       ImportBatchStatusRunning,
+		Creator:      who.ID,
+		Created:      time.Now(),
+		who:          who,
+	}
+	b.Updated = b.Created
+
+	var entries []batchEntry
+	if dir, ok := source.(ImportDir); ok && isDir(filepath.Join(string(dir), filepath.FromSlash(name))) {
+		if name == "." {
+			b.Name = filepath.Base(string(dir))
+		}
+		entries, err = dirEntries(filepath.Join(string(dir), filepath.FromSlash(name)))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		z, err := newImportDoc(source, name).openArchive()
+		if err != nil {
+			return nil, err
+		}
+		defer z.Close()
+		entries = zipEntries(z)
+	}
+	if len(entries) == 0 {
+		return nil, NewFailure(fmt.Sprintf("%s has no files to import", b.Name))
+	}
+	if len(entries) > maxImportBatchFiles {
+		return nil, NewFailure(fmt.Sprintf("%s has more than %d files, which is more than can be imported at once",
+			b.Name, maxImportBatchFiles))
+	}
+	var size int64
+	for _, e := range entries {
+		// files too large to import aren't copied
+		if e.size <= maxImportFileSize {
+			size += e.size
+		}
+	}
+	if size > maxImportBatchSize {
+		return nil, NewFailure(fmt.Sprintf("%s has more than %dMB of files, which is more than can be imported at once",
+			b.Name, maxImportBatchSize>>20))
+	}
+
+	if dir, ok := source.(ImportDir); ok {
+		b.sourcePath, err = filepath.Abs(filepath.Join(string(dir), filepath.FromSlash(name)))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		b.sourceBlob, err = writeBatchSource(source, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = data.BeginTx(func(tx *sql.Tx) error {
+		_, err := sqlImportBatchInsert.Tx(tx).Tenant(b.TenantID).Exec(
+			sql.Named("id", b.ID),
+			sql.Named("name", b.Name),
+			sql.Named("collection_id", nullString(b.CollectionID)),
+			sql.Named("status", b.Status),
+			sql.Named("creator", b.Creator),
+			sql.Named("created", b.Created),
+			sql.Named("updated", b.Updated),
+			sql.Named("source_path", nullString(b.sourcePath)),
+			sql.Named("source_blob_id", nullString(b.sourceBlob)),
+		)
+		if err != nil {
+			return err
+		}
+		for i, e := range entries {
+			_, err = sqlImportBatchFileInsert.Tx(tx).Tenant(b.TenantID).Exec(
+				sql.Named("batch_id", b.ID),
+				sql.Named("path_key", pathKey(e.path)),
+				sql.Named("path", e.path),
+				sql.Named("sequence", i+1),
+				sql.Named("format", nullString("")),
+				sql.Named("blob_id", nullString("")),
+				sql.Named("status", importBatchFileStatusCopying),
+				sql.Named("message", nullString("")),
+				sql.Named("updated", b.Created),
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if b.sourceBlob != "" {
+			if rErr := data.BlobRelease(nil, b.sourceBlob); rErr != nil {
+				LogError(rErr)
+			}
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// writeBatchSource copies the zip file being imported into the blob store, so its files can be copied after the
+// source is gone.  Zip files that aren't on the server's file system are already read into memory to list their
+// files, so they're no larger than maxImportFileSize
+func writeBatchSource(source ImportSource, name string) (string, error) {
+	r, err := source.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	blob, err := data.BlobWrite(r)
+	if err != nil {
+		return "", err
+	}
+	return blob.ID, nil
+}
+
+func isDir(name string) bool {
+	info, err := os.Stat(name)
+	return err == nil && info.IsDir()
+}
+
+// hiddenFile returns whether the file, or any directory it's in, is hidden or holds macOS metadata
+func hiddenFile(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") || part == "__MACOSX" {
+			return true
+		}
+	}
+	return false
+}
+
+// withinDir returns whether the file is in the directory once any links in its path are followed
+func withinDir(dir, file string) bool {
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return false
+	}
+	file, err = filepath.EvalSymlinks(file)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, file)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// dirEntries returns the files in the directory and the directories below it, sorted by their paths.  Links are
+// skipped, so no file outside of the directory is imported
+func dirEntries(dir string) ([]batchEntry, error) {
+	var entries []batchEntry
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			return nil
+		}
+		if hiddenFile(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		entries = append(entries, batchEntry{
+			path: rel,
+			size: info.Size(),
+			open: func() (io.ReadCloser, error) { return os.Open(file) },
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortBatchEntries(entries)
+	return entries, nil
+}
+
+// zipEntries returns the files in the zip file, sorted by their paths.  Files whose paths are outside of the zip
+// file are left out
+func zipEntries(z *officeZip) []batchEntry {
+	var entries []batchEntry
+	for name, f := range z.files {
+		f := f
+		clean, err := importPath(name)
+		if err != nil || f.FileInfo().IsDir() || hiddenFile(clean) {
+			continue
+		}
+		entries = append(entries, batchEntry{path: clean, size: int64(f.UncompressedSize64), open: f.Open})
+	}
+	sortBatchEntries(entries)
+	return entries
+}
+
+func sortBatchEntries(entries []batchEntry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].path < entries[j].path })
+}
+
+// copyBatchFile copies the file into the blob store, and detects its format
+func copyBatchFile(e batchEntry) (*importBatchFile, error) {
+	f := &importBatchFile{path: e.path, status: ImportBatchFileStatusPending}
+	r, err := e.open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	head = head[:n]
+
+	blob, err := data.BlobWrite(io.LimitReader(io.MultiReader(bytes.NewReader(head), r), maxImportFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if blob.Size > maxImportFileSize {
+		err = data.BlobRelease(nil, blob.ID)
+		if err != nil {
+			return nil, err
+		}
+		f.status = ImportBatchFileStatusFailed
+		f.message = fmt.Sprintf("%s is too large to import", f.path)
+		return f, nil
+	}
+	f.blob = blob.ID
+
+	importer, ok := DetectImporter(f.path, "", head)
+	if !ok {
+		f.status = ImportBatchFileStatusSkipped
+		f.message = "Files of this type can't be imported as documents, but can be attached to the documents " +
+			"that link to them"
+		return f, nil
+	}
+	f.format = importer.Name()
+	return f, nil
+}
+
+// ImportBatchGet retrieves a batch import started by the user, or any batch import if the user is an admin
+func ImportBatchGet(who *User, id string) (*ImportBatch, error) {
+	if who == nil {
+		return nil, Unauthorized("You must log in")
+	}
+	b, err := scanImportBatch(sqlImportBatchGet.Tenant(who.TenantID).QueryRow(sql.Named("id", id)))
+	if err != nil {
+		return nil, err
+	}
+	if b.Creator != who.ID && !who.Admin {
+		return nil, NotFound("Import not found")
+	}
+	b.who = who
+	return b, nil
+}
+
+func scanImportBatch(row scanner) (*ImportBatch, error) {
+	b := &ImportBatch{}
+	var collectionID, message, sourcePath, sourceBlob sql.NullString
+	err := row.Scan(&b.ID, &b.TenantID, &b.Name, &collectionID, &b.Status, &message, &b.Creator, &b.Created,
+		&b.Updated, &sourcePath, &sourceBlob)
+	if err == sql.ErrNoRows {
+		return nil, NotFound("Import not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	b.CollectionID = collectionID.String
+	b.Message = message.String
+	b.sourcePath = sourcePath.String
+	b.sourceBlob = sourceBlob.String
+	return b, nil
+}
+
+// Files returns the files in the batch in the order they're imported, with the outcome of each
+func (b *ImportBatch) Files(offset, limit int) ([]*ImportBatchFile, error) {
+	if limit == 0 || limit > maxRows {
+		limit = 10
+	}
+	rows, err := sqlImportBatchFileList.Tenant(b.TenantID).Query(
+		sql.Named("batch_id", b.ID),
+		sql.Named("offset", offset),
+		sql.Named("limit", limit),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []*ImportBatchFile
+	for rows.Next() {
+		f := &ImportBatchFile{}
+		var format, documentID, warnings, message sql.NullString
+		err = rows.Scan(&f.Path, &format, &f.Status, &documentID, &warnings, &message, &f.Updated)
+		if err != nil {
+			return nil, err
+		}
+		if f.Status == importBatchFileStatusCopying {
+			f.Status = ImportBatchFileStatusPending
+		}
+		f.Format = format.String
+		f.DocumentID = documentID.String
+		if warnings.String != "" {
+			f.Warnings = strings.Split(warnings.String, "\n")
+		}
+		f.Message = message.String
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// Report returns the number of files in the batch with each outcome
+func (b *ImportBatch) Report() (*ImportBatchReport, error) {
+	rows, err := sqlImportBatchFileCount.Tenant(b.TenantID).Query(sql.Named("batch_id", b.ID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	r := &ImportBatchReport{}
+	for rows.Next() {
+		var status string
+		count := 0
+		err = rows.Scan(&status, &count)
+		if err != nil {
+			return nil, err
+		}
+		r.Files += count
+		switch status {
+		case ImportBatchFileStatusPending, importBatchFileStatusCopying:
+			r.Pending += count
+		case ImportBatchFileStatusImported:
+			r.Imported = count
+		case ImportBatchFileStatusWarned:
+			r.Warned = count
+		case ImportBatchFileStatusFailed:
+			r.Failed = count
+		case ImportBatchFileStatusSkipped:
+			r.Skipped = count
+		}
+	}
+	return r, rows.Err()
+}
+
+// Cancel stops a running batch import.  The documents already imported are kept
+func (b *ImportBatch) Cancel() error {
+	if b.Status != ImportBatchStatusRunning {
+		return NewFailure("Only running imports can be canceled")
+	}
+	return b.finish(ImportBatchStatusCanceled, "")
+}
+
+// finish sets the status of a batch that's no longer running, and releases the copies of its files and its source
+func (b *ImportBatch) finish(status, message string) error {
+	rows, err := sqlImportBatchFileBlobs.Tenant(b.TenantID).Query(sql.Named("batch_id", b.ID))
+	if err != nil {
+		return err
+	}
+	var blobs []string
+	for rows.Next() {
+		var blob string
+		err = rows.Scan(&blob)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		blobs = append(blobs, blob)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if b.sourceBlob != "" {
+		blobs = append(blobs, b.sourceBlob)
+	}
+
+	updated := time.Now()
+	err = data.BeginTx(func(tx *sql.Tx) error {
+		_, err := sqlImportBatchUpdate.Tx(tx).Tenant(b.TenantID).Exec(
+			sql.Named("id", b.ID),
+			sql.Named("status", status),
+			sql.Named("message", nullString(message)),
+			sql.Named("updated", updated),
+		)
+		if err != nil {
+			return err
+		}
+		_, err = sqlImportBatchFileRelease.Tx(tx).Tenant(b.TenantID).Exec(sql.Named("batch_id", b.ID))
+		if err != nil {
+			return err
+		}
+		for _, blob := range blobs {
+			err = data.BlobRelease(tx, blob)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	b.Status = status
+	b.Message = message
+	b.Updated = updated
+	b.sourceBlob = ""
+	return nil
+}
+
+// ImportBatchPending imports the next files of every running batch import.  It returns the number of files
+// processed, and is meant to be run regularly in the background
+func ImportBatchPending() (int, error) {
+	count := 0
+	err := EachTenant(func(t *Tenant) error {
+		batches, err := runningImportBatches(t)
+		if err != nil {
+			return err
+		}
+		for _, b := range batches {
+			n, err := b.run()
+			count += n
+			if err != nil {
+				// one failing batch shouldn't hold up the rest
+				LogError(fmt.Errorf("Error running import batch %s in tenant %s: %s", b.ID, t.ID, err))
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+func runningImportBatches(t *Tenant) ([]*ImportBatch, error) {
+	rows, err := sqlImportBatchRunning.Tenant(t.ID).Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batches []*ImportBatch
+	for rows.Next() {
+		b, err := scanImportBatch(rows)
+		if err != nil {
+			return nil, err
+		}
+		batches = append(batches, b)
+	}
+	return batches, rows.Err()
+}
+
+// batchRun imports the next files of a batch
+type batchRun struct {
+	b          *ImportBatch
+	collection *Collection
+	folders    map[string]*Collection // by the path of the folder
+}
+
+// run imports the next pending files of the batch, and finishes it once there are none left.  A batch that can't
+// continue, because its creator can no longer create documents, fails
+func (b *ImportBatch) run() (int, error) {
+	if b.who == nil {
+		who, _, err := userGet(nil, b.TenantID, b.Creator)
+		if IsFailType(err, FailNotFound) {
+			return 0, b.finish(ImportBatchStatusFailed, "The user who started the import no longer exists")
+		}
+		if err != nil {
+			return 0, err
+		}
+		b.who = who
+	}
+
+	r := &batchRun{b: b, folders: make(map[string]*Collection)}
+	if b.CollectionID != "" {
+		collection, err := CollectionGet(b.who, b.CollectionID)
+		if IsFail(err) {
+			return 0, b.finish(ImportBatchStatusFailed, err.Error())
+		}
+		if err != nil {
+			return 0, err
+		}
+		r.collection = collection
+	}
+	if _, err := canCreateDocument(b.who, r.collection); IsFail(err) {
+		return 0, b.finish(ImportBatchStatusFailed, err.Error())
+	}
+
+	// every file is copied before any are imported, so the documents can attach the files they link to
+	copied, err := b.copyFiles()
+	if err != nil || copied > 0 || b.Status != ImportBatchStatusRunning {
+		return 0, err
+	}
+
+	pending, err := b.nextFiles()
+	if err != nil {
+		return 0, err
+	}
+	if len(pending) == 0 {
+		return 0, b.finish(ImportBatchStatusDone, "")
+	}
+	for _, f := range pending {
+		err = r.importFile(f)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(pending), nil
+}
+
+// copyFiles copies the next files of the batch from its source into the blob store, and returns the number copied.
+// Once every file is copied the batch's source is released, and if the source is gone the batch fails
+func (b *ImportBatch) copyFiles() (int, error) {
+	rows, err := sqlImportBatchFileCopyNext.Tenant(b.TenantID).Query(
+		sql.Named("batch_id", b.ID),
+		sql.Named("limit", importBatchSize),
+	)
+	if err != nil {
+		return 0, err
+	}
+	var files []*importBatchFile
+	for rows.Next() {
+		f := &importBatchFile{}
+		err = rows.Scan(&f.path, &f.sequence)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		files = append(files, f)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(files) == 0 {
+		return 0, b.releaseSource()
+	}
+
+	entries, closeSource, err := b.openSource()
+	if IsFail(err) {
+		return 0, b.finish(ImportBatchStatusFailed, err.Error())
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer closeSource()
+
+	for _, f := range files {
+		var copied *importBatchFile
+		if e, ok := entries(f.path); ok {
+			copied, err = copyBatchFile(e)
+			if err != nil && !os.IsNotExist(err) {
+				return 0, err
+			}
+		}
+		if copied == nil {
+			copied = &importBatchFile{path: f.path, status: ImportBatchFileStatusFailed,
+				message: fmt.Sprintf("%s is no longer there to import", f.path)}
+		}
+		_, err = sqlImportBatchFileCopied.Tenant(b.TenantID).Exec(
+			sql.Named("batch_id", b.ID),
+			sql.Named("path_key", pathKey(f.path)),
+			sql.Named("format", nullString(copied.format)),
+			sql.Named("blob_id", nullString(copied.blob)),
+			sql.Named("status", copied.status),
+			sql.Named("message", nullString(copied.message)),
+			sql.Named("updated", time.Now()),
+		)
+		if err != nil {
+			if copied.blob != "" {
+				if rErr := data.BlobRelease(nil, copied.blob); rErr != nil {
+					LogError(rErr)
+				}
+			}
+			return 0, err
+		}
+	}
+	return len(files), nil
+}
+
+// openSource opens the directory or zip file the batch's files are copied from, and returns a function that finds
+// its files by their paths, and a function that closes the source once the files are copied
+func (b *ImportBatch) openSource() (func(string) (batchEntry, bool), func(), error) {
+	if b.sourcePath != "" && isDir(b.sourcePath) {
+		dir := b.sourcePath
+		return func(name string) (batchEntry, bool) {
+			file := filepath.Join(dir, filepath.FromSlash(name))
+			// files are only copied if they're still regular files, and not links to files outside the directory
+			info, err := os.Lstat(file)
+			if err != nil || !info.Mode().IsRegular() || !withinDir(dir, file) {
+				return batchEntry{}, false
+			}
+			return batchEntry{path: name, size: info.Size(), open: func() (io.ReadCloser, error) {
+				return os.Open(file)
+			}}, true
+		}, func() {}, nil
+	}
+
+	var z *officeZip
+	var err error
+	if b.sourcePath != "" {
+		z, err = newImportDoc(ImportDir(filepath.Dir(b.sourcePath)), filepath.Base(b.sourcePath)).openArchive()
+	} else {
+		z, err = newImportDoc(batchSourceBlob(b.sourceBlob), b.Name).openArchive()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	entries := make(map[string]batchEntry)
+	for _, e := range zipEntries(z) {
+		entries[e.path] = e
+	}
+	return func(name string) (batchEntry, bool) {
+			e, ok := entries[name]
+			return e, ok
+		}, func() {
+			if err := z.Close(); err != nil {
+				LogError(err)
+			}
+		}, nil
+}
+
+// releaseSource releases the copy of the zip file the batch's files were copied from, once they're all copied
+func (b *ImportBatch) releaseSource() error {
+	if b.sourceBlob == "" {
+		return nil
+	}
+	err := data.BeginTx(func(tx *sql.Tx) error {
+		_, err := sqlImportBatchSourceRelease.Tx(tx).Tenant(b.TenantID).Exec(sql.Named("id", b.ID))
+		if err != nil {
+			return err
+		}
+		return data.BlobRelease(tx, b.sourceBlob)
+	})
+	if err != nil {
+		return err
+	}
+	b.sourceBlob = ""
+	return nil
+}
+
+// batchSourceBlob is an import source of the zip file a batch was started with, kept in the blob store until the
+// batch's files are copied
+type batchSourceBlob string
+
+func (s batchSourceBlob) Open(name string) (io.ReadCloser, error) {
+	r, err := data.BlobRead(string(s))
+	if err == data.ErrBlobNotFound {
+		return nil, os.ErrNotExist
+	}
+	return r, err
+}
+
+// nextFiles returns the first pending files, in the order they're imported
+func (b *ImportBatch) nextFiles() ([]*importBatchFile, error) {
+	rows, err := sqlImportBatchFileNext.Tenant(b.TenantID).Query(
+		sql.Named("batch_id", b.ID),
+		sql.Named("limit", importBatchSize),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []*importBatchFile
+	for rows.Next() {
+		f := &importBatchFile{}
+		var format, blob, message sql.NullString
+		err = rows.Scan(&f.path, &f.sequence, &format, &blob, &f.status, &message)
+		if err != nil {
+			return nil, err
+		}
+		f.format = format.String
+		f.blob = blob.String
+		f.message = message.String
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// importFile imports the file into the collection of its folder with the importer of its format
+func (r *batchRun) importFile(f *importBatchFile) error {
+	var importer Importer
+	for _, i := range importers {
+		if i.Name() == f.format {
+			importer = i
+			break
+		}
+	}
+	if importer == nil {
+		return r.b.updateFile(f, ImportBatchFileStatusFailed, nil,
+			fmt.Sprintf("There is no longer an importer for %s files", f.format))
+	}
+
+	collection, err := r.folder(path.Dir(f.path))
+	if IsFail(err) {
+		return r.b.updateFile(f, ImportBatchFileStatusFailed, nil,
+			fmt.Sprintf("The collection for %s could not be created: %s", path.Dir(f.path), err))
+	}
+	if err != nil {
+		return err
+	}
+
+	result, err := importAs(importer, r.b.who, collection, &batchSource{b: r.b}, f.path)
+	if IsFail(err) {
+		return r.b.updateFile(f, ImportBatchFileStatusFailed, nil, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	status := ImportBatchFileStatusImported
+	if len(result.Warnings) > 0 {
+		status = ImportBatchFileStatusWarned
+	}
+	return r.b.updateFile(f, status, result, "")
+}
+
+// folder returns the collection for the folder, creating it, and the collections of the folders it's in, if they
+// don't exist yet.  Files that aren't in a folder are imported into the batch's collection
+func (r *batchRun) folder(dir string) (*Collection, error) {
+	if dir == "." {
+		return r.collection, nil
+	}
+	if collection, ok := r.folders[dir]; ok {
+		return collection, nil
+	}
+
+	var id string
+	err := sqlImportBatchFolderGet.Tenant(r.b.TenantID).QueryRow(
+		sql.Named("batch_id", r.b.ID),
+		sql.Named("path_key", pathKey(dir)),
+	).Scan(&id)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == nil {
+		collection, err := CollectionGet(r.b.who, id)
+		if err == nil {
+			r.folders[dir] = collection
+			return collection, nil
+		}
+		if !IsFailType(err, FailNotFound) {
+			return nil, err
+		}
+		// the collection was deleted while the batch was running, so it's created again
+		_, err = sqlImportBatchFolderDelete.Tenant(r.b.TenantID).Exec(
+			sql.Named("batch_id", r.b.ID),
+			sql.Named("path_key", pathKey(dir)),
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	parent, err := r.folder(path.Dir(dir))
+	if err != nil {
+		return nil, err
+	}
+	name := truncate(path.Base(dir), maxCollectionNameLength)
+	var collection *Collection
+	if parent != nil {
+		collection, err = parent.NewChild(name)
+	} else {
+		collection, err = CollectionNew(r.b.who, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = sqlImportBatchFolderInsert.Tenant(r.b.TenantID).Exec(
+		sql.Named("batch_id", r.b.ID),
+		sql.Named("path_key", pathKey(dir)),
+		sql.Named("path", dir),
+		sql.Named("collection_id", collection.ID),
+	)
+	if err != nil {
+		return nil, err
+	}
+	r.folders[dir] = collection
+	return collection, nil
+}
+
+// updateFile records the outcome of importing the file
+func (b *ImportBatch) updateFile(f *importBatchFile, status string, result *ImportResult, message string) error {
+	documentID := ""
+	warnings := ""
+	if result != nil {
+		documentID = result.Document.ID
+		warnings = strings.Join(result.Warnings, "\n")
+	}
+	_, err := sqlImportBatchFileUpdate.Tenant(b.TenantID).Exec(
+		sql.Named("batch_id", b.ID),
+		sql.Named("path_key", pathKey(f.path)),
+		sql.Named("status", status),
+		sql.Named("document_id", nullString(documentID)),
+		sql.Named("warnings", nullString(warnings)),
+		sql.Named("message", nullString(message)),
+		sql.Named("updated", time.Now()),
+	)
+	return err
+}
+
+// batchSource is an import source of the files in a batch, as they were copied when it was started
+type batchSource struct {
+	b *ImportBatch
+}
+
+func (s *batchSource) Open(name string) (io.ReadCloser, error) {
+	var blob sql.NullString
+	err := sqlImportBatchFileBlob.Tenant(s.b.TenantID).QueryRow(
+		sql.Named("batch_id", s.b.ID),
+		sql.Named("path_key", pathKey(name)),
+	).Scan(&blob)
+	if err == sql.ErrNoRows || (err == nil && !blob.Valid) {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data.BlobRead(blob.String)
+}
@@ -0,0 +1,11 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+// SetMaxImportBatchSize sets the most bytes of files a batch can import, and returns the previous limit, so tests
+// don't have to build batches of more than a gigabyte
+func SetMaxImportBatchSize(size int64) int64 {
+	previous := maxImportBatchSize
+	maxImportBatchSize = size
+	return previous
+}
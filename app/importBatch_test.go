@@ -0,0 +1,431 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lexLibrary/lexLibrary/app"
+)
+
+func testZip(t *testing.T, files map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	for name, content := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatalf("Error adding %s to zip: %s", name, err)
+		}
+		_, err = f.Write([]byte(content))
+		if err != nil {
+			t.Fatalf("Error writing %s to zip: %s", name, err)
+		}
+	}
+	err := w.Close()
+	if err != nil {
+		t.Fatalf("Error writing zip: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func runImportBatch(t *testing.T, who *app.User, batch *app.ImportBatch) *app.ImportBatch {
+	// every run starts from what's in the database, as it would after a restart
+	for runs := 0; batch.Status == app.ImportBatchStatusRunning; runs++ {
+		if runs > 20 {
+			t.Fatalf("Import didn't finish")
+		}
+		_, err := app.ImportBatchPending()
+		if err != nil {
+			t.Fatalf("Error running imports: %s", err)
+		}
+		batch, err = app.ImportBatchGet(who, batch.ID)
+		if err != nil {
+			t.Fatalf("Error getting import: %s", err)
+		}
+	}
+	if batch.Status != app.ImportBatchStatusDone {
+		t.Fatalf("Import %s: %s", batch.Status, batch.Message)
+	}
+	return batch
+}
+
+func TestImportBatch(t *testing.T) {
+	resetDocuments(t)
+
+	tenant, err := app.TenantNew(installAdmin(t), "Import Batch Tenant", "", "")
+	if err != nil {
+		t.Fatalf("Error creating tenant: %s", err)
+	}
+	author := testUser(t, tenant, "author")
+	other := testUser(t, tenant, "other")
+	// only administrators of the default tenant can import from directories on the server
+	admin := installAdmin(t)
+
+	logo, err := ioutil.ReadFile("testdata/import/img/logo.png")
+	if err != nil {
+		t.Fatalf("Error reading logo: %s", err)
+	}
+	files := app.ImportFiles{
+		"batch.zip": testZip(t, map[string]string{
+			"docs/guide.md":            "# Guide\n\n![Logo](img/logo.png)\n",
+			"docs/img/logo.png":        string(logo),
+			"docs/howto/setup.rst":     "Setup\n=====\n\nRun it.\n",
+			"notes.md":                 "<!DOCTYPE html>\n<html><body><h1>Notes</h1></body></html>",
+			"readme.txt":               "Read me",
+			"broken.docx":              "not a zip file",
+			".hidden.md":               "# Hidden",
+			"__MACOSX/docs/._guide.md": "metadata",
+		}),
+		"empty.zip": testZip(t, map[string]string{".DS_Store": ""}),
+		"text.zip":  []byte("not a zip file"),
+	}
+
+	t.Run("New", func(t *testing.T) {
+		_, err := app.ImportBatchNew(nil, nil, files, "batch.zip")
+		if !app.IsFailType(err, app.FailUnauthorized) {
+			t.Fatalf("Expected unauthorized without a user, got %v", err)
+		}
+		_, err = app.ImportBatchNew(author, nil, files, "missing.zip")
+		if !app.IsFailType(err, app.FailNotFound) {
+			t.Fatalf("Expected not found importing a missing zip, got %v", err)
+		}
+		for _, name := range []string{"empty.zip", "text.zip", "../batch.zip"} {
+			_, err = app.ImportBatchNew(author, nil, files, name)
+			if !app.IsFailType(err, app.FailInvalid) {
+				t.Fatalf("Expected invalid failure importing %s, got %v", name, err)
+			}
+		}
+
+		previous := app.SetMaxImportBatchSize(10)
+		defer app.SetMaxImportBatchSize(previous)
+		_, err = app.ImportBatchNew(author, nil, files, "batch.zip")
+		if !app.IsFailType(err, app.FailInvalid) {
+			t.Fatalf("Expected invalid failure importing more than the batch size limit, got %v", err)
+		}
+	})
+
+	batch, err := app.ImportBatchNew(author, nil, files, "batch.zip")
+	if err != nil {
+		t.Fatalf("Error starting import: %s", err)
+	}
+	if batch.Name != "batch.zip" || batch.Status != app.ImportBatchStatusRunning {
+		t.Fatalf("Invalid import: %+v", batch)
+	}
+
+	t.Run("Not Copied", func(t *testing.T) {
+		// the files are copied in the background, not when the batch is started
+		report, err := batch.Report()
+		if err != nil {
+			t.Fatalf("Error getting report: %s", err)
+		}
+		if *report != (app.ImportBatchReport{Files: 6, Pending: 6}) {
+			t.Fatalf("Invalid report: %+v", report)
+		}
+		files, err := batch.Files(0, 100)
+		if err != nil {
+			t.Fatalf("Error getting files: %s", err)
+		}
+		for _, f := range files {
+			if f.Status != app.ImportBatchFileStatusPending || f.Format != "" {
+				t.Fatalf("Invalid file: %+v", f)
+			}
+		}
+	})
+
+	t.Run("Get", func(t *testing.T) {
+		_, err := app.ImportBatchGet(other, batch.ID)
+		if !app.IsFailType(err, app.FailNotFound) {
+			t.Fatalf("Expected not found getting another user's import, got %v", err)
+		}
+	})
+
+	batch = runImportBatch(t, author, batch)
+
+	report, err := batch.Report()
+	if err != nil {
+		t.Fatalf("Error getting report: %s", err)
+	}
+	if *report != (app.ImportBatchReport{Files: 6, Imported: 2, Warned: 1, Failed: 1, Skipped: 2}) {
+		t.Fatalf("Invalid report: %+v", report)
+	}
+
+	batchFiles, err := batch.Files(0, 100)
+	if err != nil {
+		t.Fatalf("Error getting files: %s", err)
+	}
+	docs := make(map[string]string)
+
+	t.Run("Files", func(t *testing.T) {
+		expected := []struct {
+			path   string
+			format string
+			status string
+		}{
+			{"broken.docx", "docx", app.ImportBatchFileStatusFailed},
+			{"docs/guide.md", "markdown", app.ImportBatchFileStatusImported},
+			{"docs/howto/setup.rst", "rst", app.ImportBatchFileStatusImported},
+			{"docs/img/logo.png", "", app.ImportBatchFileStatusSkipped},
+			{"notes.md", "html", app.ImportBatchFileStatusWarned},
+			{"readme.txt", "", app.ImportBatchFileStatusSkipped},
+		}
+		if len(batchFiles) != len(expected) {
+			t.Fatalf("Expected %d files, got %d: %+v", len(expected), len(batchFiles), batchFiles)
+		}
+		for i := range expected {
+			f := batchFiles[i]
+			if f.Path != expected[i].path || f.Format != expected[i].format || f.Status != expected[i].status {
+				t.Fatalf("Invalid file %d. Wanted %+v, got %+v", i, expected[i], f)
+			}
+			imported := f.Status == app.ImportBatchFileStatusImported || f.Status == app.ImportBatchFileStatusWarned
+			if (f.DocumentID != "") != imported {
+				t.Fatalf("Invalid document id for %s: %q", f.Path, f.DocumentID)
+			}
+			docs[f.Path] = f.DocumentID
+		}
+		if batchFiles[0].Message != "broken.docx is not a valid DOCX file" {
+			t.Fatalf("Invalid failure message: %q", batchFiles[0].Message)
+		}
+		if len(batchFiles[4].Warnings) != 1 || batchFiles[4].Warnings[0] != "notes.md was imported as html, "+
+			"because its content doesn't match its extension" {
+			t.Fatalf("Invalid warnings: %q", batchFiles[4].Warnings)
+		}
+		if batchFiles[3].Message == "" || batchFiles[5].Message == "" {
+			t.Fatalf("Skipped files have no message: %+v %+v", batchFiles[3], batchFiles[5])
+		}
+	})
+
+	t.Run("Collections", func(t *testing.T) {
+		guide, err := app.DocumentGet(author, docs["docs/guide.md"])
+		if err != nil {
+			t.Fatalf("Error getting document: %s", err)
+		}
+		setup, err := app.DocumentGet(author, docs["docs/howto/setup.rst"])
+		if err != nil {
+			t.Fatalf("Error getting document: %s", err)
+		}
+		notes, err := app.DocumentGet(author, docs["notes.md"])
+		if err != nil {
+			t.Fatalf("Error getting document: %s", err)
+		}
+		if notes.CollectionID != "" {
+			t.Fatalf("A file outside of any folder was imported into a collection")
+		}
+
+		docsCollection, err := app.CollectionGet(author, guide.CollectionID)
+		if err != nil {
+			t.Fatalf("Error getting collection: %s", err)
+		}
+		howto, err := app.CollectionGet(author, setup.CollectionID)
+		if err != nil {
+			t.Fatalf("Error getting collection: %s", err)
+		}
+		if docsCollection.Name != "docs" || docsCollection.ParentID != "" || howto.Name != "howto" ||
+			howto.ParentID != docsCollection.ID {
+			t.Fatalf("Invalid collections: %+v %+v", docsCollection, howto)
+		}
+
+		attachments, err := guide.Attachments()
+		if err != nil {
+			t.Fatalf("Error getting attachments: %s", err)
+		}
+		if len(attachments) != 1 || attachments[0].Name != "logo.png" {
+			t.Fatalf("Invalid attachments: %+v", attachments)
+		}
+	})
+
+	t.Run("Directory", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "lexImport")
+		if err != nil {
+			t.Fatalf("Error creating directory: %s", err)
+		}
+		defer os.RemoveAll(dir)
+		for name, content := range map[string]string{
+			"manuals/pump.md":   "# Pump\n",
+			"manuals/.git/HEAD": "ref: refs/heads/master",
+		} {
+			err = os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0700)
+			if err != nil {
+				t.Fatalf("Error creating directory: %s", err)
+			}
+			err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+			if err != nil {
+				t.Fatalf("Error writing %s: %s", name, err)
+			}
+		}
+
+		outside, err := ioutil.TempDir("", "lexImportOutside")
+		if err != nil {
+			t.Fatalf("Error creating directory: %s", err)
+		}
+		defer os.RemoveAll(outside)
+		err = ioutil.WriteFile(filepath.Join(outside, "secret.md"), []byte("# Secret\n"), 0600)
+		if err != nil {
+			t.Fatalf("Error writing file: %s", err)
+		}
+		err = os.Symlink(filepath.Join(outside, "secret.md"), filepath.Join(dir, "manuals", "secret.md"))
+		if err != nil {
+			t.Fatalf("Error linking file: %s", err)
+		}
+		err = os.Symlink(outside, filepath.Join(dir, "linked"))
+		if err != nil {
+			t.Fatalf("Error linking directory: %s", err)
+		}
+
+		_, err = app.ImportBatchNew(author, nil, app.ImportDir(dir), ".")
+		if !app.IsFailType(err, app.FailForbidden) {
+			t.Fatalf("Expected forbidden importing a directory as a user of another tenant, got %v", err)
+		}
+		_, err = app.ImportBatchNew(admin, nil, app.ImportDir(dir), "linked")
+		if !app.IsFailType(err, app.FailNotFound) {
+			t.Fatalf("Expected not found importing a link to a directory outside the source, got %v", err)
+		}
+
+		parent, err := app.CollectionNew(admin, "Imported")
+		if err != nil {
+			t.Fatalf("Error creating collection: %s", err)
+		}
+		b, err := app.ImportBatchNew(admin, parent, app.ImportDir(dir), ".")
+		if err != nil {
+			t.Fatalf("Error starting import: %s", err)
+		}
+		if b.Name != filepath.Base(dir) || b.CollectionID != parent.ID {
+			t.Fatalf("Invalid import: %+v", b)
+		}
+		b = runImportBatch(t, admin, b)
+
+		files, err := b.Files(0, 100)
+		if err != nil {
+			t.Fatalf("Error getting files: %s", err)
+		}
+		if len(files) != 1 || files[0].Path != "manuals/pump.md" || files[0].Status != app.ImportBatchFileStatusImported {
+			t.Fatalf("Invalid files: %+v", files)
+		}
+		doc, err := app.DocumentGet(admin, files[0].DocumentID)
+		if err != nil {
+			t.Fatalf("Error getting document: %s", err)
+		}
+		manuals, err := app.CollectionGet(admin, doc.CollectionID)
+		if err != nil {
+			t.Fatalf("Error getting collection: %s", err)
+		}
+		if manuals.Name != "manuals" || manuals.ParentID != parent.ID {
+			t.Fatalf("Invalid collection: %+v", manuals)
+		}
+	})
+
+	t.Run("Source Removed", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "lexImport")
+		if err != nil {
+			t.Fatalf("Error creating directory: %s", err)
+		}
+		defer os.RemoveAll(dir)
+		err = ioutil.WriteFile(filepath.Join(dir, "gone.md"), []byte("# Gone\n"), 0600)
+		if err != nil {
+			t.Fatalf("Error writing file: %s", err)
+		}
+
+		b, err := app.ImportBatchNew(admin, nil, app.ImportDir(dir), ".")
+		if err != nil {
+			t.Fatalf("Error starting import: %s", err)
+		}
+		err = os.RemoveAll(dir)
+		if err != nil {
+			t.Fatalf("Error removing directory: %s", err)
+		}
+		_, err = app.ImportBatchPending()
+		if err != nil {
+			t.Fatalf("Error running imports: %s", err)
+		}
+		b, err = app.ImportBatchGet(admin, b.ID)
+		if err != nil {
+			t.Fatalf("Error getting import: %s", err)
+		}
+		if b.Status != app.ImportBatchStatusFailed || b.Message == "" {
+			t.Fatalf("Import of a removed directory didn't fail: %+v", b)
+		}
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		err := batch.Cancel()
+		if !app.IsFailType(err, app.FailInvalid) {
+			t.Fatalf("Expected invalid failure canceling a finished import, got %v", err)
+		}
+
+		b, err := app.ImportBatchNew(author, nil, files, "batch.zip")
+		if err != nil {
+			t.Fatalf("Error starting import: %s", err)
+		}
+		err = b.Cancel()
+		if err != nil {
+			t.Fatalf("Error canceling import: %s", err)
+		}
+		count, err := app.ImportBatchPending()
+		if err != nil {
+			t.Fatalf("Error running imports: %s", err)
+		}
+		if count != 0 {
+			t.Fatalf("A canceled import imported %d files", count)
+		}
+	})
+}
+
+func TestDetectImporter(t *testing.T) {
+	docx, err := ioutil.ReadFile("testdata/import/guide.docx")
+	if err != nil {
+		t.Fatalf("Error reading docx: %s", err)
+	}
+	odt, err := ioutil.ReadFile("testdata/import/notes.odt")
+	if err != nil {
+		t.Fatalf("Error reading odt: %s", err)
+	}
+
+	tests := []struct {
+		name     string
+		mimeType string
+		head     []byte
+		format   string
+	}{
+		{"guide.md", "", []byte("# Guide"), "markdown"},
+		{"guide.MD", "", []byte("# Guide"), "markdown"},
+		{"guide.md", "", []byte("<div>Guide</div>"), "markdown"},
+		{"guide.md", "", []byte("\xef\xbb\xbf  <!DOCTYPE HTML>"), "html"},
+		{"guide.txt", "", []byte("<html>"), "html"},
+		{"report.txt", "", []byte("%PDF-1.4"), "pdf"},
+		{"report.bin", "", docx, "docx"},
+		{"notes.zip", "", odt, "odt"},
+		{"notes.docx", "", odt, "odt"},
+		{"upload", "text/x-rst; charset=utf-8", []byte("Guide"), "rst"},
+		{"upload.md", "application/octet-stream", []byte("Guide"), "markdown"},
+		{"guide.adoc", "", []byte("= Guide"), "asciidoc"},
+		{"analysis.ipynb", "", []byte("{"), "notebook"},
+		{"readme.txt", "", []byte("Read me"), ""},
+		{"archive.zip", "", []byte("PK\x03\x04"), ""},
+	}
+	for _, test := range tests {
+		importer, ok := app.DetectImporter(test.name, test.mimeType, test.head)
+		if !ok {
+			if test.format != "" {
+				t.Fatalf("No importer detected for %s, wanted %s", test.name, test.format)
+			}
+			continue
+		}
+		if importer.Name() != test.format {
+			t.Fatalf("Invalid importer for %s. Wanted %q got %q", test.name, test.format, importer.Name())
+		}
+	}
+
+	t.Run("Duplicate", func(t *testing.T) {
+		importer, _ := app.DetectImporter("guide.md", "", nil)
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("Registering an importer with the same name didn't panic")
+			}
+		}()
+		app.RegisterImporter(importer)
+	})
+}
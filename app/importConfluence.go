@@ -0,0 +1,722 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Confluence spaces are imported from an XML space export, a zip file holding every object in the space in
+	entities.xml, and the files attached to the pages under attachments/<page id>/<attachment id>/<version>.
+
+	entities.xml can be very large, so it's streamed twice.  The first pass reads everything except the bodies of the
+	pages: the spaces, pages, attachments, labels and users.  That's enough to lay out the page hierarchy and give
+	every page its new document's id, so links between pages can point at the documents they'll become.  The second
+	pass reads the bodies, and imports each page as its body is read.
+
+	Each space becomes a collection, and each page with child pages becomes a collection nested in its parent's,
+	holding the page and its children.  The children of the space's home page are in the space's collection along
+	with the home page.  Labels become tags, and the files attached to each page become the document's attachments.
+
+	Only the current version of each page is imported.  Historical versions, blog posts, comments, and pages in the
+	trash are left out.  HTML space exports aren't imported: they're rendered for reading, without the labels,
+	attachment metadata or macros of the pages, so the HTML importer is a better fit for them.
+
+	The body of a page is in Confluence's storage format, which is converted to HTML in confluenceStorage.go.
+*/
+
+// confluenceEntities is the file in a space export that holds the spaces, pages and everything else in them
+const confluenceEntities = "entities.xml"
+
+// ConfluenceImport is the outcome of importing a Confluence space export, or of a dry run that shows what the
+// import would create
+type ConfluenceImport struct {
+	File   string
+	DryRun bool
+	// Collections are the collections created for the spaces and pages with child pages, by their path of
+	// collection names from the outermost
+	Collections [][]string
+	Pages       []*ConfluencePage
+	// UnmappedMacros are the macros without an equivalent in a document, with the pages they're on
+	UnmappedMacros []*ConfluenceMacro
+}
+
+// ConfluencePage is a page from a Confluence space export, and the document it was imported as
+type ConfluencePage struct {
+	Title string
+	// Path is the path of collection names of the collection the page is in, from the outermost
+	Path        []string
+	Tags        []string
+	Attachments []string
+	// Warnings are the parts of the page that couldn't be imported as they were
+	Warnings []string
+	// Document is the imported page, which is nil on a dry run, or if the page couldn't be imported
+	Document *Document
+}
+
+// ConfluenceMacro is a macro that has no equivalent in a document
+type ConfluenceMacro struct {
+	Name  string
+	Pages []string
+}
+
+// confluenceObject is an object in entities.xml.  Properties that reference another object hold its id
+type confluenceObject struct {
+	Class      string `xml:"class,attr"`
+	ID         string `xml:"id"`
+	Properties []struct {
+		Name  string `xml:"name,attr"`
+		Value string `xml:",chardata"`
+		ID    string `xml:"id"`
+	} `xml:"property"`
+}
+
+// property returns the value of the property, or the id of the object it references
+func (o *confluenceObject) property(name string) string {
+	for _, p := range o.Properties {
+		if p.Name == name {
+			if p.ID != "" {
+				return strings.TrimSpace(p.ID)
+			}
+			return p.Value
+		}
+	}
+	return ""
+}
+
+// current is whether the object is the current version of its content, and not a historical version or in the
+// trash
+func (o *confluenceObject) current() bool {
+	status := o.property("contentStatus")
+	return o.property("originalVersion") == "" && (status == "" || status == "current")
+}
+
+// date returns the date in the property, or the zero time if it has none
+func (o *confluenceObject) date(name string) time.Time {
+	t, err := parseImportDate(o.property(name))
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+type confluenceSpace struct {
+	id    string
+	key   string
+	name  string
+	home  string
+	pages []*confluencePage // the pages at the top of the space's hierarchy
+}
+
+type confluencePage struct {
+	id       string
+	space    *confluenceSpace
+	parentID string
+	parent   *confluencePage
+	children []*confluencePage
+	title    string
+	position int
+	created  time.Time
+	updated  time.Time
+	modifier string // the user key of the last user to change the page
+
+	documentID  string
+	labels      []string
+	attachments []*confluenceAttachment
+	imported    bool
+	report      *ConfluencePage
+}
+
+type confluenceAttachment struct {
+	id      string
+	name    string
+	version string
+}
+
+// confluenceImport is the import of a space export
+type confluenceImport struct {
+	who        *User
+	collection *Collection
+	source     ImportSource
+	file       string
+	dryRun     bool
+	zip        *officeZip
+	authors    *importAuthors
+
+	spaces      map[string]*confluenceSpace
+	pages       map[string]*confluencePage
+	users       map[string]string // usernames by user key
+	collections map[string]*Collection
+	macros      map[string][]string
+	report      *ConfluenceImport
+}
+
+// ImportConfluence imports the spaces in a Confluence XML space export as collections of documents.  If a
+// collection is passed in, the collections for the spaces are nested in it.  A dry run reads and converts the whole
+// export, and reports what would be imported, but doesn't create anything.
+//
+// Pages that can't be imported are reported with warnings and without a document.  If the import fails part way
+// through, what was imported before the failure is reported with the error
+func ImportConfluence(who *User, collection *Collection, source ImportSource, name string,
+	dryRun bool) (*ConfluenceImport, error) {
+	_, err := canCreateDocument(who, collection)
+	if err != nil {
+		return nil, err
+	}
+	name, err = importPath(name)
+	if err != nil {
+		return nil, err
+	}
+	authors, err := newImportAuthors(who)
+	if err != nil {
+		return nil, err
+	}
+
+	z, err := newImportDoc(source, name).openArchive()
+	if err != nil {
+		return nil, err
+	}
+	defer z.Close()
+
+	c := &confluenceImport{
+		who:         who,
+		collection:  collection,
+		source:      source,
+		file:        name,
+		dryRun:      dryRun,
+		zip:         z,
+		authors:     authors,
+		spaces:      make(map[string]*confluenceSpace),
+		pages:       make(map[string]*confluencePage),
+		users:       make(map[string]string),
+		collections: make(map[string]*Collection),
+		macros:      make(map[string][]string),
+		report:      &ConfluenceImport{File: name, DryRun: dryRun},
+	}
+
+	err = c.read()
+	if err != nil {
+		return nil, err
+	}
+	err = c.layout()
+	if err != nil {
+		return c.report, err
+	}
+
+	err = c.objects(func(d *xml.Decoder, start *xml.StartElement, class string) error {
+		if class != "BodyContent" {
+			return d.Skip()
+		}
+		o := &confluenceObject{}
+		err := d.DecodeElement(o, start)
+		if err != nil {
+			return err
+		}
+		p, ok := c.pages[o.property("content")]
+		if !ok || p.imported {
+			return nil
+		}
+		return c.importPage(p, o.property("body"), o.property("bodyType"))
+	})
+	if err != nil {
+		return c.report, err
+	}
+
+	// pages without a body are imported empty
+	for _, p := range c.ordered() {
+		if !p.imported {
+			err = c.importPage(p, "", "")
+			if err != nil {
+				return c.report, err
+			}
+		}
+	}
+
+	names := make([]string, 0, len(c.macros))
+	for name := range c.macros {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c.report.UnmappedMacros = append(c.report.UnmappedMacros, &ConfluenceMacro{
+			Name:  name,
+			Pages: uniqueSorted(c.macros[name]),
+		})
+	}
+	return c.report, nil
+}
+
+// objects streams the objects in entities.xml to fn, which must read or skip each object
+func (c *confluenceImport) objects(fn func(d *xml.Decoder, start *xml.StartElement, class string) error) error {
+	r, err := c.zip.open(confluenceEntities)
+	if err == errNotInZip {
+		if _, ok := c.zip.files["index.html"]; ok {
+			return NewFailure(fmt.Sprintf("%s is a Confluence HTML export.  Only XML space exports can be imported",
+				c.file))
+		}
+		return NewFailure(fmt.Sprintf("%s is not a Confluence space export", c.file))
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	invalid := func(err error) error {
+		return NewFailure(fmt.Sprintf("%s in %s could not be read: %s", confluenceEntities, c.file, err))
+	}
+
+	d := xml.NewDecoder(r)
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return invalid(err)
+		}
+		start, ok := t.(xml.StartElement)
+		if !ok || start.Name.Local != "object" {
+			continue
+		}
+		class := ""
+		for _, a := range start.Attr {
+			if a.Name.Local == "class" {
+				class = a.Value
+			}
+		}
+		err = fn(d, &start, class)
+		if err != nil {
+			if _, ok := err.(*xml.SyntaxError); ok {
+				return invalid(err)
+			}
+			return err
+		}
+	}
+}
+
+// read reads everything but the bodies of the pages from entities.xml
+func (c *confluenceImport) read() error {
+	type labelling struct{ label, content string }
+	labels := make(map[string]string)
+	var labellings []labelling
+	var attachments []*confluenceObject
+
+	err := c.objects(func(d *xml.Decoder, start *xml.StartElement, class string) error {
+		switch class {
+		case "Space", "Page", "Attachment", "Label", "Labelling", "ConfluenceUserImpl":
+		default:
+			return d.Skip()
+		}
+		o := &confluenceObject{}
+		err := d.DecodeElement(o, start)
+		if err != nil {
+			return err
+		}
+		id := strings.TrimSpace(o.ID)
+
+		switch class {
+		case "Space":
+			c.spaces[id] = &confluenceSpace{
+				id:   id,
+				key:  o.property("key"),
+				name: strings.TrimSpace(o.property("name")),
+				home: o.property("homePage"),
+			}
+		case "Page":
+			if !o.current() {
+				return nil
+			}
+			position, _ := strconv.Atoi(strings.TrimSpace(o.property("position")))
+			c.pages[id] = &confluencePage{
+				id:         id,
+				space:      &confluenceSpace{id: o.property("space")},
+				parentID:   o.property("parent"),
+				title:      strings.TrimSpace(o.property("title")),
+				position:   position,
+				created:    o.date("creationDate"),
+				updated:    o.date("lastModificationDate"),
+				modifier:   o.property("lastModifier"),
+				documentID: newID(),
+			}
+		case "Attachment":
+			if o.current() {
+				attachments = append(attachments, o)
+			}
+		case "Label":
+			if o.property("namespace") != "my" {
+				// personal labels aren't shared, so they aren't tags
+				labels[id] = o.property("name")
+			}
+		case "Labelling":
+			content := o.property("content")
+			if content == "" {
+				content = o.property("owningContent")
+			}
+			labellings = append(labellings, labelling{label: o.property("label"), content: content})
+		case "ConfluenceUserImpl":
+			c.users[id] = o.property("name")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(c.pages) == 0 {
+		return NewFailure(fmt.Sprintf("%s has no pages to import", c.file))
+	}
+
+	for _, a := range attachments {
+		page := a.property("containerContent")
+		if page == "" {
+			page = a.property("content")
+		}
+		p, ok := c.pages[page]
+		if !ok {
+			continue
+		}
+		version := strings.TrimSpace(a.property("version"))
+		if version == "" {
+			version = "1"
+		}
+		p.attachments = append(p.attachments, &confluenceAttachment{
+			id:      strings.TrimSpace(a.ID),
+			name:    strings.TrimSpace(a.property("title")),
+			version: version,
+		})
+	}
+	for _, l := range labellings {
+		p, ok := c.pages[l.content]
+		name, labeled := labels[l.label]
+		if ok && labeled {
+			p.labels = append(p.labels, name)
+		}
+	}
+	return nil
+}
+
+// layout builds the page hierarchy of each space, and creates the collections for it, unless it's a dry run
+func (c *confluenceImport) layout() error {
+	for _, p := range c.pages {
+		space, ok := c.spaces[p.space.id]
+		if !ok {
+			space = &confluenceSpace{id: p.space.id, name: "Confluence"}
+			c.spaces[space.id] = space
+		}
+		p.space = space
+		if parent, ok := c.pages[p.parentID]; ok && parent != p {
+			p.parent = parent
+			parent.children = append(parent.children, p)
+		} else {
+			space.pages = append(space.pages, p)
+		}
+	}
+	for _, s := range c.spaces {
+		sortConfluencePages(s.pages)
+		for _, p := range s.pages {
+			p.sortChildren()
+		}
+	}
+
+	for _, p := range c.ordered() {
+		p.report = &ConfluencePage{
+			Title: p.title,
+			Path:  c.path(p),
+			Tags:  uniqueSorted(p.labels),
+		}
+		for _, a := range p.attachments {
+			p.report.Attachments = append(p.report.Attachments, a.name)
+		}
+		c.report.Pages = append(c.report.Pages, p.report)
+
+		for _, collection := range [][]string{c.parentPath(p), p.report.Path} {
+			if !containsPath(c.report.Collections, collection) {
+				c.report.Collections = append(c.report.Collections, collection)
+			}
+		}
+	}
+
+	if c.dryRun {
+		return nil
+	}
+	for _, p := range c.ordered() {
+		_, err := c.collectionFor(p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ordered returns every page in the order of the hierarchy of each space, spaces ordered by name
+func (c *confluenceImport) ordered() []*confluencePage {
+	spaces := make([]*confluenceSpace, 0, len(c.spaces))
+	for _, s := range c.spaces {
+		spaces = append(spaces, s)
+	}
+	sort.Slice(spaces, func(i, j int) bool {
+		if spaces[i].name != spaces[j].name {
+			return spaces[i].name < spaces[j].name
+		}
+		return spaces[i].id < spaces[j].id
+	})
+
+	var pages []*confluencePage
+	var walk func(p *confluencePage)
+	walk = func(p *confluencePage) {
+		pages = append(pages, p)
+		for _, child := range p.children {
+			walk(child)
+		}
+	}
+	for _, s := range spaces {
+		for _, p := range s.pages {
+			walk(p)
+		}
+	}
+	return pages
+}
+
+func sortConfluencePages(pages []*confluencePage) {
+	sort.SliceStable(pages, func(i, j int) bool {
+		if pages[i].position != pages[j].position {
+			return pages[i].position < pages[j].position
+		}
+		return pages[i].title < pages[j].title
+	})
+}
+
+func (p *confluencePage) sortChildren() {
+	sortConfluencePages(p.children)
+	for _, child := range p.children {
+		child.sortChildren()
+	}
+}
+
+// home is whether the page is the home page of its space
+func (p *confluencePage) home() bool {
+	return p.id == p.space.home
+}
+
+// hasCollection is whether the page has its own collection, holding it and its children
+func (p *confluencePage) hasCollection() bool {
+	return len(p.children) > 0 && !p.home()
+}
+
+// childPath returns the path of the collection the page's children are in
+func (c *confluenceImport) childPath(p *confluencePage) []string {
+	if p.home() {
+		return []string{p.space.name}
+	}
+	return append(c.parentPath(p), p.title)
+}
+
+// parentPath returns the path of the collection the page's parent keeps its children in
+func (c *confluenceImport) parentPath(p *confluencePage) []string {
+	if p.parent == nil {
+		return []string{p.space.name}
+	}
+	return c.childPath(p.parent)
+}
+
+// path returns the path of the collection the page is in
+func (c *confluenceImport) path(p *confluencePage) []string {
+	if p.hasCollection() {
+		return c.childPath(p)
+	}
+	return c.parentPath(p)
+}
+
+func samePath(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func containsPath(paths [][]string, find []string) bool {
+	for _, p := range paths {
+		if samePath(p, find) {
+			return true
+		}
+	}
+	return false
+}
+
+// collectionFor returns the collection the page is in, creating it and the collections it's nested in if they
+// don't exist yet
+func (c *confluenceImport) collectionFor(p *confluencePage) (*Collection, error) {
+	if p.hasCollection() {
+		return c.childCollection(p)
+	}
+	return c.parentCollection(p)
+}
+
+// childCollection returns the collection the page's children are in
+func (c *confluenceImport) childCollection(p *confluencePage) (*Collection, error) {
+	if p.home() {
+		return c.spaceCollection(p.space)
+	}
+	if collection, ok := c.collections[p.id]; ok {
+		return collection, nil
+	}
+	parent, err := c.parentCollection(p)
+	if err != nil {
+		return nil, err
+	}
+	collection, err := parent.NewChild(truncate(p.title, maxCollectionNameLength))
+	if err != nil {
+		return nil, err
+	}
+	c.collections[p.id] = collection
+	return collection, nil
+}
+
+// parentCollection returns the collection the page's parent keeps its children in
+func (c *confluenceImport) parentCollection(p *confluencePage) (*Collection, error) {
+	if p.parent == nil {
+		return c.spaceCollection(p.space)
+	}
+	return c.childCollection(p.parent)
+}
+
+// spaceCollection returns the collection for the space
+func (c *confluenceImport) spaceCollection(s *confluenceSpace) (*Collection, error) {
+	if collection, ok := c.collections[s.id]; ok {
+		return collection, nil
+	}
+	name := truncate(s.name, maxCollectionNameLength)
+	var collection *Collection
+	var err error
+	if c.collection != nil {
+		collection, err = c.collection.NewChild(name)
+	} else {
+		collection, err = CollectionNew(c.who, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.collections[s.id] = collection
+	return collection, nil
+}
+
+// pageByTitle returns the page in the space with the title, or nil if there isn't one
+func (c *confluenceImport) pageByTitle(spaceKey, title string, from *confluencePage) *confluencePage {
+	space := from.space
+	if spaceKey != "" && spaceKey != space.key {
+		space = nil
+		for _, s := range c.spaces {
+			if s.key == spaceKey {
+				space = s
+			}
+		}
+		if space == nil {
+			return nil
+		}
+	}
+	if title == "" {
+		return from
+	}
+	for _, p := range c.pages {
+		if p.space == space && p.title == title {
+			return p
+		}
+	}
+	return nil
+}
+
+// importPage converts the body of the page, and imports it as a document
+func (c *confluenceImport) importPage(p *confluencePage, body, bodyType string) error {
+	p.imported = true
+
+	i := newImportDoc(c.source, c.file)
+	i.id = p.documentID
+	i.title = p.title
+	i.created = p.created
+	i.updated = p.updated
+	i.tags = p.labels
+
+	author, err := c.authors.id(c.users[p.modifier])
+	if err != nil {
+		return err
+	}
+	i.author = author
+
+	if bodyType != "" && bodyType != "2" {
+		i.warn("The page %s is in the old wiki markup format, and was imported as plain text", p.title)
+		i.body = "<pre>" + escapeHTML(body) + "</pre>"
+	} else {
+		v := &confluenceConverter{c: c, page: p, i: i}
+		i.body = v.convert(body)
+	}
+
+	for _, a := range p.attachments {
+		c.attach(i, p, a)
+	}
+
+	if c.dryRun {
+		p.report.Warnings = i.warnings
+		return nil
+	}
+
+	collection, err := c.collectionFor(p)
+	if err != nil {
+		return err
+	}
+	result, err := i.create(c.who, collection)
+	if IsFail(err) {
+		p.report.Warnings = append(i.warnings, fmt.Sprintf("The page could not be imported: %s", err))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	p.report.Document = result.Document
+	p.report.Warnings = result.Warnings
+	return nil
+}
+
+// attach attaches the file attached to the page, and returns the link to the attachment.  On a dry run nothing is
+// attached, and the link is empty
+func (c *confluenceImport) attach(i *importDoc, p *confluencePage, a *confluenceAttachment) (string, bool) {
+	dir := path.Join("attachments", p.id, a.id)
+	name := path.Join(dir, a.version)
+	if _, ok := c.zip.files[name]; !ok {
+		// fall back to the latest version in the export
+		latest := -1
+		for file := range c.zip.files {
+			if path.Dir(file) != dir {
+				continue
+			}
+			if v, err := strconv.Atoi(path.Base(file)); err == nil && v > latest {
+				latest = v
+				name = file
+			}
+		}
+		if latest == -1 {
+			i.warn("The attachment %s is missing from the export, and was skipped", a.name)
+			return "", false
+		}
+	}
+	if c.dryRun {
+		return "", true
+	}
+	return i.embedAs(c.who, c.zip, name, a.name)
+}
+
+// unmapped records a macro without an equivalent in a document
+func (c *confluenceImport) unmapped(name string, p *confluencePage) {
+	c.macros[name] = append(c.macros[name], p.title)
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lexLibrary/lexLibrary/app"
+)
+
+func TestImportConfluence(t *testing.T) {
+	resetDocuments(t)
+
+	tenant, err := app.TenantNew(installAdmin(t), "Import Confluence Tenant", "", "")
+	if err != nil {
+		t.Fatalf("Error creating tenant: %s", err)
+	}
+	importer := testUser(t, tenant, "importer")
+	author := testUser(t, tenant, "author")
+	fixtures := app.ImportDir("testdata/import")
+
+	collections := [][]string{{"Operations"}, {"Operations", "Runbooks"}}
+	titles := []string{"Operations Home", "Runbooks", "Drain the pump", "Restart the pump", "Orphan"}
+
+	t.Run("Dry Run", func(t *testing.T) {
+		result, err := app.ImportConfluence(importer, nil, fixtures, "confluence.zip", true)
+		if err != nil {
+			t.Fatalf("Error importing confluence.zip: %s", err)
+		}
+		if !reflect.DeepEqual(result.Collections, collections) {
+			t.Fatalf("Invalid collections: %v", result.Collections)
+		}
+		if len(result.Pages) != len(titles) {
+			t.Fatalf("Expected %d pages, got %d", len(titles), len(result.Pages))
+		}
+		for i, p := range result.Pages {
+			if p.Title != titles[i] || p.Document != nil {
+				t.Fatalf("Invalid page %d: %+v", i, p)
+			}
+		}
+		restart := result.Pages[3]
+		if !reflect.DeepEqual(restart.Path, collections[1]) ||
+			!reflect.DeepEqual(restart.Tags, []string{"pumps", "runbook"}) ||
+			!reflect.DeepEqual(restart.Attachments, []string{"diagram.png"}) {
+			t.Fatalf("Invalid page: %+v", restart)
+		}
+		if len(result.UnmappedMacros) != 2 || result.UnmappedMacros[0].Name != "children" ||
+			result.UnmappedMacros[1].Name != "jira" ||
+			!reflect.DeepEqual(result.UnmappedMacros[1].Pages, []string{"Restart the pump"}) {
+			t.Fatalf("Invalid unmapped macros: %+v", result.UnmappedMacros)
+		}
+
+		all, err := app.CollectionList(importer)
+		if err != nil {
+			t.Fatalf("Error listing collections: %s", err)
+		}
+		if len(all) != 0 {
+			t.Fatalf("A dry run created %d collections", len(all))
+		}
+	})
+
+	result, err := app.ImportConfluence(importer, nil, fixtures, "confluence.zip", false)
+	if err != nil {
+		t.Fatalf("Error importing confluence.zip: %s", err)
+	}
+	pages := make(map[string]*app.ConfluencePage)
+	for _, p := range result.Pages {
+		if p.Document == nil {
+			t.Fatalf("Page %s wasn't imported: %v", p.Title, p.Warnings)
+		}
+		pages[p.Title] = p
+	}
+
+	t.Run("Collections", func(t *testing.T) {
+		all, err := app.CollectionList(importer)
+		if err != nil {
+			t.Fatalf("Error listing collections: %s", err)
+		}
+		if len(all) != 2 {
+			t.Fatalf("Expected 2 collections, got %d", len(all))
+		}
+		space := all[0]
+		if space.Name != "Operations" {
+			space = all[1]
+		}
+		children, err := space.Children()
+		if err != nil {
+			t.Fatalf("Error getting children: %s", err)
+		}
+		if space.ParentID != "" || len(children) != 1 || children[0].Name != "Runbooks" {
+			t.Fatalf("Invalid collection hierarchy: %+v %+v", space, children)
+		}
+
+		for title, collection := range map[string]*app.Collection{
+			"Operations Home":  space,
+			"Orphan":           space,
+			"Runbooks":         children[0],
+			"Restart the pump": children[0],
+			"Drain the pump":   children[0],
+		} {
+			if pages[title].Document.CollectionID != collection.ID {
+				t.Fatalf("%s is in the wrong collection", title)
+			}
+		}
+	})
+
+	t.Run("Page", func(t *testing.T) {
+		d := pages["Restart the pump"].Document
+		rev, err := d.Latest()
+		if err != nil {
+			t.Fatalf("Error getting revision: %s", err)
+		}
+		if rev.Author != author.ID || !d.Updated.Equal(time.Date(2017, 4, 2, 11, 22, 33, 0, time.UTC)) ||
+			!d.Created.Equal(time.Date(2017, 3, 1, 10, 20, 30, 0, time.UTC)) {
+			t.Fatalf("Invalid author or dates: %s %s %s", rev.Author, d.Created, d.Updated)
+		}
+
+		attachments, err := d.Attachments()
+		if err != nil {
+			t.Fatalf("Error getting attachments: %s", err)
+		}
+		if len(attachments) != 1 || attachments[0].Name != "diagram.png" {
+			t.Fatalf("Invalid attachments: %+v", attachments)
+		}
+		diagram := attachments[0].URL()
+
+		for _, want := range []string{
+			`See <a href="../` + pages["Runbooks"].Document.ID + `/">Runbooks</a> and Missing page.`,
+			`<pre><code class="language-bash">systemctl restart pump &amp;&amp; echo &lt;done&gt;</code></pre>`,
+			"<blockquote>\n<p><strong>Info</strong></p>\n<p>Takes a minute.</p>\n</blockquote>",
+			"<blockquote>\n<p><strong>Careful</strong></p>\n<p>Wear gloves\u00a0first.</p>\n</blockquote>",
+			`<code>{jira}</code>`,
+			`<img src="` + diagram + `" alt="diagram.png" width="200" /> <a href="` + diagram + `">the diagram</a> ✅`,
+			`<li><input type="checkbox" checked="" disabled="" /> Stop it</li>`,
+			`<li><input type="checkbox" disabled="" /> Start it</li>`,
+		} {
+			if !strings.Contains(rev.Body, want) {
+				t.Fatalf("Body is missing %s:\n%s", want, rev.Body)
+			}
+		}
+		if strings.Contains(rev.Body, "OPS-1") {
+			t.Fatalf("Body contains a macro parameter:\n%s", rev.Body)
+		}
+
+		tags, err := d.Tags()
+		if err != nil {
+			t.Fatalf("Error getting tags: %s", err)
+		}
+		if len(tags) != 2 || tags[0].Name != "pumps" || tags[1].Name != "runbook" {
+			t.Fatalf("Invalid tags: %+v", tags)
+		}
+
+		warnings := strings.Join(pages["Restart the pump"].Warnings, "\n")
+		for _, warning := range []string{"jira", "Missing page"} {
+			if !strings.Contains(warnings, warning) {
+				t.Fatalf("Expected a warning about %s, got %q", warning, warnings)
+			}
+		}
+	})
+
+	t.Run("Invalid Files", func(t *testing.T) {
+		files := app.ImportFiles{
+			"notzip.zip": []byte("not a zip"),
+		}
+		_, err := app.ImportConfluence(importer, nil, files, "notzip.zip", true)
+		if !app.IsFailType(err, app.FailInvalid) {
+			t.Fatalf("Expected invalid failure, got %v", err)
+		}
+
+		_, err = app.ImportConfluence(importer, nil, fixtures, "guide.docx", true)
+		if !app.IsFailType(err, app.FailInvalid) {
+			t.Fatalf("Expected invalid failure importing a docx file, got %v", err)
+		}
+
+		_, err = app.ImportConfluence(importer, nil, fixtures, "missing.zip", true)
+		if !app.IsFailType(err, app.FailNotFound) {
+			t.Fatalf("Expected not found, got %v", err)
+		}
+	})
+}
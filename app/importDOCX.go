@@ -0,0 +1,527 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"path"
+	"strconv"
+	"strings"
+)
+
+// XML namespaces of the parts of a DOCX file
+const (
+	nsDOCXMain          = "http://schemas.openxmlformats.org/wordprocessingml/2006/main"
+	nsDOCXRelationships = "http://schemas.openxmlformats.org/officeDocument/2006/relationships"
+	nsDOCXPackageRels   = "http://schemas.openxmlformats.org/package/2006/relationships"
+	nsDOCXDrawing       = "http://schemas.openxmlformats.org/drawingml/2006/main"
+	nsDOCXPicture       = "http://schemas.openxmlformats.org/drawingml/2006/wordprocessingDrawing"
+	nsDOCXVML           = "urn:schemas-microsoft-com:vml"
+	nsDOCXCore          = "http://schemas.openxmlformats.org/package/2006/metadata/core-properties"
+	nsDublinCore        = "http://purl.org/dc/elements/1.1/"
+	nsDublinCoreTerms   = "http://purl.org/dc/terms/"
+)
+
+// docxRelationship is a link from a part of a DOCX file to another part, or to an external URL
+type docxRelationship struct {
+	kind     string
+	target   string
+	external bool
+}
+
+// docxStyle is a paragraph or character style in a DOCX file
+type docxStyle struct {
+	name     string
+	basedOn  string
+	outline  int // outline level starting at 1, or 0 if the style isn't in the outline
+	numID    string
+	numLevel int
+	format   officeFormat
+}
+
+// docxReader converts the main document of a DOCX file to HTML
+type docxReader struct {
+	i         *importDoc
+	who       *User
+	zip       *officeZip
+	dir       string // the directory of the main document in the zip
+	rels      map[string]docxRelationship
+	styles    map[string]*docxStyle
+	numbering map[string]map[int]bool // whether each level of each numbering is ordered
+	warned    map[string]bool
+}
+
+// ImportDOCX imports a Word document from the source as a new document, in the collection if it isn't nil
+func ImportDOCX(who *User, collection *Collection, source ImportSource, name string) (*ImportResult, error) {
+	_, err := canCreateDocument(who, collection)
+	if err != nil {
+		return nil, err
+	}
+	name, err = importPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	i := newImportDoc(source, name)
+	file, err := i.readBytes()
+	if err != nil {
+		return nil, err
+	}
+	z, err := i.openZip(file)
+	if err != nil {
+		return nil, err
+	}
+
+	err = i.docx(who, z)
+	if err != nil {
+		i.release()
+		return nil, err
+	}
+	return i.create(who, collection)
+}
+
+// docx sets the fields and body of the document from a DOCX file
+func (i *importDoc) docx(who *User, z *officeZip) error {
+	main, err := docxMainDocument(z)
+	if err != nil {
+		return err
+	}
+	doc, err := z.xml(main)
+	if err != nil {
+		return err
+	}
+	body := doc.path(nsDOCXMain, "document", "body")
+	if body == nil {
+		return NewFailure(i.file + " is not a valid DOCX file")
+	}
+
+	r := &docxReader{
+		i:      i,
+		who:    who,
+		zip:    z,
+		dir:    path.Dir(main),
+		warned: make(map[string]bool),
+	}
+	r.rels, err = docxRelationships(z, path.Join(r.dir, "_rels", path.Base(main)+".rels"))
+	if err != nil {
+		return err
+	}
+	err = r.readStyles()
+	if err != nil {
+		return err
+	}
+	err = r.readNumbering()
+	if err != nil {
+		return err
+	}
+	err = i.docxProperties(z)
+	if err != nil {
+		return err
+	}
+
+	w := &officeWriter{}
+	r.blocks(body, w)
+	i.body = w.html()
+	if i.title == "" {
+		i.title = firstHeading(i.body)
+	}
+	return nil
+}
+
+// docxMainDocument returns the path of the main document in the zip
+func docxMainDocument(z *officeZip) (string, error) {
+	rels, err := docxRelationships(z, "_rels/.rels")
+	if err != nil {
+		return "", err
+	}
+	for _, rel := range rels {
+		if strings.HasSuffix(rel.kind, "/officeDocument") && !rel.external {
+			return strings.TrimPrefix(rel.target, "/"), nil
+		}
+	}
+	return "word/document.xml", nil
+}
+
+// docxRelationships reads the relationships of a part of the file, by their id
+func docxRelationships(z *officeZip, name string) (map[string]docxRelationship, error) {
+	rels := make(map[string]docxRelationship)
+	doc, err := z.xml(name)
+	if err != nil || doc == nil {
+		return rels, err
+	}
+	for _, rel := range doc.child(nsDOCXPackageRels, "Relationships").Children {
+		if !rel.is(nsDOCXPackageRels, "Relationship") {
+			continue
+		}
+		rels[rel.attr("", "Id")] = docxRelationship{
+			kind:     rel.attr("", "Type"),
+			target:   rel.attr("", "Target"),
+			external: rel.attr("", "TargetMode") == "External",
+		}
+	}
+	return rels, nil
+}
+
+func (r *docxReader) readStyles() error {
+	r.styles = make(map[string]*docxStyle)
+	doc, err := r.zip.xml(path.Join(r.dir, "styles.xml"))
+	if err != nil || doc == nil {
+		return err
+	}
+	for _, s := range doc.child(nsDOCXMain, "styles").Children {
+		if !s.is(nsDOCXMain, "style") {
+			continue
+		}
+		style := &docxStyle{
+			name:    s.child(nsDOCXMain, "name").attr(nsDOCXMain, "val"),
+			basedOn: s.child(nsDOCXMain, "basedOn").attr(nsDOCXMain, "val"),
+			format:  r.format(s.child(nsDOCXMain, "rPr"), officeFormat{}),
+		}
+		pPr := s.child(nsDOCXMain, "pPr")
+		if outline := pPr.child(nsDOCXMain, "outlineLvl"); outline != nil {
+			level, err := strconv.Atoi(outline.attr(nsDOCXMain, "val"))
+			if err == nil && level < 9 {
+				style.outline = level + 1
+			}
+		}
+		if numPr := pPr.child(nsDOCXMain, "numPr"); numPr != nil {
+			style.numID = numPr.child(nsDOCXMain, "numId").attr(nsDOCXMain, "val")
+			style.numLevel, _ = strconv.Atoi(numPr.child(nsDOCXMain, "ilvl").attr(nsDOCXMain, "val"))
+		}
+		r.styles[s.attr(nsDOCXMain, "styleId")] = style
+	}
+	return nil
+}
+
+func (r *docxReader) readNumbering() error {
+	r.numbering = make(map[string]map[int]bool)
+	doc, err := r.zip.xml(path.Join(r.dir, "numbering.xml"))
+	if err != nil || doc == nil {
+		return err
+	}
+	numbering := doc.child(nsDOCXMain, "numbering")
+
+	abstract := make(map[string]map[int]bool)
+	for _, a := range numbering.Children {
+		if !a.is(nsDOCXMain, "abstractNum") {
+			continue
+		}
+		levels := make(map[int]bool)
+		for _, lvl := range a.Children {
+			if !lvl.is(nsDOCXMain, "lvl") {
+				continue
+			}
+			level, err := strconv.Atoi(lvl.attr(nsDOCXMain, "ilvl"))
+			if err != nil {
+				continue
+			}
+			format := lvl.child(nsDOCXMain, "numFmt").attr(nsDOCXMain, "val")
+			levels[level] = format != "" && format != "bullet" && format != "none"
+		}
+		abstract[a.attr(nsDOCXMain, "abstractNumId")] = levels
+	}
+	for _, num := range numbering.Children {
+		if num.is(nsDOCXMain, "num") {
+			r.numbering[num.attr(nsDOCXMain, "numId")] =
+				abstract[num.child(nsDOCXMain, "abstractNumId").attr(nsDOCXMain, "val")]
+		}
+	}
+	return nil
+}
+
+// docxProperties reads the title, description, keywords and dates from the document's core properties
+func (i *importDoc) docxProperties(z *officeZip) error {
+	doc, err := z.xml("docProps/core.xml")
+	if err != nil || doc == nil {
+		return err
+	}
+	props := doc.child(nsDOCXCore, "coreProperties")
+	i.title = strings.TrimSpace(props.child(nsDublinCore, "title").text())
+	i.summary = strings.Join(strings.Fields(props.child(nsDublinCore, "description").text()), " ")
+	i.tags = append(i.tags, splitKeywords(props.child(nsDOCXCore, "keywords").text())...)
+	i.officeDate("created", props.child(nsDublinCoreTerms, "created").text(), &i.created)
+	i.officeDate("modified", props.child(nsDublinCoreTerms, "modified").text(), &i.updated)
+	return nil
+}
+
+func (r *docxReader) warnOnce(format string, args ...interface{}) {
+	if r.warned[format] {
+		return
+	}
+	r.warned[format] = true
+	r.i.warn(format, args...)
+}
+
+// blocks writes the paragraphs and tables in the body, table cell, or content control
+func (r *docxReader) blocks(n *xmlNode, w *officeWriter) {
+	for _, c := range n.Children {
+		switch {
+		case c.is(nsDOCXMain, "p"):
+			r.paragraph(c, w)
+		case c.is(nsDOCXMain, "tbl"):
+			r.table(c, w)
+		case c.is(nsDOCXMain, "sdt"):
+			r.blocks(c.child(nsDOCXMain, "sdtContent"), w)
+		case c.is(nsDOCXMain, "customXml"), c.is(nsDOCXMain, "ins"):
+			r.blocks(c, w)
+		}
+	}
+}
+
+// paragraphStyle returns the element and list numbering of a paragraph from its style, following the styles it's
+// based on
+func (r *docxReader) paragraphStyle(id string) (element string, title bool, numID string, numLevel int) {
+	outline := 0
+	for depth := 0; id != "" && depth < 10; depth++ {
+		style, ok := r.styles[id]
+		if !ok {
+			// documents without a styles part still use the built in style ids, like Heading1
+			element, title = styleStructure(id)
+			break
+		}
+		if element == "" {
+			element, title = styleStructure(style.name)
+		}
+		if outline == 0 {
+			outline = style.outline
+		}
+		if numID == "" {
+			numID, numLevel = style.numID, style.numLevel
+		}
+		id = style.basedOn
+	}
+	if element == "" && outline > 0 {
+		element = headingElement(outline)
+	}
+	return element, title, numID, numLevel
+}
+
+func (r *docxReader) paragraph(p *xmlNode, w *officeWriter) {
+	pPr := p.child(nsDOCXMain, "pPr")
+	element, title, numID, numLevel := r.paragraphStyle(pPr.child(nsDOCXMain, "pStyle").attr(nsDOCXMain, "val"))
+	if outline := pPr.child(nsDOCXMain, "outlineLvl"); outline != nil {
+		level, err := strconv.Atoi(outline.attr(nsDOCXMain, "val"))
+		if err == nil && level < 9 {
+			element = headingElement(level + 1)
+		}
+	}
+	if numPr := pPr.child(nsDOCXMain, "numPr"); numPr != nil {
+		numID = numPr.child(nsDOCXMain, "numId").attr(nsDOCXMain, "val")
+		numLevel, _ = strconv.Atoi(numPr.child(nsDOCXMain, "ilvl").attr(nsDOCXMain, "val"))
+	}
+
+	o := &officeInline{}
+	r.inline(p, o, element == "pre")
+	content := o.html()
+
+	if title && r.i.title == "" {
+		r.i.title = htmlToText(content)
+	}
+
+	levels, numbered := r.numbering[numID]
+	switch {
+	case numbered && element == "":
+		w.listItem(numID, numLevel, levels[numLevel], content)
+	case element == "":
+		w.paragraph("p", content)
+	default:
+		w.paragraph(element, content)
+	}
+}
+
+// inline writes the runs, links and images in the paragraph.  In a code block the runs aren't marked as code,
+// because the whole block is
+func (r *docxReader) inline(n *xmlNode, o *officeInline, code bool) {
+	for _, c := range n.Children {
+		switch {
+		case c.is(nsDOCXMain, "r"):
+			r.run(c, o, code)
+		case c.is(nsDOCXMain, "hyperlink"):
+			href := ""
+			if rel, ok := r.rels[c.attr(nsDOCXRelationships, "id")]; ok && rel.external {
+				href = rel.target
+			} else if anchor := c.attr(nsDOCXMain, "anchor"); anchor != "" {
+				href = "#" + anchor
+			}
+			if href == "" {
+				r.inline(c, o, code)
+				continue
+			}
+			o.raw(`<a href="` + escapeHTML(href) + `">`)
+			r.inline(c, o, code)
+			o.raw("</a>")
+		case c.is(nsDOCXMain, "bookmarkStart"):
+			name := c.attr(nsDOCXMain, "name")
+			if name != "" && name != "_GoBack" {
+				o.raw(`<a name="` + escapeHTML(name) + `"></a>`)
+			}
+		case c.is(nsDOCXMain, "sdt"):
+			r.inline(c.child(nsDOCXMain, "sdtContent"), o, code)
+		case c.is(nsDOCXMain, "ins"), c.is(nsDOCXMain, "smartTag"), c.is(nsDOCXMain, "customXml"),
+			c.is(nsDOCXMain, "fldSimple"), c.is(nsDOCXMain, "moveTo"):
+			r.inline(c, o, code)
+		}
+	}
+}
+
+// format returns the formatting of a run's properties, on top of the formatting it inherits
+func (r *docxReader) format(rPr *xmlNode, format officeFormat) officeFormat {
+	if rPr == nil {
+		return format
+	}
+	if style, ok := r.styles[rPr.child(nsDOCXMain, "rStyle").attr(nsDOCXMain, "val")]; ok {
+		format = style.format
+		if element, _ := styleStructure(style.name); element == "pre" {
+			format.code = true
+		}
+	}
+	if b := rPr.child(nsDOCXMain, "b"); b != nil {
+		format.bold = docxOn(b)
+	}
+	if i := rPr.child(nsDOCXMain, "i"); i != nil {
+		format.italic = docxOn(i)
+	}
+	if u := rPr.child(nsDOCXMain, "u"); u != nil {
+		format.underline = u.attr(nsDOCXMain, "val") != "none"
+	}
+	if s := rPr.child(nsDOCXMain, "strike"); s != nil {
+		format.strike = docxOn(s)
+	}
+	if s := rPr.child(nsDOCXMain, "dstrike"); s != nil {
+		format.strike = docxOn(s)
+	}
+	switch rPr.child(nsDOCXMain, "vertAlign").attr(nsDOCXMain, "val") {
+	case "superscript":
+		format.position = "sup"
+	case "subscript":
+		format.position = "sub"
+	case "baseline":
+		format.position = ""
+	}
+	if fonts := rPr.child(nsDOCXMain, "rFonts"); fonts != nil && isMonospace(fonts.attr(nsDOCXMain, "ascii")) {
+		format.code = true
+	}
+	return format
+}
+
+// docxOn returns true if a toggle property like bold is on.  The property is on if it has no value
+func docxOn(n *xmlNode) bool {
+	switch n.attr(nsDOCXMain, "val") {
+	case "0", "false", "off":
+		return false
+	}
+	return true
+}
+
+func (r *docxReader) run(run *xmlNode, o *officeInline, code bool) {
+	format := r.format(run.child(nsDOCXMain, "rPr"), officeFormat{})
+	if code {
+		format.code = false
+	}
+	for _, c := range run.Children {
+		switch {
+		case c.is(nsDOCXMain, "t"):
+			o.write(format, c.text())
+		case c.is(nsDOCXMain, "tab"):
+			o.write(format, "\t")
+		case c.is(nsDOCXMain, "noBreakHyphen"):
+			o.write(format, "-")
+		case c.is(nsDOCXMain, "br"), c.is(nsDOCXMain, "cr"):
+			if t := c.attr(nsDOCXMain, "type"); t == "page" || t == "column" {
+				continue
+			}
+			if code {
+				o.write(format, "\n")
+			} else {
+				o.raw("<br />")
+			}
+		case c.is(nsDOCXMain, "drawing"):
+			blip := c.find(nsDOCXDrawing, "blip")
+			if blip == nil {
+				r.warnOnce("Charts, shapes and other drawings that aren't pictures were skipped")
+				continue
+			}
+			alt := c.find(nsDOCXPicture, "docPr")
+			r.image(blip.attr(nsDOCXRelationships, "embed"), alt.attr("", "descr"), o)
+		case c.is(nsDOCXMain, "pict"):
+			if data := c.find(nsDOCXVML, "imagedata"); data != nil {
+				r.image(data.attr(nsDOCXRelationships, "id"), data.attr("", "title"), o)
+			}
+		case c.is(nsDOCXMain, "object"):
+			r.warnOnce("Embedded objects, like spreadsheets, were skipped")
+		}
+	}
+}
+
+// image attaches the embedded image, and adds it to the paragraph
+func (r *docxReader) image(id, alt string, o *officeInline) {
+	rel, ok := r.rels[id]
+	if !ok {
+		return
+	}
+	src := rel.target
+	if !rel.external {
+		name := strings.TrimPrefix(rel.target, "/")
+		if !strings.HasPrefix(rel.target, "/") {
+			name = path.Join(r.dir, rel.target)
+		}
+		src, ok = r.i.embed(r.who, r.zip, name)
+		if !ok {
+			return
+		}
+	}
+	o.raw(`<img src="` + escapeHTML(src) + `" alt="` + escapeHTML(alt) + `" />`)
+}
+
+func (r *docxReader) table(tbl *xmlNode, w *officeWriter) {
+	var rows [][]*officeCell
+	header := false
+	merged := make(map[int]*officeCell) // the cell that cells merged into from above belong to, by grid column
+
+	for _, tr := range tbl.Children {
+		if !tr.is(nsDOCXMain, "tr") {
+			continue
+		}
+		if len(rows) == 0 {
+			if h := tr.path(nsDOCXMain, "trPr", "tblHeader"); h != nil {
+				header = docxOn(h)
+			}
+		}
+
+		var row []*officeCell
+		column := 0
+		for _, tc := range tr.Children {
+			if !tc.is(nsDOCXMain, "tc") {
+				continue
+			}
+			tcPr := tc.child(nsDOCXMain, "tcPr")
+			span, err := strconv.Atoi(tcPr.child(nsDOCXMain, "gridSpan").attr(nsDOCXMain, "val"))
+			if err != nil || span < 1 {
+				span = 1
+			}
+
+			vMerge := tcPr.child(nsDOCXMain, "vMerge")
+			if vMerge != nil && vMerge.attr(nsDOCXMain, "val") != "restart" {
+				if above, ok := merged[column]; ok {
+					above.rowspan++
+					column += span
+					continue
+				}
+			}
+
+			cw := &officeWriter{}
+			r.blocks(tc, cw)
+			cell := &officeCell{content: cw.cellHTML(), colspan: span, rowspan: 1}
+			row = append(row, cell)
+			if vMerge != nil {
+				merged[column] = cell
+			} else {
+				delete(merged, column)
+			}
+			column += span
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) > 0 {
+		w.table(rows, header)
+	}
+}
@@ -0,0 +1,706 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lexLibrary/lexLibrary/data"
+)
+
+/*
+	A git sync imports the documentation files in a git repository on the server, either a bare repository or a
+	working copy, and can be synced again later to bring the documents up to date with the repository.
+
+	Each file matching the sync's paths at its ref becomes a document, and each commit that changed the file becomes
+	one of the document's revisions, written by the user with the same email address as the commit's author, at the
+	time it was authored.  The sync remembers the content hash of every file it imported, so syncing again only adds
+	revisions to the documents whose files changed, one for each commit since the last sync.  Files removed from the
+	repository are reported, but their documents are kept.
+
+	The repository is read with the git command, which must be installed on the server.  Only administrators of the
+	default tenant can sync repositories, because they're read straight from the server's file system, which is
+	shared by every tenant in the installation.
+*/
+
+// statuses of a file in a git sync
+const (
+	GitFileStatusAdded     = "added"
+	GitFileStatusUpdated   = "updated"
+	GitFileStatusUnchanged = "unchanged"
+	GitFileStatusRemoved   = "removed"
+	GitFileStatusSkipped   = "skipped"
+	GitFileStatusFailed    = "failed"
+)
+
+const (
+	// maxGitRevisions is the most commits imported as revisions when a file is first imported.  Older commits are
+	// left out
+	maxGitRevisions = 100
+	// gitTimeout is the longest any git command can run
+	gitTimeout = 5 * time.Minute
+)
+
+// gitFormats are the formats of the files that can be synced, by extension
+var gitFormats = map[string]string{
+	".md":       "markdown",
+	".markdown": "markdown",
+	".mdown":    "markdown",
+	".html":     "html",
+	".htm":      "html",
+	".rst":      "rst",
+	".rest":     "rst",
+	".adoc":     "asciidoc",
+	".asciidoc": "asciidoc",
+	".asc":      "asciidoc",
+}
+
+// GitSync imports the files in a git repository as documents, and keeps them in sync with the repository
+type GitSync struct {
+	ID         string
+	TenantID   string
+	Repository string // the absolute path of the repository on the server
+	Ref        string
+	// Paths are the patterns of the files synced, relative to the root of the repository.  * matches any part of a
+	// file or directory name, and ** matches any number of directories
+	Paths        []string
+	CollectionID string // empty if the documents aren't imported into a collection
+	Commit       string // the commit last synced, empty if the repository was never synced
+	Creator      string
+	Created      time.Time
+	Updated      time.Time
+
+	who *User
+}
+
+// GitSyncFile is the outcome of syncing a file
+type GitSyncFile struct {
+	Path       string
+	Status     string
+	DocumentID string
+	Revisions  int // the number of revisions added to the document
+	// Warnings are the parts of the file that couldn't be imported as they were, or why it wasn't imported
+	Warnings []string
+}
+
+// gitSyncFile is a file imported by a sync as it's stored
+type gitSyncFile struct {
+	path       string
+	documentID string
+	blob       string // the hash of the file's content when it was last synced, empty if it has been removed
+	commit     string // the commit the file was last synced at
+}
+
+// gitCommit is a commit that changed a synced file
+type gitCommit struct {
+	hash    string
+	author  string
+	email   string
+	created time.Time
+}
+
+var (
+	sqlGitSyncInsert = data.NewQuery(`
+		insert into git_syncs (tenant_id, id, repository, ref, paths, collection_id, creator, created, updated)
+		values ({{tenant}}, {{arg "id"}}, {{arg "repository"}}, {{arg "ref"}}, {{arg "paths"}},
+			{{arg "collection_id"}}, {{arg "creator"}}, {{arg "created"}}, {{arg "updated"}})
+	`)
+	sqlGitSyncGet = data.NewQuery(`
+		select id, tenant_id, repository, ref, paths, collection_id, last_commit, creator, created, updated
+		from git_syncs
+		where tenant_id = {{tenant}} and id = {{arg "id"}}
+	`)
+	sqlGitSyncUpdate = data.NewQuery(`
+		update git_syncs set last_commit = {{arg "last_commit"}}, updated = {{arg "updated"}}
+		where tenant_id = {{tenant}} and id = {{arg "id"}}
+	`)
+
+	sqlGitSyncFileInsert = data.NewQuery(`
+		insert into git_sync_files (tenant_id, sync_id, path_key, path, document_id, blob_hash, last_commit,
+			updated)
+		values ({{tenant}}, {{arg "sync_id"}}, {{arg "path_key"}}, {{arg "path"}}, {{arg "document_id"}},
+			{{arg "blob_hash"}}, {{arg "last_commit"}}, {{arg "updated"}})
+	`)
+	sqlGitSyncFileList = data.NewQuery(`
+		select path, document_id, blob_hash, last_commit from git_sync_files
+		where tenant_id = {{tenant}} and sync_id = {{arg "sync_id"}}
+	`)
+	sqlGitSyncFileUpdate = data.NewQuery(`
+		update git_sync_files set document_id = {{arg "document_id"}}, blob_hash = {{arg "blob_hash"}},
+			last_commit = {{arg "last_commit"}}, updated = {{arg "updated"}}
+		where tenant_id = {{tenant}} and sync_id = {{arg "sync_id"}} and path_key = {{arg "path_key"}}
+	`)
+)
+
+// GitSyncNew sets up the sync of the files matching the paths in the git repository at the ref, into the collection
+// if it isn't nil.  The ref defaults to HEAD, and the paths to every markdown file.  Nothing is imported until the
+// sync is run with Sync
+func GitSyncNew(who *User, collection *Collection, repository, ref string, paths []string) (*GitSync, error) {
+	err := canAdminInstallation(who)
+	if err != nil {
+		return nil, err
+	}
+	collectionID, err := canCreateDocument(who, collection)
+	if err != nil {
+		return nil, err
+	}
+
+	repository = strings.TrimSpace(repository)
+	if !filepath.IsAbs(repository) {
+		return nil, NewFailure("The repository must be an absolute path on the server")
+	}
+	repository = filepath.Clean(repository)
+	if _, err := runGit(repository, "rev-parse", "--git-dir"); err != nil {
+		if _, ok := err.(*gitError); ok {
+			return nil, NewFailure(fmt.Sprintf("%s is not a git repository", repository))
+		}
+		return nil, err
+	}
+
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		ref = "HEAD"
+	}
+	if strings.HasPrefix(ref, "-") {
+		return nil, NewFailure(fmt.Sprintf("%s is not a valid ref", ref))
+	}
+
+	var patterns []string
+	for _, p := range paths {
+		p = strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(p), "/"), "./")
+		if p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	if len(patterns) == 0 {
+		patterns = []string{"**/*.md"}
+	}
+
+	s := &GitSync{
+		ID:           newID(),
+		TenantID:     who.TenantID,
+		Repository:   repository,
+		Ref:          ref,
+		Paths:        patterns,
+		CollectionID: collectionID,
+		Creator:      who.ID,
+		Created:      time.Now(),
+		who:          who,
+	}
+	s.Updated = s.Created
+
+	_, err = s.head()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = sqlGitSyncInsert.Tenant(s.TenantID).Exec(
+		sql.Named("id", s.ID),
+		sql.Named("repository", s.Repository),
+		sql.Named("ref", s.Ref),
+		sql.Named("paths", strings.Join(s.Paths, "\n")),
+		sql.Named("collection_id", nullString(s.CollectionID)),
+		sql.Named("creator", s.Creator),
+		sql.Named("created", s.Created),
+		sql.Named("updated", s.Updated),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// GitSyncGet retrieves a git sync set up by the user, or any git sync if the user is an admin
+func GitSyncGet(who *User, id string) (*GitSync, error) {
+	if who == nil {
+		return nil, Unauthorized("You must log in")
+	}
+	s := &GitSync{}
+	var paths string
+	var collectionID, commit sql.NullString
+	err := sqlGitSyncGet.Tenant(who.TenantID).QueryRow(sql.Named("id", id)).Scan(&s.ID, &s.TenantID,
+		&s.Repository, &s.Ref, &paths, &collectionID, &commit, &s.Creator, &s.Created, &s.Updated)
+	if err == sql.ErrNoRows {
+		return nil, NotFound("Git sync not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.Creator != who.ID && !who.Admin {
+		return nil, NotFound("Git sync not found")
+	}
+	s.Paths = strings.Split(paths, "\n")
+	s.CollectionID = collectionID.String
+	s.Commit = commit.String
+	s.who = who
+	return s, nil
+}
+
+// Sync imports the files that were added or changed in the repository since the last sync.  New files become new
+// documents with a revision for each of their commits, and changed files get a new revision for each commit since
+// the last sync.  The outcome of syncing every matching file is returned, in path order.
+//
+// A file that can't be imported is reported as failed, and is tried again on the next sync
+func (s *GitSync) Sync() ([]*GitSyncFile, error) {
+	err := canAdminInstallation(s.who)
+	if err != nil {
+		return nil, err
+	}
+	var collection *Collection
+	if s.CollectionID != "" {
+		collection, err = CollectionGet(s.who, s.CollectionID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	head, err := s.head()
+	if err != nil {
+		return nil, err
+	}
+	tree, err := s.tree(head)
+	if err != nil {
+		return nil, err
+	}
+	files, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+	authors, err := newImportAuthors(s.who)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(tree))
+	for name := range tree {
+		paths = append(paths, name)
+	}
+	for name, f := range files {
+		if _, ok := tree[name]; !ok && f.blob != "" {
+			paths = append(paths, name)
+		}
+	}
+	sort.Strings(paths)
+
+	var results []*GitSyncFile
+	for _, name := range paths {
+		f := files[name]
+		blob, ok := tree[name]
+		result := &GitSyncFile{Path: name, Status: GitFileStatusUnchanged}
+		if f != nil {
+			result.DocumentID = f.documentID
+		}
+		results = append(results, result)
+
+		switch {
+		case !ok:
+			result.Status = GitFileStatusRemoved
+			err = s.saveFile(f, &gitSyncFile{path: name, documentID: f.documentID, commit: head})
+		case f != nil && f.blob == blob:
+		case gitFormats[strings.ToLower(path.Ext(name))] == "":
+			result.Status = GitFileStatusSkipped
+			result.Warnings = []string{fmt.Sprintf(
+				"%s can't be imported, only markdown, HTML, reStructuredText and AsciiDoc files can be synced", name)}
+		default:
+			err = s.syncFile(result, collection, authors, f, head, blob)
+		}
+		if err != nil {
+			return results, err
+		}
+	}
+
+	updated := time.Now()
+	_, err = sqlGitSyncUpdate.Tenant(s.TenantID).Exec(
+		sql.Named("id", s.ID),
+		sql.Named("last_commit", head),
+		sql.Named("updated", updated),
+	)
+	if err != nil {
+		return results, err
+	}
+	s.Commit = head
+	s.Updated = updated
+	return results, nil
+}
+
+// syncFile imports the commits of the file since it was last synced, as a new document if it wasn't imported yet
+func (s *GitSync) syncFile(result *GitSyncFile, collection *Collection, authors *importAuthors, f *gitSyncFile,
+	head, blob string) error {
+	since := ""
+	if f != nil {
+		since = f.commit
+	}
+	commits, skipped, err := s.commits(head, result.Path, since)
+	if err != nil {
+		return err
+	}
+
+	var d *Document
+	if f != nil {
+		d, err = DocumentGet(s.who, f.documentID)
+		if IsFailType(err, FailNotFound) {
+			// the document is gone, so the file is imported again from the start
+			commits, skipped, err = s.commits(head, result.Path, "")
+			d = nil
+		}
+		if IsFail(err) {
+			result.Status = GitFileStatusFailed
+			result.Warnings = []string{fmt.Sprintf("%s could not be synced: %s", result.Path, err)}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	i := newImportDoc(nil, result.Path)
+	if skipped {
+		i.warn("%s has more than %d commits, only the latest %d were imported", result.Path, maxGitRevisions,
+			maxGitRevisions)
+	}
+	var unknown []string
+	for n, c := range commits {
+		rev, err := s.revision(i, c)
+		if IsFail(err) {
+			result.Status = GitFileStatusFailed
+			result.Warnings = append(i.warnings, fmt.Sprintf("%s could not be imported: %s", result.Path, err))
+			i.release()
+			return nil
+		}
+		if err != nil {
+			i.release()
+			return err
+		}
+		rev.Author, err = authors.email(c.email)
+		if err != nil {
+			i.release()
+			return err
+		}
+		if rev.Author == "" {
+			unknown = append(unknown, c.author+" <"+c.email+">")
+		}
+		if n < len(commits)-1 {
+			i.history = append(i.history, rev)
+			continue
+		}
+		i.author = rev.Author
+	}
+	i.created = commits[0].created
+	i.updated = commits[len(commits)-1].created
+	if unknown = uniqueSorted(unknown); len(unknown) > 0 {
+		i.warn("The commits to %s by %s were attributed to you, because no user has the same email address",
+			result.Path, strings.Join(unknown, ", "))
+	}
+
+	var imported *ImportResult
+	if d == nil {
+		result.Status = GitFileStatusAdded
+		imported, err = i.create(s.who, collection)
+	} else {
+		result.Status = GitFileStatusUpdated
+		imported, err = i.update(s.who, d)
+	}
+	if IsFail(err) {
+		result.Status = GitFileStatusFailed
+		result.Warnings = append(i.warnings, fmt.Sprintf("%s could not be imported: %s", result.Path, err))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	result.DocumentID = imported.Document.ID
+	result.Revisions = len(commits)
+	result.Warnings = imported.Warnings
+	return s.saveFile(f, &gitSyncFile{
+		path:       result.Path,
+		documentID: result.DocumentID,
+		blob:       blob,
+		commit:     head,
+	})
+}
+
+// revision converts the file as it was at the commit.  The converted title, body and summary are left on the
+// import, so the last revision converted becomes its latest
+func (s *GitSync) revision(i *importDoc, c *gitCommit) (*Revision, error) {
+	i.source = gitSource{repository: s.Repository, commit: c.hash}
+	i.title, i.summary, i.tags = "", "", nil
+
+	file, err := i.readBytes()
+	if err != nil {
+		return nil, err
+	}
+	switch gitFormats[strings.ToLower(path.Ext(i.file))] {
+	case "markdown":
+		i.markdown(i.text(file))
+	case "html":
+		err = i.html(i.decodeHTML(file))
+		if err != nil {
+			return nil, err
+		}
+	case "rst":
+		i.rst(i.text(file))
+	case "asciidoc":
+		i.asciidoc(i.text(file))
+	}
+
+	// links are attached now, while the source is at the commit the revision is from
+	i.body = sanitizeHTML(i.body)
+	i.attachLinks(s.who)
+	title := i.title
+	if strings.TrimSpace(title) == "" {
+		title = strings.TrimSuffix(path.Base(i.file), path.Ext(i.file))
+	}
+	return &Revision{
+		Title:         title,
+		Body:          i.body,
+		Summary:       i.summary,
+		SummaryManual: i.summary != "" && utf8.RuneCountInString(i.summary) <= maxSummaryLength,
+		Created:       c.created,
+	}, nil
+}
+
+// head returns the commit the sync's ref points at
+func (s *GitSync) head() (string, error) {
+	out, err := runGit(s.Repository, "rev-parse", "--verify", "--quiet", s.Ref+"^{commit}")
+	if _, ok := err.(*gitError); ok {
+		return "", NewFailure(fmt.Sprintf("The ref %s was not found in the repository", s.Ref))
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// tree returns the hashes of the files matching the sync's paths at the commit, by path
+func (s *GitSync) tree(commit string) (map[string]string, error) {
+	var patterns []*regexp.Regexp
+	for _, p := range s.Paths {
+		patterns = append(patterns, globPattern(p))
+	}
+
+	out, err := runGit(s.Repository, "ls-tree", "-r", "-z", "--full-tree", commit)
+	if err != nil {
+		return nil, err
+	}
+	tree := make(map[string]string)
+	for _, entry := range strings.Split(string(out), "\x00") {
+		// <mode> SP <type> SP <hash> TAB <path>
+		tab := strings.Index(entry, "\t")
+		if tab == -1 {
+			continue
+		}
+		fields := strings.Fields(entry[:tab])
+		name := entry[tab+1:]
+		if len(fields) != 3 || fields[1] != "blob" || fields[0] == "120000" {
+			// only regular files, not symbolic links or submodules
+			continue
+		}
+		for _, p := range patterns {
+			if p.MatchString(name) {
+				tree[name] = fields[2]
+				break
+			}
+		}
+	}
+	return tree, nil
+}
+
+// commits returns the commits that changed the file since the commit it was last synced at, oldest first.  A file
+// that was never synced has its latest maxGitRevisions commits returned, and skipped is true if there were more.
+// A file that changed without any commits since it was synced, like after history was rewritten, has the latest
+// commit that changed it returned
+func (s *GitSync) commits(head, name, since string) (commits []*gitCommit, skipped bool, err error) {
+	args := []string{"log", "--format=%H%x1f%at%x1f%an%x1f%ae"}
+	if since == "" {
+		args = append(args, "-n", strconv.Itoa(maxGitRevisions+1), head)
+	} else {
+		args = append(args, since+".."+head)
+	}
+	out, err := runGit(s.Repository, append(args, "--", name)...)
+	if _, ok := err.(*gitError); ok && since != "" {
+		// the commit last synced is gone
+		out, err = nil, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if len(bytes.TrimSpace(out)) == 0 && since != "" {
+		out, err = runGit(s.Repository, "log", "--format=%H%x1f%at%x1f%an%x1f%ae", "-n", "1", head, "--", name)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Split(line, "\x1f")
+		if len(fields) != 4 {
+			continue
+		}
+		created, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid commit time %q from git log", fields[1])
+		}
+		commits = append(commits, &gitCommit{
+			hash:    fields[0],
+			author:  fields[2],
+			email:   fields[3],
+			created: time.Unix(created, 0),
+		})
+	}
+	if len(commits) == 0 {
+		return nil, false, fmt.Errorf("no commits found for %s", name)
+	}
+	if since == "" && len(commits) > maxGitRevisions {
+		commits = commits[:maxGitRevisions]
+		skipped = true
+	}
+	for a, b := 0, len(commits)-1; a < b; a, b = a+1, b-1 {
+		commits[a], commits[b] = commits[b], commits[a]
+	}
+	return commits, skipped, nil
+}
+
+// files returns the files synced so far, by path
+func (s *GitSync) files() (map[string]*gitSyncFile, error) {
+	rows, err := sqlGitSyncFileList.Tenant(s.TenantID).Query(sql.Named("sync_id", s.ID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := make(map[string]*gitSyncFile)
+	for rows.Next() {
+		f := &gitSyncFile{}
+		var blob sql.NullString
+		err = rows.Scan(&f.path, &f.documentID, &blob, &f.commit)
+		if err != nil {
+			return nil, err
+		}
+		f.blob = blob.String
+		files[f.path] = f
+	}
+	return files, rows.Err()
+}
+
+// saveFile records the file as synced, replacing the record of when it was last synced if there is one
+func (s *GitSync) saveFile(previous, f *gitSyncFile) error {
+	query := sqlGitSyncFileInsert
+	if previous != nil {
+		query = sqlGitSyncFileUpdate
+	}
+	_, err := query.Tenant(s.TenantID).Exec(
+		sql.Named("sync_id", s.ID),
+		sql.Named("path_key", pathKey(f.path)),
+		sql.Named("path", f.path),
+		sql.Named("document_id", f.documentID),
+		sql.Named("blob_hash", nullString(f.blob)),
+		sql.Named("last_commit", f.commit),
+		sql.Named("updated", time.Now()),
+	)
+	return err
+}
+
+// globPattern returns the regular expression matching the paths matched by the glob.  * matches anything but a
+// slash, ? matches a single character that isn't a slash, and ** matches anything, including any number of
+// directories
+func globPattern(glob string) *regexp.Regexp {
+	buf := bytes.NewBufferString("^")
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			buf.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			buf.WriteString(".*")
+			i++
+		case glob[i] == '*':
+			buf.WriteString("[^/]*")
+		case glob[i] == '?':
+			buf.WriteString("[^/]")
+		default:
+			buf.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	buf.WriteString("$")
+	return regexp.MustCompile(buf.String())
+}
+
+// gitSource is an import source of the files in a git repository at a commit
+type gitSource struct {
+	repository string
+	commit     string
+}
+
+// Open reads the file at the commit
+func (g gitSource) Open(name string) (io.ReadCloser, error) {
+	name, err := importPath(name)
+	if err != nil {
+		return nil, err
+	}
+	object := g.commit + ":" + name
+	out, err := runGit(g.repository, "cat-file", "-s", object)
+	if _, ok := err.(*gitError); ok {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid size %q of %s from git", out, object)
+	}
+	if size > maxImportFileSize {
+		return nil, NewFailure(fmt.Sprintf("%s is too large to import", name))
+	}
+
+	out, err = runGit(g.repository, "cat-file", "blob", object)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(out)), nil
+}
+
+// gitError is a git command that failed, as opposed to git not being able to run at all
+type gitError struct {
+	command string
+	message string
+}
+
+func (e *gitError) Error() string {
+	return fmt.Sprintf("git %s failed: %s", e.command, e.message)
+}
+
+// runGit runs the git command in the repository, and returns what it wrote to standard out
+func runGit(repository string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", repository}, args...)...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if _, ok := err.(*exec.ExitError); ok {
+		return nil, &gitError{command: args[0], message: strings.TrimSpace(stderr.String())}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
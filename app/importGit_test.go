@@ -0,0 +1,275 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lexLibrary/lexLibrary/app"
+)
+
+// testRepo is a temporary git repository
+type testRepo struct {
+	t   *testing.T
+	dir string
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	dir, err := ioutil.TempDir("", "lexlibrary-git")
+	if err != nil {
+		t.Fatalf("Error creating repository directory: %s", err)
+	}
+	r := &testRepo{t: t, dir: dir}
+	r.git(nil, "init", "-q")
+	return r
+}
+
+func (r *testRepo) git(env []string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = r.dir
+	cmd.Env = append(os.Environ(), append([]string{
+		"GIT_CONFIG_NOSYSTEM=1",
+		"HOME=" + r.dir,
+		"GIT_COMMITTER_NAME=Committer",
+		"GIT_COMMITTER_EMAIL=committer@example.com",
+	}, env...)...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		r.t.Fatalf("Error running git %s: %s %s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// commit writes the files, removing the ones that are empty, and commits them by the author at the time
+func (r *testRepo) commit(author string, at time.Time, files map[string]string) {
+	for name, content := range files {
+		file := filepath.Join(r.dir, filepath.FromSlash(name))
+		if content == "" {
+			r.git(nil, "rm", "-q", name)
+			continue
+		}
+		err := os.MkdirAll(filepath.Dir(file), 0700)
+		if err != nil {
+			r.t.Fatalf("Error creating directory: %s", err)
+		}
+		err = ioutil.WriteFile(file, []byte(content), 0600)
+		if err != nil {
+			r.t.Fatalf("Error writing %s: %s", name, err)
+		}
+		r.git(nil, "add", name)
+	}
+	date := at.Format(time.RFC3339)
+	r.git([]string{
+		"GIT_AUTHOR_NAME=" + author,
+		"GIT_AUTHOR_EMAIL=" + strings.ToLower(author) + "@example.com",
+		"GIT_AUTHOR_DATE=" + date,
+		"GIT_COMMITTER_DATE=" + date,
+	}, "commit", "-q", "-m", "Change docs")
+}
+
+func TestGitSync(t *testing.T) {
+	resetDocuments(t)
+	// the first user in the default tenant is its administrator, who can sync repositories
+	resetUsers(t)
+
+	tenant, err := app.DefaultTenant()
+	if err != nil {
+		t.Fatalf("Error getting default tenant: %s", err)
+	}
+	admin := installAdmin(t)
+	author := testUser(t, tenant, "author")
+	err = author.SetEmail(author, "Author@example.com")
+	if err != nil {
+		t.Fatalf("Error setting email: %s", err)
+	}
+
+	repo := newTestRepo(t)
+	defer os.RemoveAll(repo.dir)
+
+	first := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	second := first.Add(24 * time.Hour)
+	third := second.Add(24 * time.Hour)
+	repo.commit("Author", first, map[string]string{
+		"docs/guide.md":       "# Guide\n\nInstall it.\n",
+		"docs/deep/nested.md": "# Nested\n\nDeep.\n",
+		"docs/notes.txt":      "Not synced.\n",
+		"README.md":           "# Readme\n",
+	})
+	repo.commit("Stranger", second, map[string]string{
+		"docs/guide.md":     "---\ntitle: The Guide\n---\nInstall it, then see ![logo](img/logo.png).\n",
+		"docs/img/logo.png": "not really a png",
+	})
+
+	sync, err := app.GitSyncNew(admin, nil, repo.dir, "", []string{"docs/**/*.md", "docs/*.txt"})
+	if err != nil {
+		t.Fatalf("Error creating git sync: %s", err)
+	}
+	files, err := sync.Sync()
+	if err != nil {
+		t.Fatalf("Error syncing: %s", err)
+	}
+	statuses := func(files []*app.GitSyncFile) string {
+		var s []string
+		for _, f := range files {
+			s = append(s, f.Path+" "+f.Status)
+		}
+		return strings.Join(s, ", ")
+	}
+	if got := statuses(files); got != "docs/deep/nested.md added, docs/guide.md added, docs/notes.txt skipped" {
+		t.Fatalf("Invalid files synced: %s", got)
+	}
+	guideID := files[1].DocumentID
+
+	t.Run("History", func(t *testing.T) {
+		guide, err := app.DocumentGet(admin, guideID)
+		if err != nil {
+			t.Fatalf("Error getting document: %s", err)
+		}
+		revisions, err := guide.Revisions(0, 10)
+		if err != nil {
+			t.Fatalf("Error getting revisions: %s", err)
+		}
+		if len(revisions) != 2 {
+			t.Fatalf("Expected 2 revisions, got %d", len(revisions))
+		}
+		older, latest := revisions[1], revisions[0]
+		if older.Title != "Guide" || older.Author != author.ID || !older.Created.Equal(first) {
+			t.Fatalf("Invalid first revision: %+v", older)
+		}
+		if latest.Title != "The Guide" || latest.Author != admin.ID || !latest.Created.Equal(second) {
+			t.Fatalf("Invalid latest revision: %+v", latest)
+		}
+
+		attachments, err := guide.Attachments()
+		if err != nil {
+			t.Fatalf("Error getting attachments: %s", err)
+		}
+		if len(attachments) != 1 || attachments[0].Name != "logo.png" {
+			t.Fatalf("Invalid attachments: %+v", attachments)
+		}
+		rev, err := guide.Latest()
+		if err != nil {
+			t.Fatalf("Error getting revision: %s", err)
+		}
+		if !strings.Contains(rev.Body, `src="`+attachments[0].URL()+`"`) {
+			t.Fatalf("Body doesn't link to the attachment: %s", rev.Body)
+		}
+		if !strings.Contains(strings.Join(files[1].Warnings, "\n"), "Stranger <stranger@example.com>") {
+			t.Fatalf("Expected a warning about the unknown author, got %q", files[1].Warnings)
+		}
+	})
+
+	t.Run("Resync", func(t *testing.T) {
+		repo.commit("Author", third, map[string]string{
+			"docs/deep/nested.md": "# Nested\n\nDeeper.\n",
+		})
+		repo.commit("Author", third.Add(time.Hour), map[string]string{
+			"docs/deep/nested.md": "# Nested\n\nDeepest, see ![logo](../img/logo.png).\n",
+			"docs/added.md":       "# Added\n",
+			"docs/guide.md":       "",
+		})
+
+		sync, err := app.GitSyncGet(admin, sync.ID)
+		if err != nil {
+			t.Fatalf("Error getting git sync: %s", err)
+		}
+		files, err := sync.Sync()
+		if err != nil {
+			t.Fatalf("Error syncing: %s", err)
+		}
+		want := "docs/added.md added, docs/deep/nested.md updated, docs/guide.md removed, docs/notes.txt skipped"
+		if got := statuses(files); got != want {
+			t.Fatalf("Invalid files synced: %s", got)
+		}
+		if files[1].Revisions != 2 {
+			t.Fatalf("Expected 2 new revisions, got %d", files[1].Revisions)
+		}
+
+		nested, err := app.DocumentGet(admin, files[1].DocumentID)
+		if err != nil {
+			t.Fatalf("Error getting document: %s", err)
+		}
+		if nested.LatestRevision != 3 {
+			t.Fatalf("Expected 3 revisions, got %d", nested.LatestRevision)
+		}
+		rev, err := nested.Revision(2)
+		if err != nil {
+			t.Fatalf("Error getting revision: %s", err)
+		}
+		if !strings.Contains(rev.Body, "Deeper.") || !rev.Created.Equal(third) || rev.Author != author.ID {
+			t.Fatalf("Invalid revision: %+v", rev)
+		}
+
+		if _, err := app.DocumentGet(admin, guideID); err != nil {
+			t.Fatalf("The document of a removed file was deleted: %s", err)
+		}
+
+		files, err = sync.Sync()
+		if err != nil {
+			t.Fatalf("Error syncing: %s", err)
+		}
+		want = "docs/added.md unchanged, docs/deep/nested.md unchanged, docs/notes.txt skipped"
+		if got := statuses(files); got != want {
+			t.Fatalf("Invalid files synced: %s", got)
+		}
+	})
+
+	t.Run("Bare", func(t *testing.T) {
+		bare, err := ioutil.TempDir("", "lexlibrary-bare")
+		if err != nil {
+			t.Fatalf("Error creating directory: %s", err)
+		}
+		defer os.RemoveAll(bare)
+		repo.git(nil, "clone", "-q", "--bare", repo.dir, bare)
+
+		sync, err := app.GitSyncNew(admin, nil, bare, "HEAD~1", []string{"docs/deep/*.md"})
+		if err != nil {
+			t.Fatalf("Error creating git sync: %s", err)
+		}
+		files, err := sync.Sync()
+		if err != nil {
+			t.Fatalf("Error syncing: %s", err)
+		}
+		if len(files) != 1 || files[0].Status != app.GitFileStatusAdded || files[0].Revisions != 2 {
+			t.Fatalf("Invalid files synced: %+v", files)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := app.GitSyncNew(author, nil, repo.dir, "", nil)
+		if !app.IsFailType(err, app.FailForbidden) {
+			t.Fatalf("Expected forbidden for a user that isn't an admin, got %v", err)
+		}
+		other, err := app.TenantNew(admin, "Git Sync Tenant", "", "")
+		if err != nil {
+			t.Fatalf("Error creating tenant: %s", err)
+		}
+		_, err = app.GitSyncNew(testUser(t, other, "admin"), nil, repo.dir, "", nil)
+		if !app.IsFailType(err, app.FailForbidden) {
+			t.Fatalf("Expected forbidden for an admin of another tenant, got %v", err)
+		}
+		notRepo, err := ioutil.TempDir("", "lexlibrary-norepo")
+		if err != nil {
+			t.Fatalf("Error creating directory: %s", err)
+		}
+		defer os.RemoveAll(notRepo)
+
+		for _, test := range []struct{ repository, ref string }{
+			{"relative/path", ""},
+			{notRepo, ""},
+			{repo.dir, "missing-branch"},
+			{repo.dir, "--output=/tmp/x"},
+		} {
+			_, err := app.GitSyncNew(admin, nil, test.repository, test.ref, nil)
+			if !app.IsFailType(err, app.FailInvalid) {
+				t.Fatalf("Expected invalid failure for %+v, got %v", test, err)
+			}
+		}
+	})
+}
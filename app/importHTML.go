@@ -0,0 +1,342 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/html/charset"
+)
+
+/*
+	HTML pages usually wrap their content in site navigation, headers, footers and sidebars, none of which belong
+	in a document.  The main content of a page is found the way readability tools find it: an <article> or <main>
+	element is used if the page has one, otherwise the boilerplate is removed, and the element holding the most
+	paragraph text, with the fewest links, is chosen.
+
+	The title comes from the page's <title>, and the summary from its meta description.
+*/
+
+var (
+	// reUnlikelyContent matches the class or id of elements that are probably not part of the main content
+	reUnlikelyContent = regexp.MustCompile(`(?i)banner|breadcrumb|comment|cookie|disqus|footer|menu|navbar|` +
+		`pagination|pager|popup|promo|related|share|sidebar|social|sponsor|advert`)
+	// reMaybeContent matches the class or id of elements that could be the main content, even if they match
+	// reUnlikelyContent
+	reMaybeContent = regexp.MustCompile(`(?i)article|body|content|main`)
+	// rePositiveContent and reNegativeContent adjust the score of elements by their class and id
+	rePositiveContent = regexp.MustCompile(`(?i)article|body|content|entry|main|page|post|text|blog|story|docs|` +
+		`documentation`)
+	reNegativeContent = regexp.MustCompile(`(?i)hidden|banner|comment|contact|foot|masthead|media|meta|promo|` +
+		`related|share|sidebar|sponsor|widget|nav|menu|tool`)
+)
+
+// boilerplateRoles are the ARIA roles of elements that aren't part of the main content
+var boilerplateRoles = []string{"navigation", "banner", "contentinfo", "complementary", "search"}
+
+// ImportHTML imports an HTML page from the source as a new document, in the collection if it isn't nil
+func ImportHTML(who *User, collection *Collection, source ImportSource, name string) (*ImportResult, error) {
+	_, err := canCreateDocument(who, collection)
+	if err != nil {
+		return nil, err
+	}
+	name, err = importPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	i := newImportDoc(source, name)
+	file, err := i.readBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	err = i.html(i.decodeHTML(file))
+	if err != nil {
+		return nil, err
+	}
+	return i.create(who, collection)
+}
+
+// decodeHTML returns the page as UTF-8 text, using the encoding from its byte order mark or meta charset
+func (i *importDoc) decodeHTML(file []byte) string {
+	e, name, _ := charset.DetermineEncoding(file, "")
+	if name == "utf-8" {
+		return i.text(file)
+	}
+	decoded, err := e.NewDecoder().Bytes(file)
+	if err != nil {
+		i.warn("%s could not be read as %s text, and was read as UTF-8", i.file, name)
+		return i.text(file)
+	}
+	return string(decoded)
+}
+
+// html sets the title, summary and body of the document from an HTML page
+func (i *importDoc) html(page string) error {
+	doc, err := html.Parse(strings.NewReader(page))
+	if err != nil {
+		return err
+	}
+
+	title := ""
+	if n := findElement(doc, func(n *html.Node) bool { return n.DataAtom == atom.Title }); n != nil {
+		title = nodeText(n)
+	}
+	for _, meta := range findElements(doc, func(n *html.Node) bool { return n.DataAtom == atom.Meta }) {
+		key := strings.ToLower(attrValue(meta, "name") + attrValue(meta, "property"))
+		content := strings.Join(strings.Fields(attrValue(meta, "content")), " ")
+		switch {
+		case key == "og:title" && title == "":
+			title = content
+		case key == "description" || (key == "og:description" && i.summary == ""):
+			i.summary = content
+		}
+	}
+
+	content := mainContent(doc)
+
+	if h1 := findElement(content, func(n *html.Node) bool { return n.DataAtom == atom.H1 }); h1 != nil {
+		// page titles often include the site name, like "Page - Site", when the page's own heading doesn't
+		heading := nodeText(h1)
+		if title == "" || (heading != "" && strings.Contains(title, heading)) {
+			title = heading
+		}
+	}
+	i.title = title
+
+	buf := &bytes.Buffer{}
+	for c := content.FirstChild; c != nil; c = c.NextSibling {
+		err = html.Render(buf, c)
+		if err != nil {
+			return err
+		}
+	}
+	i.body = buf.String()
+	return nil
+}
+
+// mainContent returns the element holding the main content of the page
+func mainContent(doc *html.Node) *html.Node {
+	body := findElement(doc, func(n *html.Node) bool { return n.DataAtom == atom.Body })
+	if body == nil {
+		body = doc
+	}
+
+	removeBoilerplate(body)
+
+	articles := findElements(body, func(n *html.Node) bool { return n.DataAtom == atom.Article })
+	if len(articles) == 1 {
+		return articles[0]
+	}
+	mains := findElements(body, func(n *html.Node) bool {
+		return n.Data == "main" || attrValue(n, "role") == "main"
+	})
+	if len(mains) == 1 {
+		return mains[0]
+	}
+
+	if best := bestCandidate(body); best != nil {
+		return best
+	}
+	return body
+}
+
+// removeBoilerplate removes the elements that aren't part of the main content, like navigation, headers, footers,
+// sidebars and scripts
+func removeBoilerplate(n *html.Node) {
+	var next *html.Node
+	for c := n.FirstChild; c != nil; c = next {
+		next = c.NextSibling
+		if c.Type == html.CommentNode {
+			n.RemoveChild(c)
+			continue
+		}
+		if c.Type != html.ElementNode {
+			continue
+		}
+		if isBoilerplate(c) {
+			n.RemoveChild(c)
+			continue
+		}
+		removeBoilerplate(c)
+	}
+}
+
+func isBoilerplate(n *html.Node) bool {
+	switch n.DataAtom {
+	case atom.Nav, atom.Header, atom.Footer, atom.Aside, atom.Script, atom.Style, atom.Noscript, atom.Template,
+		atom.Form, atom.Iframe:
+		return true
+	case atom.Article, atom.Pre, atom.Code, atom.Table, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5,
+		atom.H6:
+		return false
+	}
+	if stringIn(strings.ToLower(attrValue(n, "role")), boilerplateRoles) {
+		return true
+	}
+	if hasAttr(n, "hidden") || attrValue(n, "aria-hidden") == "true" ||
+		strings.Contains(strings.Replace(strings.ToLower(attrValue(n, "style")), " ", "", -1), "display:none") {
+		return true
+	}
+	match := attrValue(n, "class") + " " + attrValue(n, "id")
+	return reUnlikelyContent.MatchString(match) && !reMaybeContent.MatchString(match)
+}
+
+// bestCandidate scores the parents of each paragraph by the amount of text in them, and returns the highest
+// scoring element, or nil if the page has no paragraphs
+func bestCandidate(body *html.Node) *html.Node {
+	scores := make(map[*html.Node]float64)
+	var candidates []*html.Node
+
+	addScore := func(n *html.Node, score float64) {
+		if n == nil || n.Type != html.ElementNode {
+			return
+		}
+		if _, ok := scores[n]; !ok {
+			scores[n] = contentWeight(n)
+			candidates = append(candidates, n)
+		}
+		scores[n] += score
+	}
+
+	for _, p := range findElements(body, isParagraph) {
+		text := nodeText(p)
+		if len(text) < 25 {
+			continue
+		}
+		score := 1 + float64(strings.Count(text, ",")) + float64(minInt(len(text)/100, 3))
+		addScore(p.Parent, score)
+		if p.Parent != nil && p.Parent != body {
+			addScore(p.Parent.Parent, score/2)
+		}
+	}
+
+	var best *html.Node
+	bestScore := 0.0
+	for _, n := range candidates {
+		score := scores[n] * (1 - linkDensity(n))
+		if best == nil || score > bestScore {
+			best, bestScore = n, score
+		}
+	}
+	return best
+}
+
+// isParagraph returns true if the element is a block of text, including divs used as paragraphs
+func isParagraph(n *html.Node) bool {
+	switch n.DataAtom {
+	case atom.P, atom.Pre, atom.Td:
+		return true
+	case atom.Div:
+		return findElement(n, func(c *html.Node) bool { return c != n && blockElement(c) }) == nil
+	}
+	return false
+}
+
+func blockElement(n *html.Node) bool {
+	switch n.DataAtom {
+	case atom.Address, atom.Blockquote, atom.Dl, atom.Div, atom.Img, atom.Ol, atom.P, atom.Pre, atom.Table,
+		atom.Ul, atom.Section, atom.Article, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		return true
+	}
+	return false
+}
+
+// contentWeight is the starting score of an element, based on how likely its kind and class are to hold content
+func contentWeight(n *html.Node) float64 {
+	weight := 0.0
+	switch n.DataAtom {
+	case atom.Div, atom.Article, atom.Section:
+		weight = 5
+	case atom.Pre, atom.Td, atom.Blockquote:
+		weight = 3
+	case atom.Address, atom.Ol, atom.Ul, atom.Dl, atom.Dd, atom.Dt, atom.Li, atom.Form:
+		weight = -3
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Th:
+		weight = -5
+	}
+
+	for _, value := range []string{attrValue(n, "class"), attrValue(n, "id")} {
+		if value == "" {
+			continue
+		}
+		if reNegativeContent.MatchString(value) {
+			weight -= 25
+		}
+		if rePositiveContent.MatchString(value) {
+			weight += 25
+		}
+	}
+	return weight
+}
+
+// linkDensity is the share of the element's text that is in links
+func linkDensity(n *html.Node) float64 {
+	text := len(nodeText(n))
+	if text == 0 {
+		return 0
+	}
+	links := 0
+	for _, a := range findElements(n, func(c *html.Node) bool { return c.DataAtom == atom.A }) {
+		links += len(nodeText(a))
+	}
+	return float64(links) / float64(text)
+}
+
+// nodeText returns the text in the node, with its whitespace collapsed
+func nodeText(n *html.Node) string {
+	buf := &bytes.Buffer{}
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			buf.WriteString(n.Data)
+			buf.WriteString(" ")
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return strings.Join(strings.Fields(buf.String()), " ")
+}
+
+// findElement returns the first element in the tree, in document order, that matches
+func findElement(n *html.Node, match func(n *html.Node) bool) *html.Node {
+	if n.Type == html.ElementNode && match(n) {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if found := findElement(c, match); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// findElements returns all of the elements in the tree that match, in document order
+func findElements(n *html.Node, match func(n *html.Node) bool) []*html.Node {
+	var found []*html.Node
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && match(n) {
+			found = append(found, n)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return found
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/lexLibrary/lexLibrary/app"
+)
+
+func TestImportHTML(t *testing.T) {
+	resetDocuments(t)
+
+	tenant, err := app.TenantNew(installAdmin(t), "Import HTML Tenant", "", "")
+	if err != nil {
+		t.Fatalf("Error creating tenant: %s", err)
+	}
+	author := testUser(t, tenant, "author")
+
+	files := app.ImportFiles{
+		"intranet/page.html": []byte(`<!DOCTYPE html>
+<html>
+<head>
+	<title>Deploying the Service - Company Intranet</title>
+	<meta name="description" content="How to deploy
+		the service.">
+	<style>body { color: red; }</style>
+	<script>alert("head")</script>
+</head>
+<body onload="track()">
+	<header><a href="/">Company</a> <a href="/about">About</a></header>
+	<nav><ul><li><a href="/a">Home</a></li><li><a href="/b">Docs</a></li></ul></nav>
+	<div class="sidebar">Popular pages, recent changes and other links</div>
+	<div id="content" class="content">
+		<h1>Deploying the Service</h1>
+		<p onclick="steal()">Deployments are run from the build server, after the tests pass, once a day.</p>
+		<h2>Steps</h2>
+		<pre><code class="language-sh highlight">make deploy</code></pre>
+		<p>Read <a href="javascript:alert(1)">the details</a> and see the <img src="images/flow.png" alt="Flow">.</p>
+		<script>alert("body")</script>
+	</div>
+	<footer>Copyright Company, all rights reserved</footer>
+</body>
+</html>`),
+		"intranet/images/flow.png": []byte("not really a png"),
+		"latin1.html":              []byte("<html><head><meta charset=\"iso-8859-1\"></head><body><p>Caf\xe9</p></body></html>"),
+		"article.html": []byte(`<html><head><meta property="og:title" content="Open Graph Title"></head><body>
+			<div class="menu">Menu</div><article><p>The article, with short text.</p></article>
+			<div>A much longer block of text that would otherwise score higher, with many commas, in it, yes.</div>
+			</body></html>`),
+	}
+
+	t.Run("Page", func(t *testing.T) {
+		result, err := app.ImportHTML(author, nil, files, "intranet/page.html")
+		if err != nil {
+			t.Fatalf("Error importing HTML: %s", err)
+		}
+		if len(result.Warnings) != 0 {
+			t.Fatalf("Unexpected warnings: %v", result.Warnings)
+		}
+		rev, err := result.Document.Latest()
+		if err != nil {
+			t.Fatalf("Error getting revision: %s", err)
+		}
+		if rev.Title != "Deploying the Service" {
+			t.Fatalf("Invalid title: %q", rev.Title)
+		}
+		if rev.Summary != "How to deploy the service." || !rev.SummaryManual {
+			t.Fatalf("Invalid summary: %q", rev.Summary)
+		}
+
+		for _, removed := range []string{"script", "alert", "style", "onclick", "onload", "javascript:", "Company",
+			"Home", "Popular", "Copyright"} {
+			if strings.Contains(rev.Body, removed) {
+				t.Fatalf("Body contains %q: %s", removed, rev.Body)
+			}
+		}
+		for _, kept := range []string{
+			"<h1>Deploying the Service</h1>",
+			"<h2>Steps</h2>",
+			`<pre><code class="language-sh">make deploy</code></pre>`,
+			"<p>Deployments are run from the build server",
+			"<a>the details</a>",
+		} {
+			if !strings.Contains(rev.Body, kept) {
+				t.Fatalf("Body is missing %q: %s", kept, rev.Body)
+			}
+		}
+
+		attachments, err := result.Document.Attachments()
+		if err != nil {
+			t.Fatalf("Error getting attachments: %s", err)
+		}
+		if len(attachments) != 1 || attachments[0].Name != "flow.png" {
+			t.Fatalf("Invalid attachments: %+v", attachments)
+		}
+		if !strings.Contains(rev.Body, `src="`+attachments[0].URL()+`"`) {
+			t.Fatalf("Image was not linked to the attachment: %s", rev.Body)
+		}
+	})
+
+	t.Run("Charset", func(t *testing.T) {
+		result, err := app.ImportHTML(author, nil, files, "latin1.html")
+		if err != nil {
+			t.Fatalf("Error importing HTML: %s", err)
+		}
+		rev, err := result.Document.Latest()
+		if err != nil {
+			t.Fatalf("Error getting revision: %s", err)
+		}
+		if rev.Body != "<p>Café</p>" {
+			t.Fatalf("Invalid body: %q", rev.Body)
+		}
+		if rev.Title != "latin1" {
+			t.Fatalf("Invalid title: %q", rev.Title)
+		}
+	})
+
+	t.Run("Article", func(t *testing.T) {
+		result, err := app.ImportHTML(author, nil, files, "article.html")
+		if err != nil {
+			t.Fatalf("Error importing HTML: %s", err)
+		}
+		rev, err := result.Document.Latest()
+		if err != nil {
+			t.Fatalf("Error getting revision: %s", err)
+		}
+		if rev.Title != "Open Graph Title" {
+			t.Fatalf("Invalid title: %q", rev.Title)
+		}
+		if strings.TrimSpace(rev.Body) != "<p>The article, with short text.</p>" {
+			t.Fatalf("Invalid body: %q", rev.Body)
+		}
+	})
+
+	t.Run("Not Found", func(t *testing.T) {
+		_, err := app.ImportHTML(author, nil, files, "missing.html")
+		if !app.IsFailType(err, app.FailNotFound) {
+			t.Fatalf("Expected not found error, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	toml "github.com/pelletier/go-toml"
+	yaml "gopkg.in/yaml.v2"
+)
+
+/*
+	Markdown files can start with front matter, as used by static site generators like Jekyll and Hugo: YAML between
+	lines of ---, or TOML between lines of +++.  The title, tags, dates and description are read from the front
+	matter, and anything else in it is ignored.  Without a title in the front matter, the first top level heading is
+	used, and failing that the file name.
+*/
+
+// ImportMarkdown imports a Markdown file from the source as a new document, in the collection if it isn't nil
+func ImportMarkdown(who *User, collection *Collection, source ImportSource, name string) (*ImportResult, error) {
+	_, err := canCreateDocument(who, collection)
+	if err != nil {
+		return nil, err
+	}
+	name, err = importPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	i := newImportDoc(source, name)
+	text, err := i.read()
+	if err != nil {
+		return nil, err
+	}
+
+	i.markdown(text)
+	return i.create(who, collection)
+}
+
+// markdown sets the body of the document from the markdown text, and its other fields from the front matter
+func (i *importDoc) markdown(text string) {
+	format, matter, markdown := splitFrontMatter(text)
+	if format != "" {
+		i.frontMatter(format, matter)
+	}
+
+	i.body = markdownToHTML(markdown)
+	if i.title == "" {
+		i.title = firstHeading(i.body)
+	}
+}
+
+// splitFrontMatter splits YAML or TOML front matter from the start of the text.  format is empty if there is no
+// front matter
+func splitFrontMatter(text string) (format, matter, body string) {
+	fence := ""
+	switch {
+	case strings.HasPrefix(text, "---"):
+		format, fence = "yaml", "---"
+	case strings.HasPrefix(text, "+++"):
+		format, fence = "toml", "+++"
+	default:
+		return "", "", text
+	}
+
+	lines := strings.SplitAfter(text, "\n")
+	if strings.TrimSpace(lines[0]) != fence {
+		return "", "", text
+	}
+	for l := 1; l < len(lines); l++ {
+		line := strings.TrimSpace(lines[l])
+		if line == fence || (format == "yaml" && line == "...") {
+			return format, strings.Join(lines[1:l], ""), strings.Join(lines[l+1:], "")
+		}
+	}
+	// without a closing fence, the --- is a thematic break
+	return "", "", text
+}
+
+// frontMatter reads the document's fields from the front matter
+func (i *importDoc) frontMatter(format, matter string) {
+	fields := make(map[string]interface{})
+	switch format {
+	case "yaml":
+		err := yaml.Unmarshal([]byte(matter), &fields)
+		if err != nil {
+			i.warn("The YAML front matter could not be read and was skipped: %s", err)
+			return
+		}
+	case "toml":
+		tree, err := toml.Load(matter)
+		if err != nil {
+			i.warn("The TOML front matter could not be read and was skipped: %s", err)
+			return
+		}
+		fields = tree.ToMap()
+	}
+
+	for key, value := range fields {
+		switch strings.ToLower(key) {
+		case "title":
+			i.title = strings.TrimSpace(fmt.Sprint(value))
+		case "description", "summary":
+			i.summary = strings.Join(strings.Fields(fmt.Sprint(value)), " ")
+		case "tags":
+			i.tags = append(i.tags, frontMatterList(value)...)
+		case "date", "created":
+			i.created = i.frontMatterDate(key, value)
+		case "lastmod", "updated", "modified":
+			i.updated = i.frontMatterDate(key, value)
+		}
+	}
+}
+
+// frontMatterList returns the values of a list, or of a comma separated string
+func frontMatterList(value interface{}) []string {
+	var list []string
+	switch value := value.(type) {
+	case []interface{}:
+		for _, v := range value {
+			list = append(list, fmt.Sprint(v))
+		}
+	case string:
+		list = strings.Split(value, ",")
+	default:
+		list = []string{fmt.Sprint(value)}
+	}
+	return list
+}
+
+func (i *importDoc) frontMatterDate(key string, value interface{}) time.Time {
+	switch value := value.(type) {
+	case time.Time:
+		return value
+	case string:
+		t, err := parseImportDate(value)
+		if err == nil {
+			return t
+		}
+		i.warn("The %s in the front matter was skipped: %s", key, err)
+	default:
+		i.warn("The %s in the front matter was skipped: %v is not a date", key, value)
+	}
+	return time.Time{}
+}
+
+// reFirstHeading matches the start tag of a top level heading, which can have an id
+var reFirstHeading = regexp.MustCompile(`<h1[\s>]`)
+
+// firstHeading returns the text of the first top level heading in the HTML
+func firstHeading(body string) string {
+	start := reFirstHeading.FindStringIndex(body)
+	if start == nil {
+		return ""
+	}
+	end := strings.Index(body[start[0]:], "</h1>")
+	if end == -1 {
+		return ""
+	}
+	return htmlToText(body[start[0] : start[0]+end])
+}
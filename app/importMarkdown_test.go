@@ -0,0 +1,207 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app_test
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lexLibrary/lexLibrary/app"
+)
+
+func TestImportMarkdown(t *testing.T) {
+	resetDocuments(t)
+
+	tenant, err := app.TenantNew(installAdmin(t), "Import Markdown Tenant", "", "")
+	if err != nil {
+		t.Fatalf("Error creating tenant: %s", err)
+	}
+	author := testUser(t, tenant, "author")
+	reader := testUser(t, tenant, "reader")
+
+	files := app.ImportFiles{
+		"guides/setup.md": []byte(`---
+title: Setup Guide
+tags: [Install, "Getting Started"]
+date: 2017-06-01
+lastmod: not a date
+description: How to set up the library.
+---
+# Installing
+
+![Diagram](images/diagram.png) and [the config](../config.yaml#logging) and [again](images/diagram.png).
+[Missing](missing.pdf), [outside](../../secret) and [external](https://example.com).
+`),
+		"guides/images/diagram.png": []byte("not really a png"),
+		"config.yaml":               []byte("Port: 8080"),
+		"notes.md": []byte(`+++
+title = "Notes"
+tags = "one, two"
+date = 2016-01-02T03:04:05Z
++++
+Some notes
+`),
+		"untitled.md": []byte("Just text\n\n# Heading Title\n"),
+		"broken.md":   []byte("---\ntitle: [unclosed\n---\nBody\n"),
+	}
+
+	t.Run("YAML Front Matter", func(t *testing.T) {
+		result, err := app.ImportMarkdown(author, nil, files, "guides/setup.md")
+		if err != nil {
+			t.Fatalf("Error importing markdown: %s", err)
+		}
+		doc := result.Document
+		rev, err := doc.Latest()
+		if err != nil {
+			t.Fatalf("Error getting revision: %s", err)
+		}
+		if rev.Title != "Setup Guide" {
+			t.Fatalf("Invalid title. Wanted %q got %q", "Setup Guide", rev.Title)
+		}
+		if rev.Summary != "How to set up the library." || !rev.SummaryManual {
+			t.Fatalf("Invalid summary: %q", rev.Summary)
+		}
+		if !doc.Created.Equal(time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)) {
+			t.Fatalf("Invalid created date: %s", doc.Created)
+		}
+
+		tags, err := doc.Tags()
+		if err != nil {
+			t.Fatalf("Error getting tags: %s", err)
+		}
+		if len(tags) != 2 || tags[0].Name != "getting started" || tags[1].Name != "install" || tags[0].Automatic {
+			t.Fatalf("Invalid tags: %+v", tags)
+		}
+
+		attachments, err := doc.Attachments()
+		if err != nil {
+			t.Fatalf("Error getting attachments: %s", err)
+		}
+		if len(attachments) != 2 {
+			t.Fatalf("Invalid number of attachments. Wanted %d got %d", 2, len(attachments))
+		}
+		var diagram, config *app.Attachment
+		for _, a := range attachments {
+			switch a.Name {
+			case "diagram.png":
+				diagram = a
+			case "config.yaml":
+				config = a
+			}
+		}
+		if diagram == nil || config == nil {
+			t.Fatalf("Missing attachments: %+v", attachments)
+		}
+		if diagram.ContentType != "image/png" || diagram.Size != int64(len("not really a png")) {
+			t.Fatalf("Invalid attachment: %+v", diagram)
+		}
+
+		r, err := diagram.Open()
+		if err != nil {
+			t.Fatalf("Error opening attachment: %s", err)
+		}
+		content, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("Error reading attachment: %s", err)
+		}
+		if string(content) != "not really a png" {
+			t.Fatalf("Invalid attachment content: %s", content)
+		}
+
+		if strings.Count(rev.Body, `src="`+diagram.URL()+`"`) != 1 ||
+			strings.Count(rev.Body, `href="`+diagram.URL()+`"`) != 1 ||
+			!strings.Contains(rev.Body, `href="`+config.URL()+`#logging"`) {
+			t.Fatalf("Links were not rewritten to attachments: %s", rev.Body)
+		}
+		if !strings.Contains(rev.Body, `href="missing.pdf"`) ||
+			!strings.Contains(rev.Body, `href="https://example.com"`) {
+			t.Fatalf("Links that couldn't be attached were changed: %s", rev.Body)
+		}
+
+		if len(result.Warnings) != 3 {
+			t.Fatalf("Invalid number of warnings. Wanted %d got %d: %v", 3, len(result.Warnings),
+				result.Warnings)
+		}
+	})
+
+	t.Run("TOML Front Matter", func(t *testing.T) {
+		result, err := app.ImportMarkdown(author, nil, files, "notes.md")
+		if err != nil {
+			t.Fatalf("Error importing markdown: %s", err)
+		}
+		rev, err := result.Document.Latest()
+		if err != nil {
+			t.Fatalf("Error getting revision: %s", err)
+		}
+		if rev.Title != "Notes" || rev.Body != "<p>Some notes</p>\n" {
+			t.Fatalf("Invalid revision: %+v", rev)
+		}
+		if !result.Document.Created.Equal(time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)) {
+			t.Fatalf("Invalid created date: %s", result.Document.Created)
+		}
+		tags, err := result.Document.Tags()
+		if err != nil {
+			t.Fatalf("Error getting tags: %s", err)
+		}
+		if len(tags) != 2 || tags[0].Name != "one" || tags[1].Name != "two" {
+			t.Fatalf("Invalid tags: %+v", tags)
+		}
+		if len(result.Warnings) != 0 {
+			t.Fatalf("Unexpected warnings: %v", result.Warnings)
+		}
+	})
+
+	t.Run("Title", func(t *testing.T) {
+		result, err := app.ImportMarkdown(author, nil, files, "untitled.md")
+		if err != nil {
+			t.Fatalf("Error importing markdown: %s", err)
+		}
+		rev, err := result.Document.Latest()
+		if err != nil {
+			t.Fatalf("Error getting revision: %s", err)
+		}
+		if rev.Title != "Heading Title" {
+			t.Fatalf("Title was not taken from the first heading: %q", rev.Title)
+		}
+
+		result, err = app.ImportMarkdown(author, nil, files, "broken.md")
+		if err != nil {
+			t.Fatalf("Error importing markdown: %s", err)
+		}
+		rev, err = result.Document.Latest()
+		if err != nil {
+			t.Fatalf("Error getting revision: %s", err)
+		}
+		if rev.Title != "broken" || rev.Body != "<p>Body</p>\n" || len(result.Warnings) != 1 {
+			t.Fatalf("Invalid front matter was not skipped with a warning: %q %q %v", rev.Title, rev.Body,
+				result.Warnings)
+		}
+	})
+
+	t.Run("Failures", func(t *testing.T) {
+		_, err := app.ImportMarkdown(author, nil, files, "none.md")
+		if !app.IsFailType(err, app.FailNotFound) {
+			t.Fatalf("Expected not found importing a missing file, got %v", err)
+		}
+		_, err = app.ImportMarkdown(author, nil, files, "../outside.md")
+		if !app.IsFailType(err, app.FailInvalid) {
+			t.Fatalf("Expected invalid importing a file outside the source, got %v", err)
+		}
+		_, err = app.ImportMarkdown(nil, nil, files, "notes.md")
+		if !app.IsFailType(err, app.FailUnauthorized) {
+			t.Fatalf("Expected unauthorized importing without a user, got %v", err)
+		}
+
+		collection, err := app.CollectionNew(author, "Imports")
+		if err != nil {
+			t.Fatalf("Error creating collection: %s", err)
+		}
+		_, err = app.ImportMarkdown(reader, collection, files, "notes.md")
+		if !app.IsFailType(err, app.FailForbidden) {
+			t.Fatalf("Expected forbidden importing into a collection without permission, got %v", err)
+		}
+	})
+}
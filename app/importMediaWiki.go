@@ -0,0 +1,351 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+	A MediaWiki XML dump is read twice, as a stream of XML tokens, so dumps of any size can be imported without
+	loading them into memory.  The first pass only collects the titles of the pages and redirects, so every page
+	can be given its new document's id before anything is imported, and links between the pages can point at the
+	documents they'll become.  The second pass converts and imports the pages one at a time.
+
+	Only the pages in the main namespace are imported.  Talk, user, template and other pages aren't documentation,
+	and the files in the file namespace aren't part of a dump.
+*/
+
+// maxMediaWikiRevisions is the most revisions imported for a page.  Older revisions are left out, so a page's
+// history always fits in memory
+const maxMediaWikiRevisions = 100
+
+// mediaWikiPage is a page read from a dump
+type mediaWikiPage struct {
+	title     string
+	namespace int
+	redirect  string
+	revisions []*mediaWikiRevision
+	skipped   int // revisions left out for being older than the latest maxMediaWikiRevisions
+}
+
+// mediaWikiRevision is a revision of a page in a dump
+type mediaWikiRevision struct {
+	Timestamp   string `xml:"timestamp"`
+	Contributor struct {
+		Username string `xml:"username"`
+		IP       string `xml:"ip"`
+	} `xml:"contributor"`
+	Text string `xml:"text"`
+}
+
+// mediaWikiSiteInfo is the information about the wiki at the start of a dump
+type mediaWikiSiteInfo struct {
+	Namespaces []struct {
+		Key  int    `xml:"key,attr"`
+		Name string `xml:",chardata"`
+	} `xml:"namespaces>namespace"`
+}
+
+// mediaWikiImport is the import of a dump
+type mediaWikiImport struct {
+	who        *User
+	collection *Collection
+	source     ImportSource
+	file       string
+
+	namespaces map[string]int
+	ids        map[string]string // the ids of the new documents, by page title
+	redirects  map[string]string // the titles redirects point to, by the title of the redirect
+	authors    *importAuthors
+}
+
+// ImportMediaWiki imports the pages of a MediaWiki XML dump as documents, one per page.  The revisions of each page
+// become the document's revisions, written by the users with the same usernames as their contributors, and the
+// categories of each page become the document's tags.  Links between the imported pages point at their documents.
+//
+// A page that can't be imported is reported with a result without a document.  If the import fails part way
+// through, the results of the pages imported before the failure are returned with the error
+func ImportMediaWiki(who *User, collection *Collection, source ImportSource, name string) ([]*ImportResult, error) {
+	_, err := canCreateDocument(who, collection)
+	if err != nil {
+		return nil, err
+	}
+	name, err = importPath(name)
+	if err != nil {
+		return nil, err
+	}
+	authors, err := newImportAuthors(who)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &mediaWikiImport{
+		who:        who,
+		collection: collection,
+		source:     source,
+		file:       name,
+		namespaces: make(map[string]int),
+		ids:        make(map[string]string),
+		redirects:  make(map[string]string),
+		authors:    authors,
+	}
+
+	err = m.pages(false, func(p *mediaWikiPage) error {
+		if p.namespace != wikiNamespaceMain {
+			return nil
+		}
+		if p.redirect != "" {
+			m.redirects[wikiTitle(p.title)] = wikiTitle(p.redirect)
+			return nil
+		}
+		m.ids[wikiTitle(p.title)] = newID()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*ImportResult
+	err = m.pages(true, func(p *mediaWikiPage) error {
+		if p.namespace != wikiNamespaceMain || p.redirect != "" || len(p.revisions) == 0 {
+			return nil
+		}
+		result, err := m.importPage(p)
+		if IsFail(err) {
+			result = &ImportResult{
+				File:     m.file,
+				Warnings: []string{fmt.Sprintf("The page %s could not be imported: %s", p.title, err)},
+			}
+		} else if err != nil {
+			return err
+		}
+		results = append(results, result)
+		return nil
+	})
+	return results, err
+}
+
+// pages streams the pages of the dump to fn, with their revisions if revisions is true
+func (m *mediaWikiImport) pages(revisions bool, fn func(p *mediaWikiPage) error) error {
+	r, err := m.source.Open(m.file)
+	if os.IsNotExist(err) {
+		return NotFound(fmt.Sprintf("%s was not found", m.file))
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	invalid := func(err error) error {
+		return NewFailure(fmt.Sprintf("%s is not a valid MediaWiki XML dump: %s", m.file, err))
+	}
+
+	d := xml.NewDecoder(r)
+	var page *mediaWikiPage
+	dump := false
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return invalid(err)
+		}
+
+		switch t := t.(type) {
+		case xml.StartElement:
+			if !dump {
+				if t.Name.Local != "mediawiki" {
+					return invalid(fmt.Errorf("the root element is %s instead of mediawiki", t.Name.Local))
+				}
+				dump = true
+				continue
+			}
+			switch t.Name.Local {
+			case "siteinfo":
+				info := &mediaWikiSiteInfo{}
+				err = d.DecodeElement(info, &t)
+				if err != nil {
+					return invalid(err)
+				}
+				for _, ns := range info.Namespaces {
+					if ns.Name != "" {
+						m.namespaces[strings.ToLower(ns.Name)] = ns.Key
+					}
+				}
+			case "page":
+				page = &mediaWikiPage{}
+			case "title", "ns":
+				if page == nil {
+					continue
+				}
+				value := ""
+				err = d.DecodeElement(&value, &t)
+				if err != nil {
+					return invalid(err)
+				}
+				if t.Name.Local == "title" {
+					page.title = strings.TrimSpace(value)
+				} else {
+					fmt.Sscan(value, &page.namespace)
+				}
+			case "redirect":
+				if page == nil {
+					continue
+				}
+				for _, a := range t.Attr {
+					if a.Name.Local == "title" {
+						page.redirect = a.Value
+					}
+				}
+			case "revision":
+				if page == nil || !revisions {
+					err = d.Skip()
+					if err != nil {
+						return invalid(err)
+					}
+					continue
+				}
+				rev := &mediaWikiRevision{}
+				err = d.DecodeElement(rev, &t)
+				if err != nil {
+					return invalid(err)
+				}
+				page.revisions = append(page.revisions, rev)
+				if len(page.revisions) > maxMediaWikiRevisions {
+					page.revisions[0] = nil
+					page.revisions = page.revisions[1:]
+					page.skipped++
+				}
+			}
+		case xml.EndElement:
+			if t.Name.Local == "page" && page != nil {
+				err = fn(page)
+				if err != nil {
+					return err
+				}
+				page = nil
+			}
+		}
+	}
+	if !dump {
+		return invalid(fmt.Errorf("the file is empty"))
+	}
+	return nil
+}
+
+// link returns the link to the document imported from the page with the title, following redirects
+func (m *mediaWikiImport) link(title string) (string, bool) {
+	title = wikiTitle(title)
+	for i := 0; i < 10; i++ {
+		target, ok := m.redirects[title]
+		if !ok {
+			break
+		}
+		title = target
+	}
+	id, ok := m.ids[title]
+	if !ok {
+		return "", false
+	}
+	return documentLink(id), true
+}
+
+// importPage converts the revisions of the page and imports it as a document
+func (m *mediaWikiImport) importPage(p *mediaWikiPage) (*ImportResult, error) {
+	i := newImportDoc(m.source, m.file)
+	i.id = m.ids[wikiTitle(p.title)]
+	i.title = p.title
+
+	// revisions in a dump are usually oldest first, but nothing guarantees it
+	created := make([]time.Time, len(p.revisions))
+	for r := range p.revisions {
+		t, err := time.Parse(time.RFC3339, strings.TrimSpace(p.revisions[r].Timestamp))
+		if err != nil {
+			i.warn("The revision of %s with the timestamp %q was imported as written now", p.title,
+				p.revisions[r].Timestamp)
+			t = time.Now()
+		}
+		created[r] = t
+	}
+	sort.Stable(mediaWikiHistory{p.revisions, created})
+
+	var unknown []string
+	var latest *wikiConverter
+	for r, rev := range p.revisions {
+		if len(rev.Text) > maxImportFileSize {
+			return nil, NewFailure(fmt.Sprintf("The page %s is too large to import", p.title))
+		}
+		author, err := m.authors.id(rev.Contributor.Username)
+		if err != nil {
+			return nil, err
+		}
+		if author == "" {
+			contributor := rev.Contributor.Username
+			if contributor == "" {
+				contributor = rev.Contributor.IP
+			}
+			unknown = append(unknown, contributor)
+		}
+
+		w := newWikiConverter(m.namespaces, m.link)
+		body := w.convert(rev.Text)
+		if r < len(p.revisions)-1 {
+			i.history = append(i.history, &Revision{
+				Title:   p.title,
+				Body:    body,
+				Author:  author,
+				Created: created[r],
+			})
+			continue
+		}
+		latest = w
+		i.body = body
+		i.author = author
+		i.updated = created[r]
+	}
+	i.created = created[0]
+	i.tags = latest.categories
+
+	if p.skipped > 0 {
+		i.warn("%s had more than %d revisions, the %d oldest were left out", p.title, maxMediaWikiRevisions,
+			p.skipped)
+	}
+	if unknown = uniqueSorted(unknown); len(unknown) > 0 {
+		i.warn("The revisions of %s by %s were attributed to you, because no user has the same username",
+			p.title, strings.Join(unknown, ", "))
+	}
+	if templates := uniqueSorted(latest.templates); len(templates) > 0 {
+		i.warn("The templates %s on %s were left as placeholders", strings.Join(templates, ", "), p.title)
+	}
+	if files := uniqueSorted(latest.files); len(files) > 0 {
+		i.warn("The files %s on %s aren't part of the dump and were left as placeholders",
+			strings.Join(files, ", "), p.title)
+	}
+	if missing := uniqueSorted(latest.missing); len(missing) > 0 {
+		i.warn("The links on %s to %s were left as text, because those pages weren't imported", p.title,
+			strings.Join(missing, ", "))
+	}
+
+	return i.create(m.who, m.collection)
+}
+
+// mediaWikiHistory sorts the revisions of a page by when they were created
+type mediaWikiHistory struct {
+	revisions []*mediaWikiRevision
+	created   []time.Time
+}
+
+func (h mediaWikiHistory) Len() int           { return len(h.revisions) }
+func (h mediaWikiHistory) Less(a, b int) bool { return h.created[a].Before(h.created[b]) }
+func (h mediaWikiHistory) Swap(a, b int) {
+	h.revisions[a], h.revisions[b] = h.revisions[b], h.revisions[a]
+	h.created[a], h.created[b] = h.created[b], h.created[a]
+}
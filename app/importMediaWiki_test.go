@@ -0,0 +1,160 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lexLibrary/lexLibrary/app"
+)
+
+func TestImportMediaWiki(t *testing.T) {
+	resetDocuments(t)
+
+	tenant, err := app.TenantNew(installAdmin(t), "Import MediaWiki Tenant", "", "")
+	if err != nil {
+		t.Fatalf("Error creating tenant: %s", err)
+	}
+	importer := testUser(t, tenant, "importer")
+	author := testUser(t, tenant, "author")
+	fixtures := app.ImportDir("testdata/import")
+
+	results, err := app.ImportMediaWiki(importer, nil, fixtures, "wiki.xml")
+	if err != nil {
+		t.Fatalf("Error importing wiki.xml: %s", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 pages to be imported, got %d", len(results))
+	}
+	pump, seals := results[0].Document, results[1].Document
+
+	t.Run("Page", func(t *testing.T) {
+		rev, err := pump.Latest()
+		if err != nil {
+			t.Fatalf("Error getting revision: %s", err)
+		}
+		if rev.Title != "Pump maintenance" {
+			t.Fatalf("Invalid title: %q", rev.Title)
+		}
+
+		body := strings.NewReplacer("SEALS", "../"+seals.ID+"/").Replace(`<p><code>{{Infobox pump}}</code>
+<b>Always</b> switch the pump off <i>first</i>.<sup><a href="#cite-note-1">[1]</a></sup></p>
+<h2 id="Parts">Parts</h2>
+<ul>
+<li><a href="SEALS">Seals</a>
+<ul>
+<li><a href="SEALS">Old</a> ones</li>
+</ul>
+</li>
+<li>Nowhere &amp; gaskets</li>
+</ul>
+<ol>
+<li>One</li>
+<li>Two</li>
+</ol>
+<dl>
+<dt>Term</dt>
+<dd>Definition</dd>
+</dl>
+<table>
+<caption>Sizes</caption>
+<tbody><tr>
+<th>Size</th>
+<th>Flow</th>
+</tr>
+<tr>
+<td>Small</td>
+<td>5</td>
+</tr>
+<tr>
+<td colspan="2">Large &lt;script&gt;</td>
+</tr>
+</tbody></table>
+<pre>x = 1</pre>
+<p><code>[[Datei:Pump.png]]</code>
+''raw'' see <a href="#Parts">#Parts</a></p>
+<ol>
+<li id="cite-note-1">See <a href="http://example.com/manual">the manual</a>.</li>
+</ol>
+`)
+		if rev.Body != body {
+			t.Fatalf("Invalid body. Wanted:\n%s\nGot:\n%s", body, rev.Body)
+		}
+
+		tags, err := pump.Tags()
+		if err != nil {
+			t.Fatalf("Error getting tags: %s", err)
+		}
+		if len(tags) != 2 || tags[0].Name != "maintenance" || tags[1].Name != "pumps" {
+			t.Fatalf("Invalid tags: %+v", tags)
+		}
+
+		warnings := strings.Join(results[0].Warnings, "\n")
+		for _, warning := range []string{"OldAdmin", "Infobox pump", "Pump.png", "Nowhere"} {
+			if !strings.Contains(warnings, warning) {
+				t.Fatalf("Expected a warning about %s, got %q", warning, results[0].Warnings)
+			}
+		}
+	})
+
+	t.Run("Revisions", func(t *testing.T) {
+		revisions, err := pump.Revisions(0, 10)
+		if err != nil {
+			t.Fatalf("Error getting revisions: %s", err)
+		}
+		if len(revisions) != 2 {
+			t.Fatalf("Expected 2 revisions, got %d", len(revisions))
+		}
+		first, latest := revisions[1], revisions[0]
+		if first.Author != author.ID || !first.Created.Equal(time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)) {
+			t.Fatalf("Invalid first revision: %+v", first)
+		}
+		if latest.Author != importer.ID || !latest.Created.Equal(time.Date(2016, 2, 3, 4, 5, 6, 0, time.UTC)) {
+			t.Fatalf("Invalid latest revision: %+v", latest)
+		}
+		if !pump.Created.Equal(first.Created) || !pump.Updated.Equal(latest.Created) {
+			t.Fatalf("Invalid document dates: %s %s", pump.Created, pump.Updated)
+		}
+
+		rev, err := pump.Revision(1)
+		if err != nil {
+			t.Fatalf("Error getting revision: %s", err)
+		}
+		if rev.Body != "<p>Switch it off first.</p>\n" {
+			t.Fatalf("Invalid first revision body: %q", rev.Body)
+		}
+
+		rev, err = seals.Latest()
+		if err != nil {
+			t.Fatalf("Error getting revision: %s", err)
+		}
+		link := `<a href="../` + pump.ID + `/#Parts">pump_maintenance#Parts</a>`
+		if !strings.Contains(rev.Body, link) {
+			t.Fatalf("Body is missing the link %s:\n%s", link, rev.Body)
+		}
+		if !strings.Contains(strings.Join(results[1].Warnings, "\n"), "203.0.113.5") {
+			t.Fatalf("Expected a warning about the anonymous revision, got %q", results[1].Warnings)
+		}
+	})
+
+	t.Run("Invalid Files", func(t *testing.T) {
+		files := app.ImportFiles{
+			"empty.xml": []byte(""),
+			"html.xml":  []byte("<html><body></body></html>"),
+			"bad.xml":   []byte("<mediawiki><page><title>Broken</page></mediawiki>"),
+		}
+		for file := range files {
+			_, err := app.ImportMediaWiki(importer, nil, files, file)
+			if !app.IsFailType(err, app.FailInvalid) {
+				t.Fatalf("Expected invalid failure importing %s, got %v", file, err)
+			}
+		}
+
+		_, err := app.ImportMediaWiki(importer, nil, fixtures, "missing.xml")
+		if !app.IsFailType(err, app.FailNotFound) {
+			t.Fatalf("Expected not found importing missing.xml, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,230 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html/atom"
+)
+
+/*
+	Jupyter notebooks are JSON files holding a list of cells.  Markdown cells are converted like any other markdown,
+	and code cells become code blocks in the notebook's language, followed by the outputs saved with them.  Text
+	output is kept as preformatted text, HTML output as HTML, and images are added to the document as attachments.
+
+	Only version 4 notebooks, the format every Jupyter release since 2015 writes, are imported.
+*/
+
+// notebookImages are the image outputs kept, by MIME type, with the extension of the attachment they become
+var notebookImages = []struct{ mimeType, extension string }{
+	{"image/png", ".png"},
+	{"image/jpeg", ".jpg"},
+	{"image/gif", ".gif"},
+	{"image/svg+xml", ".svg"},
+}
+
+// reANSI matches the terminal escape codes that color text output and tracebacks
+var reANSI = regexp.MustCompile("\x1b\\[[0-9;]*[A-Za-z]")
+
+// notebookText is text in a notebook, which is either a string or a list of lines
+type notebookText string
+
+func (t *notebookText) UnmarshalJSON(b []byte) error {
+	var lines []string
+	if json.Unmarshal(b, &lines) == nil {
+		*t = notebookText(strings.Join(lines, ""))
+		return nil
+	}
+	var text string
+	err := json.Unmarshal(b, &text)
+	if err != nil {
+		return err
+	}
+	*t = notebookText(text)
+	return nil
+}
+
+type notebook struct {
+	Format   int `json:"nbformat"`
+	Metadata struct {
+		Title      string   `json:"title"`
+		Tags       []string `json:"tags"`
+		KernelSpec struct {
+			Language string `json:"language"`
+		} `json:"kernelspec"`
+		LanguageInfo struct {
+			Name string `json:"name"`
+		} `json:"language_info"`
+	} `json:"metadata"`
+	Cells []struct {
+		Type        string                             `json:"cell_type"`
+		Source      notebookText                       `json:"source"`
+		Attachments map[string]map[string]notebookText `json:"attachments"`
+		Outputs     []struct {
+			Type      string                  `json:"output_type"`
+			Text      notebookText            `json:"text"`
+			Data      map[string]notebookText `json:"data"`
+			Name      string                  `json:"ename"`
+			Value     string                  `json:"evalue"`
+			Traceback []string                `json:"traceback"`
+		} `json:"outputs"`
+	} `json:"cells"`
+}
+
+// ImportNotebook imports a Jupyter notebook as a new document in the collection, or outside of any collection if
+// collection is nil
+func ImportNotebook(who *User, collection *Collection, source ImportSource, name string) (*ImportResult, error) {
+	_, err := canCreateDocument(who, collection)
+	if err != nil {
+		return nil, err
+	}
+	name, err = importPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	i := newImportDoc(source, name)
+	file, err := i.readBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	nb := &notebook{}
+	err = json.Unmarshal(file, nb)
+	if err != nil {
+		return nil, NewFailure(fmt.Sprintf("%s is not a valid Jupyter notebook: %s", name, err))
+	}
+	if nb.Format < 4 {
+		return nil, NewFailure(fmt.Sprintf("%s is a version %d notebook, only version 4 notebooks can be imported",
+			name, nb.Format))
+	}
+
+	i.notebook(who, nb)
+	return i.create(who, collection)
+}
+
+// notebook sets the document's fields from the notebook
+func (i *importDoc) notebook(who *User, nb *notebook) {
+	language := strings.ToLower(nb.Metadata.LanguageInfo.Name)
+	if language == "" {
+		language = strings.ToLower(nb.Metadata.KernelSpec.Language)
+	}
+	i.title = strings.TrimSpace(nb.Metadata.Title)
+	i.tags = nb.Metadata.Tags
+
+	buf := &bytes.Buffer{}
+	images := 0
+	for c, cell := range nb.Cells {
+		switch cell.Type {
+		case "markdown":
+			body := markdownToHTML(string(cell.Source))
+			body = rewriteLinks(body, func(element atom.Atom, link string) (string, bool) {
+				name := strings.TrimPrefix(link, "attachment:")
+				if name == link {
+					return "", false
+				}
+				for mimeType, data := range cell.Attachments[name] {
+					return i.embedData(who, fmt.Sprintf("cell-%d/%s", c+1, name), name, mimeType, string(data))
+				}
+				i.warn("The attachment %s in cell %d is missing, and was skipped", name, c+1)
+				return "", false
+			})
+			buf.WriteString(body)
+		case "code":
+			if strings.TrimSpace(string(cell.Source)) == "" {
+				continue
+			}
+			buf.WriteString("<pre><code")
+			if language != "" {
+				buf.WriteString(` class="language-` + escapeHTML(language) + `"`)
+			}
+			buf.WriteString(">" + escapeHTML(strings.TrimRight(string(cell.Source), "\n")) + "</code></pre>\n")
+
+			for _, output := range cell.Outputs {
+				switch output.Type {
+				case "stream":
+					writeNotebookText(buf, string(output.Text))
+				case "error":
+					text := output.Name + ": " + output.Value
+					if len(output.Traceback) > 0 {
+						text = strings.Join(output.Traceback, "\n")
+					}
+					writeNotebookText(buf, text)
+				case "execute_result", "display_data":
+					images += i.notebookOutput(who, buf, output.Data, c, images)
+				}
+			}
+		case "raw":
+			writeNotebookText(buf, string(cell.Source))
+		}
+	}
+	i.body = buf.String()
+	if i.title == "" {
+		i.title = firstHeading(i.body)
+	}
+}
+
+// notebookOutput writes the richest output of the data that can be kept, and returns the number of images written
+func (i *importDoc) notebookOutput(who *User, buf *bytes.Buffer, data map[string]notebookText, cell, images int) int {
+	for _, image := range notebookImages {
+		content, ok := data[image.mimeType]
+		if !ok {
+			continue
+		}
+		name := fmt.Sprintf("output-%d%s", images+1, image.extension)
+		link, ok := i.embedData(who, name, name, image.mimeType, string(content))
+		if !ok {
+			break
+		}
+		buf.WriteString(`<p><img src="` + escapeHTML(link) + `" alt="Output of cell ` + fmt.Sprint(cell+1) +
+			`" /></p>` + "\n")
+		return 1
+	}
+	if html, ok := data["text/html"]; ok {
+		buf.WriteString("<div>" + string(html) + "</div>\n")
+		return 0
+	}
+	if text, ok := data["text/plain"]; ok {
+		writeNotebookText(buf, string(text))
+	}
+	return 0
+}
+
+func writeNotebookText(buf *bytes.Buffer, text string) {
+	text = strings.TrimRight(reANSI.ReplaceAllString(text, ""), "\n")
+	if text != "" {
+		buf.WriteString("<pre>" + escapeHTML(text) + "</pre>\n")
+	}
+}
+
+// embedData attaches a file stored in the notebook, and returns the link to the attachment.  SVG images are stored
+// as text, and every other file base64 encoded
+func (i *importDoc) embedData(who *User, key, name, mimeType, data string) (string, bool) {
+	key = path.Join(i.file, key)
+	a, ok := i.attachments[key]
+	if !ok {
+		var err error
+		file := []byte(data)
+		if mimeType != "image/svg+xml" {
+			file, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(data), ""))
+			if err != nil {
+				i.warn("The embedded file %s could not be read, and was skipped", name)
+				return "", false
+			}
+		}
+		a, err = newAttachment(who, name, bytes.NewReader(file))
+		if err != nil {
+			i.warn("The embedded file %s could not be attached: %s", name, err)
+			return "", false
+		}
+		i.attachments[key] = a
+	}
+	return a.URL(), true
+}
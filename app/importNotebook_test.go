@@ -0,0 +1,93 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/lexLibrary/lexLibrary/app"
+)
+
+func TestImportNotebook(t *testing.T) {
+	resetDocuments(t)
+
+	tenant, err := app.TenantNew(installAdmin(t), "Import Notebook Tenant", "", "")
+	if err != nil {
+		t.Fatalf("Error creating tenant: %s", err)
+	}
+	author := testUser(t, tenant, "author")
+	fixtures := app.ImportDir("testdata/import")
+
+	result, err := app.Import(author, nil, fixtures, "notebook.ipynb")
+	if err != nil {
+		t.Fatalf("Error importing notebook.ipynb: %s", err)
+	}
+	if len(result.Warnings) != 0 {
+		t.Fatalf("Unexpected warnings: %q", result.Warnings)
+	}
+
+	doc := result.Document
+	rev, err := doc.Latest()
+	if err != nil {
+		t.Fatalf("Error getting revision: %s", err)
+	}
+	if rev.Title != "Pump Analysis" {
+		t.Fatalf("Invalid title: %q", rev.Title)
+	}
+
+	tags, err := doc.Tags()
+	if err != nil {
+		t.Fatalf("Error getting tags: %s", err)
+	}
+	if len(tags) != 2 || tags[0].Name != "analysis" || tags[1].Name != "pumps" {
+		t.Fatalf("Invalid tags: %+v", tags)
+	}
+
+	attachments, err := doc.Attachments()
+	if err != nil {
+		t.Fatalf("Error getting attachments: %s", err)
+	}
+	images := make(map[string]string)
+	for _, a := range attachments {
+		if a.ContentType != "image/png" {
+			t.Fatalf("Invalid attachment: %+v", a)
+		}
+		images[a.Name] = a.URL()
+	}
+	if len(images) != 2 || images["diagram.png"] == "" || images["output-1.png"] == "" {
+		t.Fatalf("Invalid attachments: %+v", attachments)
+	}
+
+	for _, want := range []string{
+		"<p>Flow rates for the <strong>pump</strong>.</p>",
+		`<img src="` + images["diagram.png"] + `" alt="diagram" />`,
+		"<pre><code class=\"language-python\">rates = [1, 2, 3]\nprint(sum(rates) &lt; 10)</code></pre>\n<pre>True</pre>",
+		"<pre>[1, 2, 3]</pre>",
+		`<img src="` + images["output-1.png"] + `" alt="Output of cell 4" />`,
+		"<div><table><tbody><tr><td>1</td></tr></tbody></table></div>",
+		"<pre>ZeroDivisionError Traceback (most recent call last)\nZeroDivisionError: division by zero</pre>",
+		"<pre>raw &lt;text&gt;</pre>",
+	} {
+		if !strings.Contains(rev.Body, want) {
+			t.Fatalf("Body is missing %s:\n%s", want, rev.Body)
+		}
+	}
+	if strings.Contains(rev.Body, "&lt;Figure&gt;") || strings.Contains(rev.Body, "<pre>table</pre>") {
+		t.Fatalf("Body has the plain text of rich output:\n%s", rev.Body)
+	}
+
+	t.Run("Invalid Files", func(t *testing.T) {
+		files := app.ImportFiles{
+			"text.ipynb": []byte("not json"),
+			"v3.ipynb":   []byte(`{"nbformat": 3, "worksheets": []}`),
+			"notes.txt":  []byte("plain text"),
+		}
+		for _, file := range []string{"text.ipynb", "v3.ipynb", "notes.txt"} {
+			_, err := app.Import(author, nil, files, file)
+			if !app.IsFailType(err, app.FailInvalid) {
+				t.Fatalf("Expected invalid failure importing %s, got %v", file, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,509 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"path"
+	"strconv"
+	"strings"
+)
+
+// XML namespaces of the parts of an ODT file
+const (
+	nsODTOffice = "urn:oasis:names:tc:opendocument:xmlns:office:1.0"
+	nsODTStyle  = "urn:oasis:names:tc:opendocument:xmlns:style:1.0"
+	nsODTText   = "urn:oasis:names:tc:opendocument:xmlns:text:1.0"
+	nsODTTable  = "urn:oasis:names:tc:opendocument:xmlns:table:1.0"
+	nsODTDraw   = "urn:oasis:names:tc:opendocument:xmlns:drawing:1.0"
+	nsODTFO     = "urn:oasis:names:tc:opendocument:xmlns:xsl-fo-compatible:1.0"
+	nsODTSVG    = "urn:oasis:names:tc:opendocument:xmlns:svg-compatible:1.0"
+	nsODTMeta   = "urn:oasis:names:tc:opendocument:xmlns:meta:1.0"
+	nsXLink     = "http://www.w3.org/1999/xlink"
+)
+
+// maxODTRepeat is the most times a repeated table row or cell is repeated.  Spreadsheet-like tables repeat empty
+// cells to the edge of the sheet
+const maxODTRepeat = 100
+
+// odtStyle is a paragraph or text style in an ODT file
+type odtStyle struct {
+	name        string
+	displayName string
+	parent      string
+	format      officeFormat
+}
+
+// odtReader converts the content of an ODT file to HTML
+type odtReader struct {
+	i          *importDoc
+	who        *User
+	zip        *officeZip
+	styles     map[string]*odtStyle
+	lists      map[string]map[int]bool // whether each level of each list style is ordered
+	fixedFonts map[string]bool
+	warned     map[string]bool
+}
+
+// ImportODT imports an OpenDocument text file, as written by LibreOffice, from the source as a new document, in
+// the collection if it isn't nil
+func ImportODT(who *User, collection *Collection, source ImportSource, name string) (*ImportResult, error) {
+	_, err := canCreateDocument(who, collection)
+	if err != nil {
+		return nil, err
+	}
+	name, err = importPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	i := newImportDoc(source, name)
+	file, err := i.readBytes()
+	if err != nil {
+		return nil, err
+	}
+	z, err := i.openZip(file)
+	if err != nil {
+		return nil, err
+	}
+
+	err = i.odt(who, z)
+	if err != nil {
+		i.release()
+		return nil, err
+	}
+	return i.create(who, collection)
+}
+
+// odt sets the fields and body of the document from an ODT file
+func (i *importDoc) odt(who *User, z *officeZip) error {
+	content, err := z.xml("content.xml")
+	if err != nil {
+		return err
+	}
+	text := content.path(nsODTOffice, "document-content", "body", "text")
+	if text == nil {
+		return NewFailure(i.file + " is not a valid ODT file")
+	}
+
+	r := &odtReader{
+		i:          i,
+		who:        who,
+		zip:        z,
+		styles:     make(map[string]*odtStyle),
+		lists:      make(map[string]map[int]bool),
+		fixedFonts: make(map[string]bool),
+		warned:     make(map[string]bool),
+	}
+	styles, err := z.xml("styles.xml")
+	if err != nil {
+		return err
+	}
+	// the styles in the content refer to the styles in styles.xml, so those are read first
+	for _, doc := range []*xmlNode{styles.child(nsODTOffice, "document-styles"),
+		content.child(nsODTOffice, "document-content")} {
+		r.readFonts(doc.child(nsODTOffice, "font-face-decls"))
+		r.readStyles(doc.child(nsODTOffice, "styles"))
+		r.readStyles(doc.child(nsODTOffice, "automatic-styles"))
+	}
+
+	err = i.odtMeta(z)
+	if err != nil {
+		return err
+	}
+
+	w := &officeWriter{}
+	r.blocks(text, w)
+	i.body = w.html()
+	if i.title == "" {
+		i.title = firstHeading(i.body)
+	}
+	return nil
+}
+
+// odtMeta reads the title, description, keywords and dates from the document's metadata
+func (i *importDoc) odtMeta(z *officeZip) error {
+	doc, err := z.xml("meta.xml")
+	if err != nil || doc == nil {
+		return err
+	}
+	meta := doc.path(nsODTOffice, "document-meta", "meta")
+	i.title = strings.TrimSpace(meta.child(nsDublinCore, "title").text())
+	i.summary = strings.Join(strings.Fields(meta.child(nsDublinCore, "description").text()), " ")
+	if meta != nil {
+		for _, c := range meta.Children {
+			if c.is(nsODTMeta, "keyword") {
+				i.tags = append(i.tags, splitKeywords(c.text())...)
+			}
+		}
+	}
+	i.officeDate("creation", meta.child(nsODTMeta, "creation-date").text(), &i.created)
+	i.officeDate("modified", meta.child(nsDublinCore, "date").text(), &i.updated)
+	return nil
+}
+
+func (r *odtReader) readFonts(decls *xmlNode) {
+	if decls == nil {
+		return
+	}
+	for _, f := range decls.Children {
+		if f.is(nsODTStyle, "font-face") {
+			r.fixedFonts[f.attr(nsODTStyle, "name")] = f.attr(nsODTStyle, "font-pitch") == "fixed" ||
+				isMonospace(f.attr(nsODTSVG, "font-family"))
+		}
+	}
+}
+
+func (r *odtReader) readStyles(styles *xmlNode) {
+	if styles == nil {
+		return
+	}
+	for _, s := range styles.Children {
+		switch {
+		case s.is(nsODTStyle, "style"):
+			name := s.attr(nsODTStyle, "name")
+			r.styles[name] = &odtStyle{
+				name:        name,
+				displayName: s.attr(nsODTStyle, "display-name"),
+				parent:      s.attr(nsODTStyle, "parent-style-name"),
+				format:      r.format(s.child(nsODTStyle, "text-properties")),
+			}
+		case s.is(nsODTText, "list-style"):
+			levels := make(map[int]bool)
+			for _, l := range s.Children {
+				level, err := strconv.Atoi(l.attr(nsODTText, "level"))
+				if err != nil {
+					continue
+				}
+				levels[level-1] = l.is(nsODTText, "list-level-style-number")
+			}
+			r.lists[s.attr(nsODTStyle, "name")] = levels
+		}
+	}
+}
+
+// format returns the formatting of a style's text properties
+func (r *odtReader) format(props *xmlNode) officeFormat {
+	format := officeFormat{}
+	if props == nil {
+		return format
+	}
+	weight := props.attr(nsODTFO, "font-weight")
+	if n, err := strconv.Atoi(weight); weight == "bold" || (err == nil && n >= 600) {
+		format.bold = true
+	}
+	if style := props.attr(nsODTFO, "font-style"); style == "italic" || style == "oblique" {
+		format.italic = true
+	}
+	if u := props.attr(nsODTStyle, "text-underline-style"); u != "" && u != "none" {
+		format.underline = true
+	}
+	if s := props.attr(nsODTStyle, "text-line-through-style"); s != "" && s != "none" {
+		format.strike = true
+	}
+	position := props.attr(nsODTStyle, "text-position")
+	switch {
+	case strings.HasPrefix(position, "super"):
+		format.position = "sup"
+	case strings.HasPrefix(position, "sub"), strings.HasPrefix(position, "-"):
+		format.position = "sub"
+	case position != "" && !strings.HasPrefix(position, "0"):
+		format.position = "sup"
+	}
+	if font := props.attr(nsODTStyle, "font-name"); font != "" && (r.fixedFonts[font] || isMonospace(font)) {
+		format.code = true
+	}
+	return format
+}
+
+// paragraphStyle returns the element of a paragraph from its style, following the styles it inherits from
+func (r *odtReader) paragraphStyle(name string) (element string, title bool) {
+	for depth := 0; name != "" && depth < 10; depth++ {
+		style, ok := r.styles[name]
+		if !ok {
+			break
+		}
+		display := style.displayName
+		if display == "" {
+			display = style.name
+		}
+		element, title = styleStructure(display)
+		if element != "" {
+			break
+		}
+		name = style.parent
+	}
+	return element, title
+}
+
+// textFormat returns the formatting of a text style, following the styles it inherits from
+func (r *odtReader) textFormat(name string, format officeFormat) officeFormat {
+	var chain []*odtStyle
+	for depth := 0; name != "" && depth < 10; depth++ {
+		style, ok := r.styles[name]
+		if !ok {
+			break
+		}
+		chain = append(chain, style)
+		name = style.parent
+	}
+	for c := len(chain) - 1; c >= 0; c-- {
+		f := chain[c].format
+		format.bold = format.bold || f.bold
+		format.italic = format.italic || f.italic
+		format.underline = format.underline || f.underline
+		format.strike = format.strike || f.strike
+		format.code = format.code || f.code
+		if f.position != "" {
+			format.position = f.position
+		}
+		display := chain[c].displayName
+		if display == "" {
+			display = chain[c].name
+		}
+		if element, _ := styleStructure(display); element == "pre" {
+			format.code = true
+		}
+	}
+	return format
+}
+
+func (r *odtReader) warnOnce(format string, args ...interface{}) {
+	if r.warned[format] {
+		return
+	}
+	r.warned[format] = true
+	r.i.warn(format, args...)
+}
+
+// blocks writes the headings, paragraphs, lists and tables in the text, section or table cell
+func (r *odtReader) blocks(n *xmlNode, w *officeWriter) {
+	for _, c := range n.Children {
+		switch {
+		case c.is(nsODTText, "h"):
+			level, err := strconv.Atoi(c.attr(nsODTText, "outline-level"))
+			if err != nil || level < 1 {
+				level = 1
+			}
+			w.paragraph(headingElement(level), r.inlineHTML(c, false))
+		case c.is(nsODTText, "p"):
+			r.paragraph(c, w)
+		case c.is(nsODTText, "list"):
+			r.list(c, w, 0, c.attr(nsODTText, "style-name"))
+		case c.is(nsODTTable, "table"):
+			r.table(c, w)
+		case c.is(nsODTText, "section"), c.is(nsODTText, "table-of-content"), c.is(nsODTText, "index-body"),
+			c.is(nsODTText, "alphabetical-index"), c.is(nsODTText, "illustration-index"):
+			r.blocks(c, w)
+		}
+	}
+}
+
+func (r *odtReader) paragraph(p *xmlNode, w *officeWriter) {
+	element, title := r.paragraphStyle(p.attr(nsODTText, "style-name"))
+	content := r.inlineHTML(p, element == "pre")
+	if title && r.i.title == "" {
+		r.i.title = htmlToText(content)
+	}
+	if element == "" {
+		element = "p"
+	}
+	w.paragraph(element, content)
+}
+
+// list writes the items of the list at the level, starting at 0.  Nested lists without a style use the style of
+// the list they're in
+func (r *odtReader) list(list *xmlNode, w *officeWriter, level int, style string) {
+	if s := list.attr(nsODTText, "style-name"); s != "" {
+		style = s
+	}
+	ordered := r.lists[style][level]
+
+	for _, item := range list.Children {
+		if !item.is(nsODTText, "list-item") && !item.is(nsODTText, "list-header") {
+			continue
+		}
+		first := true
+		for _, c := range item.Children {
+			switch {
+			case c.is(nsODTText, "p"), c.is(nsODTText, "h"):
+				content := r.inlineHTML(c, false)
+				if first {
+					w.listItem(style, level, ordered, content)
+					first = false
+				} else {
+					w.listParagraph(content)
+				}
+			case c.is(nsODTText, "list"):
+				if first {
+					w.listItem(style, level, ordered, "")
+					first = false
+				}
+				r.list(c, w, level+1, style)
+			}
+		}
+	}
+}
+
+// inlineHTML returns the HTML of the text, spans, links and images in a paragraph.  In a code block the text
+// isn't marked as code, because the whole block is
+func (r *odtReader) inlineHTML(p *xmlNode, code bool) string {
+	o := &officeInline{}
+	// paragraph styles set the look of the whole paragraph, like bold headings, which isn't kept
+	r.inline(p, o, officeFormat{}, code)
+	return o.html()
+}
+
+func (r *odtReader) inline(n *xmlNode, o *officeInline, format officeFormat, code bool) {
+	if code {
+		format.code = false
+	}
+
+	for _, c := range n.Children {
+		switch {
+		case c.Name.Local == "":
+			o.write(format, c.Text)
+		case c.is(nsODTText, "span"):
+			r.inline(c, o, r.textFormat(c.attr(nsODTText, "style-name"), format), code)
+		case c.is(nsODTText, "a"):
+			href := c.attr(nsXLink, "href")
+			if href == "" {
+				r.inline(c, o, format, code)
+				continue
+			}
+			o.raw(`<a href="` + escapeHTML(href) + `">`)
+			r.inline(c, o, format, code)
+			o.raw("</a>")
+		case c.is(nsODTText, "s"):
+			count, err := strconv.Atoi(c.attr(nsODTText, "c"))
+			if err != nil || count < 1 {
+				count = 1
+			}
+			o.write(format, strings.Repeat(" ", count))
+		case c.is(nsODTText, "tab"):
+			o.write(format, "\t")
+		case c.is(nsODTText, "line-break"):
+			if code {
+				o.write(format, "\n")
+			} else {
+				o.raw("<br />")
+			}
+		case c.is(nsODTText, "bookmark"), c.is(nsODTText, "bookmark-start"):
+			if name := c.attr(nsODTText, "name"); name != "" {
+				o.raw(`<a name="` + escapeHTML(name) + `"></a>`)
+			}
+		case c.is(nsODTDraw, "frame"):
+			r.frame(c, o)
+		case c.is(nsODTDraw, "a"):
+			r.inline(c, o, format, code)
+		case c.is(nsODTText, "note"), c.is(nsODTOffice, "annotation"), c.is(nsODTText, "bookmark-end"),
+			c.is(nsODTText, "soft-page-break"), c.Name.Space == nsODTDraw:
+			// footnotes, comments and shapes aren't kept
+		default:
+			// fields like dates and page numbers, and anything else, are replaced by their text
+			r.inline(c, o, format, code)
+		}
+	}
+}
+
+// frame attaches the image in a frame, and adds it to the paragraph
+func (r *odtReader) frame(frame *xmlNode, o *officeInline) {
+	image := frame.child(nsODTDraw, "image")
+	if image == nil {
+		if frame.child(nsODTDraw, "object") != nil || frame.child(nsODTDraw, "text-box") != nil {
+			r.warnOnce("Embedded objects, charts and text boxes were skipped")
+		}
+		return
+	}
+	alt := strings.TrimSpace(frame.child(nsODTSVG, "title").text())
+	if alt == "" {
+		alt = strings.TrimSpace(frame.child(nsODTSVG, "desc").text())
+	}
+
+	src := image.attr(nsXLink, "href")
+	if !strings.Contains(src, ":") {
+		var ok bool
+		src, ok = r.i.embed(r.who, r.zip, path.Clean(strings.TrimPrefix(src, "./")))
+		if !ok {
+			return
+		}
+	}
+	o.raw(`<img src="` + escapeHTML(src) + `" alt="` + escapeHTML(alt) + `" />`)
+}
+
+func (r *odtReader) table(table *xmlNode, w *officeWriter) {
+	var rows [][]*officeCell
+	header := false
+
+	var readRows func(n *xmlNode)
+	readRows = func(n *xmlNode) {
+		for _, c := range n.Children {
+			switch {
+			case c.is(nsODTTable, "table-header-rows"):
+				header = len(rows) == 0
+				readRows(c)
+			case c.is(nsODTTable, "table-rows"), c.is(nsODTTable, "table-row-group"):
+				readRows(c)
+			case c.is(nsODTTable, "table-row"):
+				row := r.tableRow(c)
+				for repeat := odtRepeat(c, "number-rows-repeated"); repeat > 0; repeat-- {
+					rows = append(rows, row)
+				}
+			}
+		}
+	}
+	readRows(table)
+
+	// repeated empty rows and cells fill the rest of the table, and aren't kept
+	for len(rows) > 0 && emptyRow(rows[len(rows)-1]) {
+		rows = rows[:len(rows)-1]
+	}
+	if len(rows) > 0 {
+		w.table(rows, header)
+	}
+}
+
+func (r *odtReader) tableRow(tr *xmlNode) []*officeCell {
+	var row []*officeCell
+	for _, tc := range tr.Children {
+		if !tc.is(nsODTTable, "table-cell") {
+			continue
+		}
+		cw := &officeWriter{}
+		r.blocks(tc, cw)
+		cell := &officeCell{content: cw.cellHTML(), colspan: 1, rowspan: 1}
+		if span, err := strconv.Atoi(tc.attr(nsODTTable, "number-columns-spanned")); err == nil && span > 1 {
+			cell.colspan = span
+		}
+		if span, err := strconv.Atoi(tc.attr(nsODTTable, "number-rows-spanned")); err == nil && span > 1 {
+			cell.rowspan = span
+		}
+		for repeat := odtRepeat(tc, "number-columns-repeated"); repeat > 0; repeat-- {
+			row = append(row, cell)
+		}
+	}
+	for len(row) > 1 && row[len(row)-1].content == "" {
+		row = row[:len(row)-1]
+	}
+	return row
+}
+
+// odtRepeat returns the number of times a table row or cell is repeated
+func odtRepeat(n *xmlNode, attr string) int {
+	repeat, err := strconv.Atoi(n.attr(nsODTTable, attr))
+	if err != nil || repeat < 1 {
+		return 1
+	}
+	if repeat > maxODTRepeat {
+		return maxODTRepeat
+	}
+	return repeat
+}
+
+func emptyRow(row []*officeCell) bool {
+	for _, cell := range row {
+		if cell.content != "" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,601 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Word (DOCX) and LibreOffice (ODT) documents are zip files holding XML.  Both are read without any external
+	converter: the XML is walked for headings, paragraphs, lists, tables, links and images, and the styles of each
+	paragraph are mapped onto the HTML of a document.  Headings come from heading styles and outline levels, and
+	paragraphs in code or quote styles become preformatted blocks and block quotes.  Images embedded in the file are
+	added to the document as attachments.
+
+	The shared parts of both formats are here, and each format is read in importDOCX.go and importODT.go.
+*/
+
+// maxOfficeXMLSize is the largest XML file that will be read from an office document, in bytes
+const maxOfficeXMLSize = 64 << 20
+
+// monospaceFonts are the fonts that mark text as code
+var monospaceFonts = []string{"consolas", "courier", "courier new", "lucida console", "menlo", "monaco",
+	"source code pro", "dejavu sans mono", "liberation mono", "inconsolata", "fira mono", "fira code"}
+
+// officeZip is the zip container of an office document, or of any other zip file being imported
+type officeZip struct {
+	files  map[string]*zip.File
+	closer io.Closer
+}
+
+func (i *importDoc) openZip(file []byte) (*officeZip, error) {
+	return i.newZip(bytes.NewReader(file), int64(len(file)))
+}
+
+func (i *importDoc) newZip(r io.ReaderAt, size int64) (*officeZip, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		format := strings.ToUpper(strings.TrimPrefix(path.Ext(i.file), "."))
+		return nil, NewFailure(fmt.Sprintf("%s is not a valid %s file", i.file, format))
+	}
+	z := &officeZip{files: make(map[string]*zip.File, len(zr.File))}
+	for _, f := range zr.File {
+		z.files[f.Name] = f
+	}
+	return z, nil
+}
+
+// openArchive opens the zip file being imported.  A file on disk is read in place, so archives can be larger than
+// maxImportFileSize, and any other file is read into memory.  The archive must be closed when it's no longer needed
+func (i *importDoc) openArchive() (*officeZip, error) {
+	r, err := i.source.Open(i.file)
+	if os.IsNotExist(err) {
+		return nil, NotFound(fmt.Sprintf("%s was not found", i.file))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if f, ok := r.(*os.File); ok {
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		z, err := i.newZip(f, info.Size())
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		z.closer = f
+		return z, nil
+	}
+	r.Close()
+
+	file, err := i.readBytes()
+	if err != nil {
+		return nil, err
+	}
+	return i.openZip(file)
+}
+
+// Close closes the zip file, if it's read in place
+func (z *officeZip) Close() error {
+	if z.closer == nil {
+		return nil
+	}
+	return z.closer.Close()
+}
+
+// open opens the file in the zip, returning errNotInZip if it doesn't exist
+func (z *officeZip) open(name string) (io.ReadCloser, error) {
+	f, ok := z.files[name]
+	if !ok {
+		return nil, errNotInZip
+	}
+	return f.Open()
+}
+
+var errNotInZip = fmt.Errorf("file not found in zip")
+
+// xml parses the XML file in the zip, and returns nil if the file doesn't exist.  The zip is in memory, so any
+// error is a problem with the file being imported
+func (z *officeZip) xml(name string) (*xmlNode, error) {
+	r, err := z.open(name)
+	if err == errNotInZip {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, NewFailure(fmt.Sprintf("%s could not be read: %s", name, err))
+	}
+	defer r.Close()
+	n, err := parseXML(io.LimitReader(r, maxOfficeXMLSize))
+	if err != nil {
+		return nil, NewFailure(fmt.Sprintf("%s could not be read: %s", name, err))
+	}
+	return n, nil
+}
+
+// embed attaches a file from the office document, and returns the link to the attachment
+func (i *importDoc) embed(who *User, z *officeZip, name string) (string, bool) {
+	return i.embedAs(who, z, name, name)
+}
+
+// embedAs attaches a file from the zip file with a different name, and returns the link to the attachment
+func (i *importDoc) embedAs(who *User, z *officeZip, name, as string) (string, bool) {
+	key := path.Join(i.file, name)
+	a, ok := i.attachments[key]
+	if !ok {
+		r, err := z.open(name)
+		if err != nil {
+			i.warn("The embedded file %s could not be found, and was skipped", as)
+			return "", false
+		}
+		a, err = newAttachment(who, as, r)
+		r.Close()
+		if err != nil {
+			i.warn("The embedded file %s could not be attached: %s", as, err)
+			return "", false
+		}
+		i.attachments[key] = a
+	}
+	return a.URL(), true
+}
+
+// xmlNode is an element or text in an XML document.  Unlike encoding/xml's struct decoding, the order of text and
+// elements is kept, which matters for mixed content like ODT paragraphs
+type xmlNode struct {
+	Name     xml.Name
+	Attr     []xml.Attr
+	Children []*xmlNode
+	Text     string // only set on text nodes, which have no name
+}
+
+func parseXML(r io.Reader) (*xmlNode, error) {
+	return parseXMLTokens(xml.NewDecoder(r))
+}
+
+// parseXMLTokens builds the tree of the tokens from the decoder, which can be set up to read more lenient XML
+func parseXMLTokens(d *xml.Decoder) (*xmlNode, error) {
+	root := &xmlNode{}
+	stack := []*xmlNode{root}
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		parent := stack[len(stack)-1]
+		switch t := t.(type) {
+		case xml.StartElement:
+			n := &xmlNode{Name: t.Name, Attr: t.Copy().Attr}
+			parent.Children = append(parent.Children, n)
+			stack = append(stack, n)
+		case xml.EndElement:
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			parent.Children = append(parent.Children, &xmlNode{Text: string(t)})
+		}
+	}
+	return root, nil
+}
+
+// is returns true if the node is the element
+func (n *xmlNode) is(space, local string) bool {
+	return n != nil && n.Name.Space == space && n.Name.Local == local
+}
+
+// attr returns the value of the attribute
+func (n *xmlNode) attr(space, local string) string {
+	if n == nil {
+		return ""
+	}
+	for _, a := range n.Attr {
+		if a.Name.Space == space && a.Name.Local == local {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// child returns the first child element, or nil if there isn't one
+func (n *xmlNode) child(space, local string) *xmlNode {
+	if n == nil {
+		return nil
+	}
+	for _, c := range n.Children {
+		if c.is(space, local) {
+			return c
+		}
+	}
+	return nil
+}
+
+// find returns the first element in the tree below the node, or nil if there isn't one
+func (n *xmlNode) find(space, local string) *xmlNode {
+	if n == nil {
+		return nil
+	}
+	for _, c := range n.Children {
+		if c.is(space, local) {
+			return c
+		}
+		if found := c.find(space, local); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// path returns the element at the path of child elements in the same namespace, or nil if there isn't one
+func (n *xmlNode) path(space string, locals ...string) *xmlNode {
+	for _, local := range locals {
+		n = n.child(space, local)
+	}
+	return n
+}
+
+// text returns all of the text in the node
+func (n *xmlNode) text() string {
+	if n == nil {
+		return ""
+	}
+	if n.Name.Local == "" {
+		return n.Text
+	}
+	buf := &bytes.Buffer{}
+	for _, c := range n.Children {
+		buf.WriteString(c.text())
+	}
+	return buf.String()
+}
+
+// officeFormat is the character formatting of text in an office document
+type officeFormat struct {
+	bold      bool
+	italic    bool
+	underline bool
+	strike    bool
+	code      bool
+	position  string // sup or sub
+}
+
+func (f officeFormat) open() string {
+	s := ""
+	if f.code {
+		s += "<code>"
+	}
+	if f.bold {
+		s += "<strong>"
+	}
+	if f.italic {
+		s += "<em>"
+	}
+	if f.underline {
+		s += "<u>"
+	}
+	if f.strike {
+		s += "<s>"
+	}
+	if f.position != "" {
+		s += "<" + f.position + ">"
+	}
+	return s
+}
+
+func (f officeFormat) close() string {
+	s := ""
+	if f.position != "" {
+		s += "</" + f.position + ">"
+	}
+	if f.strike {
+		s += "</s>"
+	}
+	if f.underline {
+		s += "</u>"
+	}
+	if f.italic {
+		s += "</em>"
+	}
+	if f.bold {
+		s += "</strong>"
+	}
+	if f.code {
+		s += "</code>"
+	}
+	return s
+}
+
+// officeInline builds the HTML of a paragraph's content, joining neighbouring runs of text with the same
+// formatting
+type officeInline struct {
+	buf    bytes.Buffer
+	format officeFormat
+	text   bytes.Buffer
+}
+
+// write adds the text with the formatting
+func (o *officeInline) write(format officeFormat, text string) {
+	if text == "" {
+		return
+	}
+	if format != o.format {
+		o.flush()
+		o.format = format
+	}
+	o.text.WriteString(escapeHTML(text))
+}
+
+// raw adds HTML that isn't formatted, like a line break or image
+func (o *officeInline) raw(html string) {
+	o.flush()
+	o.buf.WriteString(html)
+}
+
+func (o *officeInline) flush() {
+	if o.text.Len() == 0 {
+		return
+	}
+	o.buf.WriteString(o.format.open())
+	o.buf.Write(o.text.Bytes())
+	o.buf.WriteString(o.format.close())
+	o.text.Reset()
+}
+
+func (o *officeInline) html() string {
+	o.flush()
+	return o.buf.String()
+}
+
+// officeList is a list that is open in the document's HTML
+type officeList struct {
+	id      string
+	ordered bool
+}
+
+// officeWriter builds the HTML body of an office document, one paragraph at a time.  Office documents don't nest
+// their paragraphs, so neighbouring code and quote paragraphs are joined into a single block, and list items
+// are nested into lists by their level
+type officeWriter struct {
+	buf   bytes.Buffer
+	block string // the open pre or blockquote
+	lists []officeList
+}
+
+// paragraph adds a paragraph as the element, one of p, h1-h6, pre or blockquote
+func (w *officeWriter) paragraph(element, content string) {
+	w.closeLists()
+	if element != w.block {
+		w.closeBlock()
+	}
+
+	switch element {
+	case "pre":
+		if w.block == "pre" {
+			w.buf.WriteString("\n")
+		} else {
+			w.buf.WriteString("<pre><code>")
+			w.block = element
+		}
+		w.buf.WriteString(content)
+		return
+	case "blockquote":
+		if w.block != "blockquote" {
+			w.buf.WriteString("<blockquote>\n")
+			w.block = element
+		}
+		element = "p"
+	}
+
+	if strings.TrimSpace(content) == "" {
+		return
+	}
+	w.buf.WriteString("<" + element + ">" + content + "</" + element + ">\n")
+}
+
+// listItem adds an item to a list at the level, starting at 0.  Items with the same list id and level are in the
+// same list
+func (w *officeWriter) listItem(id string, level int, ordered bool, content string) {
+	w.closeBlock()
+	list := officeList{id: id, ordered: ordered}
+	for len(w.lists) > level+1 {
+		w.closeList()
+	}
+	if len(w.lists) == level+1 {
+		if w.lists[level] == list {
+			w.buf.WriteString("</li>\n<li>" + content)
+			return
+		}
+		w.closeList()
+	}
+	for len(w.lists) < level+1 {
+		if len(w.lists) > 0 {
+			w.buf.WriteString("\n")
+		}
+		w.lists = append(w.lists, list)
+		if ordered {
+			w.buf.WriteString("<ol>\n<li>")
+		} else {
+			w.buf.WriteString("<ul>\n<li>")
+		}
+	}
+	w.buf.WriteString(content)
+}
+
+// listParagraph adds another paragraph to the open list item
+func (w *officeWriter) listParagraph(content string) {
+	if len(w.lists) == 0 {
+		w.paragraph("p", content)
+		return
+	}
+	if strings.TrimSpace(content) != "" {
+		w.buf.WriteString("<br />" + content)
+	}
+}
+
+// table adds a table, with the first row as the header if header is true
+func (w *officeWriter) table(rows [][]*officeCell, header bool) {
+	w.closeLists()
+	w.closeBlock()
+	w.buf.WriteString("<table>\n")
+	for r, row := range rows {
+		if r == 0 && header {
+			w.buf.WriteString("<thead>\n")
+		}
+		if (r == 0 && !header) || (r == 1 && header) {
+			w.buf.WriteString("<tbody>\n")
+		}
+		w.buf.WriteString("<tr>\n")
+		element := "td"
+		if r == 0 && header {
+			element = "th"
+		}
+		for _, cell := range row {
+			w.buf.WriteString("<" + element)
+			if cell.colspan > 1 {
+				w.buf.WriteString(` colspan="` + strconv.Itoa(cell.colspan) + `"`)
+			}
+			if cell.rowspan > 1 {
+				w.buf.WriteString(` rowspan="` + strconv.Itoa(cell.rowspan) + `"`)
+			}
+			w.buf.WriteString(">" + cell.content + "</" + element + ">\n")
+		}
+		w.buf.WriteString("</tr>\n")
+		if r == 0 && header {
+			w.buf.WriteString("</thead>\n")
+		}
+	}
+	if len(rows) > 1 || !header {
+		w.buf.WriteString("</tbody>\n")
+	}
+	w.buf.WriteString("</table>\n")
+}
+
+func (w *officeWriter) closeBlock() {
+	switch w.block {
+	case "pre":
+		w.buf.WriteString("</code></pre>\n")
+	case "blockquote":
+		w.buf.WriteString("</blockquote>\n")
+	}
+	w.block = ""
+}
+
+func (w *officeWriter) closeList() {
+	list := w.lists[len(w.lists)-1]
+	w.lists = w.lists[:len(w.lists)-1]
+	if list.ordered {
+		w.buf.WriteString("</li>\n</ol>")
+	} else {
+		w.buf.WriteString("</li>\n</ul>")
+	}
+	if len(w.lists) == 0 {
+		w.buf.WriteString("\n")
+	}
+}
+
+func (w *officeWriter) closeLists() {
+	for len(w.lists) > 0 {
+		w.closeList()
+	}
+}
+
+// html closes any open blocks and returns the HTML
+func (w *officeWriter) html() string {
+	w.closeLists()
+	w.closeBlock()
+	return w.buf.String()
+}
+
+// cellHTML returns the HTML of a table cell's content, without the paragraph around it if it's a single paragraph
+func (w *officeWriter) cellHTML() string {
+	content := strings.TrimSpace(w.html())
+	if strings.HasPrefix(content, "<p>") && strings.HasSuffix(content, "</p>") &&
+		strings.Count(content, "<p>") == 1 {
+		return content[len("<p>") : len(content)-len("</p>")]
+	}
+	return content
+}
+
+// officeCell is a cell in a table of an office document
+type officeCell struct {
+	content string
+	colspan int
+	rowspan int
+}
+
+// styleStructure maps the name of a paragraph style to the element it's used for, and whether it's the style of
+// the document's title
+func styleStructure(name string) (element string, title bool) {
+	name = strings.ToLower(strings.TrimSpace(strings.Replace(name, "_20_", " ", -1)))
+	switch {
+	case name == "title":
+		return "h1", true
+	case name == "subtitle":
+		return "h2", false
+	case strings.HasPrefix(name, "heading"):
+		level, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(name, "heading")))
+		if err != nil || level < 1 {
+			return "", false
+		}
+		return headingElement(level), false
+	case strings.Contains(name, "quot") || name == "block text":
+		return "blockquote", false
+	case strings.Contains(name, "code") || strings.Contains(name, "preformatted") ||
+		strings.Contains(name, "source") || strings.Contains(name, "typewriter"):
+		return "pre", false
+	}
+	return "", false
+}
+
+// headingElement returns the heading element for the outline level, starting at 1
+func headingElement(level int) string {
+	if level > 6 {
+		level = 6
+	}
+	return "h" + strconv.Itoa(level)
+}
+
+// isMonospace returns true if the font is a monospace font used for code
+func isMonospace(font string) bool {
+	font = strings.ToLower(strings.Trim(strings.TrimSpace(font), `'"`))
+	return stringIn(font, monospaceFonts)
+}
+
+// splitKeywords splits the keywords of a document's properties into tags
+func splitKeywords(keywords string) []string {
+	var tags []string
+	for _, tag := range strings.FieldsFunc(keywords, func(r rune) bool { return r == ',' || r == ';' }) {
+		if strings.TrimSpace(tag) != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// officeDate sets a date from a document's properties
+func (i *importDoc) officeDate(name, value string, date *time.Time) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return
+	}
+	t, err := parseImportDate(value)
+	if err != nil {
+		i.warn("The %s date in the document properties was skipped: %s", name, err)
+		return
+	}
+	*date = t
+}
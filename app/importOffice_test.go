@@ -0,0 +1,219 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lexLibrary/lexLibrary/app"
+)
+
+func TestImportOffice(t *testing.T) {
+	resetDocuments(t)
+
+	tenant, err := app.TenantNew(installAdmin(t), "Import Office Tenant", "", "")
+	if err != nil {
+		t.Fatalf("Error creating tenant: %s", err)
+	}
+	author := testUser(t, tenant, "author")
+	fixtures := app.ImportDir("testdata/import")
+
+	tests := []struct {
+		name     string
+		importer func(*app.User, *app.Collection, app.ImportSource, string) (*app.ImportResult, error)
+		file     string
+		title    string
+		summary  string
+		created  time.Time
+		tags     []string
+		image    string
+		warnings []string
+		body     string
+	}{
+		{
+			name:     "DOCX",
+			importer: app.ImportDOCX,
+			file:     "guide.docx",
+			title:    "Deployment Guide",
+			summary:  "How to deploy the service.",
+			created:  time.Date(2017, 3, 4, 5, 6, 7, 0, time.UTC),
+			tags:     []string{"deploy", "operations"},
+			image:    "image1.png",
+			warnings: []string{"Embedded objects, like spreadsheets, were skipped"},
+			body: `<h1>Deployment Guide</h1>
+<h1>Overview</h1>
+<p>Deploy the <strong>service daily</strong>, with <code>make deploy</code> from the ` +
+				`<a href="https://build.example.com/deploy"><em><u>build server</u></em></a>.<br />H<sub>2</sub>O</p>
+<p><img src="IMAGE" alt="Deployment flow" /></p>
+<h2>Steps</h2>
+<ol>
+<li>Build the release
+<ul>
+<li>Check the tests</li>
+<li>Check the docs</li>
+</ul></li>
+<li>Copy it to the servers</li>
+</ol>
+<ul>
+<li>Restart the service</li>
+<li>Watch the logs</li>
+</ul>
+<pre><code>systemctl restart lex
+journalctl -f -u lex</code></pre>
+<blockquote>
+<p>Never deploy on a Friday.</p>
+</blockquote>
+<table>
+<thead>
+<tr>
+<th>Server</th>
+<th colspan="2">Role</th>
+</tr>
+</thead>
+<tbody>
+<tr>
+<td rowspan="2">web1</td>
+<td>web</td>
+<td>primary</td>
+</tr>
+<tr>
+<td>api</td>
+<td>backup</td>
+</tr>
+</tbody>
+</table>
+`,
+		},
+		{
+			name:     "ODT",
+			importer: app.ImportODT,
+			file:     "notes.odt",
+			title:    "Release Notes",
+			summary:  "What changed in the release.",
+			created:  time.Date(2017, 5, 6, 7, 8, 9, 0, time.UTC),
+			tags:     []string{"release", "upgrade"},
+			image:    "chart.png",
+			warnings: []string{`The modified date in the document properties was skipped: "bad date" is not a ` +
+				`recognized date`},
+			body: `<h1>Release Notes</h1>
+<h1>Changes</h1>
+<p>Search is <strong>faster</strong>,  <strong><em>much</em></strong> faster, see ` +
+				`<a href="https://example.com/search">the search page</a> and <code>lex --search</code>. E = mc<sup>2</sup></p>
+<p><img src="IMAGE" alt="Search speed" /></p>
+<h2>Upgrading</h2>
+<ol>
+<li>Back up the database
+<ul>
+<li>Check the backup</li>
+</ul></li>
+<li>Install the new version<br />and restart it</li>
+</ol>
+<ul>
+<li>Done</li>
+</ul>
+<pre><code>lex upgrade
+  --force</code></pre>
+<blockquote>
+<p>It just works.</p>
+</blockquote>
+<table>
+<thead>
+<tr>
+<th>Version</th>
+<th colspan="2">Notes</th>
+</tr>
+</thead>
+<tbody>
+<tr>
+<td rowspan="2">2.0</td>
+<td>Search</td>
+<td>Faster</td>
+</tr>
+<tr>
+<td>Tags</td>
+<td>Synonyms</td>
+</tr>
+</tbody>
+</table>
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := test.importer(author, nil, fixtures, test.file)
+			if err != nil {
+				t.Fatalf("Error importing %s: %s", test.file, err)
+			}
+			if strings.Join(result.Warnings, "\n") != strings.Join(test.warnings, "\n") {
+				t.Fatalf("Invalid warnings. Wanted %q got %q", test.warnings, result.Warnings)
+			}
+
+			doc := result.Document
+			rev, err := doc.Latest()
+			if err != nil {
+				t.Fatalf("Error getting revision: %s", err)
+			}
+			if rev.Title != test.title {
+				t.Fatalf("Invalid title. Wanted %q got %q", test.title, rev.Title)
+			}
+			if rev.Summary != test.summary || !rev.SummaryManual {
+				t.Fatalf("Invalid summary. Wanted %q got %q", test.summary, rev.Summary)
+			}
+			if !doc.Created.Equal(test.created) {
+				t.Fatalf("Invalid created date. Wanted %s got %s", test.created, doc.Created)
+			}
+
+			tags, err := doc.Tags()
+			if err != nil {
+				t.Fatalf("Error getting tags: %s", err)
+			}
+			if len(tags) != len(test.tags) {
+				t.Fatalf("Invalid tags: %+v", tags)
+			}
+			for i := range tags {
+				if tags[i].Name != test.tags[i] {
+					t.Fatalf("Invalid tag. Wanted %q got %q", test.tags[i], tags[i].Name)
+				}
+			}
+
+			attachments, err := doc.Attachments()
+			if err != nil {
+				t.Fatalf("Error getting attachments: %s", err)
+			}
+			if len(attachments) != 1 || attachments[0].Name != test.image ||
+				attachments[0].ContentType != "image/png" {
+				t.Fatalf("Invalid attachments: %+v", attachments)
+			}
+
+			body := strings.Replace(test.body, "IMAGE", attachments[0].URL(), 1)
+			if rev.Body != body {
+				t.Fatalf("Invalid body. Wanted:\n%s\nGot:\n%s", body, rev.Body)
+			}
+		})
+	}
+
+	t.Run("Invalid Files", func(t *testing.T) {
+		files := app.ImportFiles{
+			"text.docx":  []byte("not a zip file"),
+			"text.odt":   []byte("not a zip file"),
+			"empty.docx": []byte("PK\x05\x06\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"),
+		}
+		for _, file := range []string{"text.docx", "empty.docx"} {
+			_, err := app.ImportDOCX(author, nil, files, file)
+			if !app.IsFailType(err, app.FailInvalid) {
+				t.Fatalf("Expected invalid failure importing %s, got %v", file, err)
+			}
+		}
+		_, err := app.ImportODT(author, nil, files, "text.odt")
+		if !app.IsFailType(err, app.FailInvalid) {
+			t.Fatalf("Expected invalid failure importing text.odt, got %v", err)
+		}
+		_, err = app.ImportODT(author, nil, fixtures, "missing.odt")
+		if !app.IsFailType(err, app.FailNotFound) {
+			t.Fatalf("Expected not found importing missing.odt, got %v", err)
+		}
+	})
+}
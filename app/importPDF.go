@@ -0,0 +1,506 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"math"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// maxPDFUnreadable is the share of the characters in a PDF that can be unreadable before the import fails
+	maxPDFUnreadable = 0.2
+	// minPDFHeadingScale is how much bigger than the body text a line's font must be to be a heading
+	minPDFHeadingScale = 1.15
+)
+
+var rePDFPageNumber = regexp.MustCompile(`(?i)^(page\s+)?\d+(\s+of\s+\d+)?$`)
+
+// pdfLine is a line of text on a page, or an image
+type pdfLine struct {
+	x, y, end  float64
+	size       float64
+	text       string
+	chars      int
+	unreadable int
+	image      *pdfItem
+}
+
+// pdfReader converts the pages of a PDF file to HTML
+type pdfReader struct {
+	i      *importDoc
+	who    *User
+	f      *pdfFile
+	images map[int]string // the attachment URLs of images that are indirect objects
+	count  int
+	warned map[string]bool
+}
+
+// ImportPDF imports a PDF file from the source as a new document, in the collection if it isn't nil.  Encrypted
+// PDFs, and PDFs that are only scanned images of pages, can't be imported
+func ImportPDF(who *User, collection *Collection, source ImportSource, name string) (*ImportResult, error) {
+	_, err := canCreateDocument(who, collection)
+	if err != nil {
+		return nil, err
+	}
+	name, err = importPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	i := newImportDoc(source, name)
+	file, err := i.readBytes()
+	if err != nil {
+		return nil, err
+	}
+	f, err := openPDF(file)
+	if err != nil {
+		return nil, NewFailure(fmt.Sprintf("%s is not a valid PDF file", i.file))
+	}
+	if _, ok := f.trailer["Encrypt"]; ok {
+		return nil, NewFailure(fmt.Sprintf("%s is encrypted, and encrypted PDF files are not supported", i.file))
+	}
+
+	r := &pdfReader{
+		i:      i,
+		who:    who,
+		f:      f,
+		images: make(map[int]string),
+		warned: make(map[string]bool),
+	}
+	err = r.document()
+	if err != nil {
+		i.release()
+		return nil, err
+	}
+	return i.create(who, collection)
+}
+
+func (r *pdfReader) warnOnce(format string, args ...interface{}) {
+	if r.warned[format] {
+		return
+	}
+	r.warned[format] = true
+	r.i.warn(format, args...)
+}
+
+func (r *pdfReader) document() error {
+	info, _ := r.f.dict(r.f.trailer["Info"])
+	r.i.title = strings.TrimSpace(r.f.text(info["Title"]))
+	r.i.summary = strings.Join(strings.Fields(r.f.text(info["Subject"])), " ")
+	r.i.tags = append(r.i.tags, splitKeywords(r.f.text(info["Keywords"]))...)
+	r.i.officeDate("created", pdfDate(r.f.text(info["CreationDate"])), &r.i.created)
+	r.i.officeDate("modified", pdfDate(r.f.text(info["ModDate"])), &r.i.updated)
+
+	var pages [][]pdfLine
+	chars, unreadable, images := 0, 0, 0
+	for n, page := range r.f.pages() {
+		lines := r.lines(n+1, page)
+		for _, l := range lines {
+			if l.image != nil {
+				images++
+			}
+			chars += l.chars
+			unreadable += l.unreadable
+		}
+		pages = append(pages, lines)
+	}
+
+	if chars == 0 {
+		if images > 0 {
+			return NewFailure(fmt.Sprintf("%s only has scanned images of its pages, which are not supported, "+
+				"because there is no text to import", r.i.file))
+		}
+		return NewFailure(fmt.Sprintf("%s has no text to import", r.i.file))
+	}
+	if float64(unreadable) > float64(chars)*maxPDFUnreadable {
+		return NewFailure(fmt.Sprintf("The text in %s uses fonts that can't be read, so it can't be imported",
+			r.i.file))
+	}
+
+	headings := pdfHeadings(pages)
+	buf := &bytes.Buffer{}
+	for n, lines := range pages {
+		r.page(buf, n+1, skipPageNumbers(lines), headings)
+	}
+	r.i.body = buf.String()
+	if r.i.title == "" {
+		r.i.title = firstHeading(r.i.body)
+	}
+	return nil
+}
+
+// pages returns the pages of the file in order, with the resources they inherit from the page tree
+func (f *pdfFile) pages() []pdfDict {
+	var pages []pdfDict
+	var walk func(node interface{}, resources interface{}, depth int)
+	walk = func(node interface{}, resources interface{}, depth int) {
+		d, ok := f.dict(node)
+		if !ok || depth > maxPDFDepth {
+			return
+		}
+		if r, ok := d["Resources"]; ok {
+			resources = r
+		}
+		kids, hasKids := d["Kids"]
+		if f.resolve(d["Type"]) == pdfName("Page") || !hasKids {
+			page := make(pdfDict, len(d)+1)
+			for k, v := range d {
+				page[k] = v
+			}
+			page["Resources"] = resources
+			pages = append(pages, page)
+			return
+		}
+		for _, kid := range f.array(kids) {
+			walk(kid, resources, depth+1)
+		}
+	}
+	root, _ := f.dict(f.trailer["Root"])
+	walk(root["Pages"], nil, 0)
+	return pages
+}
+
+// lines runs the content of the page, and joins the text drawn on the same baseline into lines
+func (r *pdfReader) lines(n int, page pdfDict) []pdfLine {
+	content := &bytes.Buffer{}
+	contents := r.f.resolve(page["Contents"])
+	streams, ok := contents.(pdfArray)
+	if !ok {
+		streams = pdfArray{contents}
+	}
+	for _, s := range streams {
+		s, ok := r.f.resolve(s).(*pdfStream)
+		if !ok {
+			continue
+		}
+		data, err := r.f.decode(s)
+		if err != nil {
+			r.i.warn("Page %d could not be read completely, and some of its text may be missing", n)
+			continue
+		}
+		content.Write(data)
+		content.WriteByte('\n')
+	}
+
+	resources, _ := r.f.dict(page["Resources"])
+	c := &pdfContent{f: r.f}
+	c.run(content.Bytes(), resources, pdfIdentity, 0)
+
+	var lines []pdfLine
+	for n := range c.items {
+		item := &c.items[n]
+		if item.image != nil {
+			lines = append(lines, pdfLine{image: item})
+			continue
+		}
+		if len(lines) > 0 {
+			last := &lines[len(lines)-1]
+			if last.image == nil && math.Abs(last.y-item.y) < 0.5*math.Max(last.size, item.size) &&
+				item.x > last.x {
+				gap := item.x - last.end
+				if gap > 0.15*item.size && !strings.HasSuffix(last.text, " ") &&
+					!strings.HasPrefix(item.text, " ") {
+					last.text += " "
+				}
+				last.text += item.text
+				last.end = math.Max(last.end, item.end)
+				chars := countPDFChars(item.text)
+				if chars > last.chars {
+					// the line is the size of most of its text, not its superscripts
+					last.size = item.size
+				}
+				last.chars += chars
+				last.unreadable += item.unreadable
+				continue
+			}
+		}
+		lines = append(lines, pdfLine{
+			x:          item.x,
+			y:          item.y,
+			end:        item.end,
+			size:       item.size,
+			text:       item.text,
+			chars:      countPDFChars(item.text),
+			unreadable: item.unreadable,
+		})
+	}
+
+	// text made of only spaces isn't a line
+	text := lines[:0]
+	for _, l := range lines {
+		if l.image != nil || strings.TrimSpace(l.text) != "" {
+			l.text = strings.Join(strings.Fields(l.text), " ")
+			text = append(text, l)
+		}
+	}
+	return text
+}
+
+func countPDFChars(text string) int {
+	chars := 0
+	for _, r := range text {
+		if !unicode.IsSpace(r) {
+			chars++
+		}
+	}
+	return chars
+}
+
+// pdfFontSize rounds font sizes, so that text set in the same size compares as equal
+func pdfFontSize(size float64) float64 {
+	return math.Floor(size*2+0.5) / 2
+}
+
+// pdfHeadings returns the heading element for each font size bigger than the body text, which is the size most
+// of the characters are in
+func pdfHeadings(pages [][]pdfLine) map[float64]string {
+	chars := make(map[float64]int)
+	for _, lines := range pages {
+		for _, l := range lines {
+			if l.image == nil {
+				chars[pdfFontSize(l.size)] += l.chars
+			}
+		}
+	}
+	body := 0.0
+	for size, count := range chars {
+		if count > chars[body] || (count == chars[body] && size < body) {
+			body = size
+		}
+	}
+
+	var sizes []float64
+	for size := range chars {
+		if size >= body*minPDFHeadingScale {
+			sizes = append(sizes, size)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.Float64Slice(sizes)))
+	headings := make(map[float64]string, len(sizes))
+	for level, size := range sizes {
+		headings[size] = headingElement(level + 1)
+	}
+	return headings
+}
+
+// skipPageNumbers removes page numbers from the top and bottom of a page
+func skipPageNumbers(lines []pdfLine) []pdfLine {
+	if len(lines) > 0 && rePDFPageNumber.MatchString(lines[len(lines)-1].text) {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) > 0 && rePDFPageNumber.MatchString(lines[0].text) {
+		lines = lines[1:]
+	}
+	return lines
+}
+
+// page writes the lines of the page as headings, paragraphs and images.  Lines in the same font size with no
+// more than a line's space between them are in the same paragraph
+func (r *pdfReader) page(buf *bytes.Buffer, n int, lines []pdfLine, headings map[float64]string) {
+	anchor := fmt.Sprintf(`<a name="page-%d"></a>`, n)
+	element := ""
+	var last *pdfLine
+	text := &bytes.Buffer{}
+
+	flush := func() {
+		if element == "" {
+			return
+		}
+		fmt.Fprintf(buf, "<%s>%s%s</%s>\n", element, anchor, text.String(), element)
+		anchor = ""
+		element = ""
+		text.Reset()
+	}
+
+	for n := range lines {
+		l := &lines[n]
+		if l.image != nil {
+			src, ok := r.image(l.image)
+			if ok {
+				flush()
+				fmt.Fprintf(buf, `<p>%s<img src="%s" /></p>`+"\n", anchor, escapeHTML(src))
+				anchor = ""
+			}
+			last = nil
+			continue
+		}
+
+		size := pdfFontSize(l.size)
+		if element != "" && last != nil && pdfFontSize(last.size) == size && last.y > l.y &&
+			last.y-l.y <= 1.6*l.size {
+			joinPDFLines(text, l.text)
+		} else {
+			flush()
+			element = "p"
+			if heading, ok := headings[size]; ok {
+				element = heading
+			}
+			text.WriteString(escapeHTML(l.text))
+		}
+		last = l
+	}
+	flush()
+}
+
+// joinPDFLines adds the next line of a paragraph, joining words hyphenated across the line break
+func joinPDFLines(text *bytes.Buffer, line string) {
+	current := text.String()
+	before, _ := utf8.DecodeLastRuneInString(strings.TrimSuffix(current, "-"))
+	next, _ := utf8.DecodeRuneInString(line)
+	if strings.HasSuffix(current, "-") && unicode.IsLetter(before) && unicode.IsLower(next) {
+		text.Truncate(text.Len() - 1)
+	} else {
+		text.WriteByte(' ')
+	}
+	text.WriteString(escapeHTML(line))
+}
+
+// image attaches an image drawn on a page, returning the URL of the attachment.  JPEG images are attached as they
+// are, and other 8 bit gray and RGB images are converted to PNG
+func (r *pdfReader) image(item *pdfItem) (string, bool) {
+	if src, ok := r.images[item.imageNum]; ok && item.imageNum != 0 {
+		return src, true
+	}
+	s := item.image
+	if mask, _ := r.f.resolve(s.dict["ImageMask"]).(bool); mask {
+		// stencil masks are shapes painted in a color, not pictures
+		return "", false
+	}
+
+	filters := r.f.array(s.dict["Filter"])
+	var name string
+	var data []byte
+	if len(filters) == 1 && (r.f.resolve(filters[0]) == pdfName("DCTDecode") ||
+		r.f.resolve(filters[0]) == pdfName("DCT")) {
+		name = fmt.Sprintf("image%d.jpg", r.count+1)
+		data = s.data
+	} else {
+		var err error
+		data, err = r.pngImage(s)
+		if err != nil {
+			r.warnOnce("Some images could not be converted, and were skipped")
+			return "", false
+		}
+		name = fmt.Sprintf("image%d.png", r.count+1)
+	}
+
+	a, err := newAttachment(r.who, name, bytes.NewReader(data))
+	if err != nil {
+		r.i.warn("The image %s could not be attached: %s", name, err)
+		return "", false
+	}
+	r.count++
+	r.i.attachments[path.Join(r.i.file, name)] = a
+	if item.imageNum != 0 {
+		r.images[item.imageNum] = a.URL()
+	}
+	return a.URL(), true
+}
+
+// pngImage converts a gray or RGB image with 8 bits per component to a PNG
+func (r *pdfReader) pngImage(s *pdfStream) ([]byte, error) {
+	width, _ := r.f.number(s.dict["Width"])
+	height, _ := r.f.number(s.dict["Height"])
+	bits, _ := r.f.number(s.dict["BitsPerComponent"])
+	w, h := int(width), int(height)
+	if w <= 0 || h <= 0 || bits != 8 || w*h > maxImportFileSize {
+		return nil, errPDFUnsupportedFilter
+	}
+
+	components := 0
+	space := r.f.resolve(s.dict["ColorSpace"])
+	if a, ok := space.(pdfArray); ok && len(a) == 2 && r.f.resolve(a[0]) == pdfName("ICCBased") {
+		if profile, ok := r.f.resolve(a[1]).(*pdfStream); ok {
+			n, _ := r.f.number(profile.dict["N"])
+			components = int(n)
+		}
+	}
+	switch space {
+	case pdfName("DeviceGray"), pdfName("G"):
+		components = 1
+	case pdfName("DeviceRGB"), pdfName("RGB"):
+		components = 3
+	}
+	if components != 1 && components != 3 {
+		return nil, errPDFUnsupportedFilter
+	}
+
+	data, err := r.f.decode(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < w*h*components {
+		return nil, errPDFSyntax
+	}
+
+	var img image.Image
+	if components == 1 {
+		gray := image.NewGray(image.Rect(0, 0, w, h))
+		copy(gray.Pix, data)
+		img = gray
+	} else {
+		rgba := image.NewNRGBA(image.Rect(0, 0, w, h))
+		for p := 0; p < w*h; p++ {
+			copy(rgba.Pix[p*4:p*4+3], data[p*3:p*3+3])
+			rgba.Pix[p*4+3] = 0xFF
+		}
+		img = rgba
+	}
+
+	buf := &bytes.Buffer{}
+	err = png.Encode(buf, img)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// pdfDate converts a PDF date like D:20170304050607+01'00' to RFC 3339, leaving it as it is if it isn't a PDF date
+func pdfDate(value string) string {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "D:")
+	if len(value) < 4 {
+		return value
+	}
+	for _, c := range value[:4] {
+		if c < '0' || c > '9' {
+			return value
+		}
+	}
+
+	digits := value
+	zone := ""
+	if i := strings.IndexAny(value, "Zz+-"); i != -1 {
+		digits, zone = value[:i], value[i:]
+	}
+	if len(digits) > 14 {
+		return value
+	}
+	// missing parts default to the start of the year, month or day
+	digits += "0101000000"[len(digits)-4:]
+
+	switch {
+	case zone == "" || zone[0] == 'Z' || zone[0] == 'z':
+		zone = "Z"
+	default:
+		offset := strings.Replace(strings.TrimSuffix(zone[1:], "'"), "'", "", -1)
+		if len(offset) == 2 {
+			offset += "00"
+		}
+		if len(offset) != 4 {
+			return value
+		}
+		zone = zone[:1] + offset[:2] + ":" + offset[2:]
+	}
+	return fmt.Sprintf("%s-%s-%sT%s:%s:%s%s", digits[:4], digits[4:6], digits[6:8], digits[8:10], digits[10:12],
+		digits[12:14], zone)
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lexLibrary/lexLibrary/app"
+)
+
+func TestImportPDF(t *testing.T) {
+	resetDocuments(t)
+
+	tenant, err := app.TenantNew(installAdmin(t), "Import PDF Tenant", "", "")
+	if err != nil {
+		t.Fatalf("Error creating tenant: %s", err)
+	}
+	author := testUser(t, tenant, "author")
+	fixtures := app.ImportDir("testdata/import")
+
+	t.Run("Manual", func(t *testing.T) {
+		result, err := app.ImportPDF(author, nil, fixtures, "manual.pdf")
+		if err != nil {
+			t.Fatalf("Error importing manual.pdf: %s", err)
+		}
+		if len(result.Warnings) != 0 {
+			t.Fatalf("Unexpected warnings: %q", result.Warnings)
+		}
+
+		doc := result.Document
+		rev, err := doc.Latest()
+		if err != nil {
+			t.Fatalf("Error getting revision: %s", err)
+		}
+		if rev.Title != "Pump Manual" {
+			t.Fatalf("Invalid title. Wanted %q got %q", "Pump Manual", rev.Title)
+		}
+		if rev.Summary != "Servicing the pump." || !rev.SummaryManual {
+			t.Fatalf("Invalid summary: %q", rev.Summary)
+		}
+		created := time.Date(2017, 3, 4, 5, 6, 7, 0, time.UTC)
+		if !doc.Created.Equal(created) {
+			t.Fatalf("Invalid created date. Wanted %s got %s", created, doc.Created)
+		}
+
+		tags, err := doc.Tags()
+		if err != nil {
+			t.Fatalf("Error getting tags: %s", err)
+		}
+		if len(tags) != 2 || tags[0].Name != "maintenance" || tags[1].Name != "pumps" {
+			t.Fatalf("Invalid tags: %+v", tags)
+		}
+
+		attachments, err := doc.Attachments()
+		if err != nil {
+			t.Fatalf("Error getting attachments: %s", err)
+		}
+		if len(attachments) != 1 || attachments[0].Name != "image1.png" ||
+			attachments[0].ContentType != "image/png" {
+			t.Fatalf("Invalid attachments: %+v", attachments)
+		}
+
+		body := strings.Replace(`<h1><a name="page-1"></a>Pump Manual</h1>
+<h2>Safety</h2>
+<p>Always switch off the pump before servicing it, and wait for it to cool.</p>
+<p>Replacement seals cost €5 each.</p>
+<p><img src="IMAGE" /></p>
+<h2><a name="page-2"></a>Parts</h2>
+<p>Seals &amp; gaskets are in the Café kit.</p>
+`, "IMAGE", attachments[0].URL(), 1)
+		if rev.Body != body {
+			t.Fatalf("Invalid body. Wanted:\n%s\nGot:\n%s", body, rev.Body)
+		}
+	})
+
+	t.Run("Unsupported Files", func(t *testing.T) {
+		files := app.ImportFiles{
+			"text.pdf": []byte("not a PDF file"),
+		}
+		_, err := app.ImportPDF(author, nil, files, "text.pdf")
+		if !app.IsFailType(err, app.FailInvalid) {
+			t.Fatalf("Expected invalid failure importing text.pdf, got %v", err)
+		}
+
+		for _, file := range []string{"encrypted.pdf", "scanned.pdf"} {
+			_, err = app.ImportPDF(author, nil, fixtures, file)
+			if !app.IsFailType(err, app.FailInvalid) {
+				t.Fatalf("Expected invalid failure importing %s, got %v", file, err)
+			}
+			if !strings.Contains(err.Error(), "not supported") {
+				t.Fatalf("Expected %s to be unsupported, got %s", file, err)
+			}
+		}
+
+		_, err = app.ImportPDF(author, nil, fixtures, "missing.pdf")
+		if !app.IsFailType(err, app.FailNotFound) {
+			t.Fatalf("Expected not found importing missing.pdf, got %v", err)
+		}
+	})
+}
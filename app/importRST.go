@@ -0,0 +1,57 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"strings"
+)
+
+/*
+	reStructuredText files, the format of Sphinx and docutils documentation, are converted by the converter in
+	rst.go.  The title is the first top level heading, and the tags are the document's tags or keywords field.
+	Images are attached like any other linked file.
+*/
+
+// ImportRST imports a reStructuredText file from the source as a new document, in the collection if it isn't nil
+func ImportRST(who *User, collection *Collection, source ImportSource, name string) (*ImportResult, error) {
+	_, err := canCreateDocument(who, collection)
+	if err != nil {
+		return nil, err
+	}
+	name, err = importPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	i := newImportDoc(source, name)
+	text, err := i.read()
+	if err != nil {
+		return nil, err
+	}
+
+	i.rst(text)
+	return i.create(who, collection)
+}
+
+// rst sets the fields of the document from the reStructuredText, and warns about anything that couldn't be
+// converted
+func (i *importDoc) rst(text string) {
+	r := newRSTConverter()
+	i.body = r.convert(text)
+	i.title = firstHeading(i.body)
+	i.tags = r.tags
+
+	if unknown := uniqueSorted(r.unknown); len(unknown) > 0 {
+		i.warn("The directives %s have no equivalent in a document, and only their content was kept",
+			strings.Join(unknown, ", "))
+	}
+	if documents := uniqueSorted(r.documents); len(documents) > 0 {
+		i.warn("The links to the documents %s were left as text", strings.Join(documents, ", "))
+	}
+	if includes := uniqueSorted(r.includes); len(includes) > 0 {
+		i.warn("The included files %s were left out", strings.Join(includes, ", "))
+	}
+	if missing := uniqueSorted(r.missing); len(missing) > 0 {
+		i.warn("The references to %s have no target, and were left as text", strings.Join(missing, ", "))
+	}
+}
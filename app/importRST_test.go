@@ -0,0 +1,84 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/lexLibrary/lexLibrary/app"
+)
+
+func TestImportRST(t *testing.T) {
+	resetDocuments(t)
+
+	tenant, err := app.TenantNew(installAdmin(t), "Import RST Tenant", "", "")
+	if err != nil {
+		t.Fatalf("Error creating tenant: %s", err)
+	}
+	author := testUser(t, tenant, "author")
+	fixtures := app.ImportDir("testdata/import")
+
+	result, err := app.ImportRST(author, nil, fixtures, "guide.rst")
+	if err != nil {
+		t.Fatalf("Error importing guide.rst: %s", err)
+	}
+	warnings := []string{
+		"The directives jira have no equivalent in a document, and only their content was kept",
+		"The links to the documents other/page were left as text",
+		"The references to Missing have no target, and were left as text",
+	}
+	if strings.Join(result.Warnings, "\n") != strings.Join(warnings, "\n") {
+		t.Fatalf("Invalid warnings. Wanted %q got %q", warnings, result.Warnings)
+	}
+
+	doc := result.Document
+	rev, err := doc.Latest()
+	if err != nil {
+		t.Fatalf("Error getting revision: %s", err)
+	}
+	if rev.Title != "Pump Guide" {
+		t.Fatalf("Invalid title: %q", rev.Title)
+	}
+
+	tags, err := doc.Tags()
+	if err != nil {
+		t.Fatalf("Error getting tags: %s", err)
+	}
+	if len(tags) != 2 || tags[0].Name != "maintenance" || tags[1].Name != "pumps" {
+		t.Fatalf("Invalid tags: %+v", tags)
+	}
+
+	attachments, err := doc.Attachments()
+	if err != nil {
+		t.Fatalf("Error getting attachments: %s", err)
+	}
+	if len(attachments) != 1 || attachments[0].Name != "logo.png" {
+		t.Fatalf("Invalid attachments: %+v", attachments)
+	}
+
+	for _, want := range []string{
+		`<h1 id="pump-guide">Pump Guide</h1>`,
+		`see <a href="#installing">Installing</a> and <a href="#cleaning">the cleaning steps</a>.`,
+		`<a href="https://example.com/pumps">the vendor</a> or <a href="https://example.com">Vendor</a>.`,
+		`<h2 id="installing">Installing</h2>`,
+		"<blockquote>\n<p><strong>Note</strong></p>\n<p>Turn the power off\nbefore starting.</p>\n</blockquote>",
+		"<blockquote>\n<p><strong>Warning</strong></p>\n<p>Wear gloves.</p>\n</blockquote>",
+		`<pre><code class="language-bash">pump --install &amp;&amp; echo &quot;&lt;done&gt;&quot;</code></pre>`,
+		"<p>Run it from the shell:</p>\n<pre><code>$ pump status</code></pre>",
+		`<h3 id="cleaning">Cleaning</h3>`,
+		"<li><p>Scrub it with <code>soap</code>.</p>\n<ul>\n<li>Gently.</li>",
+		`<img src="` + attachments[0].URL() + `" alt="Logo" width="100"`,
+		"<thead>\n<tr><th>Part</th><th>Count</th></tr>\n</thead>\n<tbody>\n<tr><td>Filter</td><td>2</td></tr>",
+		"<tr><td>Scrub</td><td>10 min</td></tr>",
+		`<tr><td>Monday</td><td><a href="#cleaning">Cleaning</a></td></tr>`,
+		"<p>See other/page and Missing.</p>\n<p>Ticket content.</p>",
+	} {
+		if !strings.Contains(rev.Body, want) {
+			t.Fatalf("Body is missing %s:\n%s", want, rev.Body)
+		}
+	}
+	if strings.Contains(rev.Body, "OPS-1") || strings.Contains(rev.Body, "orphan") {
+		t.Fatalf("Body contains directive arguments or metadata:\n%s", rev.Body)
+	}
+}
@@ -0,0 +1,993 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+	Markdown is converted to HTML with a CommonMark parser, extended with the GitHub Flavored Markdown tables, task
+	lists and strikethrough.  Parsing follows the CommonMark reference implementation: the document is first split
+	into a tree of blocks (paragraphs, lists, block quotes, code blocks etc) one line at a time, and then the text
+	of each paragraph, heading and table cell is parsed into inlines (emphasis, links, code spans etc).  See
+	markdownInline.go for the inline parser.
+
+	Raw HTML in the Markdown is passed through as is, so anything rendered from Markdown that isn't trusted needs to
+	be sanitized.
+*/
+
+type mdBlockType int
+
+const (
+	mdDocument mdBlockType = iota
+	mdBlockQuote
+	mdList
+	mdItem
+	mdParagraph
+	mdHeading
+	mdThematicBreak
+	mdCodeBlock
+	mdHTMLBlock
+	mdTable
+)
+
+// Task list item states
+const (
+	mdTaskNone = iota
+	mdTaskOpen
+	mdTaskDone
+)
+
+// mdBlock is a block in the tree of a Markdown document
+type mdBlock struct {
+	typ           mdBlockType
+	parent        *mdBlock
+	children      []*mdBlock
+	open          bool
+	lastLineBlank bool
+	startLine     int
+
+	// lines of text in paragraphs, code blocks, html blocks and tables
+	lines []string
+	// content of paragraphs and headings after parsing
+	content string
+	level   int
+
+	// code blocks
+	fenced      bool
+	fenceChar   byte
+	fenceLength int
+	fenceOffset int
+	info        string
+
+	htmlType int
+
+	// lists and list items
+	list *mdListData
+	task int
+
+	// tables
+	align []string
+	rows  [][]string
+}
+
+// mdListData describes the marker of a list and its items
+type mdListData struct {
+	ordered      bool
+	bullet       byte // the bullet character, or the delimiter after the number of an ordered list
+	start        int
+	tight        bool
+	markerOffset int
+	padding      int
+}
+
+func (b *mdBlock) lastChild() *mdBlock {
+	if len(b.children) == 0 {
+		return nil
+	}
+	return b.children[len(b.children)-1]
+}
+
+// acceptsLines is true for blocks that take the rest of each line as their content
+func (b *mdBlock) acceptsLines() bool {
+	switch b.typ {
+	case mdParagraph, mdCodeBlock, mdHTMLBlock, mdTable:
+		return true
+	}
+	return false
+}
+
+func (b *mdBlock) canContain(t mdBlockType) bool {
+	switch b.typ {
+	case mdDocument, mdBlockQuote, mdItem:
+		return t != mdItem
+	case mdList:
+		return t == mdItem
+	}
+	return false
+}
+
+// remove removes the block from its parent
+func (b *mdBlock) remove() {
+	if b.parent == nil {
+		return
+	}
+	siblings := b.parent.children
+	for i := range siblings {
+		if siblings[i] == b {
+			b.parent.children = append(siblings[:i], siblings[i+1:]...)
+			return
+		}
+	}
+}
+
+// mdRef is a link reference definition
+type mdRef struct {
+	dest  string
+	title string
+}
+
+// mdParser parses Markdown into blocks one line at a time
+type mdParser struct {
+	doc          *mdBlock
+	tip          *mdBlock
+	oldTip       *mdBlock
+	lastMatched  *mdBlock
+	allClosed    bool
+	refs         map[string]mdRef
+	line         string
+	lineNumber   int
+	offset       int
+	nextNonspace int
+	indent       int
+	indented     bool
+	blank        bool
+}
+
+const mdCodeIndent = 4
+
+var (
+	reMDATXHeading     = regexp.MustCompile(`^#{1,6}(?:[ \t]+|$)`)
+	reMDATXClosing     = regexp.MustCompile(`(?:^|[ \t]+)#+[ \t]*$`)
+	reMDCodeFence      = regexp.MustCompile("^(?:`{3,}|~{3,})")
+	reMDClosingFence   = regexp.MustCompile("^(?:`{3,}|~{3,})[ \t]*$")
+	reMDSetextHeading  = regexp.MustCompile(`^(?:=+|-+)[ \t]*$`)
+	reMDThematicBreak  = regexp.MustCompile(`^(?:(?:\*[ \t]*){3,}|(?:_[ \t]*){3,}|(?:-[ \t]*){3,})$`)
+	reMDTableDelimiter = regexp.MustCompile(`^\|?[ \t]*:?-+:?[ \t]*(?:\|[ \t]*:?-+:?[ \t]*)*\|?[ \t]*$`)
+
+	reMDHTMLBlockOpen = []*regexp.Regexp{
+		nil,
+		regexp.MustCompile(`(?i)^<(?:script|pre|textarea|style)(?:\s|>|$)`),
+		regexp.MustCompile(`^<!--`),
+		regexp.MustCompile(`^<[?]`),
+		regexp.MustCompile(`^<![A-Za-z]`),
+		regexp.MustCompile(`^<!\[CDATA\[`),
+		regexp.MustCompile(`(?i)^</?(?:address|article|aside|base|basefont|blockquote|body|caption|center|col|` +
+			`colgroup|dd|details|dialog|dir|div|dl|dt|fieldset|figcaption|figure|footer|form|frame|frameset|` +
+			`h[123456]|head|header|hr|html|iframe|legend|li|link|main|menu|menuitem|nav|noframes|ol|optgroup|` +
+			`option|p|param|search|section|summary|table|tbody|td|tfoot|th|thead|title|tr|track|ul)(?:\s|/?>|$)`),
+		regexp.MustCompile(`(?i)^(?:` + mdOpenTag + `|` + mdCloseTag + `)\s*$`),
+	}
+	reMDHTMLBlockClose = []*regexp.Regexp{
+		nil,
+		regexp.MustCompile(`(?i)</(?:script|pre|textarea|style)>`),
+		regexp.MustCompile(`-->`),
+		regexp.MustCompile(`\?>`),
+		regexp.MustCompile(`>`),
+		regexp.MustCompile(`\]\]>`),
+	}
+)
+
+// markdownToHTML converts CommonMark with GitHub Flavored Markdown tables, task lists and strikethrough to HTML
+func markdownToHTML(markdown string) string {
+	p := &mdParser{
+		doc:  &mdBlock{typ: mdDocument, open: true},
+		refs: make(map[string]mdRef),
+	}
+	p.tip = p.doc
+	p.oldTip = p.doc
+
+	markdown = strings.Replace(markdown, "\r\n", "\n", -1)
+	markdown = strings.Replace(markdown, "\r", "\n", -1)
+	markdown = strings.Replace(markdown, "\x00", "�", -1)
+	lines := strings.Split(markdown, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	for _, line := range lines {
+		p.incorporateLine(line)
+	}
+	for p.tip != nil {
+		p.finalize(p.tip)
+	}
+
+	r := &mdRenderer{refs: p.refs}
+	r.block(p.doc, false)
+	return r.buf.String()
+}
+
+// expandTabs replaces the tabs in the indentation of a line with spaces, to the next tab stop
+func expandTabs(line string) string {
+	if strings.IndexByte(line, '\t') == -1 {
+		return line
+	}
+	buf := &bytes.Buffer{}
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if c == '\t' {
+			buf.WriteString(strings.Repeat(" ", 4-buf.Len()%4))
+			continue
+		}
+		if c != ' ' && c != '>' {
+			buf.WriteString(line[i:])
+			break
+		}
+		buf.WriteByte(c)
+	}
+	return buf.String()
+}
+
+func (p *mdParser) findNextNonspace() {
+	i := p.offset
+	for i < len(p.line) && (p.line[i] == ' ' || p.line[i] == '\t') {
+		i++
+	}
+	p.nextNonspace = i
+	p.indent = i - p.offset
+	p.indented = p.indent >= mdCodeIndent
+	p.blank = i >= len(p.line)
+}
+
+func (p *mdParser) advanceNextNonspace() {
+	p.offset = p.nextNonspace
+}
+
+func (p *mdParser) advanceOffset(count int) {
+	p.offset += count
+	if p.offset > len(p.line) {
+		p.offset = len(p.line)
+	}
+}
+
+func (p *mdParser) peek(i int) byte {
+	if i < len(p.line) {
+		return p.line[i]
+	}
+	return 0
+}
+
+func (p *mdParser) incorporateLine(line string) {
+	p.line = expandTabs(line)
+	p.lineNumber++
+	p.offset = 0
+	p.oldTip = p.tip
+
+	container := p.doc
+	for {
+		last := container.lastChild()
+		if last == nil || !last.open {
+			break
+		}
+		p.findNextNonspace()
+		match := p.continueBlock(last)
+		if match == mdNoMatch {
+			break
+		}
+		if match == mdLineDone {
+			return
+		}
+		container = last
+	}
+
+	p.allClosed = container == p.oldTip
+	p.lastMatched = container
+
+	matchedLeaf := container.typ != mdParagraph && container.typ != mdTable && container.acceptsLines()
+	for !matchedLeaf {
+		p.findNextNonspace()
+		started := mdNoMatch
+		for _, start := range mdBlockStarts {
+			started = start(p, container)
+			if started != mdNoMatch {
+				break
+			}
+		}
+		if started == mdNoMatch {
+			p.advanceNextNonspace()
+			break
+		}
+		container = p.tip
+		if started == mdLeaf {
+			matchedLeaf = true
+		}
+	}
+
+	if !p.allClosed && !p.blank && p.tip.typ == mdParagraph {
+		// lazy continuation of a paragraph
+		p.addLine()
+		return
+	}
+
+	p.closeUnmatchedBlocks()
+	if p.blank && container.lastChild() != nil {
+		container.lastChild().lastLineBlank = true
+	}
+
+	lastLineBlank := p.blank && !(container.typ == mdBlockQuote ||
+		(container.typ == mdCodeBlock && container.fenced) ||
+		(container.typ == mdItem && len(container.children) == 0 && container.startLine == p.lineNumber))
+	for b := container; b != nil; b = b.parent {
+		b.lastLineBlank = lastLineBlank
+	}
+
+	if container.acceptsLines() {
+		p.addLine()
+		if container.typ == mdHTMLBlock && container.htmlType >= 1 && container.htmlType <= 5 &&
+			reMDHTMLBlockClose[container.htmlType].MatchString(p.line[p.offset:]) {
+			p.finalize(container)
+		}
+	} else if p.offset < len(p.line) && !p.blank {
+		p.addChild(mdParagraph)
+		p.advanceNextNonspace()
+		p.addLine()
+	}
+}
+
+// Results of continuing or starting a block
+const (
+	mdNoMatch = iota
+	mdMatched
+	mdLeaf
+	mdLineDone
+)
+
+// continueBlock checks if the line continues an open block, and consumes the block's markers if it does
+func (p *mdParser) continueBlock(b *mdBlock) int {
+	switch b.typ {
+	case mdDocument, mdList:
+		return mdMatched
+	case mdBlockQuote:
+		if p.indented || p.peek(p.nextNonspace) != '>' {
+			return mdNoMatch
+		}
+		p.advanceNextNonspace()
+		p.advanceOffset(1)
+		if c := p.peek(p.offset); c == ' ' || c == '\t' {
+			p.advanceOffset(1)
+		}
+		return mdMatched
+	case mdItem:
+		if p.blank {
+			if len(b.children) == 0 {
+				// an item can start with at most one blank line
+				return mdNoMatch
+			}
+			p.advanceNextNonspace()
+			return mdMatched
+		}
+		if p.indent >= b.list.markerOffset+b.list.padding {
+			p.advanceOffset(b.list.markerOffset + b.list.padding)
+			return mdMatched
+		}
+		return mdNoMatch
+	case mdCodeBlock:
+		if b.fenced {
+			rest := p.line[p.nextNonspace:]
+			if p.indent < mdCodeIndent && len(rest) > 0 && rest[0] == b.fenceChar &&
+				reMDClosingFence.MatchString(rest) &&
+				len(strings.TrimRight(rest, " \t")) >= b.fenceLength {
+				p.finalize(b)
+				return mdLineDone
+			}
+			for i := b.fenceOffset; i > 0 && p.peek(p.offset) == ' '; i-- {
+				p.advanceOffset(1)
+			}
+			return mdMatched
+		}
+		if p.indent >= mdCodeIndent {
+			p.advanceOffset(mdCodeIndent)
+			return mdMatched
+		}
+		if p.blank {
+			p.advanceNextNonspace()
+			return mdMatched
+		}
+		return mdNoMatch
+	case mdHTMLBlock:
+		if p.blank && (b.htmlType == 6 || b.htmlType == 7) {
+			return mdNoMatch
+		}
+		return mdMatched
+	case mdParagraph, mdTable:
+		if p.blank {
+			return mdNoMatch
+		}
+		return mdMatched
+	}
+	// headings and thematic breaks are only ever one line
+	return mdNoMatch
+}
+
+// closeUnmatchedBlocks finalizes the blocks that weren't continued by the current line
+func (p *mdParser) closeUnmatchedBlocks() {
+	if p.allClosed {
+		return
+	}
+	for p.oldTip != p.lastMatched {
+		parent := p.oldTip.parent
+		p.finalize(p.oldTip)
+		p.oldTip = parent
+	}
+	p.allClosed = true
+}
+
+// addChild adds a new block as a child of the tip, closing any blocks that can't contain it
+func (p *mdParser) addChild(t mdBlockType) *mdBlock {
+	for !p.tip.canContain(t) {
+		p.finalize(p.tip)
+	}
+	b := &mdBlock{typ: t, parent: p.tip, open: true, startLine: p.lineNumber}
+	p.tip.children = append(p.tip.children, b)
+	p.tip = b
+	return b
+}
+
+func (p *mdParser) addLine() {
+	p.tip.lines = append(p.tip.lines, p.line[p.offset:])
+}
+
+// finalize closes the block, and does any processing that needs the block's full content
+func (p *mdParser) finalize(b *mdBlock) {
+	b.open = false
+	p.tip = b.parent
+
+	switch b.typ {
+	case mdParagraph:
+		b.content = p.paragraphContent(b)
+		if b.content == "" {
+			b.remove()
+		}
+	case mdCodeBlock:
+		if b.fenced {
+			if len(b.lines) > 0 {
+				b.info = unescapeMarkdown(strings.TrimSpace(b.lines[0]))
+				b.lines = b.lines[1:]
+			}
+			break
+		}
+		for len(b.lines) > 0 && strings.TrimSpace(b.lines[len(b.lines)-1]) == "" {
+			b.lines = b.lines[:len(b.lines)-1]
+		}
+	case mdItem:
+		b.task = taskState(b)
+	case mdList:
+		b.list.tight = listTight(b)
+	case mdTable:
+		b.rows = make([][]string, 0, len(b.lines)-1)
+		b.rows = append(b.rows, tableCells(b.lines[0], len(b.align)))
+		for _, line := range b.lines[2:] {
+			b.rows = append(b.rows, tableCells(line, len(b.align)))
+		}
+	}
+}
+
+// paragraphContent removes any link reference definitions from the start of the paragraph, and returns what's left
+func (p *mdParser) paragraphContent(b *mdBlock) string {
+	lines := make([]string, len(b.lines))
+	for i := range b.lines {
+		lines[i] = strings.TrimLeft(b.lines[i], " \t")
+	}
+	content := strings.Join(lines, "\n")
+	for strings.HasPrefix(content, "[") {
+		consumed := parseReference(content, p.refs)
+		if consumed == 0 {
+			break
+		}
+		content = content[consumed:]
+	}
+	return strings.TrimRight(content, " \t\n")
+}
+
+// listTight returns true if none of the list's items are separated by blank lines, and no item has blank lines
+// between its blocks
+func listTight(list *mdBlock) bool {
+	for i, item := range list.children {
+		lastItem := i == len(list.children)-1
+		if endsWithBlankLine(item) && !lastItem {
+			return false
+		}
+		for j, child := range item.children {
+			if endsWithBlankLine(child) && (!lastItem || j != len(item.children)-1) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func endsWithBlankLine(b *mdBlock) bool {
+	for b != nil {
+		if b.lastLineBlank {
+			return true
+		}
+		if b.typ != mdList && b.typ != mdItem {
+			return false
+		}
+		b = b.lastChild()
+	}
+	return false
+}
+
+// taskState returns the state of a GFM task list item, which starts with [ ] or [x], and removes the checkbox from
+// the item's text
+func taskState(item *mdBlock) int {
+	if len(item.children) == 0 || item.children[0].typ != mdParagraph {
+		return mdTaskNone
+	}
+	para := item.children[0]
+	content := para.content
+	if len(content) < 4 || content[0] != '[' || content[2] != ']' || (content[3] != ' ' && content[3] != '\t' &&
+		content[3] != '\n') {
+		return mdTaskNone
+	}
+	state := mdTaskNone
+	switch content[1] {
+	case ' ':
+		state = mdTaskOpen
+	case 'x', 'X':
+		state = mdTaskDone
+	default:
+		return mdTaskNone
+	}
+	para.content = strings.TrimLeft(content[4:], " \t")
+	return state
+}
+
+// mdBlockStart checks if the line starts a new block in the container, and adds it if it does
+type mdBlockStart func(p *mdParser, container *mdBlock) int
+
+var mdBlockStarts []mdBlockStart
+
+func init() {
+	mdBlockStarts = []mdBlockStart{
+		startBlockQuote,
+		startATXHeading,
+		startFencedCode,
+		startHTMLBlock,
+		startSetextHeading,
+		startTable,
+		startThematicBreak,
+		startListItem,
+		startIndentedCode,
+	}
+}
+
+func startBlockQuote(p *mdParser, container *mdBlock) int {
+	if p.indented || p.peek(p.nextNonspace) != '>' {
+		return mdNoMatch
+	}
+	p.advanceNextNonspace()
+	p.advanceOffset(1)
+	if c := p.peek(p.offset); c == ' ' || c == '\t' {
+		p.advanceOffset(1)
+	}
+	p.closeUnmatchedBlocks()
+	p.addChild(mdBlockQuote)
+	return mdMatched
+}
+
+func startATXHeading(p *mdParser, container *mdBlock) int {
+	if p.indented {
+		return mdNoMatch
+	}
+	match := reMDATXHeading.FindString(p.line[p.nextNonspace:])
+	if match == "" {
+		return mdNoMatch
+	}
+	p.advanceNextNonspace()
+	p.advanceOffset(len(match))
+	p.closeUnmatchedBlocks()
+	b := p.addChild(mdHeading)
+	b.level = len(strings.TrimRight(match, " \t"))
+	b.content = strings.TrimSpace(reMDATXClosing.ReplaceAllString(p.line[p.offset:], ""))
+	p.advanceOffset(len(p.line))
+	return mdLeaf
+}
+
+func startFencedCode(p *mdParser, container *mdBlock) int {
+	if p.indented {
+		return mdNoMatch
+	}
+	rest := p.line[p.nextNonspace:]
+	fence := reMDCodeFence.FindString(rest)
+	if fence == "" {
+		return mdNoMatch
+	}
+	if fence[0] == '`' && strings.IndexByte(rest[len(fence):], '`') != -1 {
+		// the info string of a backtick fence can't contain backticks
+		return mdNoMatch
+	}
+	p.closeUnmatchedBlocks()
+	b := p.addChild(mdCodeBlock)
+	b.fenced = true
+	b.fenceChar = fence[0]
+	b.fenceLength = len(fence)
+	b.fenceOffset = p.indent
+	p.advanceNextNonspace()
+	p.advanceOffset(len(fence))
+	return mdLeaf
+}
+
+func startHTMLBlock(p *mdParser, container *mdBlock) int {
+	if p.indented || p.peek(p.nextNonspace) != '<' {
+		return mdNoMatch
+	}
+	rest := p.line[p.nextNonspace:]
+	for t := 1; t < len(reMDHTMLBlockOpen); t++ {
+		if !reMDHTMLBlockOpen[t].MatchString(rest) {
+			continue
+		}
+		if t == 7 && (container.typ == mdParagraph || (!p.allClosed && !p.blank && p.tip.typ == mdParagraph)) {
+			// only the first six types of HTML blocks can interrupt a paragraph
+			return mdNoMatch
+		}
+		p.closeUnmatchedBlocks()
+		b := p.addChild(mdHTMLBlock)
+		b.htmlType = t
+		return mdLeaf
+	}
+	return mdNoMatch
+}
+
+func startSetextHeading(p *mdParser, container *mdBlock) int {
+	if p.indented || container.typ != mdParagraph {
+		return mdNoMatch
+	}
+	rest := p.line[p.nextNonspace:]
+	if !reMDSetextHeading.MatchString(rest) {
+		return mdNoMatch
+	}
+	p.closeUnmatchedBlocks()
+	content := p.paragraphContent(container)
+	if content == "" {
+		// the paragraph was only link reference definitions
+		return mdNoMatch
+	}
+
+	heading := &mdBlock{typ: mdHeading, parent: container.parent, open: true, startLine: container.startLine,
+		content: content}
+	heading.level = 2
+	if rest[0] == '=' {
+		heading.level = 1
+	}
+	siblings := container.parent.children
+	siblings[len(siblings)-1] = heading
+	p.tip = heading
+	p.advanceOffset(len(p.line))
+	return mdLeaf
+}
+
+func startTable(p *mdParser, container *mdBlock) int {
+	if p.indented || container.typ != mdParagraph || len(container.lines) == 0 {
+		return mdNoMatch
+	}
+	rest := strings.TrimRight(p.line[p.nextNonspace:], " \t")
+	if strings.IndexByte(rest, '|') == -1 || !reMDTableDelimiter.MatchString(rest) {
+		return mdNoMatch
+	}
+	header := container.lines[len(container.lines)-1]
+	delimiters := splitTableRow(rest)
+	if len(splitTableRow(header)) != len(delimiters) {
+		return mdNoMatch
+	}
+
+	p.closeUnmatchedBlocks()
+	container.lines = container.lines[:len(container.lines)-1]
+	if len(container.lines) == 0 {
+		container.remove()
+		p.tip = container.parent
+	} else {
+		p.finalize(container)
+	}
+
+	b := p.addChild(mdTable)
+	b.lines = []string{strings.TrimSpace(header)}
+	for _, d := range delimiters {
+		left := strings.HasPrefix(d, ":")
+		right := strings.HasSuffix(d, ":")
+		switch {
+		case left && right:
+			b.align = append(b.align, "center")
+		case left:
+			b.align = append(b.align, "left")
+		case right:
+			b.align = append(b.align, "right")
+		default:
+			b.align = append(b.align, "")
+		}
+	}
+	p.advanceNextNonspace()
+	return mdLeaf
+}
+
+// splitTableRow splits a row of a table into its trimmed cells on the pipes that aren't escaped
+func splitTableRow(row string) []string {
+	row = strings.TrimSpace(row)
+	row = strings.TrimPrefix(row, "|")
+	if strings.HasSuffix(row, "|") && !strings.HasSuffix(row, `\|`) {
+		row = row[:len(row)-1]
+	}
+
+	var cells []string
+	cell := &bytes.Buffer{}
+	for i := 0; i < len(row); i++ {
+		switch {
+		case row[i] == '\\' && i+1 < len(row) && row[i+1] == '|':
+			cell.WriteByte('|')
+			i++
+		case row[i] == '\\' && i+1 < len(row):
+			cell.WriteString(row[i : i+2])
+			i++
+		case row[i] == '|':
+			cells = append(cells, strings.TrimSpace(cell.String()))
+			cell.Reset()
+		default:
+			cell.WriteByte(row[i])
+		}
+	}
+	return append(cells, strings.TrimSpace(cell.String()))
+}
+
+// tableCells returns the cells of a table row, padded or cut to the number of columns in the table
+func tableCells(row string, columns int) []string {
+	cells := splitTableRow(row)
+	for len(cells) < columns {
+		cells = append(cells, "")
+	}
+	return cells[:columns]
+}
+
+func startThematicBreak(p *mdParser, container *mdBlock) int {
+	if p.indented || !reMDThematicBreak.MatchString(p.line[p.nextNonspace:]) {
+		return mdNoMatch
+	}
+	p.closeUnmatchedBlocks()
+	p.addChild(mdThematicBreak)
+	p.advanceOffset(len(p.line))
+	return mdLeaf
+}
+
+func startListItem(p *mdParser, container *mdBlock) int {
+	if p.indented && container.typ != mdList {
+		return mdNoMatch
+	}
+	data := p.parseListMarker(container)
+	if data == nil {
+		return mdNoMatch
+	}
+	p.closeUnmatchedBlocks()
+
+	if p.tip.typ != mdList || !listsMatch(p.tip.list, data) {
+		list := p.addChild(mdList)
+		list.list = data
+	}
+	item := p.addChild(mdItem)
+	item.list = data
+	return mdMatched
+}
+
+// parseListMarker parses the bullet or number that starts a list item, and consumes it along with the spaces after
+// it that are part of the item's indentation
+func (p *mdParser) parseListMarker(container *mdBlock) *mdListData {
+	if p.indent >= mdCodeIndent {
+		return nil
+	}
+	rest := p.line[p.nextNonspace:]
+	data := &mdListData{tight: true, markerOffset: p.indent}
+	markerLength := 0
+
+	switch {
+	case rest == "":
+		return nil
+	case rest[0] == '*' || rest[0] == '+' || rest[0] == '-':
+		data.bullet = rest[0]
+		markerLength = 1
+	default:
+		digits := 0
+		for digits < len(rest) && digits < 10 && rest[digits] >= '0' && rest[digits] <= '9' {
+			digits++
+		}
+		if digits == 0 || digits > 9 || digits >= len(rest) || (rest[digits] != '.' && rest[digits] != ')') {
+			return nil
+		}
+		start, _ := strconv.Atoi(rest[:digits])
+		if container.typ == mdParagraph && start != 1 {
+			// only a list starting with 1 can interrupt a paragraph
+			return nil
+		}
+		data.ordered = true
+		data.start = start
+		data.bullet = rest[digits]
+		markerLength = digits + 1
+	}
+
+	if markerLength < len(rest) && rest[markerLength] != ' ' && rest[markerLength] != '\t' {
+		return nil
+	}
+	if container.typ == mdParagraph && strings.TrimSpace(rest[markerLength:]) == "" {
+		// an empty item can't interrupt a paragraph
+		return nil
+	}
+
+	p.advanceNextNonspace()
+	p.advanceOffset(markerLength)
+	spacesStart := p.offset
+	for p.offset-spacesStart < 5 && (p.peek(p.offset) == ' ' || p.peek(p.offset) == '\t') {
+		p.advanceOffset(1)
+	}
+	spaces := p.offset - spacesStart
+	blankItem := p.offset >= len(p.line)
+	if spaces >= 5 || spaces < 1 || blankItem {
+		// content indented five or more spaces is an indented code block inside the item
+		data.padding = markerLength + 1
+		p.offset = spacesStart
+		if c := p.peek(p.offset); c == ' ' || c == '\t' {
+			p.advanceOffset(1)
+		}
+	} else {
+		data.padding = markerLength + spaces
+	}
+	return data
+}
+
+func listsMatch(list, item *mdListData) bool {
+	return list.ordered == item.ordered && list.bullet == item.bullet
+}
+
+func startIndentedCode(p *mdParser, container *mdBlock) int {
+	if !p.indented || p.tip.typ == mdParagraph || p.blank {
+		return mdNoMatch
+	}
+	p.advanceOffset(mdCodeIndent)
+	p.closeUnmatchedBlocks()
+	p.addChild(mdCodeBlock)
+	return mdLeaf
+}
+
+// mdRenderer writes the blocks of a Markdown document as HTML
+type mdRenderer struct {
+	buf  bytes.Buffer
+	refs map[string]mdRef
+}
+
+// cr starts a new line, if the output isn't already at the start of one
+func (r *mdRenderer) cr() {
+	if r.buf.Len() > 0 && r.buf.Bytes()[r.buf.Len()-1] != '\n' {
+		r.buf.WriteByte('\n')
+	}
+}
+
+func (r *mdRenderer) inlines(text string) {
+	renderInlines(&r.buf, parseInlines(text, r.refs))
+}
+
+func (r *mdRenderer) block(b *mdBlock, tight bool) {
+	switch b.typ {
+	case mdDocument:
+		for _, child := range b.children {
+			r.block(child, false)
+		}
+	case mdBlockQuote:
+		r.cr()
+		r.buf.WriteString("<blockquote>\n")
+		for _, child := range b.children {
+			r.block(child, false)
+		}
+		r.cr()
+		r.buf.WriteString("</blockquote>\n")
+	case mdList:
+		r.cr()
+		tag := "ul"
+		if b.list.ordered {
+			tag = "ol"
+		}
+		r.buf.WriteString("<" + tag)
+		if b.list.ordered && b.list.start != 1 {
+			r.buf.WriteString(` start="` + strconv.Itoa(b.list.start) + `"`)
+		}
+		r.buf.WriteString(">\n")
+		for _, item := range b.children {
+			r.block(item, b.list.tight)
+		}
+		r.cr()
+		r.buf.WriteString("</" + tag + ">\n")
+	case mdItem:
+		r.cr()
+		r.buf.WriteString("<li>")
+		switch b.task {
+		case mdTaskOpen:
+			r.buf.WriteString(`<input type="checkbox" disabled="" /> `)
+		case mdTaskDone:
+			r.buf.WriteString(`<input type="checkbox" checked="" disabled="" /> `)
+		}
+		for _, child := range b.children {
+			r.block(child, tight)
+		}
+		r.buf.WriteString("</li>\n")
+	case mdParagraph:
+		if tight {
+			r.inlines(b.content)
+			return
+		}
+		r.cr()
+		r.buf.WriteString("<p>")
+		r.inlines(b.content)
+		r.buf.WriteString("</p>\n")
+	case mdHeading:
+		tag := "h" + strconv.Itoa(b.level)
+		r.cr()
+		r.buf.WriteString("<" + tag + ">")
+		r.inlines(b.content)
+		r.buf.WriteString("</" + tag + ">\n")
+	case mdThematicBreak:
+		r.cr()
+		r.buf.WriteString("<hr />\n")
+	case mdCodeBlock:
+		r.cr()
+		r.buf.WriteString("<pre><code")
+		if info := strings.Fields(b.info); len(info) > 0 {
+			r.buf.WriteString(` class="language-` + escapeHTML(info[0]) + `"`)
+		}
+		r.buf.WriteString(">")
+		for _, line := range b.lines {
+			r.buf.WriteString(escapeHTML(line) + "\n")
+		}
+		r.buf.WriteString("</code></pre>\n")
+	case mdHTMLBlock:
+		r.cr()
+		r.buf.WriteString(strings.Join(b.lines, "\n"))
+		r.cr()
+	case mdTable:
+		r.table(b)
+	}
+}
+
+func (r *mdRenderer) table(b *mdBlock) {
+	row := func(cells []string, tag string) {
+		r.buf.WriteString("<tr>\n")
+		for i, cell := range cells {
+			r.buf.WriteString("<" + tag)
+			if b.align[i] != "" {
+				r.buf.WriteString(` align="` + b.align[i] + `"`)
+			}
+			r.buf.WriteString(">")
+			r.inlines(cell)
+			r.buf.WriteString("</" + tag + ">\n")
+		}
+		r.buf.WriteString("</tr>\n")
+	}
+
+	r.cr()
+	r.buf.WriteString("<table>\n<thead>\n")
+	row(b.rows[0], "th")
+	r.buf.WriteString("</thead>\n")
+	if len(b.rows) > 1 {
+		r.buf.WriteString("<tbody>\n")
+		for _, cells := range b.rows[1:] {
+			row(cells, "td")
+		}
+		r.buf.WriteString("</tbody>\n")
+	}
+	r.buf.WriteString("</table>\n")
+}
+
+// escapeHTML escapes the text so it can be written into HTML content or a quoted attribute
+func escapeHTML(text string) string {
+	return htmlEscaper.Replace(text)
+}
+
+var htmlEscaper = strings.NewReplacer(`&`, "&amp;", `<`, "&lt;", `>`, "&gt;", `"`, "&quot;")
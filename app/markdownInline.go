@@ -0,0 +1,855 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+/*
+	Inline Markdown is parsed into a tree of inlines with the CommonMark delimiter algorithm: runs of *, _ and ~ are
+	added as text and remembered on a delimiter stack, and once a closing bracket or the end of the text is
+	reached, the delimiters are matched into emphasis, strong emphasis and strikethrough from the inside out.
+*/
+
+type mdInlineType int
+
+const (
+	mdText mdInlineType = iota
+	mdSoftBreak
+	mdHardBreak
+	mdCode
+	mdEmph
+	mdStrong
+	mdStrike
+	mdLink
+	mdImage
+	mdRawHTML
+	mdInlineRoot
+)
+
+// mdInline is an inline in a paragraph, linked to its siblings so delimiters can be matched into emphasis
+type mdInline struct {
+	typ     mdInlineType
+	literal string
+	dest    string
+	title   string
+
+	parent      *mdInline
+	first, last *mdInline
+	prev, next  *mdInline
+}
+
+func (n *mdInline) appendChild(child *mdInline) {
+	child.unlink()
+	child.parent = n
+	if n.last == nil {
+		n.first = child
+		n.last = child
+		return
+	}
+	n.last.next = child
+	child.prev = n.last
+	n.last = child
+}
+
+func (n *mdInline) insertAfter(sibling *mdInline) {
+	sibling.unlink()
+	sibling.next = n.next
+	if sibling.next != nil {
+		sibling.next.prev = sibling
+	}
+	sibling.prev = n
+	n.next = sibling
+	sibling.parent = n.parent
+	if n.parent != nil && n.parent.last == n {
+		n.parent.last = sibling
+	}
+}
+
+func (n *mdInline) unlink() {
+	if n.prev != nil {
+		n.prev.next = n.next
+	} else if n.parent != nil {
+		n.parent.first = n.next
+	}
+	if n.next != nil {
+		n.next.prev = n.prev
+	} else if n.parent != nil {
+		n.parent.last = n.prev
+	}
+	n.parent = nil
+	n.prev = nil
+	n.next = nil
+}
+
+// mdDelimiter is a run of emphasis characters that may open or close emphasis
+type mdDelimiter struct {
+	node          *mdInline
+	char          byte
+	count         int
+	originalCount int
+	canOpen       bool
+	canClose      bool
+	prev, next    *mdDelimiter
+}
+
+// mdBracket is an opening bracket of a link or image that hasn't been closed yet
+type mdBracket struct {
+	node         *mdInline
+	prev         *mdBracket
+	prevDelim    *mdDelimiter
+	index        int
+	image        bool
+	active       bool
+	bracketAfter bool
+}
+
+// mdInlineParser parses the text of a paragraph, heading or table cell
+type mdInlineParser struct {
+	subject  string
+	pos      int
+	refs     map[string]mdRef
+	delims   *mdDelimiter
+	brackets *mdBracket
+}
+
+const (
+	mdTagName        = `[A-Za-z][A-Za-z0-9-]*`
+	mdAttributeName  = `[a-zA-Z_:][a-zA-Z0-9:._-]*`
+	mdAttributeValue = `(?:[^"'=<>` + "`" + `\x00-\x20]+|'[^']*'|"[^"]*")`
+	mdAttribute      = `(?:\s+` + mdAttributeName + `(?:\s*=\s*` + mdAttributeValue + `)?)`
+	mdOpenTag        = `<` + mdTagName + mdAttribute + `*\s*/?>`
+	mdCloseTag       = `</` + mdTagName + `\s*[>]`
+	mdComment        = `<!---?>|<!--(?:[^-]|-[^-])*-->`
+	mdProcessing     = `[<][?][\s\S]*?[?][>]`
+	mdDeclaration    = `<![A-Za-z][^>]*>`
+	mdCDATA          = `<!\[CDATA\[[\s\S]*?\]\]>`
+	mdPunctuation    = "!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"
+)
+
+var (
+	reMDHTMLTag = regexp.MustCompile(`^(?:` + mdOpenTag + `|` + mdCloseTag + `|` + mdComment + `|` + mdProcessing +
+		`|` + mdDeclaration + `|` + mdCDATA + `)`)
+	reMDAutolink   = regexp.MustCompile(`^<[A-Za-z][A-Za-z0-9.+-]{1,31}:[^<>\x00-\x20]*>`)
+	reMDEmail      = regexp.MustCompile(`^<[a-zA-Z0-9.!#$%&'*+/=?^_` + "`" + `{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*>`)
+	reMDEntity     = regexp.MustCompile(`^&(?:#[xX][0-9a-fA-F]{1,6}|#[0-9]{1,7}|[A-Za-z][A-Za-z0-9]{1,31});`)
+	reMDEscapable  = regexp.MustCompile(`\\[!"#$%&'()*+,./:;<=>?@[\\\]^_` + "`" + `{|}~-]|&(?:#[xX][0-9a-fA-F]{1,6}|#[0-9]{1,7}|[A-Za-z][A-Za-z0-9]{1,31});`)
+	reMDTicks      = regexp.MustCompile("`+")
+	reMDWhitespace = regexp.MustCompile(`[ \t\n]+`)
+)
+
+// parseInlines parses the text into a tree of inlines, using the link reference definitions of the document
+func parseInlines(text string, refs map[string]mdRef) *mdInline {
+	p := &mdInlineParser{subject: text, refs: refs}
+	root := &mdInline{typ: mdInlineRoot}
+	for p.pos < len(p.subject) {
+		p.parseInline(root)
+	}
+	p.processEmphasis(nil)
+	return root
+}
+
+func (p *mdInlineParser) peek() byte {
+	if p.pos < len(p.subject) {
+		return p.subject[p.pos]
+	}
+	return 0
+}
+
+func textInline(text string) *mdInline {
+	return &mdInline{typ: mdText, literal: text}
+}
+
+func (p *mdInlineParser) parseInline(block *mdInline) {
+	c := p.peek()
+	switch c {
+	case '\n':
+		p.parseNewline(block)
+	case '\\':
+		p.parseBackslash(block)
+	case '`':
+		p.parseBackticks(block)
+	case '*', '_', '~':
+		p.parseDelimiters(block, c)
+	case '[':
+		p.pos++
+		node := textInline("[")
+		block.appendChild(node)
+		p.addBracket(node, p.pos-1, false)
+	case '!':
+		p.pos++
+		if p.peek() == '[' {
+			p.pos++
+			node := textInline("![")
+			block.appendChild(node)
+			p.addBracket(node, p.pos-1, true)
+			return
+		}
+		block.appendChild(textInline("!"))
+	case ']':
+		p.parseCloseBracket(block)
+	case '<':
+		p.parseAngle(block)
+	case '&':
+		entity := reMDEntity.FindString(p.subject[p.pos:])
+		if entity != "" && html.UnescapeString(entity) != entity {
+			p.pos += len(entity)
+			block.appendChild(textInline(html.UnescapeString(entity)))
+			return
+		}
+		p.pos++
+		block.appendChild(textInline("&"))
+	default:
+		end := p.pos + 1
+		for end < len(p.subject) && strings.IndexByte("\n\\`*_~[]!<&", p.subject[end]) == -1 {
+			end++
+		}
+		block.appendChild(textInline(p.subject[p.pos:end]))
+		p.pos = end
+	}
+}
+
+func (p *mdInlineParser) parseNewline(block *mdInline) {
+	p.pos++
+	hard := false
+	if last := block.last; last != nil && last.typ == mdText {
+		hard = strings.HasSuffix(last.literal, "  ")
+		last.literal = strings.TrimRight(last.literal, " ")
+	}
+	if hard {
+		block.appendChild(&mdInline{typ: mdHardBreak})
+	} else {
+		block.appendChild(&mdInline{typ: mdSoftBreak})
+	}
+	for p.pos < len(p.subject) && (p.subject[p.pos] == ' ' || p.subject[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *mdInlineParser) parseBackslash(block *mdInline) {
+	p.pos++
+	c := p.peek()
+	switch {
+	case c == '\n':
+		p.pos++
+		block.appendChild(&mdInline{typ: mdHardBreak})
+		for p.pos < len(p.subject) && (p.subject[p.pos] == ' ' || p.subject[p.pos] == '\t') {
+			p.pos++
+		}
+	case c != 0 && strings.IndexByte(mdPunctuation, c) != -1:
+		p.pos++
+		block.appendChild(textInline(string(c)))
+	default:
+		block.appendChild(textInline(`\`))
+	}
+}
+
+func (p *mdInlineParser) parseBackticks(block *mdInline) {
+	ticks := reMDTicks.FindString(p.subject[p.pos:])
+	start := p.pos + len(ticks)
+	p.pos = start
+	for {
+		loc := reMDTicks.FindStringIndex(p.subject[p.pos:])
+		if loc == nil {
+			break
+		}
+		if loc[1]-loc[0] == len(ticks) {
+			code := strings.Replace(p.subject[start:p.pos+loc[0]], "\n", " ", -1)
+			if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.Trim(code, " ") != "" {
+				code = code[1 : len(code)-1]
+			}
+			p.pos += loc[1]
+			block.appendChild(&mdInline{typ: mdCode, literal: code})
+			return
+		}
+		p.pos += loc[1]
+	}
+	// no matching closing backticks, so the opening backticks are just text
+	p.pos = start
+	block.appendChild(textInline(ticks))
+}
+
+// parseDelimiters adds a run of emphasis characters as text, and pushes it on the delimiter stack
+func (p *mdInlineParser) parseDelimiters(block *mdInline, c byte) {
+	start := p.pos
+	for p.pos < len(p.subject) && p.subject[p.pos] == c {
+		p.pos++
+	}
+	count := p.pos - start
+
+	before, after := ' ', ' '
+	if start > 0 {
+		before, _ = utf8.DecodeLastRuneInString(p.subject[:start])
+	}
+	if p.pos < len(p.subject) {
+		after, _ = utf8.DecodeRuneInString(p.subject[p.pos:])
+	}
+	beforeSpace, afterSpace := unicode.IsSpace(before), unicode.IsSpace(after)
+	beforePunct, afterPunct := isMDPunct(before), isMDPunct(after)
+
+	leftFlanking := !afterSpace && (!afterPunct || beforeSpace || beforePunct)
+	rightFlanking := !beforeSpace && (!beforePunct || afterSpace || afterPunct)
+
+	canOpen, canClose := leftFlanking, rightFlanking
+	if c == '_' {
+		canOpen = leftFlanking && (!rightFlanking || beforePunct)
+		canClose = rightFlanking && (!leftFlanking || afterPunct)
+	}
+	if c == '~' && count > 2 {
+		canOpen, canClose = false, false
+	}
+
+	node := textInline(p.subject[start:p.pos])
+	block.appendChild(node)
+	if !canOpen && !canClose {
+		return
+	}
+	d := &mdDelimiter{
+		node:          node,
+		char:          c,
+		count:         count,
+		originalCount: count,
+		canOpen:       canOpen,
+		canClose:      canClose,
+		prev:          p.delims,
+	}
+	if d.prev != nil {
+		d.prev.next = d
+	}
+	p.delims = d
+}
+
+func isMDPunct(r rune) bool {
+	return unicode.IsPunct(r) || unicode.IsSymbol(r)
+}
+
+func (p *mdInlineParser) removeDelimiter(d *mdDelimiter) {
+	if d.prev != nil {
+		d.prev.next = d.next
+	}
+	if d.next == nil {
+		p.delims = d.prev
+	} else {
+		d.next.prev = d.prev
+	}
+}
+
+// processEmphasis matches the delimiters above the stack bottom into emphasis
+func (p *mdInlineParser) processEmphasis(stackBottom *mdDelimiter) {
+	type bottomKey struct {
+		char    byte
+		canOpen bool
+		mod     int
+	}
+	openersBottom := make(map[bottomKey]*mdDelimiter)
+
+	var closer *mdDelimiter
+	for d := p.delims; d != nil && d != stackBottom; d = d.prev {
+		closer = d
+	}
+
+	for closer != nil {
+		if !closer.canClose {
+			closer = closer.next
+			continue
+		}
+
+		key := bottomKey{closer.char, closer.canOpen, closer.originalCount % 3}
+		bottom, ok := openersBottom[key]
+		if !ok {
+			bottom = stackBottom
+		}
+		opener := closer.prev
+		found := false
+		for opener != nil && opener != stackBottom && opener != bottom {
+			oddMatch := (closer.canOpen || opener.canClose) && closer.originalCount%3 != 0 &&
+				(opener.originalCount+closer.originalCount)%3 == 0
+			if opener.char == closer.char && opener.canOpen && !oddMatch &&
+				(closer.char != '~' || opener.count == closer.count) {
+				found = true
+				break
+			}
+			opener = opener.prev
+		}
+
+		if !found {
+			openersBottom[key] = closer.prev
+			next := closer.next
+			if !closer.canOpen {
+				p.removeDelimiter(closer)
+			}
+			closer = next
+			continue
+		}
+
+		use := 1
+		typ := mdEmph
+		switch {
+		case closer.char == '~':
+			use = closer.count
+			typ = mdStrike
+		case closer.count >= 2 && opener.count >= 2:
+			use = 2
+			typ = mdStrong
+		}
+		opener.count -= use
+		closer.count -= use
+		opener.node.literal = opener.node.literal[:len(opener.node.literal)-use]
+		closer.node.literal = closer.node.literal[:len(closer.node.literal)-use]
+
+		emph := &mdInline{typ: typ}
+		for n := opener.node.next; n != nil && n != closer.node; {
+			next := n.next
+			emph.appendChild(n)
+			n = next
+		}
+		opener.node.insertAfter(emph)
+
+		// delimiters between the opener and closer can no longer match
+		for d := closer.prev; d != nil && d != opener; d = d.prev {
+			p.removeDelimiter(d)
+		}
+
+		if opener.count == 0 {
+			opener.node.unlink()
+			p.removeDelimiter(opener)
+		}
+		if closer.count == 0 {
+			closer.node.unlink()
+			next := closer.next
+			p.removeDelimiter(closer)
+			closer = next
+		}
+	}
+
+	for p.delims != nil && p.delims != stackBottom {
+		p.removeDelimiter(p.delims)
+	}
+}
+
+func (p *mdInlineParser) addBracket(node *mdInline, index int, image bool) {
+	if p.brackets != nil {
+		p.brackets.bracketAfter = true
+	}
+	p.brackets = &mdBracket{
+		node:      node,
+		prev:      p.brackets,
+		prevDelim: p.delims,
+		index:     index,
+		image:     image,
+		active:    true,
+	}
+}
+
+// parseCloseBracket closes the most recent opening bracket as a link or image, if a link destination or
+// reference follows it
+func (p *mdInlineParser) parseCloseBracket(block *mdInline) {
+	start := p.pos
+	p.pos++
+
+	opener := p.brackets
+	if opener == nil {
+		block.appendChild(textInline("]"))
+		return
+	}
+	if !opener.active {
+		p.brackets = opener.prev
+		block.appendChild(textInline("]"))
+		return
+	}
+
+	dest, title := "", ""
+	matched := false
+	afterBracket := p.pos
+
+	if p.peek() == '(' {
+		p.pos++
+		p.skipSpaceNewline()
+		var ok bool
+		dest, ok = p.parseLinkDestination()
+		if ok {
+			beforeTitle := p.pos
+			p.skipSpaceNewline()
+			if p.pos > beforeTitle {
+				var titleOK bool
+				title, titleOK = p.parseLinkTitle()
+				if !titleOK {
+					title = ""
+				}
+			}
+			p.skipSpaceNewline()
+			if p.peek() == ')' {
+				p.pos++
+				matched = true
+			}
+		}
+		if !matched {
+			p.pos = afterBracket
+		}
+	}
+
+	if !matched {
+		label := ""
+		length := p.parseLinkLabel()
+		if length > 2 {
+			label = p.subject[afterBracket : afterBracket+length]
+		} else if !opener.bracketAfter {
+			// a collapsed or shortcut reference uses the link text as its label
+			label = p.subject[opener.index : start+1]
+		}
+		if length == 0 {
+			p.pos = afterBracket
+		}
+		if label != "" {
+			if ref, ok := p.refs[normalizeLabel(label)]; ok {
+				dest, title = ref.dest, ref.title
+				matched = true
+			}
+		}
+		if !matched {
+			p.pos = afterBracket
+		}
+	}
+
+	if !matched {
+		p.brackets = opener.prev
+		block.appendChild(textInline("]"))
+		return
+	}
+
+	link := &mdInline{typ: mdLink, dest: dest, title: title}
+	if opener.image {
+		link.typ = mdImage
+	}
+	for n := opener.node.next; n != nil; {
+		next := n.next
+		link.appendChild(n)
+		n = next
+	}
+	block.appendChild(link)
+	p.processEmphasis(opener.prevDelim)
+	p.brackets = opener.prev
+	opener.node.unlink()
+
+	if !opener.image {
+		// links can't contain other links
+		for b := p.brackets; b != nil; b = b.prev {
+			if !b.image {
+				b.active = false
+			}
+		}
+	}
+}
+
+func (p *mdInlineParser) skipSpaceNewline() {
+	newline := false
+	for p.pos < len(p.subject) {
+		c := p.subject[p.pos]
+		if c == '\n' {
+			if newline {
+				return
+			}
+			newline = true
+		} else if c != ' ' && c != '\t' {
+			return
+		}
+		p.pos++
+	}
+}
+
+// parseLinkDestination parses a link destination in angle brackets, or a run of characters with balanced
+// parentheses
+func (p *mdInlineParser) parseLinkDestination() (string, bool) {
+	start := p.pos
+	if p.peek() == '<' {
+		for i := p.pos + 1; i < len(p.subject); i++ {
+			switch p.subject[i] {
+			case '\\':
+				i++
+			case '\n', '<':
+				return "", false
+			case '>':
+				p.pos = i + 1
+				return unescapeMarkdown(p.subject[start+1 : i]), true
+			}
+		}
+		return "", false
+	}
+
+	depth := 0
+	i := p.pos
+loop:
+	for ; i < len(p.subject); i++ {
+		c := p.subject[i]
+		switch {
+		case c == '\\' && i+1 < len(p.subject) && strings.IndexByte(mdPunctuation, p.subject[i+1]) != -1:
+			i++
+		case c == '(':
+			depth++
+			if depth > 32 {
+				return "", false
+			}
+		case c == ')':
+			if depth == 0 {
+				break loop
+			}
+			depth--
+		case c <= ' ' || c == 0x7f:
+			break loop
+		}
+	}
+	if depth != 0 || (i == start && (i >= len(p.subject) || p.subject[i] != ')')) {
+		return "", false
+	}
+	p.pos = i
+	return unescapeMarkdown(p.subject[start:i]), true
+}
+
+// parseLinkTitle parses a link title in double quotes, single quotes or parentheses
+func (p *mdInlineParser) parseLinkTitle() (string, bool) {
+	open := p.peek()
+	close := open
+	switch open {
+	case '"', '\'':
+	case '(':
+		close = ')'
+	default:
+		return "", false
+	}
+	for i := p.pos + 1; i < len(p.subject); i++ {
+		c := p.subject[i]
+		switch {
+		case c == '\\' && i+1 < len(p.subject):
+			i++
+		case c == close:
+			title := unescapeMarkdown(p.subject[p.pos+1 : i])
+			p.pos = i + 1
+			return title, true
+		case c == '(' && open == '(':
+			return "", false
+		}
+	}
+	return "", false
+}
+
+// parseLinkLabel parses a link label in brackets and returns its length including the brackets, or 0 if there
+// isn't a valid label
+func (p *mdInlineParser) parseLinkLabel() int {
+	if p.peek() != '[' {
+		return 0
+	}
+	for i := p.pos + 1; i < len(p.subject) && i-p.pos <= 1000; i++ {
+		switch p.subject[i] {
+		case '\\':
+			i++
+		case '[':
+			return 0
+		case ']':
+			length := i + 1 - p.pos
+			if length > 2 && strings.TrimSpace(p.subject[p.pos+1:i]) == "" {
+				return 0
+			}
+			p.pos = i + 1
+			return length
+		}
+	}
+	return 0
+}
+
+// parseAngle parses an autolink or raw HTML
+func (p *mdInlineParser) parseAngle(block *mdInline) {
+	rest := p.subject[p.pos:]
+	if m := reMDAutolink.FindString(rest); m != "" {
+		p.pos += len(m)
+		dest := m[1 : len(m)-1]
+		link := &mdInline{typ: mdLink, dest: dest}
+		link.appendChild(textInline(dest))
+		block.appendChild(link)
+		return
+	}
+	if m := reMDEmail.FindString(rest); m != "" {
+		p.pos += len(m)
+		email := m[1 : len(m)-1]
+		link := &mdInline{typ: mdLink, dest: "mailto:" + email}
+		link.appendChild(textInline(email))
+		block.appendChild(link)
+		return
+	}
+	if m := reMDHTMLTag.FindString(rest); m != "" {
+		p.pos += len(m)
+		block.appendChild(&mdInline{typ: mdRawHTML, literal: m})
+		return
+	}
+	p.pos++
+	block.appendChild(textInline("<"))
+}
+
+// parseReference parses a link reference definition from the start of the text, adds it to the references,
+// and returns the number of bytes it used, or 0 if the text doesn't start with a reference definition
+func parseReference(text string, refs map[string]mdRef) int {
+	p := &mdInlineParser{subject: text}
+	length := p.parseLinkLabel()
+	if length == 0 || p.peek() != ':' {
+		return 0
+	}
+	label := text[:length]
+	p.pos++
+
+	p.skipSpaceNewline()
+	angled := p.peek() == '<'
+	dest, ok := p.parseLinkDestination()
+	if !ok || (dest == "" && !angled) {
+		return 0
+	}
+
+	beforeTitle := p.pos
+	p.skipSpaceNewline()
+	title := ""
+	titleOK := false
+	if p.pos != beforeTitle {
+		title, titleOK = p.parseLinkTitle()
+	}
+	if !titleOK || !p.atLineEnd() {
+		// a title that isn't followed by the end of the line isn't part of the definition
+		title = ""
+		p.pos = beforeTitle
+		if !p.atLineEnd() {
+			return 0
+		}
+	}
+
+	key := normalizeLabel(label)
+	if key == "" {
+		return 0
+	}
+	if _, ok := refs[key]; !ok {
+		refs[key] = mdRef{dest: dest, title: title}
+	}
+	return p.pos
+}
+
+// atLineEnd skips spaces, and returns true if they are followed by the end of the line, which is also skipped
+func (p *mdInlineParser) atLineEnd() bool {
+	i := p.pos
+	for i < len(p.subject) && (p.subject[i] == ' ' || p.subject[i] == '\t') {
+		i++
+	}
+	if i < len(p.subject) && p.subject[i] != '\n' {
+		return false
+	}
+	if i < len(p.subject) {
+		i++
+	}
+	p.pos = i
+	return true
+}
+
+// normalizeLabel returns the key of a link label in brackets, which matches labels case insensitively and with
+// whitespace collapsed
+func normalizeLabel(label string) string {
+	label = strings.TrimSpace(label[1 : len(label)-1])
+	return strings.ToUpper(strings.ToLower(reMDWhitespace.ReplaceAllString(label, " ")))
+}
+
+// unescapeMarkdown replaces the backslash escapes and entities in the text
+func unescapeMarkdown(text string) string {
+	return reMDEscapable.ReplaceAllStringFunc(text, func(m string) string {
+		if m[0] == '\\' {
+			return m[1:]
+		}
+		return html.UnescapeString(m)
+	})
+}
+
+// renderInlines writes the inlines as HTML
+func renderInlines(buf *bytes.Buffer, n *mdInline) {
+	for c := n.first; c != nil; c = c.next {
+		switch c.typ {
+		case mdText:
+			buf.WriteString(escapeHTML(c.literal))
+		case mdSoftBreak:
+			buf.WriteString("\n")
+		case mdHardBreak:
+			buf.WriteString("<br />\n")
+		case mdCode:
+			buf.WriteString("<code>" + escapeHTML(c.literal) + "</code>")
+		case mdRawHTML:
+			buf.WriteString(c.literal)
+		case mdEmph:
+			buf.WriteString("<em>")
+			renderInlines(buf, c)
+			buf.WriteString("</em>")
+		case mdStrong:
+			buf.WriteString("<strong>")
+			renderInlines(buf, c)
+			buf.WriteString("</strong>")
+		case mdStrike:
+			buf.WriteString("<del>")
+			renderInlines(buf, c)
+			buf.WriteString("</del>")
+		case mdLink:
+			buf.WriteString(`<a href="` + escapeHTML(encodeURL(c.dest)) + `"`)
+			if c.title != "" {
+				buf.WriteString(` title="` + escapeHTML(c.title) + `"`)
+			}
+			buf.WriteString(">")
+			renderInlines(buf, c)
+			buf.WriteString("</a>")
+		case mdImage:
+			buf.WriteString(`<img src="` + escapeHTML(encodeURL(c.dest)) + `" alt="` + escapeHTML(inlineText(c)) + `"`)
+			if c.title != "" {
+				buf.WriteString(` title="` + escapeHTML(c.title) + `"`)
+			}
+			buf.WriteString(" />")
+		}
+	}
+}
+
+// inlineText returns the plain text of the inlines, used for the alt text of images
+func inlineText(n *mdInline) string {
+	buf := &bytes.Buffer{}
+	for c := n.first; c != nil; c = c.next {
+		switch c.typ {
+		case mdText, mdCode:
+			buf.WriteString(c.literal)
+		case mdSoftBreak, mdHardBreak:
+			buf.WriteString("\n")
+		case mdRawHTML:
+		default:
+			buf.WriteString(inlineText(c))
+		}
+	}
+	return buf.String()
+}
+
+// encodeURL percent encodes the characters in a URL that aren't allowed, leaving existing percent encoding alone
+func encodeURL(url string) string {
+	const hex = "0123456789ABCDEF"
+	buf := &bytes.Buffer{}
+	for i := 0; i < len(url); i++ {
+		c := url[i]
+		switch {
+		case c == '%' && i+2 < len(url) && isHex(url[i+1]) && isHex(url[i+2]):
+			buf.WriteByte(c)
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+			strings.IndexByte(";/?:@&=+$,-_.!~*'()#", c) != -1:
+			buf.WriteByte(c)
+		default:
+			buf.WriteByte('%')
+			buf.WriteByte(hex[c>>4])
+			buf.WriteByte(hex[c&0xf])
+		}
+	}
+	return buf.String()
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app_test
+
+import (
+	"testing"
+
+	"github.com/lexLibrary/lexLibrary/app"
+)
+
+func TestMarkdown(t *testing.T) {
+	resetDocuments(t)
+
+	tenant, err := app.TenantNew(installAdmin(t), "Markdown Tenant", "", "")
+	if err != nil {
+		t.Fatalf("Error creating tenant: %s", err)
+	}
+	author := testUser(t, tenant, "author")
+
+	tests := []struct {
+		name     string
+		markdown string
+		html     string
+	}{
+		{"ATX Heading", "# Hello *world* #\n", "<h1>Hello <em>world</em></h1>\n"},
+		{"Setext Heading", "Hello\n=====\n\nSub\n---\n", "<h1>Hello</h1>\n<h2>Sub</h2>\n"},
+		{"Line Breaks", "a\nb  \nc\\\nd\n", "<p>a\nb<br />\nc<br />\nd</p>\n"},
+		{"Tight List", "- a\n  - b\n    - c\n",
+			"<ul>\n<li>a\n<ul>\n<li>b\n<ul>\n<li>c</li>\n</ul>\n</li>\n</ul>\n</li>\n</ul>\n"},
+		{"Loose List", "- a\n- b\n\n  c\n- d\n",
+			"<ul>\n<li>\n<p>a</p>\n</li>\n<li>\n<p>b</p>\n<p>c</p>\n</li>\n<li>\n<p>d</p>\n</li>\n</ul>\n"},
+		{"Ordered List", "1. one\n2. two\n\n3) x\n",
+			"<ol>\n<li>one</li>\n<li>two</li>\n</ol>\n<ol start=\"3\">\n<li>x</li>\n</ol>\n"},
+		{"Block Quote", "> quote\nlazy\n> > nested\n",
+			"<blockquote>\n<p>quote\nlazy</p>\n<blockquote>\n<p>nested</p>\n</blockquote>\n</blockquote>\n"},
+		{"Fenced Code", "```go\nfunc main() {\n  <x>\n}\n```\n",
+			"<pre><code class=\"language-go\">func main() {\n  &lt;x&gt;\n}\n</code></pre>\n"},
+		{"Indented Code", "    code\n      more\n\npara\n", "<pre><code>code\n  more\n</code></pre>\n<p>para</p>\n"},
+		{"Thematic Breaks", "***\n---\n___\n", "<hr />\n<hr />\n<hr />\n"},
+		{"Links", "[link](http://example.com \"title\") <http://x.com> <a@b.com>\n",
+			"<p><a href=\"http://example.com\" title=\"title\">link</a> <a href=\"http://x.com\">http://x.com</a> " +
+				"<a href=\"mailto:a@b.com\">a@b.com</a></p>\n"},
+		{"Reference Links", "[foo][bar] [Bar] [baz][]\n\n[bar]: http://a.com \"t\"\n[baz]: <http://b.com/a b>\n",
+			"<p><a href=\"http://a.com\" title=\"t\">foo</a> <a href=\"http://a.com\" title=\"t\">Bar</a> " +
+				"<a href=\"http://b.com/a%20b\">baz</a></p>\n"},
+		{"Emphasis", "*a **b** c* __d__ _e_ ***f*** ~~g~~ `h*i` snake_case_word\n",
+			"<p><em>a <strong>b</strong> c</em> <strong>d</strong> <em>e</em> <em><strong>f</strong></em> " +
+				"<del>g</del> <code>h*i</code> snake_case_word</p>\n"},
+		{"Nested Emphasis", "*foo**bar**baz* *(*foo*)*\n",
+			"<p><em>foo<strong>bar</strong>baz</em> <em>(<em>foo</em>)</em></p>\n"},
+		{"Table", "| a | b |\n|:--|--:|\n| 1 | 2 \\| 3 |\n| 4 |\n",
+			"<table>\n<thead>\n<tr>\n<th align=\"left\">a</th>\n<th align=\"right\">b</th>\n</tr>\n</thead>\n" +
+				"<tbody>\n<tr>\n<td align=\"left\">1</td>\n<td align=\"right\">2 | 3</td>\n</tr>\n" +
+				"<tr>\n<td align=\"left\">4</td>\n<td align=\"right\"></td>\n</tr>\n</tbody>\n</table>\n"},
+		{"Task List", "- [ ] todo\n- [x] done\n",
+			"<ul>\n<li><input type=\"checkbox\" disabled=\"\" /> todo</li>\n" +
+				"<li><input type=\"checkbox\" checked=\"\" disabled=\"\" /> done</li>\n</ul>\n"},
+		{"HTML Block", "<div>\n*raw*\n</div>\n\n*md*\n", "<div>\n*raw*\n</div>\n<p><em>md</em></p>\n"},
+		{"Entities and Escapes", "&amp; &copy; &bogus; \\*x\\*\n", "<p>&amp; © &amp;bogus; *x*</p>\n"},
+		{"No Links in Links", "[a [b](http://c)](http://d)\n", "<p>[a <a href=\"http://c\">b</a>](http://d)</p>\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := app.ImportMarkdown(author, nil, app.ImportFiles{
+				"test.md": []byte(test.markdown),
+			}, "test.md")
+			if err != nil {
+				t.Fatalf("Error importing markdown: %s", err)
+			}
+			rev, err := result.Document.Latest()
+			if err != nil {
+				t.Fatalf("Error getting revision: %s", err)
+			}
+			if rev.Body != test.html {
+				t.Fatalf("Invalid HTML.\nWanted: %q\nGot:    %q", test.html, rev.Body)
+			}
+		})
+	}
+}
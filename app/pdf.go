@@ -0,0 +1,1062 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+)
+
+/*
+	PDF files are read with a small parser for the parts of the format that importing needs: the cross reference
+	tables and streams that locate each object, indirect objects and object streams, and the stream filters in
+	common use.  Files with a broken cross reference table, which are common, are read by scanning the whole file
+	for its objects instead.
+
+	Text extraction from the content streams is in pdfText.go, and the importer itself is in importPDF.go.
+*/
+
+// pdfName is a PDF name object, like /Type
+type pdfName string
+
+// pdfKeyword is a bare keyword, like an operator in a content stream, or the end of an array or dictionary
+type pdfKeyword string
+
+// pdfDict is a PDF dictionary
+type pdfDict map[pdfName]interface{}
+
+// pdfArray is a PDF array
+type pdfArray []interface{}
+
+// pdfRef is a reference to an indirect object
+type pdfRef struct {
+	num int
+	gen int
+}
+
+// pdfStream is a stream object, with its data still encoded
+type pdfStream struct {
+	dict pdfDict
+	data []byte
+}
+
+var (
+	errPDFSyntax            = errors.New("invalid PDF syntax")
+	errPDFUnsupportedFilter = errors.New("unsupported PDF stream filter")
+)
+
+// maxPDFDepth limits how deeply nested objects, page trees and forms are followed, so a malformed file can't
+// recurse forever
+const maxPDFDepth = 32
+
+var rePDFObject = regexp.MustCompile(`(\d+)\s+(\d+)\s+obj\b`)
+
+// pdfLexer reads objects from PDF data: the file itself, a content stream, or a CMap
+type pdfLexer struct {
+	data  []byte
+	pos   int
+	depth int
+}
+
+func isPDFSpace(c byte) bool {
+	switch c {
+	case 0, '\t', '\n', '\f', '\r', ' ':
+		return true
+	}
+	return false
+}
+
+func isPDFDelimiter(c byte) bool {
+	switch c {
+	case '(', ')', '<', '>', '[', ']', '{', '}', '/', '%':
+		return true
+	}
+	return false
+}
+
+func (l *pdfLexer) peek(offset int) byte {
+	if l.pos+offset >= len(l.data) {
+		return 0
+	}
+	return l.data[l.pos+offset]
+}
+
+func (l *pdfLexer) skipSpace() {
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		if c == '%' {
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' && l.data[l.pos] != '\r' {
+				l.pos++
+			}
+			continue
+		}
+		if !isPDFSpace(c) {
+			return
+		}
+		l.pos++
+	}
+}
+
+// object reads the next object.  Strings are returned as Go strings of their bytes, numbers as int or float64,
+// and the null object as nil
+func (l *pdfLexer) object() (interface{}, error) {
+	l.skipSpace()
+	if l.pos >= len(l.data) {
+		return nil, io.EOF
+	}
+	c := l.data[l.pos]
+	switch {
+	case c == '/':
+		return l.name(), nil
+	case c == '(':
+		return l.literalString(), nil
+	case c == '<' && l.peek(1) == '<':
+		l.pos += 2
+		return l.dict()
+	case c == '<':
+		return l.hexString(), nil
+	case c == '>' && l.peek(1) == '>':
+		l.pos += 2
+		return pdfKeyword(">>"), nil
+	case c == '[':
+		l.pos++
+		return l.array()
+	case c == ']' || c == '{' || c == '}' || c == ')' || c == '>':
+		l.pos++
+		return pdfKeyword(string(c)), nil
+	case c == '+' || c == '-' || c == '.' || (c >= '0' && c <= '9'):
+		return l.number(), nil
+	}
+
+	keyword := l.keyword()
+	switch keyword {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	return keyword, nil
+}
+
+func (l *pdfLexer) keyword() pdfKeyword {
+	start := l.pos
+	for l.pos < len(l.data) && !isPDFSpace(l.data[l.pos]) && !isPDFDelimiter(l.data[l.pos]) {
+		l.pos++
+	}
+	if l.pos == start {
+		// a stray delimiter
+		l.pos++
+	}
+	return pdfKeyword(l.data[start:l.pos])
+}
+
+func (l *pdfLexer) name() pdfName {
+	l.pos++
+	buf := &bytes.Buffer{}
+	for l.pos < len(l.data) && !isPDFSpace(l.data[l.pos]) && !isPDFDelimiter(l.data[l.pos]) {
+		c := l.data[l.pos]
+		if c == '#' && l.pos+2 < len(l.data) {
+			if b, err := strconv.ParseUint(string(l.data[l.pos+1:l.pos+3]), 16, 8); err == nil {
+				buf.WriteByte(byte(b))
+				l.pos += 3
+				continue
+			}
+		}
+		buf.WriteByte(c)
+		l.pos++
+	}
+	return pdfName(buf.String())
+}
+
+// number reads an integer or real number, or an indirect reference like 12 0 R
+func (l *pdfLexer) number() interface{} {
+	start := l.pos
+	l.pos++
+	for l.pos < len(l.data) && (l.data[l.pos] == '.' || (l.data[l.pos] >= '0' && l.data[l.pos] <= '9')) {
+		l.pos++
+	}
+	text := string(l.data[start:l.pos])
+	n, err := strconv.Atoi(text)
+	if err != nil {
+		f, _ := strconv.ParseFloat(text, 64)
+		return f
+	}
+	if n < 0 || text[0] == '+' {
+		return n
+	}
+
+	// look ahead for a generation number and R
+	end := l.pos
+	l.skipSpace()
+	genStart := l.pos
+	for l.pos < len(l.data) && l.data[l.pos] >= '0' && l.data[l.pos] <= '9' {
+		l.pos++
+	}
+	if l.pos > genStart && l.pos < len(l.data) && isPDFSpace(l.data[l.pos]) {
+		gen, _ := strconv.Atoi(string(l.data[genStart:l.pos]))
+		l.skipSpace()
+		if l.peek(0) == 'R' && (l.pos+1 == len(l.data) || isPDFSpace(l.peek(1)) || isPDFDelimiter(l.peek(1))) {
+			l.pos++
+			return pdfRef{num: n, gen: gen}
+		}
+	}
+	l.pos = end
+	return n
+}
+
+func (l *pdfLexer) literalString() string {
+	l.pos++
+	buf := &bytes.Buffer{}
+	depth := 1
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		l.pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return buf.String()
+			}
+		case '\r':
+			// end of lines in strings are always a line feed
+			if l.peek(0) == '\n' {
+				l.pos++
+			}
+			c = '\n'
+		case '\\':
+			if l.pos >= len(l.data) {
+				return buf.String()
+			}
+			c = l.data[l.pos]
+			l.pos++
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				if l.peek(0) == '\n' {
+					l.pos++
+				}
+				continue
+			case '\n':
+				continue
+			case '0', '1', '2', '3', '4', '5', '6', '7':
+				n := int(c - '0')
+				for i := 0; i < 2 && l.peek(0) >= '0' && l.peek(0) <= '7'; i++ {
+					n = n*8 + int(l.data[l.pos]-'0')
+					l.pos++
+				}
+				c = byte(n)
+			}
+		}
+		buf.WriteByte(c)
+	}
+	return buf.String()
+}
+
+func (l *pdfLexer) hexString() string {
+	l.pos++
+	buf := &bytes.Buffer{}
+	var digits []byte
+	for l.pos < len(l.data) && l.data[l.pos] != '>' {
+		c := l.data[l.pos]
+		l.pos++
+		if isHexDigit(c) {
+			digits = append(digits, c)
+		}
+		if len(digits) == 2 {
+			b, _ := strconv.ParseUint(string(digits), 16, 8)
+			buf.WriteByte(byte(b))
+			digits = digits[:0]
+		}
+	}
+	l.pos++
+	if len(digits) == 1 {
+		b, _ := strconv.ParseUint(string(digits)+"0", 16, 8)
+		buf.WriteByte(byte(b))
+	}
+	return buf.String()
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func (l *pdfLexer) array() (pdfArray, error) {
+	l.depth++
+	defer func() { l.depth-- }()
+	if l.depth > maxPDFDepth {
+		return nil, errPDFSyntax
+	}
+
+	var a pdfArray
+	for {
+		obj, err := l.object()
+		if err != nil {
+			return a, err
+		}
+		if obj == pdfKeyword("]") {
+			return a, nil
+		}
+		a = append(a, obj)
+	}
+}
+
+func (l *pdfLexer) dict() (pdfDict, error) {
+	l.depth++
+	defer func() { l.depth-- }()
+	if l.depth > maxPDFDepth {
+		return nil, errPDFSyntax
+	}
+
+	d := make(pdfDict)
+	for {
+		key, err := l.object()
+		if err != nil {
+			return d, err
+		}
+		if key == pdfKeyword(">>") {
+			return d, nil
+		}
+		name, ok := key.(pdfName)
+		if !ok {
+			continue
+		}
+		value, err := l.object()
+		if err != nil {
+			return d, err
+		}
+		if value == pdfKeyword(">>") {
+			return d, nil
+		}
+		d[name] = value
+	}
+}
+
+// pdfFile is a parsed PDF file, whose objects are loaded as they're needed
+type pdfFile struct {
+	data    []byte
+	xref    map[int]pdfXref
+	trailer pdfDict
+	objects map[int]interface{}
+	loading map[int]bool
+	streams map[int]*pdfObjectStream
+	fonts   map[int]*pdfFont
+}
+
+// pdfObjectStream is a decoded stream of objects
+type pdfObjectStream struct {
+	data  []byte
+	first int // the offset of the first object
+}
+
+// pdfXref is the location of an object
+type pdfXref struct {
+	offset int // the offset of the object in the file, or its index in its object stream
+	stream int // the object stream the object is in, or 0 if it isn't in one
+}
+
+func openPDF(data []byte) (*pdfFile, error) {
+	header := data
+	if len(header) > 1024 {
+		header = header[:1024]
+	}
+	if !bytes.Contains(header, []byte("%PDF-")) {
+		return nil, errPDFSyntax
+	}
+
+	f := &pdfFile{
+		data:    data,
+		xref:    make(map[int]pdfXref),
+		trailer: make(pdfDict),
+		objects: make(map[int]interface{}),
+		loading: make(map[int]bool),
+		streams: make(map[int]*pdfObjectStream),
+		fonts:   make(map[int]*pdfFont),
+	}
+	err := f.readXref()
+	if _, ok := f.dict(f.trailer["Root"]); err != nil || !ok {
+		f.rebuildXref()
+	}
+	if _, ok := f.dict(f.trailer["Root"]); !ok {
+		return nil, errPDFSyntax
+	}
+	return f, nil
+}
+
+// readXref reads the cross reference sections of the file, starting with the last one
+func (f *pdfFile) readXref() error {
+	start := bytes.LastIndex(f.data, []byte("startxref"))
+	if start == -1 {
+		return errPDFSyntax
+	}
+	l := &pdfLexer{data: f.data, pos: start + len("startxref")}
+	offset, ok := mustObject(l).(int)
+	if !ok {
+		return errPDFSyntax
+	}
+
+	seen := make(map[int]bool)
+	offsets := []int{offset}
+	for len(offsets) > 0 {
+		offset, offsets = offsets[0], offsets[1:]
+		if seen[offset] || offset < 0 || offset >= len(f.data) {
+			continue
+		}
+		seen[offset] = true
+
+		trailer, err := f.readXrefSection(offset)
+		if err != nil {
+			return err
+		}
+		for key, value := range trailer {
+			if _, ok := f.trailer[key]; !ok {
+				f.trailer[key] = value
+			}
+		}
+		// hybrid files have an xref stream as well as a table, which takes priority over older sections
+		if stm, ok := trailer["XRefStm"].(int); ok {
+			offsets = append(offsets, stm)
+		}
+		if prev, ok := trailer["Prev"].(int); ok {
+			offsets = append(offsets, prev)
+		}
+	}
+	return nil
+}
+
+// readXrefSection reads a cross reference table or stream, adding the objects that aren't already known from a
+// newer section, and returns its trailer
+func (f *pdfFile) readXrefSection(offset int) (pdfDict, error) {
+	l := &pdfLexer{data: f.data, pos: offset}
+	first, err := l.object()
+	if err != nil {
+		return nil, err
+	}
+	if first == pdfKeyword("xref") {
+		return f.readXrefTable(l)
+	}
+
+	l.pos = offset
+	obj, err := f.readObject(l)
+	if err != nil {
+		return nil, err
+	}
+	s, ok := obj.(*pdfStream)
+	if !ok || s.dict["Type"] != pdfName("XRef") {
+		return nil, errPDFSyntax
+	}
+	return s.dict, f.readXrefStream(s)
+}
+
+func (f *pdfFile) readXrefTable(l *pdfLexer) (pdfDict, error) {
+	for {
+		obj, err := l.object()
+		if err != nil {
+			return nil, err
+		}
+		if obj == pdfKeyword("trailer") {
+			break
+		}
+		start, ok := obj.(int)
+		count, ok2 := mustObject(l).(int)
+		if !ok || !ok2 {
+			return nil, errPDFSyntax
+		}
+		for i := 0; i < count; i++ {
+			offset, ok := mustObject(l).(int)
+			mustObject(l)
+			kind := mustObject(l)
+			if !ok {
+				return nil, errPDFSyntax
+			}
+			if _, exists := f.xref[start+i]; !exists && kind == pdfKeyword("n") && start+i > 0 {
+				f.xref[start+i] = pdfXref{offset: offset}
+			}
+		}
+	}
+	trailer, ok := mustObject(l).(pdfDict)
+	if !ok {
+		return nil, errPDFSyntax
+	}
+	return trailer, nil
+}
+
+func (f *pdfFile) readXrefStream(s *pdfStream) error {
+	data, err := f.decode(s)
+	if err != nil {
+		return err
+	}
+	widths, _ := s.dict["W"].(pdfArray)
+	if len(widths) != 3 {
+		return errPDFSyntax
+	}
+	var w [3]int
+	for i := range w {
+		w[i], _ = widths[i].(int)
+		if w[i] < 0 || w[i] > 8 {
+			return errPDFSyntax
+		}
+	}
+	index, _ := s.dict["Index"].(pdfArray)
+	if len(index) == 0 {
+		size, _ := s.dict["Size"].(int)
+		index = pdfArray{0, size}
+	}
+
+	entry := w[0] + w[1] + w[2]
+	if entry == 0 {
+		return errPDFSyntax
+	}
+	pos := 0
+	for i := 0; i+1 < len(index); i += 2 {
+		start, _ := index[i].(int)
+		count, _ := index[i+1].(int)
+		for n := start; n < start+count && pos+entry <= len(data); n++ {
+			fields := [3]int{1, 0, 0}
+			for field := range fields {
+				if w[field] == 0 {
+					continue
+				}
+				value := 0
+				for _, b := range data[pos : pos+w[field]] {
+					value = value<<8 | int(b)
+				}
+				fields[field] = value
+				pos += w[field]
+			}
+			if _, exists := f.xref[n]; exists || n == 0 {
+				continue
+			}
+			switch fields[0] {
+			case 1:
+				f.xref[n] = pdfXref{offset: fields[1]}
+			case 2:
+				f.xref[n] = pdfXref{stream: fields[1], offset: fields[2]}
+			}
+		}
+	}
+	return nil
+}
+
+// rebuildXref finds the objects by scanning the whole file, for files whose cross reference table is missing or
+// broken
+func (f *pdfFile) rebuildXref() {
+	f.xref = make(map[int]pdfXref)
+	f.objects = make(map[int]interface{})
+	for _, match := range rePDFObject.FindAllSubmatchIndex(f.data, -1) {
+		num, err := strconv.Atoi(string(f.data[match[2]:match[3]]))
+		if err != nil || num == 0 {
+			continue
+		}
+		f.xref[num] = pdfXref{offset: match[0]}
+	}
+
+	trailer := make(pdfDict)
+	for _, t := range bytesIndexAll(f.data, []byte("trailer")) {
+		l := &pdfLexer{data: f.data, pos: t + len("trailer")}
+		if d, ok := mustObject(l).(pdfDict); ok {
+			for key, value := range d {
+				trailer[key] = value
+			}
+		}
+	}
+
+	var nums []int
+	for num := range f.xref {
+		nums = append(nums, num)
+	}
+	for _, num := range nums {
+		obj := f.object(num)
+		s, ok := obj.(*pdfStream)
+		if !ok {
+			if d, ok := obj.(pdfDict); ok && d["Type"] == pdfName("Catalog") && trailer["Root"] == nil {
+				trailer["Root"] = pdfRef{num: num}
+			}
+			continue
+		}
+		switch s.dict["Type"] {
+		case pdfName("ObjStm"):
+			count, _ := s.dict["N"].(int)
+			for i := 0; i < count; i++ {
+				f.objectStreamEntry(num, i, func(n int) {
+					if _, exists := f.xref[n]; !exists {
+						f.xref[n] = pdfXref{stream: num, offset: i}
+					}
+				})
+			}
+		case pdfName("XRef"):
+			for key, value := range s.dict {
+				if _, ok := trailer[key]; !ok {
+					trailer[key] = value
+				}
+			}
+		}
+	}
+	// catalogs inside object streams
+	if trailer["Root"] == nil {
+		for num := range f.xref {
+			if d, ok := f.object(num).(pdfDict); ok && d["Type"] == pdfName("Catalog") {
+				trailer["Root"] = pdfRef{num: num}
+				break
+			}
+		}
+	}
+	f.trailer = trailer
+}
+
+func bytesIndexAll(data, sep []byte) []int {
+	var all []int
+	for start := 0; ; {
+		i := bytes.Index(data[start:], sep)
+		if i == -1 {
+			return all
+		}
+		all = append(all, start+i)
+		start += i + len(sep)
+	}
+}
+
+// mustObject reads the next object, returning nil if there isn't one
+func mustObject(l *pdfLexer) interface{} {
+	obj, err := l.object()
+	if err != nil {
+		return nil
+	}
+	return obj
+}
+
+// readObject reads an indirect object, like 12 0 obj ... endobj, at the lexer's position
+func (f *pdfFile) readObject(l *pdfLexer) (interface{}, error) {
+	if _, ok := mustObject(l).(int); !ok {
+		return nil, errPDFSyntax
+	}
+	mustObject(l)
+	if mustObject(l) != pdfKeyword("obj") {
+		return nil, errPDFSyntax
+	}
+	obj, err := l.object()
+	if err != nil {
+		return nil, err
+	}
+
+	d, ok := obj.(pdfDict)
+	if !ok {
+		return obj, nil
+	}
+	l.skipSpace()
+	if !bytes.HasPrefix(l.data[l.pos:], []byte("stream")) {
+		return d, nil
+	}
+	l.pos += len("stream")
+	if l.peek(0) == '\r' {
+		l.pos++
+	}
+	if l.peek(0) == '\n' {
+		l.pos++
+	}
+
+	start := l.pos
+	length, ok := f.resolve(d["Length"]).(int)
+	if ok && length >= 0 && start+length <= len(l.data) {
+		rest := bytes.TrimLeft(l.data[start+length:], "\r\n \t")
+		if bytes.HasPrefix(rest, []byte("endstream")) {
+			return &pdfStream{dict: d, data: l.data[start : start+length]}, nil
+		}
+	}
+	// the length is missing or wrong, so the stream ends at endstream
+	end := bytes.Index(l.data[start:], []byte("endstream"))
+	if end == -1 {
+		return nil, errPDFSyntax
+	}
+	data := l.data[start : start+end]
+	data = bytes.TrimSuffix(data, []byte("\n"))
+	data = bytes.TrimSuffix(data, []byte("\r"))
+	return &pdfStream{dict: d, data: data}, nil
+}
+
+// object returns the indirect object, or nil if it doesn't exist or can't be read
+func (f *pdfFile) object(num int) interface{} {
+	if obj, ok := f.objects[num]; ok {
+		return obj
+	}
+	entry, ok := f.xref[num]
+	if !ok || f.loading[num] {
+		return nil
+	}
+	f.loading[num] = true
+	defer delete(f.loading, num)
+
+	var obj interface{}
+	if entry.stream != 0 {
+		f.objectStreamEntry(entry.stream, entry.offset, func(n int) {})
+		obj = f.objects[num]
+	} else if entry.offset >= 0 && entry.offset < len(f.data) {
+		obj, _ = f.readObject(&pdfLexer{data: f.data, pos: entry.offset})
+	}
+	f.objects[num] = obj
+	return obj
+}
+
+// objectStreamEntry reads the object at the index in an object stream, calling found with its object number
+func (f *pdfFile) objectStreamEntry(stream, index int, found func(num int)) {
+	objects, ok := f.streams[stream]
+	if !ok {
+		objects = &pdfObjectStream{}
+		if s, isStream := f.object(stream).(*pdfStream); isStream {
+			objects.data, _ = f.decode(s)
+			objects.first, _ = s.dict["First"].(int)
+		}
+		f.streams[stream] = objects
+	}
+	data, first := objects.data, objects.first
+	if data == nil {
+		return
+	}
+
+	l := &pdfLexer{data: data}
+	num, offset := 0, 0
+	for i := 0; i <= index; i++ {
+		n, ok := mustObject(l).(int)
+		o, ok2 := mustObject(l).(int)
+		if !ok || !ok2 {
+			return
+		}
+		num, offset = n, o
+	}
+	found(num)
+	if _, loaded := f.objects[num]; loaded || first+offset >= len(data) {
+		return
+	}
+	obj, err := (&pdfLexer{data: data, pos: first + offset}).object()
+	if err == nil {
+		f.objects[num] = obj
+	}
+}
+
+// resolve returns the object a reference points to, or the object itself if it isn't a reference
+func (f *pdfFile) resolve(obj interface{}) interface{} {
+	for depth := 0; depth < maxPDFDepth; depth++ {
+		ref, ok := obj.(pdfRef)
+		if !ok {
+			return obj
+		}
+		obj = f.object(ref.num)
+	}
+	return nil
+}
+
+// dict resolves the object as a dictionary, including a stream's dictionary
+func (f *pdfFile) dict(obj interface{}) (pdfDict, bool) {
+	switch obj := f.resolve(obj).(type) {
+	case pdfDict:
+		return obj, true
+	case *pdfStream:
+		return obj.dict, true
+	}
+	return nil, false
+}
+
+// array resolves the object as an array.  A single object is returned as an array of one
+func (f *pdfFile) array(obj interface{}) pdfArray {
+	switch obj := f.resolve(obj).(type) {
+	case pdfArray:
+		return obj
+	case nil:
+		return nil
+	default:
+		return pdfArray{obj}
+	}
+}
+
+// number resolves the object as a number
+func (f *pdfFile) number(obj interface{}) (float64, bool) {
+	switch obj := f.resolve(obj).(type) {
+	case int:
+		return float64(obj), true
+	case float64:
+		return obj, true
+	}
+	return 0, false
+}
+
+// text resolves the object as a text string, which is either UTF-16 with a byte order mark, or PDFDocEncoding
+func (f *pdfFile) text(obj interface{}) string {
+	s, _ := f.resolve(obj).(string)
+	return pdfTextString(s)
+}
+
+// decode returns the decoded data of the stream.  Image filters like DCTDecode return errPDFUnsupportedFilter
+func (f *pdfFile) decode(s *pdfStream) ([]byte, error) {
+	filters := f.array(s.dict["Filter"])
+	params := f.array(s.dict["DecodeParms"])
+	data := s.data
+	for i, filter := range filters {
+		param, _ := f.dict(nil)
+		if i < len(params) {
+			param, _ = f.dict(params[i])
+		}
+
+		var err error
+		switch f.resolve(filter) {
+		case pdfName("FlateDecode"), pdfName("Fl"):
+			data, err = flateDecode(data)
+			if err == nil {
+				data, err = f.predict(data, param)
+			}
+		case pdfName("LZWDecode"), pdfName("LZW"):
+			early := 1
+			if e, ok := param["EarlyChange"].(int); ok {
+				early = e
+			}
+			data, err = lzwDecode(data, early)
+			if err == nil {
+				data, err = f.predict(data, param)
+			}
+		case pdfName("ASCIIHexDecode"), pdfName("AHx"):
+			data = []byte((&pdfLexer{data: append(append([]byte("<"), data...), '>')}).hexString())
+		case pdfName("ASCII85Decode"), pdfName("A85"):
+			data, err = ascii85Decode(data)
+		case pdfName("RunLengthDecode"), pdfName("RL"):
+			data = runLengthDecode(data)
+		default:
+			return nil, errPDFUnsupportedFilter
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// flateDecode inflates zlib data.  Truncated and corrupt streams are common, so whatever could be read is used
+func flateDecode(data []byte) ([]byte, error) {
+	var r io.ReadCloser
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		// some writers leave out the zlib header
+		r = flate.NewReader(bytes.NewReader(data))
+	}
+	defer r.Close()
+	out, err := ioutil.ReadAll(r)
+	if err != nil && len(out) == 0 {
+		return nil, err
+	}
+	return out, nil
+}
+
+// predict reverses the PNG or TIFF predictor applied to the data before it was compressed
+func (f *pdfFile) predict(data []byte, param pdfDict) ([]byte, error) {
+	predictor, _ := param["Predictor"].(int)
+	if predictor <= 1 {
+		return data, nil
+	}
+	colors, columns, bpc := 1, 1, 8
+	if c, ok := param["Colors"].(int); ok && c > 0 {
+		colors = c
+	}
+	if c, ok := param["Columns"].(int); ok && c > 0 {
+		columns = c
+	}
+	if b, ok := param["BitsPerComponent"].(int); ok && b > 0 {
+		bpc = b
+	}
+	bpp := (colors*bpc + 7) / 8
+	rowSize := (colors*bpc*columns + 7) / 8
+
+	if predictor == 2 {
+		if bpc != 8 {
+			return nil, errPDFUnsupportedFilter
+		}
+		for row := 0; row+rowSize <= len(data); row += rowSize {
+			for i := bpp; i < rowSize; i++ {
+				data[row+i] += data[row+i-bpp]
+			}
+		}
+		return data, nil
+	}
+
+	out := make([]byte, 0, len(data))
+	prev := make([]byte, rowSize)
+	for pos := 0; pos+1+rowSize <= len(data); pos += 1 + rowSize {
+		kind := data[pos]
+		row := append([]byte{}, data[pos+1:pos+1+rowSize]...)
+		for i := range row {
+			var left, upLeft byte
+			if i >= bpp {
+				left, upLeft = row[i-bpp], prev[i-bpp]
+			}
+			up := prev[i]
+			switch kind {
+			case 1:
+				row[i] += left
+			case 2:
+				row[i] += up
+			case 3:
+				row[i] += byte((int(left) + int(up)) / 2)
+			case 4:
+				row[i] += paeth(left, up, upLeft)
+			}
+		}
+		out = append(out, row...)
+		prev = row
+	}
+	return out, nil
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := absInt(p-int(a)), absInt(p-int(b)), absInt(p-int(c))
+	switch {
+	case pa <= pb && pa <= pc:
+		return a
+	case pb <= pc:
+		return b
+	}
+	return c
+}
+
+func absInt(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// lzwDecode decodes LZW data the way PDF encodes it, which differs from compress/lzw in when the code width
+// changes
+func lzwDecode(data []byte, early int) ([]byte, error) {
+	out := &bytes.Buffer{}
+	table := make([][]byte, 258, 4096)
+	for i := 0; i < 256; i++ {
+		table[i] = []byte{byte(i)}
+	}
+	width := 9
+	var prev []byte
+	var bits uint32
+	var count uint
+	for pos := 0; ; {
+		for count < uint(width) {
+			if pos >= len(data) {
+				return out.Bytes(), nil
+			}
+			bits = bits<<8 | uint32(data[pos])
+			pos++
+			count += 8
+		}
+		code := int(bits>>(count-uint(width))) & (1<<uint(width) - 1)
+		count -= uint(width)
+		bits &= 1<<count - 1
+
+		switch code {
+		case 256:
+			table = table[:258]
+			width = 9
+			prev = nil
+			continue
+		case 257:
+			return out.Bytes(), nil
+		}
+
+		var entry []byte
+		switch {
+		case code < len(table):
+			entry = table[code]
+		case code == len(table) && prev != nil:
+			entry = append(append([]byte{}, prev...), prev[0])
+		default:
+			return out.Bytes(), errPDFSyntax
+		}
+		out.Write(entry)
+		if prev != nil && len(table) < 4096 {
+			table = append(table, append(append([]byte{}, prev...), entry[0]))
+		}
+		prev = entry
+		if len(table)+early >= 1<<uint(width) && width < 12 {
+			width++
+		}
+	}
+}
+
+func ascii85Decode(data []byte) ([]byte, error) {
+	out := &bytes.Buffer{}
+	var group [5]byte
+	n := 0
+	flush := func(count int) {
+		value := uint32(0)
+		for i := 0; i < 5; i++ {
+			value = value*85 + uint32(group[i]-'!')
+		}
+		word := []byte{byte(value >> 24), byte(value >> 16), byte(value >> 8), byte(value)}
+		out.Write(word[:count])
+	}
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == '~':
+			i = len(data)
+		case c == 'z' && n == 0:
+			out.Write([]byte{0, 0, 0, 0})
+		case c >= '!' && c <= 'u':
+			group[n] = c
+			n++
+			if n == 5 {
+				flush(4)
+				n = 0
+			}
+		case isPDFSpace(c):
+		default:
+			return nil, fmt.Errorf("invalid ASCII85 character %q", c)
+		}
+	}
+	if n > 1 {
+		for i := n; i < 5; i++ {
+			group[i] = 'u'
+		}
+		flush(n - 1)
+	}
+	return out.Bytes(), nil
+}
+
+func runLengthDecode(data []byte) []byte {
+	out := &bytes.Buffer{}
+	for i := 0; i < len(data); {
+		length := int(data[i])
+		i++
+		switch {
+		case length < 128:
+			end := i + length + 1
+			if end > len(data) {
+				end = len(data)
+			}
+			out.Write(data[i:end])
+			i = end
+		case length > 128:
+			if i < len(data) {
+				out.Write(bytes.Repeat(data[i:i+1], 257-length))
+			}
+			i++
+		default:
+			return out.Bytes()
+		}
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,728 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+/*
+	The text of a PDF page is drawn by the operators in its content stream, each piece at a position on the page and
+	in a font.  The content stream is run to find every piece of text and every image, along with where it's drawn
+	and how big its font is, and importPDF.go lays those out into lines and paragraphs.
+
+	The codes in a string are mapped to unicode with the font's ToUnicode CMap if it has one, and otherwise with
+	the font's encoding and glyph names.  Composite fonts without a ToUnicode CMap can't be read, and their text is
+	counted as unreadable.
+*/
+
+// pdfMatrix is a transformation matrix [a b c d e f]
+type pdfMatrix [6]float64
+
+var pdfIdentity = pdfMatrix{1, 0, 0, 1, 0, 0}
+
+// multiply returns m × n
+func (m pdfMatrix) multiply(n pdfMatrix) pdfMatrix {
+	return pdfMatrix{
+		m[0]*n[0] + m[1]*n[2],
+		m[0]*n[1] + m[1]*n[3],
+		m[2]*n[0] + m[3]*n[2],
+		m[2]*n[1] + m[3]*n[3],
+		m[4]*n[0] + m[5]*n[2] + n[4],
+		m[4]*n[1] + m[5]*n[3] + n[5],
+	}
+}
+
+func pdfTranslate(x, y float64) pdfMatrix {
+	return pdfMatrix{1, 0, 0, 1, x, y}
+}
+
+// pdfItem is a piece of text or an image drawn on a page
+type pdfItem struct {
+	x, y       float64 // the start of the text's baseline on the page
+	end        float64 // the end of the text's baseline
+	size       float64 // the font size on the page
+	text       string
+	unreadable int // characters that couldn't be mapped to unicode
+
+	image    *pdfStream
+	imageNum int // the object number of the image, if it's an indirect object
+}
+
+// pdfFont maps the codes shown in a font to unicode, and measures them
+type pdfFont struct {
+	toUnicode    map[int]string
+	encoding     *[256]rune // the encoding of simple fonts, nil for composite fonts
+	codeBytes    int
+	widths       map[int]float64 // in thousandths of a text space unit
+	defaultWidth float64
+}
+
+// pdfGlyph is a single character code shown in a font
+type pdfGlyph struct {
+	text  string
+	width float64
+	space bool // a single byte code 32, which word spacing applies to
+}
+
+// font loads the font from its dictionary
+func (f *pdfFile) font(obj interface{}) *pdfFont {
+	ref, isRef := obj.(pdfRef)
+	if isRef {
+		if font, ok := f.fonts[ref.num]; ok {
+			return font
+		}
+	}
+	d, ok := f.dict(obj)
+	if !ok {
+		return nil
+	}
+
+	font := &pdfFont{codeBytes: 1, widths: make(map[int]float64), defaultWidth: 1000}
+	if s, ok := f.resolve(d["ToUnicode"]).(*pdfStream); ok {
+		if data, err := f.decode(s); err == nil {
+			font.toUnicode = parseCMap(data)
+		}
+	}
+
+	switch f.resolve(d["Subtype"]) {
+	case pdfName("Type0"):
+		font.codeBytes = 2
+		descendants := f.array(d["DescendantFonts"])
+		if len(descendants) > 0 {
+			descendant, _ := f.dict(descendants[0])
+			if dw, ok := f.number(descendant["DW"]); ok {
+				font.defaultWidth = dw
+			}
+			f.compositeWidths(font, f.array(descendant["W"]))
+		}
+	default:
+		font.encoding = f.simpleEncoding(d)
+		first, _ := f.number(d["FirstChar"])
+		scale := 1.0
+		if matrix := f.array(d["FontMatrix"]); len(matrix) == 6 && f.resolve(d["Subtype"]) == pdfName("Type3") {
+			// type 3 glyphs are measured in their own glyph space
+			if a, ok := f.number(matrix[0]); ok {
+				scale = a * 1000
+			}
+		}
+		for i, w := range f.array(d["Widths"]) {
+			if width, ok := f.number(w); ok {
+				font.widths[int(first)+i] = width * scale
+			}
+		}
+		if descriptor, ok := f.dict(d["FontDescriptor"]); ok {
+			if missing, ok := f.number(descriptor["MissingWidth"]); ok && missing > 0 {
+				font.defaultWidth = missing
+			}
+		}
+	}
+
+	if isRef {
+		f.fonts[ref.num] = font
+	}
+	return font
+}
+
+// compositeWidths reads the widths of a composite font, which are either c [w1 w2 ...] or cFirst cLast w
+func (f *pdfFile) compositeWidths(font *pdfFont, w pdfArray) {
+	for i := 0; i < len(w); {
+		first, ok := f.number(w[i])
+		if !ok || i+1 >= len(w) {
+			return
+		}
+		if widths, ok := f.resolve(w[i+1]).(pdfArray); ok {
+			for c, width := range widths {
+				if n, ok := f.number(width); ok {
+					font.widths[int(first)+c] = n
+				}
+			}
+			i += 2
+			continue
+		}
+		if i+2 >= len(w) {
+			return
+		}
+		last, _ := f.number(w[i+1])
+		width, _ := f.number(w[i+2])
+		for c := int(first); c <= int(last) && c-int(first) < 65536; c++ {
+			font.widths[c] = width
+		}
+		i += 3
+	}
+}
+
+// simpleEncoding returns the encoding of a simple font, from its base encoding and differences
+func (f *pdfFile) simpleEncoding(d pdfDict) *[256]rune {
+	encoding := pdfStandardEncoding
+	var differences pdfArray
+
+	setBase := func(name interface{}) {
+		switch name {
+		case pdfName("WinAnsiEncoding"):
+			encoding = pdfWinAnsiEncoding
+		case pdfName("MacRomanEncoding"):
+			encoding = pdfMacRomanEncoding
+		case pdfName("StandardEncoding"):
+			encoding = pdfStandardEncoding
+		}
+	}
+	switch e := f.resolve(d["Encoding"]).(type) {
+	case pdfName:
+		setBase(e)
+	case pdfDict:
+		setBase(f.resolve(e["BaseEncoding"]))
+		differences = f.array(e["Differences"])
+	default:
+		if f.resolve(d["Subtype"]) == pdfName("TrueType") {
+			encoding = pdfWinAnsiEncoding
+		}
+	}
+
+	if len(differences) == 0 {
+		return &encoding
+	}
+	code := 0
+	for _, diff := range differences {
+		switch diff := f.resolve(diff).(type) {
+		case int:
+			code = diff
+		case pdfName:
+			if code >= 0 && code < 256 {
+				if text, ok := pdfGlyphText(string(diff)); ok {
+					runes := []rune(text)
+					if len(runes) == 1 {
+						encoding[code] = runes[0]
+					} else {
+						// ligatures are kept as private use characters, and expanded when decoded
+						encoding[code] = pdfLigatureRune(text)
+					}
+				} else {
+					encoding[code] = 0
+				}
+			}
+			code++
+		}
+	}
+	return &encoding
+}
+
+// decode splits a string shown in the font into its glyphs
+func (font *pdfFont) decode(s string) []pdfGlyph {
+	glyphs := make([]pdfGlyph, 0, len(s)/font.codeBytes)
+	for i := 0; i+font.codeBytes <= len(s); i += font.codeBytes {
+		code := int(s[i])
+		if font.codeBytes == 2 {
+			code = code<<8 | int(s[i+1])
+		}
+
+		text, ok := font.toUnicode[code]
+		if !ok {
+			text = "�"
+			if font.encoding != nil {
+				text = ""
+				if r := font.encoding[code]; r != 0 {
+					text = pdfExpandLigature(r)
+				} else if code > 32 {
+					text = "�"
+				}
+			}
+		}
+
+		width, ok := font.widths[code]
+		if !ok {
+			width = font.defaultWidth
+		}
+		glyphs = append(glyphs, pdfGlyph{text: text, width: width, space: font.codeBytes == 1 && code == 32})
+	}
+	return glyphs
+}
+
+// parseCMap reads the mappings from character codes to unicode in a ToUnicode CMap
+func parseCMap(data []byte) map[int]string {
+	cmap := make(map[int]string)
+	l := &pdfLexer{data: data}
+	var operands []interface{}
+	for {
+		obj, err := l.object()
+		if err != nil {
+			return cmap
+		}
+		keyword, ok := obj.(pdfKeyword)
+		if !ok {
+			operands = append(operands, obj)
+			continue
+		}
+
+		switch keyword {
+		case "endbfchar":
+			for i := 0; i+1 < len(operands); i += 2 {
+				src, ok := operands[i].(string)
+				dst, ok2 := operands[i+1].(string)
+				if ok && ok2 {
+					cmap[pdfCode(src)] = utf16BE(dst)
+				}
+			}
+		case "endbfrange":
+			for i := 0; i+2 < len(operands); i += 3 {
+				lo, ok := operands[i].(string)
+				hi, ok2 := operands[i+1].(string)
+				if !ok || !ok2 {
+					continue
+				}
+				first, last := pdfCode(lo), pdfCode(hi)
+				if last < first || last-first > 65535 {
+					continue
+				}
+				switch dst := operands[i+2].(type) {
+				case string:
+					units := utf16Units(dst)
+					if len(units) == 0 {
+						continue
+					}
+					for code := first; code <= last; code++ {
+						units[len(units)-1] = utf16Units(dst)[len(units)-1] + uint16(code-first)
+						cmap[code] = string(utf16.Decode(units))
+					}
+				case pdfArray:
+					for c, d := range dst {
+						if s, ok := d.(string); ok && first+c <= last {
+							cmap[first+c] = utf16BE(s)
+						}
+					}
+				}
+			}
+		}
+		operands = operands[:0]
+	}
+}
+
+// pdfCode returns the character code of the bytes of a string
+func pdfCode(s string) int {
+	code := 0
+	for i := 0; i < len(s); i++ {
+		code = code<<8 | int(s[i])
+	}
+	return code
+}
+
+func utf16Units(s string) []uint16 {
+	units := make([]uint16, len(s)/2)
+	for i := range units {
+		units[i] = uint16(s[2*i])<<8 | uint16(s[2*i+1])
+	}
+	return units
+}
+
+func utf16BE(s string) string {
+	return string(utf16.Decode(utf16Units(s)))
+}
+
+// pdfTextString decodes a text string from outside of a content stream, like the document's title
+func pdfTextString(s string) string {
+	if strings.HasPrefix(s, "\xfe\xff") {
+		return utf16BE(s[2:])
+	}
+	buf := &bytes.Buffer{}
+	for i := 0; i < len(s); i++ {
+		if r, ok := pdfDocEncoding[s[i]]; ok {
+			buf.WriteRune(r)
+		} else {
+			buf.WriteRune(rune(s[i]))
+		}
+	}
+	return buf.String()
+}
+
+// pdfState is the part of the graphics state that text extraction needs
+type pdfState struct {
+	ctm       pdfMatrix
+	font      *pdfFont
+	size      float64
+	charSpace float64
+	wordSpace float64
+	scale     float64
+	leading   float64
+	rise      float64
+}
+
+// pdfContent runs a page's content streams, collecting the text and images drawn
+type pdfContent struct {
+	f     *pdfFile
+	items []pdfItem
+}
+
+func (c *pdfContent) run(content []byte, resources pdfDict, ctm pdfMatrix, depth int) {
+	if depth > maxPDFDepth {
+		return
+	}
+	fonts, _ := c.f.dict(resources["Font"])
+	xobjects, _ := c.f.dict(resources["XObject"])
+
+	state := pdfState{ctm: ctm, scale: 1}
+	var stack []pdfState
+	tm, tlm := pdfIdentity, pdfIdentity
+
+	l := &pdfLexer{data: content}
+	var operands []interface{}
+	number := func(i int) float64 {
+		if i >= len(operands) {
+			return 0
+		}
+		n, _ := c.f.number(operands[i])
+		return n
+	}
+	nextLine := func(x, y float64) {
+		tlm = pdfTranslate(x, y).multiply(tlm)
+		tm = tlm
+	}
+	show := func(s string) {
+		if state.font == nil {
+			return
+		}
+		item := pdfItem{}
+		text := &bytes.Buffer{}
+		start := pdfMatrix{state.size * state.scale, 0, 0, state.size, 0, state.rise}.multiply(tm).multiply(state.ctm)
+		item.x, item.y = start[4], start[5]
+		item.size = math.Hypot(start[2], start[3])
+		for _, g := range state.font.decode(s) {
+			text.WriteString(g.text)
+			if g.text == "�" {
+				item.unreadable++
+			}
+			advance := g.width/1000*state.size + state.charSpace
+			if g.space {
+				advance += state.wordSpace
+			}
+			tm = pdfTranslate(advance*state.scale, 0).multiply(tm)
+		}
+		end := pdfMatrix{1, 0, 0, 1, 0, state.rise}.multiply(tm).multiply(state.ctm)
+		item.end = end[4]
+		item.text = text.String()
+		if item.text != "" {
+			c.items = append(c.items, item)
+		}
+	}
+
+	for {
+		obj, err := l.object()
+		if err != nil {
+			return
+		}
+		op, ok := obj.(pdfKeyword)
+		if !ok {
+			operands = append(operands, obj)
+			continue
+		}
+
+		switch op {
+		case "q":
+			stack = append(stack, state)
+		case "Q":
+			if len(stack) > 0 {
+				state = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+			}
+		case "cm":
+			if len(operands) == 6 {
+				state.ctm = pdfMatrix{number(0), number(1), number(2), number(3), number(4), number(5)}.
+					multiply(state.ctm)
+			}
+		case "BT":
+			tm, tlm = pdfIdentity, pdfIdentity
+		case "Tf":
+			if len(operands) == 2 {
+				if name, ok := operands[0].(pdfName); ok {
+					state.font = c.f.font(fonts[name])
+				}
+				state.size = number(1)
+			}
+		case "Tc":
+			state.charSpace = number(0)
+		case "Tw":
+			state.wordSpace = number(0)
+		case "Tz":
+			state.scale = number(0) / 100
+		case "TL":
+			state.leading = number(0)
+		case "Ts":
+			state.rise = number(0)
+		case "Td":
+			nextLine(number(0), number(1))
+		case "TD":
+			state.leading = -number(1)
+			nextLine(number(0), number(1))
+		case "Tm":
+			if len(operands) == 6 {
+				tlm = pdfMatrix{number(0), number(1), number(2), number(3), number(4), number(5)}
+				tm = tlm
+			}
+		case "T*":
+			nextLine(0, -state.leading)
+		case "Tj":
+			if len(operands) > 0 {
+				s, _ := operands[0].(string)
+				show(s)
+			}
+		case "'":
+			nextLine(0, -state.leading)
+			if len(operands) > 0 {
+				s, _ := operands[0].(string)
+				show(s)
+			}
+		case `"`:
+			if len(operands) == 3 {
+				state.wordSpace, state.charSpace = number(0), number(1)
+				nextLine(0, -state.leading)
+				s, _ := operands[2].(string)
+				show(s)
+			}
+		case "TJ":
+			if len(operands) > 0 {
+				for _, e := range c.f.array(operands[0]) {
+					switch e := e.(type) {
+					case string:
+						show(e)
+					case int, float64:
+						n, _ := c.f.number(e)
+						tm = pdfTranslate(-n/1000*state.size*state.scale, 0).multiply(tm)
+					}
+				}
+			}
+		case "Do":
+			if len(operands) > 0 {
+				if name, ok := operands[0].(pdfName); ok {
+					c.xobject(xobjects[name], resources, state.ctm, depth)
+				}
+			}
+		case "BI":
+			skipInlineImage(l)
+		}
+		operands = operands[:0]
+	}
+}
+
+// xobject adds an image, or runs a form's content stream
+func (c *pdfContent) xobject(obj interface{}, resources pdfDict, ctm pdfMatrix, depth int) {
+	s, ok := c.f.resolve(obj).(*pdfStream)
+	if !ok {
+		return
+	}
+	switch c.f.resolve(s.dict["Subtype"]) {
+	case pdfName("Image"):
+		item := pdfItem{image: s, x: ctm[4], y: ctm[5] + ctm[3], end: ctm[4] + ctm[0]}
+		if ref, ok := obj.(pdfRef); ok {
+			item.imageNum = ref.num
+		}
+		c.items = append(c.items, item)
+	case pdfName("Form"):
+		data, err := c.f.decode(s)
+		if err != nil {
+			return
+		}
+		if r, ok := c.f.dict(s.dict["Resources"]); ok {
+			resources = r
+		}
+		if m := c.f.array(s.dict["Matrix"]); len(m) == 6 {
+			var matrix pdfMatrix
+			for i := range matrix {
+				matrix[i], _ = c.f.number(m[i])
+			}
+			ctm = matrix.multiply(ctm)
+		}
+		c.run(data, resources, ctm, depth+1)
+	}
+}
+
+// skipInlineImage skips over the data of an inline image, which can't be read as objects
+func skipInlineImage(l *pdfLexer) {
+	for {
+		obj, err := l.object()
+		if err != nil || obj == pdfKeyword("ID") {
+			break
+		}
+	}
+	l.pos++
+	for l.pos+2 <= len(l.data) {
+		if l.data[l.pos] == 'E' && l.data[l.pos+1] == 'I' && isPDFSpace(l.data[l.pos-1]) &&
+			(l.pos+2 == len(l.data) || isPDFSpace(l.data[l.pos+2])) {
+			l.pos += 2
+			return
+		}
+		l.pos++
+	}
+	l.pos = len(l.data)
+}
+
+// pdfGlyphText returns the text of a glyph name, from the names used in font encodings
+func pdfGlyphText(name string) (string, bool) {
+	if dot := strings.Index(name, "."); dot > 0 {
+		// variants like a.sc are the same character
+		name = name[:dot]
+	}
+	if text, ok := pdfGlyphNames[name]; ok {
+		return text, true
+	}
+	if len(name) == 1 && ((name[0] >= 'a' && name[0] <= 'z') || (name[0] >= 'A' && name[0] <= 'Z')) {
+		return name, true
+	}
+	if strings.Contains(name, "_") {
+		// ligatures like f_f_i
+		text := ""
+		for _, part := range strings.Split(name, "_") {
+			t, ok := pdfGlyphText(part)
+			if !ok {
+				return "", false
+			}
+			text += t
+		}
+		return text, true
+	}
+	if strings.HasPrefix(name, "uni") && len(name) >= 7 && (len(name)-3)%4 == 0 {
+		text := ""
+		for i := 3; i < len(name); i += 4 {
+			n, err := strconv.ParseUint(name[i:i+4], 16, 16)
+			if err != nil {
+				return "", false
+			}
+			text += string(rune(n))
+		}
+		return text, true
+	}
+	if strings.HasPrefix(name, "u") && len(name) >= 5 && len(name) <= 7 {
+		if n, err := strconv.ParseUint(name[1:], 16, 32); err == nil {
+			return string(rune(n)), true
+		}
+	}
+	for accent, letters := range pdfAccents {
+		if !strings.HasSuffix(name, accent) {
+			continue
+		}
+		base := strings.TrimSuffix(name, accent)
+		runes := []rune(letters)
+		for i := 0; i+1 < len(runes); i += 2 {
+			if string(runes[i]) == base {
+				return string(runes[i+1]), true
+			}
+		}
+	}
+	return "", false
+}
+
+// pdfLigatures are the ligatures from font encodings, which are stored in the encoding as private use
+// characters
+var pdfLigatures = []string{"ff", "fi", "fl", "ffi", "ffl"}
+
+func pdfLigatureRune(text string) rune {
+	for i, l := range pdfLigatures {
+		if l == text {
+			return rune(0xF700 + i)
+		}
+	}
+	return 0xFFFD
+}
+
+func pdfExpandLigature(r rune) string {
+	if r >= 0xF700 && int(r-0xF700) < len(pdfLigatures) {
+		return pdfLigatures[r-0xF700]
+	}
+	return string(r)
+}
+
+// pdfAccents are the accented letters named by a base letter and an accent, as pairs of the base and accented
+// letter
+var pdfAccents = map[string]string{
+	"acute":      "aáeéiíoóuúyýAÁEÉIÍOÓUÚYÝcćCĆnńNŃsśSŚzźZŹ",
+	"grave":      "aàeèiìoòuùAÀEÈIÌOÒUÙ",
+	"circumflex": "aâeêiîoôuûAÂEÊIÎOÔUÛ",
+	"dieresis":   "aäeëiïoöuüyÿAÄEËIÏOÖUÜYŸ",
+	"tilde":      "aãnñoõAÃNÑOÕ",
+	"ring":       "aåuůAÅUŮ",
+	"cedilla":    "cçCÇ",
+	"caron":      "cčCČeěEĚrřRŘsšSŠzžZŽ",
+}
+
+// pdfGlyphNames are the glyph names, other than letters, used in font encodings
+var pdfGlyphNames = map[string]string{
+	"space": " ", "exclam": "!", "quotedbl": `"`, "numbersign": "#", "dollar": "$", "percent": "%",
+	"ampersand": "&", "quotesingle": "'", "quoteright": "’", "quoteleft": "‘", "parenleft": "(",
+	"parenright": ")", "asterisk": "*", "plus": "+", "comma": ",", "hyphen": "-", "period": ".", "slash": "/",
+	"zero": "0", "one": "1", "two": "2", "three": "3", "four": "4", "five": "5", "six": "6", "seven": "7",
+	"eight": "8", "nine": "9", "colon": ":", "semicolon": ";", "less": "<", "equal": "=", "greater": ">",
+	"question": "?", "at": "@", "bracketleft": "[", "backslash": `\`, "bracketright": "]", "asciicircum": "^",
+	"underscore": "_", "grave": "`", "braceleft": "{", "bar": "|", "braceright": "}", "asciitilde": "~",
+	"quotedblleft": "“", "quotedblright": "”", "quotesinglbase": "‚", "quotedblbase": "„", "endash": "–",
+	"emdash": "—", "bullet": "•", "ellipsis": "…", "ff": "ff", "fi": "fi", "fl": "fl", "ffi": "ffi",
+	"ffl": "ffl", "dagger": "†", "daggerdbl": "‡", "trademark": "™", "copyright": "©", "registered": "®",
+	"degree": "°", "section": "§", "paragraph": "¶", "periodcentered": "·", "minus": "−", "multiply": "×",
+	"divide": "÷", "plusminus": "±", "Euro": "€", "sterling": "£", "yen": "¥", "cent": "¢",
+	"germandbls": "ß", "ae": "æ", "AE": "Æ", "oe": "œ", "OE": "Œ", "oslash": "ø", "Oslash": "Ø",
+	"exclamdown": "¡", "questiondown": "¿", "guillemotleft": "«", "guillemotright": "»",
+	"guilsinglleft": "‹", "guilsinglright": "›", "nbspace": " ", "nonbreakingspace": " ",
+	"dotlessi": "ı", "lslash": "ł", "Lslash": "Ł", "mu": "µ", "onehalf": "½", "onequarter": "¼",
+	"threequarters": "¾", "ordfeminine": "ª", "ordmasculine": "º", "logicalnot": "¬", "brokenbar": "¦",
+	"currency": "¤", "florin": "ƒ", "perthousand": "‰", "acute": "´", "dieresis": "¨", "macron": "¯",
+	"cedilla": "¸", "circumflex": "ˆ", "tilde": "˜", "caron": "ˇ", "breve": "˘", "dotaccent": "˙",
+	"ring": "˚", "hungarumlaut": "˝", "ogonek": "˛", "fraction": "⁄", "arrowright": "→", "arrowleft": "←",
+	"eth": "ð", "Eth": "Ð", "thorn": "þ", "Thorn": "Þ", "onesuperior": "¹", "twosuperior": "²",
+	"threesuperior": "³", "Scaron": "Š", "scaron": "š", "Zcaron": "Ž", "zcaron": "ž", "Ydieresis": "Ÿ",
+}
+
+// the single byte encodings of simple fonts
+var (
+	pdfStandardEncoding = pdfEncoding(map[byte]rune{
+		0x27: '’', 0x60: '‘', 0xA1: '¡', 0xA2: '¢', 0xA3: '£', 0xA4: '⁄', 0xA5: '¥', 0xA6: 'ƒ', 0xA7: '§',
+		0xA8: '¤', 0xA9: '\'', 0xAA: '“', 0xAB: '«', 0xAC: '‹', 0xAD: '›', 0xAE: 0xF701, 0xAF: 0xF702,
+		0xB1: '–', 0xB2: '†', 0xB3: '‡', 0xB4: '·', 0xB6: '¶', 0xB7: '•', 0xB8: '‚', 0xB9: '„', 0xBA: '”',
+		0xBB: '»', 0xBC: '…', 0xBD: '‰', 0xBF: '¿', 0xC1: '`', 0xC2: '´', 0xC3: 'ˆ', 0xC4: '˜', 0xC5: '¯',
+		0xC6: '˘', 0xC7: '˙', 0xC8: '¨', 0xCA: '˚', 0xCB: '¸', 0xCD: '˝', 0xCE: '˛', 0xCF: 'ˇ', 0xD0: '—',
+		0xE1: 'Æ', 0xE3: 'ª', 0xE8: 'Ł', 0xE9: 'Ø', 0xEA: 'Œ', 0xEB: 'º', 0xF1: 'æ', 0xF5: 'ı', 0xF8: 'ł',
+		0xF9: 'ø', 0xFA: 'œ', 0xFB: 'ß',
+	}, false)
+	pdfWinAnsiEncoding = pdfEncoding(map[byte]rune{
+		0x80: '€', 0x82: '‚', 0x83: 'ƒ', 0x84: '„', 0x85: '…', 0x86: '†', 0x87: '‡', 0x88: 'ˆ', 0x89: '‰',
+		0x8A: 'Š', 0x8B: '‹', 0x8C: 'Œ', 0x8E: 'Ž', 0x91: '‘', 0x92: '’', 0x93: '“', 0x94: '”', 0x95: '•',
+		0x96: '–', 0x97: '—', 0x98: '˜', 0x99: '™', 0x9A: 'š', 0x9B: '›', 0x9C: 'œ', 0x9E: 'ž', 0x9F: 'Ÿ',
+	}, true)
+	pdfMacRomanEncoding = pdfMacRoman()
+)
+
+// pdfDocEncoding is the encoding of text strings that aren't UTF-16, where it differs from Latin-1
+var pdfDocEncoding = map[byte]rune{
+	0x80: '•', 0x81: '†', 0x82: '‡', 0x83: '…', 0x84: '—', 0x85: '–', 0x86: 'ƒ', 0x87: '⁄', 0x88: '‹',
+	0x89: '›', 0x8A: '−', 0x8B: '‰', 0x8C: '„', 0x8D: '“', 0x8E: '”', 0x8F: '‘', 0x90: '’', 0x91: '‚',
+	0x92: '™', 0x93: 'ﬁ', 0x94: 'ﬂ', 0x95: 'Ł', 0x96: 'Œ', 0x97: 'Š', 0x98: 'Ÿ', 0x99: 'Ž', 0x9A: 'ı',
+	0x9B: 'ł', 0x9C: 'œ', 0x9D: 'š', 0x9E: 'ž', 0xA0: '€',
+}
+
+// pdfEncoding builds an encoding from ASCII, and Latin-1 if latin1 is true, with the differences
+func pdfEncoding(differences map[byte]rune, latin1 bool) [256]rune {
+	var encoding [256]rune
+	for c := 32; c < 127; c++ {
+		encoding[c] = rune(c)
+	}
+	if latin1 {
+		for c := 160; c < 256; c++ {
+			encoding[c] = rune(c)
+		}
+	}
+	for c, r := range differences {
+		encoding[c] = r
+	}
+	return encoding
+}
+
+func pdfMacRoman() [256]rune {
+	encoding := pdfEncoding(nil, false)
+	upper := []rune("ÄÅÇÉÑÖÜáàâäãåçéèêëíìîïñóòôöõúùûü†°¢£§•¶ß®©™´¨≠ÆØ∞±≤≥¥µ∂∑∏π∫ªºΩæø" +
+		"¿¡¬√ƒ≈∆«»… ÀÃÕŒœ–—“”‘’÷◊ÿŸ⁄€‹›‡·‚„‰ÂÊÁËÈÍÎÏÌÓÔÒÚÛÙıˆ˜¯˘˙˚¸˝˛ˇ")
+	for i, r := range upper {
+		encoding[128+i] = r
+	}
+	encoding[0xDE] = 0xF701
+	return encoding
+}
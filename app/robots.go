@@ -0,0 +1,145 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"bufio"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// crawlUserAgent is the user agent the crawler identifies itself with, and follows the robots.txt rules for
+const crawlUserAgent = "LexLibrary"
+
+// robotsRules are the rules from a site's robots.txt file that apply to the crawler
+type robotsRules struct {
+	rules []robotsRule
+	delay time.Duration
+}
+
+// robotsRule allows or disallows the paths matching its pattern
+type robotsRule struct {
+	allow   bool
+	length  int // the length of the pattern, the longest matching pattern wins
+	pattern *regexp.Regexp
+}
+
+// robotsGroup is a group of rules for one or more user agents
+type robotsGroup struct {
+	agents []string
+	rules  []robotsRule
+	delay  time.Duration
+}
+
+// parseRobots parses a robots.txt file, returning the rules of the groups for the crawler's user agent, or the
+// rules for every user agent if there are none for the crawler
+func parseRobots(file string) *robotsRules {
+	var groups []*robotsGroup
+	var group *robotsGroup
+	agentLines := false
+
+	s := bufio.NewScanner(strings.NewReader(file))
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i]
+		}
+		colon := strings.Index(line, ":")
+		if colon == -1 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:colon]))
+		value := strings.TrimSpace(line[colon+1:])
+
+		if key == "user-agent" {
+			if !agentLines {
+				// consecutive user agent lines share the rules that follow them
+				group = &robotsGroup{}
+				groups = append(groups, group)
+			}
+			group.agents = append(group.agents, strings.ToLower(value))
+			agentLines = true
+			continue
+		}
+		agentLines = false
+		if group == nil {
+			continue
+		}
+
+		switch key {
+		case "allow", "disallow":
+			if value == "" {
+				// an empty disallow allows everything
+				continue
+			}
+			group.rules = append(group.rules, robotsRule{
+				allow:   key == "allow",
+				length:  len(value),
+				pattern: robotsPattern(value),
+			})
+		case "crawl-delay":
+			seconds, err := strconv.ParseFloat(value, 64)
+			if err == nil && seconds > 0 {
+				group.delay = time.Duration(seconds * float64(time.Second))
+			}
+		}
+	}
+
+	agent := strings.ToLower(crawlUserAgent)
+	specific := &robotsRules{}
+	general := &robotsRules{}
+	for _, g := range groups {
+		for _, a := range g.agents {
+			rules := general
+			if a != "*" {
+				if !strings.Contains(agent, a) {
+					continue
+				}
+				rules = specific
+			}
+			rules.rules = append(rules.rules, g.rules...)
+			if g.delay > rules.delay {
+				rules.delay = g.delay
+			}
+			break
+		}
+	}
+	if len(specific.rules) > 0 || specific.delay > 0 {
+		return specific
+	}
+	return general
+}
+
+// robotsPattern converts a robots.txt path pattern, where * matches anything and a trailing $ matches the end of
+// the path, to a regular expression
+func robotsPattern(pattern string) *regexp.Regexp {
+	end := strings.HasSuffix(pattern, "$")
+	pattern = strings.TrimSuffix(pattern, "$")
+	expr := "^" + strings.Replace(regexp.QuoteMeta(pattern), `\*`, ".*", -1)
+	if end {
+		expr += "$"
+	}
+	return regexp.MustCompile(expr)
+}
+
+// allowed returns whether the path, with its query, may be crawled.  The longest matching rule wins, and allow
+// rules win ties
+func (r *robotsRules) allowed(path string) bool {
+	if path == "/robots.txt" {
+		return true
+	}
+	allowed := true
+	length := -1
+	for _, rule := range r.rules {
+		if !rule.pattern.MatchString(path) {
+			continue
+		}
+		if rule.length > length || (rule.length == length && rule.allow) {
+			allowed = rule.allow
+			length = rule.length
+		}
+	}
+	return allowed
+}
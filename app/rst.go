@@ -0,0 +1,1209 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+/*
+	reStructuredText is converted to HTML the way docutils parses it: the text is split into body elements by their
+	indentation and markers, and the content of indented elements, like list items and directives, is parsed the
+	same way recursively.  Section levels aren't fixed in reStructuredText, so each heading's level is the order its
+	adornment style was first used in.  The text of paragraphs, headings and the like is parsed for inline markup.
+
+	References can point at targets defined anywhere in the text, so links are written as placeholders, and are
+	resolved once the whole text is converted.  Sections are targets by their titles, and explicit targets before a
+	section are labels for it, the way Sphinx's :ref: role uses them.
+
+	Sphinx and docutils directives with an equivalent in a document are converted to it: code blocks, admonitions,
+	images, figures, list tables, math and raw HTML.  Any other directive is reported, and only its content is kept.
+	Other documents aren't part of the import, so links to them with the :doc: role and included files are left out
+	and reported as well.
+*/
+
+// rstAdmonitions are the labels of the admonition directives, by directive name
+var rstAdmonitions = map[string]string{
+	"attention": "Attention",
+	"caution":   "Caution",
+	"danger":    "Danger",
+	"error":     "Error",
+	"hint":      "Hint",
+	"important": "Important",
+	"note":      "Note",
+	"tip":       "Tip",
+	"warning":   "Warning",
+	"seealso":   "See also",
+	"todo":      "To do",
+}
+
+// rstCodeRoles are the interpreted text roles shown as code
+var rstCodeRoles = map[string]bool{
+	"code": true, "literal": true, "file": true, "samp": true, "command": true, "program": true, "kbd": true,
+	"envvar": true, "option": true, "math": true, "mod": true, "func": true, "class": true, "meth": true,
+	"attr": true, "exc": true, "data": true, "const": true, "obj": true, "py:mod": true, "py:func": true,
+	"py:class": true, "py:meth": true, "py:attr": true, "py:exc": true, "py:data": true, "py:const": true,
+	"py:obj": true,
+}
+
+// rstRoleElements are the interpreted text roles with an equivalent element
+var rstRoleElements = map[string]string{
+	"emphasis":    "em",
+	"strong":      "strong",
+	"sub":         "sub",
+	"subscript":   "sub",
+	"sup":         "sup",
+	"superscript": "sup",
+	"title":       "cite",
+}
+
+var (
+	reRSTBullet      = regexp.MustCompile(`^([-*+•])( +|$)`)
+	reRSTEnumerated  = regexp.MustCompile(`^(?:(\d+|#|[A-Za-z])\.|\(?(\d+|#|[A-Za-z])\))( +|$)`)
+	reRSTField       = regexp.MustCompile(`^:((?:[^:\\]|\\.)+):( +|$)`)
+	reRSTDirective   = regexp.MustCompile(`^(?:\|([^|]+)\| +)?([A-Za-z0-9][-A-Za-z0-9_.:+]*)::(?: +|$)`)
+	reRSTTarget      = regexp.MustCompile("^_(`[^`]+`|[^:]+):(?: +|$)")
+	reRSTFootnote    = regexp.MustCompile(`^\[(\d+|#[-A-Za-z0-9_.]*|[A-Za-z][-A-Za-z0-9_.]*)\](?: +|$)`)
+	reRSTGridBorder  = regexp.MustCompile(`^\+([-=]+\+)+$`)
+	reRSTSimpleTable = regexp.MustCompile(`^=+( +=+)+$`)
+	reRSTOption      = regexp.MustCompile(`^:([^:]+):(?: +(.*))?$`)
+	reRSTName        = regexp.MustCompile(`^[A-Za-z0-9]+(?:[-_.:+][A-Za-z0-9]+)*`)
+	reRSTURL         = regexp.MustCompile(`^(?:https?://|ftp://|mailto:)[^\s<>"]*[^\s<>".,:;!?)\]}']`)
+	reRSTRole        = regexp.MustCompile("^:([A-Za-z][-A-Za-z0-9_.:+]*):`")
+	reRSTRoleSuffix  = regexp.MustCompile(`^:([A-Za-z][-A-Za-z0-9_.:+]*):`)
+	reRSTFootnoteRef = regexp.MustCompile(`^\[(\d+|#[-A-Za-z0-9_.]*|[A-Za-z][-A-Za-z0-9_.]*)\]_`)
+	reRSTEscape      = regexp.MustCompile(`\\(.)`)
+	reRSTReference   = regexp.MustCompile("\x00([^\x00]*)\x00([^\x00]*)\x00")
+)
+
+// rstConverter converts reStructuredText to HTML
+type rstConverter struct {
+	// the directives, documents linked with :doc:, included files and references without targets found in the text
+	unknown   []string
+	documents []string
+	includes  []string
+	missing   []string
+	// the values of the tags or keywords fields of the document
+	tags []string
+
+	styles        []string          // the adornment styles of the headings, by level
+	targets       map[string]string // the links of the targets, by normalized name
+	titles        map[string]string // the HTML of the sections' titles, by the normalized names of their targets
+	pending       []string          // the internal targets for the next element
+	ids           map[string]bool
+	substitutions map[string]string
+	footnotes     int // the number of auto-numbered footnotes
+	footnoteRefs  int // the number of references to auto-numbered footnotes
+	language      string
+}
+
+func newRSTConverter() *rstConverter {
+	return &rstConverter{
+		targets:       make(map[string]string),
+		titles:        make(map[string]string),
+		ids:           make(map[string]bool),
+		substitutions: make(map[string]string),
+	}
+}
+
+// convert converts the reStructuredText to HTML
+func (r *rstConverter) convert(text string) string {
+	// the reference marker can't be in the text itself
+	text = strings.Replace(text, "\x00", "", -1)
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	lines := strings.Split(text, "\n")
+	for l := range lines {
+		lines[l] = strings.TrimRightFunc(rstExpandTabs(lines[l]), unicode.IsSpace)
+	}
+
+	body := r.blocks(lines)
+	body += r.flushTargets()
+
+	return reRSTReference.ReplaceAllStringFunc(body, func(ref string) string {
+		m := reRSTReference.FindStringSubmatch(ref)
+		name, text := m[1], m[2]
+		link, ok := r.targets[rstName(name)]
+		for n := 0; ok && n < 10 && strings.HasPrefix(link, "\x00"); n++ {
+			// a target that points at another target
+			link, ok = r.targets[link[1:]]
+		}
+		if text == "" {
+			text = r.titles[rstName(name)]
+			if text == "" {
+				text = escapeHTML(name)
+			}
+		}
+		if !ok {
+			r.missing = append(r.missing, name)
+			return text
+		}
+		return `<a href="` + escapeHTML(link) + `">` + text + "</a>"
+	})
+}
+
+// rstExpandTabs replaces the tabs in the line with spaces, with tab stops every 8 columns like docutils
+func rstExpandTabs(line string) string {
+	if !strings.Contains(line, "\t") {
+		return line
+	}
+	buf := &bytes.Buffer{}
+	column := 0
+	for _, c := range line {
+		if c == '\t' {
+			spaces := 8 - column%8
+			buf.WriteString(strings.Repeat(" ", spaces))
+			column += spaces
+			continue
+		}
+		buf.WriteRune(c)
+		column++
+	}
+	return buf.String()
+}
+
+// rstName normalizes the name of a target or reference
+func rstName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// rstID returns the id docutils gives an element with the name
+func rstID(name string) string {
+	id := strings.Map(func(c rune) rune {
+		c = unicode.ToLower(c)
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			return c
+		}
+		return '-'
+	}, name)
+	for strings.Contains(id, "--") {
+		id = strings.Replace(id, "--", "-", -1)
+	}
+	id = strings.Trim(strings.TrimLeft(id, "0123456789-"), "-")
+	if id == "" {
+		id = "section"
+	}
+	return id
+}
+
+// uniqueID returns a unique id for the element with the name
+func (r *rstConverter) uniqueID(name string) string {
+	base := rstID(name)
+	id := base
+	for n := 1; r.ids[id]; n++ {
+		id = base + "-" + strconv.Itoa(n)
+	}
+	r.ids[id] = true
+	return id
+}
+
+// rstReference returns the placeholder for a reference to the target with the name, which is replaced with the link
+// once the whole text is converted.  If the text is empty, the link's text is the title of the section the target
+// is for, or the name
+func rstReference(name, text string) string {
+	return "\x00" + strings.Join(strings.Fields(name), " ") + "\x00" + text + "\x00"
+}
+
+// flushTargets returns the anchors of the internal targets for the next element, when it isn't a section
+func (r *rstConverter) flushTargets() string {
+	anchors := ""
+	for _, name := range r.pending {
+		id := r.uniqueID(name)
+		r.targets[rstName(name)] = "#" + id
+		anchors += `<a name="` + escapeHTML(id) + `"></a>`
+	}
+	r.pending = nil
+	if anchors != "" {
+		anchors += "\n"
+	}
+	return anchors
+}
+
+// indentation returns the number of spaces the line is indented by
+func indentation(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// dedent removes the indentation all of the lines share
+func dedent(lines []string) []string {
+	min := -1
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		if n := indentation(line); min == -1 || n < min {
+			min = n
+		}
+	}
+	dedented := make([]string, len(lines))
+	for l, line := range lines {
+		if len(line) >= min && min > 0 {
+			line = line[min:]
+		}
+		dedented[l] = line
+	}
+	return dedented
+}
+
+// rstIndentedBlock returns the indented lines starting at start, dedented, and the index of the line after them.
+// Blank lines are part of the block when the block continues after them
+func rstIndentedBlock(lines []string, start int) ([]string, int) {
+	end := start
+	for l := start; l < len(lines); l++ {
+		if lines[l] == "" {
+			continue
+		}
+		if indentation(lines[l]) == 0 {
+			break
+		}
+		end = l + 1
+	}
+	return dedent(lines[start:end]), end
+}
+
+// rstItemBlock returns the lines of the list item, field or explicit markup block starting at start, whose first line
+// starts after the width of its marker, and the index of the line after it
+func rstItemBlock(lines []string, start, width int) ([]string, int) {
+	rest, end := rstIndentedBlock(lines, start+1)
+	first := ""
+	if width < len(lines[start]) {
+		first = lines[start][width:]
+	}
+	return append([]string{first}, rest...), end
+}
+
+// rstAdornment returns whether the line is a section adornment or transition, which repeats one punctuation
+// character
+func rstAdornment(line string) bool {
+	if len(line) < 2 || !strings.ContainsRune("!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", rune(line[0])) {
+		return false
+	}
+	return strings.Count(line, line[:1]) == len(line)
+}
+
+// blocks converts the lines into body elements
+func (r *rstConverter) blocks(lines []string) string {
+	buf := &bytes.Buffer{}
+	for l := 0; l < len(lines); {
+		line := lines[l]
+		if line == "" {
+			l++
+			continue
+		}
+
+		if indentation(line) > 0 {
+			block, end := rstIndentedBlock(lines, l)
+			buf.WriteString(r.flushTargets())
+			buf.WriteString("<blockquote>\n" + r.blocks(block) + "</blockquote>\n")
+			l = end
+			continue
+		}
+
+		if next := l + 1; next < len(lines) {
+			// a heading with an overline and underline, or only an underline
+			if rstAdornment(line) && next+1 < len(lines) && lines[next] != "" && lines[next+1] == line {
+				r.heading(buf, line[:1]+"o", strings.TrimSpace(lines[next]))
+				l += 3
+				continue
+			}
+			if !rstAdornment(line) && rstAdornment(lines[next]) &&
+				(len(lines[next]) >= utf8.RuneCountInString(line) || len(lines[next]) >= 3) {
+				r.heading(buf, lines[next][:1], line)
+				l += 2
+				continue
+			}
+		}
+
+		if strings.HasPrefix(line, "..") && (line == ".." || line[2] == ' ') {
+			l = r.explicit(buf, lines, l)
+			continue
+		}
+		buf.WriteString(r.flushTargets())
+
+		switch {
+		case rstAdornment(line) && len(line) >= 4:
+			buf.WriteString("<hr />\n")
+			l++
+		case reRSTGridBorder.MatchString(line):
+			l = r.gridTable(buf, lines, l)
+		case reRSTSimpleTable.MatchString(line):
+			l = r.simpleTable(buf, lines, l)
+		case strings.HasPrefix(line, ">>>"):
+			end := l
+			for end < len(lines) && lines[end] != "" {
+				end++
+			}
+			buf.WriteString(`<pre><code class="language-python">` + escapeHTML(strings.Join(lines[l:end], "\n")) +
+				"</code></pre>\n")
+			l = end
+		case line == "|" || strings.HasPrefix(line, "| "):
+			l = r.lineBlock(buf, lines, l)
+		case reRSTBullet.MatchString(line):
+			l = r.list(buf, lines, l, false)
+		case reRSTEnumerated.MatchString(line) && r.enumerated(lines, l):
+			l = r.list(buf, lines, l, true)
+		case reRSTField.MatchString(line):
+			l = r.fieldList(buf, lines, l)
+		case l+1 < len(lines) && lines[l+1] != "" && indentation(lines[l+1]) > 0:
+			l = r.definitionList(buf, lines, l)
+		default:
+			l = r.paragraph(buf, lines, l)
+		}
+	}
+	return buf.String()
+}
+
+// heading writes a section heading, at the level of its adornment style
+func (r *rstConverter) heading(buf *bytes.Buffer, style, title string) {
+	level := 0
+	for s := range r.styles {
+		if r.styles[s] == style {
+			level = s + 1
+		}
+	}
+	if level == 0 {
+		r.styles = append(r.styles, style)
+		level = len(r.styles)
+	}
+	if level > 6 {
+		level = 6
+	}
+
+	content := r.inline(title)
+	id := r.uniqueID(title)
+	// the titles are link text, so they can't have links of their own
+	text := reRSTReference.ReplaceAllString(content, "$2")
+	r.targets[rstName(title)] = "#" + id
+	r.titles[rstName(title)] = text
+	for _, name := range r.pending {
+		r.targets[rstName(name)] = "#" + id
+		r.titles[rstName(name)] = text
+	}
+	r.pending = nil
+
+	h := "h" + strconv.Itoa(level)
+	buf.WriteString("<" + h + ` id="` + id + `">` + content + "</" + h + ">\n")
+}
+
+// paragraph writes the paragraph starting at start, and the literal block after it if it ends with ::, and returns
+// the index of the line after them
+func (r *rstConverter) paragraph(buf *bytes.Buffer, lines []string, start int) int {
+	end := start
+	for end < len(lines) && lines[end] != "" && (end == start || indentation(lines[end]) == 0) {
+		end++
+	}
+	text := strings.Join(lines[start:end], "\n")
+
+	literal := strings.HasSuffix(text, "::")
+	if literal {
+		switch {
+		case text == "::":
+			text = ""
+		case strings.HasSuffix(text, " ::") || strings.HasSuffix(text, "\n::"):
+			text = strings.TrimRightFunc(text[:len(text)-2], unicode.IsSpace)
+		default:
+			text = text[:len(text)-1]
+		}
+	}
+	if text != "" {
+		buf.WriteString("<p>" + r.inline(text) + "</p>\n")
+	}
+	if !literal {
+		return end
+	}
+
+	next := end
+	for next < len(lines) && lines[next] == "" {
+		next++
+	}
+	if next == len(lines) || indentation(lines[next]) == 0 {
+		return end
+	}
+	block, end := rstIndentedBlock(lines, next)
+	r.code(buf, r.language, block)
+	return end
+}
+
+// code writes a code block in the language
+func (r *rstConverter) code(buf *bytes.Buffer, language string, lines []string) {
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	buf.WriteString("<pre><code")
+	if language != "" && language != "none" && language != "text" {
+		buf.WriteString(` class="language-` + escapeHTML(strings.ToLower(language)) + `"`)
+	}
+	buf.WriteString(">" + escapeHTML(strings.Join(lines, "\n")) + "</code></pre>\n")
+}
+
+// lineBlock writes the lines starting with | as a paragraph, keeping the line breaks
+func (r *rstConverter) lineBlock(buf *bytes.Buffer, lines []string, start int) int {
+	var converted []string
+	l := start
+	for ; l < len(lines) && (lines[l] == "|" || strings.HasPrefix(lines[l], "| ")); l++ {
+		converted = append(converted, r.inline(strings.TrimSpace(lines[l][1:])))
+	}
+	buf.WriteString("<p>" + strings.Join(converted, "<br />\n") + "</p>\n")
+	return l
+}
+
+// enumerated returns whether the line starting with an enumerator starts a list, instead of a paragraph that
+// happens to start with something like "A. Smith"
+func (r *rstConverter) enumerated(lines []string, start int) bool {
+	return start+1 == len(lines) || lines[start+1] == "" || indentation(lines[start+1]) > 0 ||
+		reRSTEnumerated.MatchString(lines[start+1])
+}
+
+// list writes the bullet or enumerated list starting at start, and returns the index of the line after it
+func (r *rstConverter) list(buf *bytes.Buffer, lines []string, start int, enumerated bool) int {
+	marker := func(line string) (string, int) {
+		if enumerated {
+			m := reRSTEnumerated.FindStringSubmatch(line)
+			if m == nil {
+				return "", 0
+			}
+			enumerator := m[1] + m[2]
+			return enumerator, len(m[0])
+		}
+		m := reRSTBullet.FindStringSubmatch(line)
+		if m == nil {
+			return "", 0
+		}
+		return m[1], len(m[0])
+	}
+
+	first, _ := marker(lines[start])
+	element := "ul"
+	if enumerated {
+		element = "ol"
+		attributes := ""
+		if n, err := strconv.Atoi(first); err == nil && n != 1 {
+			attributes = ` start="` + strconv.Itoa(n) + `"`
+		} else if first != "#" && err != nil {
+			if unicode.IsUpper(rune(first[0])) {
+				attributes = ` type="A"`
+			} else {
+				attributes = ` type="a"`
+			}
+		}
+		buf.WriteString("<ol" + attributes + ">\n")
+	} else {
+		buf.WriteString("<ul>\n")
+	}
+
+	l := start
+	for l < len(lines) {
+		enumerator, width := marker(lines[l])
+		if width == 0 || (!enumerated && enumerator != first) {
+			break
+		}
+		var item []string
+		item, l = rstItemBlock(lines, l, width)
+		buf.WriteString("<li>" + r.compact(item) + "</li>\n")
+		for l < len(lines) && lines[l] == "" {
+			l++
+		}
+	}
+	buf.WriteString("</" + element + ">\n")
+	return l
+}
+
+// compact converts the lines, without wrapping them in a paragraph if they're only a paragraph
+func (r *rstConverter) compact(lines []string) string {
+	converted := strings.TrimSuffix(r.blocks(lines), "\n")
+	if strings.HasPrefix(converted, "<p>") && strings.HasSuffix(converted, "</p>") &&
+		strings.Count(converted, "<p>") == 1 {
+		return converted[3 : len(converted)-4]
+	}
+	return converted
+}
+
+// fieldList writes the field list starting at start, and returns the index of the line after it.  The tags or
+// keywords fields are the document's tags instead
+func (r *rstConverter) fieldList(buf *bytes.Buffer, lines []string, start int) int {
+	l := start
+	items := &bytes.Buffer{}
+	for l < len(lines) {
+		m := reRSTField.FindStringSubmatch(lines[l])
+		if m == nil {
+			break
+		}
+		var field []string
+		field, l = rstItemBlock(lines, l, len(m[0]))
+		name := strings.Replace(m[1], `\`, "", -1)
+		switch strings.ToLower(name) {
+		case "tags", "keywords":
+			for _, tag := range strings.Split(strings.Join(field, " "), ",") {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					r.tags = append(r.tags, tag)
+				}
+			}
+		case "orphan", "nocomments", "tocdepth":
+			// Sphinx metadata
+		default:
+			items.WriteString("<dt>" + r.inline(name) + "</dt>\n<dd>" + r.compact(field) + "</dd>\n")
+		}
+		for l < len(lines) && lines[l] == "" {
+			l++
+		}
+	}
+	if items.Len() > 0 {
+		buf.WriteString("<dl>\n" + items.String() + "</dl>\n")
+	}
+	return l
+}
+
+// definitionList writes the definition list starting at start, and returns the index of the line after it
+func (r *rstConverter) definitionList(buf *bytes.Buffer, lines []string, start int) int {
+	buf.WriteString("<dl>\n")
+	l := start
+	for l+1 < len(lines) && lines[l] != "" && indentation(lines[l]) == 0 && lines[l+1] != "" &&
+		indentation(lines[l+1]) > 0 {
+		term := lines[l]
+		if classifier := strings.Index(term, " : "); classifier != -1 {
+			term = term[:classifier]
+		}
+		var definition []string
+		definition, l = rstIndentedBlock(lines, l+1)
+		buf.WriteString("<dt>" + r.inline(term) + "</dt>\n<dd>" + r.compact(definition) + "</dd>\n")
+		for l < len(lines) && lines[l] == "" {
+			l++
+		}
+	}
+	buf.WriteString("</dl>\n")
+	return l
+}
+
+// cell converts the content of a table cell
+func (r *rstConverter) cell(lines []string) string {
+	return r.compact(dedent(lines))
+}
+
+// table writes the rows of cells as a table, the first of them in its head
+func (r *rstConverter) table(buf *bytes.Buffer, rows [][]string, head int) {
+	buf.WriteString("<table>\n")
+	for row, cells := range rows {
+		if row == 0 && head > 0 {
+			buf.WriteString("<thead>\n")
+		}
+		if row == head {
+			buf.WriteString("<tbody>\n")
+		}
+		element := "td"
+		if row < head {
+			element = "th"
+		}
+		buf.WriteString("<tr>")
+		for _, cell := range cells {
+			buf.WriteString("<" + element + ">" + cell + "</" + element + ">")
+		}
+		buf.WriteString("</tr>\n")
+		if row == head-1 {
+			buf.WriteString("</thead>\n")
+		}
+	}
+	if head < len(rows) {
+		buf.WriteString("</tbody>\n")
+	}
+	buf.WriteString("</table>\n")
+}
+
+// gridTable writes the grid table starting at start, and returns the index of the line after it.  The columns are
+// the ones of the top border, so spanned cells are split
+func (r *rstConverter) gridTable(buf *bytes.Buffer, lines []string, start int) int {
+	border := lines[start]
+	var columns []int
+	for c := range border {
+		if border[c] == '+' {
+			columns = append(columns, c)
+		}
+	}
+
+	var rows [][]string
+	var content [][]string
+	head := 0
+	l := start + 1
+	for ; l < len(lines) && (strings.HasPrefix(lines[l], "+") || strings.HasPrefix(lines[l], "|")); l++ {
+		line := lines[l]
+		if strings.HasPrefix(line, "+") {
+			if content != nil {
+				row := make([]string, len(content))
+				for c := range content {
+					row[c] = r.cell(content[c])
+				}
+				rows = append(rows, row)
+				content = nil
+			}
+			if strings.Contains(line, "=") {
+				head = len(rows)
+			}
+			continue
+		}
+		if content == nil {
+			content = make([][]string, len(columns)-1)
+		}
+		for c := 0; c < len(columns)-1; c++ {
+			from, to := columns[c]+1, columns[c+1]
+			if from > len(line) {
+				content[c] = append(content[c], "")
+				continue
+			}
+			if to > len(line) {
+				to = len(line)
+			}
+			content[c] = append(content[c], strings.TrimRight(line[from:to], " "))
+		}
+	}
+	r.table(buf, rows, head)
+	return l
+}
+
+// simpleTable writes the simple table starting at start, and returns the index of the line after it
+func (r *rstConverter) simpleTable(buf *bytes.Buffer, lines []string, start int) int {
+	border := lines[start]
+	var columns []int
+	for c := range border {
+		if border[c] == '=' && (c == 0 || border[c-1] == ' ') {
+			columns = append(columns, c)
+		}
+	}
+
+	var rows [][]string
+	var content [][]string
+	head := 0
+	borders := 1
+	flush := func() {
+		if content == nil {
+			return
+		}
+		row := make([]string, len(content))
+		for c := range content {
+			row[c] = r.cell(content[c])
+		}
+		rows = append(rows, row)
+		content = nil
+	}
+
+	l := start + 1
+	for ; l < len(lines); l++ {
+		line := lines[l]
+		if reRSTSimpleTable.MatchString(line) {
+			flush()
+			borders++
+			if l+1 == len(lines) || lines[l+1] == "" {
+				l++
+				break
+			}
+			head = len(rows)
+			continue
+		}
+		if line == "" {
+			flush()
+			continue
+		}
+		if strings.HasPrefix(line, " ") && content != nil {
+			// a continuation of the row's text, which leaves the first column blank
+		} else {
+			flush()
+			content = make([][]string, len(columns))
+		}
+		for c := range columns {
+			from := columns[c]
+			if from >= len(line) {
+				continue
+			}
+			to := len(line)
+			if c+1 < len(columns) && columns[c+1] < to {
+				to = columns[c+1]
+			}
+			content[c] = append(content[c], strings.TrimSpace(line[from:to]))
+		}
+	}
+	flush()
+	if borders < 3 {
+		head = 0
+	}
+	r.table(buf, rows, head)
+	return l
+}
+
+// explicit handles the explicit markup block starting at start, a directive, target, footnote, substitution or
+// comment, and returns the index of the line after it
+func (r *rstConverter) explicit(buf *bytes.Buffer, lines []string, start int) int {
+	block, end := rstItemBlock(lines, start, 3)
+	first := block[0]
+
+	if m := reRSTTarget.FindStringSubmatch(first); m != nil {
+		name := strings.Trim(m[1], "`")
+		link := strings.Join(strings.Fields(first[len(m[0]):]+" "+strings.Join(block[1:], " ")), "")
+		switch {
+		case link == "":
+			r.pending = append(r.pending, name)
+		case strings.HasSuffix(link, "_") && !strings.Contains(link, "://"):
+			// an alias of another target
+			r.targets[rstName(name)] = "\x00" + rstName(strings.Trim(strings.TrimSuffix(link, "_"), "`"))
+		default:
+			r.targets[rstName(name)] = link
+		}
+		return end
+	}
+
+	if m := reRSTFootnote.FindStringSubmatch(first); m != nil {
+		buf.WriteString(r.flushTargets())
+		label := m[1]
+		if strings.HasPrefix(label, "#") {
+			r.footnotes++
+			if label == "#" {
+				label = strconv.Itoa(r.footnotes)
+			} else {
+				label = label[1:]
+			}
+		}
+		block[0] = first[len(m[0]):]
+		buf.WriteString(`<p id="footnote-` + escapeHTML(rstID(label)) + `"><sup>` + escapeHTML(label) + "</sup> " +
+			r.compact(block) + "</p>\n")
+		return end
+	}
+
+	m := reRSTDirective.FindStringSubmatch(first)
+	if m == nil {
+		// a comment
+		return end
+	}
+	substitution, name := m[1], strings.ToLower(m[2])
+	argument := strings.TrimSpace(first[len(m[0]):])
+	options := make(map[string]string)
+	content := block[1:]
+	for len(content) > 0 {
+		o := reRSTOption.FindStringSubmatch(content[0])
+		if o == nil {
+			break
+		}
+		options[strings.ToLower(o[1])] = strings.TrimSpace(o[2])
+		content = content[1:]
+	}
+
+	if substitution != "" {
+		r.substitution(substitution, name, argument, options)
+		return end
+	}
+
+	buf.WriteString(r.flushTargets())
+	if id := options["name"]; id != "" {
+		r.pending = append(r.pending, id)
+		buf.WriteString(r.flushTargets())
+	}
+	r.directive(buf, name, argument, options, content)
+	return end
+}
+
+// directive writes the directive with its argument, options and content
+func (r *rstConverter) directive(buf *bytes.Buffer, name, argument string, options map[string]string,
+	content []string) {
+	if strings.HasPrefix(name, "rst:") || strings.HasPrefix(name, "sphinx:") {
+		name = name[strings.Index(name, ":")+1:]
+	}
+	caption := func() {
+		if title := options["caption"]; title != "" {
+			buf.WriteString("<p><strong>" + r.inline(title) + "</strong></p>\n")
+		}
+	}
+
+	if label, ok := rstAdmonitions[name]; ok || name == "admonition" {
+		body := append([]string{argument}, content...)
+		if name == "admonition" {
+			label = argument
+			body = content
+		}
+		buf.WriteString("<blockquote>\n<p><strong>" + r.inline(label) + "</strong></p>\n" + r.blocks(dedent(body)) +
+			"</blockquote>\n")
+		return
+	}
+
+	switch name {
+	case "code-block", "code", "sourcecode":
+		caption()
+		r.code(buf, argument, content)
+	case "highlight":
+		r.language = argument
+	case "literalinclude", "include":
+		r.includes = append(r.includes, argument)
+	case "math":
+		lines := content
+		if argument != "" {
+			lines = append([]string{argument}, content...)
+		}
+		r.code(buf, "latex", lines)
+	case "raw":
+		if strings.Contains(" "+strings.ToLower(argument)+" ", " html ") {
+			buf.WriteString(strings.Join(content, "\n") + "\n")
+		}
+	case "image":
+		buf.WriteString("<p>" + r.image(argument, options) + "</p>\n")
+	case "figure":
+		buf.WriteString("<figure>\n" + r.image(argument, options) + "\n")
+		if caption := r.blocks(dedent(content)); caption != "" {
+			buf.WriteString("<figcaption>" + strings.TrimSuffix(caption, "\n") + "</figcaption>\n")
+		}
+		buf.WriteString("</figure>\n")
+	case "list-table":
+		if argument != "" {
+			buf.WriteString("<p><strong>" + r.inline(argument) + "</strong></p>\n")
+		}
+		r.listTable(buf, options, dedent(content))
+	case "topic", "sidebar":
+		buf.WriteString("<blockquote>\n<p><strong>" + r.inline(argument) + "</strong></p>\n" +
+			r.blocks(dedent(content)) + "</blockquote>\n")
+	case "rubric":
+		buf.WriteString("<p><strong>" + r.inline(argument) + "</strong></p>\n")
+	case "epigraph", "pull-quote", "highlights", "container", "only":
+		buf.WriteString("<blockquote>\n" + r.blocks(dedent(content)) + "</blockquote>\n")
+	case "versionadded", "versionchanged", "deprecated":
+		label := map[string]string{
+			"versionadded":   "New in version",
+			"versionchanged": "Changed in version",
+			"deprecated":     "Deprecated since version",
+		}[name]
+		buf.WriteString("<p><em>" + escapeHTML(label+" "+argument) + "</em></p>\n")
+		buf.WriteString(r.blocks(dedent(content)))
+	case "contents", "sectnum", "toctree", "index", "meta", "target-notes", "default-role", "role", "title",
+		"tabularcolumns", "currentmodule", "module", "footbibliography":
+		// generated from the rest of the text, or only meaningful with the rest of the documentation
+	default:
+		r.unknown = append(r.unknown, name)
+		buf.WriteString(r.blocks(dedent(content)))
+	}
+}
+
+// image returns the image element for the image directive
+func (r *rstConverter) image(uri string, options map[string]string) string {
+	uri = strings.Join(strings.Fields(uri), "")
+	image := `<img src="` + escapeHTML(uri) + `" alt="` + escapeHTML(options["alt"]) + `"`
+	for _, size := range []string{"width", "height"} {
+		if value := strings.TrimSuffix(options[size], "px"); value != "" {
+			image += " " + size + `="` + escapeHTML(value) + `"`
+		}
+	}
+	image += " />"
+	if target := options["target"]; target != "" {
+		if strings.HasSuffix(target, "_") && !strings.Contains(target, "://") {
+			return rstReference(strings.Trim(strings.TrimSuffix(target, "_"), "`"), image)
+		}
+		return `<a href="` + escapeHTML(target) + `">` + image + "</a>"
+	}
+	return image
+}
+
+// substitution defines the substitution for |name| in the text
+func (r *rstConverter) substitution(name, directive, argument string, options map[string]string) {
+	switch directive {
+	case "replace":
+		r.substitutions[name] = r.inline(argument)
+	case "image":
+		r.substitutions[name] = r.image(argument, options)
+	case "unicode":
+		text := ""
+		for _, code := range strings.Fields(argument) {
+			if code == ".." {
+				break
+			}
+			code = strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(code), "u+"), "0x")
+			if n, err := strconv.ParseInt(code, 16, 32); err == nil {
+				text += string(rune(n))
+			} else {
+				text += code
+			}
+		}
+		r.substitutions[name] = escapeHTML(text)
+	default:
+		r.unknown = append(r.unknown, directive)
+	}
+}
+
+// listTable writes the table in the list-table directive, a list of rows, each a list of cells
+func (r *rstConverter) listTable(buf *bytes.Buffer, options map[string]string, lines []string) {
+	items := func(lines []string) [][]string {
+		var items [][]string
+		for l := 0; l < len(lines); {
+			m := reRSTBullet.FindStringSubmatch(lines[l])
+			if m == nil {
+				l++
+				continue
+			}
+			var item []string
+			item, l = rstItemBlock(lines, l, len(m[0]))
+			items = append(items, item)
+		}
+		return items
+	}
+
+	var rows [][]string
+	for _, row := range items(lines) {
+		var cells []string
+		for _, cell := range items(dedent(row)) {
+			cells = append(cells, r.cell(cell))
+		}
+		rows = append(rows, cells)
+	}
+	head, _ := strconv.Atoi(options["header-rows"])
+	if head > len(rows) {
+		head = len(rows)
+	}
+	r.table(buf, rows, head)
+}
+
+// rstStartBefore returns whether inline markup can start after the character before it
+func rstStartBefore(text string, at int) bool {
+	if at == 0 {
+		return true
+	}
+	c, _ := utf8.DecodeLastRuneInString(text[:at])
+	return unicode.IsSpace(c) || strings.ContainsRune(`-:/'"<([{`, c) || unicode.Is(unicode.Pd, c) ||
+		unicode.Is(unicode.Ps, c) || unicode.Is(unicode.Pi, c)
+}
+
+// rstEndAfter returns whether inline markup can end before the character at
+func rstEndAfter(text string, at int) bool {
+	if at >= len(text) {
+		return true
+	}
+	c, _ := utf8.DecodeRuneInString(text[at:])
+	return unicode.IsSpace(c) || strings.ContainsRune(`-.,:;!?\/'")]}>`, c) || unicode.Is(unicode.Pd, c) ||
+		unicode.Is(unicode.Pe, c) || unicode.Is(unicode.Pf, c)
+}
+
+// rstInlineEnd returns the index of the end string of inline markup whose content starts at from, or -1.  The end
+// of interpreted text can be followed by the underscores of a reference or a role
+func rstInlineEnd(text string, from int, end string) int {
+	for at := from; at < len(text); {
+		n := strings.Index(text[at:], end)
+		if n == -1 {
+			return -1
+		}
+		at += n
+		after := at + len(end)
+		if end == "`" {
+			if m := reRSTRoleSuffix.FindString(text[after:]); m != "" {
+				after += len(m)
+			} else {
+				for n := 0; n < 2 && after < len(text) && text[after] == '_'; n++ {
+					after++
+				}
+			}
+		}
+		if at > from && !unicode.IsSpace(rune(text[at-1])) && text[at-1] != '\\' && rstEndAfter(text, after) {
+			return at
+		}
+		at++
+	}
+	return -1
+}
+
+// inline converts the inline markup in the text
+func (r *rstConverter) inline(text string) string {
+	buf := &bytes.Buffer{}
+	for at := 0; at < len(text); {
+		c := text[at]
+		rest := text[at:]
+		start := rstStartBefore(text, at)
+
+		switch {
+		case c == '\\':
+			if at+1 < len(text) {
+				next, size := utf8.DecodeRuneInString(text[at+1:])
+				if !unicode.IsSpace(next) {
+					buf.WriteString(escapeHTML(string(next)))
+				}
+				at += 1 + size
+			} else {
+				at++
+			}
+			continue
+		case start && strings.HasPrefix(rest, "``") && len(rest) > 2 && rest[2] != ' ':
+			if end := strings.Index(text[at+2:], "``"); end > 0 {
+				buf.WriteString("<code>" + escapeHTML(text[at+2:at+2+end]) + "</code>")
+				at += end + 4
+				continue
+			}
+		case start && strings.HasPrefix(rest, "**") && len(rest) > 2 && rest[2] != ' ':
+			if end := rstInlineEnd(text, at+2, "**"); end != -1 {
+				buf.WriteString("<strong>" + r.unescape(text[at+2:end]) + "</strong>")
+				at = end + 2
+				continue
+			}
+		case start && c == '*' && len(rest) > 1 && rest[1] != ' ' && rest[1] != '*':
+			if end := rstInlineEnd(text, at+1, "*"); end != -1 {
+				buf.WriteString("<em>" + r.unescape(text[at+1:end]) + "</em>")
+				at = end + 1
+				continue
+			}
+		case start && c == ':':
+			if m := reRSTRole.FindStringSubmatch(rest); m != nil {
+				if end := rstInlineEnd(text, at+len(m[0]), "`"); end != -1 {
+					buf.WriteString(r.role(strings.ToLower(m[1]), text[at+len(m[0]):end]))
+					at = end + 1
+					continue
+				}
+			}
+		case start && c == '`' && len(rest) > 1 && rest[1] != ' ':
+			if end := rstInlineEnd(text, at+1, "`"); end != -1 {
+				content := text[at+1 : end]
+				at = end + 1
+				if strings.HasPrefix(text[at:], "__") {
+					at += 2
+					buf.WriteString(r.link(content, true))
+				} else if strings.HasPrefix(text[at:], "_") {
+					at++
+					buf.WriteString(r.link(content, false))
+				} else if m := reRSTRoleSuffix.FindStringSubmatch(text[at:]); m != nil {
+					at += len(m[0])
+					buf.WriteString(r.role(strings.ToLower(m[1]), content))
+				} else {
+					buf.WriteString("<em>" + r.unescape(content) + "</em>")
+				}
+				continue
+			}
+		case start && c == '|':
+			if end := rstInlineEnd(text, at+1, "|"); end != -1 {
+				if s, ok := r.substitutions[text[at+1:end]]; ok {
+					buf.WriteString(s)
+					at = end + 1
+					if strings.HasPrefix(text[at:], "_") {
+						at++
+					}
+					continue
+				}
+			}
+		case start && c == '[':
+			if m := reRSTFootnoteRef.FindStringSubmatch(rest); m != nil && rstEndAfter(text, at+len(m[0])) {
+				label := m[1]
+				if label == "#" {
+					r.footnoteRefs++
+					label = strconv.Itoa(r.footnoteRefs)
+				}
+				label = strings.TrimPrefix(label, "#")
+				buf.WriteString(`<sup><a href="#footnote-` + escapeHTML(rstID(label)) + `">` + escapeHTML(label) +
+					"</a></sup>")
+				at += len(m[0])
+				continue
+			}
+		case start && (c == 'h' || c == 'f' || c == 'm'):
+			if url := reRSTURL.FindString(rest); url != "" {
+				buf.WriteString(`<a href="` + escapeHTML(url) + `">` + escapeHTML(url) + "</a>")
+				at += len(url)
+				continue
+			}
+		}
+
+		if name := reRSTName.FindString(rest); name != "" {
+			if start && strings.HasPrefix(rest[len(name):], "_") {
+				end := at + len(name) + 1
+				anonymous := strings.HasPrefix(text[end:], "_")
+				if anonymous {
+					end++
+				}
+				if rstEndAfter(text, end) {
+					if anonymous {
+						buf.WriteString(escapeHTML(name))
+					} else {
+						buf.WriteString(rstReference(name, escapeHTML(name)))
+					}
+					at = end
+					continue
+				}
+			}
+			// the rest of the word can't start markup
+			buf.WriteString(escapeHTML(name))
+			at += len(name)
+			continue
+		}
+
+		_, size := utf8.DecodeRuneInString(rest)
+		buf.WriteString(escapeHTML(rest[:size]))
+		at += size
+	}
+	return buf.String()
+}
+
+// unescape returns the text of inline markup, without its escapes
+func (r *rstConverter) unescape(text string) string {
+	return escapeHTML(reRSTEscape.ReplaceAllString(text, "$1"))
+}
+
+// rstSplitTarget splits the text of a reference or role like "text <target>" into its text and target.  If there's
+// no explicit target, text is empty
+func rstSplitTarget(content string) (text, target string) {
+	content = strings.TrimSpace(content)
+	open := strings.LastIndex(content, "<")
+	if !strings.HasSuffix(content, ">") || open == -1 || (open > 0 && content[open-1] != ' ') {
+		return "", content
+	}
+	return strings.TrimSpace(content[:open]), strings.Join(strings.Fields(content[open+1:len(content)-1]), "")
+}
+
+// link returns the link for the hyperlink reference
+func (r *rstConverter) link(content string, anonymous bool) string {
+	text, target := rstSplitTarget(content)
+	if text == "" && target != content {
+		// `<url>`_
+		text = target
+	}
+	if text == "" {
+		if anonymous {
+			return r.unescape(content)
+		}
+		return rstReference(content, r.unescape(content))
+	}
+	if strings.HasSuffix(target, "_") && !strings.Contains(target, "://") {
+		return rstReference(strings.TrimSuffix(target, "_"), r.unescape(text))
+	}
+	if !anonymous {
+		r.targets[rstName(text)] = target
+	}
+	return `<a href="` + escapeHTML(target) + `">` + r.unescape(text) + "</a>"
+}
+
+// role returns the interpreted text with the role
+func (r *rstConverter) role(role, content string) string {
+	if element, ok := rstRoleElements[role]; ok {
+		return "<" + element + ">" + r.unescape(content) + "</" + element + ">"
+	}
+	if rstCodeRoles[role] {
+		text, target := rstSplitTarget(content)
+		if text == "" {
+			text = strings.TrimLeft(target, "~!")
+			if strings.HasPrefix(target, "~") {
+				text = text[strings.LastIndex(text, ".")+1:]
+			}
+		}
+		return "<code>" + escapeHTML(text) + "</code>"
+	}
+
+	text, target := rstSplitTarget(content)
+	switch role {
+	case "ref", "std:ref", "numref":
+		return rstReference(target, r.unescape(text))
+	case "doc", "std:doc":
+		r.documents = append(r.documents, target)
+		if text == "" {
+			text = target
+		}
+		return r.unescape(text)
+	case "abbr":
+		if open := strings.Index(content, " ("); open != -1 && strings.HasSuffix(content, ")") {
+			return `<abbr title="` + escapeHTML(content[open+2:len(content)-1]) + `">` +
+				r.unescape(content[:open]) + "</abbr>"
+		}
+	}
+	if text == "" {
+		text = target
+	}
+	return r.unescape(text)
+}
@@ -0,0 +1,277 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"bytes"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+/*
+	Imported HTML is sanitized with an allow list before it's stored in a document.  Only the elements and
+	attributes below are kept, so scripts, styles, event handlers, forms and embedded content are all removed, and
+	links can only use safe URL schemes.  Elements that aren't allowed but whose content is, like <font> or <center>,
+	are replaced by their content.
+
+	The HTML is parsed the same way a browser would parse it, so the sanitized output is always well formed.
+*/
+
+// allowedElements are the elements kept in sanitized HTML, along with the attributes allowed on each
+var allowedElements = map[atom.Atom][]string{
+	atom.A:          {"href", "name"},
+	atom.Abbr:       nil,
+	atom.Article:    nil,
+	atom.Audio:      {"src", "controls"},
+	atom.B:          nil,
+	atom.Blockquote: {"cite"},
+	atom.Br:         nil,
+	atom.Caption:    nil,
+	atom.Cite:       nil,
+	atom.Code:       {"class"},
+	atom.Col:        {"span"},
+	atom.Colgroup:   {"span"},
+	atom.Dd:         nil,
+	atom.Del:        {"cite", "datetime"},
+	atom.Details:    {"open"},
+	atom.Dfn:        nil,
+	atom.Div:        nil,
+	atom.Dl:         nil,
+	atom.Dt:         nil,
+	atom.Em:         nil,
+	atom.Figcaption: nil,
+	atom.Figure:     nil,
+	atom.H1:         nil,
+	atom.H2:         nil,
+	atom.H3:         nil,
+	atom.H4:         nil,
+	atom.H5:         nil,
+	atom.H6:         nil,
+	atom.Hr:         nil,
+	atom.I:          nil,
+	atom.Img:        {"src", "alt", "width", "height"},
+	atom.Input:      {"type", "checked", "disabled"},
+	atom.Ins:        {"cite", "datetime"},
+	atom.Kbd:        nil,
+	atom.Li:         {"value"},
+	atom.Mark:       nil,
+	atom.Ol:         {"start", "type", "reversed"},
+	atom.P:          nil,
+	atom.Pre:        {"class"},
+	atom.Q:          {"cite"},
+	atom.S:          nil,
+	atom.Samp:       nil,
+	atom.Section:    nil,
+	atom.Small:      nil,
+	atom.Source:     {"src", "type"},
+	atom.Span:       nil,
+	atom.Strong:     nil,
+	atom.Sub:        nil,
+	atom.Summary:    nil,
+	atom.Sup:        nil,
+	atom.Table:      nil,
+	atom.Tbody:      nil,
+	atom.Td:         {"align", "colspan", "rowspan"},
+	atom.Tfoot:      nil,
+	atom.Th:         {"align", "colspan", "rowspan", "scope"},
+	atom.Thead:      nil,
+	atom.Time:       {"datetime"},
+	atom.Tr:         nil,
+	atom.U:          nil,
+	atom.Ul:         nil,
+	atom.Var:        nil,
+	atom.Video:      {"src", "controls", "width", "height"},
+}
+
+// globalAttributes are allowed on every allowed element
+var globalAttributes = []string{"id", "title", "lang", "dir"}
+
+// removedElements are removed along with everything in them
+var removedElements = map[atom.Atom]bool{
+	atom.Applet:   true,
+	atom.Button:   true,
+	atom.Embed:    true,
+	atom.Frame:    true,
+	atom.Frameset: true,
+	atom.Head:     true,
+	atom.Iframe:   true,
+	atom.Link:     true,
+	atom.Math:     true,
+	atom.Meta:     true,
+	atom.Noscript: true,
+	atom.Object:   true,
+	atom.Script:   true,
+	atom.Select:   true,
+	atom.Style:    true,
+	atom.Svg:      true,
+	atom.Template: true,
+	atom.Textarea: true,
+	atom.Title:    true,
+}
+
+// voidElements never have content or an end tag
+var voidElements = map[atom.Atom]bool{
+	atom.Br:     true,
+	atom.Col:    true,
+	atom.Hr:     true,
+	atom.Img:    true,
+	atom.Input:  true,
+	atom.Source: true,
+}
+
+// urlAttributes are the attributes that hold URLs, and need a safe scheme
+var urlAttributes = map[string]bool{"href": true, "src": true, "cite": true}
+
+var (
+	reCodeClass  = regexp.MustCompile(`^language-[A-Za-z0-9_+#-]+$`)
+	reDataImage  = regexp.MustCompile(`^data:image/(?:png|gif|jpeg|webp);base64,[A-Za-z0-9+/=]+$`)
+	reURLIgnored = regexp.MustCompile(`[\x00-\x20\x7f]+`)
+)
+
+// sanitizeHTML returns the HTML with everything that isn't on the allow list removed
+func sanitizeHTML(body string) string {
+	nodes, err := html.ParseFragment(strings.NewReader(body), &html.Node{
+		Type:     html.ElementNode,
+		Data:     "body",
+		DataAtom: atom.Body,
+	})
+	if err != nil {
+		// the parser only fails if reading fails, which it can't from a string
+		return escapeHTML(body)
+	}
+
+	buf := &bytes.Buffer{}
+	for _, n := range nodes {
+		sanitizeNode(buf, n)
+	}
+	return buf.String()
+}
+
+func sanitizeNode(buf *bytes.Buffer, n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		buf.WriteString(escapeHTML(n.Data))
+		return
+	case html.DocumentNode:
+		sanitizeChildren(buf, n)
+		return
+	case html.ElementNode:
+	default:
+		// comments and doctypes
+		return
+	}
+
+	if removedElements[n.DataAtom] || n.Namespace != "" {
+		return
+	}
+	allowed, ok := allowedElements[n.DataAtom]
+	if !ok {
+		sanitizeChildren(buf, n)
+		return
+	}
+	if n.DataAtom == atom.Input && attrValue(n, "type") != "checkbox" {
+		// task list checkboxes are the only input allowed
+		return
+	}
+
+	buf.WriteString("<" + n.Data)
+	for _, a := range n.Attr {
+		if a.Namespace != "" || !(stringIn(a.Key, allowed) || stringIn(a.Key, globalAttributes)) {
+			continue
+		}
+		value, ok := sanitizeAttr(n.DataAtom, a.Key, a.Val)
+		if !ok {
+			continue
+		}
+		buf.WriteString(" " + a.Key + `="` + escapeHTML(value) + `"`)
+	}
+	if n.DataAtom == atom.Input && !hasAttr(n, "disabled") {
+		buf.WriteString(` disabled=""`)
+	}
+	if voidElements[n.DataAtom] {
+		buf.WriteString(" />")
+		return
+	}
+	buf.WriteString(">")
+	if n.DataAtom == atom.Pre && n.FirstChild != nil && n.FirstChild.Type == html.TextNode &&
+		strings.HasPrefix(n.FirstChild.Data, "\n") {
+		// the parser drops a newline at the start of a pre, so one needs to be added to keep the one in the text
+		buf.WriteString("\n")
+	}
+	sanitizeChildren(buf, n)
+	buf.WriteString("</" + n.Data + ">")
+}
+
+func sanitizeChildren(buf *bytes.Buffer, n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		sanitizeNode(buf, c)
+	}
+}
+
+// sanitizeAttr returns the value of an allowed attribute, and false if the value isn't safe
+func sanitizeAttr(element atom.Atom, key, value string) (string, bool) {
+	switch {
+	case key == "class":
+		// only the language of code blocks is kept, for syntax highlighting
+		var classes []string
+		for _, class := range strings.Fields(value) {
+			if reCodeClass.MatchString(class) {
+				classes = append(classes, class)
+			}
+		}
+		return strings.Join(classes, " "), len(classes) > 0
+	case key == "type" && element == atom.Input:
+		return value, value == "checkbox"
+	case urlAttributes[key]:
+		return value, safeURL(element, value)
+	}
+	return value, true
+}
+
+// safeURL returns true if the URL is relative, or uses a scheme that can't run script
+func safeURL(element atom.Atom, value string) bool {
+	// browsers ignore whitespace and control characters in URLs, so javascript: can be hidden with them
+	value = reURLIgnored.ReplaceAllString(value, "")
+	u, err := url.Parse(value)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "", "http", "https", "mailto", "ftp":
+		return true
+	case "data":
+		return element == atom.Img && reDataImage.MatchString(value)
+	}
+	return false
+}
+
+func attrValue(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key && a.Namespace == "" {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func hasAttr(n *html.Node, key string) bool {
+	for _, a := range n.Attr {
+		if a.Key == key && a.Namespace == "" {
+			return true
+		}
+	}
+	return false
+}
+
+func stringIn(value string, list []string) bool {
+	for i := range list {
+		if list[i] == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,979 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/lexLibrary/lexLibrary/data"
+)
+
+/*
+	Search finds the published documents a user can read that match a query, see searchQuery.go for the query
+	language.  Words are looked up in the terms kept for every published document in the document_terms table (see
+	tag.go), so a document can be found once it has been tagged in the background.  Phrases are checked against the
+	text of each document that has all of their words.
+
+	Results are scored by TF-IDF, like the tagger scores terms, summed over every word the query looks for, so
+	documents that mention rare words more often rank higher.  Words in a NOT don't add to the score.  Each result
+	has a snippet of its text around the first word that matched, and the tags and authors of every match are
+	counted, so results can be narrowed down further.
+*/
+
+// Search result orders
+const (
+	SearchSortRelevance = "relevance"
+	SearchSortDate      = "date"
+)
+
+const (
+	// searchSnippetWords is the number of words in a result's snippet
+	searchSnippetWords = 30
+	// searchSnippetBefore is the number of words shown before the first match in a snippet
+	searchSnippetBefore = 8
+	// searchFacetLimit is the most tags and authors counted in search results
+	searchFacetLimit = 10
+	// searchBatchSize is the number of documents each query loading the documents, statistics, facets or text of
+	// search results is run for
+	searchBatchSize = 50
+)
+
+// SearchResults are a page of the documents matching a search
+type SearchResults struct {
+	Query   string // the query in its canonical form
+	Total   int    // the number of documents matching the query
+	Results []*SearchResult
+	Tags    []SearchFacet // the tags used most in the matching documents, most used first
+	Authors []SearchFacet // the usernames of the authors of the most matching documents, most first
+}
+
+// SearchResult is a document matching a search
+type SearchResult struct {
+	Document *Document
+	Title    string
+	Snippet  string // HTML, with the words that matched in <mark> elements
+	Score    float64
+}
+
+// SearchFacet is how many of the matching documents have a tag or author
+type SearchFacet struct {
+	Name  string
+	Count int
+}
+
+// sqlSearchIDs restricts a query to a batch of documents, see searchBatches
+var sqlSearchIDs = searchIDArgs()
+
+var (
+	sqlSearchDocuments = data.NewQuery(`
+		select ` + sqlDocumentColumns + ` from documents d
+		where d.tenant_id = {{tenant}} and d.status = 'published' and ` + sqlCanDocument)
+	sqlSearchDocumentBatch = data.NewQuery(`
+		select ` + sqlDocumentColumns + ` from documents d
+		where d.tenant_id = {{tenant}} and d.status = 'published' and d.id in (` + sqlSearchIDs + `)
+		and ` + sqlCanDocument)
+	sqlSearchTerm = data.NewQuery(`
+		select document_id, term, frequency from document_terms
+		where tenant_id = {{tenant}}
+		and (term = {{arg "term"}} or ({{arg "prefix"}} = 1 and (term like {{arg "word"}} or term like {{arg "stem"}})))
+	`)
+	sqlSearchTermTotals = data.NewQuery(`
+		select document_id, sum(frequency) from document_terms
+		where tenant_id = {{tenant}} and document_id in (` + sqlSearchIDs + `)
+		group by document_id
+	`)
+	sqlSearchTag = data.NewQuery(`
+		select dt.document_id from document_tags dt
+		where dt.tenant_id = {{tenant}} and dt.tag = {{arg "tag"}} and dt.rejected = 0
+	`)
+	sqlSearchTags = data.NewQuery(`
+		select dt.document_id, dt.tag from document_tags dt
+		where dt.tenant_id = {{tenant}} and dt.rejected = 0 and dt.document_id in (` + sqlSearchIDs + `)
+	`)
+	sqlSearchAuthor = data.NewQuery(`
+		select distinct r.document_id from document_revisions r
+		join users u on u.tenant_id = r.tenant_id and u.id = r.author
+		where r.tenant_id = {{tenant}} and u.username_key = {{arg "username_key"}}
+	`)
+	sqlSearchAuthors = data.NewQuery(`
+		select distinct r.document_id, u.username from document_revisions r
+		join users u on u.tenant_id = r.tenant_id and u.id = r.author
+		where r.tenant_id = {{tenant}} and r.document_id in (` + sqlSearchIDs + `)
+	`)
+	sqlSearchTexts = data.NewQuery(`
+		select r.document_id, r.title, r.body from document_revisions r
+		join documents d on d.tenant_id = r.tenant_id and d.id = r.document_id and d.published_revision = r.revision
+		where r.tenant_id = {{tenant}} and r.document_id in (` + sqlSearchIDs + `)
+	`)
+)
+
+// Search returns the published documents the user can read that match the query, sorted by relevance or by the
+// date they were last updated
+func Search(who *User, query, sortBy string, offset, limit int) (*SearchResults, error) {
+	if who == nil {
+		return nil, Unauthorized("You must log in")
+	}
+	if sortBy == "" {
+		sortBy = SearchSortRelevance
+	}
+	if sortBy != SearchSortRelevance && sortBy != SearchSortDate {
+		return nil, NewFailure("Search results can only be sorted by relevance or date")
+	}
+	if limit == 0 || limit > maxRows {
+		limit = 10
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	q, err := ParseSearchQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if q.Empty() {
+		return nil, NewFailure("Enter something to search for")
+	}
+
+	s := newSearcher(who)
+	matches, err := s.match(q.root, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	// the index has every published document, so only the documents it matched are checked for the user
+	matches, err = s.readable(matches)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(matches))
+	for id := range matches {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := ids[i], ids[j]
+		if sortBy == SearchSortRelevance && s.scores[a] != s.scores[b] {
+			return s.scores[a] > s.scores[b]
+		}
+		updatedA, updatedB := s.documents[a].Updated, s.documents[b].Updated
+		if !updatedA.Equal(updatedB) {
+			return updatedA.After(updatedB)
+		}
+		return a < b
+	})
+
+	results := &SearchResults{
+		Query: q.String(),
+		Total: len(ids),
+	}
+	tags, err := s.values(sqlSearchTags, ids)
+	if err != nil {
+		return nil, err
+	}
+	results.Tags = searchFacets(ids, tags)
+	authors, err := s.values(sqlSearchAuthors, ids)
+	if err != nil {
+		return nil, err
+	}
+	results.Authors = searchFacets(ids, authors)
+
+	if offset > len(ids) {
+		offset = len(ids)
+	}
+	page := ids[offset:]
+	if len(page) > limit {
+		page = page[:limit]
+	}
+	err = s.loadTexts(page)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range page {
+		text, err := s.text(id)
+		if err != nil {
+			return nil, err
+		}
+		results.Results = append(results.Results, &SearchResult{
+			Document: s.documents[id],
+			Title:    text.title,
+			Snippet:  s.snippet(text.body),
+			Score:    s.scores[id],
+		})
+	}
+	return results, nil
+}
+
+// searcher matches the nodes of a query against the documents a user can read.  Words, tags and authors are
+// looked up in the index, and everything else about the documents is loaded as needed, only for the documents the
+// index matched whenever it can be
+type searcher struct {
+	who    *User
+	scores map[string]float64
+	// highlights are the words the query looks for, to mark in snippets
+	highlights []searchTerm
+
+	// loaded as needed
+	documents map[string]*Document // the published documents the user can read, of those checked
+	checked   searchSet            // the documents checked for the user
+	all       bool                 // whether every document the user can read is loaded
+	corpus    int                  // the number of documents with terms in the tenant, -1 until it's loaded
+	totals    map[string]int       // the sum of the frequencies of each document's terms
+	texts     map[string]*searchText
+}
+
+// searchText is the published text of a document
+type searchText struct {
+	title string
+	body  string
+	words [][]searchSpan // the words of the title and the body
+}
+
+// searchSpan is a word in some text, lower cased, with its position in bytes
+type searchSpan struct {
+	start, end int
+	word       string
+}
+
+// searchSet is the set of ids of the documents matching part of a query
+type searchSet map[string]bool
+
+func newSearcher(who *User) *searcher {
+	return &searcher{
+		who:       who,
+		scores:    make(map[string]float64),
+		documents: make(map[string]*Document),
+		checked:   make(searchSet),
+		corpus:    -1,
+		totals:    make(map[string]int),
+		texts:     make(map[string]*searchText),
+	}
+}
+
+// searchIDArgs returns the args of a batch of document ids, for a query's in clause
+func searchIDArgs() string {
+	args := make([]string, searchBatchSize)
+	for i := range args {
+		args[i] = fmt.Sprintf(`{{arg "id%d"}}`, i)
+	}
+	return strings.Join(args, ", ")
+}
+
+// searchBatches calls fn with the args of each batch of the ids.  The last batch is padded with empty ids, which
+// no document has
+func searchBatches(ids []string, fn func(args []sql.NamedArg) error) error {
+	for start := 0; start < len(ids); start += searchBatchSize {
+		args := make([]sql.NamedArg, searchBatchSize)
+		for i := range args {
+			id := ""
+			if start+i < len(ids) {
+				id = ids[start+i]
+			}
+			args[i] = sql.Named(fmt.Sprintf("id%d", i), id)
+		}
+		err := fn(args)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readable returns the documents in the set that are published and that the user can read
+func (s *searcher) readable(set searchSet) (searchSet, error) {
+	var unchecked []string
+	for id := range set {
+		if !s.all && !s.checked[id] {
+			unchecked = append(unchecked, id)
+		}
+	}
+	sort.Strings(unchecked)
+	err := searchBatches(unchecked, func(args []sql.NamedArg) error {
+		rows, err := sqlSearchDocumentBatch.Tenant(s.who.TenantID).Query(
+			append(canArgs(s.who, PermissionRead), args...)...)
+		if err != nil {
+			return err
+		}
+		return s.addDocuments(rows)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range unchecked {
+		s.checked[id] = true
+	}
+
+	readable := make(searchSet, len(set))
+	for id := range set {
+		if _, ok := s.documents[id]; ok {
+			readable[id] = true
+		}
+	}
+	return readable, nil
+}
+
+// candidates returns the documents in the set the user can read, or every document the user can read if the set
+// is nil
+func (s *searcher) candidates(set searchSet) (searchSet, error) {
+	if set != nil {
+		return s.readable(set)
+	}
+	if !s.all {
+		rows, err := sqlSearchDocuments.Tenant(s.who.TenantID).Query(canArgs(s.who, PermissionRead)...)
+		if err != nil {
+			return nil, err
+		}
+		err = s.addDocuments(rows)
+		if err != nil {
+			return nil, err
+		}
+		s.all = true
+	}
+	all := make(searchSet, len(s.documents))
+	for id := range s.documents {
+		all[id] = true
+	}
+	return all, nil
+}
+
+func (s *searcher) addDocuments(rows *sql.Rows) error {
+	documents, err := scanDocuments(s.who, rows)
+	if err != nil {
+		return err
+	}
+	for _, d := range documents {
+		s.documents[d.ID] = d
+	}
+	return nil
+}
+
+// match returns the documents matching the node.  If within isn't nil, only the documents in it need to be
+// matched, and documents outside of it may or may not be returned.  Words that aren't negated add to the scores of
+// the documents they match
+func (s *searcher) match(node searchNode, negated bool, within searchSet) (searchSet, error) {
+	switch n := node.(type) {
+	case searchTerm:
+		return s.matchTerm(n, negated)
+	case searchPhrase:
+		return s.matchPhrase(n, negated, within)
+	case searchField:
+		return s.matchField(n, within)
+	case searchUpdated:
+		return s.matchUpdated(n, within)
+	case searchNot:
+		set, err := s.candidates(within)
+		if err != nil {
+			return nil, err
+		}
+		not, err := s.match(n.node, !negated, set)
+		if err != nil {
+			return nil, err
+		}
+		for id := range not {
+			delete(set, id)
+		}
+		return set, nil
+	case searchAnd:
+		// the nodes found in the index are matched first, so the rest only have to check the documents they found
+		nodes := make([]searchNode, len(n.nodes))
+		copy(nodes, n.nodes)
+		sort.SliceStable(nodes, func(i, j int) bool { return searchIndexed(nodes[i]) && !searchIndexed(nodes[j]) })
+
+		set := within
+		for _, child := range nodes {
+			matches, err := s.match(child, negated, set)
+			if err != nil {
+				return nil, err
+			}
+			if set == nil {
+				set = matches
+				continue
+			}
+			both := make(searchSet)
+			for id := range set {
+				if matches[id] {
+					both[id] = true
+				}
+			}
+			set = both
+		}
+		return set, nil
+	case searchOr:
+		set := make(searchSet)
+		for _, child := range n.nodes {
+			matches, err := s.match(child, negated, within)
+			if err != nil {
+				return nil, err
+			}
+			for id := range matches {
+				set[id] = true
+			}
+		}
+		return set, nil
+	}
+	return make(searchSet), nil
+}
+
+// searchIndexed returns true if the documents matching the node are found in the index, without checking every
+// document the user can read
+func searchIndexed(node searchNode) bool {
+	switch n := node.(type) {
+	case searchTerm:
+		return true
+	case searchPhrase:
+		for _, word := range n.words {
+			if !isStopword(word) {
+				return true
+			}
+		}
+		return false
+	case searchField:
+		return n.field == searchFieldTag || n.field == searchFieldAuthor
+	case searchAnd:
+		for _, child := range n.nodes {
+			if searchIndexed(child) {
+				return true
+			}
+		}
+		return false
+	case searchOr:
+		for _, child := range n.nodes {
+			if !searchIndexed(child) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// matchTerm returns the documents with the term, or any term starting with it
+func (s *searcher) matchTerm(t searchTerm, negated bool) (searchSet, error) {
+	if !negated {
+		s.highlights = append(s.highlights, t)
+	}
+	scores, err := s.termScores(t)
+	if err != nil {
+		return nil, err
+	}
+	set := make(searchSet, len(scores))
+	for id, score := range scores {
+		set[id] = true
+		if !negated {
+			s.scores[id] += score
+		}
+	}
+	return set, nil
+}
+
+// termScores returns the TF-IDF score of the term in each document that has it
+func (s *searcher) termScores(t searchTerm) (map[string]float64, error) {
+	if s.corpus == -1 {
+		err := sqlTermDocumentCount.Tenant(s.who.TenantID).QueryRow().Scan(&s.corpus)
+		if err != nil {
+			return nil, err
+		}
+	}
+	stem := stemWord(t.word)
+	rows, err := sqlSearchTerm.Tenant(s.who.TenantID).Query(
+		sql.Named("term", stem),
+		sql.Named("prefix", boolInt(t.prefix)),
+		sql.Named("word", t.word+"%"),
+		sql.Named("stem", stem+"%"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type posting struct {
+		documentID string
+		term       string
+		frequency  int
+	}
+	var postings []posting
+	frequencies := make(map[string]int) // the number of documents with each term
+	for rows.Next() {
+		p := posting{}
+		err = rows.Scan(&p.documentID, &p.term, &p.frequency)
+		if err != nil {
+			return nil, err
+		}
+		postings = append(postings, p)
+		frequencies[p.term]++
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	ids := make([]string, 0, len(postings))
+	for _, p := range postings {
+		ids = append(ids, p.documentID)
+	}
+	err = s.loadTotals(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	scores := make(map[string]float64)
+	for _, p := range postings {
+		if s.totals[p.documentID] == 0 {
+			continue
+		}
+		scores[p.documentID] += tfidf(p.frequency, s.totals[p.documentID], frequencies[p.term], s.corpus)
+	}
+	return scores, nil
+}
+
+// loadTotals loads the size of each of the documents that isn't loaded yet, for scoring
+func (s *searcher) loadTotals(ids []string) error {
+	var missing []string
+	for _, id := range ids {
+		if _, ok := s.totals[id]; !ok {
+			// loaded once, even if the document has no terms
+			s.totals[id] = 0
+			missing = append(missing, id)
+		}
+	}
+	return searchBatches(missing, func(args []sql.NamedArg) error {
+		rows, err := sqlSearchTermTotals.Tenant(s.who.TenantID).Query(args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			id := ""
+			total := 0
+			err = rows.Scan(&id, &total)
+			if err != nil {
+				return err
+			}
+			s.totals[id] = total
+		}
+		return rows.Err()
+	})
+}
+
+// matchPhrase returns the documents with the words of the phrase next to each other.  Only the documents the user
+// can read with every word that's in the index are checked, or if none of the words are, the documents the phrase
+// is matched within
+func (s *searcher) matchPhrase(p searchPhrase, negated bool, within searchSet) (searchSet, error) {
+	var candidates searchSet
+	scores := make(map[string]float64)
+	for _, word := range p.words {
+		if isStopword(word) {
+			continue
+		}
+		t := searchTerm{word: word}
+		if !negated {
+			s.highlights = append(s.highlights, t)
+		}
+		termScores, err := s.termScores(t)
+		if err != nil {
+			return nil, err
+		}
+		if candidates == nil {
+			candidates = make(searchSet, len(termScores))
+			for id := range termScores {
+				if within == nil || within[id] {
+					candidates[id] = true
+				}
+			}
+		}
+		for id := range candidates {
+			if _, ok := termScores[id]; !ok {
+				delete(candidates, id)
+			}
+		}
+		for id, score := range termScores {
+			scores[id] += score
+		}
+	}
+	var err error
+	if candidates == nil {
+		candidates = within
+	}
+	candidates, err = s.candidates(candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(candidates))
+	for id := range candidates {
+		ids = append(ids, id)
+	}
+	err = s.loadTexts(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	stems := make([]string, len(p.words))
+	for i := range p.words {
+		stems[i] = stemWord(p.words[i])
+	}
+	set := make(searchSet)
+	for id := range candidates {
+		text, ok := s.texts[id]
+		if !ok {
+			continue
+		}
+		for _, words := range text.words {
+			if searchHasPhrase(words, stems) {
+				set[id] = true
+				if !negated {
+					s.scores[id] += scores[id]
+				}
+				break
+			}
+		}
+	}
+	return set, nil
+}
+
+// searchHasPhrase returns true if the stems of the words include the stems in order
+func searchHasPhrase(words []searchSpan, stems []string) bool {
+	for i := 0; i+len(stems) <= len(words); i++ {
+		found := true
+		for j := range stems {
+			if stemWord(words[i+j].word) != stems[j] {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *searcher) matchField(f searchField, within searchSet) (searchSet, error) {
+	set := make(searchSet)
+	switch f.field {
+	case searchFieldTag:
+		names, err := s.tagNames(f.value)
+		if err != nil {
+			return nil, err
+		}
+		for name := range names {
+			err = s.addIDs(set, sqlSearchTag, sql.Named("tag", name))
+			if err != nil {
+				return nil, err
+			}
+		}
+	case searchFieldAuthor:
+		err := s.addIDs(set, sqlSearchAuthor, sql.Named("username_key", f.value))
+		if err != nil {
+			return nil, err
+		}
+	case searchFieldCollection:
+		collections, err := s.collections(f.value)
+		if err != nil {
+			return nil, err
+		}
+		candidates, err := s.candidates(within)
+		if err != nil {
+			return nil, err
+		}
+		for id := range candidates {
+			if collections[s.documents[id].CollectionID] {
+				set[id] = true
+			}
+		}
+	}
+	return set, nil
+}
+
+// addIDs adds the document ids the query returns to the set
+func (s *searcher) addIDs(set searchSet, query *data.Query, args ...sql.NamedArg) error {
+	rows, err := query.Tenant(s.who.TenantID).Query(args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		id := ""
+		err = rows.Scan(&id)
+		if err != nil {
+			return err
+		}
+		set[id] = true
+	}
+	return rows.Err()
+}
+
+// tagNames returns the name of the tag, following synonyms, along with the names of every tag nested under it
+func (s *searcher) tagNames(name string) (map[string]bool, error) {
+	name, err := resolveTag(nil, s.who.TenantID, name)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{name: true}
+	row, err := getTagRow(nil, s.who.TenantID, name)
+	if err != nil || row == nil {
+		return names, err
+	}
+	descendants, err := queryTagRows(sqlTagRowDescendants.Tenant(s.who.TenantID).Query(
+		sql.Named("path", row.path+"%"),
+		sql.Named("id", row.id),
+	))
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range descendants {
+		names[d.name] = true
+	}
+	return names, nil
+}
+
+// collections returns the ids of the collections the user can read with the id or name, and the collections
+// nested in them
+func (s *searcher) collections(value string) (map[string]bool, error) {
+	all, err := CollectionList(s.who)
+	if err != nil {
+		return nil, err
+	}
+	children := make(map[string][]string)
+	var matches []string
+	for _, c := range all {
+		children[c.ParentID] = append(children[c.ParentID], c.ID)
+		if c.ID == value || strings.ToLower(strings.Join(strings.Fields(c.Name), " ")) == value {
+			matches = append(matches, c.ID)
+		}
+	}
+
+	ids := make(map[string]bool)
+	for len(matches) > 0 {
+		id := matches[0]
+		matches = matches[1:]
+		if ids[id] {
+			continue
+		}
+		ids[id] = true
+		matches = append(matches, children[id]...)
+	}
+	return ids, nil
+}
+
+// matchUpdated returns the documents last updated before, after or on the day, in UTC
+func (s *searcher) matchUpdated(u searchUpdated, within searchSet) (searchSet, error) {
+	candidates, err := s.candidates(within)
+	if err != nil {
+		return nil, err
+	}
+	day := u.date
+	next := day.AddDate(0, 0, 1)
+	set := make(searchSet)
+	for id := range candidates {
+		updated := s.documents[id].Updated.UTC()
+		var match bool
+		switch u.op {
+		case ">":
+			match = !updated.Before(next)
+		case ">=":
+			match = !updated.Before(day)
+		case "<":
+			match = updated.Before(day)
+		case "<=":
+			match = updated.Before(next)
+		default:
+			match = !updated.Before(day) && updated.Before(next)
+		}
+		if match {
+			set[id] = true
+		}
+	}
+	return set, nil
+}
+
+// values returns the values the query returns for each of the documents, like their tags or authors
+func (s *searcher) values(query *data.Query, ids []string) (map[string][]string, error) {
+	values := make(map[string][]string)
+	err := searchBatches(ids, func(args []sql.NamedArg) error {
+		rows, err := query.Tenant(s.who.TenantID).Query(args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			id, value := "", ""
+			err = rows.Scan(&id, &value)
+			if err != nil {
+				return err
+			}
+			values[id] = append(values[id], value)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// searchFacets counts the values of the documents, most common first
+func searchFacets(ids []string, values map[string][]string) []SearchFacet {
+	if len(ids) == 0 {
+		return nil
+	}
+	counts := make(map[string]int)
+	for _, id := range ids {
+		for _, value := range values[id] {
+			counts[value]++
+		}
+	}
+
+	facets := make([]SearchFacet, 0, len(counts))
+	for name, count := range counts {
+		facets = append(facets, SearchFacet{Name: name, Count: count})
+	}
+	sort.Slice(facets, func(i, j int) bool {
+		if facets[i].Count != facets[j].Count {
+			return facets[i].Count > facets[j].Count
+		}
+		return facets[i].Name < facets[j].Name
+	})
+	if len(facets) > searchFacetLimit {
+		facets = facets[:searchFacetLimit]
+	}
+	return facets
+}
+
+// loadTexts loads the published title and text of each of the documents that isn't loaded yet
+func (s *searcher) loadTexts(ids []string) error {
+	var missing []string
+	for _, id := range ids {
+		if _, ok := s.texts[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	sort.Strings(missing)
+	return searchBatches(missing, func(args []sql.NamedArg) error {
+		rows, err := sqlSearchTexts.Tenant(s.who.TenantID).Query(args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			id := ""
+			text := &searchText{}
+			var body data.EncryptedText
+			err = rows.Scan(&id, &text.title, &body)
+			if err != nil {
+				return err
+			}
+			text.body = htmlToText(string(body))
+			text.words = [][]searchSpan{searchSpans(text.title), searchSpans(text.body)}
+			s.texts[id] = text
+		}
+		return rows.Err()
+	})
+}
+
+// text returns the published title and text of a document loaded by loadTexts
+func (s *searcher) text(id string) (*searchText, error) {
+	text, ok := s.texts[id]
+	if !ok {
+		return nil, NotFound("Revision not found")
+	}
+	return text, nil
+}
+
+// searchSpans returns the words in the text.  Like textWords, numbers on their own aren't words
+func searchSpans(text string) []searchSpan {
+	var spans []searchSpan
+	start := -1
+	letter := false
+	end := func(i int) {
+		if start != -1 && letter {
+			spans = append(spans, searchSpan{start: start, end: i, word: strings.ToLower(text[start:i])})
+		}
+		start = -1
+		letter = false
+	}
+	for i, r := range text {
+		if !unicode.IsLetter(r) && !unicode.IsNumber(r) {
+			end(i)
+			continue
+		}
+		if start == -1 {
+			start = i
+		}
+		letter = letter || unicode.IsLetter(r)
+	}
+	end(len(text))
+	return spans
+}
+
+// highlighted returns true if the word is one the query looks for
+func (s *searcher) highlighted(word string) bool {
+	stem := ""
+	for _, t := range s.highlights {
+		if t.prefix && strings.HasPrefix(word, t.word) {
+			return true
+		}
+		if stem == "" {
+			stem = stemWord(word)
+		}
+		if stem == stemWord(t.word) {
+			return true
+		}
+	}
+	return false
+}
+
+// snippet returns the words of the text around the first word the query looks for, as HTML with the words the
+// query looks for marked
+func (s *searcher) snippet(text string) string {
+	spans := searchSpans(text)
+	if len(spans) == 0 {
+		return ""
+	}
+	first := 0
+	for i := range spans {
+		if s.highlighted(spans[i].word) {
+			first = i
+			break
+		}
+	}
+	start := first - searchSnippetBefore
+	if start < 0 {
+		start = 0
+	}
+	end := start + searchSnippetWords
+	if end > len(spans) {
+		end = len(spans)
+		start = end - searchSnippetWords
+		if start < 0 {
+			start = 0
+		}
+	}
+
+	var parts []string
+	if start > 0 {
+		parts = append(parts, "… ")
+	}
+	pos := spans[start].start
+	for _, span := range spans[start:end] {
+		parts = append(parts, escapeHTML(text[pos:span.start]))
+		word := escapeHTML(text[span.start:span.end])
+		if s.highlighted(span.word) {
+			word = "<mark>" + word + "</mark>"
+		}
+		parts = append(parts, word)
+		pos = span.end
+	}
+	if end < len(spans) {
+		parts = append(parts, " …")
+	} else {
+		parts = append(parts, escapeHTML(text[pos:]))
+	}
+	return strings.Join(strings.Fields(strings.Join(parts, "")), " ")
+}
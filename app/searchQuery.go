@@ -0,0 +1,443 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"strings"
+	"time"
+	"unicode"
+)
+
+/*
+	Search queries are made up of words, which are matched against the terms of each document (see terms.go), so
+	"publishing" finds documents that mention "published".  Words next to each other must all match, and the
+	query language adds:
+
+		"quick fox"			a phrase: the words next to each other, in order
+		fox OR dog			either matches
+		fox AND dog			both match, the same as fox dog
+		NOT dog, -dog			doesn't match
+		(fox OR dog) cat		parentheses group
+		pub*				any word starting with pub
+		tag:kubernetes			has the tag, or any tag nested under it
+		author:bob			has a revision written by the user
+		collection:"User Guides"	in the collection, by name or id, or any collection nested in it
+		updated:>2017-01-01		updated after the day, also >=, < and <=, or on the day with no operator
+
+	Operators are upper case, so "and" on its own is just a word.  Words that are too common to search for, like
+	"the", are ignored unless they're part of a phrase.  Queries never fail to parse, except for an invalid date,
+	so anything a user types finds something: unbalanced quotes and parentheses are closed at the end of the query.
+
+	A parsed query prints in a canonical form, which parses to the same query.
+*/
+
+// Search fields
+const (
+	searchFieldTag        = "tag"
+	searchFieldAuthor     = "author"
+	searchFieldCollection = "collection"
+	searchFieldUpdated    = "updated"
+)
+
+const searchDateFormat = "2006-01-02"
+
+// SearchQuery is a parsed search query
+type SearchQuery struct {
+	root searchNode // nil if there is nothing to search for
+}
+
+// searchNode is a part of a parsed query
+type searchNode interface {
+	String() string
+}
+
+// searchTerm matches a single word, or any word starting with it if prefix is true
+type searchTerm struct {
+	word   string
+	prefix bool
+}
+
+// searchPhrase matches words next to each other, in order
+type searchPhrase struct {
+	words []string
+}
+
+// searchField matches documents by their tags, authors or collection
+type searchField struct {
+	field string
+	value string
+}
+
+// searchUpdated matches documents by the day they were last updated
+type searchUpdated struct {
+	op   string // one of >, >=, <, <=, or empty for the day itself
+	date time.Time
+}
+
+type searchAnd struct {
+	nodes []searchNode
+}
+
+type searchOr struct {
+	nodes []searchNode
+}
+
+type searchNot struct {
+	node searchNode
+}
+
+// ParseSearchQuery parses a query written in the search query language
+func ParseSearchQuery(query string) (*SearchQuery, error) {
+	p := &searchParser{tokens: lexSearchQuery(query)}
+	var nodes []searchNode
+	for !p.done() {
+		node, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		nodes = appendSearchNode(nodes, node, true)
+		// a close without an open is ignored
+		if p.peek().kind == searchTokenClose {
+			p.next()
+		}
+	}
+	return &SearchQuery{root: searchAndOf(nodes)}, nil
+}
+
+// String returns the query in its canonical form
+func (q *SearchQuery) String() string {
+	if q.root == nil {
+		return ""
+	}
+	return q.root.String()
+}
+
+// Empty returns true if there is nothing in the query to search for
+func (q *SearchQuery) Empty() bool {
+	return q.root == nil
+}
+
+type searchTokenKind int
+
+const (
+	searchTokenEnd searchTokenKind = iota
+	searchTokenWord
+	searchTokenPhrase
+	searchTokenField
+	searchTokenOpen
+	searchTokenClose
+	searchTokenAnd
+	searchTokenOr
+	searchTokenNot
+)
+
+type searchToken struct {
+	kind  searchTokenKind
+	text  string // the word, phrase, or field value
+	field string
+}
+
+// lexSearchQuery splits the query into tokens
+func lexSearchQuery(query string) []searchToken {
+	var tokens []searchToken
+	runes := []rune(query)
+	i := 0
+	// quoted reads a quoted string starting after the opening quote, up to the closing quote or the end
+	quoted := func() string {
+		start := i
+		for i < len(runes) && runes[i] != '"' {
+			i++
+		}
+		text := string(runes[start:i])
+		i++
+		return text
+	}
+	for i < len(runes) {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, searchToken{kind: searchTokenOpen})
+			i++
+		case r == ')':
+			tokens = append(tokens, searchToken{kind: searchTokenClose})
+			i++
+		case r == '"':
+			i++
+			tokens = append(tokens, searchToken{kind: searchTokenPhrase, text: quoted()})
+		case r == '-' && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]):
+			tokens = append(tokens, searchToken{kind: searchTokenNot})
+			i++
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune(`()"`, runes[i]) {
+				i++
+			}
+			word := string(runes[start:i])
+
+			switch word {
+			case "AND":
+				tokens = append(tokens, searchToken{kind: searchTokenAnd})
+				continue
+			case "OR":
+				tokens = append(tokens, searchToken{kind: searchTokenOr})
+				continue
+			case "NOT":
+				tokens = append(tokens, searchToken{kind: searchTokenNot})
+				continue
+			}
+
+			if colon := strings.IndexRune(word, ':'); colon != -1 {
+				field := strings.ToLower(word[:colon])
+				switch field {
+				case searchFieldTag, searchFieldAuthor, searchFieldCollection, searchFieldUpdated:
+					value := word[colon+1:]
+					if value == "" && i < len(runes) && runes[i] == '"' {
+						i++
+						value = quoted()
+					}
+					tokens = append(tokens, searchToken{kind: searchTokenField, field: field, text: value})
+					continue
+				}
+			}
+			tokens = append(tokens, searchToken{kind: searchTokenWord, text: word})
+		}
+	}
+	return tokens
+}
+
+// searchParser is a recursive descent parser over the query's tokens.  AND binds tighter than OR, and NOT
+// tighter than both
+type searchParser struct {
+	tokens []searchToken
+	pos    int
+}
+
+func (p *searchParser) peek() searchToken {
+	if p.pos >= len(p.tokens) {
+		return searchToken{kind: searchTokenEnd}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *searchParser) next() searchToken {
+	t := p.peek()
+	if p.pos < len(p.tokens) {
+		p.pos++
+	}
+	return t
+}
+
+func (p *searchParser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+// or parses and groups separated by OR, up to a close or the end
+func (p *searchParser) or() (searchNode, error) {
+	var nodes []searchNode
+	for {
+		node, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		nodes = appendSearchNode(nodes, node, false)
+		if p.peek().kind != searchTokenOr {
+			break
+		}
+		p.next()
+	}
+	switch len(nodes) {
+	case 0:
+		return nil, nil
+	case 1:
+		return nodes[0], nil
+	}
+	return searchOr{nodes: nodes}, nil
+}
+
+// and parses everything up to an OR, a close or the end
+func (p *searchParser) and() (searchNode, error) {
+	var nodes []searchNode
+	for {
+		switch p.peek().kind {
+		case searchTokenEnd, searchTokenOr, searchTokenClose:
+			return searchAndOf(nodes), nil
+		case searchTokenAnd:
+			p.next()
+			continue
+		}
+		node, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		nodes = appendSearchNode(nodes, node, true)
+	}
+}
+
+func (p *searchParser) unary() (searchNode, error) {
+	t := p.next()
+	switch t.kind {
+	case searchTokenNot:
+		switch p.peek().kind {
+		case searchTokenEnd, searchTokenOr, searchTokenClose, searchTokenAnd:
+			// nothing to negate
+			return nil, nil
+		}
+		node, err := p.unary()
+		if err != nil || node == nil {
+			return nil, err
+		}
+		if not, ok := node.(searchNot); ok {
+			return not.node, nil
+		}
+		return searchNot{node: node}, nil
+	case searchTokenOpen:
+		node, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek().kind == searchTokenClose {
+			p.next()
+		}
+		return node, nil
+	case searchTokenPhrase:
+		return searchWords(textWords(t.text), false), nil
+	case searchTokenField:
+		return newSearchField(t.field, t.text)
+	}
+
+	return searchWords(textWords(t.text), strings.HasSuffix(t.text, "*")), nil
+}
+
+// searchWords returns the node matching the words.  A single word is a term, and more than one is a phrase
+func searchWords(words []string, prefix bool) searchNode {
+	switch len(words) {
+	case 0:
+		return nil
+	case 1:
+		if !prefix && isStopword(words[0]) {
+			// too common to be in the index
+			return nil
+		}
+		return searchTerm{word: words[0], prefix: prefix}
+	}
+	return searchPhrase{words: words}
+}
+
+func newSearchField(field, value string) (searchNode, error) {
+	switch field {
+	case searchFieldTag:
+		value = normalizeTag(value)
+	case searchFieldAuthor:
+		value = userKey(strings.TrimSpace(value))
+	case searchFieldCollection:
+		value = strings.ToLower(strings.Join(strings.Fields(value), " "))
+	case searchFieldUpdated:
+		return newSearchUpdated(value)
+	}
+	// a value can't be quoted if it has quotes in it, and normalizing can turn other characters into quotes or
+	// spaces
+	value = strings.Join(strings.Fields(strings.Replace(value, `"`, "", -1)), " ")
+	if value == "" {
+		return nil, nil
+	}
+	return searchField{field: field, value: value}, nil
+}
+
+func newSearchUpdated(value string) (searchNode, error) {
+	if value == "" {
+		return nil, nil
+	}
+	op := ""
+	for _, o := range []string{">=", "<=", ">", "<"} {
+		if strings.HasPrefix(value, o) {
+			op = o
+			break
+		}
+	}
+	date, err := time.Parse(searchDateFormat, strings.TrimSpace(value[len(op):]))
+	if err != nil {
+		return nil, NewFailure("Invalid date in updated:" + value + ", dates are written as YYYY-MM-DD")
+	}
+	return searchUpdated{op: op, date: date}, nil
+}
+
+// appendSearchNode adds the node to the list, skipping empty nodes.  If and is true, the nodes of a nested AND
+// are added to the list, and otherwise the nodes of a nested OR are
+func appendSearchNode(nodes []searchNode, node searchNode, and bool) []searchNode {
+	switch n := node.(type) {
+	case nil:
+		return nodes
+	case searchAnd:
+		if and {
+			return append(nodes, n.nodes...)
+		}
+	case searchOr:
+		if !and {
+			return append(nodes, n.nodes...)
+		}
+	}
+	return append(nodes, node)
+}
+
+func searchAndOf(nodes []searchNode) searchNode {
+	switch len(nodes) {
+	case 0:
+		return nil
+	case 1:
+		return nodes[0]
+	}
+	return searchAnd{nodes: nodes}
+}
+
+func (t searchTerm) String() string {
+	if t.prefix {
+		return t.word + "*"
+	}
+	return t.word
+}
+
+func (p searchPhrase) String() string {
+	return `"` + strings.Join(p.words, " ") + `"`
+}
+
+func (f searchField) String() string {
+	if strings.IndexFunc(f.value, func(r rune) bool {
+		return unicode.IsSpace(r) || strings.ContainsRune(`()"`, r)
+	}) != -1 {
+		return f.field + `:"` + f.value + `"`
+	}
+	return f.field + ":" + f.value
+}
+
+func (u searchUpdated) String() string {
+	return searchFieldUpdated + ":" + u.op + u.date.Format(searchDateFormat)
+}
+
+func (a searchAnd) String() string {
+	parts := make([]string, len(a.nodes))
+	for i := range a.nodes {
+		parts[i] = a.nodes[i].String()
+		if _, ok := a.nodes[i].(searchOr); ok {
+			parts[i] = "(" + parts[i] + ")"
+		}
+	}
+	return strings.Join(parts, " AND ")
+}
+
+func (o searchOr) String() string {
+	parts := make([]string, len(o.nodes))
+	for i := range o.nodes {
+		parts[i] = o.nodes[i].String()
+	}
+	return strings.Join(parts, " OR ")
+}
+
+func (n searchNot) String() string {
+	switch n.node.(type) {
+	case searchAnd, searchOr:
+		return "NOT (" + n.node.String() + ")"
+	}
+	return "NOT " + n.node.String()
+}
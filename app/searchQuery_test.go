@@ -0,0 +1,192 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app_test
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+
+	"github.com/lexLibrary/lexLibrary/app"
+)
+
+// searchQueryInput is a random search query, made from the pieces of the query language so the properties are
+// checked against queries that use it, and not just random text
+type searchQueryInput string
+
+var searchQueryPieces = []string{
+	"fox", "Quick", "dog", "the", "and", "pub*", "a*", "snake_case", "e-mail", "2017", "v2", "Überweisung", "日本語",
+	"AND", "OR", "NOT", "-", "(", ")", `"`, `"quick fox"`, `"the"`, "*", ":", "tag:", "tag:Kubernetes",
+	`tag:"Getting Started"`, "author:Bob", `author:"b o b"`, "collection:", "collection:Guides", "unknown:field",
+	"updated:2017-01-01", "updated:>2017-01-01", "updated:<=2017-12-31", "updated:>=", "updated:yesterday",
+}
+
+var searchQuerySpaces = []string{"", " ", "  ", "\t", "\n"}
+
+func (searchQueryInput) Generate(rand *rand.Rand, size int) reflect.Value {
+	var parts []string
+	for i := rand.Intn(size + 1); i > 0; i-- {
+		if rand.Intn(10) == 0 {
+			// random text, which can be anything
+			value, _ := quick.Value(reflect.TypeOf(""), rand)
+			parts = append(parts, value.String())
+		} else {
+			parts = append(parts, searchQueryPieces[rand.Intn(len(searchQueryPieces))])
+		}
+		parts = append(parts, searchQuerySpaces[rand.Intn(len(searchQuerySpaces))])
+	}
+	return reflect.ValueOf(searchQueryInput(strings.Join(parts, "")))
+}
+
+func TestSearchQuery(t *testing.T) {
+	t.Run("Examples", func(t *testing.T) {
+		tests := []struct {
+			query     string
+			canonical string
+		}{
+			{"quick fox", "quick AND fox"},
+			{"quick AND fox", "quick AND fox"},
+			{`"Quick   Fox"`, `"quick fox"`},
+			{`"fox"`, "fox"},
+			{"fox OR dog cat", "fox OR dog AND cat"},
+			{"(fox OR dog) cat", "(fox OR dog) AND cat"},
+			{"(fox OR dog) OR cat", "fox OR dog OR cat"},
+			{"-dog fox", "NOT dog AND fox"},
+			{"NOT NOT dog", "dog"},
+			{"NOT (fox dog)", "NOT (fox AND dog)"},
+			{"NOT", ""},
+			{"pub*", "pub*"},
+			{"snake_case", `"snake case"`},
+			{`Tag:"Getting   Started"`, `tag:"getting started"`},
+			{"tag:Kubernetes", "tag:kubernetes"},
+			{"tag:\"dog \uFE7E\"", "tag:\"dog \u0652\""},
+			{"author:Bob", "author:bob"},
+			{`collection:"User Guides"`, `collection:"user guides"`},
+			{"updated:>2017-01-01", "updated:>2017-01-01"},
+			{"updated:2017-01-01", "updated:2017-01-01"},
+			{"unknown:field", `"unknown field"`},
+			{"the and of", ""},
+			{"2017", ""},
+			{"((fox", "fox"},
+			{"fox)) dog", "fox AND dog"},
+			{"fox OR", "fox"},
+			{`"quick fox`, `"quick fox"`},
+		}
+		for _, test := range tests {
+			q, err := app.ParseSearchQuery(test.query)
+			if err != nil {
+				t.Fatalf("Error parsing %q: %s", test.query, err)
+			}
+			if q.String() != test.canonical {
+				t.Fatalf("Invalid canonical form of %q. Wanted %q got %q", test.query, test.canonical, q.String())
+			}
+			if q.Empty() != (test.canonical == "") {
+				t.Fatalf("Invalid empty query %q", test.query)
+			}
+		}
+	})
+
+	t.Run("Invalid Date", func(t *testing.T) {
+		for _, query := range []string{"updated:yesterday", "updated:>2017-13-01", "updated:=2017-01-01"} {
+			_, err := app.ParseSearchQuery(query)
+			if !app.IsFail(err) {
+				t.Fatalf("Parsing %q didn't fail: %v", query, err)
+			}
+		}
+	})
+
+	// parse returns the canonical form of the query, and false if the query failed for any reason other than a
+	// failure that can be shown to the user
+	parse := func(query string) (string, bool) {
+		q, err := app.ParseSearchQuery(query)
+		if err != nil {
+			return "", app.IsFail(err)
+		}
+		return q.String(), true
+	}
+
+	// canonical checks that the query parses, and its canonical form parses to the same query
+	canonical := func(query string) bool {
+		c, ok := parse(query)
+		if !ok {
+			return false
+		}
+		if c == "" {
+			return true
+		}
+		again, ok := parse(c)
+		if !ok || again != c {
+			t.Logf("Canonical form of %q is %q, which parses to %q", query, c, again)
+			return false
+		}
+		return true
+	}
+
+	config := &quick.Config{MaxCount: 2000}
+
+	t.Run("Canonical", func(t *testing.T) {
+		err := quick.Check(func(query searchQueryInput) bool {
+			return canonical(string(query))
+		}, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Random Text", func(t *testing.T) {
+		err := quick.Check(canonical, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Grouping", func(t *testing.T) {
+		err := quick.Check(func(query searchQueryInput) bool {
+			c, ok := parse(string(query))
+			if !ok || c == "" {
+				return ok
+			}
+			grouped, ok := parse("(" + c + ")")
+			return ok && grouped == c
+		}, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Double Negation", func(t *testing.T) {
+		err := quick.Check(func(query searchQueryInput) bool {
+			c, ok := parse(string(query))
+			if !ok || c == "" {
+				return ok
+			}
+			negated, ok := parse("NOT (NOT (" + c + "))")
+			return ok && negated == c
+		}, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Conjunction", func(t *testing.T) {
+		// two queries next to each other are both required, whatever they contain
+		err := quick.Check(func(a, b searchQueryInput) bool {
+			ca, ok := parse(string(a))
+			if !ok || ca == "" {
+				return ok
+			}
+			cb, ok := parse(string(b))
+			if !ok || cb == "" {
+				return ok
+			}
+			both, ok := parse("(" + ca + ") (" + cb + ")")
+			expected, _ := parse("(" + ca + ") AND (" + cb + ")")
+			return ok && both == expected && strings.Contains(both, " AND ")
+		}, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,366 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app_test
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/lexLibrary/lexLibrary/app"
+)
+
+func TestSearch(t *testing.T) {
+	resetDocuments(t)
+
+	tenant, err := app.TenantNew(installAdmin(t), "Search Tenant", "", "")
+	if err != nil {
+		t.Fatalf("Error creating tenant: %s", err)
+	}
+	author := testUser(t, tenant, "author")
+	other := testUser(t, tenant, "other")
+	reader := testUser(t, tenant, "reader")
+
+	guides, err := app.CollectionNew(author, "Guides")
+	if err != nil {
+		t.Fatalf("Error creating collection: %s", err)
+	}
+	setup, err := guides.NewChild("Setup")
+	if err != nil {
+		t.Fatalf("Error creating collection: %s", err)
+	}
+	for _, c := range []*app.Collection{guides, setup} {
+		err = app.Grant(author, c, reader, app.PermissionRead)
+		if err != nil {
+			t.Fatalf("Error granting permission: %s", err)
+		}
+	}
+
+	publish := func(collection *app.Collection, title, body string, readers ...app.Principal) *app.Document {
+		doc, err := app.DocumentNew(author, collection, title, body)
+		if err != nil {
+			t.Fatalf("Error creating document: %s", err)
+		}
+		err = doc.Publish(0)
+		if err != nil {
+			t.Fatalf("Error publishing document: %s", err)
+		}
+		for _, r := range readers {
+			err = doc.Grant(r, app.PermissionRead)
+			if err != nil {
+				t.Fatalf("Error granting permission: %s", err)
+			}
+		}
+		return doc
+	}
+
+	publish(setup, "Deploying Kubernetes Clusters",
+		"<p>Kubernetes clusters are deployed with the same tooling, and upgraded together.</p>")
+	publish(nil, "Baking Sourdough Bread", `<p>The quick brown fox watches the sourdough bread rise.  The fox likes
+		a warm fox den, and 2 &lt; 3.</p>`, reader)
+	tomatoes := publish(nil, "Planting Tomatoes", "<p>A brown quick fox ran through the tomatoes.</p>", reader)
+	publish(nil, "Secret Kubernetes Plans", "<p>Nobody else can read about these kubernetes plans.</p>")
+	_, err = app.DocumentNew(author, nil, "Kubernetes Draft", "<p>Kubernetes isn't published yet.</p>")
+	if err != nil {
+		t.Fatalf("Error creating document: %s", err)
+	}
+
+	// another author edits the tomatoes, so they are updated last
+	err = tomatoes.Grant(other, app.PermissionEdit)
+	if err != nil {
+		t.Fatalf("Error granting permission: %s", err)
+	}
+	otherTomatoes, err := app.DocumentGet(other, tomatoes.ID)
+	if err != nil {
+		t.Fatalf("Error getting document: %s", err)
+	}
+	draft, err := otherTomatoes.Edit()
+	if err != nil {
+		t.Fatalf("Error starting draft: %s", err)
+	}
+	err = draft.Update("Planting Tomatoes", `<p>A brown quick fox ran through the tomatoes.</p>
+		<p>Water the tomatoes every morning.</p>`)
+	if err != nil {
+		t.Fatalf("Error updating draft: %s", err)
+	}
+	_, err = draft.Save()
+	if err != nil {
+		t.Fatalf("Error saving draft: %s", err)
+	}
+	tomatoes, err = app.DocumentGet(author, tomatoes.ID)
+	if err != nil {
+		t.Fatalf("Error getting document: %s", err)
+	}
+	err = tomatoes.Publish(0)
+	if err != nil {
+		t.Fatalf("Error publishing document: %s", err)
+	}
+
+	err = tomatoes.AddTag("tomatoes")
+	if err != nil {
+		t.Fatalf("Error adding tag: %s", err)
+	}
+	tag, err := app.TagGet(author, "tomatoes")
+	if err != nil {
+		t.Fatalf("Error getting tag: %s", err)
+	}
+	err = tag.SetParent("gardening")
+	if err != nil {
+		t.Fatalf("Error setting tag parent: %s", err)
+	}
+	err = tag.AddSynonym("love apples")
+	if err != nil {
+		t.Fatalf("Error adding synonym: %s", err)
+	}
+
+	_, err = app.TagPending()
+	if err != nil {
+		t.Fatalf("Error indexing documents: %s", err)
+	}
+
+	search := func(who *app.User, query, sortBy string) *app.SearchResults {
+		results, err := app.Search(who, query, sortBy, 0, 100)
+		if err != nil {
+			t.Fatalf("Error searching for %q: %s", query, err)
+		}
+		return results
+	}
+
+	// found returns the titles of the documents found, in order
+	found := func(results *app.SearchResults) []string {
+		list := make([]string, 0, len(results.Results))
+		for _, r := range results.Results {
+			list = append(list, r.Title)
+		}
+		return list
+	}
+
+	expect := func(who *app.User, query string, expected ...string) {
+		got := found(search(who, query, app.SearchSortRelevance))
+		sort.Strings(got)
+		sort.Strings(expected)
+		if strings.Join(got, "|") != strings.Join(expected, "|") {
+			t.Fatalf("Invalid results for %q. Wanted %v got %v", query, expected, got)
+		}
+	}
+
+	t.Run("Words", func(t *testing.T) {
+		expect(reader, "kubernetes", "Deploying Kubernetes Clusters")
+		expect(reader, "deploy clusters", "Deploying Kubernetes Clusters")
+		expect(reader, "tomato", "Planting Tomatoes")
+		expect(reader, "giraffe")
+		expect(reader, "morning", "Planting Tomatoes")
+	})
+
+	t.Run("Permissions", func(t *testing.T) {
+		expect(author, "kubernetes", "Deploying Kubernetes Clusters", "Secret Kubernetes Plans")
+		expect(other, "kubernetes")
+		expect(reader, "NOT giraffe", "Deploying Kubernetes Clusters", "Baking Sourdough Bread", "Planting Tomatoes")
+
+		_, err := app.Search(nil, "kubernetes", "", 0, 10)
+		if !app.IsFailType(err, app.FailUnauthorized) {
+			t.Fatalf("Searching without a user didn't fail: %v", err)
+		}
+	})
+
+	t.Run("Phrases", func(t *testing.T) {
+		expect(reader, `"quick brown fox"`, "Baking Sourdough Bread")
+		expect(reader, `"brown quick fox"`, "Planting Tomatoes")
+		expect(reader, "quick brown fox", "Baking Sourdough Bread", "Planting Tomatoes")
+		expect(reader, `"through the tomatoes"`, "Planting Tomatoes")
+		expect(reader, `"the tomatoes through"`)
+		// phrases of words too common to be in the index
+		expect(reader, `"through the"`, "Planting Tomatoes")
+		expect(reader, `fox "through the"`, "Planting Tomatoes")
+		expect(reader, `fox NOT "through the"`, "Baking Sourdough Bread")
+	})
+
+	t.Run("Boolean", func(t *testing.T) {
+		expect(reader, "fox NOT tomatoes", "Baking Sourdough Bread")
+		expect(reader, "-tomatoes fox", "Baking Sourdough Bread")
+		expect(reader, "kubernetes OR sourdough", "Deploying Kubernetes Clusters", "Baking Sourdough Bread")
+		expect(reader, "fox AND kubernetes")
+		expect(reader, "(kubernetes OR bread) NOT sourdough", "Deploying Kubernetes Clusters")
+	})
+
+	t.Run("Prefix", func(t *testing.T) {
+		expect(reader, "sourd*", "Baking Sourdough Bread")
+		expect(reader, "kube* OR tomat*", "Deploying Kubernetes Clusters", "Planting Tomatoes")
+		expect(reader, "deploying*", "Deploying Kubernetes Clusters")
+	})
+
+	t.Run("Fields", func(t *testing.T) {
+		expect(reader, "tag:tomatoes", "Planting Tomatoes")
+		expect(reader, "tag:gardening", "Planting Tomatoes")
+		expect(reader, `tag:"Love  Apples"`, "Planting Tomatoes")
+		expect(reader, "author:other", "Planting Tomatoes")
+		expect(reader, "author:Author fox", "Baking Sourdough Bread", "Planting Tomatoes")
+		expect(reader, "author:nobody")
+		expect(reader, "collection:guides", "Deploying Kubernetes Clusters")
+		expect(reader, "collection:"+setup.ID, "Deploying Kubernetes Clusters")
+		expect(reader, "fox collection:guides")
+
+		today := time.Now().UTC().Format("2006-01-02")
+		expect(reader, "updated:"+today, "Deploying Kubernetes Clusters", "Baking Sourdough Bread",
+			"Planting Tomatoes")
+		expect(reader, "updated:>2000-01-01 sourdough", "Baking Sourdough Bread")
+		expect(reader, "updated:<2000-01-01")
+		expect(reader, "updated:<="+today+" bread", "Baking Sourdough Bread")
+		expect(reader, "updated:>"+today)
+	})
+
+	t.Run("Sort", func(t *testing.T) {
+		// the fox is mentioned more in the bread, but the tomatoes were updated last
+		got := strings.Join(found(search(reader, "fox", app.SearchSortRelevance)), "|")
+		if got != "Baking Sourdough Bread|Planting Tomatoes" {
+			t.Fatalf("Invalid relevance order: %s", got)
+		}
+		got = strings.Join(found(search(reader, "fox", app.SearchSortDate)), "|")
+		if got != "Planting Tomatoes|Baking Sourdough Bread" {
+			t.Fatalf("Invalid date order: %s", got)
+		}
+
+		_, err := app.Search(reader, "fox", "title", 0, 10)
+		if !app.IsFail(err) {
+			t.Fatalf("Sorting by an invalid order didn't fail: %v", err)
+		}
+	})
+
+	t.Run("Snippets", func(t *testing.T) {
+		results := search(reader, "fox rise", app.SearchSortRelevance)
+		if len(results.Results) != 1 {
+			t.Fatalf("Invalid results: %v", found(results))
+		}
+		expected := "The quick brown <mark>fox</mark> watches the sourdough bread <mark>rise</mark>. The " +
+			"<mark>fox</mark> likes a warm <mark>fox</mark> den, and 2 &lt; 3."
+		if results.Results[0].Snippet != expected {
+			t.Fatalf("Invalid snippet. Wanted %s got %s", expected, results.Results[0].Snippet)
+		}
+		if results.Results[0].Score <= 0 {
+			t.Fatalf("Result wasn't scored: %v", results.Results[0].Score)
+		}
+
+		results = search(reader, "tag:gardening", app.SearchSortRelevance)
+		expected = "A brown quick fox ran through the tomatoes. Water the tomatoes every morning."
+		if results.Results[0].Snippet != expected {
+			t.Fatalf("Invalid snippet. Wanted %s got %s", expected, results.Results[0].Snippet)
+		}
+	})
+
+	t.Run("Facets", func(t *testing.T) {
+		results := search(reader, "fox", app.SearchSortRelevance)
+		expected := []app.SearchFacet{{Name: "author", Count: 2}, {Name: "other", Count: 1}}
+		if len(results.Authors) != len(expected) || results.Authors[0] != expected[0] ||
+			results.Authors[1] != expected[1] {
+			t.Fatalf("Invalid author facets. Wanted %v got %v", expected, results.Authors)
+		}
+		found := false
+		for _, facet := range results.Tags {
+			if facet == (app.SearchFacet{Name: "tomatoes", Count: 1}) {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("Tag facets are missing the tomatoes tag: %v", results.Tags)
+		}
+	})
+
+	t.Run("Paging", func(t *testing.T) {
+		results, err := app.Search(reader, "fox", app.SearchSortDate, 1, 1)
+		if err != nil {
+			t.Fatalf("Error searching: %s", err)
+		}
+		if results.Total != 2 || len(results.Results) != 1 || results.Results[0].Title != "Baking Sourdough Bread" {
+			t.Fatalf("Invalid page of results: %d %v", results.Total, found(results))
+		}
+		if results.Query != "fox" {
+			t.Fatalf("Invalid canonical query: %s", results.Query)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, query := range []string{"", "   ", "the", "updated:yesterday"} {
+			_, err := app.Search(reader, query, "", 0, 10)
+			if !app.IsFail(err) {
+				t.Fatalf("Searching for %q didn't fail: %v", query, err)
+			}
+		}
+	})
+
+	t.Run("Properties", func(t *testing.T) {
+		words := []string{"fox", "kubernetes", "bread", "tomatoes", "quick", "sourdough", "plans", "giraffe",
+			"author:other", "tag:gardening", "collection:guides", `"brown fox"`}
+		ids := func(query string) map[string]bool {
+			set := make(map[string]bool)
+			for _, r := range search(reader, query, app.SearchSortRelevance).Results {
+				set[r.Document.ID] = true
+				if r.Title == "Secret Kubernetes Plans" {
+					t.Fatalf("Search for %q found a document the user can't read", query)
+				}
+			}
+			return set
+		}
+		equal := func(a, b map[string]bool) bool {
+			if len(a) != len(b) {
+				return false
+			}
+			for id := range a {
+				if !b[id] {
+					return false
+				}
+			}
+			return true
+		}
+
+		err := quick.Check(func(i, j uint8) bool {
+			a, b := words[int(i)%len(words)], words[int(j)%len(words)]
+			both, either, onlyA := ids(a+" "+b), ids(a+" OR "+b), ids(a)
+			for id := range both {
+				if !onlyA[id] {
+					return false
+				}
+			}
+			for id := range onlyA {
+				if !either[id] {
+					return false
+				}
+			}
+			return equal(ids("NOT ("+a+" OR "+b+")"), ids("NOT "+a+" NOT "+b)) &&
+				equal(ids("NOT ("+a+" "+b+")"), ids("NOT "+a+" OR NOT "+b)) &&
+				equal(ids(b+" "+a), both)
+		}, &quick.Config{MaxCount: 50})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Many", func(t *testing.T) {
+		// more results than are loaded at once
+		const count = 120
+		for i := 0; i < count; i++ {
+			publish(nil, fmt.Sprintf("Zebra %d", i), "<p>Zebras have stripes.</p>", reader)
+		}
+		for {
+			n, err := app.TagPending()
+			if err != nil {
+				t.Fatalf("Error indexing documents: %s", err)
+			}
+			if n == 0 {
+				break
+			}
+		}
+		results, err := app.Search(reader, "zebra NOT giraffe", app.SearchSortRelevance, 100, 10)
+		if err != nil {
+			t.Fatalf("Error searching: %s", err)
+		}
+		if results.Total != count || len(results.Results) != 10 || results.Results[0].Snippet == "" {
+			t.Fatalf("Invalid results: %d %v", results.Total, found(results))
+		}
+		if len(results.Authors) != 1 || results.Authors[0] != (app.SearchFacet{Name: "author", Count: count}) {
+			t.Fatalf("Invalid author facets: %v", results.Authors)
+		}
+	})
+}
@@ -0,0 +1,285 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	"github.com/lexLibrary/lexLibrary/data"
+)
+
+/*
+	Sessions keep a user logged in between requests.  The session token handed to the client is never stored, only
+	its SHA-256 hash, so the contents of the sessions table can't be used to take over a session.
+
+	A session expires after SessionIdleMinutes without being used, and after SessionMaxDays no matter how often
+	it's used.  Expired sessions are removed by SessionCleanup.
+*/
+
+// sessionTouchInterval is how often a session's last access is written, so that every request doesn't need a write
+const sessionTouchInterval = time.Minute
+
+// Session is a logged in user's session
+type Session struct {
+	ID          string
+	TenantID    string
+	UserID      string
+	UserAgent   string
+	IPAddress   string
+	Created     time.Time
+	Accessed    time.Time
+	IdleExpires time.Time
+	Expires     time.Time
+
+	// Token is the secret value the client uses to identify the session.  It is only set when the session is created
+	Token string
+}
+
+var (
+	sqlSessionInsert = data.NewQuery(`
+		insert into sessions (tenant_id, id, token, user_id, user_agent, ip_address, created, accessed, idle_expires,
+			expires)
+		values ({{tenant}}, {{arg "id"}}, {{arg "token"}}, {{arg "user_id"}}, {{arg "user_agent"}},
+			{{arg "ip_address"}}, {{arg "created"}}, {{arg "accessed"}}, {{arg "idle_expires"}}, {{arg "expires"}})
+	`)
+	sqlSessionColumns = `id, tenant_id, user_id, user_agent, ip_address, created, accessed, idle_expires, expires`
+	sqlSessionGet     = data.NewQuery(`
+		select ` + sqlSessionColumns + ` from sessions where tenant_id = {{tenant}} and token = {{arg "token"}}
+	`)
+	sqlSessionTouch = data.NewQuery(`
+		update sessions set accessed = {{arg "accessed"}}, idle_expires = {{arg "idle_expires"}}
+		where tenant_id = {{tenant}} and id = {{arg "id"}}
+	`)
+	sqlSessionDelete = data.NewQuery(`
+		delete from sessions where tenant_id = {{tenant}} and id = {{arg "id"}}
+	`)
+	sqlSessionDeleteUserSession = data.NewQuery(`
+		delete from sessions where tenant_id = {{tenant}} and id = {{arg "id"}} and user_id = {{arg "user_id"}}
+	`)
+	sqlSessionDeleteUser = data.NewQuery(`
+		delete from sessions where tenant_id = {{tenant}} and user_id = {{arg "user_id"}}
+	`)
+	sqlSessionList = data.NewQuery(`
+		select ` + sqlSessionColumns + ` from sessions
+		where tenant_id = {{tenant}} and user_id = {{arg "user_id"}}
+		and idle_expires > {{arg "now"}} and expires > {{arg "now"}}
+		order by accessed desc
+	`)
+	sqlSessionDeleteExpired = data.NewQuery(`
+		delete from sessions
+		where tenant_id = {{tenant}} and (idle_expires <= {{arg "now"}} or expires <= {{arg "now"}})
+	`)
+)
+
+// SessionNew starts a new session for the user
+func SessionNew(tenant *Tenant, user *User, userAgent, ipAddress string) (*Session, error) {
+	if user.Disabled || user.Locked {
+		return nil, Unauthorized("This account can't log in")
+	}
+
+	token := make([]byte, 32)
+	_, err := rand.Read(token)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	s := &Session{
+		ID:          newID(),
+		TenantID:    tenant.ID,
+		UserID:      user.ID,
+		UserAgent:   userAgent,
+		IPAddress:   ipAddress,
+		Created:     now,
+		Accessed:    now,
+		IdleExpires: now.Add(sessionIdle(tenant)),
+		Expires:     now.AddDate(0, 0, tenant.settingInt("SessionMaxDays")),
+		Token:       base64.RawURLEncoding.EncodeToString(token),
+	}
+
+	_, err = sqlSessionInsert.Tenant(s.TenantID).Exec(
+		sql.Named("id", s.ID),
+		sql.Named("token", hashSessionToken(s.Token)),
+		sql.Named("user_id", s.UserID),
+		sql.Named("user_agent", nullString(s.UserAgent)),
+		sql.Named("ip_address", nullString(s.IPAddress)),
+		sql.Named("created", s.Created),
+		sql.Named("accessed", s.Accessed),
+		sql.Named("idle_expires", s.IdleExpires),
+		sql.Named("expires", s.Expires),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SessionGet returns the unexpired session for the token, and extends its idle expiration
+func SessionGet(tenant *Tenant, token string) (*Session, error) {
+	if token == "" {
+		return nil, Unauthorized("You must log in")
+	}
+
+	s, err := scanSession(sqlSessionGet.Tenant(tenant.ID).QueryRow(
+		sql.Named("token", hashSessionToken(token))))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if s.expired(now) {
+		return nil, Unauthorized("Your session has expired.  Please log in again")
+	}
+
+	if now.Sub(s.Accessed) > sessionTouchInterval {
+		s.Accessed = now
+		s.IdleExpires = now.Add(sessionIdle(tenant))
+		_, err = sqlSessionTouch.Tenant(s.TenantID).Exec(
+			sql.Named("id", s.ID),
+			sql.Named("accessed", s.Accessed),
+			sql.Named("idle_expires", s.IdleExpires),
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func scanSession(row scanner) (*Session, error) {
+	s := &Session{}
+	var userAgent, ipAddress sql.NullString
+	err := row.Scan(
+		&s.ID,
+		&s.TenantID,
+		&s.UserID,
+		&userAgent,
+		&ipAddress,
+		&s.Created,
+		&s.Accessed,
+		&s.IdleExpires,
+		&s.Expires,
+	)
+	if err == sql.ErrNoRows {
+		return nil, Unauthorized("You must log in")
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.UserAgent = userAgent.String
+	s.IPAddress = ipAddress.String
+	return s, nil
+}
+
+func (s *Session) expired(now time.Time) bool {
+	return !now.Before(s.IdleExpires) || !now.Before(s.Expires)
+}
+
+// User returns the session's user.  If the user can no longer log in, the session is ended
+func (s *Session) User() (*User, error) {
+	u, _, err := userGet(nil, s.TenantID, s.UserID)
+	if IsFailType(err, FailNotFound) {
+		return nil, s.expire()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if u.Disabled || u.Locked {
+		return nil, s.expire()
+	}
+	return u, nil
+}
+
+func (s *Session) expire() error {
+	err := s.Logout()
+	if err != nil {
+		return err
+	}
+	return Unauthorized("Your session has expired.  Please log in again")
+}
+
+// Logout ends the session
+func (s *Session) Logout() error {
+	_, err := sqlSessionDelete.Tenant(s.TenantID).Exec(sql.Named("id", s.ID))
+	return err
+}
+
+// Sessions returns the user's active sessions, most recently used first
+func (u *User) Sessions() ([]*Session, error) {
+	rows, err := sqlSessionList.Tenant(u.TenantID).Query(
+		sql.Named("user_id", u.ID),
+		sql.Named("now", time.Now()),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*Session
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// LogoutSession ends one of the user's sessions
+func (u *User) LogoutSession(id string) error {
+	result, err := sqlSessionDeleteUserSession.Tenant(u.TenantID).Exec(
+		sql.Named("id", id),
+		sql.Named("user_id", u.ID),
+	)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return NotFound("Session not found")
+	}
+	return nil
+}
+
+// LogoutEverywhere ends all of the user's sessions
+func (u *User) LogoutEverywhere() error {
+	_, err := sqlSessionDeleteUser.Tenant(u.TenantID).Exec(sql.Named("user_id", u.ID))
+	return err
+}
+
+// SessionCleanup removes all expired sessions from every tenant, and returns how many were removed
+func SessionCleanup() (int, error) {
+	count := 0
+	now := time.Now()
+	err := EachTenant(func(t *Tenant) error {
+		result, err := sqlSessionDeleteExpired.Tenant(t.ID).Exec(sql.Named("now", now))
+		if err != nil {
+			return err
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		count += int(rows)
+		return nil
+	})
+	return count, err
+}
+
+func sessionIdle(tenant *Tenant) time.Duration {
+	return time.Duration(tenant.settingInt("SessionIdleMinutes")) * time.Minute
+}
+
+func hashSessionToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
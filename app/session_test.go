@@ -0,0 +1,201 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app_test
+
+import (
+	"testing"
+
+	"github.com/lexLibrary/lexLibrary/app"
+	"github.com/lexLibrary/lexLibrary/data"
+)
+
+func TestSession(t *testing.T) {
+	resetUsers(t)
+	_, err := data.NewQuery("delete from sessions").Exec()
+	if err != nil {
+		t.Fatalf("Error emptying sessions table before running tests: %s", err)
+	}
+
+	tenant, err := app.TenantNew(installAdmin(t), "Session Tenant", "", "")
+	if err != nil {
+		t.Fatalf("Error creating tenant: %s", err)
+	}
+	user, err := app.UserNew(tenant, "sessionuser", "session password")
+	if err != nil {
+		t.Fatalf("Error creating user: %s", err)
+	}
+
+	t.Run("New", func(t *testing.T) {
+		s, err := app.SessionNew(tenant, user, "test agent", "127.0.0.1")
+		if err != nil {
+			t.Fatalf("Error creating session: %s", err)
+		}
+		if s.Token == "" || !s.Expires.After(s.IdleExpires) {
+			t.Fatalf("Invalid new session: %+v", s)
+		}
+
+		got, err := app.SessionGet(tenant, s.Token)
+		if err != nil {
+			t.Fatalf("Error getting session: %s", err)
+		}
+		if got.ID != s.ID || got.UserAgent != "test agent" || got.IPAddress != "127.0.0.1" || got.Token != "" {
+			t.Fatalf("Invalid session retrieved: %+v", got)
+		}
+
+		u, err := got.User()
+		if err != nil {
+			t.Fatalf("Error getting session user: %s", err)
+		}
+		if u.ID != user.ID {
+			t.Fatalf("Invalid session user: %+v", u)
+		}
+
+		_, err = app.SessionGet(tenant, s.Token+"x")
+		if !app.IsFailType(err, app.FailUnauthorized) {
+			t.Fatalf("Expected unauthorized for an invalid token, got %v", err)
+		}
+
+		def, err := app.DefaultTenant()
+		if err != nil {
+			t.Fatalf("Error getting default tenant: %s", err)
+		}
+		_, err = app.SessionGet(def, s.Token)
+		if !app.IsFailType(err, app.FailUnauthorized) {
+			t.Fatalf("Session was valid for another tenant: %v", err)
+		}
+
+		err = got.Logout()
+		if err != nil {
+			t.Fatalf("Error logging out: %s", err)
+		}
+		_, err = app.SessionGet(tenant, s.Token)
+		if !app.IsFailType(err, app.FailUnauthorized) {
+			t.Fatalf("Expected unauthorized after logging out, got %v", err)
+		}
+	})
+
+	t.Run("Logout Everywhere", func(t *testing.T) {
+		one, err := app.SessionNew(tenant, user, "agent one", "10.0.0.1")
+		if err != nil {
+			t.Fatalf("Error creating session: %s", err)
+		}
+		two, err := app.SessionNew(tenant, user, "agent two", "10.0.0.2")
+		if err != nil {
+			t.Fatalf("Error creating session: %s", err)
+		}
+
+		sessions, err := user.Sessions()
+		if err != nil {
+			t.Fatalf("Error listing sessions: %s", err)
+		}
+		if len(sessions) != 2 {
+			t.Fatalf("Invalid number of sessions. Wanted %d got %d", 2, len(sessions))
+		}
+
+		err = user.LogoutSession(one.ID)
+		if err != nil {
+			t.Fatalf("Error logging out session: %s", err)
+		}
+		err = user.LogoutSession(one.ID)
+		if !app.IsFailType(err, app.FailNotFound) {
+			t.Fatalf("Expected not found logging out an ended session, got %v", err)
+		}
+
+		_, err = app.SessionNew(tenant, user, "agent three", "10.0.0.3")
+		if err != nil {
+			t.Fatalf("Error creating session: %s", err)
+		}
+
+		err = user.LogoutEverywhere()
+		if err != nil {
+			t.Fatalf("Error logging out everywhere: %s", err)
+		}
+		sessions, err = user.Sessions()
+		if err != nil {
+			t.Fatalf("Error listing sessions: %s", err)
+		}
+		if len(sessions) != 0 {
+			t.Fatalf("Sessions remained after logging out everywhere: %d", len(sessions))
+		}
+		_, err = app.SessionGet(tenant, two.Token)
+		if !app.IsFailType(err, app.FailUnauthorized) {
+			t.Fatalf("Expected unauthorized after logging out everywhere, got %v", err)
+		}
+	})
+
+	t.Run("Disabled User", func(t *testing.T) {
+		s, err := app.SessionNew(tenant, user, "agent", "10.0.0.1")
+		if err != nil {
+			t.Fatalf("Error creating session: %s", err)
+		}
+		err = user.Disable(user)
+		if err != nil {
+			t.Fatalf("Error disabling user: %s", err)
+		}
+		_, err = app.SessionGet(tenant, s.Token)
+		if !app.IsFailType(err, app.FailUnauthorized) {
+			t.Fatalf("Expected disabling the user to end their sessions, got %v", err)
+		}
+		_, err = app.SessionNew(tenant, user, "agent", "10.0.0.1")
+		if !app.IsFailType(err, app.FailUnauthorized) {
+			t.Fatalf("Expected unauthorized starting a session for a disabled user, got %v", err)
+		}
+		err = user.Enable(user)
+		if err != nil {
+			t.Fatalf("Error enabling user: %s", err)
+		}
+	})
+
+	t.Run("Expiration", func(t *testing.T) {
+		err := tenant.SetSetting(user, "SessionIdleMinutes", "0")
+		if err != nil {
+			t.Fatalf("Error setting idle minutes: %s", err)
+		}
+		idle, err := app.SessionNew(tenant, user, "idle", "10.0.0.1")
+		if err != nil {
+			t.Fatalf("Error creating session: %s", err)
+		}
+		err = tenant.ResetSetting(user, "SessionIdleMinutes")
+		if err != nil {
+			t.Fatalf("Error resetting setting: %s", err)
+		}
+
+		err = tenant.SetSetting(user, "SessionMaxDays", "0")
+		if err != nil {
+			t.Fatalf("Error setting max days: %s", err)
+		}
+		absolute, err := app.SessionNew(tenant, user, "absolute", "10.0.0.1")
+		if err != nil {
+			t.Fatalf("Error creating session: %s", err)
+		}
+		err = tenant.ResetSetting(user, "SessionMaxDays")
+		if err != nil {
+			t.Fatalf("Error resetting setting: %s", err)
+		}
+
+		active, err := app.SessionNew(tenant, user, "active", "10.0.0.1")
+		if err != nil {
+			t.Fatalf("Error creating session: %s", err)
+		}
+
+		for _, s := range []*app.Session{idle, absolute} {
+			_, err = app.SessionGet(tenant, s.Token)
+			if !app.IsFailType(err, app.FailUnauthorized) {
+				t.Fatalf("Expected unauthorized for an expired %s session, got %v", s.UserAgent, err)
+			}
+		}
+
+		count, err := app.SessionCleanup()
+		if err != nil {
+			t.Fatalf("Error cleaning up sessions: %s", err)
+		}
+		if count != 2 {
+			t.Fatalf("Invalid number of expired sessions removed. Wanted %d got %d", 2, count)
+		}
+
+		_, err = app.SessionGet(tenant, active.Token)
+		if err != nil {
+			t.Fatalf("Cleanup removed an active session: %s", err)
+		}
+	})
+}
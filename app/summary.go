@@ -0,0 +1,322 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"database/sql"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/lexLibrary/lexLibrary/data"
+)
+
+/*
+	Every revision of a document has a short summary made of the sentences that best represent it.  Sentences are
+	ranked with TextRank: each sentence is a node in a graph, connected to every other sentence by how many terms
+	they share, and the sentences that are most similar to the rest of the document rank highest, the same way
+	PageRank ranks the pages with the most links.  The best sentences are returned in the order they appear.
+
+	Summaries are generated without any outside service, and the same text always gives the same summary.  Authors
+	can replace a revision's generated summary with their own, and restoring a revision keeps its summary.
+*/
+
+const (
+	// summaryDamping is the chance of following an edge in the sentence graph, as in PageRank
+	summaryDamping = 0.85
+	// summaryIterations is the most iterations of ranking done before giving up on converging
+	summaryIterations = 100
+	// summaryTolerance is the change in rank below which ranking has converged
+	summaryTolerance = 1e-6
+	// maxSummaryInput is the most sentences ranked, longer documents are summarized from their first sentences
+	maxSummaryInput = 500
+	// minSummaryWords is the fewest words a sentence needs to be used in a summary, so headings and captions
+	// are skipped if there are better sentences
+	minSummaryWords = 4
+	// maxSummaryLength is the longest summary an author can write, in characters
+	maxSummaryLength = 2000
+)
+
+var sqlRevisionSetSummary = data.NewQuery(`
+	update document_revisions set summary = {{arg "summary"}}, summary_manual = {{arg "summary_manual"}}
+	where tenant_id = {{tenant}} and document_id = {{arg "document_id"}} and revision = {{arg "revision"}}
+`)
+
+// abbreviations are the words that are followed by a period but don't end a sentence
+var abbreviations = map[string]bool{
+	"mr": true, "mrs": true, "ms": true, "dr": true, "prof": true, "rev": true, "gen": true, "sen": true,
+	"rep": true, "st": true, "mt": true, "jr": true, "sr": true, "vs": true, "cf": true, "fig": true, "no": true,
+	"vol": true, "approx": true, "dept": true, "e.g": true, "i.e": true, "a.m": true, "p.m": true, "u.s": true,
+	"jan": true, "feb": true, "mar": true, "apr": true, "jun": true, "jul": true, "aug": true, "sep": true,
+	"sept": true, "oct": true, "nov": true, "dec": true,
+}
+
+// SetSummary replaces the generated summary of a revision with one written by the author.  An empty summary
+// goes back to the generated summary
+func (d *Document) SetSummary(revision int, summary string) error {
+	err := Can(d.who, PermissionEdit, d)
+	if err != nil {
+		return err
+	}
+	if d.Status == DocumentStatusArchived {
+		return NewFailure("An archived document can't be edited")
+	}
+	summary = strings.Join(strings.Fields(summary), " ")
+	if utf8.RuneCountInString(summary) > maxSummaryLength {
+		return NewFailure("A summary can't be longer than 2000 characters")
+	}
+
+	manual := summary != ""
+	if !manual {
+		r, err := d.revision(nil, revision)
+		if err != nil {
+			return err
+		}
+		summary, err = revisionSummary(d.TenantID, r.Body)
+		if err != nil {
+			return err
+		}
+	}
+
+	result, err := sqlRevisionSetSummary.Tenant(d.TenantID).Exec(
+		sql.Named("document_id", d.ID),
+		sql.Named("revision", revision),
+		sql.Named("summary", data.EncryptedText(summary)),
+		sql.Named("summary_manual", boolInt(manual)),
+	)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return NotFound("Revision not found")
+	}
+	return nil
+}
+
+// revisionSummary returns the generated summary of a revision's body, with the tenant's summary length
+func revisionSummary(tenantID, body string) (string, error) {
+	t, err := TenantGet(tenantID)
+	if err != nil {
+		return "", err
+	}
+	return summarize(body, t.settingInt("SummarySentences")), nil
+}
+
+// summarize returns the most representative sentences of the HTML body, in the order they appear
+func summarize(body string, sentences int) string {
+	if sentences <= 0 {
+		return ""
+	}
+
+	var all []string
+	for _, line := range strings.Split(htmlToText(body), "\n") {
+		all = append(all, splitSentences(line)...)
+	}
+	if len(all) > maxSummaryInput {
+		all = all[:maxSummaryInput]
+	}
+
+	// prefer full sentences over headings, but fall back to whatever there is
+	var candidates []int
+	for i := range all {
+		if len(strings.Fields(all[i])) >= minSummaryWords {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		for i := range all {
+			candidates = append(candidates, i)
+		}
+	}
+
+	if len(candidates) > sentences {
+		terms := make([][]string, len(candidates))
+		for i, c := range candidates {
+			terms[i] = sentenceTerms(all[c])
+		}
+		ranks := textRank(terms)
+
+		best := make([]int, len(candidates))
+		for i := range best {
+			best[i] = i
+		}
+		// ties go to the earlier sentence
+		sort.SliceStable(best, func(i, j int) bool {
+			return ranks[best[i]] > ranks[best[j]]
+		})
+		best = best[:sentences]
+		sort.Ints(best)
+
+		chosen := make([]int, len(best))
+		for i := range best {
+			chosen[i] = candidates[best[i]]
+		}
+		candidates = chosen
+	}
+
+	summary := make([]string, len(candidates))
+	for i, c := range candidates {
+		summary[i] = all[c]
+	}
+	return strings.Join(summary, " ")
+}
+
+// sentenceTerms returns the distinct stemmed terms of the sentence, sorted
+func sentenceTerms(sentence string) []string {
+	seen := make(map[string]bool)
+	var terms []string
+	for _, word := range textWords(sentence) {
+		if isStopword(word) {
+			continue
+		}
+		stem := stemWord(word)
+		if !seen[stem] {
+			seen[stem] = true
+			terms = append(terms, stem)
+		}
+	}
+	sort.Strings(terms)
+	return terms
+}
+
+// similarity is the number of terms shared by two sentences, normalized by their lengths so long sentences
+// aren't favored just for being long
+func similarity(a, b []string) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	shared := 0
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			shared++
+			i++
+			j++
+		case a[i] < b[j]:
+			i++
+		default:
+			j++
+		}
+	}
+	if shared == 0 {
+		return 0
+	}
+	return float64(shared) / (math.Log(float64(len(a)+1)) + math.Log(float64(len(b)+1)))
+}
+
+// textRank ranks the sentences by running PageRank over the graph of their similarities
+func textRank(terms [][]string) []float64 {
+	n := len(terms)
+	weights := make([][]float64, n)
+	totals := make([]float64, n)
+	for i := range weights {
+		weights[i] = make([]float64, n)
+	}
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			w := similarity(terms[i], terms[j])
+			weights[i][j] = w
+			weights[j][i] = w
+			totals[i] += w
+			totals[j] += w
+		}
+	}
+
+	ranks := make([]float64, n)
+	for i := range ranks {
+		ranks[i] = 1
+	}
+	next := make([]float64, n)
+	for iteration := 0; iteration < summaryIterations; iteration++ {
+		change := 0.0
+		for i := 0; i < n; i++ {
+			sum := 0.0
+			for j := 0; j < n; j++ {
+				if weights[j][i] != 0 {
+					sum += weights[j][i] / totals[j] * ranks[j]
+				}
+			}
+			next[i] = (1 - summaryDamping) + summaryDamping*sum
+			change += math.Abs(next[i] - ranks[i])
+		}
+		ranks, next = next, ranks
+		if change < summaryTolerance {
+			break
+		}
+	}
+	return ranks
+}
+
+// splitSentences splits a line of text into sentences.  A sentence ends with a period, question mark, or
+// exclamation point followed by a space, unless the period ends an abbreviation or someone's initial
+func splitSentences(line string) []string {
+	var sentences []string
+	start := 0
+	for i := 0; i < len(line); i++ {
+		if !sentenceEnd(line[i]) {
+			continue
+		}
+
+		end := i + 1
+		// include repeated punctuation, and any closing quotes or brackets
+		for end < len(line) && (sentenceEnd(line[end]) || strings.IndexByte(`"')]`, line[end]) != -1) {
+			end++
+		}
+		r, _ := utf8.DecodeRuneInString(line[end:])
+		for r == '”' || r == '’' {
+			end += utf8.RuneLen(r)
+			r, _ = utf8.DecodeRuneInString(line[end:])
+		}
+		if end < len(line) && !unicode.IsSpace(r) {
+			continue
+		}
+		if line[i] == '.' && !periodEndsSentence(line[start:i], line[end:]) {
+			continue
+		}
+
+		if sentence := strings.TrimSpace(line[start:end]); sentence != "" {
+			sentences = append(sentences, sentence)
+		}
+		start = end
+		i = end - 1
+	}
+
+	if sentence := strings.TrimSpace(line[start:]); sentence != "" {
+		sentences = append(sentences, sentence)
+	}
+	return sentences
+}
+
+func sentenceEnd(b byte) bool {
+	return b == '.' || b == '?' || b == '!'
+}
+
+// periodEndsSentence returns true if a period after the text before it ends the sentence, based on the word before
+// the period and the text after it
+func periodEndsSentence(before, after string) bool {
+	fields := strings.Fields(before)
+	if len(fields) == 0 {
+		return true
+	}
+	word := strings.ToLower(strings.TrimLeft(fields[len(fields)-1], `"'([`))
+
+	if abbreviations[word] {
+		return false
+	}
+	// a single letter is an initial, as in J. R. R. Tolkien
+	if utf8.RuneCountInString(word) == 1 && unicode.IsLetter([]rune(word)[0]) {
+		return false
+	}
+
+	// a sentence doesn't start with a lower case letter
+	after = strings.TrimSpace(after)
+	r, _ := utf8.DecodeRuneInString(after)
+	return !unicode.IsLower(r)
+}
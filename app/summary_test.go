@@ -0,0 +1,174 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/lexLibrary/lexLibrary/app"
+)
+
+func TestSummary(t *testing.T) {
+	resetDocuments(t)
+
+	tenant, err := app.TenantNew(installAdmin(t), "Summary Tenant", "", "")
+	if err != nil {
+		t.Fatalf("Error creating tenant: %s", err)
+	}
+	author := testUser(t, tenant, "author")
+
+	body := `<h1>Library Search</h1>
+		<p>The library search indexes every published document. Dr. Jones wrote the first version of the search
+		index in Jan. 2017, e.g. the stemming and the ranking. Search results are ranked by how well the document
+		matches the search terms.</p>
+		<p>Lunch is served at noon. The search index is rebuilt whenever a document is published, so search results
+		are always current! Is the cafeteria open on weekends?</p>`
+
+	generated := "The library search indexes every published document. Search results are ranked by how well " +
+		"the document matches the search terms. The search index is rebuilt whenever a document is published, so " +
+		"search results are always current!"
+
+	doc, err := app.DocumentNew(author, nil, "Search", body)
+	if err != nil {
+		t.Fatalf("Error creating document: %s", err)
+	}
+
+	latest := func() *app.Revision {
+		rev, err := doc.Latest()
+		if err != nil {
+			t.Fatalf("Error getting revision: %s", err)
+		}
+		return rev
+	}
+
+	t.Run("Generated", func(t *testing.T) {
+		rev := latest()
+		if rev.Summary != generated || rev.SummaryManual {
+			t.Fatalf("Invalid summary. Wanted %q got %q", generated, rev.Summary)
+		}
+
+		revisions, err := doc.Revisions(0, 10)
+		if err != nil {
+			t.Fatalf("Error listing revisions: %s", err)
+		}
+		if len(revisions) != 1 || revisions[0].Summary != generated {
+			t.Fatalf("Revision list didn't include the summary: %+v", revisions)
+		}
+	})
+
+	t.Run("Length", func(t *testing.T) {
+		err := tenant.SetSetting(author, "SummarySentences", "4")
+		if err != nil {
+			t.Fatalf("Error setting summary sentences: %s", err)
+		}
+		defer tenant.ResetSetting(author, "SummarySentences")
+
+		draft, err := doc.Edit()
+		if err != nil {
+			t.Fatalf("Error starting draft: %s", err)
+		}
+		err = draft.Update("Search", body)
+		if err != nil {
+			t.Fatalf("Error updating draft: %s", err)
+		}
+		rev, err := draft.Save()
+		if err != nil {
+			t.Fatalf("Error saving draft: %s", err)
+		}
+
+		expected := "The library search indexes every published document. Dr. Jones wrote the first version of " +
+			"the search index in Jan. 2017, e.g. the stemming and the ranking. Search results are ranked by how " +
+			"well the document matches the search terms. The search index is rebuilt whenever a document is " +
+			"published, so search results are always current!"
+		if rev.Summary != expected {
+			t.Fatalf("Invalid summary. Wanted %q got %q", expected, rev.Summary)
+		}
+
+		doc, err = app.DocumentGet(author, doc.ID)
+		if err != nil {
+			t.Fatalf("Error getting document: %s", err)
+		}
+	})
+
+	t.Run("Manual", func(t *testing.T) {
+		err := doc.SetSummary(1, "  How the   search index works. ")
+		if err != nil {
+			t.Fatalf("Error setting summary: %s", err)
+		}
+		rev, err := doc.Revision(1)
+		if err != nil {
+			t.Fatalf("Error getting revision: %s", err)
+		}
+		if rev.Summary != "How the search index works." || !rev.SummaryManual {
+			t.Fatalf("Summary wasn't set: %+v", rev)
+		}
+
+		restored, err := doc.Restore(1)
+		if err != nil {
+			t.Fatalf("Error restoring revision: %s", err)
+		}
+		if restored.Summary != rev.Summary || !restored.SummaryManual {
+			t.Fatalf("Restore didn't keep the summary: %+v", restored)
+		}
+
+		err = doc.SetSummary(restored.Revision, "")
+		if err != nil {
+			t.Fatalf("Error resetting summary: %s", err)
+		}
+		rev = latest()
+		if rev.Summary != generated || rev.SummaryManual {
+			t.Fatalf("Summary wasn't generated again. Wanted %q got %q", generated, rev.Summary)
+		}
+
+		err = doc.SetSummary(restored.Revision, strings.Repeat("ü", 2000))
+		if err != nil {
+			t.Fatalf("Error setting a summary of 2000 characters longer than 2000 bytes: %s", err)
+		}
+		err = doc.SetSummary(restored.Revision, strings.Repeat("ü", 2001))
+		if !app.IsFail(err) {
+			t.Fatalf("Setting a summary longer than 2000 characters didn't fail: %v", err)
+		}
+
+		err = doc.SetSummary(100, "Missing revision")
+		if !app.IsFailType(err, app.FailNotFound) {
+			t.Fatalf("Expected not found setting the summary of an invalid revision, got %v", err)
+		}
+
+		reader := testUser(t, tenant, "reader")
+		err = doc.Grant(reader, app.PermissionRead)
+		if err != nil {
+			t.Fatalf("Error granting read: %s", err)
+		}
+		readerDoc, err := app.DocumentGet(reader, doc.ID)
+		if err != nil {
+			t.Fatalf("Error getting document: %s", err)
+		}
+		err = readerDoc.SetSummary(1, "Reader summary")
+		if !app.IsFailType(err, app.FailForbidden) {
+			t.Fatalf("Expected forbidden setting a summary without edit permission, got %v", err)
+		}
+	})
+
+	t.Run("Short Documents", func(t *testing.T) {
+		tests := map[string]string{
+			"<h1>Only a Heading</h1>":                           "Only a Heading",
+			"<p>One sentence only. Mr. Smith agrees.</p>":       "One sentence only. Mr. Smith agrees.",
+			"<p>Initials like J. R. R. Tolkien stay whole.</p>": "Initials like J. R. R. Tolkien stay whole.",
+			"": "",
+		}
+		for body, expected := range tests {
+			short, err := app.DocumentNew(author, nil, "Short", body)
+			if err != nil {
+				t.Fatalf("Error creating document: %s", err)
+			}
+			rev, err := short.Latest()
+			if err != nil {
+				t.Fatalf("Error getting revision: %s", err)
+			}
+			if rev.Summary != expected {
+				t.Fatalf("Invalid summary for %q. Wanted %q got %q", body, expected, rev.Summary)
+			}
+		}
+	})
+}
@@ -0,0 +1,436 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"database/sql"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lexLibrary/lexLibrary/data"
+)
+
+/*
+	Published documents are tagged automatically with the terms that best describe them.  Each term in a
+	document is scored by TF-IDF: how often it appears in the document, weighted by how rare it is across the rest
+	of the library, so words that are common in every document don't make useful tags.  Words in the title count
+	more than words in the body.
+
+	The terms of every published document are kept in the document_terms table, which gives the corpus statistics
+	needed for scoring.  Tagging runs in the background (see TagPending), so publishing a document never waits on
+	it, and no outside service is used.
+
+	Automatic tags are replaced each time a new revision is published, but tags added by users are always kept.
+	When a user removes a tag it is remembered as rejected, so it won't be suggested for that document again.
+	Tags are always stored under their canonical name, never a synonym, see taxonomy.go.
+*/
+
+const (
+	// maxTagLength is the longest tag in bytes
+	maxTagLength = 64
+	// titleTermWeight is how many times more a word in the title counts than a word in the body
+	titleTermWeight = 3
+	// tagBatchSize is the most documents tagged per tenant each time TagPending runs
+	tagBatchSize = 100
+)
+
+// Tag is a keyword describing a document
+type Tag struct {
+	Name      string
+	Automatic bool // true if the tag was suggested by the tagger instead of added by a user
+	Created   time.Time
+}
+
+var (
+	sqlTagList = data.NewQuery(`
+		select tag, automatic, created from document_tags
+		where tenant_id = {{tenant}} and document_id = {{arg "document_id"}} and rejected = 0
+		order by automatic, tag
+	`)
+	sqlTagAll = data.NewQuery(`
+		select tag, automatic, rejected from document_tags
+		where tenant_id = {{tenant}} and document_id = {{arg "document_id"}}
+	`)
+	sqlTagInsert = data.NewQuery(`
+		insert into document_tags (tenant_id, document_id, tag, automatic, rejected, created)
+		values ({{tenant}}, {{arg "document_id"}}, {{arg "tag"}}, {{arg "automatic"}}, {{arg "rejected"}},
+			{{arg "created"}})
+	`)
+	sqlTagUpdate = data.NewQuery(`
+		update document_tags set automatic = {{arg "automatic"}}, rejected = {{arg "rejected"}}
+		where tenant_id = {{tenant}} and document_id = {{arg "document_id"}} and tag = {{arg "tag"}}
+	`)
+	sqlTagDelete = data.NewQuery(`
+		delete from document_tags
+		where tenant_id = {{tenant}} and document_id = {{arg "document_id"}} and tag = {{arg "tag"}}
+	`)
+
+	sqlTagPending = data.NewQuery(`
+		select id, published_revision from documents
+		where tenant_id = {{tenant}}
+		and ((status = 'published' and published_revision <> tagged_revision)
+			or (status <> 'published' and tagged_revision <> 0))
+		LIMIT {{arg "limit"}}
+	`)
+	sqlTagSetRevision = data.NewQuery(`
+		update documents set tagged_revision = {{arg "revision"}}
+		where tenant_id = {{tenant}} and id = {{arg "id"}}
+	`)
+
+	sqlTermDelete = data.NewQuery(`
+		delete from document_terms where tenant_id = {{tenant}} and document_id = {{arg "document_id"}}
+	`)
+	sqlTermInsert = data.NewQuery(`
+		insert into document_terms (tenant_id, document_id, term, frequency)
+		values ({{tenant}}, {{arg "document_id"}}, {{arg "term"}}, {{arg "frequency"}})
+	`)
+	sqlTermDocumentCount = data.NewQuery(`
+		select count(distinct document_id) from document_terms where tenant_id = {{tenant}}
+	`)
+	sqlTermDocumentFrequency = data.NewQuery(`
+		select t.term, count(*) from document_terms t
+		where t.tenant_id = {{tenant}}
+		and t.term in (
+			select m.term from document_terms m where m.tenant_id = {{tenant}} and m.document_id = {{arg "document_id"}}
+		)
+		group by t.term
+	`)
+)
+
+// Tags returns the document's tags, tags added by users first
+func (d *Document) Tags() ([]Tag, error) {
+	err := Can(d.who, PermissionRead, d)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := sqlTagList.Tenant(d.TenantID).Query(sql.Named("document_id", d.ID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []Tag
+	for rows.Next() {
+		tag := Tag{}
+		automatic := 0
+		err = rows.Scan(&tag.Name, &automatic, &tag.Created)
+		if err != nil {
+			return nil, err
+		}
+		tag.Automatic = automatic != 0
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// AddTag tags the document.  If the tag was added automatically, it is kept as if the user had added it, so it
+// won't be replaced when the document is next tagged
+func (d *Document) AddTag(name string) error {
+	return d.setTag(name, false)
+}
+
+// RemoveTag removes the tag from the document.  The tagger won't suggest a removed tag for the document again
+func (d *Document) RemoveTag(name string) error {
+	return d.setTag(name, true)
+}
+
+func (d *Document) setTag(name string, rejected bool) error {
+	err := Can(d.who, PermissionEdit, d)
+	if err != nil {
+		return err
+	}
+	name = normalizeTag(name)
+	err = validateTag(name)
+	if err != nil {
+		return err
+	}
+
+	return data.BeginTx(func(tx *sql.Tx) error {
+		name, err := resolveTag(tx, d.TenantID, name)
+		if err != nil {
+			return err
+		}
+		existing, err := documentTags(tx, d.TenantID, d.ID)
+		if err != nil {
+			return err
+		}
+		if _, ok := existing[name]; !ok {
+			// removed tags are still inserted, so the tagger knows not to suggest them
+			return insertTag(tx, d.TenantID, d.ID, name, false, rejected)
+		}
+
+		_, err = sqlTagUpdate.Tx(tx).Tenant(d.TenantID).Exec(
+			sql.Named("document_id", d.ID),
+			sql.Named("tag", name),
+			sql.Named("automatic", boolInt(false)),
+			sql.Named("rejected", boolInt(rejected)),
+		)
+		return err
+	})
+}
+
+// normalizeTag lower cases the tag, collapses its whitespace, and normalizes its unicode characters, so tags
+// that look the same are the same
+func normalizeTag(name string) string {
+	// spaces are collapsed after normalizing, as normalizing can turn other characters into spaces
+	return strings.Join(strings.Fields(userKey(name)), " ")
+}
+
+// existingTag is the state of a tag already on a document
+type existingTag struct {
+	automatic bool
+	rejected  bool
+}
+
+func documentTags(tx *sql.Tx, tenantID, documentID string) (map[string]existingTag, error) {
+	rows, err := sqlTagAll.Tx(tx).Tenant(tenantID).Query(sql.Named("document_id", documentID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make(map[string]existingTag)
+	for rows.Next() {
+		name := ""
+		automatic, rejected := 0, 0
+		err = rows.Scan(&name, &automatic, &rejected)
+		if err != nil {
+			return nil, err
+		}
+		tags[name] = existingTag{automatic: automatic != 0, rejected: rejected != 0}
+	}
+	return tags, rows.Err()
+}
+
+func insertTag(tx *sql.Tx, tenantID, documentID, name string, automatic, rejected bool) error {
+	_, err := sqlTagInsert.Tx(tx).Tenant(tenantID).Exec(
+		sql.Named("document_id", documentID),
+		sql.Named("tag", name),
+		sql.Named("automatic", boolInt(automatic)),
+		sql.Named("rejected", boolInt(rejected)),
+		sql.Named("created", time.Now()),
+	)
+	return err
+}
+
+// TagPending tags every published document whose published revision hasn't been tagged yet, and removes the
+// terms of documents that are no longer published from the corpus statistics.  It returns the number of documents
+// updated, and is meant to be run regularly in the background
+func TagPending() (int, error) {
+	count := 0
+	err := EachTenant(func(t *Tenant) error {
+		pending, err := pendingTags(t)
+		if err != nil {
+			return err
+		}
+
+		// the terms of every pending document are updated before any are tagged, so documents published
+		// together are scored against each other
+		terms := make(map[string]*termCounts, len(pending))
+		for id, revision := range pending {
+			terms[id], err = indexTerms(t, id, revision)
+			if err != nil {
+				return err
+			}
+		}
+		for id, revision := range pending {
+			err = tagDocument(t, id, revision, terms[id])
+			if err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// pendingTags returns the ids of the documents in the tenant that need tagging, and their published revisions
+func pendingTags(t *Tenant) (map[string]int, error) {
+	rows, err := sqlTagPending.Tenant(t.ID).Query(sql.Named("limit", tagBatchSize))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pending := make(map[string]int)
+	for rows.Next() {
+		id := ""
+		revision := sql.NullInt64{}
+		err = rows.Scan(&id, &revision)
+		if err != nil {
+			return nil, err
+		}
+		pending[id] = int(revision.Int64)
+	}
+	return pending, rows.Err()
+}
+
+// indexTerms replaces the document's terms with the terms of the revision.  If revision is 0, the document isn't
+// published, and its terms are only removed
+func indexTerms(t *Tenant, documentID string, revision int) (*termCounts, error) {
+	counts := newTermCounts()
+	err := data.BeginTx(func(tx *sql.Tx) error {
+		_, err := sqlTermDelete.Tx(tx).Tenant(t.ID).Exec(sql.Named("document_id", documentID))
+		if err != nil {
+			return err
+		}
+		if revision == 0 {
+			return nil
+		}
+
+		r, err := (&Document{ID: documentID, TenantID: t.ID}).revision(tx, revision)
+		if err != nil {
+			return err
+		}
+		counts.add(r.Title, titleTermWeight)
+		counts.add(htmlToText(r.Body), 1)
+
+		for _, term := range counts.terms {
+			_, err = sqlTermInsert.Tx(tx).Tenant(t.ID).Exec(
+				sql.Named("document_id", documentID),
+				sql.Named("term", term.stem),
+				sql.Named("frequency", term.count),
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// tagDocument replaces the document's automatic tags with the best of its terms, and marks the revision as tagged
+func tagDocument(t *Tenant, documentID string, revision int, counts *termCounts) error {
+	return data.BeginTx(func(tx *sql.Tx) error {
+		if revision != 0 {
+			suggested, err := suggestTags(tx, t, documentID, counts)
+			if err != nil {
+				return err
+			}
+			err = mergeTags(tx, t.ID, documentID, suggested)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := sqlTagSetRevision.Tx(tx).Tenant(t.ID).Exec(
+			sql.Named("id", documentID),
+			sql.Named("revision", revision),
+		)
+		return err
+	})
+}
+
+// suggestTags returns the best tags for the document's terms, best first
+func suggestTags(tx *sql.Tx, t *Tenant, documentID string, counts *termCounts) ([]string, error) {
+	limit := t.settingInt("AutoTagCount")
+	if limit <= 0 || counts.total == 0 {
+		return nil, nil
+	}
+
+	documents := 0
+	err := sqlTermDocumentCount.Tx(tx).Tenant(t.ID).QueryRow().Scan(&documents)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := sqlTermDocumentFrequency.Tx(tx).Tenant(t.ID).Query(sql.Named("document_id", documentID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type scored struct {
+		word  string
+		score float64
+	}
+	var terms []scored
+	for rows.Next() {
+		stem := ""
+		frequency := 0
+		err = rows.Scan(&stem, &frequency)
+		if err != nil {
+			return nil, err
+		}
+		term, ok := counts.terms[stem]
+		if !ok {
+			continue
+		}
+		terms = append(terms, scored{
+			word:  term.word,
+			score: tfidf(term.count, counts.total, frequency, documents),
+		})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(terms, func(i, j int) bool {
+		if terms[i].score != terms[j].score {
+			return terms[i].score > terms[j].score
+		}
+		return terms[i].word < terms[j].word
+	})
+
+	var tags []string
+	for i := 0; i < len(terms) && i < limit; i++ {
+		tags = append(tags, terms[i].word)
+	}
+	return tags, nil
+}
+
+// tfidf scores a term by its frequency in a document, weighted by the inverse of the number of documents in the
+// corpus that contain it.  The idf is smoothed so a library with a single document can still be tagged
+func tfidf(count, total, documentFrequency, documents int) float64 {
+	tf := float64(count) / float64(total)
+	idf := math.Log(float64(1+documents) / float64(documentFrequency))
+	return tf * idf
+}
+
+// mergeTags replaces the document's automatic tags with the suggested tags, leaving tags added or removed by users
+func mergeTags(tx *sql.Tx, tenantID, documentID string, suggested []string) error {
+	existing, err := documentTags(tx, tenantID, documentID)
+	if err != nil {
+		return err
+	}
+
+	keep := make(map[string]bool, len(suggested))
+	for _, name := range suggested {
+		name, err = resolveTag(tx, tenantID, name)
+		if err != nil {
+			return err
+		}
+		_, ok := existing[name]
+		if ok || keep[name] {
+			keep[name] = true
+			continue
+		}
+		keep[name] = true
+		err = insertTag(tx, tenantID, documentID, name, true, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	for name, tag := range existing {
+		if !tag.automatic || tag.rejected || keep[name] {
+			continue
+		}
+		_, err = sqlTagDelete.Tx(tx).Tenant(tenantID).Exec(
+			sql.Named("document_id", documentID),
+			sql.Named("tag", name),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
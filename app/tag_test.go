@@ -0,0 +1,208 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app_test
+
+import (
+	"testing"
+
+	"github.com/lexLibrary/lexLibrary/app"
+)
+
+func TestTag(t *testing.T) {
+	resetDocuments(t)
+
+	tenant, err := app.TenantNew(installAdmin(t), "Tag Tenant", "", "")
+	if err != nil {
+		t.Fatalf("Error creating tenant: %s", err)
+	}
+	author := testUser(t, tenant, "author")
+	reader := testUser(t, tenant, "reader")
+
+	publish := func(title, body string) *app.Document {
+		doc, err := app.DocumentNew(author, nil, title, body)
+		if err != nil {
+			t.Fatalf("Error creating document: %s", err)
+		}
+		err = doc.Publish(0)
+		if err != nil {
+			t.Fatalf("Error publishing document: %s", err)
+		}
+		return doc
+	}
+
+	tagPending := func(expected int) {
+		count, err := app.TagPending()
+		if err != nil {
+			t.Fatalf("Error tagging documents: %s", err)
+		}
+		if count != expected {
+			t.Fatalf("Invalid number of documents tagged. Wanted %d got %d", expected, count)
+		}
+	}
+
+	tagNames := func(doc *app.Document) map[string]bool {
+		tags, err := doc.Tags()
+		if err != nil {
+			t.Fatalf("Error getting tags: %s", err)
+		}
+		names := make(map[string]bool, len(tags))
+		for _, tag := range tags {
+			names[tag.Name] = tag.Automatic
+		}
+		return names
+	}
+
+	doc := publish("Deploying Kubernetes Clusters",
+		`<p>This guide explains how the team deploys Kubernetes clusters.</p>
+		<p>Every cluster is deployed with the same tooling, and the clusters are upgraded together.</p>
+		<p>Kubernetes upgrades are published in the guide when they're scheduled.</p>`)
+	publish("Baking Sourdough Bread", `<p>This guide explains how to bake bread with a sourdough starter.
+		Feed the starter the night before baking the bread.</p>`)
+	publish("Planting Tomatoes", `<p>This guide explains when tomatoes should be planted. Tomatoes need sun and
+		the tomatoes should be watered every morning.</p>`)
+
+	t.Run("Automatic", func(t *testing.T) {
+		tags := tagNames(doc)
+		if len(tags) != 0 {
+			t.Fatalf("Document was tagged before the tagger ran: %v", tags)
+		}
+
+		tagPending(3)
+		tagPending(0)
+
+		tags = tagNames(doc)
+		if len(tags) != 5 {
+			t.Fatalf("Invalid number of tags. Wanted %d got %d: %v", 5, len(tags), tags)
+		}
+		for _, expected := range []string{"kubernetes", "clusters"} {
+			automatic, ok := tags[expected]
+			if !ok {
+				t.Fatalf("Expected tag %s is missing: %v", expected, tags)
+			}
+			if !automatic {
+				t.Fatalf("Tag %s wasn't marked as automatic", expected)
+			}
+		}
+		for _, unexpected := range []string{"the", "every", "guide", "explains", "cluster"} {
+			if _, ok := tags[unexpected]; ok {
+				t.Fatalf("Unexpected tag %s: %v", unexpected, tags)
+			}
+		}
+	})
+
+	t.Run("User Tags", func(t *testing.T) {
+		err := doc.AddTag("  Infrastructure   Team ")
+		if err != nil {
+			t.Fatalf("Error adding tag: %s", err)
+		}
+		err = doc.AddTag("kubernetes")
+		if err != nil {
+			t.Fatalf("Error adding tag: %s", err)
+		}
+		err = doc.RemoveTag("Clusters")
+		if err != nil {
+			t.Fatalf("Error removing tag: %s", err)
+		}
+		err = doc.AddTag(" ")
+		if !app.IsFailType(err, app.FailInvalid) {
+			t.Fatalf("Expected invalid failure for an empty tag, got %v", err)
+		}
+
+		tags := tagNames(doc)
+		if automatic, ok := tags["infrastructure team"]; !ok || automatic {
+			t.Fatalf("User tag wasn't added: %v", tags)
+		}
+		if automatic := tags["kubernetes"]; automatic {
+			t.Fatalf("Automatic tag wasn't kept as a user tag: %v", tags)
+		}
+		if _, ok := tags["clusters"]; ok {
+			t.Fatalf("Tag wasn't removed: %v", tags)
+		}
+
+		err = app.Grant(author, doc, reader, app.PermissionRead)
+		if err != nil {
+			t.Fatalf("Error granting read: %s", err)
+		}
+		readerDoc, err := app.DocumentGet(reader, doc.ID)
+		if err != nil {
+			t.Fatalf("Error getting document: %s", err)
+		}
+		if len(tagNames(readerDoc)) != len(tags) {
+			t.Fatalf("Reader didn't see the same tags")
+		}
+		err = readerDoc.AddTag("reader tag")
+		if !app.IsFailType(err, app.FailForbidden) {
+			t.Fatalf("Expected forbidden adding a tag without edit permission, got %v", err)
+		}
+	})
+
+	t.Run("Republish", func(t *testing.T) {
+		draft, err := doc.Edit()
+		if err != nil {
+			t.Fatalf("Error starting draft: %s", err)
+		}
+		err = draft.Update("Deploying Kubernetes Clusters",
+			`<p>Clusters are now deployed with Terraform. Terraform modules describe each cluster, and Terraform
+			plans are reviewed before they're applied to the clusters.</p>`)
+		if err != nil {
+			t.Fatalf("Error updating draft: %s", err)
+		}
+		_, err = draft.Save()
+		if err != nil {
+			t.Fatalf("Error saving draft: %s", err)
+		}
+		doc, err = app.DocumentGet(author, doc.ID)
+		if err != nil {
+			t.Fatalf("Error getting document: %s", err)
+		}
+		err = doc.Publish(0)
+		if err != nil {
+			t.Fatalf("Error publishing document: %s", err)
+		}
+
+		tagPending(1)
+
+		tags := tagNames(doc)
+		if automatic, ok := tags["terraform"]; !ok || !automatic {
+			t.Fatalf("New revision wasn't tagged: %v", tags)
+		}
+		for _, kept := range []string{"infrastructure team", "kubernetes"} {
+			if _, ok := tags[kept]; !ok {
+				t.Fatalf("User tag %s was removed by the tagger: %v", kept, tags)
+			}
+		}
+		if _, ok := tags["clusters"]; ok {
+			t.Fatalf("Removed tag was suggested again: %v", tags)
+		}
+		if _, ok := tags["upgrades"]; ok {
+			t.Fatalf("Tag from the old revision remained: %v", tags)
+		}
+	})
+
+	t.Run("Unpublish", func(t *testing.T) {
+		err := doc.Unpublish()
+		if err != nil {
+			t.Fatalf("Error unpublishing document: %s", err)
+		}
+		tagPending(1)
+		tagPending(0)
+
+		if len(tagNames(doc)) == 0 {
+			t.Fatalf("Unpublishing removed the document's tags")
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		err := tenant.SetSetting(author, "AutoTagCount", "0")
+		if err != nil {
+			t.Fatalf("Error setting auto tag count: %s", err)
+		}
+		defer tenant.ResetSetting(author, "AutoTagCount")
+
+		other := publish("Disabled Tagging", "<p>Nothing should be tagged automatically here.</p>")
+		tagPending(1)
+		if len(tagNames(other)) != 0 {
+			t.Fatalf("Document was tagged with automatic tagging disabled")
+		}
+	})
+}
@@ -0,0 +1,757 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lexLibrary/lexLibrary/data"
+)
+
+/*
+	Tenant administrators can organize the tags used across their library.
+
+	Tags can be placed in a hierarchy, so listing the documents with a tag includes the documents tagged with any
+	of its children.  Each tag in the hierarchy keeps the path of ids from the top of the hierarchy down to itself,
+	so all of a tag's descendants can be found with a single prefix match.
+
+	Synonyms are alternate names for a tag.  Tags added by users or by the tagger are stored under the name of the
+	tag they are a synonym of, so "k8s" can always be stored as "kubernetes".
+
+	Renaming or merging tags rewrites every document using them.  When two tags are merged, the old name becomes a
+	synonym of the tag it was merged into.
+*/
+
+// TagDetail is a tag as it's used and organized across the library
+type TagDetail struct {
+	Name     string
+	Parent   string // empty if the tag is at the top of the hierarchy
+	Children []string
+	Synonyms []string
+	Usage    int // the number of documents the user can read that have the tag
+
+	tenantID string
+	who      *User
+	row      *tagRow // nil if the tag isn't in the hierarchy and has no synonyms
+}
+
+// TagUsage is how many documents use a tag
+type TagUsage struct {
+	Name  string
+	Count int
+}
+
+// tagRow is a tag's place in the hierarchy
+type tagRow struct {
+	id       string
+	name     string
+	parentID string
+	path     string
+}
+
+var (
+	sqlTagRowColumns = `id, name, parent_id, path`
+	sqlTagRowGet     = data.NewQuery(`
+		select ` + sqlTagRowColumns + ` from tags where tenant_id = {{tenant}} and name = {{arg "name"}}
+	`)
+	sqlTagRowGetID = data.NewQuery(`
+		select ` + sqlTagRowColumns + ` from tags where tenant_id = {{tenant}} and id = {{arg "id"}}
+	`)
+	sqlTagRowChildren = data.NewQuery(`
+		select ` + sqlTagRowColumns + ` from tags where tenant_id = {{tenant}} and parent_id = {{arg "parent_id"}}
+		order by name
+	`)
+	sqlTagRowDescendants = data.NewQuery(`
+		select ` + sqlTagRowColumns + ` from tags
+		where tenant_id = {{tenant}} and path like {{arg "path"}} and id <> {{arg "id"}}
+	`)
+	sqlTagRowInsert = data.NewQuery(`
+		insert into tags (tenant_id, id, name, parent_id, path, created, updated)
+		values ({{tenant}}, {{arg "id"}}, {{arg "name"}}, {{arg "parent_id"}}, {{arg "path"}}, {{arg "created"}},
+			{{arg "updated"}})
+	`)
+	sqlTagRowUpdate = data.NewQuery(`
+		update tags set name = {{arg "name"}}, parent_id = {{arg "parent_id"}}, path = {{arg "path"}},
+			updated = {{arg "updated"}}
+		where tenant_id = {{tenant}} and id = {{arg "id"}}
+	`)
+	sqlTagRowDelete = data.NewQuery(`
+		delete from tags where tenant_id = {{tenant}} and id = {{arg "id"}}
+	`)
+
+	sqlTagSynonymResolve = data.NewQuery(`
+		select t.name from tag_synonyms s
+		join tags t on t.tenant_id = s.tenant_id and t.id = s.tag_id
+		where s.tenant_id = {{tenant}} and s.synonym = {{arg "synonym"}}
+	`)
+	sqlTagSynonymList = data.NewQuery(`
+		select synonym from tag_synonyms where tenant_id = {{tenant}} and tag_id = {{arg "tag_id"}} order by synonym
+	`)
+	sqlTagSynonymInsert = data.NewQuery(`
+		insert into tag_synonyms (tenant_id, synonym, tag_id) values ({{tenant}}, {{arg "synonym"}}, {{arg "tag_id"}})
+	`)
+	sqlTagSynonymDelete = data.NewQuery(`
+		delete from tag_synonyms where tenant_id = {{tenant}} and synonym = {{arg "synonym"}}
+	`)
+	sqlTagSynonymMove = data.NewQuery(`
+		update tag_synonyms set tag_id = {{arg "to_id"}} where tenant_id = {{tenant}} and tag_id = {{arg "from_id"}}
+	`)
+
+	sqlTagDocumentsUsing = data.NewQuery(`
+		select document_id, automatic, rejected from document_tags where tenant_id = {{tenant}} and tag = {{arg "tag"}}
+	`)
+	sqlTagDocumentState = data.NewQuery(`
+		select automatic, rejected from document_tags
+		where tenant_id = {{tenant}} and document_id = {{arg "document_id"}} and tag = {{arg "tag"}}
+	`)
+	sqlTagRename = data.NewQuery(`
+		update document_tags set tag = {{arg "to"}}
+		where tenant_id = {{tenant}} and document_id = {{arg "document_id"}} and tag = {{arg "from"}}
+	`)
+	sqlTagUseCount = data.NewQuery(`
+		select count(*) from document_tags where tenant_id = {{tenant}} and tag = {{arg "tag"}}
+	`)
+
+	sqlTagUsage = data.NewQuery(`
+		select count(*) from documents d
+		where d.tenant_id = {{tenant}}
+		and exists (
+			select 1 from document_tags dt
+			where dt.tenant_id = d.tenant_id and dt.document_id = d.id and dt.tag = {{arg "tag"}} and dt.rejected = 0
+		)
+		and ` + sqlCanDocument)
+	sqlTagCloud = data.NewQuery(`
+		select dt.tag, count(*) from document_tags dt
+		join documents d on d.tenant_id = dt.tenant_id and d.id = dt.document_id
+		where dt.tenant_id = {{tenant}} and dt.rejected = 0 and ` + sqlCanDocument + `
+		group by dt.tag
+		order by count(*) desc, dt.tag
+		LIMIT {{arg "limit"}}
+	`)
+	sqlTagDocuments = data.NewQuery(`
+		select ` + sqlDocumentColumns + ` from documents d
+		where d.tenant_id = {{tenant}}
+		and exists (
+			select 1 from document_tags dt
+			where dt.tenant_id = d.tenant_id and dt.document_id = d.id and dt.rejected = 0
+			and (dt.tag = {{arg "tag"}} or dt.tag in (
+				select t.name from tags t where t.tenant_id = {{tenant}} and t.path like {{arg "path"}}
+			))
+		)
+		and ` + sqlCanDocument + `
+		order by d.updated desc
+		LIMIT {{arg "limit"}} OFFSET {{arg "offset"}}
+	`)
+)
+
+// TagGet retrieves a tag by its name or any of its synonyms
+func TagGet(who *User, name string) (*TagDetail, error) {
+	if who == nil {
+		return nil, Unauthorized("You must log in")
+	}
+	t := &TagDetail{tenantID: who.TenantID, who: who}
+	err := t.load(name)
+	if err != nil {
+		return nil, err
+	}
+	if t.row == nil && t.Usage == 0 {
+		return nil, NotFound("Tag not found")
+	}
+	return t, nil
+}
+
+// TagCloud returns the tags used on the most documents the user can read, most used first
+func TagCloud(who *User, limit int) ([]TagUsage, error) {
+	if who == nil {
+		return nil, Unauthorized("You must log in")
+	}
+	if limit == 0 || limit > maxRows {
+		limit = 10
+	}
+
+	rows, err := sqlTagCloud.Tenant(who.TenantID).Query(
+		append(canArgs(who, PermissionRead), sql.Named("limit", limit))...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []TagUsage
+	for rows.Next() {
+		usage := TagUsage{}
+		err = rows.Scan(&usage.Name, &usage.Count)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, usage)
+	}
+	return tags, rows.Err()
+}
+
+// load loads the tag's hierarchy, synonyms and usage, following the name if it's a synonym
+func (t *TagDetail) load(name string) error {
+	name, err := resolveTag(nil, t.tenantID, name)
+	if err != nil {
+		return err
+	}
+	loaded := TagDetail{Name: name, tenantID: t.tenantID, who: t.who}
+
+	loaded.row, err = getTagRow(nil, t.tenantID, name)
+	if err != nil {
+		return err
+	}
+	if loaded.row != nil {
+		err = loaded.loadHierarchy()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = sqlTagUsage.Tenant(t.tenantID).QueryRow(
+		append(canArgs(t.who, PermissionRead), sql.Named("tag", name))...).Scan(&loaded.Usage)
+	if err != nil {
+		return err
+	}
+
+	*t = loaded
+	return nil
+}
+
+func (t *TagDetail) loadHierarchy() error {
+	if t.row.parentID != "" {
+		parent, err := scanTagRow(sqlTagRowGetID.Tenant(t.tenantID).QueryRow(sql.Named("id", t.row.parentID)))
+		if err != nil {
+			return err
+		}
+		t.Parent = parent.name
+	}
+
+	children, err := tagRowChildren(nil, t.tenantID, t.row.id)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		t.Children = append(t.Children, child.name)
+	}
+
+	rows, err := sqlTagSynonymList.Tenant(t.tenantID).Query(sql.Named("tag_id", t.row.id))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		synonym := ""
+		err = rows.Scan(&synonym)
+		if err != nil {
+			return err
+		}
+		t.Synonyms = append(t.Synonyms, synonym)
+	}
+	return rows.Err()
+}
+
+// Documents returns the documents the user can read that have the tag, or any of its children's tags, most
+// recently updated first
+func (t *TagDetail) Documents(offset, limit int) ([]*Document, error) {
+	if limit == 0 || limit > maxRows {
+		limit = 10
+	}
+	path := ""
+	if t.row != nil {
+		path = t.row.path + "%"
+	}
+
+	args := append(canArgs(t.who, PermissionRead),
+		sql.Named("tag", t.Name),
+		sql.Named("path", path),
+		sql.Named("offset", offset),
+		sql.Named("limit", limit),
+	)
+	rows, err := sqlTagDocuments.Tenant(t.tenantID).Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanDocuments(t.who, rows)
+}
+
+// SetParent moves the tag, along with all of its children, under the parent tag.  An empty parent moves the tag
+// to the top of the hierarchy
+func (t *TagDetail) SetParent(parent string) error {
+	err := canAdminTenant(t.who)
+	if err != nil {
+		return err
+	}
+	parent = normalizeTag(parent)
+	if len(parent) > maxTagLength {
+		return NewFailure("A tag can't be longer than 64 characters")
+	}
+
+	err = data.BeginTx(func(tx *sql.Tx) error {
+		row, err := ensureTagRow(tx, t.tenantID, t.Name)
+		if err != nil {
+			return err
+		}
+		if parent == "" {
+			return moveTagRow(tx, t.tenantID, row, nil)
+		}
+
+		parent, err = resolveTag(tx, t.tenantID, parent)
+		if err != nil {
+			return err
+		}
+		if parent == t.Name {
+			return NewFailure("A tag can't be its own parent")
+		}
+		parentRow, err := ensureTagRow(tx, t.tenantID, parent)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(parentRow.path, row.path) {
+			return NewFailure("A tag can't be moved under one of its own children")
+		}
+		return moveTagRow(tx, t.tenantID, row, parentRow)
+	})
+	if err != nil {
+		return err
+	}
+	return t.load(t.Name)
+}
+
+// Rename changes the name of the tag on every document that uses it
+func (t *TagDetail) Rename(name string) error {
+	err := canAdminTenant(t.who)
+	if err != nil {
+		return err
+	}
+	name = normalizeTag(name)
+	err = validateTag(name)
+	if err != nil {
+		return err
+	}
+	if name == t.Name {
+		return nil
+	}
+
+	err = data.BeginTx(func(tx *sql.Tx) error {
+		resolved, err := resolveTag(tx, t.tenantID, name)
+		if err != nil {
+			return err
+		}
+		if resolved != name {
+			return Conflict(fmt.Sprintf("%s is a synonym of %s", name, resolved))
+		}
+		existing, err := getTagRow(tx, t.tenantID, name)
+		if err != nil {
+			return err
+		}
+		count := 0
+		err = sqlTagUseCount.Tx(tx).Tenant(t.tenantID).QueryRow(sql.Named("tag", name)).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if existing != nil || count > 0 {
+			return Conflict(fmt.Sprintf("The tag %s already exists, merge the tags instead", name))
+		}
+
+		err = rewriteTag(tx, t.tenantID, t.Name, name)
+		if err != nil {
+			return err
+		}
+		row, err := getTagRow(tx, t.tenantID, t.Name)
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			return nil
+		}
+		row.name = name
+		return updateTagRow(tx, t.tenantID, row)
+	})
+	if err != nil {
+		return err
+	}
+	return t.load(name)
+}
+
+// Merge replaces the tag with the tag named into on every document, and makes this tag's name a synonym of it.
+// Any children or synonyms of this tag are moved to the tag it's merged into
+func (t *TagDetail) Merge(into string) error {
+	err := canAdminTenant(t.who)
+	if err != nil {
+		return err
+	}
+	into = normalizeTag(into)
+	err = validateTag(into)
+	if err != nil {
+		return err
+	}
+
+	err = data.BeginTx(func(tx *sql.Tx) error {
+		into, err = resolveTag(tx, t.tenantID, into)
+		if err != nil {
+			return err
+		}
+		if into == t.Name {
+			return NewFailure("A tag can't be merged into itself")
+		}
+		return mergeTag(tx, t.tenantID, t.Name, into)
+	})
+	if err != nil {
+		return err
+	}
+	return t.load(into)
+}
+
+// AddSynonym makes the synonym an alternate name of the tag.  If the synonym is already used as a tag, it's
+// merged into this one
+func (t *TagDetail) AddSynonym(synonym string) error {
+	err := canAdminTenant(t.who)
+	if err != nil {
+		return err
+	}
+	synonym = normalizeTag(synonym)
+	err = validateTag(synonym)
+	if err != nil {
+		return err
+	}
+	if synonym == t.Name {
+		return NewFailure("A tag can't be a synonym of itself")
+	}
+
+	err = data.BeginTx(func(tx *sql.Tx) error {
+		resolved, err := resolveTag(tx, t.tenantID, synonym)
+		if err != nil {
+			return err
+		}
+		if resolved == t.Name {
+			return nil
+		}
+		if resolved != synonym {
+			return Conflict(fmt.Sprintf("%s is already a synonym of %s", synonym, resolved))
+		}
+		return mergeTag(tx, t.tenantID, synonym, t.Name)
+	})
+	if err != nil {
+		return err
+	}
+	return t.load(t.Name)
+}
+
+// RemoveSynonym removes the synonym from the tag.  Documents already tagged are left as they are
+func (t *TagDetail) RemoveSynonym(synonym string) error {
+	err := canAdminTenant(t.who)
+	if err != nil {
+		return err
+	}
+	synonym = normalizeTag(synonym)
+
+	found := false
+	for _, s := range t.Synonyms {
+		if s == synonym {
+			found = true
+		}
+	}
+	if !found {
+		return NotFound("Synonym not found")
+	}
+
+	_, err = sqlTagSynonymDelete.Tenant(t.tenantID).Exec(sql.Named("synonym", synonym))
+	if err != nil {
+		return err
+	}
+	return t.load(t.Name)
+}
+
+func validateTag(name string) error {
+	if name == "" {
+		return NewFailure("A tag is required")
+	}
+	if len(name) > maxTagLength {
+		return NewFailure("A tag can't be longer than 64 characters")
+	}
+	return nil
+}
+
+// resolveTag normalizes the tag name, and returns the name of the tag it's a synonym of, if it's a synonym
+func resolveTag(tx *sql.Tx, tenantID, name string) (string, error) {
+	name = normalizeTag(name)
+	resolved := ""
+	err := sqlTagSynonymResolve.Tx(tx).Tenant(tenantID).QueryRow(sql.Named("synonym", name)).Scan(&resolved)
+	if err == sql.ErrNoRows {
+		return name, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return resolved, nil
+}
+
+// mergeTag moves every use of the from tag to the into tag, and makes from a synonym of into
+func mergeTag(tx *sql.Tx, tenantID, from, into string) error {
+	intoRow, err := ensureTagRow(tx, tenantID, into)
+	if err != nil {
+		return err
+	}
+	err = rewriteTag(tx, tenantID, from, into)
+	if err != nil {
+		return err
+	}
+
+	fromRow, err := getTagRow(tx, tenantID, from)
+	if err != nil {
+		return err
+	}
+	if fromRow != nil {
+		if strings.HasPrefix(intoRow.path, fromRow.path) {
+			// merging a tag into one of its own children, so the child takes the tag's place in the hierarchy
+			var parent *tagRow
+			if fromRow.parentID != "" {
+				parent, err = scanTagRow(sqlTagRowGetID.Tx(tx).Tenant(tenantID).QueryRow(
+					sql.Named("id", fromRow.parentID)))
+				if err != nil {
+					return err
+				}
+			}
+			err = moveTagRow(tx, tenantID, intoRow, parent)
+			if err != nil {
+				return err
+			}
+		}
+
+		children, err := tagRowChildren(tx, tenantID, fromRow.id)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			err = moveTagRow(tx, tenantID, child, intoRow)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = sqlTagSynonymMove.Tx(tx).Tenant(tenantID).Exec(
+			sql.Named("from_id", fromRow.id),
+			sql.Named("to_id", intoRow.id),
+		)
+		if err != nil {
+			return err
+		}
+		_, err = sqlTagRowDelete.Tx(tx).Tenant(tenantID).Exec(sql.Named("id", fromRow.id))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = sqlTagSynonymDelete.Tx(tx).Tenant(tenantID).Exec(sql.Named("synonym", from))
+	if err != nil {
+		return err
+	}
+	_, err = sqlTagSynonymInsert.Tx(tx).Tenant(tenantID).Exec(
+		sql.Named("synonym", from),
+		sql.Named("tag_id", intoRow.id),
+	)
+	return err
+}
+
+// tagStrength orders the states of a document's tag, so when two tags on a document are combined the stronger is
+// kept: a tag added by a user beats an automatic tag, which beats a removed tag
+func tagStrength(automatic, rejected bool) int {
+	switch {
+	case rejected:
+		return 0
+	case automatic:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// rewriteTag changes the from tag to the into tag on every document.  Documents are updated one at a time, so
+// documents that already have both tags can be combined
+func rewriteTag(tx *sql.Tx, tenantID, from, into string) error {
+	type documentTag struct {
+		documentID string
+		existingTag
+	}
+
+	rows, err := sqlTagDocumentsUsing.Tx(tx).Tenant(tenantID).Query(sql.Named("tag", from))
+	if err != nil {
+		return err
+	}
+	var using []documentTag
+	for rows.Next() {
+		dt := documentTag{}
+		automatic, rejected := 0, 0
+		err = rows.Scan(&dt.documentID, &automatic, &rejected)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		dt.automatic = automatic != 0
+		dt.rejected = rejected != 0
+		using = append(using, dt)
+	}
+	err = rows.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, dt := range using {
+		automatic, rejected := 0, 0
+		err = sqlTagDocumentState.Tx(tx).Tenant(tenantID).QueryRow(
+			sql.Named("document_id", dt.documentID),
+			sql.Named("tag", into),
+		).Scan(&automatic, &rejected)
+		if err == sql.ErrNoRows {
+			_, err = sqlTagRename.Tx(tx).Tenant(tenantID).Exec(
+				sql.Named("document_id", dt.documentID),
+				sql.Named("from", from),
+				sql.Named("to", into),
+			)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if tagStrength(dt.automatic, dt.rejected) > tagStrength(automatic != 0, rejected != 0) {
+			_, err = sqlTagUpdate.Tx(tx).Tenant(tenantID).Exec(
+				sql.Named("document_id", dt.documentID),
+				sql.Named("tag", into),
+				sql.Named("automatic", boolInt(dt.automatic)),
+				sql.Named("rejected", boolInt(dt.rejected)),
+			)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = sqlTagDelete.Tx(tx).Tenant(tenantID).Exec(
+			sql.Named("document_id", dt.documentID),
+			sql.Named("tag", from),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getTagRow returns the tag's place in the hierarchy, or nil if it doesn't have one
+func getTagRow(tx *sql.Tx, tenantID, name string) (*tagRow, error) {
+	row, err := scanTagRow(sqlTagRowGet.Tx(tx).Tenant(tenantID).QueryRow(sql.Named("name", name)))
+	if IsFailType(err, FailNotFound) {
+		return nil, nil
+	}
+	return row, err
+}
+
+// ensureTagRow returns the tag's place in the hierarchy, adding it to the top of the hierarchy if it doesn't
+// have one yet
+func ensureTagRow(tx *sql.Tx, tenantID, name string) (*tagRow, error) {
+	row, err := getTagRow(tx, tenantID, name)
+	if err != nil || row != nil {
+		return row, err
+	}
+
+	row = &tagRow{id: newID(), name: name}
+	row.path = "/" + row.id + "/"
+	now := time.Now()
+	_, err = sqlTagRowInsert.Tx(tx).Tenant(tenantID).Exec(
+		sql.Named("id", row.id),
+		sql.Named("name", row.name),
+		sql.Named("parent_id", nullString(row.parentID)),
+		sql.Named("path", row.path),
+		sql.Named("created", now),
+		sql.Named("updated", now),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return row, nil
+}
+
+func tagRowChildren(tx *sql.Tx, tenantID, parentID string) ([]*tagRow, error) {
+	return queryTagRows(sqlTagRowChildren.Tx(tx).Tenant(tenantID).Query(sql.Named("parent_id", parentID)))
+}
+
+func queryTagRows(rows *sql.Rows, err error) ([]*tagRow, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []*tagRow
+	for rows.Next() {
+		row, err := scanTagRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, row)
+	}
+	return tags, rows.Err()
+}
+
+func scanTagRow(record scanner) (*tagRow, error) {
+	row := &tagRow{}
+	var parentID sql.NullString
+	err := record.Scan(&row.id, &row.name, &parentID, &row.path)
+	if err == sql.ErrNoRows {
+		return nil, NotFound("Tag not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	row.parentID = parentID.String
+	return row, nil
+}
+
+func updateTagRow(tx *sql.Tx, tenantID string, row *tagRow) error {
+	_, err := sqlTagRowUpdate.Tx(tx).Tenant(tenantID).Exec(
+		sql.Named("id", row.id),
+		sql.Named("name", row.name),
+		sql.Named("parent_id", nullString(row.parentID)),
+		sql.Named("path", row.path),
+		sql.Named("updated", time.Now()),
+	)
+	return err
+}
+
+// moveTagRow moves the tag under the parent, or to the top of the hierarchy if parent is nil, and updates the
+// paths of all of its descendants
+func moveTagRow(tx *sql.Tx, tenantID string, row, parent *tagRow) error {
+	descendants, err := queryTagRows(sqlTagRowDescendants.Tx(tx).Tenant(tenantID).Query(
+		sql.Named("path", row.path+"%"),
+		sql.Named("id", row.id),
+	))
+	if err != nil {
+		return err
+	}
+
+	oldPath := row.path
+	row.parentID = ""
+	row.path = "/" + row.id + "/"
+	if parent != nil {
+		row.parentID = parent.id
+		row.path = parent.path + row.id + "/"
+	}
+	err = updateTagRow(tx, tenantID, row)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range descendants {
+		d.path = row.path + strings.TrimPrefix(d.path, oldPath)
+		err = updateTagRow(tx, tenantID, d)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,303 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app_test
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/lexLibrary/lexLibrary/app"
+)
+
+func TestTaxonomy(t *testing.T) {
+	resetDocuments(t)
+
+	tenant, err := app.TenantNew(installAdmin(t), "Taxonomy Tenant", "", "")
+	if err != nil {
+		t.Fatalf("Error creating tenant: %s", err)
+	}
+	admin := testUser(t, tenant, "admin")
+	editor := testUser(t, tenant, "editor")
+
+	docs := make(map[string]*app.Document)
+	tagged := func(title string, tags ...string) {
+		doc, err := app.DocumentNew(admin, nil, title, "<p>"+title+"</p>")
+		if err != nil {
+			t.Fatalf("Error creating document: %s", err)
+		}
+		for _, tag := range tags {
+			err = doc.AddTag(tag)
+			if err != nil {
+				t.Fatalf("Error adding tag %s: %s", tag, err)
+			}
+		}
+		docs[title] = doc
+	}
+
+	getTag := func(name string) *app.TagDetail {
+		tag, err := app.TagGet(admin, name)
+		if err != nil {
+			t.Fatalf("Error getting tag %s: %s", name, err)
+		}
+		return tag
+	}
+
+	documentTitles := func(tag *app.TagDetail) []string {
+		list, err := tag.Documents(0, 100)
+		if err != nil {
+			t.Fatalf("Error listing documents with tag: %s", err)
+		}
+		var titles []string
+		for _, d := range list {
+			for title, doc := range docs {
+				if doc.ID == d.ID {
+					titles = append(titles, title)
+				}
+			}
+		}
+		sort.Strings(titles)
+		return titles
+	}
+
+	tagNames := func(title string) []string {
+		tags, err := docs[title].Tags()
+		if err != nil {
+			t.Fatalf("Error getting tags: %s", err)
+		}
+		var names []string
+		for _, tag := range tags {
+			names = append(names, tag.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	tagged("one", "Kubernetes", "orchestration")
+	tagged("two", "K8s", "Orchestration")
+	tagged("three", "Docker")
+	tagged("four", "containers")
+	tagged("five", "helm")
+
+	t.Run("Cloud", func(t *testing.T) {
+		cloud, err := app.TagCloud(admin, 0)
+		if err != nil {
+			t.Fatalf("Error getting tag cloud: %s", err)
+		}
+		expected := []app.TagUsage{
+			{Name: "orchestration", Count: 2},
+			{Name: "containers", Count: 1},
+			{Name: "docker", Count: 1},
+			{Name: "helm", Count: 1},
+			{Name: "k8s", Count: 1},
+			{Name: "kubernetes", Count: 1},
+		}
+		if !reflect.DeepEqual(cloud, expected) {
+			t.Fatalf("Invalid tag cloud. Wanted %v got %v", expected, cloud)
+		}
+
+		cloud, err = app.TagCloud(editor, 0)
+		if err != nil {
+			t.Fatalf("Error getting tag cloud: %s", err)
+		}
+		if len(cloud) != 0 {
+			t.Fatalf("Tag cloud included documents the user can't read: %v", cloud)
+		}
+		_, err = app.TagGet(editor, "kubernetes")
+		if !app.IsFailType(err, app.FailNotFound) {
+			t.Fatalf("Expected not found getting a tag only used on unreadable documents, got %v", err)
+		}
+		_, err = app.TagGet(admin, "unused")
+		if !app.IsFailType(err, app.FailNotFound) {
+			t.Fatalf("Expected not found getting an unused tag, got %v", err)
+		}
+	})
+
+	t.Run("Synonyms", func(t *testing.T) {
+		kube := getTag("kubernetes")
+		err := kube.AddSynonym(" K8S ")
+		if err != nil {
+			t.Fatalf("Error adding synonym: %s", err)
+		}
+		if kube.Usage != 2 || !reflect.DeepEqual(kube.Synonyms, []string{"k8s"}) {
+			t.Fatalf("Synonym wasn't merged into the tag: %+v", kube)
+		}
+		if names := tagNames("two"); !reflect.DeepEqual(names, []string{"kubernetes", "orchestration"}) {
+			t.Fatalf("Document tag wasn't rewritten: %v", names)
+		}
+
+		if getTag("k8s").Name != "kubernetes" {
+			t.Fatalf("Getting a synonym didn't return its tag")
+		}
+
+		err = docs["five"].AddTag("K8s")
+		if err != nil {
+			t.Fatalf("Error adding tag: %s", err)
+		}
+		if names := tagNames("five"); !reflect.DeepEqual(names, []string{"helm", "kubernetes"}) {
+			t.Fatalf("Tag wasn't stored under its synonym's tag: %v", names)
+		}
+		err = docs["five"].RemoveTag("kubernetes")
+		if err != nil {
+			t.Fatalf("Error removing tag: %s", err)
+		}
+
+		err = getTag("docker").AddSynonym("k8s")
+		if !app.IsFailType(err, app.FailConflict) {
+			t.Fatalf("Expected conflict reusing a synonym, got %v", err)
+		}
+		err = kube.AddSynonym("kubernetes")
+		if !app.IsFailType(err, app.FailInvalid) {
+			t.Fatalf("Expected invalid failure making a tag a synonym of itself, got %v", err)
+		}
+
+		err = kube.AddSynonym("kube")
+		if err != nil {
+			t.Fatalf("Error adding synonym: %s", err)
+		}
+		err = kube.RemoveSynonym("kube")
+		if err != nil {
+			t.Fatalf("Error removing synonym: %s", err)
+		}
+		err = kube.RemoveSynonym("kube")
+		if !app.IsFailType(err, app.FailNotFound) {
+			t.Fatalf("Expected not found removing a missing synonym, got %v", err)
+		}
+	})
+
+	t.Run("Hierarchy", func(t *testing.T) {
+		for child, parent := range map[string]string{"kubernetes": "containers", "docker": "containers",
+			"helm": "k8s"} {
+			err := getTag(child).SetParent(parent)
+			if err != nil {
+				t.Fatalf("Error setting parent of %s: %s", child, err)
+			}
+		}
+
+		containers := getTag("containers")
+		if !reflect.DeepEqual(containers.Children, []string{"docker", "kubernetes"}) {
+			t.Fatalf("Invalid children: %v", containers.Children)
+		}
+		if getTag("helm").Parent != "kubernetes" {
+			t.Fatalf("Parent wasn't resolved from its synonym")
+		}
+		if titles := documentTitles(containers); !reflect.DeepEqual(titles,
+			[]string{"five", "four", "one", "three", "two"}) {
+			t.Fatalf("Tag documents didn't include every descendant: %v", titles)
+		}
+
+		page, err := containers.Documents(0, 2)
+		if err != nil {
+			t.Fatalf("Error listing documents: %s", err)
+		}
+		next, err := containers.Documents(2, 2)
+		if err != nil {
+			t.Fatalf("Error listing documents: %s", err)
+		}
+		if len(page) != 2 || len(next) != 2 || page[0].ID == next[0].ID {
+			t.Fatalf("Invalid pages of documents: %d %d", len(page), len(next))
+		}
+
+		err = containers.SetParent("helm")
+		if !app.IsFailType(err, app.FailInvalid) {
+			t.Fatalf("Expected invalid failure moving a tag under its own descendant, got %v", err)
+		}
+
+		err = getTag("kubernetes").SetParent("")
+		if err != nil {
+			t.Fatalf("Error moving tag to the top: %s", err)
+		}
+		if titles := documentTitles(getTag("containers")); !reflect.DeepEqual(titles, []string{"four", "three"}) {
+			t.Fatalf("Moved tags remained in the hierarchy: %v", titles)
+		}
+		if titles := documentTitles(getTag("kubernetes")); !reflect.DeepEqual(titles,
+			[]string{"five", "one", "two"}) {
+			t.Fatalf("Moved tag lost its descendants: %v", titles)
+		}
+	})
+
+	t.Run("Rename", func(t *testing.T) {
+		docker := getTag("docker")
+		err := docker.Rename("Docker Engine")
+		if err != nil {
+			t.Fatalf("Error renaming tag: %s", err)
+		}
+		if docker.Name != "docker engine" || docker.Parent != "containers" || docker.Usage != 1 {
+			t.Fatalf("Invalid renamed tag: %+v", docker)
+		}
+		if names := tagNames("three"); !reflect.DeepEqual(names, []string{"docker engine"}) {
+			t.Fatalf("Document tag wasn't renamed: %v", names)
+		}
+
+		err = docker.Rename("kubernetes")
+		if !app.IsFailType(err, app.FailConflict) {
+			t.Fatalf("Expected conflict renaming to an existing tag, got %v", err)
+		}
+		err = docker.Rename("k8s")
+		if !app.IsFailType(err, app.FailConflict) {
+			t.Fatalf("Expected conflict renaming to a synonym, got %v", err)
+		}
+	})
+
+	t.Run("Merge", func(t *testing.T) {
+		orchestration := getTag("orchestration")
+		err := orchestration.Merge("K8s")
+		if err != nil {
+			t.Fatalf("Error merging tags: %s", err)
+		}
+		if orchestration.Name != "kubernetes" || orchestration.Usage != 2 {
+			t.Fatalf("Invalid merged tag: %+v", orchestration)
+		}
+		for _, title := range []string{"one", "two"} {
+			if names := tagNames(title); !reflect.DeepEqual(names, []string{"kubernetes"}) {
+				t.Fatalf("Document tags weren't merged: %v", names)
+			}
+		}
+		if !reflect.DeepEqual(orchestration.Synonyms, []string{"k8s", "orchestration"}) {
+			t.Fatalf("Merged tag didn't become a synonym: %v", orchestration.Synonyms)
+		}
+		if names := tagNames("five"); !reflect.DeepEqual(names, []string{"helm"}) {
+			t.Fatalf("Merge restored a removed tag: %v", names)
+		}
+
+		// merging a tag into its own child
+		containers := getTag("containers")
+		err = containers.Merge("docker engine")
+		if err != nil {
+			t.Fatalf("Error merging tag into its child: %s", err)
+		}
+		if containers.Parent != "" || containers.Usage != 2 {
+			t.Fatalf("Invalid tag after merging into a child: %+v", containers)
+		}
+		if titles := documentTitles(containers); !reflect.DeepEqual(titles, []string{"four", "three"}) {
+			t.Fatalf("Invalid documents after merge: %v", titles)
+		}
+
+		err = containers.Merge("containers")
+		if !app.IsFailType(err, app.FailInvalid) {
+			t.Fatalf("Expected invalid failure merging a tag into its synonym, got %v", err)
+		}
+	})
+
+	t.Run("Permissions", func(t *testing.T) {
+		err := docs["one"].Grant(editor, app.PermissionRead)
+		if err != nil {
+			t.Fatalf("Error granting read: %s", err)
+		}
+		tag, err := app.TagGet(editor, "kubernetes")
+		if err != nil {
+			t.Fatalf("Error getting tag: %s", err)
+		}
+		if tag.Usage != 1 {
+			t.Fatalf("Usage included documents the user can't read: %d", tag.Usage)
+		}
+		err = tag.Rename("kube")
+		if !app.IsFailType(err, app.FailForbidden) {
+			t.Fatalf("Expected forbidden renaming a tag as a non-admin, got %v", err)
+		}
+		err = tag.SetParent("")
+		if !app.IsFailType(err, app.FailForbidden) {
+			t.Fatalf("Expected forbidden moving a tag as a non-admin, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,499 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lexLibrary/lexLibrary/data"
+)
+
+// Tenant is an isolated library within a single Lex Library installation.  Every document, user and setting
+// belongs to a tenant, and no tenant can see another tenant's data.  Requests are routed to a tenant either
+// by the hostname of the request, or by the first segment of the request path.
+// Installations with a single library don't route tenants, and only ever use the default tenant
+type Tenant struct {
+	ID         string
+	Name       string
+	Host       string
+	PathPrefix string
+	Created    time.Time
+	Updated    time.Time
+
+	settings map[string]string
+}
+
+// settingDefaults are the installation wide values for every setting that can be overridden per tenant
+var settingDefaults = map[string]string{
+	"SiteName": "Lex Library",
+
+	"PasswordMinLength": "10",
+	// failed logins allowed before each further attempt has to wait, and how long the first wait is in seconds.
+	// The wait doubles with every additional failed attempt
+	"LoginThrottleAttempts": "5",
+	"LoginThrottleSeconds":  "30",
+	// failed logins before the account is locked and has to be unlocked by an administrator, 0 never locks
+	"LoginLockAttempts": "20",
+	// sessions expire after this many minutes without a request, and after this many days no matter what
+	"SessionIdleMinutes": "1440",
+	"SessionMaxDays":     "30",
+	// how many tags are automatically added to published documents, 0 disables automatic tagging
+	"AutoTagCount": "5",
+	// how many sentences are in the generated summary of each document revision
+	"SummarySentences": "3",
+}
+
+var pathPrefixPattern = regexp.MustCompile("^[a-z0-9_-]+$")
+
+// defaultTenantID is the id of the default tenant.  It isn't in the tenants table, and can't be the id of any
+// other tenant
+const defaultTenantID = "default"
+
+var (
+	sqlTenantInsert = data.NewQuery(`
+		insert into tenants (id, name, host, path_prefix, created, updated)
+		values ({{arg "id"}}, {{arg "name"}}, {{arg "host"}}, {{arg "path_prefix"}}, {{arg "created"}},
+			{{arg "updated"}})
+	`)
+	sqlTenantUpdate = data.NewQuery(`
+		update tenants set name = {{arg "name"}}, host = {{arg "host"}}, path_prefix = {{arg "path_prefix"}},
+			updated = {{arg "updated"}}
+		where id = {{arg "id"}}
+	`)
+	sqlTenantGet = data.NewQuery(`
+		select id, name, host, path_prefix, created, updated from tenants where id = {{arg "id"}}
+	`)
+	sqlTenantFromHost = data.NewQuery(`
+		select id, name, host, path_prefix, created, updated from tenants where host = {{arg "host"}}
+	`)
+	sqlTenantFromPathPrefix = data.NewQuery(`
+		select id, name, host, path_prefix, created, updated from tenants where path_prefix = {{arg "path_prefix"}}
+	`)
+	sqlTenantConflicts = data.NewQuery(`
+		select count(*) from tenants
+		where id <> {{arg "id"}}
+		and (host = {{arg "host"}} or path_prefix = {{arg "path_prefix"}})
+	`)
+	sqlTenantList = data.NewQuery(`
+		select id, name, host, path_prefix, created, updated from tenants order by name
+	`)
+	sqlTenantSettings = data.NewQuery(`
+		select setting, value from tenant_settings where tenant_id = {{tenant}}
+	`)
+	sqlTenantSettingDelete = data.NewQuery(`
+		delete from tenant_settings where tenant_id = {{tenant}} and setting = {{arg "setting"}}
+	`)
+	sqlTenantSettingInsert = data.NewQuery(`
+		insert into tenant_settings (tenant_id, setting, value) values ({{tenant}}, {{arg "setting"}}, {{arg "value"}})
+	`)
+)
+
+// DefaultTenant returns the tenant used for requests that don't match any other tenant
+func DefaultTenant() (*Tenant, error) {
+	t := &Tenant{
+		ID:   defaultTenantID,
+		Name: "Default",
+	}
+	err := t.loadSettings()
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// TenantNew creates a new tenant. The host and path prefix determine how requests are routed to the tenant,
+// and can be left empty if the tenant isn't routed that way.  Only administrators of the default tenant can create
+// tenants
+func TenantNew(who *User, name, host, pathPrefix string) (*Tenant, error) {
+	err := canAdminInstallation(who)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Tenant{
+		ID:         newID(),
+		Name:       strings.TrimSpace(name),
+		Host:       normalizeHost(host),
+		PathPrefix: strings.ToLower(strings.Trim(pathPrefix, "/ ")),
+		Created:    time.Now(),
+		settings:   make(map[string]string),
+	}
+	t.Updated = t.Created
+
+	err = t.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	err = data.BeginTx(func(tx *sql.Tx) error {
+		err := t.checkConflicts(tx)
+		if err != nil {
+			return err
+		}
+		_, err = sqlTenantInsert.Tx(tx).Exec(
+			sql.Named("id", t.ID),
+			sql.Named("name", t.Name),
+			sql.Named("host", nullString(t.Host)),
+			sql.Named("path_prefix", nullString(t.PathPrefix)),
+			sql.Named("created", t.Created),
+			sql.Named("updated", t.Updated),
+		)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// TenantGet retrieves a tenant by its id
+func TenantGet(id string) (*Tenant, error) {
+	if id == defaultTenantID {
+		return DefaultTenant()
+	}
+	return tenantFromRow(sqlTenantGet.QueryRow(sql.Named("id", id)))
+}
+
+// TenantFromHost returns the tenant routed to by the passed in request host.  Only installations routing
+// tenants by host should call it, so a host that no tenant uses is not found, rather than served by the
+// default tenant
+func TenantFromHost(host string) (*Tenant, error) {
+	host = normalizeHost(host)
+	if host == "" {
+		return nil, NotFound("No library is served at this host")
+	}
+	t, err := tenantFromRow(sqlTenantFromHost.QueryRow(sql.Named("host", host)))
+	if IsFailType(err, FailNotFound) {
+		return nil, NotFound("No library is served at this host")
+	}
+	return t, err
+}
+
+// TenantFromPath returns the tenant routed to by the first segment of the passed in request path, along with the
+// remaining path after the tenant's prefix.  Only installations routing tenants by path should call it, so a path
+// that doesn't start with a tenant's prefix is not found, rather than served by the default tenant
+func TenantFromPath(urlPath string) (*Tenant, string, error) {
+	trimmed := strings.TrimPrefix(urlPath, "/")
+	prefix := trimmed
+	rest := "/"
+	if i := strings.Index(trimmed, "/"); i != -1 {
+		prefix = trimmed[:i]
+		rest = trimmed[i:]
+	}
+	prefix = strings.ToLower(prefix)
+
+	if !pathPrefixPattern.MatchString(prefix) {
+		return nil, "", NotFound("No library is served at this path")
+	}
+
+	t, err := tenantFromRow(sqlTenantFromPathPrefix.QueryRow(sql.Named("path_prefix", prefix)))
+	if IsFailType(err, FailNotFound) {
+		return nil, "", NotFound("No library is served at this path")
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return t, rest, nil
+}
+
+// TenantList returns all of the tenants in the installation, not including the default tenant
+func TenantList() ([]*Tenant, error) {
+	rows, err := sqlTenantList.Query()
+	if err != nil {
+		return nil, err
+	}
+
+	var tenants []*Tenant
+	for rows.Next() {
+		t, err := scanTenant(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tenants = append(tenants, t)
+	}
+	err = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// settings are loaded after the rows are closed, so the connection is free for the settings queries
+	for i := range tenants {
+		err = tenants[i].loadSettings()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tenants, nil
+}
+
+// TenantError is an error returned by the function passed to EachTenant for a single tenant
+type TenantError struct {
+	TenantID string
+	Err      error
+}
+
+func (e *TenantError) Error() string {
+	return fmt.Sprintf("Tenant %s: %s", e.TenantID, e.Err)
+}
+
+// TenantErrors is the list of every tenant the function passed to EachTenant failed for
+type TenantErrors []*TenantError
+
+func (e TenantErrors) Error() string {
+	msg := fmt.Sprintf("%d tenants failed:", len(e))
+	for i := range e {
+		msg += "\n\t" + e[i].Error()
+	}
+	return msg
+}
+
+// EachTenant calls fn with every tenant in the installation, including the default tenant.  A tenant that fails
+// doesn't stop the rest from being visited, and the errors from every failed tenant are returned together as
+// TenantErrors
+func EachTenant(fn func(*Tenant) error) error {
+	tenants, err := TenantList()
+	if err != nil {
+		return err
+	}
+	def, err := DefaultTenant()
+	if err != nil {
+		return err
+	}
+
+	var errs TenantErrors
+	for _, t := range append(tenants, def) {
+		err = fn(t)
+		if err != nil {
+			errs = append(errs, &TenantError{TenantID: t.ID, Err: err})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanTenant(row scanner) (*Tenant, error) {
+	t := &Tenant{}
+	var host, pathPrefix sql.NullString
+	err := row.Scan(&t.ID, &t.Name, &host, &pathPrefix, &t.Created, &t.Updated)
+	if err == sql.ErrNoRows {
+		return nil, NotFound("Tenant not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.Host = host.String
+	t.PathPrefix = pathPrefix.String
+	return t, nil
+}
+
+func tenantFromRow(row *sql.Row) (*Tenant, error) {
+	t, err := scanTenant(row)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.loadSettings()
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// IsDefault returns whether or not this is the default tenant
+func (t *Tenant) IsDefault() bool {
+	return t.ID == defaultTenantID
+}
+
+// canAdmin returns nil if the user is an administrator of the tenant
+func (t *Tenant) canAdmin(who *User) error {
+	err := canAdminTenant(who)
+	if err != nil {
+		return err
+	}
+	if who.TenantID != t.ID {
+		return Forbidden("You can only manage your own library")
+	}
+	return nil
+}
+
+// Update updates the tenant's name and routing
+func (t *Tenant) Update(who *User, name, host, pathPrefix string) error {
+	err := t.canAdmin(who)
+	if err != nil {
+		return err
+	}
+	if t.IsDefault() {
+		return NewFailure("The default tenant can't be updated")
+	}
+	updated := *t
+	updated.Name = strings.TrimSpace(name)
+	updated.Host = normalizeHost(host)
+	updated.PathPrefix = strings.ToLower(strings.Trim(pathPrefix, "/ "))
+	updated.Updated = time.Now()
+
+	err = updated.validate()
+	if err != nil {
+		return err
+	}
+
+	err = data.BeginTx(func(tx *sql.Tx) error {
+		err := updated.checkConflicts(tx)
+		if err != nil {
+			return err
+		}
+		_, err = sqlTenantUpdate.Tx(tx).Exec(
+			sql.Named("id", updated.ID),
+			sql.Named("name", updated.Name),
+			sql.Named("host", nullString(updated.Host)),
+			sql.Named("path_prefix", nullString(updated.PathPrefix)),
+			sql.Named("updated", updated.Updated),
+		)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	*t = updated
+	return nil
+}
+
+func (t *Tenant) validate() error {
+	if t.Name == "" {
+		return NewFailure("A tenant name is required")
+	}
+	if t.PathPrefix != "" && !pathPrefixPattern.MatchString(t.PathPrefix) {
+		return NewFailure("A tenant path prefix can only contain lowercase letters, numbers, - and _")
+	}
+	if strings.ContainsAny(t.Host, "/ ") {
+		return NewFailure("Invalid tenant host")
+	}
+	return nil
+}
+
+func (t *Tenant) checkConflicts(tx *sql.Tx) error {
+	count := 0
+	err := sqlTenantConflicts.Tx(tx).QueryRow(
+		sql.Named("id", t.ID),
+		sql.Named("host", nullString(t.Host)),
+		sql.Named("path_prefix", nullString(t.PathPrefix)),
+	).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return Conflict("Another tenant is already using this host or path prefix")
+	}
+	return nil
+}
+
+func (t *Tenant) loadSettings() error {
+	t.settings = make(map[string]string)
+	rows, err := sqlTenantSettings.Tenant(t.ID).Query()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		setting, value := "", ""
+		err = rows.Scan(&setting, &value)
+		if err != nil {
+			return err
+		}
+		t.settings[setting] = value
+	}
+	return rows.Err()
+}
+
+// Setting returns the tenant's value for the setting, or the installation default if the tenant
+// hasn't overridden it
+func (t *Tenant) Setting(setting string) string {
+	if value, ok := t.settings[setting]; ok {
+		return value
+	}
+	return settingDefaults[setting]
+}
+
+// settingInt returns the integer value of a setting.  If the tenant's value isn't a valid number, the error is
+// logged and the installation default is used instead
+func (t *Tenant) settingInt(setting string) int {
+	value, err := strconv.Atoi(t.Setting(setting))
+	if err != nil {
+		LogError(fmt.Errorf("Invalid value for setting %s for tenant %s: %s", setting, t.ID, err))
+		value, _ = strconv.Atoi(settingDefaults[setting])
+	}
+	return value
+}
+
+// SetSetting overrides the installation default for a setting for this tenant
+func (t *Tenant) SetSetting(who *User, setting, value string) error {
+	err := t.canAdmin(who)
+	if err != nil {
+		return err
+	}
+	def, ok := settingDefaults[setting]
+	if !ok {
+		return NotFound("Invalid setting " + setting)
+	}
+	if _, err := strconv.Atoi(def); err == nil {
+		if n, err := strconv.Atoi(value); err != nil || n < 0 {
+			return NewFailure("The setting " + setting + " must be a whole number")
+		}
+	}
+
+	err = data.BeginTx(func(tx *sql.Tx) error {
+		_, err := sqlTenantSettingDelete.Tx(tx).Tenant(t.ID).Exec(sql.Named("setting", setting))
+		if err != nil {
+			return err
+		}
+		_, err = sqlTenantSettingInsert.Tx(tx).Tenant(t.ID).Exec(
+			sql.Named("setting", setting),
+			sql.Named("value", value))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	t.settings[setting] = value
+	return nil
+}
+
+// ResetSetting removes the tenant's override for a setting, and uses the installation default instead
+func (t *Tenant) ResetSetting(who *User, setting string) error {
+	err := t.canAdmin(who)
+	if err != nil {
+		return err
+	}
+	_, err = sqlTenantSettingDelete.Tenant(t.ID).Exec(sql.Named("setting", setting))
+	if err != nil {
+		return err
+	}
+	delete(t.settings, setting)
+	return nil
+}
+
+func normalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if i := strings.LastIndex(host, ":"); i != -1 && !strings.HasSuffix(host, "]") {
+		host = host[:i]
+	}
+	return host
+}
+
+func nullString(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
@@ -0,0 +1,242 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app_test
+
+import (
+	"testing"
+
+	"github.com/lexLibrary/lexLibrary/app"
+	"github.com/lexLibrary/lexLibrary/data"
+)
+
+func TestTenant(t *testing.T) {
+	for _, table := range []string{"tenant_settings", "tenants"} {
+		_, err := data.NewQuery("delete from " + table).Exec()
+		if err != nil {
+			t.Fatalf("Error emptying %s table before running tests: %s", table, err)
+		}
+	}
+
+	admin := installAdmin(t)
+	var hr, security *app.Tenant
+	var hrAdmin, securityAdmin *app.User
+
+	t.Run("New", func(t *testing.T) {
+		var err error
+		hr, err = app.TenantNew(admin, "Human Resources", "HR.Example.com:8080", "/HR/")
+		if err != nil {
+			t.Fatalf("Error creating tenant: %s", err)
+		}
+		if hr.Host != "hr.example.com" || hr.PathPrefix != "hr" {
+			t.Fatalf("Tenant routing was not normalized: %s %s", hr.Host, hr.PathPrefix)
+		}
+
+		hrAdmin = testUser(t, hr, "hradmin")
+
+		security, err = app.TenantNew(admin, "Security", "security.example.com", "")
+		if err != nil {
+			t.Fatalf("Error creating tenant: %s", err)
+		}
+
+		securityAdmin = testUser(t, security, "securityadmin")
+
+		_, err = app.TenantNew(nil, "Unauthorized", "", "")
+		if !app.IsFailType(err, app.FailUnauthorized) {
+			t.Fatalf("Expected unauthorized creating a tenant without logging in, got %v", err)
+		}
+		_, err = app.TenantNew(hrAdmin, "Forbidden", "", "")
+		if !app.IsFailType(err, app.FailForbidden) {
+			t.Fatalf("Expected forbidden creating a tenant as an admin of another tenant, got %v", err)
+		}
+		_, err = app.TenantNew(admin, "", "", "")
+		if !app.IsFailType(err, app.FailInvalid) {
+			t.Fatalf("Expected invalid failure for a tenant with no name, got %v", err)
+		}
+		_, err = app.TenantNew(admin, "Bad Prefix", "", "hr/docs")
+		if !app.IsFailType(err, app.FailInvalid) {
+			t.Fatalf("Expected invalid failure for a tenant with an invalid path prefix, got %v", err)
+		}
+		_, err = app.TenantNew(admin, "Duplicate", "hr.example.com", "")
+		if !app.IsFailType(err, app.FailConflict) {
+			t.Fatalf("Expected conflict failure for a duplicate host, got %v", err)
+		}
+		_, err = app.TenantNew(admin, "Duplicate", "", "hr")
+		if !app.IsFailType(err, app.FailConflict) {
+			t.Fatalf("Expected conflict failure for a duplicate path prefix, got %v", err)
+		}
+	})
+
+	t.Run("Routing", func(t *testing.T) {
+		tenant, err := app.TenantFromHost("hr.example.com:443")
+		if err != nil {
+			t.Fatalf("Error getting tenant from host: %s", err)
+		}
+		if tenant.ID != hr.ID {
+			t.Fatalf("Host routed to the wrong tenant: %s", tenant.Name)
+		}
+
+		for _, host := range []string{"unknown.example.com", "", ":8080"} {
+			_, err = app.TenantFromHost(host)
+			if !app.IsFailType(err, app.FailNotFound) {
+				t.Fatalf("Expected not found failure for host %q, got %v", host, err)
+			}
+		}
+
+		tenant, rest, err := app.TenantFromPath("/hr/documents/1")
+		if err != nil {
+			t.Fatalf("Error getting tenant from path: %s", err)
+		}
+		if tenant.ID != hr.ID || rest != "/documents/1" {
+			t.Fatalf("Path routed to the wrong tenant: %s %s", tenant.Name, rest)
+		}
+
+		tenant, rest, err = app.TenantFromPath("/hr")
+		if err != nil {
+			t.Fatalf("Error getting tenant from path: %s", err)
+		}
+		if tenant.ID != hr.ID || rest != "/" {
+			t.Fatalf("Path routed to the wrong tenant: %s %s", tenant.Name, rest)
+		}
+
+		for _, path := range []string{"/documents/1", "/", "", "/HR Docs/1"} {
+			_, _, err = app.TenantFromPath(path)
+			if !app.IsFailType(err, app.FailNotFound) {
+				t.Fatalf("Expected not found failure for path %q, got %v", path, err)
+			}
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		err := security.Update(hrAdmin, "Security Team", "sec.example.com", "sec")
+		if !app.IsFailType(err, app.FailForbidden) {
+			t.Fatalf("Expected forbidden updating a tenant as an admin of another tenant, got %v", err)
+		}
+		err = security.Update(testUser(t, security, "securityuser"), "Security Team", "sec.example.com", "sec")
+		if !app.IsFailType(err, app.FailForbidden) {
+			t.Fatalf("Expected forbidden updating a tenant as a non-admin, got %v", err)
+		}
+		err = security.Update(securityAdmin, "Security Team", "security.example.com", "hr")
+		if !app.IsFailType(err, app.FailConflict) {
+			t.Fatalf("Expected conflict failure when updating to a used path prefix, got %v", err)
+		}
+		err = security.Update(securityAdmin, "Security Team", "sec.example.com", "sec")
+		if err != nil {
+			t.Fatalf("Error updating tenant: %s", err)
+		}
+
+		tenant, err := app.TenantGet(security.ID)
+		if err != nil {
+			t.Fatalf("Error getting tenant: %s", err)
+		}
+		if tenant.Name != "Security Team" || tenant.Host != "sec.example.com" || tenant.PathPrefix != "sec" {
+			t.Fatalf("Tenant was not updated: %+v", tenant)
+		}
+
+		tenants, err := app.TenantList()
+		if err != nil {
+			t.Fatalf("Error listing tenants: %s", err)
+		}
+		if len(tenants) != 2 {
+			t.Fatalf("Invalid number of tenants. Wanted %d got %d", 2, len(tenants))
+		}
+	})
+
+	t.Run("Settings", func(t *testing.T) {
+		if hr.Setting("SiteName") != "Lex Library" {
+			t.Fatalf("Tenant setting was not the installation default: %s", hr.Setting("SiteName"))
+		}
+
+		err := hr.SetSetting(securityAdmin, "SiteName", "HR Library")
+		if !app.IsFailType(err, app.FailForbidden) {
+			t.Fatalf("Expected forbidden changing a setting as an admin of another tenant, got %v", err)
+		}
+		err = hr.SetSetting(hrAdmin, "SiteName", "HR Library")
+		if err != nil {
+			t.Fatalf("Error overriding setting: %s", err)
+		}
+		err = hr.SetSetting(hrAdmin, "SiteName", "HR Docs")
+		if err != nil {
+			t.Fatalf("Error overriding setting again: %s", err)
+		}
+		err = hr.SetSetting(hrAdmin, "NotASetting", "value")
+		if !app.IsFailType(err, app.FailNotFound) {
+			t.Fatalf("Expected not found failure for an invalid setting, got %v", err)
+		}
+
+		tenant, err := app.TenantGet(hr.ID)
+		if err != nil {
+			t.Fatalf("Error getting tenant: %s", err)
+		}
+		if tenant.Setting("SiteName") != "HR Docs" {
+			t.Fatalf("Tenant setting was not overridden: %s", tenant.Setting("SiteName"))
+		}
+
+		// other tenants can't see the override
+		tenant, err = app.TenantGet(security.ID)
+		if err != nil {
+			t.Fatalf("Error getting tenant: %s", err)
+		}
+		if tenant.Setting("SiteName") != "Lex Library" {
+			t.Fatalf("Tenant read another tenant's setting: %s", tenant.Setting("SiteName"))
+		}
+		def, err := app.DefaultTenant()
+		if err != nil {
+			t.Fatalf("Error getting default tenant: %s", err)
+		}
+		if def.Setting("SiteName") != "Lex Library" {
+			t.Fatalf("Default tenant read another tenant's setting: %s", def.Setting("SiteName"))
+		}
+
+		err = hr.ResetSetting(nil, "SiteName")
+		if !app.IsFailType(err, app.FailUnauthorized) {
+			t.Fatalf("Expected unauthorized resetting a setting without logging in, got %v", err)
+		}
+		err = hr.ResetSetting(hrAdmin, "SiteName")
+		if err != nil {
+			t.Fatalf("Error resetting setting: %s", err)
+		}
+		tenant, err = app.TenantGet(hr.ID)
+		if err != nil {
+			t.Fatalf("Error getting tenant: %s", err)
+		}
+		if tenant.Setting("SiteName") != "Lex Library" {
+			t.Fatalf("Tenant setting was not reset: %s", tenant.Setting("SiteName"))
+		}
+	})
+
+	t.Run("Each", func(t *testing.T) {
+		visited := make(map[string]bool)
+		err := app.EachTenant(func(tenant *app.Tenant) error {
+			visited[tenant.ID] = true
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Error visiting tenants: %s", err)
+		}
+		def, err := app.DefaultTenant()
+		if err != nil {
+			t.Fatalf("Error getting default tenant: %s", err)
+		}
+		if !visited[def.ID] || !visited[hr.ID] || !visited[security.ID] {
+			t.Fatalf("Not every tenant was visited: %v", visited)
+		}
+
+		count := 0
+		err = app.EachTenant(func(tenant *app.Tenant) error {
+			count++
+			if tenant.ID == hr.ID {
+				return nil
+			}
+			return app.NewFailure("failed")
+		})
+		errs, ok := err.(app.TenantErrors)
+		if !ok || len(errs) != 2 || count != 3 {
+			t.Fatalf("Visiting tenants didn't continue past errors: %v after %d tenants", err, count)
+		}
+		for _, e := range errs {
+			if e.TenantID == hr.ID || !app.IsFail(e.Err) {
+				t.Fatalf("Invalid tenant error: %v", e)
+			}
+		}
+	})
+}
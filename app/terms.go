@@ -0,0 +1,371 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"strings"
+	"unicode"
+)
+
+/*
+	Terms are the normalized words of a document used for tagging and search.  Text is split into words on
+	anything that isn't a letter or a number, lower cased, common English stopwords are removed, and each word is
+	reduced to its stem with the Porter stemming algorithm, so "publishing", "published" and "publishes" are all
+	the same term.
+*/
+
+const (
+	minTermLength = 3
+	maxTermLength = 64
+)
+
+// term is a stemmed word, along with the word as it was most often written, so it can be shown to users
+type term struct {
+	stem  string
+	word  string
+	count int
+}
+
+// termCounts counts the stemmed terms in the text, remembering the most common original form of each
+type termCounts struct {
+	terms map[string]*term
+	words map[string]map[string]int
+	total int
+}
+
+func newTermCounts() *termCounts {
+	return &termCounts{
+		terms: make(map[string]*term),
+		words: make(map[string]map[string]int),
+	}
+}
+
+// add counts every term in the text, weight times
+func (c *termCounts) add(text string, weight int) {
+	for _, word := range textWords(text) {
+		if isStopword(word) || len(word) > maxTermLength {
+			continue
+		}
+		stem := stemWord(word)
+		if len(stem) < minTermLength || len(stem) > maxTermLength {
+			continue
+		}
+
+		t, ok := c.terms[stem]
+		if !ok {
+			t = &term{stem: stem}
+			c.terms[stem] = t
+			c.words[stem] = make(map[string]int)
+		}
+		t.count += weight
+		c.total += weight
+
+		words := c.words[stem]
+		words[word] += weight
+		if t.word == "" || words[word] > words[t.word] || (words[word] == words[t.word] && word < t.word) {
+			t.word = word
+		}
+	}
+}
+
+// textWords returns the lower cased words in the text.  Numbers on their own aren't words
+func textWords(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	words := fields[:0]
+	for _, f := range fields {
+		if strings.IndexFunc(f, unicode.IsLetter) == -1 {
+			continue
+		}
+		words = append(words, f)
+	}
+	return words
+}
+
+func isStopword(word string) bool {
+	return len(word) < minTermLength || stopwords[word]
+}
+
+// stopwords are common English words that say nothing about what a document is about
+var stopwords = make(map[string]bool)
+
+func init() {
+	for _, word := range strings.Fields(`
+		about above across after afterwards again against all almost alone along already also although always
+		among amongst and another any anyhow anyone anything anyway anywhere are around because been before
+		beforehand behind being below beside besides between beyond both but can cannot could did does doing done
+		down during each either else elsewhere enough etc even ever every everyone everything everywhere except
+		few for former formerly from further had has have having hence her here hereafter hereby herein hers
+		herself him himself his how however into its itself just last latter least less many may meanwhile might
+		mine more moreover most mostly much must myself neither never nevertheless next nobody none noone nor not
+		nothing now nowhere off often once one only onto other others otherwise our ours ourselves out over own
+		per perhaps please rather same seem seemed seeming seems several she should since some somehow someone
+		something sometime sometimes somewhere still such than that the their theirs them themselves then thence
+		there thereafter thereby therefore therein thereupon these they this those though through throughout thru
+		thus together too toward towards under until upon use used using very via was well were what whatever
+		when whence whenever where whereafter whereas whereby wherein whereupon wherever whether which while
+		whither who whoever whole whom whose why will with within without would yet you your yours yourself
+		yourselves
+	`) {
+		stopwords[word] = true
+	}
+}
+
+// stemWord returns the stem of the lower cased word using the Porter stemming algorithm.  Words that aren't plain
+// ASCII letters are returned unchanged
+func stemWord(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+	for i := 0; i < len(word); i++ {
+		if word[i] < 'a' || word[i] > 'z' {
+			return word
+		}
+	}
+
+	s := &stemmer{b: []byte(word)}
+	s.step1ab()
+	s.step1c()
+	s.step2()
+	s.step3()
+	s.step4()
+	s.step5()
+	return string(s.b)
+}
+
+// stemmer holds the word being stemmed.  j marks the end of the stem when checking a suffix
+type stemmer struct {
+	b []byte
+	j int
+}
+
+// cons returns true if the letter at i is a consonant
+func (s *stemmer) cons(i int) bool {
+	switch s.b[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		if i == 0 {
+			return true
+		}
+		return !s.cons(i - 1)
+	}
+	return true
+}
+
+// m counts the vowel consonant sequences in the stem before j
+func (s *stemmer) m() int {
+	n := 0
+	i := 0
+	for {
+		if i > s.j {
+			return n
+		}
+		if !s.cons(i) {
+			break
+		}
+		i++
+	}
+	i++
+	for {
+		for {
+			if i > s.j {
+				return n
+			}
+			if s.cons(i) {
+				break
+			}
+			i++
+		}
+		i++
+		n++
+		for {
+			if i > s.j {
+				return n
+			}
+			if !s.cons(i) {
+				break
+			}
+			i++
+		}
+		i++
+	}
+}
+
+// vowelInStem returns true if the stem before j contains a vowel
+func (s *stemmer) vowelInStem() bool {
+	for i := 0; i <= s.j; i++ {
+		if !s.cons(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// doubleCons returns true if the letters at i and i-1 are the same consonant
+func (s *stemmer) doubleCons(i int) bool {
+	if i < 1 || s.b[i] != s.b[i-1] {
+		return false
+	}
+	return s.cons(i)
+}
+
+// cvc returns true if the letters ending at i are consonant vowel consonant, and the last consonant isn't w, x,
+// or y.  This is used to restore an e in words like hop(e), cav(e), and lov(e)
+func (s *stemmer) cvc(i int) bool {
+	if i < 2 || !s.cons(i) || s.cons(i-1) || !s.cons(i-2) {
+		return false
+	}
+	switch s.b[i] {
+	case 'w', 'x', 'y':
+		return false
+	}
+	return true
+}
+
+// ends returns true if the word ends with the suffix, and sets j to the end of the stem before it
+func (s *stemmer) ends(suffix string) bool {
+	if len(suffix) > len(s.b) || string(s.b[len(s.b)-len(suffix):]) != suffix {
+		return false
+	}
+	s.j = len(s.b) - len(suffix) - 1
+	return true
+}
+
+// setTo replaces everything after j with the value
+func (s *stemmer) setTo(value string) {
+	s.b = append(s.b[:s.j+1], value...)
+}
+
+// replace replaces the suffix after j with the value if the stem has at least one vowel consonant sequence
+func (s *stemmer) replace(value string) {
+	if s.m() > 0 {
+		s.setTo(value)
+	}
+}
+
+// step1ab removes plurals and -ed or -ing
+func (s *stemmer) step1ab() {
+	if s.b[len(s.b)-1] == 's' {
+		switch {
+		case s.ends("sses"):
+			s.b = s.b[:len(s.b)-2]
+		case s.ends("ies"):
+			s.setTo("i")
+		case len(s.b) > 1 && s.b[len(s.b)-2] != 's':
+			s.b = s.b[:len(s.b)-1]
+		}
+	}
+
+	if s.ends("eed") {
+		if s.m() > 0 {
+			s.b = s.b[:len(s.b)-1]
+		}
+		return
+	}
+	if !((s.ends("ed") || s.ends("ing")) && s.vowelInStem()) {
+		return
+	}
+
+	s.b = s.b[:s.j+1]
+	switch {
+	case s.ends("at"):
+		s.setTo("ate")
+	case s.ends("bl"):
+		s.setTo("ble")
+	case s.ends("iz"):
+		s.setTo("ize")
+	case s.doubleCons(len(s.b) - 1):
+		switch s.b[len(s.b)-1] {
+		case 'l', 's', 'z':
+		default:
+			s.b = s.b[:len(s.b)-1]
+		}
+	default:
+		s.j = len(s.b) - 1
+		if s.m() == 1 && s.cvc(len(s.b)-1) {
+			s.b = append(s.b, 'e')
+		}
+	}
+}
+
+// step1c turns a terminal y into i when there is another vowel in the stem
+func (s *stemmer) step1c() {
+	if s.ends("y") && s.vowelInStem() {
+		s.b[len(s.b)-1] = 'i'
+	}
+}
+
+// suffixRule replaces a suffix with a shorter one
+type suffixRule struct {
+	suffix  string
+	replace string
+}
+
+var step2Rules = []suffixRule{
+	{"ational", "ate"}, {"tional", "tion"}, {"enci", "ence"}, {"anci", "ance"}, {"izer", "ize"}, {"bli", "ble"},
+	{"alli", "al"}, {"entli", "ent"}, {"eli", "e"}, {"ousli", "ous"}, {"ization", "ize"}, {"ation", "ate"},
+	{"ator", "ate"}, {"alism", "al"}, {"iveness", "ive"}, {"fulness", "ful"}, {"ousness", "ous"}, {"aliti", "al"},
+	{"iviti", "ive"}, {"biliti", "ble"}, {"logi", "log"},
+}
+
+var step3Rules = []suffixRule{
+	{"icate", "ic"}, {"ative", ""}, {"alize", "al"}, {"iciti", "ic"}, {"ical", "ic"}, {"ful", ""}, {"ness", ""},
+}
+
+var step4Suffixes = []string{
+	"al", "ance", "ence", "er", "ic", "able", "ible", "ant", "ement", "ment", "ent", "ion", "ou", "ism", "ate",
+	"iti", "ous", "ive", "ize",
+}
+
+// step2 maps double suffixes to single ones, so -ization becomes -ize
+func (s *stemmer) step2() {
+	s.applyRules(step2Rules)
+}
+
+// step3 handles -ic-, -full, -ness etc.
+func (s *stemmer) step3() {
+	s.applyRules(step3Rules)
+}
+
+func (s *stemmer) applyRules(rules []suffixRule) {
+	for _, r := range rules {
+		if s.ends(r.suffix) {
+			s.replace(r.replace)
+			return
+		}
+	}
+}
+
+// step4 removes -ant, -ence etc. from stems with more than one vowel consonant sequence
+func (s *stemmer) step4() {
+	for _, suffix := range step4Suffixes {
+		if !s.ends(suffix) {
+			continue
+		}
+		if suffix == "ion" && (s.j < 0 || (s.b[s.j] != 's' && s.b[s.j] != 't')) {
+			return
+		}
+		if s.m() > 1 {
+			s.b = s.b[:s.j+1]
+		}
+		return
+	}
+}
+
+// step5 removes a final -e and changes -ll to -l in longer stems
+func (s *stemmer) step5() {
+	s.j = len(s.b) - 1
+	if s.b[len(s.b)-1] == 'e' {
+		a := s.m()
+		if a > 1 || (a == 1 && !s.cvc(len(s.b)-2)) {
+			s.b = s.b[:len(s.b)-1]
+		}
+	}
+	s.j = len(s.b) - 1
+	if s.b[len(s.b)-1] == 'l' && s.doubleCons(len(s.b)-1) && s.m() > 1 {
+		s.b = s.b[:len(s.b)-1]
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"bytes"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// blockElements are the elements that start a new line of text
+var blockElements = map[atom.Atom]bool{
+	atom.Address:    true,
+	atom.Article:    true,
+	atom.Aside:      true,
+	atom.Blockquote: true,
+	atom.Br:         true,
+	atom.Dd:         true,
+	atom.Div:        true,
+	atom.Dl:         true,
+	atom.Dt:         true,
+	atom.Figcaption: true,
+	atom.Figure:     true,
+	atom.Footer:     true,
+	atom.H1:         true,
+	atom.H2:         true,
+	atom.H3:         true,
+	atom.H4:         true,
+	atom.H5:         true,
+	atom.H6:         true,
+	atom.Header:     true,
+	atom.Hr:         true,
+	atom.Li:         true,
+	atom.Ol:         true,
+	atom.P:          true,
+	atom.Pre:        true,
+	atom.Section:    true,
+	atom.Table:      true,
+	atom.Tr:         true,
+	atom.Ul:         true,
+}
+
+// htmlToText returns the plain text of a document's HTML body, with each block of text (paragraphs, headings,
+// list items, etc) on its own line, and whitespace collapsed outside of preformatted blocks
+func htmlToText(body string) string {
+	z := html.NewTokenizer(strings.NewReader(body))
+
+	var lines []string
+	line := &bytes.Buffer{}
+	pre := 0
+	skip := 0
+
+	endLine := func() {
+		text := line.String()
+		if pre == 0 {
+			text = strings.Join(strings.Fields(text), " ")
+		}
+		if strings.TrimSpace(text) != "" {
+			lines = append(lines, text)
+		}
+		line.Reset()
+	}
+
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			endLine()
+			return strings.Join(lines, "\n")
+		case html.TextToken:
+			if skip > 0 {
+				continue
+			}
+			text := string(z.Text())
+			if pre > 0 {
+				// each line of preformatted text is kept as its own line
+				parts := strings.Split(text, "\n")
+				for i := range parts {
+					if i > 0 {
+						endLine()
+					}
+					line.WriteString(parts[i])
+				}
+				continue
+			}
+			line.WriteString(text)
+		case html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			a := atom.Lookup(name)
+			switch a {
+			case atom.Script, atom.Style, atom.Head, atom.Template:
+				if tt == html.StartTagToken {
+					skip++
+				} else if tt == html.EndTagToken && skip > 0 {
+					skip--
+				}
+				continue
+			case atom.Pre:
+				endLine()
+				if tt == html.StartTagToken {
+					pre++
+				} else if tt == html.EndTagToken && pre > 0 {
+					pre--
+				}
+				continue
+			case atom.Img:
+				if alt := attr(z, "alt"); alt != "" && skip == 0 {
+					line.WriteString(" " + alt + " ")
+				}
+				continue
+			}
+			if blockElements[a] {
+				endLine()
+			} else if pre == 0 && (a == atom.Td || a == atom.Th) {
+				line.WriteString(" ")
+			}
+		}
+	}
+}
+
+// attr returns the value of the attribute on the current tag of the tokenizer
+func attr(z *html.Tokenizer, name string) string {
+	for {
+		key, val, more := z.TagAttr()
+		if string(key) == name {
+			return string(val)
+		}
+		if !more {
+			return ""
+		}
+	}
+}
@@ -0,0 +1,670 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lexLibrary/lexLibrary/data"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/text/unicode/norm"
+)
+
+/*
+	Users belong to a single tenant, and their usernames and emails are unique within that tenant, ignoring case.
+	The lowercase keys of the username and email are stored separately from the values the user entered, so that
+	uniqueness is enforced by the same index on every database, no matter its collation.
+
+	Passwords are hashed with bcrypt.  If the cost of a user's stored hash is lower than the current cost, the
+	password is rehashed the next time the user logs in.
+
+	After LoginThrottleAttempts failed logins in a row, the user has to wait before trying again, and the wait
+	doubles with each failure.  After LoginLockAttempts failed logins in a row, the account is locked until an
+	administrator unlocks it.  A disabled account can't log in at all.
+*/
+
+const (
+	passwordCost       = 12
+	maxPasswordLength  = 72 // bcrypt ignores anything longer
+	maxUsernameLength  = 64
+	maxEmailLength     = 255
+	maxLoginThrottle   = time.Hour
+	invalidLoginReason = "Invalid username or password"
+)
+
+var usernamePattern = regexp.MustCompile(`^[\p{L}\p{N}._-]+$`)
+
+// User is a person who can log in to a tenant's library
+type User struct {
+	ID           string
+	TenantID     string
+	Username     string
+	Name         string
+	Email        string
+	Admin        bool // tenant administrator
+	Disabled     bool
+	Locked       bool
+	FailedLogins int
+	LastLogin    time.Time // zero if the user has never logged in
+	Version      int
+	Created      time.Time
+	Updated      time.Time
+}
+
+var (
+	sqlUserInsert = data.NewQuery(`
+		insert into users (tenant_id, id, username, username_key, name, email, email_key, password, admin, disabled,
+			locked, failed_logins, version, created, updated, first_of_tenant)
+		values ({{tenant}}, {{arg "id"}}, {{arg "username"}}, {{arg "username_key"}}, {{arg "name"}}, {{arg "email"}},
+			{{arg "email_key"}}, {{arg "password"}}, {{arg "admin"}}, 0, 0, 0, {{arg "version"}}, {{arg "created"}},
+			{{arg "updated"}}, {{arg "first_of_tenant"}})
+	`)
+	sqlUserColumns = `id, tenant_id, username, name, email, admin, disabled, locked, failed_logins, last_failed,
+		last_login, version, created, updated, password`
+	sqlUserGet = data.NewQuery(`
+		select ` + sqlUserColumns + ` from users where tenant_id = {{tenant}} and id = {{arg "id"}}
+	`)
+	sqlUserFromUsername = data.NewQuery(`
+		select ` + sqlUserColumns + ` from users
+		where tenant_id = {{tenant}} and username_key = {{arg "username_key"}}
+	`)
+	sqlUserFromEmail = data.NewQuery(`
+		select ` + sqlUserColumns + ` from users
+		where tenant_id = {{tenant}} and email_key = {{arg "email_key"}}
+	`)
+	sqlUserUpdate = data.NewQuery(`
+		update users set
+			username = {{arg "username"}},
+			username_key = {{arg "username_key"}},
+			name = {{arg "name"}},
+			email = {{arg "email"}},
+			email_key = {{arg "email_key"}},
+			admin = {{arg "admin"}},
+			disabled = {{arg "disabled"}},
+			locked = {{arg "locked"}},
+			failed_logins = {{arg "failed_logins"}},
+			version = version + 1,
+			updated = {{arg "updated"}}
+		where tenant_id = {{tenant}} and id = {{arg "id"}} and version = {{arg "version"}}
+	`)
+	sqlUserUpdatePassword = data.NewQuery(`
+		update users set password = {{arg "password"}}
+		where tenant_id = {{tenant}} and id = {{arg "id"}}
+	`)
+	sqlUserLoginFailed = data.NewQuery(`
+		update users set
+			failed_logins = {{arg "failed_logins"}},
+			locked = {{arg "locked"}},
+			last_failed = {{arg "last_failed"}}
+		where tenant_id = {{tenant}} and id = {{arg "id"}}
+	`)
+	sqlUserLoginSucceeded = data.NewQuery(`
+		update users set failed_logins = 0, last_login = {{arg "last_login"}}
+		where tenant_id = {{tenant}} and id = {{arg "id"}}
+	`)
+	sqlUserCount = data.NewQuery(`
+		select count(*) from users where tenant_id = {{tenant}}
+	`)
+	sqlUserConflicts = data.NewQuery(`
+		select username_key, email_key from users
+		where tenant_id = {{tenant}} and id <> {{arg "id"}}
+		and (username_key = {{arg "username_key"}} or email_key = {{arg "email_key"}})
+	`)
+)
+
+// userLogin is the login state of a user that is never exposed outside of this package
+type userLogin struct {
+	password   string
+	lastFailed time.Time
+}
+
+// UserNew creates a new user in the tenant.  The first user in a tenant is its administrator, even when several
+// users are created in an empty tenant at once
+func UserNew(tenant *Tenant, username, password string) (*User, error) {
+	u := &User{
+		ID:       newID(),
+		TenantID: tenant.ID,
+		Username: strings.TrimSpace(username),
+		Version:  1,
+		Created:  time.Now(),
+	}
+	u.Updated = u.Created
+
+	err := u.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := hashPassword(tenant, password)
+	if err != nil {
+		return nil, err
+	}
+
+	insert := func(tx *sql.Tx) error {
+		err := u.checkConflicts(tx)
+		if err != nil {
+			return err
+		}
+
+		count := 0
+		err = sqlUserCount.Tx(tx).Tenant(u.TenantID).QueryRow().Scan(&count)
+		if err != nil {
+			return err
+		}
+		u.Admin = count == 0
+		first := ""
+		if u.Admin {
+			first = u.TenantID
+		}
+
+		_, err = sqlUserInsert.Tx(tx).Tenant(u.TenantID).Exec(
+			sql.Named("id", u.ID),
+			sql.Named("username", u.Username),
+			sql.Named("username_key", userKey(u.Username)),
+			sql.Named("name", nullString(u.Name)),
+			sql.Named("email", nullString(u.Email)),
+			sql.Named("email_key", nullString(userKey(u.Email))),
+			sql.Named("password", hash),
+			sql.Named("admin", boolInt(u.Admin)),
+			sql.Named("version", u.Version),
+			sql.Named("created", u.Created),
+			sql.Named("updated", u.Updated),
+			sql.Named("first_of_tenant", nullString(first)),
+		)
+		return err
+	}
+
+	err = data.BeginTx(insert)
+	if err != nil && u.Admin {
+		// The first user of a tenant is unique, so if another user was created in the empty tenant at the same
+		// time, only one of them is inserted as the administrator.  The other is tried again, and isn't the first
+		err = data.BeginTx(insert)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// UserGet retrieves a user by their id
+func UserGet(tenant *Tenant, id string) (*User, error) {
+	u, _, err := userGet(nil, tenant.ID, id)
+	return u, err
+}
+
+// UserFromUsername retrieves a user by their username, ignoring case
+func UserFromUsername(tenant *Tenant, username string) (*User, error) {
+	u, _, err := scanUser(sqlUserFromUsername.Tenant(tenant.ID).QueryRow(
+		sql.Named("username_key", userKey(strings.TrimSpace(username)))))
+	return u, err
+}
+
+// userFromEmail retrieves a user by their email address, ignoring case
+func userFromEmail(tenant *Tenant, email string) (*User, error) {
+	u, _, err := scanUser(sqlUserFromEmail.Tenant(tenant.ID).QueryRow(
+		sql.Named("email_key", userKey(strings.TrimSpace(email)))))
+	return u, err
+}
+
+func userGet(tx *sql.Tx, tenantID, id string) (*User, *userLogin, error) {
+	return scanUser(sqlUserGet.Tx(tx).Tenant(tenantID).QueryRow(sql.Named("id", id)))
+}
+
+func scanUser(row scanner) (*User, *userLogin, error) {
+	u := &User{}
+	login := &userLogin{}
+	var name, email sql.NullString
+	var admin, disabled, locked int
+	var lastFailed, lastLogin *time.Time
+
+	err := row.Scan(
+		&u.ID,
+		&u.TenantID,
+		&u.Username,
+		&name,
+		&email,
+		&admin,
+		&disabled,
+		&locked,
+		&u.FailedLogins,
+		&lastFailed,
+		&lastLogin,
+		&u.Version,
+		&u.Created,
+		&u.Updated,
+		&login.password,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil, NotFound("User not found")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	u.Name = name.String
+	u.Email = email.String
+	u.Admin = admin != 0
+	u.Disabled = disabled != 0
+	u.Locked = locked != 0
+	if lastLogin != nil {
+		u.LastLogin = *lastLogin
+	}
+	if lastFailed != nil {
+		login.lastFailed = *lastFailed
+	}
+	return u, login, nil
+}
+
+// UserLogin checks the username and password, and returns the user if they are allowed to log in
+func UserLogin(tenant *Tenant, username, password string) (*User, error) {
+	u, login, err := scanUser(sqlUserFromUsername.Tenant(tenant.ID).QueryRow(
+		sql.Named("username_key", userKey(strings.TrimSpace(username)))))
+	if IsFailType(err, FailNotFound) {
+		// compare against a hash anyway so the response takes as long as it would for a real user, and doesn't
+		// give away which usernames exist
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return nil, Unauthorized(invalidLoginReason)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the password is always checked before the state of the account is given away, so only someone who knows
+	// the password can tell that an account is disabled or locked.  Throttled attempts are rejected whether or
+	// not the password matches, otherwise they could still be used to guess it
+	err = bcrypt.CompareHashAndPassword([]byte(login.password), []byte(password))
+	if err != nil && err != bcrypt.ErrMismatchedHashAndPassword {
+		return nil, err
+	}
+	if wait := u.loginWait(tenant, login); wait > 0 {
+		return nil, Unauthorized(fmt.Sprintf("Too many failed login attempts. Try again in %s",
+			wait.Round(time.Second)))
+	}
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		err = u.loginFailed(tenant)
+		if err != nil {
+			return nil, err
+		}
+		return nil, Unauthorized(invalidLoginReason)
+	}
+
+	if u.Disabled {
+		return nil, Unauthorized("This account has been disabled")
+	}
+	if u.Locked {
+		return nil, Unauthorized("This account has been locked because of too many failed login attempts. " +
+			"Contact an administrator to unlock it")
+	}
+
+	u.FailedLogins = 0
+	u.LastLogin = time.Now()
+	_, err = sqlUserLoginSucceeded.Tenant(u.TenantID).Exec(
+		sql.Named("id", u.ID),
+		sql.Named("last_login", u.LastLogin),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if cost, err := bcrypt.Cost([]byte(login.password)); err != nil || cost < passwordCost {
+		// the login is still valid if the hash can't be upgraded, it'll be tried again on the next login
+		err = u.setPassword(password)
+		if err != nil {
+			LogError(fmt.Errorf("Error upgrading password hash for user %s: %s", u.ID, err))
+		}
+	}
+
+	return u, nil
+}
+
+// loginWait returns how long the user has to wait before they can attempt another login
+func (u *User) loginWait(tenant *Tenant, login *userLogin) time.Duration {
+	attempts := tenant.settingInt("LoginThrottleAttempts")
+	if attempts == 0 || u.FailedLogins < attempts {
+		return 0
+	}
+
+	wait := time.Duration(tenant.settingInt("LoginThrottleSeconds")) * time.Second
+	for i := attempts; i < u.FailedLogins && wait < maxLoginThrottle; i++ {
+		wait *= 2
+	}
+	if wait > maxLoginThrottle {
+		wait = maxLoginThrottle
+	}
+
+	return login.lastFailed.Add(wait).Sub(time.Now())
+}
+
+func (u *User) loginFailed(tenant *Tenant) error {
+	return data.BeginTx(func(tx *sql.Tx) error {
+		// reload the user so concurrent failures are all counted
+		current, _, err := userGet(tx, u.TenantID, u.ID)
+		if err != nil {
+			return err
+		}
+
+		current.FailedLogins++
+		lock := tenant.settingInt("LoginLockAttempts")
+		if lock > 0 && current.FailedLogins >= lock {
+			current.Locked = true
+		}
+
+		_, err = sqlUserLoginFailed.Tx(tx).Tenant(u.TenantID).Exec(
+			sql.Named("id", u.ID),
+			sql.Named("failed_logins", current.FailedLogins),
+			sql.Named("locked", boolInt(current.Locked)),
+			sql.Named("last_failed", time.Now()),
+		)
+		return err
+	})
+}
+
+// SetPassword changes the user's password.  The user's current password is required
+func (u *User) SetPassword(tenant *Tenant, oldPassword, newPassword string) error {
+	_, login, err := userGet(nil, u.TenantID, u.ID)
+	if err != nil {
+		return err
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(login.password), []byte(oldPassword))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return Unauthorized("The current password is incorrect")
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = validatePassword(tenant, newPassword); err != nil {
+		return err
+	}
+	return u.setPassword(newPassword)
+}
+
+func (u *User) setPassword(password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return err
+	}
+	_, err = sqlUserUpdatePassword.Tenant(u.TenantID).Exec(
+		sql.Named("id", u.ID),
+		sql.Named("password", string(hash)),
+	)
+	return err
+}
+
+// SetUsername changes the user's username
+func (u *User) SetUsername(who *User, username string) error {
+	err := u.canChange(who)
+	if err != nil {
+		return err
+	}
+	return u.change(func(changed *User) {
+		changed.Username = strings.TrimSpace(username)
+	})
+}
+
+// SetName changes the user's display name
+func (u *User) SetName(who *User, name string) error {
+	err := u.canChange(who)
+	if err != nil {
+		return err
+	}
+	return u.change(func(changed *User) {
+		changed.Name = strings.TrimSpace(name)
+	})
+}
+
+// SetEmail changes the user's email address.  An empty email removes the user's email address
+func (u *User) SetEmail(who *User, email string) error {
+	err := u.canChange(who)
+	if err != nil {
+		return err
+	}
+	return u.change(func(changed *User) {
+		changed.Email = strings.TrimSpace(email)
+	})
+}
+
+// SetAdmin makes the user a tenant administrator, or removes them as one
+func (u *User) SetAdmin(who *User, admin bool) error {
+	err := u.canAdmin(who)
+	if err != nil {
+		return err
+	}
+	if who.ID == u.ID && !admin {
+		return NewFailure("You can't remove yourself as an administrator")
+	}
+	return u.change(func(changed *User) {
+		changed.Admin = admin
+	})
+}
+
+// Disable prevents the user from logging in, and ends all of their sessions.  Users can disable their own account
+func (u *User) Disable(who *User) error {
+	err := u.canChange(who)
+	if err != nil {
+		return err
+	}
+	err = u.change(func(changed *User) {
+		changed.Disabled = true
+	})
+	if err != nil {
+		return err
+	}
+	return u.LogoutEverywhere()
+}
+
+// Enable allows a disabled user to log in again.  Only administrators can enable a user
+func (u *User) Enable(who *User) error {
+	err := u.canAdmin(who)
+	if err != nil {
+		return err
+	}
+	return u.change(func(changed *User) {
+		changed.Disabled = false
+	})
+}
+
+// Lock prevents the user from logging in until they are unlocked, and ends all of their sessions.  Users can lock
+// their own account
+func (u *User) Lock(who *User) error {
+	err := u.canChange(who)
+	if err != nil {
+		return err
+	}
+	err = u.change(func(changed *User) {
+		changed.Locked = true
+	})
+	if err != nil {
+		return err
+	}
+	return u.LogoutEverywhere()
+}
+
+// Unlock allows a locked user to log in again, and clears their failed login attempts.  Only administrators can
+// unlock a user
+func (u *User) Unlock(who *User) error {
+	err := u.canAdmin(who)
+	if err != nil {
+		return err
+	}
+	return u.change(func(changed *User) {
+		changed.Locked = false
+		changed.FailedLogins = 0
+	})
+}
+
+// canChange returns nil if who is the user, or an administrator of the user's tenant
+func (u *User) canChange(who *User) error {
+	if who != nil && who.ID == u.ID && who.TenantID == u.TenantID {
+		return nil
+	}
+	return u.canAdmin(who)
+}
+
+// canAdmin returns nil if who is an administrator of the user's tenant
+func (u *User) canAdmin(who *User) error {
+	if who == nil {
+		return Unauthorized("You must log in")
+	}
+	return Can(who, PermissionAdmin, &Tenant{ID: u.TenantID})
+}
+
+// change applies the changes to a copy of the user, and only keeps them if they were written successfully.  If the
+// user was changed since it was loaded, the change fails with a conflict
+func (u *User) change(fn func(changed *User)) error {
+	changed := *u
+	fn(&changed)
+	changed.Updated = time.Now()
+
+	err := changed.validate()
+	if err != nil {
+		return err
+	}
+
+	err = data.BeginTx(func(tx *sql.Tx) error {
+		err := changed.checkConflicts(tx)
+		if err != nil {
+			return err
+		}
+
+		result, err := sqlUserUpdate.Tx(tx).Tenant(changed.TenantID).Exec(
+			sql.Named("id", changed.ID),
+			sql.Named("username", changed.Username),
+			sql.Named("username_key", userKey(changed.Username)),
+			sql.Named("name", nullString(changed.Name)),
+			sql.Named("email", nullString(changed.Email)),
+			sql.Named("email_key", nullString(userKey(changed.Email))),
+			sql.Named("admin", boolInt(changed.Admin)),
+			sql.Named("disabled", boolInt(changed.Disabled)),
+			sql.Named("locked", boolInt(changed.Locked)),
+			sql.Named("failed_logins", changed.FailedLogins),
+			sql.Named("updated", changed.Updated),
+			sql.Named("version", changed.Version),
+		)
+		if err != nil {
+			return err
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rows == 0 {
+			return Conflict("The user has been changed since it was loaded. Reload the user and try again")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	changed.Version++
+	*u = changed
+	return nil
+}
+
+func (u *User) validate() error {
+	if u.Username == "" {
+		return NewFailure("A username is required")
+	}
+	if len(u.Username) > maxUsernameLength {
+		return NewFailure(fmt.Sprintf("A username can't be longer than %d characters", maxUsernameLength))
+	}
+	if !usernamePattern.MatchString(u.Username) {
+		return NewFailure("A username can only contain letters, numbers, periods, dashes and underscores")
+	}
+
+	if u.Email != "" {
+		if len(u.Email) > maxEmailLength {
+			return NewFailure(fmt.Sprintf("An email address can't be longer than %d characters", maxEmailLength))
+		}
+		at := strings.LastIndex(u.Email, "@")
+		if at < 1 || at == len(u.Email)-1 || strings.ContainsAny(u.Email, " \t\r\n") {
+			return NewFailure("Invalid email address")
+		}
+	}
+	return nil
+}
+
+func (u *User) checkConflicts(tx *sql.Tx) error {
+	usernameKey := userKey(u.Username)
+	emailKey := userKey(u.Email)
+
+	rows, err := sqlUserConflicts.Tx(tx).Tenant(u.TenantID).Query(
+		sql.Named("id", u.ID),
+		sql.Named("username_key", usernameKey),
+		sql.Named("email_key", nullString(emailKey)),
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var otherUsername, otherEmail sql.NullString
+		err = rows.Scan(&otherUsername, &otherEmail)
+		if err != nil {
+			return err
+		}
+		if otherUsername.String == usernameKey {
+			return Conflict("The username " + u.Username + " is already taken")
+		}
+		return Conflict("Another user is already using the email address " + u.Email)
+	}
+	return rows.Err()
+}
+
+func validatePassword(tenant *Tenant, password string) error {
+	min := tenant.settingInt("PasswordMinLength")
+	if len([]rune(password)) < min {
+		return NewFailure(fmt.Sprintf("A password must be at least %d characters long", min))
+	}
+	if len(password) > maxPasswordLength {
+		return NewFailure(fmt.Sprintf("A password can't be longer than %d bytes", maxPasswordLength))
+	}
+	return nil
+}
+
+func hashPassword(tenant *Tenant, password string) (string, error) {
+	err := validatePassword(tenant, password)
+	if err != nil {
+		return "", err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+var dummy struct {
+	once sync.Once
+	hash []byte
+}
+
+// dummyHash returns a password hash that doesn't match any password, for comparing against when a user doesn't exist
+func dummyHash() []byte {
+	dummy.once.Do(func() {
+		var err error
+		dummy.hash, err = bcrypt.GenerateFromPassword([]byte(newID()), passwordCost)
+		if err != nil {
+			panic(fmt.Sprintf("Error generating dummy password hash: %s", err))
+		}
+	})
+	return dummy.hash
+}
+
+// userKey returns the case insensitive form of a username or email, used for checking uniqueness
+func userKey(value string) string {
+	return strings.ToLower(norm.NFKC.String(value))
+}
+
+func boolInt(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
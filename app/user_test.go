@@ -0,0 +1,421 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app_test
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lexLibrary/lexLibrary/app"
+	"github.com/lexLibrary/lexLibrary/data"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func resetUsers(t *testing.T) {
+	_, err := data.NewQuery("delete from users").Exec()
+	if err != nil {
+		t.Fatalf("Error emptying users table before running tests: %s", err)
+	}
+}
+
+func testUser(t *testing.T, tenant *app.Tenant, username string) *app.User {
+	user, err := app.UserNew(tenant, username, "test user password")
+	if err != nil {
+		t.Fatalf("Error creating user %s: %s", username, err)
+	}
+	return user
+}
+
+// installAdmin returns an administrator of the default tenant, who can create other tenants.  Only the first user
+// of a tenant is its administrator, so the default tenant has to be empty the first time it's called after the
+// users are reset
+func installAdmin(t *testing.T) *app.User {
+	tenant, err := app.DefaultTenant()
+	if err != nil {
+		t.Fatalf("Error getting default tenant: %s", err)
+	}
+	user, err := app.UserFromUsername(tenant, "installadmin")
+	if app.IsFailType(err, app.FailNotFound) {
+		user, err = app.UserNew(tenant, "installadmin", "test user password")
+	}
+	if err != nil {
+		t.Fatalf("Error getting default tenant administrator: %s", err)
+	}
+	if !user.Admin {
+		t.Fatalf("The default tenant already had users, so its administrator couldn't be created")
+	}
+	return user
+}
+
+func TestUser(t *testing.T) {
+	resetUsers(t)
+
+	tenant, err := app.TenantNew(installAdmin(t), "User Tenant", "", "")
+	if err != nil {
+		t.Fatalf("Error creating tenant: %s", err)
+	}
+
+	const password = "correct horse battery"
+	var user *app.User
+
+	t.Run("New", func(t *testing.T) {
+		_, err := app.UserNew(tenant, "bad name", password)
+		if !app.IsFailType(err, app.FailInvalid) {
+			t.Fatalf("Expected invalid failure for a username with a space, got %v", err)
+		}
+		_, err = app.UserNew(tenant, "shortpassword", "short")
+		if !app.IsFailType(err, app.FailInvalid) {
+			t.Fatalf("Expected invalid failure for a short password, got %v", err)
+		}
+		_, err = app.UserNew(tenant, "longpassword", strings.Repeat("a", 73))
+		if !app.IsFailType(err, app.FailInvalid) {
+			t.Fatalf("Expected invalid failure for a long password, got %v", err)
+		}
+
+		user, err = app.UserNew(tenant, "Ärger.Test", password)
+		if err != nil {
+			t.Fatalf("Error creating user: %s", err)
+		}
+
+		got, err := app.UserFromUsername(tenant, "ärger.test")
+		if err != nil {
+			t.Fatalf("Error getting user by username: %s", err)
+		}
+		if got.ID != user.ID || got.Username != "Ärger.Test" {
+			t.Fatalf("Invalid user retrieved: %+v", got)
+		}
+
+		_, err = app.UserNew(tenant, "ÄRGER.test", password)
+		if !app.IsFailType(err, app.FailConflict) {
+			t.Fatalf("Expected conflict for a username differing only by case, got %v", err)
+		}
+
+		other, err := app.TenantNew(installAdmin(t), "Other User Tenant", "", "")
+		if err != nil {
+			t.Fatalf("Error creating tenant: %s", err)
+		}
+		_, err = app.UserNew(other, "Ärger.Test", password)
+		if err != nil {
+			t.Fatalf("Username was not unique per tenant: %s", err)
+		}
+		_, err = app.UserGet(other, user.ID)
+		if !app.IsFailType(err, app.FailNotFound) {
+			t.Fatalf("Tenant was able to read another tenant's user: %v", err)
+		}
+	})
+
+	t.Run("First Admin", func(t *testing.T) {
+		empty, err := app.TenantNew(installAdmin(t), "Empty User Tenant", "", "")
+		if err != nil {
+			t.Fatalf("Error creating tenant: %s", err)
+		}
+
+		users := make(chan *app.User, 5)
+		errs := make(chan error, 5)
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				u, err := app.UserNew(empty, "first"+strconv.Itoa(i), password)
+				if err != nil {
+					errs <- err
+					return
+				}
+				users <- u
+			}(i)
+		}
+		wg.Wait()
+		close(users)
+		close(errs)
+
+		for err := range errs {
+			t.Fatalf("Error creating user: %s", err)
+		}
+		admins := 0
+		for u := range users {
+			if u.Admin {
+				admins++
+			}
+		}
+		if admins != 1 {
+			t.Fatalf("Users created at once in an empty tenant made %d administrators", admins)
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		err := user.SetEmail(user, "Test@Example.com")
+		if err != nil {
+			t.Fatalf("Error setting email: %s", err)
+		}
+		err = user.SetName(user, "Test User")
+		if err != nil {
+			t.Fatalf("Error setting name: %s", err)
+		}
+
+		second, err := app.UserNew(tenant, "second", password)
+		if err != nil {
+			t.Fatalf("Error creating user: %s", err)
+		}
+		err = second.SetEmail(second, "test@EXAMPLE.com")
+		if !app.IsFailType(err, app.FailConflict) {
+			t.Fatalf("Expected conflict for an email differing only by case, got %v", err)
+		}
+		err = second.SetEmail(second, "not an email")
+		if !app.IsFailType(err, app.FailInvalid) {
+			t.Fatalf("Expected invalid failure for an invalid email, got %v", err)
+		}
+		err = second.SetUsername(user, "ärger.TEST")
+		if !app.IsFailType(err, app.FailConflict) {
+			t.Fatalf("Expected conflict changing to a taken username, got %v", err)
+		}
+
+		stale, err := app.UserGet(tenant, user.ID)
+		if err != nil {
+			t.Fatalf("Error getting user: %s", err)
+		}
+		if stale.Email != "Test@Example.com" || stale.Name != "Test User" {
+			t.Fatalf("User changes were not saved: %+v", stale)
+		}
+		err = user.SetName(user, "Changed")
+		if err != nil {
+			t.Fatalf("Error setting name: %s", err)
+		}
+		err = stale.SetName(user, "Stale")
+		if !app.IsFailType(err, app.FailConflict) {
+			t.Fatalf("Expected conflict changing a stale user, got %v", err)
+		}
+	})
+
+	t.Run("Permissions", func(t *testing.T) {
+		second, err := app.UserFromUsername(tenant, "second")
+		if err != nil {
+			t.Fatalf("Error getting user: %s", err)
+		}
+		err = second.SetName(second, "Second User")
+		if err != nil {
+			t.Fatalf("Error changing own name: %s", err)
+		}
+
+		user, err = app.UserGet(tenant, user.ID)
+		if err != nil {
+			t.Fatalf("Error getting user: %s", err)
+		}
+		for name, change := range map[string]func() error{
+			"Set Username": func() error { return user.SetUsername(second, "taken.over") },
+			"Set Name":     func() error { return user.SetName(second, "Taken Over") },
+			"Set Email":    func() error { return user.SetEmail(second, "taken@example.com") },
+			"Disable":      func() error { return user.Disable(second) },
+			"Lock":         func() error { return user.Lock(second) },
+			"Enable":       func() error { return second.Enable(second) },
+			"Unlock":       func() error { return second.Unlock(second) },
+		} {
+			err = change()
+			if !app.IsFailType(err, app.FailForbidden) {
+				t.Fatalf("Expected forbidden for %s by a user who isn't an administrator, got %v", name, err)
+			}
+		}
+
+		err = user.SetName(nil, "Anonymous")
+		if !app.IsFailType(err, app.FailUnauthorized) {
+			t.Fatalf("Expected unauthorized changing a user without logging in, got %v", err)
+		}
+
+		other, err := app.TenantNew(installAdmin(t), "Other Admin Tenant", "", "")
+		if err != nil {
+			t.Fatalf("Error creating tenant: %s", err)
+		}
+		otherAdmin := testUser(t, other, "otheradmin")
+		err = second.SetName(otherAdmin, "Other Tenant")
+		if !app.IsFailType(err, app.FailForbidden) {
+			t.Fatalf("Expected forbidden changing a user in another tenant, got %v", err)
+		}
+
+		err = second.SetName(user, "Changed By Admin")
+		if err != nil {
+			t.Fatalf("Error changing a user as an administrator: %s", err)
+		}
+	})
+
+	t.Run("Login", func(t *testing.T) {
+		got, err := app.UserLogin(tenant, " ÄRGER.TEST ", password)
+		if err != nil {
+			t.Fatalf("Error logging in: %s", err)
+		}
+		if got.ID != user.ID || got.LastLogin.IsZero() {
+			t.Fatalf("Invalid logged in user: %+v", got)
+		}
+
+		_, err = app.UserLogin(tenant, "Ärger.Test", "wrong password")
+		if !app.IsFailType(err, app.FailUnauthorized) {
+			t.Fatalf("Expected unauthorized for a wrong password, got %v", err)
+		}
+		_, err = app.UserLogin(tenant, "nobody", password)
+		if !app.IsFailType(err, app.FailUnauthorized) {
+			t.Fatalf("Expected unauthorized for a user that doesn't exist, got %v", err)
+		}
+
+		err = user.SetPassword(tenant, "wrong password", "a new password")
+		if !app.IsFailType(err, app.FailUnauthorized) {
+			t.Fatalf("Expected unauthorized changing password with the wrong password, got %v", err)
+		}
+		err = user.SetPassword(tenant, password, "a new password")
+		if err != nil {
+			t.Fatalf("Error changing password: %s", err)
+		}
+		_, err = app.UserLogin(tenant, "Ärger.Test", "a new password")
+		if err != nil {
+			t.Fatalf("Error logging in with new password: %s", err)
+		}
+	})
+
+	t.Run("Hash Upgrade", func(t *testing.T) {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatalf("Error generating hash: %s", err)
+		}
+		_, err = data.NewQuery(`update users set password = {{arg "password"}} where id = {{arg "id"}}`).Exec(
+			sql.Named("password", string(hash)),
+			sql.Named("id", user.ID),
+		)
+		if err != nil {
+			t.Fatalf("Error setting password hash: %s", err)
+		}
+
+		_, err = app.UserLogin(tenant, "Ärger.Test", password)
+		if err != nil {
+			t.Fatalf("Error logging in with a low cost hash: %s", err)
+		}
+
+		stored := ""
+		err = data.NewQuery(`select password from users where id = {{arg "id"}}`).QueryRow(
+			sql.Named("id", user.ID)).Scan(&stored)
+		if err != nil {
+			t.Fatalf("Error getting password hash: %s", err)
+		}
+		cost, err := bcrypt.Cost([]byte(stored))
+		if err != nil {
+			t.Fatalf("Error getting hash cost: %s", err)
+		}
+		if cost <= bcrypt.MinCost {
+			t.Fatalf("Password hash was not upgraded on login")
+		}
+
+		_, err = app.UserLogin(tenant, "Ärger.Test", password)
+		if err != nil {
+			t.Fatalf("Error logging in with upgraded hash: %s", err)
+		}
+	})
+
+	t.Run("Throttle", func(t *testing.T) {
+		err := tenant.SetSetting(user, "LoginThrottleAttempts", "2")
+		if err != nil {
+			t.Fatalf("Error setting throttle attempts: %s", err)
+		}
+		err = tenant.SetSetting(user, "LoginThrottleSeconds", "3600")
+		if err != nil {
+			t.Fatalf("Error setting throttle seconds: %s", err)
+		}
+		err = tenant.SetSetting(user, "LoginThrottleSeconds", "soon")
+		if !app.IsFailType(err, app.FailInvalid) {
+			t.Fatalf("Expected invalid failure for a non numeric setting, got %v", err)
+		}
+
+		for i := 0; i < 2; i++ {
+			_, err = app.UserLogin(tenant, "Ärger.Test", "wrong password")
+			if !app.IsFailType(err, app.FailUnauthorized) {
+				t.Fatalf("Expected unauthorized for a wrong password, got %v", err)
+			}
+		}
+
+		_, err = app.UserLogin(tenant, "Ärger.Test", password)
+		if !app.IsFailType(err, app.FailUnauthorized) || !strings.Contains(err.Error(), "Try again") {
+			t.Fatalf("Expected login to be throttled, got %v", err)
+		}
+
+		err = tenant.ResetSetting(user, "LoginThrottleAttempts")
+		if err != nil {
+			t.Fatalf("Error resetting setting: %s", err)
+		}
+		err = tenant.ResetSetting(user, "LoginThrottleSeconds")
+		if err != nil {
+			t.Fatalf("Error resetting setting: %s", err)
+		}
+		_, err = app.UserLogin(tenant, "Ärger.Test", password)
+		if err != nil {
+			t.Fatalf("Error logging in after throttle was removed: %s", err)
+		}
+	})
+
+	t.Run("Lock", func(t *testing.T) {
+		err := tenant.SetSetting(user, "LoginLockAttempts", "3")
+		if err != nil {
+			t.Fatalf("Error setting lock attempts: %s", err)
+		}
+		defer tenant.ResetSetting(user, "LoginLockAttempts")
+
+		for i := 0; i < 3; i++ {
+			_, err = app.UserLogin(tenant, "Ärger.Test", "wrong password")
+			if !app.IsFailType(err, app.FailUnauthorized) {
+				t.Fatalf("Expected unauthorized for a wrong password, got %v", err)
+			}
+		}
+
+		_, err = app.UserLogin(tenant, "Ärger.Test", "wrong password")
+		if !app.IsFailType(err, app.FailUnauthorized) || strings.Contains(err.Error(), "locked") {
+			t.Fatalf("Locked account was given away without the password, got %v", err)
+		}
+		_, err = app.UserLogin(tenant, "Ärger.Test", password)
+		if !app.IsFailType(err, app.FailUnauthorized) || !strings.Contains(err.Error(), "locked") {
+			t.Fatalf("Expected account to be locked, got %v", err)
+		}
+
+		user, err = app.UserGet(tenant, user.ID)
+		if err != nil {
+			t.Fatalf("Error getting user: %s", err)
+		}
+		if !user.Locked || user.FailedLogins != 4 {
+			t.Fatalf("Invalid locked user: %+v", user)
+		}
+
+		err = user.Unlock(user)
+		if err != nil {
+			t.Fatalf("Error unlocking user: %s", err)
+		}
+		_, err = app.UserLogin(tenant, "Ärger.Test", password)
+		if err != nil {
+			t.Fatalf("Error logging in after unlock: %s", err)
+		}
+	})
+
+	t.Run("Disable", func(t *testing.T) {
+		user, err = app.UserGet(tenant, user.ID)
+		if err != nil {
+			t.Fatalf("Error getting user: %s", err)
+		}
+		err = user.Disable(user)
+		if err != nil {
+			t.Fatalf("Error disabling user: %s", err)
+		}
+		_, err = app.UserLogin(tenant, "Ärger.Test", "wrong password")
+		if !app.IsFailType(err, app.FailUnauthorized) || strings.Contains(err.Error(), "disabled") {
+			t.Fatalf("Disabled account was given away without the password, got %v", err)
+		}
+		_, err = app.UserLogin(tenant, "Ärger.Test", password)
+		if !app.IsFailType(err, app.FailUnauthorized) || !strings.Contains(err.Error(), "disabled") {
+			t.Fatalf("Expected disabled account to fail login, got %v", err)
+		}
+
+		err = user.Enable(user)
+		if err != nil {
+			t.Fatalf("Error enabling user: %s", err)
+		}
+		_, err = app.UserLogin(tenant, "Ärger.Test", password)
+		if err != nil {
+			t.Fatalf("Error logging in after enabling: %s", err)
+		}
+	})
+}
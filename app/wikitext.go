@@ -0,0 +1,882 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package app
+
+import (
+	"bytes"
+	"html"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+/*
+	MediaWiki wikitext is converted to HTML much the way MediaWiki's own parser does it.  First the parts of the
+	text that aren't wikitext, like <nowiki> and <pre> sections, are set aside, along with the templates and
+	references.  The rest is converted one line at a time into headings, lists, tables, preformatted text and
+	paragraphs, and the text of each is converted for bold and italics, links and any HTML tags MediaWiki allows.
+
+	The converted pieces that are set aside are replaced in the text by placeholders, so nothing converts them
+	twice, and the placeholders are swapped for the converted HTML at the end.
+
+	Templates can't be expanded without the wiki they came from, so each one is left in the document as a
+	placeholder showing its name, to be replaced by hand.  Uploaded files aren't part of a dump either, so files and
+	images are left as placeholders too.  Categories aren't part of the text at all, and are collected instead.
+*/
+
+// MediaWiki namespace numbers
+const (
+	wikiNamespaceMedia    = -2
+	wikiNamespaceMain     = 0
+	wikiNamespaceFile     = 6
+	wikiNamespaceCategory = 14
+)
+
+// wikiNamespaces are the canonical names of the namespaces the converter cares about, which every wiki recognizes
+// along with its own localized names
+var wikiNamespaces = map[string]int{
+	"media":    wikiNamespaceMedia,
+	"file":     wikiNamespaceFile,
+	"image":    wikiNamespaceFile,
+	"category": wikiNamespaceCategory,
+}
+
+// wikiTags are the HTML elements MediaWiki allows in wikitext.  Any other tag is escaped and shown as text
+var wikiTags = map[string]bool{
+	"abbr": true, "b": true, "bdi": true, "big": true, "blockquote": true, "br": true, "caption": true,
+	"center": true, "cite": true, "code": true, "dd": true, "del": true, "dfn": true, "div": true, "dl": true,
+	"dt": true, "em": true, "font": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"hr": true, "i": true, "ins": true, "kbd": true, "li": true, "mark": true, "ol": true, "p": true, "q": true,
+	"s": true, "samp": true, "small": true, "span": true, "strike": true, "strong": true, "sub": true, "sup": true,
+	"table": true, "td": true, "th": true, "tr": true, "tt": true, "u": true, "ul": true, "var": true,
+}
+
+// wikiBlockTags are the allowed tags that start a block, so a line starting with one isn't put in a paragraph
+var wikiBlockTags = regexp.MustCompile(`(?i)^</?(blockquote|center|div|dl|h[1-6]|hr|ol|p|table|ul)\b`)
+
+var (
+	reWikiComment     = regexp.MustCompile(`(?s)<!--.*?(-->|$)`)
+	reWikiNowikiEmpty = regexp.MustCompile(`(?i)<nowiki\s*/>`)
+	reWikiMagic       = regexp.MustCompile(`__[A-Z]+__`)
+	reWikiLang        = regexp.MustCompile(`(?i)lang\s*=\s*["']?([\w+#-]+)`)
+	reWikiRefName     = regexp.MustCompile(`(?i)name\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s/>]+))`)
+	reWikiRef         = regexp.MustCompile(`(?is)<ref(\s[^>]*?)?(?:/>|>(.*?)</ref\s*>)`)
+	reWikiReferences  = regexp.MustCompile(`(?is)<references(\s[^>]*?)?(?:/>|>.*?</references\s*>)`)
+	reWikiPlaceholder = regexp.MustCompile("\x7f(b?)([0-9]+)\x7f")
+	reWikiBlockLine   = regexp.MustCompile("^(\x7fb[0-9]+\x7f)+$")
+	reWikiHeading     = regexp.MustCompile(`^(=+)(.+?)(=+)\s*$`)
+	reWikiRule        = regexp.MustCompile(`^-{4,}`)
+	reWikiList        = regexp.MustCompile(`^[*#:;]+`)
+	reWikiLink        = regexp.MustCompile(`\[\[([^\[\]\n]+?)\]\]([a-z]*)`)
+	reWikiExternal    = regexp.MustCompile(`\[((?:https?|ftp)://[^\s\[\]<>"]+|mailto:[^\s\[\]<>"]+)(?:[ \t]+([^\]\n]*))?\]`)
+	reWikiURL         = regexp.MustCompile(`(?:https?|ftp)://[^\s\[\]<>"\x7f]+`)
+	reWikiTag         = regexp.MustCompile(`^</?([a-zA-Z][a-zA-Z0-9]*)(\s[^<>]*)?/?>`)
+	reWikiEntity      = regexp.MustCompile(`^&(#[0-9]+|#[xX][0-9a-fA-F]+|[a-zA-Z][a-zA-Z0-9]*);`)
+	reWikiCellAttr    = regexp.MustCompile(`(?i)\b(colspan|rowspan|align)\s*=\s*["']?([a-z0-9]+)`)
+	reWikiTags        = regexp.MustCompile(`<[^>]*>`)
+)
+
+// wikiProtected are the elements whose content isn't wikitext, and how each is converted
+var wikiProtected = []struct {
+	pattern *regexp.Regexp
+	block   bool
+	convert func(attributes, content string) string
+}{
+	{wikiElement("nowiki"), false, func(attributes, content string) string {
+		return escapeHTML(content)
+	}},
+	{wikiElement("pre"), true, func(attributes, content string) string {
+		return "<pre>" + escapeHTML(strings.Trim(content, "\n")) + "</pre>"
+	}},
+	{wikiElement("syntaxhighlight"), true, wikiCode},
+	{wikiElement("source"), true, wikiCode},
+	{wikiElement("math"), false, func(attributes, content string) string {
+		return "<code>" + escapeHTML(strings.TrimSpace(content)) + "</code>"
+	}},
+}
+
+// wikiElement matches an element and its content
+func wikiElement(name string) *regexp.Regexp {
+	return regexp.MustCompile(`(?is)<` + name + `(\s[^>]*)?>(.*?)</` + name + `\s*>`)
+}
+
+// wikiCode converts a block of source code, keeping the language it's highlighted as
+func wikiCode(attributes, content string) string {
+	class := ""
+	if m := reWikiLang.FindStringSubmatch(attributes); m != nil {
+		class = ` class="language-` + escapeHTML(strings.ToLower(m[1])) + `"`
+	}
+	return "<pre><code" + class + ">" + escapeHTML(strings.Trim(content, "\n")) + "</code></pre>"
+}
+
+// wikiConverter converts the wikitext of a page to HTML
+type wikiConverter struct {
+	// link returns the link to the document imported from the page with the title, if there is one
+	link       func(title string) (string, bool)
+	namespaces map[string]int
+
+	// the categories, templates, files and links to pages that weren't imported, found in the text
+	categories []string
+	templates  []string
+	files      []string
+	missing    []string
+
+	placeholders []string
+	anchors      map[string]bool
+	refs         []string
+	refNames     map[string]int
+	references   int // the placeholder for the list of references, or -1 if the text doesn't place it
+	external     int // the number of external links without a label
+}
+
+// newWikiConverter returns a converter for the wikitext of a page.  Namespaces maps the lowercase names of the
+// wiki's namespaces to their numbers
+func newWikiConverter(namespaces map[string]int, link func(title string) (string, bool)) *wikiConverter {
+	return &wikiConverter{
+		link:       link,
+		namespaces: namespaces,
+		anchors:    make(map[string]bool),
+		refNames:   make(map[string]int),
+		references: -1,
+	}
+}
+
+// convert converts the wikitext to HTML
+func (w *wikiConverter) convert(text string) string {
+	// the placeholder marker can't be in the text itself
+	text = strings.Replace(text, "\x7f", "", -1)
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	text = reWikiComment.ReplaceAllString(text, "")
+	text = reWikiNowikiEmpty.ReplaceAllString(text, "")
+	for _, p := range wikiProtected {
+		p := p
+		text = p.pattern.ReplaceAllStringFunc(text, func(element string) string {
+			m := p.pattern.FindStringSubmatch(element)
+			return w.placeholder(p.convert(m[1], m[2]), p.block)
+		})
+	}
+	text = w.convertTemplates(text)
+	text = w.convertRefs(text)
+	text = reWikiMagic.ReplaceAllString(text, "")
+
+	body := w.blocks(text)
+	if len(w.refs) > 0 {
+		if w.references == -1 {
+			body += w.placeholder("", true) + "\n"
+			w.references = len(w.placeholders) - 1
+		}
+		w.placeholders[w.references] = w.referenceList()
+	}
+	return w.restore(body)
+}
+
+// placeholder sets aside converted HTML, and returns the placeholder that stands in for it in the text.  Block
+// placeholders are written on their own instead of in a paragraph
+func (w *wikiConverter) placeholder(converted string, block bool) string {
+	w.placeholders = append(w.placeholders, converted)
+	marker := "\x7f"
+	if block {
+		marker += "b"
+	}
+	return marker + strconv.Itoa(len(w.placeholders)-1) + "\x7f"
+}
+
+// restore replaces the placeholders with their converted HTML.  Set aside HTML can contain placeholders too
+func (w *wikiConverter) restore(text string) string {
+	for strings.Contains(text, "\x7f") {
+		text = reWikiPlaceholder.ReplaceAllStringFunc(text, func(marker string) string {
+			i, _ := strconv.Atoi(reWikiPlaceholder.FindStringSubmatch(marker)[2])
+			return w.placeholders[i]
+		})
+	}
+	return text
+}
+
+// convertTemplates replaces each template, including any templates nested in it, with a placeholder
+func (w *wikiConverter) convertTemplates(text string) string {
+	buf := &bytes.Buffer{}
+	for {
+		start := strings.Index(text, "{{")
+		if start == -1 {
+			break
+		}
+		end := templateEnd(text, start)
+		if end == -1 {
+			break
+		}
+		buf.WriteString(text[:start])
+		buf.WriteString(w.template(text[start+2 : end-2]))
+		text = text[end:]
+	}
+	buf.WriteString(text)
+	return buf.String()
+}
+
+// templateEnd returns the end of the template starting at start, or -1 if it's never closed
+func templateEnd(text string, start int) int {
+	depth := 0
+	for i := start; i < len(text)-1; i++ {
+		switch text[i : i+2] {
+		case "{{":
+			depth++
+			i++
+		case "}}":
+			depth--
+			i++
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return -1
+}
+
+// template returns the placeholder for the template with the content.  Magic words that only change how the page
+// is displayed in the wiki are removed
+func (w *wikiConverter) template(content string) string {
+	name := content
+	if i := strings.IndexAny(name, "|{"); i != -1 {
+		name = name[:i]
+	}
+	name = strings.Join(strings.Fields(strings.Replace(name, "_", " ", -1)), " ")
+	for _, prefix := range []string{"subst:", "safesubst:", "msgnw:", "Template:"} {
+		name = strings.TrimPrefix(name, prefix)
+	}
+	if i := strings.Index(name, ":"); i != -1 {
+		switch strings.ToUpper(name[:i]) {
+		case "DEFAULTSORT", "DISPLAYTITLE", "DEFAULTSORTKEY", "DEFAULTCATEGORYSORT":
+			return ""
+		}
+		if strings.HasPrefix(name, "#") {
+			// parser functions are shown by their name alone
+			name = name[:i]
+		}
+	}
+	if name == "" {
+		return ""
+	}
+	w.templates = append(w.templates, name)
+	return w.placeholder("<code>{{"+escapeHTML(name)+"}}</code>", false)
+}
+
+// convertRefs replaces the references in the text with links to the list of references, and sets aside a
+// placeholder for the list where the text places it
+func (w *wikiConverter) convertRefs(text string) string {
+	text = reWikiRef.ReplaceAllStringFunc(text, func(ref string) string {
+		m := reWikiRef.FindStringSubmatch(ref)
+		name := ""
+		if n := reWikiRefName.FindStringSubmatch(m[1]); n != nil {
+			name = n[1] + n[2] + n[3]
+		}
+		content := strings.TrimSpace(m[2])
+
+		number, ok := w.refNames[name]
+		if !ok || name == "" {
+			w.refs = append(w.refs, "")
+			number = len(w.refs)
+			if name != "" {
+				w.refNames[name] = number
+			}
+		}
+		if content != "" && w.refs[number-1] == "" {
+			w.refs[number-1] = w.inline(content)
+		}
+		return w.placeholder(`<sup><a href="#cite-note-`+strconv.Itoa(number)+`">[`+strconv.Itoa(number)+
+			`]</a></sup>`, false)
+	})
+
+	return reWikiReferences.ReplaceAllStringFunc(text, func(string) string {
+		if w.references != -1 {
+			return ""
+		}
+		marker := w.placeholder("", true)
+		w.references = len(w.placeholders) - 1
+		return marker
+	})
+}
+
+// referenceList returns the list of the references in the text
+func (w *wikiConverter) referenceList() string {
+	buf := &bytes.Buffer{}
+	buf.WriteString("<ol>\n")
+	for i, ref := range w.refs {
+		buf.WriteString(`<li id="cite-note-` + strconv.Itoa(i+1) + `">` + ref + "</li>\n")
+	}
+	buf.WriteString("</ol>")
+	return buf.String()
+}
+
+// blocks converts the lines of wikitext into blocks of HTML
+func (w *wikiConverter) blocks(text string) string {
+	buf := &bytes.Buffer{}
+	var paragraph, pre []string
+	list := ""
+
+	flush := func() {
+		if len(paragraph) > 0 {
+			buf.WriteString("<p>" + strings.Join(paragraph, "\n") + "</p>\n")
+			paragraph = nil
+		}
+		if len(pre) > 0 {
+			buf.WriteString("<pre>" + strings.Join(pre, "\n") + "</pre>\n")
+			pre = nil
+		}
+		if list != "" {
+			w.listItem(buf, list, "", "")
+			list = ""
+		}
+	}
+
+	lines := strings.Split(text, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], " \t\r")
+
+		if strings.HasPrefix(strings.TrimLeft(line, " :"), "{|") {
+			// tables can also be indented with colons, which is ignored
+			end := tableEnd(lines, i)
+			flush()
+			buf.WriteString(w.table(lines[i:end]))
+			i = end - 1
+			continue
+		}
+
+		if prefix := reWikiList.FindString(line); prefix != "" {
+			if len(paragraph) > 0 || len(pre) > 0 {
+				l := list
+				list = ""
+				flush()
+				list = l
+			}
+			list = w.listItem(buf, list, prefix, line[len(prefix):])
+			continue
+		}
+
+		switch {
+		case line == "":
+			flush()
+		case reWikiHeading.MatchString(line):
+			flush()
+			w.heading(buf, line)
+		case reWikiRule.MatchString(line):
+			flush()
+			buf.WriteString("<hr />\n")
+			if rest := strings.TrimSpace(reWikiRule.ReplaceAllString(line, "")); rest != "" {
+				paragraph = append(paragraph, w.inline(rest))
+			}
+		case reWikiBlockLine.MatchString(strings.TrimSpace(line)) || wikiBlockTags.MatchString(line):
+			flush()
+			buf.WriteString(w.inline(strings.TrimSpace(line)) + "\n")
+		case strings.HasPrefix(line, " "):
+			if len(paragraph) > 0 || list != "" {
+				l := pre
+				pre = nil
+				flush()
+				pre = l
+			}
+			pre = append(pre, w.inline(line[1:]))
+		default:
+			converted := w.inline(line)
+			if strings.TrimSpace(w.restore(converted)) == "" {
+				// lines of nothing but categories aren't in the text
+				continue
+			}
+			if len(pre) > 0 || list != "" {
+				p := paragraph
+				paragraph = nil
+				flush()
+				paragraph = p
+			}
+			paragraph = append(paragraph, converted)
+		}
+	}
+	flush()
+	return buf.String()
+}
+
+// heading writes the heading on the line, with an id that links to it the way they do in MediaWiki
+func (w *wikiConverter) heading(buf *bytes.Buffer, line string) {
+	m := reWikiHeading.FindStringSubmatch(line)
+	level := len(m[1])
+	if len(m[3]) < level {
+		level = len(m[3])
+	}
+	if level > 6 {
+		level = 6
+	}
+	// unbalanced equals signs are part of the heading
+	text := strings.TrimSpace(m[1][level:] + m[2] + m[3][level:])
+	content := w.inline(text)
+
+	anchor := wikiAnchor(html.UnescapeString(reWikiTags.ReplaceAllString(w.restore(content), "")))
+	id := anchor
+	for n := 2; w.anchors[id]; n++ {
+		id = anchor + "_" + strconv.Itoa(n)
+	}
+	w.anchors[id] = true
+
+	h := "h" + strconv.Itoa(level)
+	buf.WriteString("<" + h + ` id="` + escapeHTML(id) + `">` + content + "</" + h + ">\n")
+}
+
+// wikiAnchor returns the anchor MediaWiki links to a section with the heading by
+func wikiAnchor(heading string) string {
+	return strings.Replace(strings.Join(strings.Fields(heading), " "), " ", "_", -1)
+}
+
+// wikiListElements returns the list and item elements for the list prefix character
+func wikiListElements(c byte) (list, item string) {
+	switch c {
+	case '*':
+		return "ul", "li"
+	case '#':
+		return "ol", "li"
+	case ';':
+		return "dl", "dt"
+	}
+	return "dl", "dd"
+}
+
+// sameWikiList is whether the list prefix characters continue the same list.  Terms and definitions share a list
+func sameWikiList(a, b byte) bool {
+	_, itemA := wikiListElements(a)
+	_, itemB := wikiListElements(b)
+	return a == b || (itemA != "li" && itemB != "li")
+}
+
+// listItem closes the lists of the previous line's prefix that don't continue on this line, and opens the lists and
+// item for this line.  It returns the prefix the next line continues from.  An empty prefix closes every list
+func (w *wikiConverter) listItem(buf *bytes.Buffer, previous, prefix, text string) string {
+	common := 0
+	for common < len(previous) && common < len(prefix) && sameWikiList(previous[common], prefix[common]) {
+		common++
+	}
+	if common == len(prefix) && common > 0 {
+		// a new item at the same depth as an open one
+		common--
+	}
+	for i := len(previous) - 1; i >= common; i-- {
+		list, item := wikiListElements(previous[i])
+		buf.WriteString("</" + item + ">\n")
+		if i > common || i >= len(prefix) || !sameWikiList(previous[i], prefix[i]) {
+			buf.WriteString("</" + list + ">\n")
+		}
+	}
+	for i := common; i < len(prefix); i++ {
+		list, item := wikiListElements(prefix[i])
+		if i >= len(previous) || !sameWikiList(previous[i], prefix[i]) {
+			if buf.Len() > 0 && buf.Bytes()[buf.Len()-1] != '\n' {
+				buf.WriteString("\n")
+			}
+			buf.WriteString("<" + list + ">\n")
+		}
+		buf.WriteString("<" + item + ">")
+	}
+	if prefix == "" {
+		return ""
+	}
+
+	text = strings.TrimSpace(text)
+	if prefix[len(prefix)-1] == ';' {
+		// a term can have its definition on the same line
+		if i := definitionStart(text); i != -1 {
+			buf.WriteString(w.inline(strings.TrimSpace(text[:i])) + "</dt>\n<dd>")
+			text = strings.TrimSpace(text[i+1:])
+			prefix = prefix[:len(prefix)-1] + ":"
+		}
+	}
+	buf.WriteString(w.inline(text))
+	return prefix
+}
+
+// definitionStart returns the index of the colon that starts the definition on the line of a term, or -1.  Colons
+// in links and URLs don't count
+func definitionStart(text string) int {
+	depth := 0
+	for i := 0; i < len(text); i++ {
+		switch {
+		case strings.HasPrefix(text[i:], "[["):
+			depth++
+			i++
+		case strings.HasPrefix(text[i:], "]]"):
+			depth--
+			i++
+		case text[i] == ':' && depth <= 0 && !strings.HasPrefix(text[i:], "://"):
+			return i
+		}
+	}
+	return -1
+}
+
+// tableEnd returns the index of the line after the end of the table starting on the line at start, including any
+// tables nested in it
+func tableEnd(lines []string, start int) int {
+	depth := 0
+	for i := start; i < len(lines); i++ {
+		line := strings.TrimLeft(lines[i], " :")
+		switch {
+		case strings.HasPrefix(line, "{|"):
+			depth++
+		case strings.HasPrefix(line, "|}"):
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(lines)
+}
+
+// wikiCell is a cell of a wikitext table
+type wikiCell struct {
+	header     bool
+	attributes string
+	content    string
+}
+
+// table converts the lines of a table to HTML
+func (w *wikiConverter) table(lines []string) string {
+	var caption string
+	var rows [][]*wikiCell
+	var cell *wikiCell
+	newRow := true
+
+	addCells := func(line string, header bool) {
+		if newRow {
+			rows = append(rows, nil)
+			newRow = false
+		}
+		separators := []string{"||"}
+		if header {
+			separators = append(separators, "!!")
+		}
+		for _, content := range splitCells(line, separators) {
+			cell = &wikiCell{header: header}
+			cell.attributes, cell.content = cellAttributes(content)
+			rows[len(rows)-1] = append(rows[len(rows)-1], cell)
+		}
+	}
+
+	for i := 1; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		switch {
+		case strings.HasPrefix(line, "{|"):
+			end := tableEnd(lines, i)
+			nested := w.placeholder(w.table(lines[i:end]), true)
+			if cell != nil {
+				cell.content += "\n" + nested
+			}
+			i = end - 1
+		case strings.HasPrefix(line, "|}"):
+			i = len(lines)
+		case strings.HasPrefix(line, "|+"):
+			_, caption = cellAttributes(line[2:])
+			cell = nil
+		case strings.HasPrefix(line, "|-"):
+			newRow = true
+			cell = nil
+		case strings.HasPrefix(line, "!"):
+			addCells(line[1:], true)
+		case strings.HasPrefix(line, "|"):
+			addCells(line[1:], false)
+		case cell != nil:
+			cell.content += "\n" + lines[i]
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("<table>\n")
+	if caption != "" {
+		buf.WriteString("<caption>" + w.inline(caption) + "</caption>\n")
+	}
+	for _, row := range rows {
+		buf.WriteString("<tr>\n")
+		for _, c := range row {
+			element := "td"
+			if c.header {
+				element = "th"
+			}
+			buf.WriteString("<" + element + c.attributes + ">" + w.cellContent(c.content) + "</" + element + ">\n")
+		}
+		buf.WriteString("</tr>\n")
+	}
+	buf.WriteString("</table>\n")
+	return buf.String()
+}
+
+// cellContent converts the content of a table cell, which is made of blocks if it spans more than one line
+func (w *wikiConverter) cellContent(content string) string {
+	content = strings.TrimSpace(content)
+	if !strings.Contains(content, "\n") {
+		return w.inline(content)
+	}
+	return strings.TrimSpace(w.blocks(content))
+}
+
+// splitCells splits a line of table cells on the separators, ignoring separators in links
+func splitCells(line string, separators []string) []string {
+	var cells []string
+	depth := 0
+	start := 0
+	for i := 0; i < len(line); i++ {
+		switch {
+		case strings.HasPrefix(line[i:], "[["):
+			depth++
+			i++
+			continue
+		case strings.HasPrefix(line[i:], "]]"):
+			depth--
+			i++
+			continue
+		}
+		if depth > 0 {
+			continue
+		}
+		for _, s := range separators {
+			if strings.HasPrefix(line[i:], s) {
+				cells = append(cells, line[start:i])
+				start = i + len(s)
+				i += len(s) - 1
+				break
+			}
+		}
+	}
+	return append(cells, line[start:])
+}
+
+// cellAttributes splits the attributes from the content of a cell, and returns the attributes HTML keeps
+func cellAttributes(cell string) (string, string) {
+	split := splitCells(cell, []string{"|"})
+	if len(split) == 1 || strings.Contains(split[0], "[[") {
+		return "", strings.TrimSpace(cell)
+	}
+	content := strings.TrimSpace(strings.Join(split[1:], "|"))
+	attributes := ""
+	for _, m := range reWikiCellAttr.FindAllStringSubmatch(split[0], -1) {
+		attributes += " " + strings.ToLower(m[1]) + `="` + escapeHTML(strings.ToLower(m[2])) + `"`
+	}
+	return attributes, content
+}
+
+// inline converts the links, HTML and formatting of a line of wikitext
+func (w *wikiConverter) inline(text string) string {
+	for {
+		converted := reWikiLink.ReplaceAllStringFunc(text, func(link string) string {
+			m := reWikiLink.FindStringSubmatch(link)
+			return w.placeholder(w.internalLink(m[1], m[2]), false)
+		})
+		if converted == text {
+			break
+		}
+		text = converted
+	}
+	text = reWikiExternal.ReplaceAllStringFunc(text, func(link string) string {
+		m := reWikiExternal.FindStringSubmatch(link)
+		label := strings.TrimSpace(m[2])
+		if label == "" {
+			w.external++
+			label = "[" + strconv.Itoa(w.external) + "]"
+		} else {
+			label = w.inline(label)
+		}
+		return w.placeholder(`<a href="`+escapeHTML(m[1])+`">`+label+`</a>`, false)
+	})
+	text = reWikiURL.ReplaceAllStringFunc(text, func(url string) string {
+		trimmed := strings.TrimRight(url, ".,;:!?)'")
+		return w.placeholder(`<a href="`+escapeHTML(trimmed)+`">`+escapeHTML(trimmed)+`</a>`, false) +
+			url[len(trimmed):]
+	})
+	return wikiQuotes(wikiEscape(text))
+}
+
+// internalLink converts a link to a page in the wiki.  Links to pages that weren't imported are left as text
+func (w *wikiConverter) internalLink(link, trail string) string {
+	target := link
+	label := ""
+	labeled := false
+	if i := strings.Index(link, "|"); i != -1 {
+		target, label, labeled = link[:i], link[i+1:], true
+	}
+	target = strings.TrimSpace(target)
+	colon := strings.HasPrefix(target, ":") // a leading colon links to a category or file instead of using it
+	target = strings.TrimPrefix(target, ":")
+
+	namespace, name := w.namespace(target)
+	if !colon {
+		switch namespace {
+		case wikiNamespaceCategory:
+			w.categories = append(w.categories, name)
+			return ""
+		case wikiNamespaceFile, wikiNamespaceMedia:
+			w.files = append(w.files, name)
+			return "<code>[[" + escapeHTML(target) + "]]</code>"
+		}
+	}
+
+	if !labeled || strings.TrimSpace(label) == "" {
+		label = target
+	}
+	content := w.inline(label) + escapeHTML(trail)
+
+	page, fragment := target, ""
+	if i := strings.Index(target, "#"); i != -1 {
+		page, fragment = target[:i], wikiAnchor(target[i+1:])
+	}
+	href := ""
+	if strings.TrimSpace(page) != "" {
+		var ok bool
+		href, ok = w.link(page)
+		if !ok {
+			w.missing = append(w.missing, strings.TrimSpace(page))
+			return content
+		}
+	}
+	if fragment != "" {
+		href += "#" + fragment
+	}
+	return `<a href="` + escapeHTML(href) + `">` + content + `</a>`
+}
+
+// namespace returns the number of the namespace the title is in, or the main namespace, and the title without the
+// namespace
+func (w *wikiConverter) namespace(title string) (int, string) {
+	i := strings.Index(title, ":")
+	if i == -1 {
+		return wikiNamespaceMain, title
+	}
+	prefix := strings.ToLower(strings.Replace(strings.TrimSpace(title[:i]), "_", " ", -1))
+	namespace, ok := w.namespaces[prefix]
+	if !ok {
+		namespace, ok = wikiNamespaces[prefix]
+	}
+	if !ok {
+		return wikiNamespaceMain, title
+	}
+	return namespace, strings.TrimSpace(title[i+1:])
+}
+
+// wikiEscape escapes the text of a line of wikitext for HTML, leaving the HTML tags MediaWiki allows and character
+// references as they are
+func wikiEscape(text string) string {
+	buf := &bytes.Buffer{}
+	for i := 0; i < len(text); {
+		switch text[i] {
+		case '<':
+			if m := reWikiTag.FindStringSubmatch(text[i:]); m != nil && wikiTags[strings.ToLower(m[1])] {
+				buf.WriteString(m[0])
+				i += len(m[0])
+				continue
+			}
+			buf.WriteString("&lt;")
+		case '>':
+			buf.WriteString("&gt;")
+		case '&':
+			if m := reWikiEntity.FindString(text[i:]); m != "" {
+				buf.WriteString(m)
+				i += len(m)
+				continue
+			}
+			buf.WriteString("&amp;")
+		default:
+			buf.WriteByte(text[i])
+		}
+		i++
+	}
+	return buf.String()
+}
+
+// wikiQuotes converts the apostrophes marking bold and italic text on a line.  Two are italic, three are bold and
+// five are both, and anything left open is closed at the end of the line
+func wikiQuotes(line string) string {
+	if !strings.Contains(line, "''") {
+		return line
+	}
+	buf := &bytes.Buffer{}
+	var open []string
+
+	toggle := func(element string) {
+		for i := len(open) - 1; i >= 0; i-- {
+			if open[i] != element {
+				continue
+			}
+			// close the elements opened after this one, and open them again after it
+			above := append([]string(nil), open[i+1:]...)
+			for j := len(open) - 1; j >= i; j-- {
+				buf.WriteString("</" + open[j] + ">")
+			}
+			open = open[:i]
+			for _, e := range above {
+				buf.WriteString("<" + e + ">")
+				open = append(open, e)
+			}
+			return
+		}
+		buf.WriteString("<" + element + ">")
+		open = append(open, element)
+	}
+
+	for i := 0; i < len(line); {
+		if !strings.HasPrefix(line[i:], "''") {
+			buf.WriteByte(line[i])
+			i++
+			continue
+		}
+		count := 0
+		for i+count < len(line) && line[i+count] == '\'' {
+			count++
+		}
+		i += count
+		switch {
+		case count == 4:
+			buf.WriteString("'")
+			count = 3
+		case count > 5:
+			buf.WriteString(strings.Repeat("'", count-5))
+			count = 5
+		}
+		switch count {
+		case 2:
+			toggle("i")
+		case 3:
+			toggle("b")
+		case 5:
+			if len(open) > 0 && open[len(open)-1] == "b" {
+				toggle("b")
+				toggle("i")
+			} else {
+				toggle("i")
+				toggle("b")
+			}
+		}
+	}
+	for i := len(open) - 1; i >= 0; i-- {
+		buf.WriteString("</" + open[i] + ">")
+	}
+	return buf.String()
+}
+
+// wikiTitle normalizes a page title the way MediaWiki does, so links match the titles of the pages they link to
+func wikiTitle(title string) string {
+	title = strings.Join(strings.Fields(strings.Replace(title, "_", " ", -1)), " ")
+	r, size := utf8.DecodeRuneInString(title)
+	if r == utf8.RuneError {
+		return title
+	}
+	return string(unicode.ToUpper(r)) + title[size:]
+}
+
+// uniqueSorted returns the distinct values, sorted
+func uniqueSorted(values []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
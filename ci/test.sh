@@ -4,4 +4,8 @@ set -e
 echo Running Tests against $LLDATABASE
 
 cd ..
-go test  ./... -config $PWD/ci/$LLDATABASE/config.yaml
\ No newline at end of file
+echo Checking queries against $LLDATABASE
+go run main.go -config $PWD/ci/$LLDATABASE/config.yaml -checkqueries
+
+# packages share the test database, so run them one at a time
+go test -p 1 ./... -config $PWD/ci/$LLDATABASE/config.yaml
\ No newline at end of file
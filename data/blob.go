@@ -0,0 +1,359 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package data
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	Blobs are large binary objects, such as uploaded files, images and attachments that are stored outside of the
+	regular data tables.  Blobs are content addressed by the SHA-256 hash of their data, so storing the same data
+	twice only stores it once.
+
+	The blobs table keeps track of how many references exist to each blob.  Whatever stores a blob id (an attachment,
+	an imported file, etc) should hold a reference to it with BlobAddRef, and release it with BlobRelease when it no
+	longer needs it.  Blobs with no references are removed from the blob store by BlobCollect.
+
+	The blob data itself is stored in one of the following blob stores:
+		file: 		content addressed files in a local directory
+		database:	chunked into the blob_data table of the Lex Library database
+		s3:			an S3 compatible object storage service
+*/
+
+// ErrBlobNotFound is returned when a blob doesn't exist
+var ErrBlobNotFound = errors.New("Blob not found")
+
+// blobStore stores the actual data for blobs
+// Writes and removes are made while the blob's row is locked by the passed in transaction
+type blobStore interface {
+	write(tx *sql.Tx, id string, r io.Reader, size int64) error
+	read(id string) (io.ReadCloser, error)
+	remove(tx *sql.Tx, id string) error
+}
+
+// blobFileStore is implemented by blob stores that can take ownership of an already written temp file
+type blobFileStore interface {
+	writeFile(id, filename string) error
+	tempDir() (string, error)
+}
+
+// Blob is a binary object stored in the blob store
+type Blob struct {
+	ID       string
+	Size     int64
+	Refs     int
+	Created  time.Time
+	Released *time.Time
+}
+
+const defaultBlobCollectInterval = time.Hour
+
+var (
+	blobs         blobStore
+	blobCollector chan struct{}
+)
+
+var (
+	sqlBlobGet = NewQuery(`
+		select id, size, refs, created, released from blobs where id = {{arg "id"}}
+	`)
+	sqlBlobInsert = NewQuery(`
+		insert into blobs (id, size, refs, created) values ({{arg "id"}}, {{arg "size"}}, 1, {{arg "created"}})
+	`)
+	sqlBlobAddRef = NewQuery(`
+		update blobs set refs = refs + 1, released = NULL where id = {{arg "id"}}
+	`)
+	sqlBlobRelease = NewQuery(`
+		update blobs set refs = refs - 1, released = {{arg "released"}} where id = {{arg "id"}} and refs > 0
+	`)
+	sqlBlobUnreferenced = NewQuery(`
+		select id from blobs where refs = 0 and released < {{arg "before"}} order by id
+	`)
+	sqlBlobPlaceholder = NewQuery(`
+		insert into blobs (id, size, refs, created) values ({{arg "id"}}, 0, 0, {{arg "created"}})
+	`)
+	sqlBlobDelete = NewQuery(`
+		delete from blobs where id = {{arg "id"}} and refs = 0
+	`)
+)
+
+func initBlobs(cfg Config) error {
+	var err error
+
+	switch strings.ToLower(cfg.BlobStorage) {
+	case "", "file":
+		if cfg.BlobDirectory == "" {
+			cfg.BlobDirectory = DefaultConfig().BlobDirectory
+		}
+		blobs = &fileBlobStore{dir: cfg.BlobDirectory}
+	case "database":
+		blobs = &dbBlobStore{}
+	case "s3":
+		blobs, err = newS3BlobStore(cfg)
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.Errorf("Invalid blob storage type %s", cfg.BlobStorage)
+	}
+
+	interval := defaultBlobCollectInterval
+	if cfg.BlobCollectInterval != "" {
+		interval, err = time.ParseDuration(cfg.BlobCollectInterval)
+		if err != nil {
+			log.Printf("Invalid BlobCollectInterval duration format (%s), using default", cfg.BlobCollectInterval)
+			interval = defaultBlobCollectInterval
+		}
+	}
+
+	blobCollector = make(chan struct{})
+	go collectBlobs(interval, blobCollector)
+
+	return nil
+}
+
+func collectBlobs(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			count, err := BlobCollect(interval)
+			if err != nil {
+				log.Printf("Error collecting unreferenced blobs: %s", err)
+			} else if count > 0 {
+				log.Printf("Removed %d unreferenced blobs", count)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// BlobWrite streams the data from the reader into the blob store and returns the blob with a reference held
+// for the caller.  If a blob with the same data already exists, the reference is added to the existing blob
+func BlobWrite(r io.Reader) (*Blob, error) {
+	dir := ""
+	fStore, isFileStore := blobs.(blobFileStore)
+	if isFileStore {
+		var err error
+		dir, err = fStore.tempDir()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// blobs are spooled to a temp file to get their hash before being written to the blob store
+	tmp, err := ioutil.TempFile(dir, "blob")
+	if err != nil {
+		return nil, errors.Wrap(err, "Creating temporary blob file")
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(tmp, io.TeeReader(r, hash))
+	if err != nil {
+		return nil, errors.Wrap(err, "Writing temporary blob file")
+	}
+
+	id := hex.EncodeToString(hash.Sum(nil))
+
+	err = BeginTx(func(tx *sql.Tx) error {
+		// The blob's row is locked, by adding a reference to it or inserting it, before the blob store is touched.
+		// BlobCollect holds the row in the same way while it removes the data, so the data can't be removed
+		// between checking for it here and the reference being added
+		added, err := addBlobRef(tx, id)
+		if err != nil || added {
+			return err
+		}
+
+		_, err = sqlBlobInsert.Tx(tx).Exec(
+			sql.Named("id", id),
+			sql.Named("size", size),
+			sql.Named("created", time.Now()))
+		if err != nil {
+			return errors.Wrapf(err, "Inserting blob %s", id)
+		}
+
+		if isFileStore {
+			err = tmp.Close()
+			if err != nil {
+				return err
+			}
+			return fStore.writeFile(id, tmp.Name())
+		}
+		_, err = tmp.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		return blobs.write(tx, id, tmp, size)
+	})
+	if err != nil {
+		// the same blob may have been inserted at the same time, if so add a reference to it
+		added, aErr := addBlobRef(nil, id)
+		if aErr != nil || !added {
+			return nil, errors.Wrapf(err, "Writing blob %s to the blob store", id)
+		}
+	}
+
+	return BlobGet(id)
+}
+
+// BlobGet retrieves the information about a blob
+func BlobGet(id string) (*Blob, error) {
+	b := &Blob{}
+	err := sqlBlobGet.QueryRow(sql.Named("id", id)).Scan(&b.ID, &b.Size, &b.Refs, &b.Created, &b.Released)
+	if err == sql.ErrNoRows {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// BlobRead opens the data of a blob for reading. The caller must close the returned reader
+func BlobRead(id string) (io.ReadCloser, error) {
+	_, err := BlobGet(id)
+	if err != nil {
+		return nil, err
+	}
+	return blobs.read(id)
+}
+
+// BlobAddRef adds a reference to an existing blob.  If tx is not nil, the reference is added inside the transaction
+func BlobAddRef(tx *sql.Tx, id string) error {
+	added, err := addBlobRef(tx, id)
+	if err != nil {
+		return err
+	}
+	if !added {
+		return ErrBlobNotFound
+	}
+	return nil
+}
+
+func addBlobRef(tx *sql.Tx, id string) (bool, error) {
+	result, err := sqlBlobAddRef.Tx(tx).Exec(sql.Named("id", id))
+	if err != nil {
+		return false, errors.Wrapf(err, "Adding reference to blob %s", id)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+// BlobRelease releases a reference to a blob.  Once a blob has no references left, it will be removed from the blob
+// store the next time unreferenced blobs are collected.  If tx is not nil, the reference is released inside the
+// transaction
+func BlobRelease(tx *sql.Tx, id string) error {
+	result, err := sqlBlobRelease.Tx(tx).Exec(sql.Named("id", id), sql.Named("released", time.Now()))
+	if err != nil {
+		return errors.Wrapf(err, "Releasing reference to blob %s", id)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrBlobNotFound
+	}
+	return nil
+}
+
+// BlobCollect removes all blobs from the blob store that have had no references for longer than the grace period,
+// and returns the number of blobs removed
+func BlobCollect(gracePeriod time.Duration) (int, error) {
+	rows, err := sqlBlobUnreferenced.Query(sql.Named("before", time.Now().Add(-gracePeriod)))
+	if err != nil {
+		return 0, err
+	}
+
+	var ids []string
+	for rows.Next() {
+		id := ""
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	err = rows.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for i := range ids {
+		// the row is deleted and committed before the data is removed, so a failure removing the data only leaves
+		// unreferenced data behind, rather than a blob without its data
+		deleted := false
+		err = BeginTx(func(tx *sql.Tx) error {
+			result, err := sqlBlobDelete.Tx(tx).Exec(sql.Named("id", ids[i]))
+			if err != nil {
+				return err
+			}
+			rows, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			// no rows are deleted if the blob was referenced again since it was selected
+			deleted = rows > 0
+			return nil
+		})
+		if err != nil {
+			return count, err
+		}
+		if !deleted {
+			continue
+		}
+
+		err = removeBlobData(ids[i])
+		if err != nil {
+			return count, errors.Wrapf(err, "Removing blob %s from the blob store", ids[i])
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// removeBlobData removes the data of a blob whose row has already been deleted.  A placeholder row with no
+// references locks the blob while its data is removed, so a BlobWrite of the same data waits for the removal and
+// then writes the data again.  If the blob has already been written again, the placeholder can't be inserted, and
+// the new data is left alone
+func removeBlobData(id string) error {
+	err := BeginTx(func(tx *sql.Tx) error {
+		_, err := sqlBlobPlaceholder.Tx(tx).Exec(sql.Named("id", id), sql.Named("created", time.Now()))
+		if err != nil {
+			return err
+		}
+		err = blobs.remove(tx, id)
+		if err != nil {
+			return err
+		}
+		_, err = sqlBlobDelete.Tx(tx).Exec(sql.Named("id", id))
+		return err
+	})
+	if err != nil {
+		if _, gErr := BlobGet(id); gErr == nil {
+			return nil
+		}
+	}
+	return err
+}
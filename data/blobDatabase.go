@@ -0,0 +1,122 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package data
+
+import (
+	"database/sql"
+	"io"
+)
+
+// blobChunkSize is the size of each row of blob data in the database.  Blobs are split into chunks so they can
+// be streamed in and out of the database without loading the entire blob into memory, and to stay under
+// the maximum value sizes of the various databases
+const blobChunkSize = 256 << 10
+
+var (
+	sqlBlobDataInsert = NewQuery(`
+		insert into blob_data (id, chunk, data) values ({{arg "id"}}, {{arg "chunk"}}, {{arg "data"}})
+	`)
+	sqlBlobDataGet = NewQuery(`
+		select data from blob_data where id = {{arg "id"}} and chunk = {{arg "chunk"}}
+	`)
+	sqlBlobDataDelete = NewQuery(`
+		delete from blob_data where id = {{arg "id"}}
+	`)
+)
+
+// dbBlobStore stores blobs in the Lex Library database
+type dbBlobStore struct{}
+
+func (d *dbBlobStore) write(tx *sql.Tx, id string, r io.Reader, size int64) error {
+	// clear out any partially written data
+	_, err := sqlBlobDataDelete.Tx(tx).Exec(sql.Named("id", id))
+	if err != nil {
+		return err
+	}
+
+	buff := make([]byte, blobChunkSize)
+	for chunk := 0; ; chunk++ {
+		n, err := io.ReadFull(r, buff)
+		if err == io.EOF {
+			if chunk == 0 {
+				// empty blob, some databases store empty values as null
+				_, err = sqlBlobDataInsert.Tx(tx).Exec(sql.Named("id", id), sql.Named("chunk", chunk),
+					sql.Named("data", nil))
+				return err
+			}
+			return nil
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		_, err = sqlBlobDataInsert.Tx(tx).Exec(sql.Named("id", id), sql.Named("chunk", chunk),
+			sql.Named("data", buff[:n]))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (d *dbBlobStore) read(id string) (io.ReadCloser, error) {
+	r := &dbBlobReader{id: id}
+	// load the first chunk to make sure the blob exists
+	err := r.next()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (d *dbBlobStore) remove(tx *sql.Tx, id string) error {
+	_, err := sqlBlobDataDelete.Tx(tx).Exec(sql.Named("id", id))
+	return err
+}
+
+// dbBlobReader reads a blob from the database one chunk at a time
+type dbBlobReader struct {
+	id    string
+	chunk int
+	buff  []byte
+	eof   bool
+}
+
+func (r *dbBlobReader) next() error {
+	var data []byte
+	err := sqlBlobDataGet.QueryRow(sql.Named("id", r.id), sql.Named("chunk", r.chunk)).Scan(&data)
+	if err == sql.ErrNoRows {
+		if r.chunk == 0 {
+			return ErrBlobNotFound
+		}
+		r.eof = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	r.buff = data
+	r.chunk++
+	return nil
+}
+
+func (r *dbBlobReader) Read(p []byte) (int, error) {
+	for len(r.buff) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		err := r.next()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.buff)
+	r.buff = r.buff[n:]
+	return n, nil
+}
+
+func (r *dbBlobReader) Close() error {
+	r.buff = nil
+	r.eof = true
+	return nil
+}
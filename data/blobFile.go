@@ -0,0 +1,89 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package data
+
+import (
+	"database/sql"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// fileBlobStore stores blobs as files in a local directory, named by their content hash and split into
+// sub directories by the first characters of the hash to keep directory sizes reasonable
+// i.e. <dir>/ab/cd/abcdef0123...
+type fileBlobStore struct {
+	dir string
+}
+
+func (f *fileBlobStore) filename(id string) string {
+	return filepath.Join(f.dir, id[0:2], id[2:4], id)
+}
+
+func (f *fileBlobStore) tempDir() (string, error) {
+	dir := filepath.Join(f.dir, "tmp")
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", errors.Wrap(err, "Creating blob temp directory")
+	}
+	return dir, nil
+}
+
+func (f *fileBlobStore) write(tx *sql.Tx, id string, r io.Reader, size int64) error {
+	dir, err := f.tempDir()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, "blob")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return f.writeFile(id, tmp.Name())
+}
+
+func (f *fileBlobStore) writeFile(id, filename string) error {
+	target := f.filename(id)
+	_, err := os.Stat(target)
+	if err == nil {
+		// the same content is already stored, and the caller's lock on the blob's row keeps it from being removed
+		return nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(target), 0700)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(filename, target)
+}
+
+func (f *fileBlobStore) read(id string) (io.ReadCloser, error) {
+	file, err := os.Open(f.filename(id))
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return file, err
+}
+
+func (f *fileBlobStore) remove(tx *sql.Tx, id string) error {
+	err := os.Remove(f.filename(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
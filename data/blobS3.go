@@ -0,0 +1,174 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package data
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// emptyPayloadHash is the SHA-256 hash of an empty request body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3BlobStore stores blobs in an S3 compatible object storage service using path style requests
+// signed with AWS Signature Version 4
+type s3BlobStore struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	prefix    string
+	client    *http.Client
+}
+
+func newS3BlobStore(cfg Config) (*s3BlobStore, error) {
+	if cfg.S3Endpoint == "" || cfg.S3Bucket == "" {
+		return nil, errors.New("S3Endpoint and S3Bucket must be set to use S3 blob storage")
+	}
+	u, err := url.Parse(cfg.S3Endpoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "Parsing S3Endpoint")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.Errorf("Invalid S3Endpoint %s, the endpoint must start with http:// or https://",
+			cfg.S3Endpoint)
+	}
+
+	region := cfg.S3Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	return &s3BlobStore{
+		endpoint:  u,
+		bucket:    cfg.S3Bucket,
+		region:    region,
+		accessKey: cfg.S3AccessKey,
+		secretKey: cfg.S3SecretKey,
+		prefix:    cfg.S3Prefix,
+		client:    &http.Client{},
+	}, nil
+}
+
+func (s *s3BlobStore) url(id string) *url.URL {
+	u := *s.endpoint
+	u.Path = path.Join("/", u.Path, s.bucket, s.prefix, id)
+	return &u
+}
+
+func (s *s3BlobStore) do(method, id string, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.url(id).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	s.sign(req, payloadHash, time.Now().UTC())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, ErrBlobNotFound
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		defer res.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, errors.Errorf("S3 %s request for %s failed with status %s: %s", method, id, res.Status,
+			strings.TrimSpace(string(msg)))
+	}
+	return res, nil
+}
+
+func (s *s3BlobStore) write(tx *sql.Tx, id string, r io.Reader, size int64) error {
+	// blob ids are the SHA-256 hash of their content, which is also the payload hash for the signature
+	res, err := s.do(http.MethodPut, id, r, size, id)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func (s *s3BlobStore) read(id string) (io.ReadCloser, error) {
+	res, err := s.do(http.MethodGet, id, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (s *s3BlobStore) remove(tx *sql.Tx, id string) error {
+	res, err := s.do(http.MethodDelete, id, nil, 0, emptyPayloadHash)
+	if err == ErrBlobNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// sign signs the request with AWS Signature Version 4
+// http://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+func (s *s3BlobStore) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,338 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package data
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// fakeS3 is a minimal stand in for an S3 compatible service
+type fakeS3 struct {
+	sync.Mutex
+	store   *s3BlobStore
+	objects map[string][]byte
+	t       *testing.T
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	amzDate, err := time.Parse("20060102T150405Z", r.Header.Get("x-amz-date"))
+	if err != nil {
+		http.Error(w, "Invalid x-amz-date", http.StatusForbidden)
+		return
+	}
+
+	// verify signature
+	check, err := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.store.sign(check, r.Header.Get("x-amz-content-sha256"), amzDate)
+	if check.Header.Get("Authorization") != r.Header.Get("Authorization") {
+		http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+		return
+	}
+
+	if !strings.HasPrefix(r.URL.Path, "/test-bucket/blobs/") {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hash := sha256.Sum256(body)
+		if hex.EncodeToString(hash[:]) != r.Header.Get("x-amz-content-sha256") {
+			http.Error(w, "XAmzContentSHA256Mismatch", http.StatusBadRequest)
+			return
+		}
+		f.objects[r.URL.Path] = body
+	case http.MethodGet:
+		body, ok := f.objects[r.URL.Path]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Write(body)
+	case http.MethodDelete:
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestBlobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lexLibraryBlobs")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fake := &fakeS3{objects: make(map[string][]byte), t: t}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	s3Store, err := newS3BlobStore(Config{
+		S3Endpoint:  server.URL,
+		S3Bucket:    "test-bucket",
+		S3Prefix:    "blobs",
+		S3AccessKey: "access",
+		S3SecretKey: "secret",
+	})
+	if err != nil {
+		t.Fatalf("Error creating S3 blob store: %s", err)
+	}
+	fake.store = s3Store
+
+	original := blobs
+	defer func() {
+		blobs = original
+	}()
+
+	stores := []struct {
+		name  string
+		store blobStore
+	}{
+		{"file", &fileBlobStore{dir: dir}},
+		{"database", &dbBlobStore{}},
+		{"s3", s3Store},
+	}
+
+	// larger than a single database chunk
+	large := bytes.Repeat([]byte("Lex Library blob data "), (blobChunkSize*2)/10)
+
+	for _, s := range stores {
+		blobs = s.store
+		t.Run(s.name, func(t *testing.T) {
+			_, err := NewQuery("delete from blobs").Exec()
+			if err != nil {
+				t.Fatalf("Error emptying blobs table: %s", err)
+			}
+
+			read := func(t *testing.T, id string) []byte {
+				r, err := BlobRead(id)
+				if err != nil {
+					t.Fatalf("Error opening blob: %s", err)
+				}
+				defer r.Close()
+				data, err := ioutil.ReadAll(r)
+				if err != nil {
+					t.Fatalf("Error reading blob: %s", err)
+				}
+				return data
+			}
+
+			var small, big *Blob
+
+			t.Run("Write", func(t *testing.T) {
+				small, err = BlobWrite(strings.NewReader("small blob"))
+				if err != nil {
+					t.Fatalf("Error writing blob: %s", err)
+				}
+				hash := sha256.Sum256([]byte("small blob"))
+				if small.ID != hex.EncodeToString(hash[:]) {
+					t.Fatalf("Blob id is not the SHA-256 of its content: %s", small.ID)
+				}
+				if small.Size != int64(len("small blob")) || small.Refs != 1 {
+					t.Fatalf("Invalid blob: %+v", small)
+				}
+
+				big, err = BlobWrite(bytes.NewReader(large))
+				if err != nil {
+					t.Fatalf("Error writing large blob: %s", err)
+				}
+				if big.Size != int64(len(large)) {
+					t.Fatalf("Invalid large blob size. Wanted %d got %d", len(large), big.Size)
+				}
+			})
+
+			t.Run("Read", func(t *testing.T) {
+				if string(read(t, small.ID)) != "small blob" {
+					t.Fatalf("Invalid blob data: %s", read(t, small.ID))
+				}
+				if !bytes.Equal(read(t, big.ID), large) {
+					t.Fatalf("Large blob data does not match")
+				}
+
+				_, err := BlobRead(strings.Repeat("0", 64))
+				if err != ErrBlobNotFound {
+					t.Fatalf("Expected ErrBlobNotFound, got %v", err)
+				}
+			})
+
+			t.Run("Deduplicate", func(t *testing.T) {
+				dup, err := BlobWrite(strings.NewReader("small blob"))
+				if err != nil {
+					t.Fatalf("Error writing duplicate blob: %s", err)
+				}
+				if dup.ID != small.ID || dup.Refs != 2 {
+					t.Fatalf("Duplicate blob was not deduplicated: %+v", dup)
+				}
+				err = BlobAddRef(nil, small.ID)
+				if err != nil {
+					t.Fatalf("Error adding blob reference: %s", err)
+				}
+				if s.name == "file" {
+					matches, err := filepath.Glob(filepath.Join(dir, "*", "*", small.ID))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(matches) != 1 {
+						t.Fatalf("Expected one file for blob, found %d", len(matches))
+					}
+				}
+			})
+
+			t.Run("Collect", func(t *testing.T) {
+				for i := 0; i < 3; i++ {
+					err := BlobRelease(nil, small.ID)
+					if err != nil {
+						t.Fatalf("Error releasing blob: %s", err)
+					}
+				}
+				err := BlobRelease(nil, small.ID)
+				if err != ErrBlobNotFound {
+					t.Fatalf("Releasing blob with no references did not return ErrBlobNotFound: %v", err)
+				}
+
+				count, err := BlobCollect(time.Hour)
+				if err != nil {
+					t.Fatalf("Error collecting blobs: %s", err)
+				}
+				if count != 0 {
+					t.Fatalf("Blobs inside the grace period were collected")
+				}
+
+				count, err = BlobCollect(-time.Minute)
+				if err != nil {
+					t.Fatalf("Error collecting blobs: %s", err)
+				}
+				if count != 1 {
+					t.Fatalf("Invalid number of collected blobs. Wanted %d got %d", 1, count)
+				}
+
+				_, err = BlobGet(small.ID)
+				if err != ErrBlobNotFound {
+					t.Fatalf("Collected blob still exists: %v", err)
+				}
+				_, err = s.store.read(small.ID)
+				if err != ErrBlobNotFound {
+					t.Fatalf("Collected blob is still in the blob store: %v", err)
+				}
+
+				if !bytes.Equal(read(t, big.ID), large) {
+					t.Fatalf("Referenced blob was collected")
+				}
+			})
+
+			t.Run("Rewrite", func(t *testing.T) {
+				again, err := BlobWrite(strings.NewReader("small blob"))
+				if err != nil {
+					t.Fatalf("Error writing blob: %s", err)
+				}
+				if again.Refs != 1 || string(read(t, again.ID)) != "small blob" {
+					t.Fatalf("Invalid rewritten blob: %+v", again)
+				}
+			})
+
+			t.Run("Collect While Writing", func(t *testing.T) {
+				// the data of a blob is never collected while a reference to it is held, even when the blob is
+				// written again while it's being collected
+				done := make(chan struct{})
+				collected := make(chan error)
+				go func() {
+					for {
+						select {
+						case <-done:
+							collected <- nil
+							return
+						default:
+						}
+						_, err := BlobCollect(-time.Minute)
+						if err != nil {
+							collected <- err
+							return
+						}
+					}
+				}()
+
+				var wg sync.WaitGroup
+				errs := make(chan error, 4)
+				for i := 0; i < 4; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for j := 0; j < 10; j++ {
+							b, err := BlobWrite(strings.NewReader("contended blob"))
+							if err != nil {
+								errs <- err
+								return
+							}
+							r, err := BlobRead(b.ID)
+							if err != nil {
+								errs <- err
+								return
+							}
+							data, err := ioutil.ReadAll(r)
+							r.Close()
+							if err != nil {
+								errs <- err
+								return
+							}
+							if string(data) != "contended blob" {
+								errs <- errors.Errorf("Invalid blob data: %s", data)
+								return
+							}
+							err = BlobRelease(nil, b.ID)
+							if err != nil {
+								errs <- err
+								return
+							}
+						}
+					}()
+				}
+				wg.Wait()
+				close(done)
+				close(errs)
+
+				if err := <-collected; err != nil {
+					t.Fatalf("Error collecting blobs: %s", err)
+				}
+				for err := range errs {
+					t.Fatalf("Error writing blob while collecting: %s", err)
+				}
+			})
+
+			t.Run("Empty", func(t *testing.T) {
+				empty, err := BlobWrite(bytes.NewReader(nil))
+				if err != nil {
+					t.Fatalf("Error writing empty blob: %s", err)
+				}
+				if len(read(t, empty.ID)) != 0 {
+					t.Fatalf("Empty blob has data")
+				}
+			})
+		})
+	}
+}
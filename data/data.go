@@ -49,24 +49,46 @@ type Config struct {
 	MaxConnectionLifetime string
 
 	AllowSchemaRollback bool
+
+	EncryptionKey     string
+	EncryptionKeyFile string
+
+	BlobStorage         string
+	BlobDirectory       string
+	BlobCollectInterval string
+
+	S3Endpoint  string
+	S3Bucket    string
+	S3Prefix    string
+	S3Region    string
+	S3AccessKey string
+	S3SecretKey string
 }
 
 // DefaultConfig returns the default configuration for the data layer
 func DefaultConfig() Config {
 	return Config{
-		DatabaseFile: "./lexLibrary.db",
-		SearchFile:   "./lexLibrary.search",
+		DatabaseFile:  "./lexLibrary.db",
+		SearchFile:    "./lexLibrary.search",
+		BlobStorage:   "file",
+		BlobDirectory: "./blobs",
 	}
 }
 
 // Init initializes the data layer based on the passed in configuration.
-// Initialization includes things like setting up the database and the connections to it.
+// Initialization includes things like setting up the database and the connections to it, and checking
+// that every registered query builds and prepares against it.
 func Init(cfg Config) error {
 	err := initSearch(cfg)
 	if err != nil {
 		return err
 	}
 
+	err = initEncryption(cfg)
+	if err != nil {
+		return err
+	}
+
 	switch strings.ToLower(cfg.DatabaseType) {
 	case "postgres":
 		dbType = postgres
@@ -90,7 +112,10 @@ func Init(cfg Config) error {
 		return err
 	}
 
-	prepareQueries()
+	err = prepareQueries()
+	if err != nil {
+		return err
+	}
 
 	if cfg.MaxConnectionLifetime != "" {
 		lifetime, err := time.ParseDuration(cfg.MaxConnectionLifetime)
@@ -108,7 +133,12 @@ func Init(cfg Config) error {
 		return err
 	}
 
-	return nil
+	err = initBlobs(cfg)
+	if err != nil {
+		return err
+	}
+
+	return CheckQueries()
 }
 
 func testDB(attempt int) {
@@ -131,6 +161,10 @@ func testDB(attempt int) {
 // Teardown cleanly tears down any data layer connections
 func Teardown() error {
 	log.Printf("Tearing down data connections")
+	if blobCollector != nil {
+		close(blobCollector)
+		blobCollector = nil
+	}
 	return db.Close()
 }
 
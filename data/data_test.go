@@ -0,0 +1,67 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package data
+
+import (
+	"flag"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+var flagConfigFile string
+
+const defaultConfigFile = "./config.yaml"
+
+func TestMain(m *testing.M) {
+
+	// Quick env check to prevent tests from being accidentally run against real data, as tables get truncated before
+	// tests run
+	if os.Getenv("LLTEST") != "true" {
+		log.Fatal("LLTEST environment variable is not set to 'true'.  Make sure you are not running the tests in a real environment")
+	}
+	flag.StringVar(&flagConfigFile, "config", "./config.yaml", "Sets the path to the configuration file. Either a .YAML, .JSON, or .TOML file")
+
+	flag.Parse()
+	cfg := struct {
+		Data Config
+	}{
+		Data: Config{},
+	}
+
+	viper.SetConfigFile(flagConfigFile)
+
+	err := viper.ReadInConfig()
+	if err != nil {
+		if os.IsNotExist(err) && flagConfigFile == defaultConfigFile {
+			log.Printf("No config file found, using default values: \n %+v\n", cfg)
+			// open sqlite db in memory for testing
+			cfg.Data = Config{
+				DatabaseType:       "sqlite",
+				DatabaseURL:        "file::memory:?mode=memory&cache=shared",
+				MaxIdleConnections: 1,
+				MaxOpenConnections: 1,
+				BlobStorage:        "database",
+			}
+		} else {
+			log.Fatal(err)
+		}
+	} else {
+		viper.Unmarshal(&cfg)
+	}
+
+	// All tests assume the database is empty
+	err = Init(cfg.Data)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	result := m.Run()
+	err = Teardown()
+	if err != nil {
+		log.Fatalf("Error tearing down data connections: %s", err)
+	}
+	os.Exit(result)
+}
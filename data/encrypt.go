@@ -0,0 +1,353 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package data
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+	Every value written as EncryptedText is stored in an envelope, so encrypted and plain values can't be confused
+	with each other, whatever the plain text contains:
+
+		ll:<key id>:<nonce><AES-GCM sealed data>	encrypted with the key
+		ll::<plain text>				written while no key was configured
+
+	Key ids can't be empty, so the empty key id marks plain text.  The key id lets multiple keys exist at once, so
+	keys can be rotated.  New values are always encrypted with the active key (the first key configured), and older
+	keys are used only to decrypt existing values until they are re-encrypted with the active key.  Plain values
+	are encrypted the same way, once a key is configured and the data is re-encrypted.
+
+	Keys are configured as <key id>:<base64 encoded 256 bit key>, either directly in the config file as
+	EncryptionKey, or in a separate file (EncryptionKeyFile) with one key per line.
+*/
+
+const (
+	envelopePrefix = "ll:"
+	plainPrefix    = envelopePrefix + ":"
+)
+
+type encryptionKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+var encryptionKeys []*encryptionKey
+
+// EncryptedText is a string that is encrypted at rest in the database if an encryption key is configured.
+// It can be passed in as a query argument, and scanned into from query results in place of a string.
+// Columns holding encrypted text should be defined as {{blob}}, and registered with RegisterEncryptedColumn
+// so they are included when re-encrypting with a new key
+type EncryptedText string
+
+// Value implements the driver.Valuer interface
+func (e EncryptedText) Value() (driver.Value, error) {
+	if len(encryptionKeys) == 0 {
+		return append([]byte(plainPrefix), e...), nil
+	}
+	return encryptionKeys[0].encrypt([]byte(e))
+}
+
+// Scan implements the sql.Scanner interface
+func (e *EncryptedText) Scan(src interface{}) error {
+	var value []byte
+	switch src := src.(type) {
+	case nil:
+		*e = ""
+		return nil
+	case []byte:
+		value = src
+	case string:
+		value = []byte(src)
+	default:
+		return errors.Errorf("Can't scan type %T into EncryptedText", src)
+	}
+
+	plain, err := decrypt(value)
+	if err != nil {
+		return err
+	}
+	*e = EncryptedText(plain)
+	return nil
+}
+
+// IsEncrypted returns whether or not the passed in value was encrypted by the data layer
+func IsEncrypted(value []byte) bool {
+	return bytes.HasPrefix(value, []byte(envelopePrefix)) && !bytes.HasPrefix(value, []byte(plainPrefix))
+}
+
+func (k *encryptionKey) prefix() []byte {
+	return []byte(envelopePrefix + k.id + ":")
+}
+
+func (k *encryptionKey) encrypt(plain []byte) ([]byte, error) {
+	prefix := k.prefix()
+	nonce := make([]byte, k.aead.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, errors.Wrap(err, "Generating encryption nonce")
+	}
+
+	value := make([]byte, 0, len(prefix)+len(nonce)+len(plain)+k.aead.Overhead())
+	value = append(value, prefix...)
+	value = append(value, nonce...)
+	return k.aead.Seal(value, nonce, plain, prefix), nil
+}
+
+func decrypt(value []byte) ([]byte, error) {
+	if bytes.HasPrefix(value, []byte(plainPrefix)) {
+		return value[len(plainPrefix):], nil
+	}
+	if !bytes.HasPrefix(value, []byte(envelopePrefix)) {
+		return nil, errors.New("Invalid encrypted value, the value wasn't written as EncryptedText")
+	}
+
+	rest := value[len(envelopePrefix):]
+	i := bytes.IndexByte(rest, ':')
+	if i == -1 {
+		return nil, errors.New("Invalid encrypted value, no key id found")
+	}
+	id := string(rest[:i])
+
+	var key *encryptionKey
+	for j := range encryptionKeys {
+		if encryptionKeys[j].id == id {
+			key = encryptionKeys[j]
+			break
+		}
+	}
+	if key == nil {
+		return nil, errors.Errorf("No encryption key is configured with the id %s", id)
+	}
+
+	sealed := rest[i+1:]
+	if len(sealed) < key.aead.NonceSize() {
+		return nil, errors.New("Invalid encrypted value, missing nonce")
+	}
+
+	plain, err := key.aead.Open(nil, sealed[:key.aead.NonceSize()], sealed[key.aead.NonceSize():],
+		value[:len(envelopePrefix)+i+1])
+	if err != nil {
+		return nil, errors.Wrapf(err, "Decrypting value with key %s", id)
+	}
+	return plain, nil
+}
+
+func parseEncryptionKey(key string) (*encryptionKey, error) {
+	i := strings.Index(key, ":")
+	if i <= 0 {
+		return nil, errors.New("Encryption keys must be in the format <key id>:<base64 encoded key>")
+	}
+	id := key[:i]
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return nil, errors.Errorf("Invalid encryption key id %s. Key ids can only contain letters, numbers, - and _",
+				id)
+		}
+	}
+
+	secret, err := base64.StdEncoding.DecodeString(key[i+1:])
+	if err != nil {
+		return nil, errors.Wrapf(err, "Decoding encryption key %s", id)
+	}
+	if len(secret) != 32 {
+		return nil, errors.Errorf("Encryption key %s must be 256 bits (32 bytes) long", id)
+	}
+
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptionKey{
+		id:   id,
+		aead: aead,
+	}, nil
+}
+
+func initEncryption(cfg Config) error {
+	encryptionKeys = nil
+
+	var keys []string
+	if cfg.EncryptionKey != "" {
+		keys = append(keys, cfg.EncryptionKey)
+	}
+
+	if cfg.EncryptionKeyFile != "" {
+		f, err := os.Open(cfg.EncryptionKeyFile)
+		if err != nil {
+			return errors.Wrap(err, "Opening encryption key file")
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			keys = append(keys, line)
+		}
+		if err = scanner.Err(); err != nil {
+			return errors.Wrap(err, "Reading encryption key file")
+		}
+	}
+
+	for i := range keys {
+		key, err := parseEncryptionKey(keys[i])
+		if err != nil {
+			return err
+		}
+		for j := range encryptionKeys {
+			if encryptionKeys[j].id == key.id {
+				return errors.Errorf("Duplicate encryption key id %s", key.id)
+			}
+		}
+		encryptionKeys = append(encryptionKeys, key)
+	}
+
+	return nil
+}
+
+type encryptedColumn struct {
+	table    string
+	idColumn string
+	column   string
+}
+
+var encryptedColumns []encryptedColumn
+
+// RegisterEncryptedColumn registers a table column that holds EncryptedText, so it can be re-encrypted
+// when keys are rotated.  The idColumn must uniquely identify each row in the table
+func RegisterEncryptedColumn(table, idColumn, column string) {
+	encryptedColumns = append(encryptedColumns, encryptedColumn{
+		table:    table,
+		idColumn: idColumn,
+		column:   column,
+	})
+}
+
+// Reencrypt re-encrypts every value in every registered encrypted column that isn't encrypted with the active
+// key. Rows are updated in small batches, each in their own transaction, so it can safely run in the background
+// while Lex Library is in use. Returns the number of values that were re-encrypted
+func Reencrypt(batchSize int) (int, error) {
+	if len(encryptionKeys) == 0 {
+		return 0, errors.New("No encryption keys are configured")
+	}
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+
+	total := 0
+	for _, col := range encryptedColumns {
+		count, err := col.reencrypt(batchSize)
+		total += count
+		if err != nil {
+			return total, errors.Wrapf(err, "Re-encrypting %s.%s", col.table, col.column)
+		}
+	}
+	return total, nil
+}
+
+func (c encryptedColumn) reencrypt(batchSize int) (int, error) {
+	sel := NewQuery(`
+		select ` + c.idColumn + `, ` + c.column + `
+		from ` + c.table + `
+		where ` + c.idColumn + ` > {{arg "last"}}
+		order by ` + c.idColumn + `
+		limit {{arg "limit"}}
+	`)
+	update := NewQuery(`
+		update ` + c.table + `
+		set ` + c.column + ` = {{arg "new"}}
+		where ` + c.idColumn + ` = {{arg "id"}}
+		and ` + c.column + ` = {{arg "old"}}
+	`)
+
+	prefix := encryptionKeys[0].prefix()
+	last := ""
+	total := 0
+
+	for {
+		count := 0
+		updated := 0
+		err := BeginTx(func(tx *sql.Tx) error {
+			rows, err := sel.Tx(tx).Query(sql.Named("last", last), sql.Named("limit", batchSize))
+			if err != nil {
+				return err
+			}
+
+			type row struct {
+				id    string
+				value []byte
+			}
+			var batch []row
+
+			for rows.Next() {
+				r := row{}
+				err = rows.Scan(&r.id, &r.value)
+				if err != nil {
+					rows.Close()
+					return err
+				}
+				batch = append(batch, r)
+			}
+			err = rows.Close()
+			if err != nil {
+				return err
+			}
+
+			count = len(batch)
+
+			for i := range batch {
+				last = batch[i].id
+				if batch[i].value == nil || bytes.HasPrefix(batch[i].value, prefix) {
+					continue
+				}
+				plain, err := decrypt(batch[i].value)
+				if err != nil {
+					return errors.Wrapf(err, "Decrypting row %s", batch[i].id)
+				}
+				value, err := encryptionKeys[0].encrypt(plain)
+				if err != nil {
+					return err
+				}
+				_, err = update.Tx(tx).Exec(
+					sql.Named("new", value),
+					sql.Named("id", batch[i].id),
+					sql.Named("old", batch[i].value))
+				if err != nil {
+					return err
+				}
+				updated++
+			}
+			return nil
+		})
+		if err != nil {
+			return total, err
+		}
+		total += updated
+		if count < batchSize {
+			return total, nil
+		}
+		// give other queries a chance to run between batches
+		time.Sleep(10 * time.Millisecond)
+	}
+}
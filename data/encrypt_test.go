@@ -0,0 +1,220 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package data
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testKey(id string, b byte) string {
+	return id + ":" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func TestEncryption(t *testing.T) {
+	defer func() {
+		encryptionKeys = nil
+		encryptedColumns = nil
+	}()
+
+	_, err := NewQuery("drop table if exists encryption_tests").Exec()
+	if err != nil {
+		t.Fatalf("Error dropping test table: %s", err)
+	}
+	_, err = NewQuery(`
+		create table encryption_tests (
+			id {{text}} NOT NULL,
+			secret {{blob}}
+		)
+	`).Exec()
+	if err != nil {
+		t.Fatalf("Error creating test table: %s", err)
+	}
+	defer NewQuery("drop table encryption_tests").Exec()
+
+	insert := NewQuery(`insert into encryption_tests (id, secret) values ({{arg "id"}}, {{arg "secret"}})`)
+	get := NewQuery(`select secret from encryption_tests where id = {{arg "id"}}`)
+	raw := func(t *testing.T, id string) []byte {
+		var value []byte
+		err := get.QueryRow(sql.Named("id", id)).Scan(&value)
+		if err != nil {
+			t.Fatalf("Error getting raw value: %s", err)
+		}
+		return value
+	}
+	scan := func(t *testing.T, id string) string {
+		var value EncryptedText
+		err := get.QueryRow(sql.Named("id", id)).Scan(&value)
+		if err != nil {
+			t.Fatalf("Error getting encrypted value: %s", err)
+		}
+		return string(value)
+	}
+
+	t.Run("No Key", func(t *testing.T) {
+		err := initEncryption(Config{})
+		if err != nil {
+			t.Fatalf("Error initializing encryption: %s", err)
+		}
+		_, err = insert.Exec(sql.Named("id", "a"), sql.Named("secret", EncryptedText("plain value")))
+		if err != nil {
+			t.Fatalf("Error inserting value: %s", err)
+		}
+		if string(raw(t, "a")) != "ll::plain value" {
+			t.Fatalf("Value was encrypted without a key configured: %s", raw(t, "a"))
+		}
+		if scan(t, "a") != "plain value" {
+			t.Fatalf("Invalid scanned value: %s", scan(t, "a"))
+		}
+		if IsEncrypted(raw(t, "a")) {
+			t.Fatalf("Plain value is reported as encrypted: %s", raw(t, "a"))
+		}
+	})
+
+	t.Run("Plain Text Like Ciphertext", func(t *testing.T) {
+		err := initEncryption(Config{})
+		if err != nil {
+			t.Fatalf("Error initializing encryption: %s", err)
+		}
+		for i, plain := range []string{"ll:one:not really encrypted", "ll::", "ll:", ""} {
+			id := "p" + strconv.Itoa(i)
+			_, err = insert.Exec(sql.Named("id", id), sql.Named("secret", EncryptedText(plain)))
+			if err != nil {
+				t.Fatalf("Error inserting value: %s", err)
+			}
+			if IsEncrypted(raw(t, id)) {
+				t.Fatalf("Plain value %q is reported as encrypted: %q", plain, raw(t, id))
+			}
+			if scan(t, id) != plain {
+				t.Fatalf("Invalid scanned value. Wanted %q got %q", plain, scan(t, id))
+			}
+		}
+	})
+
+	t.Run("No Envelope", func(t *testing.T) {
+		var e EncryptedText
+		err := e.Scan([]byte("written without an envelope"))
+		if err == nil {
+			t.Fatalf("No error scanning a value that wasn't written as EncryptedText")
+		}
+	})
+
+	t.Run("Encrypt", func(t *testing.T) {
+		err := initEncryption(Config{EncryptionKey: testKey("one", 1)})
+		if err != nil {
+			t.Fatalf("Error initializing encryption: %s", err)
+		}
+		_, err = insert.Exec(sql.Named("id", "b"), sql.Named("secret", EncryptedText("secret value")))
+		if err != nil {
+			t.Fatalf("Error inserting value: %s", err)
+		}
+		value := raw(t, "b")
+		if !bytes.HasPrefix(value, []byte("ll:one:")) || !IsEncrypted(value) ||
+			bytes.Contains(value, []byte("secret value")) {
+			t.Fatalf("Value was not encrypted: %q", value)
+		}
+		if scan(t, "b") != "secret value" {
+			t.Fatalf("Invalid decrypted value: %s", scan(t, "b"))
+		}
+		// values written before encryption was enabled are still readable
+		if scan(t, "a") != "plain value" {
+			t.Fatalf("Invalid scanned value: %s", scan(t, "a"))
+		}
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		value := raw(t, "b")
+		value[len(value)-1] ^= 0xff
+		var e EncryptedText
+		err := e.Scan(value)
+		if err == nil {
+			t.Fatalf("No error decrypting tampered value")
+		}
+	})
+
+	t.Run("Unknown Key", func(t *testing.T) {
+		err := initEncryption(Config{EncryptionKey: testKey("two", 2)})
+		if err != nil {
+			t.Fatalf("Error initializing encryption: %s", err)
+		}
+		var value EncryptedText
+		err = get.QueryRow(sql.Named("id", "b")).Scan(&value)
+		if err == nil || !strings.Contains(err.Error(), "one") {
+			t.Fatalf("Expected missing key error, got %v", err)
+		}
+	})
+
+	t.Run("Invalid Keys", func(t *testing.T) {
+		for _, key := range []string{
+			"nokeyid",
+			":" + testKey("", 1),
+			testKey("bad id", 1),
+			"short:" + base64.StdEncoding.EncodeToString([]byte("too short")),
+			"notbase64:!!!!",
+		} {
+			err := initEncryption(Config{EncryptionKey: key})
+			if err == nil {
+				t.Fatalf("No error for invalid key %s", key)
+			}
+		}
+	})
+
+	t.Run("Rotate", func(t *testing.T) {
+		f, err := ioutil.TempFile("", "lexLibrary")
+		if err != nil {
+			t.Fatalf("Error creating key file: %s", err)
+		}
+		defer os.Remove(f.Name())
+
+		_, err = f.WriteString("# active key\n" + testKey("two", 2) + "\n\n" + testKey("one", 1) + "\n")
+		if err != nil {
+			t.Fatalf("Error writing key file: %s", err)
+		}
+		f.Close()
+
+		err = initEncryption(Config{EncryptionKeyFile: f.Name()})
+		if err != nil {
+			t.Fatalf("Error initializing encryption: %s", err)
+		}
+		if scan(t, "b") != "secret value" {
+			t.Fatalf("Invalid decrypted value with old key: %s", scan(t, "b"))
+		}
+
+		RegisterEncryptedColumn("encryption_tests", "id", "secret")
+		for i := 0; i < 5; i++ {
+			_, err = insert.Exec(sql.Named("id", "c"+strconv.Itoa(i)), sql.Named("secret", EncryptedText("new value")))
+			if err != nil {
+				t.Fatalf("Error inserting value: %s", err)
+			}
+		}
+
+		count, err := Reencrypt(2)
+		if err != nil {
+			t.Fatalf("Error re-encrypting: %s", err)
+		}
+		if count != 6 {
+			t.Fatalf("Expected 6 values to be re-encrypted, got %d", count)
+		}
+
+		for _, id := range []string{"a", "b", "c0", "c4", "p0"} {
+			if !bytes.HasPrefix(raw(t, id), []byte("ll:two:")) {
+				t.Fatalf("Value %s was not encrypted with the active key: %q", id, raw(t, id))
+			}
+		}
+
+		// old key is no longer needed
+		err = initEncryption(Config{EncryptionKey: testKey("two", 2)})
+		if err != nil {
+			t.Fatalf("Error initializing encryption: %s", err)
+		}
+		if scan(t, "a") != "plain value" || scan(t, "b") != "secret value" || scan(t, "p0") != "ll:one:not really encrypted" {
+			t.Fatalf("Invalid re-encrypted values: %s, %s, %s", scan(t, "a"), scan(t, "b"), scan(t, "p0"))
+		}
+	})
+}
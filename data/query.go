@@ -5,16 +5,21 @@ package data
 import (
 	"bytes"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
-	"html/template"
+	"runtime"
 	"strconv"
 	"strings"
+	"text/template"
 
 	"github.com/pkg/errors"
 )
 
 var queryBuildQueue []*Query
 
+// tenantArg is the reserved argument name for the tenant a query is scoped to
+const tenantArg = "tenant"
+
 // Query is a templated query that can run across
 // multiple database backends
 type Query struct {
@@ -22,6 +27,8 @@ type Query struct {
 	built     bool
 	args      []string
 	tx        *sql.Tx
+	tenant    string
+	location  string
 }
 
 // NewQuery creates a new query from the template passed in
@@ -30,6 +37,11 @@ func NewQuery(tmpl string) *Query {
 		statement: tmpl,
 	}
 
+	_, file, line, ok := runtime.Caller(1)
+	if ok {
+		q.location = fmt.Sprintf("%s:%d", file, line)
+	}
+
 	if db != nil {
 		q.buildTemplate()
 	} else {
@@ -39,18 +51,33 @@ func NewQuery(tmpl string) *Query {
 	return q
 }
 
+// unscopedTenant is passed in place of the tenant id for queries that use {{tenant}} but were never scoped to a
+// tenant, so they fail when they run instead of reading or writing another tenant's rows
+type unscopedTenant struct {
+	location string
+}
+
+// Value implements the driver.Valuer interface
+func (u unscopedTenant) Value() (driver.Value, error) {
+	return nil, errors.Errorf("The query at %s uses {{tenant}}, but wasn't scoped to a tenant", u.location)
+}
+
 func (q *Query) orderedArgs(args []sql.NamedArg) []interface{} {
 	ordered := make([]interface{}, 0, len(q.args))
 
 	for i := range q.args {
+		if q.args[i] == tenantArg {
+			// tenant is always the one the query is scoped to, and can't be passed in
+			if q.tenant == "" {
+				ordered = append(ordered, orderedArg(sql.Named(tenantArg, unscopedTenant{location: q.location})))
+				continue
+			}
+			ordered = append(ordered, orderedArg(sql.Named(tenantArg, q.tenant)))
+			continue
+		}
 		for j := range args {
 			if args[j].Name == q.args[i] {
-				switch dbType {
-				case postgres, cockroachdb:
-					ordered = append(ordered, args[j])
-				default:
-					ordered = append(ordered, args[j].Value)
-				}
+				ordered = append(ordered, orderedArg(args[j]))
 				break
 			}
 		}
@@ -58,23 +85,58 @@ func (q *Query) orderedArgs(args []sql.NamedArg) []interface{} {
 	return ordered
 }
 
+func orderedArg(arg sql.NamedArg) interface{} {
+	switch dbType {
+	case postgres, cockroachdb:
+		return arg
+	default:
+		return arg.Value
+	}
+}
+
+func (q *Query) addArg(name string) string {
+	q.args = append(q.args, name)
+	switch dbType {
+	case postgres, cockroachdb:
+		return "$" + strconv.Itoa(len(q.args))
+	default:
+		return "?"
+	}
+}
+
 func (q *Query) buildTemplate() {
 	if db == nil {
 		panic("Can't build query templates before the database type is set")
 	}
+
+	err := q.build()
+	if err != nil {
+		panic(fmt.Errorf("Error building query template: %s", err))
+	}
+}
+
+// build compiles the query template for the current database type, returning any
+// errors found in the template instead of panicking
+func (q *Query) build() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
 	funcs := template.FuncMap{
 		"arg": func(name string) string {
 			// Args must be named, and must use sql.Named
 			if name == "" {
 				panic("Arguments must be named in sql statements")
 			}
-			q.args = append(q.args, name)
-			switch dbType {
-			case postgres, cockroachdb:
-				return "$" + strconv.Itoa(len(q.args))
-			default:
-				return "?"
+			if name == tenantArg {
+				panic("The tenant argument name is reserved, use {{tenant}} instead")
 			}
+			return q.addArg(name)
+		},
+		"tenant": func() string {
+			return q.addArg(tenantArg)
 		},
 		"bytes": func() string {
 			switch dbType {
@@ -90,6 +152,43 @@ func (q *Query) buildTemplate() {
 				panic("Unsupported database type")
 			}
 		},
+		"blob": func() string {
+			// mysql's VARBINARY is limited to the size of a row, so blobs of file data and encrypted text need
+			// its largest blob type instead
+			switch dbType {
+			case sqlite:
+				return "BLOB"
+			case postgres:
+				return "BYTEA"
+			case cockroachdb:
+				return "BYTES"
+			case mysql, tidb:
+				return "LONGBLOB"
+			default:
+				panic("Unsupported database type")
+			}
+		},
+		"int64": func() string {
+			switch dbType {
+			case sqlite:
+				return "INTEGER"
+			case postgres, cockroachdb, mysql, tidb:
+				return "BIGINT"
+			default:
+				panic("Unsupported database type")
+			}
+		},
+		"varchar": func(size int) string {
+			if size <= 0 {
+				panic("varchar columns must have a size")
+			}
+			switch dbType {
+			case sqlite, postgres, cockroachdb, mysql, tidb:
+				return "VARCHAR(" + strconv.Itoa(size) + ")"
+			default:
+				panic("Unsupported database type")
+			}
+		},
 		"datetime": func() string {
 			switch dbType {
 			case mysql, tidb, sqlite:
@@ -156,14 +255,21 @@ func (q *Query) buildTemplate() {
 		},
 	}
 
+	// statements are parsed with text/template, as html/template would escape the < and > of comparisons
+	tmpl, err := template.New("").Funcs(funcs).Parse(q.statement)
+	if err != nil {
+		return err
+	}
+
 	buff := bytes.NewBuffer([]byte{})
-	err := template.Must(template.New("").Funcs(funcs).Parse(q.statement)).Execute(buff, nil)
+	err = tmpl.Execute(buff, nil)
 	if err != nil {
-		panic(fmt.Errorf("Error building query template: %s", err))
+		return err
 	}
 
 	q.statement = strings.TrimSpace(buff.String())
 	q.built = true
+	return nil
 }
 
 // Exec executes a templated query without returning any rows
@@ -205,6 +311,8 @@ func (q *Query) copy() *Query {
 		args:      q.args,
 		built:     q.built,
 		tx:        q.tx,
+		tenant:    q.tenant,
+		location:  q.location,
 	}
 }
 
@@ -215,6 +323,15 @@ func (q *Query) Tx(tx *sql.Tx) *Query {
 	return copy
 }
 
+// Tenant returns a new copy of the query that is scoped to the passed in tenant.  Every {{tenant}} in the
+// query template is set to the tenant's id.  Queries using {{tenant}} that aren't scoped to a tenant, or are
+// scoped to an empty tenant id, fail when they run
+func (q *Query) Tenant(tenantID string) *Query {
+	copy := q.copy()
+	copy.tenant = tenantID
+	return copy
+}
+
 // Statement returns the complied query template
 func (q *Query) Statement() string {
 	if !q.built {
@@ -330,9 +447,103 @@ func (q *Query) DebugPrint(args ...sql.NamedArg) {
 	fmt.Println(q.Debug(args...))
 }
 
+// QueryError is an error found when building or preparing a registered query
+type QueryError struct {
+	Location  string
+	Statement string
+	Err       error
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Location, e.Err)
+}
+
+// QueryErrors is the list of all registered queries that failed to build or prepare against
+// the current database
+type QueryErrors []*QueryError
+
+func (e QueryErrors) Error() string {
+	msg := fmt.Sprintf("%d queries failed to build or prepare:", len(e))
+	for i := range e {
+		msg += "\n\t" + e[i].Error()
+	}
+	return msg
+}
+
+// prepareQueries builds all of the queries registered before the database type was set
 func prepareQueries() error {
+	errs := buildQueries()
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// buildQueries builds every registered query that isn't built yet, and returns the ones that failed to build
+func buildQueries() QueryErrors {
+	var errs QueryErrors
 	for i := range queryBuildQueue {
-		queryBuildQueue[i].buildTemplate()
+		if queryBuildQueue[i].built {
+			continue
+		}
+		err := queryBuildQueue[i].build()
+		if err != nil {
+			errs = append(errs, &QueryError{
+				Location:  queryBuildQueue[i].location,
+				Statement: queryBuildQueue[i].statement,
+				Err:       errors.Wrap(err, "Building query template"),
+			})
+		}
+	}
+	return errs
+}
+
+// CheckQueries renders every registered query for the current database type and prepares it against
+// the database, returning a QueryErrors list containing every query that failed.
+// Schema changes (create, alter, drop) are only rendered, as they can't be prepared against a database
+// where they've already been applied.  Queries that fail to build are reported without being prepared
+func CheckQueries() error {
+	errs := buildQueries()
+	for i := range queryBuildQueue {
+		q := queryBuildQueue[i]
+		if !q.built || q.isDDL() {
+			continue
+		}
+		stmt, err := db.Prepare(q.statement)
+		if err != nil {
+			errs = append(errs, &QueryError{
+				Location:  q.location,
+				Statement: q.statement,
+				Err:       errors.Wrap(err, "Preparing query"),
+			})
+			continue
+		}
+		err = stmt.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
 	}
 	return nil
 }
+
+// RegisteredQueries returns the number of queries registered for building and checking
+func RegisteredQueries() int {
+	return len(queryBuildQueue)
+}
+
+func (q *Query) isDDL() bool {
+	fields := strings.Fields(q.statement)
+	if len(fields) == 0 {
+		return false
+	}
+	switch strings.ToLower(fields[0]) {
+	case "create", "alter", "drop":
+		return true
+	default:
+		return false
+	}
+}
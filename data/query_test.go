@@ -0,0 +1,167 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestTenantScope(t *testing.T) {
+	_, err := NewQuery("drop table if exists tenant_tests").Exec()
+	if err != nil {
+		t.Fatalf("Error dropping test table: %s", err)
+	}
+	_, err = NewQuery(`
+		create table tenant_tests (
+			tenant_id {{varchar 32}} NOT NULL,
+			id {{varchar 32}} NOT NULL,
+			value {{text}},
+			PRIMARY KEY(tenant_id, id)
+		)
+	`).Exec()
+	if err != nil {
+		t.Fatalf("Error creating test table: %s", err)
+	}
+	defer NewQuery("drop table tenant_tests").Exec()
+
+	insert := NewQuery(`insert into tenant_tests (tenant_id, id, value) values ({{tenant}}, {{arg "id"}}, {{arg "value"}})`)
+	list := NewQuery(`select id, value from tenant_tests where tenant_id = {{tenant}} order by id`)
+	update := NewQuery(`update tenant_tests set value = {{arg "value"}} where tenant_id = {{tenant}} and id = {{arg "id"}}`)
+
+	values := func(t *testing.T, q *Query, args ...sql.NamedArg) map[string]string {
+		rows, err := q.Query(args...)
+		if err != nil {
+			t.Fatalf("Error querying tenant rows: %s", err)
+		}
+		defer rows.Close()
+		result := make(map[string]string)
+		for rows.Next() {
+			id, value := "", ""
+			err = rows.Scan(&id, &value)
+			if err != nil {
+				t.Fatalf("Error scanning tenant rows: %s", err)
+			}
+			result[id] = value
+		}
+		return result
+	}
+
+	for _, tenant := range []string{"default", "tenanta", "tenantb"} {
+		for _, id := range []string{"1", "2"} {
+			_, err = insert.Tenant(tenant).Exec(sql.Named("id", id), sql.Named("value", tenant+id))
+			if err != nil {
+				t.Fatalf("Error inserting tenant rows: %s", err)
+			}
+		}
+	}
+
+	t.Run("Scoped", func(t *testing.T) {
+		for _, tenant := range []string{"default", "tenanta", "tenantb"} {
+			result := values(t, list.Tenant(tenant))
+			if len(result) != 2 || result["1"] != tenant+"1" || result["2"] != tenant+"2" {
+				t.Fatalf("Tenant %q read another tenant's rows: %v", tenant, result)
+			}
+		}
+	})
+
+	t.Run("Unscoped", func(t *testing.T) {
+		for _, q := range []*Query{list, list.Tenant("")} {
+			rows, err := q.Query()
+			if err == nil {
+				rows.Close()
+				t.Fatalf("Query using {{tenant}} ran without being scoped to a tenant")
+			}
+			if !strings.Contains(err.Error(), "query_test.go") {
+				t.Fatalf("Unscoped query error doesn't report where the query is: %s", err)
+			}
+		}
+
+		_, err := insert.Exec(sql.Named("id", "3"), sql.Named("value", "unscoped"))
+		if err == nil {
+			t.Fatalf("Insert using {{tenant}} ran without being scoped to a tenant")
+		}
+		id := ""
+		err = NewQuery(`select id from tenant_tests where tenant_id = {{tenant}}`).QueryRow().Scan(&id)
+		if err == nil || err == sql.ErrNoRows {
+			t.Fatalf("Single row query using {{tenant}} ran without being scoped to a tenant: %v", err)
+		}
+	})
+
+	t.Run("Tenant Argument Ignored", func(t *testing.T) {
+		result := values(t, list.Tenant("tenanta"), sql.Named("tenant", "tenantb"))
+		if result["1"] != "tenanta1" {
+			t.Fatalf("Passed in tenant argument overrode the query's tenant: %v", result)
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		err := BeginTx(func(tx *sql.Tx) error {
+			_, err := update.Tx(tx).Tenant("tenanta").Exec(sql.Named("id", "1"), sql.Named("value", "updated"))
+			return err
+		})
+		if err != nil {
+			t.Fatalf("Error updating tenant row: %s", err)
+		}
+		if values(t, list.Tenant("tenanta"))["1"] != "updated" {
+			t.Fatalf("Tenant row was not updated")
+		}
+		if values(t, list.Tenant("tenantb"))["1"] != "tenantb1" {
+			t.Fatalf("Another tenant's row was updated")
+		}
+	})
+
+	t.Run("Reserved Argument", func(t *testing.T) {
+		q := &Query{statement: `select id from tenant_tests where tenant_id = {{arg "tenant"}}`}
+		if q.build() == nil {
+			t.Fatalf("Query using the reserved tenant argument built without an error")
+		}
+	})
+}
+
+func TestCheckQueries(t *testing.T) {
+	err := CheckQueries()
+	if err != nil {
+		t.Fatalf("Registered queries failed to check: %s", err)
+	}
+
+	// queries created after the database is opened aren't registered, so the broken queries are registered by hand
+	registered := queryBuildQueue
+	defer func() { queryBuildQueue = registered }()
+
+	_, file, line, _ := runtime.Caller(0)
+	broken := NewQuery(`select missing_column from missing_table where tenant_id = {{tenant}}`)
+	badTemplate := &Query{statement: `select id from tenant_tests where id = {{arg ""}}`, location: "template.go:10"}
+	queryBuildQueue = append(queryBuildQueue[:len(queryBuildQueue):len(queryBuildQueue)], broken, badTemplate)
+
+	err = CheckQueries()
+	if err == nil {
+		t.Fatalf("Checking a broken query didn't fail")
+	}
+	errs, ok := err.(QueryErrors)
+	if !ok {
+		t.Fatalf("Checking queries returned %T instead of QueryErrors: %s", err, err)
+	}
+	if len(errs) != 2 || errs[0].Location != "template.go:10" || errs[1].Statement != broken.Statement() {
+		t.Fatalf("A query that failed to build stopped the rest from being prepared: %s", errs)
+	}
+
+	// once every template builds, the broken statement fails to prepare
+	queryBuildQueue = queryBuildQueue[:len(queryBuildQueue)-1]
+	err = CheckQueries()
+	errs, ok = err.(QueryErrors)
+	if !ok || len(errs) != 1 {
+		t.Fatalf("Checking a query that fails to prepare didn't return one error: %v", err)
+	}
+	expected := fmt.Sprintf("%s:%d", file, line+1)
+	if errs[0].Location != expected {
+		t.Fatalf("Invalid location for the broken query. Wanted %s got %s", expected, errs[0].Location)
+	}
+	if !strings.Contains(errs[0].Error(), filepath.Base(file)) || errs[0].Statement != broken.Statement() {
+		t.Fatalf("The error doesn't report the broken query: %s", errs[0])
+	}
+}
@@ -20,19 +20,29 @@ type schemaVer struct {
 	|----------|-------------------|
 	|nil       | null              |
 	|int       | integer           |
-	|int64     | integer           |
+	|int64     | bigint            |
 	|float64   | float             |
 	|bool      | integer           |
 	|[]byte    | blob              |
 	|string    | text              |
+	|string    | varchar (keys)    |
 	|time.Time | timestamp/datetime|
 	+------------------------------+
 
+	Use the template functions {{int64}}, {{bytes}}, {{text}}, {{varchar <size>}} and {{datetime}} for the column
+	types that differ between databases.  Any string column that is part of a key or index must be a varchar, as
+	some databases can't index text columns.  Use {{blob}} for binary data that can be larger than a row, such as
+	file data and encrypted text
 
 	Keep column and table names in lowercase and separate words with underscores
 	tables should be named for their collections (i.e. plural)
 
 	For best compatibility, only have one statement per version; i.e. no semicolons
+
+	Every table holding library data belongs to a tenant, and must have a tenant_id {{varchar 32}} NOT NULL column
+	as the first column of its primary key.  Every query against those tables must be limited to the current tenant
+	with tenant_id = {{tenant}}.  Only installation wide tables (schema_versions, logs, blobs, tenants) have no
+	tenant_id
 */
 
 var schemaVersions = []schemaVer{
@@ -58,4 +68,524 @@ var schemaVersions = []schemaVer{
 		update:   NewQuery("create index i_occurred on logs (occurred)"),
 		rollback: NewQuery("Drop index i_occurred"),
 	},
+	schemaVer{
+		update: NewQuery(`
+			create table blobs (
+				id {{varchar 64}} NOT NULL PRIMARY KEY,
+				size {{int64}} NOT NULL,
+				refs INTEGER NOT NULL,
+				created {{datetime}} NOT NULL,
+				released {{datetime}}
+			)
+		`),
+		rollback: NewQuery("drop table blobs"),
+	},
+	schemaVer{
+		update: NewQuery(`
+			create table blob_data (
+				id {{varchar 64}} NOT NULL,
+				chunk INTEGER NOT NULL,
+				data {{blob}},
+				PRIMARY KEY(id, chunk)
+			)
+		`),
+		rollback: NewQuery("drop table blob_data"),
+	},
+	schemaVer{
+		update: NewQuery(`
+			create table tenants (
+				id {{varchar 32}} NOT NULL PRIMARY KEY,
+				name {{text}} NOT NULL,
+				host {{varchar 255}},
+				path_prefix {{varchar 64}},
+				created {{datetime}} NOT NULL,
+				updated {{datetime}} NOT NULL
+			)
+		`),
+		rollback: NewQuery("drop table tenants"),
+	},
+	schemaVer{
+		update:   NewQuery("create unique index i_tenants_host on tenants (host)"),
+		rollback: NewQuery("drop index i_tenants_host{{if or mysql tidb}} on tenants{{end}}"),
+	},
+	schemaVer{
+		update:   NewQuery("create unique index i_tenants_path_prefix on tenants (path_prefix)"),
+		rollback: NewQuery("drop index i_tenants_path_prefix{{if or mysql tidb}} on tenants{{end}}"),
+	},
+	schemaVer{
+		update: NewQuery(`
+			create table tenant_settings (
+				tenant_id {{varchar 32}} NOT NULL,
+				setting {{varchar 64}} NOT NULL,
+				value {{text}} NOT NULL,
+				PRIMARY KEY(tenant_id, setting)
+			)
+		`),
+		rollback: NewQuery("drop table tenant_settings"),
+	},
+	schemaVer{
+		update: NewQuery(`
+			create table documents (
+				tenant_id {{varchar 32}} NOT NULL,
+				id {{varchar 32}} NOT NULL,
+				status {{varchar 16}} NOT NULL,
+				latest_revision INTEGER NOT NULL,
+				published_revision INTEGER,
+				version INTEGER NOT NULL,
+				creator {{varchar 32}} NOT NULL,
+				created {{datetime}} NOT NULL,
+				updated {{datetime}} NOT NULL,
+				PRIMARY KEY(tenant_id, id)
+			)
+		`),
+		rollback: NewQuery("drop table documents"),
+	},
+	schemaVer{
+		update: NewQuery(`
+			create table document_revisions (
+				tenant_id {{varchar 32}} NOT NULL,
+				document_id {{varchar 32}} NOT NULL,
+				revision INTEGER NOT NULL,
+				id {{varchar 32}} NOT NULL,
+				title {{text}} NOT NULL,
+				body {{blob}},
+				author {{varchar 32}} NOT NULL,
+				created {{datetime}} NOT NULL,
+				PRIMARY KEY(tenant_id, document_id, revision)
+			)
+		`),
+		rollback: NewQuery("drop table document_revisions"),
+	},
+	schemaVer{
+		update:   NewQuery("create unique index i_document_revisions_id on document_revisions (id)"),
+		rollback: NewQuery("drop index i_document_revisions_id{{if or mysql tidb}} on document_revisions{{end}}"),
+	},
+	schemaVer{
+		update: NewQuery(`
+			create table document_drafts (
+				tenant_id {{varchar 32}} NOT NULL,
+				document_id {{varchar 32}} NOT NULL,
+				author {{varchar 32}} NOT NULL,
+				id {{varchar 32}} NOT NULL,
+				base_revision INTEGER NOT NULL,
+				title {{text}} NOT NULL,
+				body {{blob}},
+				version INTEGER NOT NULL,
+				updated {{datetime}} NOT NULL,
+				PRIMARY KEY(tenant_id, document_id, author)
+			)
+		`),
+		rollback: NewQuery("drop table document_drafts"),
+	},
+	schemaVer{
+		update:   NewQuery("create unique index i_document_drafts_id on document_drafts (id)"),
+		rollback: NewQuery("drop index i_document_drafts_id{{if or mysql tidb}} on document_drafts{{end}}"),
+	},
+	schemaVer{
+		update: NewQuery(`
+			create table users (
+				tenant_id {{varchar 32}} NOT NULL,
+				id {{varchar 32}} NOT NULL,
+				username {{varchar 64}} NOT NULL,
+				username_key {{varchar 64}} NOT NULL,
+				name {{text}},
+				email {{varchar 255}},
+				email_key {{varchar 255}},
+				password {{varchar 128}} NOT NULL,
+				disabled INTEGER NOT NULL,
+				locked INTEGER NOT NULL,
+				failed_logins INTEGER NOT NULL,
+				last_failed {{datetime}},
+				last_login {{datetime}},
+				version INTEGER NOT NULL,
+				created {{datetime}} NOT NULL,
+				updated {{datetime}} NOT NULL,
+				PRIMARY KEY(tenant_id, id)
+			)
+		`),
+		rollback: NewQuery("drop table users"),
+	},
+	schemaVer{
+		update:   NewQuery("create unique index i_users_username on users (tenant_id, username_key)"),
+		rollback: NewQuery("drop index i_users_username{{if or mysql tidb}} on users{{end}}"),
+	},
+	schemaVer{
+		update:   NewQuery("create unique index i_users_email on users (tenant_id, email_key)"),
+		rollback: NewQuery("drop index i_users_email{{if or mysql tidb}} on users{{end}}"),
+	},
+	schemaVer{
+		update: NewQuery(`
+			create table sessions (
+				tenant_id {{varchar 32}} NOT NULL,
+				id {{varchar 32}} NOT NULL,
+				token {{varchar 64}} NOT NULL,
+				user_id {{varchar 32}} NOT NULL,
+				user_agent {{text}},
+				ip_address {{varchar 64}},
+				created {{datetime}} NOT NULL,
+				accessed {{datetime}} NOT NULL,
+				idle_expires {{datetime}} NOT NULL,
+				expires {{datetime}} NOT NULL,
+				PRIMARY KEY(tenant_id, id)
+			)
+		`),
+		rollback: NewQuery("drop table sessions"),
+	},
+	schemaVer{
+		update:   NewQuery("create unique index i_sessions_token on sessions (token)"),
+		rollback: NewQuery("drop index i_sessions_token{{if or mysql tidb}} on sessions{{end}}"),
+	},
+	schemaVer{
+		update:   NewQuery("create index i_sessions_user on sessions (tenant_id, user_id)"),
+		rollback: NewQuery("drop index i_sessions_user{{if or mysql tidb}} on sessions{{end}}"),
+	},
+	schemaVer{
+		update:   NewQuery("alter table users add admin INTEGER NOT NULL DEFAULT 0"),
+		rollback: NewQuery("alter table users drop column admin"),
+	},
+	schemaVer{
+		update: NewQuery(`
+			create table user_groups (
+				tenant_id {{varchar 32}} NOT NULL,
+				id {{varchar 32}} NOT NULL,
+				name {{varchar 255}} NOT NULL,
+				created {{datetime}} NOT NULL,
+				updated {{datetime}} NOT NULL,
+				PRIMARY KEY(tenant_id, id)
+			)
+		`),
+		rollback: NewQuery("drop table user_groups"),
+	},
+	schemaVer{
+		update: NewQuery(`
+			create table group_members (
+				tenant_id {{varchar 32}} NOT NULL,
+				group_id {{varchar 32}} NOT NULL,
+				user_id {{varchar 32}} NOT NULL,
+				PRIMARY KEY(tenant_id, group_id, user_id)
+			)
+		`),
+		rollback: NewQuery("drop table group_members"),
+	},
+	schemaVer{
+		update:   NewQuery("create index i_group_members_user on group_members (tenant_id, user_id)"),
+		rollback: NewQuery("drop index i_group_members_user{{if or mysql tidb}} on group_members{{end}}"),
+	},
+	schemaVer{
+		update: NewQuery(`
+			create table collections (
+				tenant_id {{varchar 32}} NOT NULL,
+				id {{varchar 32}} NOT NULL,
+				name {{varchar 255}} NOT NULL,
+				creator {{varchar 32}} NOT NULL,
+				created {{datetime}} NOT NULL,
+				updated {{datetime}} NOT NULL,
+				PRIMARY KEY(tenant_id, id)
+			)
+		`),
+		rollback: NewQuery("drop table collections"),
+	},
+	schemaVer{
+		update:   NewQuery("alter table documents add collection_id {{varchar 32}}"),
+		rollback: NewQuery("alter table documents drop column collection_id"),
+	},
+	schemaVer{
+		update:   NewQuery("create index i_documents_collection on documents (tenant_id, collection_id)"),
+		rollback: NewQuery("drop index i_documents_collection{{if or mysql tidb}} on documents{{end}}"),
+	},
+	schemaVer{
+		update: NewQuery(`
+			create table acl (
+				tenant_id {{varchar 32}} NOT NULL,
+				resource_type {{varchar 16}} NOT NULL,
+				resource_id {{varchar 32}} NOT NULL,
+				principal_type {{varchar 16}} NOT NULL,
+				principal_id {{varchar 32}} NOT NULL,
+				denied INTEGER NOT NULL,
+				permission INTEGER NOT NULL,
+				PRIMARY KEY(tenant_id, resource_type, resource_id, principal_type, principal_id, denied)
+			)
+		`),
+		rollback: NewQuery("drop table acl"),
+	},
+	schemaVer{
+		update:   NewQuery("create index i_acl_principal on acl (tenant_id, principal_type, principal_id)"),
+		rollback: NewQuery("drop index i_acl_principal{{if or mysql tidb}} on acl{{end}}"),
+	},
+	schemaVer{
+		update:   NewQuery("alter table documents add tagged_revision INTEGER NOT NULL DEFAULT 0"),
+		rollback: NewQuery("alter table documents drop column tagged_revision"),
+	},
+	schemaVer{
+		update: NewQuery(`
+			create table document_terms (
+				tenant_id {{varchar 32}} NOT NULL,
+				document_id {{varchar 32}} NOT NULL,
+				term {{varchar 64}} NOT NULL,
+				frequency INTEGER NOT NULL,
+				PRIMARY KEY(tenant_id, document_id, term)
+			)
+		`),
+		rollback: NewQuery("drop table document_terms"),
+	},
+	schemaVer{
+		update:   NewQuery("create index i_document_terms_term on document_terms (tenant_id, term)"),
+		rollback: NewQuery("drop index i_document_terms_term{{if or mysql tidb}} on document_terms{{end}}"),
+	},
+	schemaVer{
+		update: NewQuery(`
+			create table document_tags (
+				tenant_id {{varchar 32}} NOT NULL,
+				document_id {{varchar 32}} NOT NULL,
+				tag {{varchar 64}} NOT NULL,
+				automatic INTEGER NOT NULL,
+				rejected INTEGER NOT NULL,
+				created {{datetime}} NOT NULL,
+				PRIMARY KEY(tenant_id, document_id, tag)
+			)
+		`),
+		rollback: NewQuery("drop table document_tags"),
+	},
+	schemaVer{
+		update:   NewQuery("create index i_document_tags_tag on document_tags (tenant_id, tag)"),
+		rollback: NewQuery("drop index i_document_tags_tag{{if or mysql tidb}} on document_tags{{end}}"),
+	},
+	schemaVer{
+		update:   NewQuery("alter table document_revisions add summary {{blob}}"),
+		rollback: NewQuery("alter table document_revisions drop column summary"),
+	},
+	schemaVer{
+		update:   NewQuery("alter table document_revisions add summary_manual INTEGER NOT NULL DEFAULT 0"),
+		rollback: NewQuery("alter table document_revisions drop column summary_manual"),
+	},
+	schemaVer{
+		update: NewQuery(`
+			create table tags (
+				tenant_id {{varchar 32}} NOT NULL,
+				id {{varchar 32}} NOT NULL,
+				name {{varchar 64}} NOT NULL,
+				parent_id {{varchar 32}},
+				path {{text}} NOT NULL,
+				created {{datetime}} NOT NULL,
+				updated {{datetime}} NOT NULL,
+				PRIMARY KEY(tenant_id, id)
+			)
+		`),
+		rollback: NewQuery("drop table tags"),
+	},
+	schemaVer{
+		update:   NewQuery("create unique index i_tags_name on tags (tenant_id, name)"),
+		rollback: NewQuery("drop index i_tags_name{{if or mysql tidb}} on tags{{end}}"),
+	},
+	schemaVer{
+		update: NewQuery(`
+			create table tag_synonyms (
+				tenant_id {{varchar 32}} NOT NULL,
+				synonym {{varchar 64}} NOT NULL,
+				tag_id {{varchar 32}} NOT NULL,
+				PRIMARY KEY(tenant_id, synonym)
+			)
+		`),
+		rollback: NewQuery("drop table tag_synonyms"),
+	},
+	schemaVer{
+		update:   NewQuery("create index i_tag_synonyms_tag on tag_synonyms (tenant_id, tag_id)"),
+		rollback: NewQuery("drop index i_tag_synonyms_tag{{if or mysql tidb}} on tag_synonyms{{end}}"),
+	},
+	schemaVer{
+		update: NewQuery(`
+			create table attachments (
+				tenant_id {{varchar 32}} NOT NULL,
+				document_id {{varchar 32}} NOT NULL,
+				id {{varchar 32}} NOT NULL,
+				name {{varchar 255}} NOT NULL,
+				content_type {{varchar 255}} NOT NULL,
+				blob_id {{varchar 64}} NOT NULL,
+				size {{int64}} NOT NULL,
+				creator {{varchar 32}} NOT NULL,
+				created {{datetime}} NOT NULL,
+				PRIMARY KEY(tenant_id, document_id, id)
+			)
+		`),
+		rollback: NewQuery("drop table attachments"),
+	},
+	schemaVer{
+		update: NewQuery(`
+			create table crawls (
+				tenant_id {{varchar 32}} NOT NULL,
+				id {{varchar 32}} NOT NULL,
+				seed_url {{text}} NOT NULL,
+				scope {{text}} NOT NULL,
+				collection_id {{varchar 32}},
+				status {{varchar 16}} NOT NULL,
+				delay INTEGER NOT NULL,
+				message {{text}},
+				creator {{varchar 32}} NOT NULL,
+				created {{datetime}} NOT NULL,
+				updated {{datetime}} NOT NULL,
+				PRIMARY KEY(tenant_id, id)
+			)
+		`),
+		rollback: NewQuery("drop table crawls"),
+	},
+	schemaVer{
+		update:   NewQuery("create index i_crawls_status on crawls (tenant_id, status)"),
+		rollback: NewQuery("drop index i_crawls_status{{if or mysql tidb}} on crawls{{end}}"),
+	},
+	schemaVer{
+		update: NewQuery(`
+			create table crawl_pages (
+				tenant_id {{varchar 32}} NOT NULL,
+				crawl_id {{varchar 32}} NOT NULL,
+				url_key {{varchar 64}} NOT NULL,
+				id {{varchar 32}} NOT NULL,
+				url {{text}} NOT NULL,
+				sequence INTEGER NOT NULL,
+				status {{varchar 16}} NOT NULL,
+				document_id {{varchar 32}} NOT NULL,
+				content_hash {{varchar 64}},
+				duplicate_of {{varchar 64}},
+				title {{text}},
+				summary {{blob}},
+				body {{blob}},
+				message {{text}},
+				updated {{datetime}} NOT NULL,
+				PRIMARY KEY(tenant_id, crawl_id, url_key)
+			)
+		`),
+		rollback: NewQuery("drop table crawl_pages"),
+	},
+	schemaVer{
+		update:   NewQuery("create unique index i_crawl_pages_id on crawl_pages (id)"),
+		rollback: NewQuery("drop index i_crawl_pages_id{{if or mysql tidb}} on crawl_pages{{end}}"),
+	},
+	schemaVer{
+		update:   NewQuery("create index i_crawl_pages_sequence on crawl_pages (tenant_id, crawl_id, status, sequence)"),
+		rollback: NewQuery("drop index i_crawl_pages_sequence{{if or mysql tidb}} on crawl_pages{{end}}"),
+	},
+	schemaVer{
+		update:   NewQuery("create index i_crawl_pages_hash on crawl_pages (tenant_id, crawl_id, content_hash)"),
+		rollback: NewQuery("drop index i_crawl_pages_hash{{if or mysql tidb}} on crawl_pages{{end}}"),
+	},
+	schemaVer{
+		update:   NewQuery("alter table collections add parent_id {{varchar 32}}"),
+		rollback: NewQuery("alter table collections drop column parent_id"),
+	},
+	schemaVer{
+		update:   NewQuery("create index i_collections_parent on collections (tenant_id, parent_id)"),
+		rollback: NewQuery("drop index i_collections_parent{{if or mysql tidb}} on collections{{end}}"),
+	},
+	schemaVer{
+		update: NewQuery(`
+			create table git_syncs (
+				tenant_id {{varchar 32}} NOT NULL,
+				id {{varchar 32}} NOT NULL,
+				repository {{text}} NOT NULL,
+				ref {{text}} NOT NULL,
+				paths {{text}} NOT NULL,
+				collection_id {{varchar 32}},
+				last_commit {{varchar 64}},
+				creator {{varchar 32}} NOT NULL,
+				created {{datetime}} NOT NULL,
+				updated {{datetime}} NOT NULL,
+				PRIMARY KEY(tenant_id, id)
+			)
+		`),
+		rollback: NewQuery("drop table git_syncs"),
+	},
+	schemaVer{
+		update: NewQuery(`
+			create table git_sync_files (
+				tenant_id {{varchar 32}} NOT NULL,
+				sync_id {{varchar 32}} NOT NULL,
+				path_key {{varchar 64}} NOT NULL,
+				path {{text}} NOT NULL,
+				document_id {{varchar 32}} NOT NULL,
+				blob_hash {{varchar 64}},
+				last_commit {{varchar 64}} NOT NULL,
+				updated {{datetime}} NOT NULL,
+				PRIMARY KEY(tenant_id, sync_id, path_key)
+			)
+		`),
+		rollback: NewQuery("drop table git_sync_files"),
+	},
+	schemaVer{
+		update: NewQuery(`
+			create table import_batches (
+				tenant_id {{varchar 32}} NOT NULL,
+				id {{varchar 32}} NOT NULL,
+				name {{text}} NOT NULL,
+				collection_id {{varchar 32}},
+				status {{varchar 16}} NOT NULL,
+				message {{text}},
+				creator {{varchar 32}} NOT NULL,
+				created {{datetime}} NOT NULL,
+				updated {{datetime}} NOT NULL,
+				PRIMARY KEY(tenant_id, id)
+			)
+		`),
+		rollback: NewQuery("drop table import_batches"),
+	},
+	schemaVer{
+		update:   NewQuery("create index i_import_batches_status on import_batches (tenant_id, status)"),
+		rollback: NewQuery("drop index i_import_batches_status{{if or mysql tidb}} on import_batches{{end}}"),
+	},
+	schemaVer{
+		update: NewQuery(`
+			create table import_batch_files (
+				tenant_id {{varchar 32}} NOT NULL,
+				batch_id {{varchar 32}} NOT NULL,
+				path_key {{varchar 64}} NOT NULL,
+				path {{text}} NOT NULL,
+				sequence INTEGER NOT NULL,
+				format {{varchar 32}},
+				blob_id {{varchar 64}},
+				status {{varchar 16}} NOT NULL,
+				document_id {{varchar 32}},
+				warnings {{text}},
+				message {{text}},
+				updated {{datetime}} NOT NULL,
+				PRIMARY KEY(tenant_id, batch_id, path_key)
+			)
+		`),
+		rollback: NewQuery("drop table import_batch_files"),
+	},
+	schemaVer{
+		update: NewQuery(`
+			create index i_import_batch_files_sequence on import_batch_files (tenant_id, batch_id, status, sequence)
+		`),
+		rollback: NewQuery("drop index i_import_batch_files_sequence{{if or mysql tidb}} on import_batch_files{{end}}"),
+	},
+	schemaVer{
+		update: NewQuery(`
+			create table import_batch_folders (
+				tenant_id {{varchar 32}} NOT NULL,
+				batch_id {{varchar 32}} NOT NULL,
+				path_key {{varchar 64}} NOT NULL,
+				path {{text}} NOT NULL,
+				collection_id {{varchar 32}} NOT NULL,
+				PRIMARY KEY(tenant_id, batch_id, path_key)
+			)
+		`),
+		rollback: NewQuery("drop table import_batch_folders"),
+	},
+	schemaVer{
+		// set to the tenant id for the first user of each tenant, so only one user can become its administrator
+		update:   NewQuery("alter table users add first_of_tenant {{varchar 32}}"),
+		rollback: NewQuery("alter table users drop column first_of_tenant"),
+	},
+	schemaVer{
+		update:   NewQuery("create unique index i_users_first_of_tenant on users (first_of_tenant)"),
+		rollback: NewQuery("drop index i_users_first_of_tenant{{if or mysql tidb}} on users{{end}}"),
+	},
+	schemaVer{
+		// the directory or zip file on the server a batch import copies its files from
+		update:   NewQuery("alter table import_batches add source_path {{text}}"),
+		rollback: NewQuery("alter table import_batches drop column source_path"),
+	},
+	schemaVer{
+		// any other zip file a batch import copies its files from, kept in the blob store until they're copied
+		update:   NewQuery("alter table import_batches add source_blob_id {{varchar 64}}"),
+		rollback: NewQuery("alter table import_batches drop column source_blob_id"),
+	},
 }
@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/signal"
 
+	"github.com/lexLibrary/lexLibrary/app"
 	"github.com/lexLibrary/lexLibrary/data"
 	"github.com/lexLibrary/lexLibrary/web"
 	"github.com/spf13/viper"
@@ -16,9 +17,21 @@ import (
 const defaultConfigFile = "./config.yaml"
 
 var flagConfigFile string
+var flagCheckQueries bool
+var flagReencrypt bool
+var flagExportSite string
+var flagExportUser string
+var flagExportCollection string
 
 func init() {
 	flag.StringVar(&flagConfigFile, "config", defaultConfigFile, "Sets the path to the configuration file. Either a .YAML, .JSON, or .TOML file")
+	flag.BoolVar(&flagCheckQueries, "checkqueries", false, "Checks that every query builds and prepares against the configured database, then exits")
+	flag.BoolVar(&flagReencrypt, "reencrypt", false, "Re-encrypts all encrypted data with the active encryption key, then exits. "+
+		"Runs in small batches, so it's safe to run while Lex Library is in use")
+	flag.StringVar(&flagExportSite, "exportsite", "", "Exports the library as a static web site to the directory, then exits. "+
+		"Only the published documents the -exportuser can read are exported")
+	flag.StringVar(&flagExportUser, "exportuser", "", "The username of the user in the default tenant that documents are exported as")
+	flag.StringVar(&flagExportCollection, "exportcollection", "", "The id of the collection to export, instead of the whole library")
 
 	go func() {
 		//Capture program shutdown, to make sure everything shuts down nicely
@@ -81,8 +94,53 @@ func main() {
 
 	log.Println("Data layer initialized")
 
+	if flagCheckQueries {
+		log.Printf("All %d queries built and prepared successfully", data.RegisteredQueries())
+		return
+	}
+
+	if flagReencrypt {
+		log.Println("Re-encrypting data with the active encryption key")
+		count, err := data.Reencrypt(0)
+		if err != nil {
+			log.Fatalf("Error re-encrypting data after %d values: %s", count, err)
+		}
+		log.Printf("Re-encrypted %d values", count)
+		return
+	}
+
+	if flagExportSite != "" {
+		log.Printf("Exporting a static site to %s", flagExportSite)
+		count, err := exportSite()
+		if err != nil {
+			log.Fatalf("Error exporting static site: %s", err)
+		}
+		log.Printf("Exported %d documents", count)
+		return
+	}
+
 	err = web.StartServer(cfg.Web)
 	if err != nil {
 		log.Fatalf("Error initializing web server: %s", err)
 	}
 }
+
+// exportSite writes the static site export requested by the export flags
+func exportSite() (int, error) {
+	tenant, err := app.DefaultTenant()
+	if err != nil {
+		return 0, err
+	}
+	user, err := app.UserFromUsername(tenant, flagExportUser)
+	if err != nil {
+		return 0, err
+	}
+	var collection *app.Collection
+	if flagExportCollection != "" {
+		collection, err = app.CollectionGet(user, flagExportCollection)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return app.ExportSite(user, collection, app.ExportDir(flagExportSite))
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package web
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/lexLibrary/lexLibrary/app"
+)
+
+type errorResponse struct {
+	Message string `json:"message"`
+}
+
+// errHandled writes the appropriate response for the error and returns true if there was an error.  Failures are
+// returned to the client with their message, anything else is logged and returned as a generic server error
+func errHandled(err error, w http.ResponseWriter, r *http.Request) bool {
+	if err == nil {
+		return false
+	}
+
+	fail, ok := err.(*app.Fail)
+	if !ok {
+		app.LogError(err)
+		respond(w, r, http.StatusInternalServerError,
+			errorResponse{Message: "An internal server error has occurred"})
+		return true
+	}
+
+	status := http.StatusBadRequest
+	switch fail.Type {
+	case app.FailNotFound:
+		status = http.StatusNotFound
+	case app.FailUnauthorized:
+		status = http.StatusUnauthorized
+	case app.FailForbidden:
+		status = http.StatusForbidden
+	case app.FailConflict:
+		status = http.StatusConflict
+	}
+
+	respond(w, r, status, errorResponse{Message: fail.Message})
+	return true
+}
+
+// respond writes the data to the client as JSON
+func respond(w http.ResponseWriter, r *http.Request, status int, data interface{}) {
+	standardHeaders(w)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	gz := responseWriter(w, r)
+	defer func() {
+		err := gz.Close()
+		if err != nil {
+			app.LogError(err)
+		}
+	}()
+
+	w.WriteHeader(status)
+	if data == nil {
+		return
+	}
+
+	err := json.NewEncoder(gz).Encode(data)
+	if err != nil {
+		app.LogError(err)
+	}
+}
+
+// parseInput decodes the JSON request body into the passed in value
+func parseInput(r *http.Request, result interface{}) error {
+	err := json.NewDecoder(io.LimitReader(r.Body, maxUploadMemory)).Decode(result)
+	if err != nil {
+		return app.NewFailure("Invalid request: " + err.Error())
+	}
+	return nil
+}
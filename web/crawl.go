@@ -0,0 +1,26 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package web
+
+import (
+	"log"
+	"time"
+
+	"github.com/lexLibrary/lexLibrary/app"
+)
+
+const defaultCrawlInterval = 10 * time.Second
+
+// crawlSites fetches and imports the next pages of running web site crawls on every interval
+func crawlSites(interval time.Duration) {
+	every(interval, func() error {
+		count, err := app.CrawlPending()
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			log.Printf("Crawled %d pages", count)
+		}
+		return nil
+	})
+}
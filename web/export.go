@@ -0,0 +1,96 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package web
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/lexLibrary/lexLibrary/app"
+)
+
+func exportRoutes(router *httprouter.Router) {
+	router.GET("/export/site", exportSiteGet)
+	router.GET("/export/markdown", exportMarkdownGet)
+	router.GET("/export/epub", exportEPUBGet)
+}
+
+// exportSiteGet returns a zip archive of the static site export of the library, or of the collection in the
+// collection query parameter
+func exportSiteGet(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	exportZip(w, r, "site.zip", app.ExportSite)
+}
+
+// exportMarkdownGet returns a zip archive of the Markdown export of the library, or of the collection in the
+// collection query parameter
+func exportMarkdownGet(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	exportZip(w, r, "markdown.zip", app.ExportMarkdown)
+}
+
+// exportEPUBGet returns the EPUB book of the library, or of the collection in the collection query parameter
+func exportEPUBGet(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	export(w, r, "library.epub", "application/epub+zip",
+		func(user *app.User, collection *app.Collection, w io.Writer) error {
+			_, err := app.ExportEPUB(user, collection, w)
+			return err
+		})
+}
+
+// exportZip writes an export of the requested collection to the response as a zip archive
+func exportZip(w http.ResponseWriter, r *http.Request, filename string,
+	fn func(*app.User, *app.Collection, app.ExportTarget) (int, error)) {
+	export(w, r, filename, "application/zip", func(user *app.User, collection *app.Collection, w io.Writer) error {
+		z := app.NewExportZip(w)
+		_, err := fn(user, collection, z)
+		if err != nil {
+			return err
+		}
+		return z.Close()
+	})
+}
+
+// export writes an export of the library, or of the collection in the collection query parameter, to the response
+// as a file download
+func export(w http.ResponseWriter, r *http.Request, filename, contentType string,
+	fn func(user *app.User, collection *app.Collection, w io.Writer) error) {
+	_, user, err := requestUser(r)
+	if errHandled(err, w, r) {
+		return
+	}
+
+	var collection *app.Collection
+	if id := r.URL.Query().Get("collection"); id != "" {
+		collection, err = app.CollectionGet(user, id)
+		if errHandled(err, w, r) {
+			return
+		}
+	}
+
+	standardHeaders(w)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	ew := &exportWriter{ResponseWriter: w}
+	err = fn(user, collection, ew)
+	if err != nil {
+		if !ew.written {
+			w.Header().Del("Content-Disposition")
+			errHandled(err, w, r)
+			return
+		}
+		// the file has already started, so the client gets a truncated file
+		app.LogError(err)
+	}
+}
+
+// exportWriter tracks whether an export has started writing its response
+type exportWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (e *exportWriter) Write(p []byte) (int, error) {
+	e.written = true
+	return e.ResponseWriter.Write(p)
+}
@@ -0,0 +1,26 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package web
+
+import (
+	"log"
+	"time"
+
+	"github.com/lexLibrary/lexLibrary/app"
+)
+
+const defaultImportInterval = 10 * time.Second
+
+// importBatches imports the next files of running batch imports on every interval
+func importBatches(interval time.Duration) {
+	every(interval, func() error {
+		count, err := app.ImportBatchPending()
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			log.Printf("Imported %d files", count)
+		}
+		return nil
+	})
+}
@@ -8,7 +8,7 @@ import (
 	"github.com/julienschmidt/httprouter"
 )
 
-func setupRoutes() http.Handler {
+func setupRoutes(tenantRouting string) http.Handler {
 	rootHandler := &httprouter.Router{
 		RedirectTrailingSlash:  true,
 		RedirectFixedPath:      true,
@@ -19,5 +19,12 @@ func setupRoutes() http.Handler {
 		// PanicHandler:           panicHandler,
 	}
 
-	return rootHandler
+	sessionRoutes(rootHandler)
+	exportRoutes(rootHandler)
+	searchRoutes(rootHandler)
+
+	return &tenantRouter{
+		routing: tenantRouting,
+		handler: rootHandler,
+	}
 }
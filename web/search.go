@@ -0,0 +1,96 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/lexLibrary/lexLibrary/app"
+)
+
+type searchResponse struct {
+	Query   string                 `json:"query"`
+	Total   int                    `json:"total"`
+	Results []searchResultResponse `json:"results"`
+	Tags    []searchFacetResponse  `json:"tags"`
+	Authors []searchFacetResponse  `json:"authors"`
+}
+
+type searchResultResponse struct {
+	ID           string    `json:"id"`
+	CollectionID string    `json:"collectionId,omitempty"`
+	Title        string    `json:"title"`
+	Snippet      string    `json:"snippet"`
+	Score        float64   `json:"score"`
+	Updated      time.Time `json:"updated"`
+}
+
+type searchFacetResponse struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func searchRoutes(router *httprouter.Router) {
+	router.GET("/search", searchGet)
+}
+
+// searchGet returns the documents matching the q query parameter, sorted by the sort parameter, and paged by the
+// offset and limit parameters
+func searchGet(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	_, user, err := requestUser(r)
+	if errHandled(err, w, r) {
+		return
+	}
+
+	values := r.URL.Query()
+	offset, limit := 0, 0
+	if value := values.Get("offset"); value != "" {
+		offset, err = strconv.Atoi(value)
+		if err != nil {
+			errHandled(app.NewFailure("Invalid offset"), w, r)
+			return
+		}
+	}
+	if value := values.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil {
+			errHandled(app.NewFailure("Invalid limit"), w, r)
+			return
+		}
+	}
+
+	results, err := app.Search(user, values.Get("q"), values.Get("sort"), offset, limit)
+	if errHandled(err, w, r) {
+		return
+	}
+
+	response := searchResponse{
+		Query:   results.Query,
+		Total:   results.Total,
+		Results: make([]searchResultResponse, len(results.Results)),
+		Tags:    newSearchFacetResponses(results.Tags),
+		Authors: newSearchFacetResponses(results.Authors),
+	}
+	for i, result := range results.Results {
+		response.Results[i] = searchResultResponse{
+			ID:           result.Document.ID,
+			CollectionID: result.Document.CollectionID,
+			Title:        result.Title,
+			Snippet:      result.Snippet,
+			Score:        result.Score,
+			Updated:      result.Document.Updated,
+		}
+	}
+	respond(w, r, http.StatusOK, response)
+}
+
+func newSearchFacetResponses(facets []app.SearchFacet) []searchFacetResponse {
+	response := make([]searchFacetResponse, len(facets))
+	for i := range facets {
+		response[i] = searchFacetResponse{Name: facets[i].Name, Count: facets[i].Count}
+	}
+	return response
+}
@@ -0,0 +1,219 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package web
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/lexLibrary/lexLibrary/app"
+)
+
+const (
+	sessionCookieName             = "lexlibrary_session"
+	defaultSessionCleanupInterval = time.Hour
+)
+
+type sessionInput struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type sessionResponse struct {
+	ID        string    `json:"id"`
+	UserAgent string    `json:"userAgent"`
+	IPAddress string    `json:"ipAddress"`
+	Created   time.Time `json:"created"`
+	Accessed  time.Time `json:"accessed"`
+	Expires   time.Time `json:"expires"`
+	Current   bool      `json:"current"`
+}
+
+func sessionRoutes(router *httprouter.Router) {
+	router.POST("/session", sessionPost)
+	router.DELETE("/session", sessionDelete)
+	router.GET("/sessions", sessionsGet)
+	router.DELETE("/sessions", sessionsDelete)
+	router.DELETE("/sessions/:id", sessionsDeleteOne)
+}
+
+// sessionPost logs in a user
+func sessionPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	input := &sessionInput{}
+	if errHandled(parseInput(r, input), w, r) {
+		return
+	}
+
+	tenant := requestTenant(r)
+	user, err := app.UserLogin(tenant, input.Username, input.Password)
+	if errHandled(err, w, r) {
+		return
+	}
+
+	s, err := app.SessionNew(tenant, user, r.UserAgent(), ipAddress(r))
+	if errHandled(err, w, r) {
+		return
+	}
+
+	setSessionCookie(w, r, s.Token, s.Expires)
+	respond(w, r, http.StatusCreated, newSessionResponse(s, s))
+}
+
+// sessionDelete logs out of the current session
+func sessionDelete(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	s, err := requestSession(r)
+	if err == nil {
+		err = s.Logout()
+	} else if app.IsFailType(err, app.FailUnauthorized) {
+		// already logged out
+		err = nil
+	}
+	if errHandled(err, w, r) {
+		return
+	}
+
+	clearSessionCookie(w, r)
+	respond(w, r, http.StatusOK, nil)
+}
+
+// sessionsGet lists the current user's active sessions
+func sessionsGet(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	s, user, err := requestUser(r)
+	if errHandled(err, w, r) {
+		return
+	}
+
+	sessions, err := user.Sessions()
+	if errHandled(err, w, r) {
+		return
+	}
+
+	result := make([]sessionResponse, len(sessions))
+	for i := range sessions {
+		result[i] = newSessionResponse(sessions[i], s)
+	}
+	respond(w, r, http.StatusOK, result)
+}
+
+// sessionsDelete logs the current user out everywhere
+func sessionsDelete(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	_, user, err := requestUser(r)
+	if errHandled(err, w, r) {
+		return
+	}
+
+	if errHandled(user.LogoutEverywhere(), w, r) {
+		return
+	}
+
+	clearSessionCookie(w, r)
+	respond(w, r, http.StatusOK, nil)
+}
+
+// sessionsDeleteOne logs out one of the current user's sessions
+func sessionsDeleteOne(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	s, user, err := requestUser(r)
+	if errHandled(err, w, r) {
+		return
+	}
+
+	if errHandled(user.LogoutSession(p.ByName("id")), w, r) {
+		return
+	}
+
+	if p.ByName("id") == s.ID {
+		clearSessionCookie(w, r)
+	}
+	respond(w, r, http.StatusOK, nil)
+}
+
+func newSessionResponse(s, current *app.Session) sessionResponse {
+	return sessionResponse{
+		ID:        s.ID,
+		UserAgent: s.UserAgent,
+		IPAddress: s.IPAddress,
+		Created:   s.Created,
+		Accessed:  s.Accessed,
+		Expires:   s.Expires,
+		Current:   s.ID == current.ID,
+	}
+}
+
+// requestSession returns the session for the request's session cookie
+func requestSession(r *http.Request) (*app.Session, error) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err == http.ErrNoCookie {
+		return nil, app.Unauthorized("You must log in")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return app.SessionGet(requestTenant(r), cookie.Value)
+}
+
+// requestUser returns the logged in user for the request
+func requestUser(r *http.Request) (*app.Session, *app.User, error) {
+	s, err := requestSession(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := s.User()
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, user, nil
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, token string, expires time.Time) {
+	writeCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     requestBasePath(r),
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   isSSL,
+	})
+}
+
+func clearSessionCookie(w http.ResponseWriter, r *http.Request) {
+	writeCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     requestBasePath(r),
+		Expires:  time.Unix(0, 0),
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   isSSL,
+	})
+}
+
+// writeCookie sets the cookie on the response with SameSite=Lax, which http.Cookie doesn't support
+func writeCookie(w http.ResponseWriter, cookie *http.Cookie) {
+	w.Header().Add("Set-Cookie", cookie.String()+"; SameSite=Lax")
+}
+
+// ipAddress returns the IP address the request came from
+func ipAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// cleanupSessions removes expired sessions on every interval
+func cleanupSessions(interval time.Duration) {
+	every(interval, func() error {
+		count, err := app.SessionCleanup()
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			log.Printf("Removed %d expired sessions", count)
+		}
+		return nil
+	})
+}
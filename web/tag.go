@@ -0,0 +1,26 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package web
+
+import (
+	"log"
+	"time"
+
+	"github.com/lexLibrary/lexLibrary/app"
+)
+
+const defaultTagInterval = time.Minute
+
+// tagDocuments automatically tags newly published documents on every interval
+func tagDocuments(interval time.Duration) {
+	every(interval, func() error {
+		count, err := app.TagPending()
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			log.Printf("Tagged %d documents", count)
+		}
+		return nil
+	})
+}
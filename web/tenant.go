@@ -0,0 +1,90 @@
+// Copyright (c) 2017 Townsourced Inc.
+
+package web
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/lexLibrary/lexLibrary/app"
+)
+
+// Tenant routing types
+const (
+	tenantRoutingNone = ""
+	tenantRoutingHost = "host"
+	tenantRoutingPath = "path"
+)
+
+type contextKey int
+
+const (
+	tenantContextKey contextKey = iota
+	basePathContextKey
+)
+
+// tenantRouter determines which tenant a request belongs to, either by the request's hostname or by the first
+// segment of the request path, and passes the request on with the tenant in its context.
+// When routing by path, the tenant's prefix is removed from the request path.  When tenants are routed, requests
+// that don't match a tenant are not found, and only installations that don't route tenants use the default tenant
+type tenantRouter struct {
+	routing string
+	handler http.Handler
+}
+
+func (t *tenantRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var tenant *app.Tenant
+	var err error
+	basePath := "/"
+
+	switch t.routing {
+	case tenantRoutingHost:
+		tenant, err = app.TenantFromHost(r.Host)
+	case tenantRoutingPath:
+		rest := ""
+		tenant, rest, err = app.TenantFromPath(r.URL.Path)
+		if err == nil {
+			r.URL.Path = rest
+			r.URL.RawPath = ""
+			basePath = "/" + tenant.PathPrefix
+		}
+	default:
+		tenant, err = app.DefaultTenant()
+	}
+
+	if app.IsFailType(err, app.FailNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		app.LogError(err)
+		http.Error(w, "An internal server error has occurred", http.StatusInternalServerError)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), tenantContextKey, tenant)
+	ctx = context.WithValue(ctx, basePathContextKey, basePath)
+	t.handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// requestTenant returns the tenant the request was routed to
+func requestTenant(r *http.Request) *app.Tenant {
+	return r.Context().Value(tenantContextKey).(*app.Tenant)
+}
+
+// requestBasePath returns the path the request's tenant is served under, which is the tenant's path prefix when
+// routing tenants by path, and / otherwise
+func requestBasePath(r *http.Request) string {
+	return r.Context().Value(basePathContextKey).(string)
+}
+
+func validTenantRouting(routing string) string {
+	switch routing {
+	case tenantRoutingNone, tenantRoutingHost, tenantRoutingPath:
+		return routing
+	default:
+		log.Printf("Invalid TenantRouting (%s), tenants will not be routed", routing)
+		return tenantRoutingNone
+	}
+}
@@ -11,6 +11,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/lexLibrary/lexLibrary/app"
 )
 
 type Config struct {
@@ -22,6 +24,15 @@ type Config struct {
 	KeyFile           string
 	MaxUploadMemoryMB int
 	Port              int
+	TenantRouting     string // host, path, or empty if all requests go to the default tenant
+	// how often expired sessions are removed
+	SessionCleanupInterval string
+	// how often newly published documents are automatically tagged
+	TagInterval string
+	// how often the next pages of running web site crawls are imported
+	CrawlInterval string
+	// how often the next files of running batch imports are imported
+	ImportInterval string
 }
 
 // DefaultConfig returns the default configuration for the web layer
@@ -73,10 +84,16 @@ func StartServer(cfg Config) error {
 		}
 	}
 
+	go cleanupSessions(parseInterval("SessionCleanupInterval", cfg.SessionCleanupInterval,
+		defaultSessionCleanupInterval))
+	go tagDocuments(parseInterval("TagInterval", cfg.TagInterval, defaultTagInterval))
+	go crawlSites(parseInterval("CrawlInterval", cfg.CrawlInterval, defaultCrawlInterval))
+	go importBatches(parseInterval("ImportInterval", cfg.ImportInterval, defaultImportInterval))
+
 	tlsCFG := &tls.Config{MinVersion: cfg.MinTLSVersion}
 
 	server := &http.Server{
-		Handler:        setupRoutes(),
+		Handler:        setupRoutes(validTenantRouting(strings.ToLower(cfg.TenantRouting))),
 		ReadTimeout:    readTimeout,
 		WriteTimeout:   writeTimeout,
 		MaxHeaderBytes: cfg.MaxHeaderBytes,
@@ -152,3 +169,30 @@ func responseWriter(w http.ResponseWriter, r *http.Request) *gzipResponse {
 
 	return &gzipResponse{zip: writer, ResponseWriter: w}
 }
+
+// parseInterval parses the duration of a background task's interval, falling back to the default if it's not set
+// or invalid
+func parseInterval(name, value string, def time.Duration) time.Duration {
+	if value == "" {
+		return def
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		log.Printf("Invalid %s duration format (%s), using default", name, value)
+		return def
+	}
+	return interval
+}
+
+// every runs fn on every interval, and logs any error it returns
+func every(interval time.Duration, fn func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := fn()
+		if err != nil {
+			app.LogError(err)
+		}
+	}
+}